@@ -0,0 +1,219 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+)
+
+const (
+	artifactCacheSuffix  = ".mender"
+	artifactCachePartial = ".partial"
+)
+
+// artifactCache keeps the last artifact downloaded, so that a failed install
+// can be retried, and nearby devices can fetch the artifact, without
+// downloading it again. A nil cache keeps nothing.
+type artifactCache struct {
+	dir string
+	// Free space, in bytes, left on the file system of dir once the
+	// artifact is kept.
+	minFree int64
+}
+
+func newArtifactCache(config *menderConfig) *artifactCache {
+	if config.ArtifactCacheDir == "" {
+		return nil
+	}
+	return &artifactCache{
+		dir:     config.ArtifactCacheDir,
+		minFree: int64(config.ArtifactCacheMinFreeMiB) * 1024 * 1024,
+	}
+}
+
+func (c *artifactCache) path(artifactName string) string {
+	return filepath.Join(c.dir, url.PathEscape(artifactName)+artifactCacheSuffix)
+}
+
+// open returns the cached artifact with the given name and its size, or nil
+// if it is not cached.
+func (c *artifactCache) open(artifactName string) (io.ReadCloser, int64) {
+	if c == nil {
+		return nil, 0
+	}
+	f, err := os.Open(c.path(artifactName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Failed to open the cached Artifact %s: %v", artifactName, err)
+		}
+		return nil, 0
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		log.Warnf("Failed to open the cached Artifact %s: %v", artifactName, err)
+		return nil, 0
+	}
+	return f, info.Size()
+}
+
+// remove removes the artifact with the given name from the cache.
+func (c *artifactCache) remove(artifactName string) {
+	if c == nil {
+		return
+	}
+	if err := os.Remove(c.path(artifactName)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove the cached Artifact %s: %v", artifactName, err)
+	}
+}
+
+// tee returns a reader of the artifact being downloaded which keeps it in the
+// cache once it has been read completely. The artifact is not kept if its
+// size is unknown, or if there is not space enough for it.
+func (c *artifactCache) tee(in io.ReadCloser, size int64, artifactName string) io.ReadCloser {
+	if c == nil || size <= 0 {
+		return in
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		log.Warnf("Failed to create the Artifact cache %s: %v", c.dir, err)
+		return in
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(c.dir, &fs); err != nil {
+		log.Warnf("Failed to read the free space of the Artifact cache %s: %v", c.dir, err)
+		return in
+	}
+	// Any artifact already cached is replaced by this one.
+	free := int64(fs.Bavail)*int64(fs.Bsize) + c.cachedSize()
+	if free-size < c.minFree {
+		log.Infof("Not caching the Artifact %s (%d bytes), as only %d bytes "+
+			"are free in %s", artifactName, size, free, c.dir)
+		return in
+	}
+	f, err := os.OpenFile(c.path(artifactName)+artifactCachePartial,
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Warnf("Failed to cache the Artifact %s: %v", artifactName, err)
+		return in
+	}
+	return &cachingReader{
+		ReadCloser: in,
+		cache:      c,
+		name:       artifactName,
+		size:       size,
+		file:       f,
+	}
+}
+
+// cachedSize returns the size of the files in the cache.
+func (c *artifactCache) cachedSize() int64 {
+	var size int64
+	files, _ := ioutil.ReadDir(c.dir)
+	for _, file := range files {
+		size += file.Size()
+	}
+	return size
+}
+
+// keep makes the complete artifact in the partial file the cached one,
+// removing the other files in the cache.
+func (c *artifactCache) keep(artifactName string) error {
+	cached := c.path(artifactName)
+	files, _ := ioutil.ReadDir(c.dir)
+	for _, file := range files {
+		path := filepath.Join(c.dir, file.Name())
+		if path != cached+artifactCachePartial &&
+			(strings.HasSuffix(path, artifactCacheSuffix) ||
+				strings.HasSuffix(path, artifactCachePartial)) {
+			os.Remove(path)
+		}
+	}
+	return os.Rename(cached+artifactCachePartial, cached)
+}
+
+// cachingReader writes what is read from the artifact to the partial file of
+// the cache.
+type cachingReader struct {
+	io.ReadCloser
+	cache *artifactCache
+	name  string
+	size  int64
+
+	// The stream may be closed by another goroutine, to abort the
+	// deployment, while it is read.
+	lock    sync.Mutex
+	file    *os.File
+	written int64
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if n == 0 || r.file == nil {
+		return n, err
+	}
+	if _, werr := r.file.Write(p[:n]); werr != nil {
+		log.Warnf("Failed to cache the Artifact %s: %v", r.name, werr)
+		r.discard()
+		return n, err
+	}
+	r.written += int64(n)
+	if r.written > r.size {
+		log.Warnf("Not caching the Artifact %s, as it is larger than the "+
+			"%d bytes announced", r.name, r.size)
+		r.discard()
+	} else if r.written == r.size {
+		werr := r.file.Sync()
+		if cerr := r.file.Close(); werr == nil {
+			werr = cerr
+		}
+		r.file = nil
+		if werr == nil {
+			werr = r.cache.keep(r.name)
+		}
+		if werr != nil {
+			log.Warnf("Failed to cache the Artifact %s: %v", r.name, werr)
+			os.Remove(r.cache.path(r.name) + artifactCachePartial)
+		} else {
+			log.Infof("Cached the Artifact %s in %s", r.name, r.cache.dir)
+		}
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	r.lock.Lock()
+	if r.file != nil {
+		r.discard()
+	}
+	r.lock.Unlock()
+	return r.ReadCloser.Close()
+}
+
+// discard removes the partial file, which is not complete.
+func (r *cachingReader) discard() {
+	r.file.Close()
+	r.file = nil
+	os.Remove(r.cache.path(r.name) + artifactCachePartial)
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactCache(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artifact-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	var nilCache *artifactCache
+	in, _ := nilCache.open("release-1")
+	assert.Nil(t, in)
+	stream := ioutil.NopCloser(bytes.NewBufferString("data"))
+	assert.Equal(t, stream, nilCache.tee(stream, 4, "release-1"))
+
+	cache := newArtifactCache(&menderConfig{
+		menderConfigFromFile: menderConfigFromFile{
+			ArtifactCacheDir: path.Join(tmp, "cache"),
+		},
+	})
+	download := func(name, data string, size int64, read int) {
+		in := cache.tee(ioutil.NopCloser(bytes.NewBufferString(data)), size, name)
+		buf := make([]byte, read)
+		_, err := io.ReadFull(in, buf)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+	}
+	cached := func(name string) string {
+		in, size := cache.open(name)
+		if in == nil {
+			return ""
+		}
+		defer in.Close()
+		data, err := ioutil.ReadAll(in)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), size)
+		return string(data)
+	}
+
+	// Downloads which are not complete are not kept.
+	download("release-1", "artifact 1", 10, 5)
+	assert.Equal(t, "", cached("release-1"))
+	// Nor are those of unknown size, or larger than announced.
+	download("release-1", "artifact 1", -1, 10)
+	assert.Equal(t, "", cached("release-1"))
+	download("release-1", "artifact 1", 8, 10)
+	assert.Equal(t, "", cached("release-1"))
+
+	download("release-1", "artifact 1", 10, 10)
+	assert.Equal(t, "artifact 1", cached("release-1"))
+
+	// Only the last artifact is kept.
+	download("release/2", "artifact 2", 10, 10)
+	assert.Equal(t, "artifact 2", cached("release/2"))
+	assert.Equal(t, "", cached("release-1"))
+	files, err := ioutil.ReadDir(cache.dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	cache.remove("release/2")
+	assert.Equal(t, "", cached("release/2"))
+
+	// Artifacts are not kept if there is not space enough for them.
+	cache.minFree = 1 << 62
+	download("release-1", "artifact 1", 10, 10)
+	assert.Equal(t, "", cached("release-1"))
+}
+
+func TestStateUpdateFetchCached(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artifact-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	DeploymentLogger = NewDeploymentLogManager(tmp)
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName: "release-1",
+		},
+	}
+	ctx := StateContext{
+		store:         store.NewMemStore(),
+		artifactCache: &artifactCache{dir: path.Join(tmp, "cache")},
+	}
+	data := "test data"
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+			fetchUpdateReturnSize:       int64(len(data)),
+		},
+	}
+
+	s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+	require.IsType(t, &UpdateStoreState{}, s)
+	in := s.(*UpdateStoreState).imagein
+	_, err = ioutil.ReadAll(in)
+	require.NoError(t, err)
+	in.Close()
+
+	// The artifact is not downloaded again.
+	sc.updater = fakeUpdater{}
+	s, _ = NewUpdateFetchState(update).Handle(&ctx, sc)
+	require.IsType(t, &UpdateStoreState{}, s)
+	assert.Equal(t, int64(len(data)), s.(*UpdateStoreState).size)
+	in = s.(*UpdateStoreState).imagein
+	content, err := ioutil.ReadAll(in)
+	require.NoError(t, err)
+	in.Close()
+	assert.Equal(t, data, string(content))
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+)
+
+// doInspectArtifact prints the header information of a local artifact, without
+// installing it.
+func doInspectArtifact(path string, policy *installer.SignaturePolicy, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "can not open artifact %s", path)
+	}
+	defer f.Close()
+
+	summary, err := installer.InspectArtifact(f, policy)
+	if err != nil {
+		return err
+	}
+	return printArtifactSummary(summary, w)
+}
+
+func printArtifactSummary(summary *installer.ArtifactSummary, w io.Writer) error {
+	fmt.Fprintf(w, "Name: %s\n", summary.Name)
+	fmt.Fprintf(w, "Format version: %d\n", summary.Version)
+	fmt.Fprintf(w, "Compatible devices: %s\n", strings.Join(summary.CompatibleDevices, ", "))
+
+	printArtifactProvides(summary.Provides, w)
+	printArtifactDepends(summary.Depends, w)
+	printArtifactSignature(summary, w)
+
+	for n, payload := range summary.Payloads {
+		if err := printArtifactPayload(n, payload, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printArtifactProvides(provides *artifact.ArtifactProvides, w io.Writer) {
+	if provides == nil {
+		return
+	}
+	fmt.Fprintln(w, "Provides:")
+	fmt.Fprintf(w, "  artifact_name: %s\n", provides.ArtifactName)
+	if provides.ArtifactGroup != "" {
+		fmt.Fprintf(w, "  artifact_group: %s\n", provides.ArtifactGroup)
+	}
+}
+
+// printArtifactDepends prints the dependencies other than the compatible
+// devices, which are printed with the summary.
+func printArtifactDepends(depends *artifact.ArtifactDepends, w io.Writer) {
+	if depends == nil ||
+		(len(depends.ArtifactName) == 0 && len(depends.ArtifactGroup) == 0) {
+		return
+	}
+	fmt.Fprintln(w, "Depends:")
+	if len(depends.ArtifactName) > 0 {
+		fmt.Fprintf(w, "  artifact_name: %s\n",
+			strings.Join(depends.ArtifactName, ", "))
+	}
+	if len(depends.ArtifactGroup) > 0 {
+		fmt.Fprintf(w, "  artifact_group: %s\n",
+			strings.Join(depends.ArtifactGroup, ", "))
+	}
+}
+
+func printArtifactSignature(summary *installer.ArtifactSummary, w io.Writer) {
+	switch {
+	case !summary.Signed:
+		fmt.Fprintln(w, "Signature: none")
+	case !summary.SignatureChecked:
+		fmt.Fprintln(w, "Signature: present, not verified (no verification key configured)")
+	case summary.SignatureError != nil:
+		fmt.Fprintf(w, "Signature: present, INVALID (%s)\n", summary.SignatureError)
+	default:
+		fmt.Fprintln(w, "Signature: present, valid")
+	}
+}
+
+func printArtifactPayload(n int, payload installer.PayloadSummary, w io.Writer) error {
+	fmt.Fprintf(w, "Payload %d:\n", n)
+	fmt.Fprintf(w, "  Type: %s\n", payload.Type)
+	if len(payload.MetaData) > 0 {
+		keys := make([]string, 0, len(payload.MetaData))
+		for key := range payload.MetaData {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(w, "  Meta-data:")
+		for _, key := range keys {
+			value, err := json.Marshal(payload.MetaData[key])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "    %s: %s\n", key, value)
+		}
+	}
+	fmt.Fprintln(w, "  Files:")
+	for _, file := range payload.Files {
+		fmt.Fprintf(w, "    %s (%d bytes)\n", file.Name, file.Size)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/installer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectArtifact(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-inspect-")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	art, err := MakeRootfsImageArtifact(3, true)
+	require.NoError(t, err)
+	artPath := path.Join(td, "artifact.mender")
+	f, err := os.Create(artPath)
+	require.NoError(t, err)
+	_, err = io.Copy(f, art)
+	require.NoError(t, err)
+	f.Close()
+
+	out := bytes.NewBuffer(nil)
+	err = doInspectArtifact(artPath, nil, out)
+	require.NoError(t, err)
+	assert.Regexp(t, `^Name: TestName
+Format version: 3
+Compatible devices: vexpress-qemu
+Provides:
+  artifact_name: TestName
+Signature: present, not verified \(no verification key configured\)
+Payload 0:
+  Type: rootfs-image
+  Files:
+    test_update\w+ \(11 bytes\)
+$`, out.String())
+
+	out.Reset()
+	err = doInspectArtifact(artPath,
+		installer.NewSingleKeyPolicy([]byte(PublicRSAKey)), out)
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "Signature: present, valid\n")
+
+	err = doInspectArtifact(path.Join(td, "missing.mender"), nil, out)
+	assert.Error(t, err)
+}
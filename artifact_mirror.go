@@ -0,0 +1,116 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+)
+
+const (
+	// How long mirrors on the local network are waited for.
+	mirrorTimeout = 10 * time.Second
+	// How long the answers of the mDNS query of mirrors are waited for.
+	mirrorDiscoveryTimeout = 2 * time.Second
+)
+
+// artifactMirrors are local sources of the artifacts, tried before the
+// server. Artifacts are only fetched from a mirror if they have the same
+// manifest as the artifact of the server, which keeps the integrity
+// guarantees of the server: all the other files of the artifact are verified
+// against the manifest when it is installed. A nil artifactMirrors has no
+// mirrors.
+type artifactMirrors struct {
+	urls        []string
+	mdnsService string
+	client      *http.Client
+}
+
+func newArtifactMirrors(config *menderConfig) *artifactMirrors {
+	if len(config.ArtifactMirrors) == 0 && config.ArtifactMirrorMDNSService == "" {
+		return nil
+	}
+	return &artifactMirrors{
+		urls:        config.ArtifactMirrors,
+		mdnsService: config.ArtifactMirrorMDNSService,
+		client: &http.Client{
+			// Mirrors are on the local network, not behind the proxy.
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{
+					Timeout: mirrorTimeout,
+				}).DialContext,
+				ResponseHeaderTimeout: mirrorTimeout,
+			},
+		},
+	}
+}
+
+// sources returns the configured mirrors, followed by those discovered.
+func (m *artifactMirrors) sources() []string {
+	sources := append([]string{}, m.urls...)
+	if m.mdnsService != "" {
+		found, err := client.DiscoverMDNSService(m.mdnsService, mirrorDiscoveryTimeout)
+		if err != nil {
+			log.Warnf("Failed to discover the artifact mirrors of %s: %v",
+				m.mdnsService, err)
+		}
+		for _, hostPort := range found {
+			sources = append(sources, "http://"+hostPort)
+		}
+	}
+	return sources
+}
+
+// fetch returns the artifact of the update from the first mirror having it,
+// or nil if none does.
+func (m *artifactMirrors) fetch(c Controller, update *datastore.UpdateInfo) (io.ReadCloser, int64) {
+	if m == nil {
+		return nil, 0
+	}
+	sources := m.sources()
+	if len(sources) == 0 {
+		return nil, 0
+	}
+
+	// Only the start of the artifact of the server is read.
+	in, _, err := c.FetchUpdate(update.URI())
+	if err != nil {
+		log.Warnf("Failed to fetch the manifest of the Artifact: %v", err)
+		return nil, 0
+	}
+	_, manifest, err := client.ReadArtifactManifest(in)
+	in.Close()
+	if err != nil {
+		log.Warnf("Failed to fetch the manifest of the Artifact: %v", err)
+		return nil, 0
+	}
+
+	for _, mirror := range sources {
+		in, size, err := client.FetchMirroredUpdate(m.client, mirror,
+			update.ArtifactName(), manifest, c.GetRetryPollInterval())
+		if err != nil {
+			log.Infof("Not fetching the Artifact from the mirror %s: %v", mirror, err)
+			continue
+		}
+		log.Infof("Fetching the Artifact from the mirror %s", mirror)
+		return in, size
+	}
+	return nil, 0
+}
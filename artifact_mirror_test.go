@@ -0,0 +1,132 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// artifactFetchController serves the artifact afresh each time it is fetched,
+// like the server does, counting the bytes read of the last one.
+type artifactFetchController struct {
+	stateTestController
+	artifact []byte
+	read     int
+}
+
+func (c *artifactFetchController) FetchUpdate(url string) (io.ReadCloser, int64, error) {
+	c.read = 0
+	return c, int64(len(c.artifact)), nil
+}
+
+func (c *artifactFetchController) Read(p []byte) (int, error) {
+	if c.read == len(c.artifact) {
+		return 0, io.EOF
+	}
+	n := copy(p, c.artifact[c.read:])
+	c.read += n
+	return n, nil
+}
+
+func (c *artifactFetchController) Close() error {
+	return nil
+}
+
+func TestStateUpdateFetchMirrored(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "artifact-mirror")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	DeploymentLogger = NewDeploymentLogManager(tmp)
+
+	stream, err := MakeRootfsImageArtifact(3, false)
+	require.NoError(t, err)
+	art, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	other, err := MakeRootfsImageArtifact(3, true)
+	require.NoError(t, err)
+	otherArt, err := ioutil.ReadAll(other)
+	require.NoError(t, err)
+	_, manifest, err := client.ReadArtifactManifest(bytes.NewReader(art))
+	require.NoError(t, err)
+	_, otherManifest, err := client.ReadArtifactManifest(bytes.NewReader(otherArt))
+	require.NoError(t, err)
+	require.NotEqual(t, manifest, otherManifest)
+
+	mirrors := map[string][]byte{}
+	served := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served[r.URL.Path]++
+		content, ok := mirrors[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName: "TestName",
+		},
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+		artifactMirrors: &artifactMirrors{
+			urls:   []string{srv.URL + "/none", srv.URL + "/other", srv.URL + "/same"},
+			client: srv.Client(),
+		},
+	}
+	sc := &artifactFetchController{artifact: art}
+	fetch := func() []byte {
+		s, _ := NewUpdateFetchState(update).Handle(&ctx, sc)
+		require.IsType(t, &UpdateStoreState{}, s)
+		assert.Equal(t, int64(len(art)), s.(*UpdateStoreState).size)
+		in := s.(*UpdateStoreState).imagein
+		defer in.Close()
+		content, err := ioutil.ReadAll(in)
+		require.NoError(t, err)
+		return content
+	}
+
+	// Artifacts of mirrors with another manifest are not used.
+	mirrors["/other/TestName.mender"] = otherArt
+	assert.Equal(t, art, fetch())
+	assert.Equal(t, map[string]int{
+		"/none/TestName.mender":  1,
+		"/other/TestName.mender": 1,
+		"/same/TestName.mender":  1,
+	}, served)
+
+	// Those with the same manifest are, and the artifact of the server is
+	// only read up to its manifest.
+	mirrors["/same/TestName.mender"] = art
+	assert.Equal(t, art, fetch())
+	assert.Equal(t, 2, served["/same/TestName.mender"])
+	assert.True(t, sc.read < len(art))
+}
@@ -14,8 +14,10 @@
 package main
 
 import (
+	"encoding/json"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -35,6 +37,16 @@ type AuthManager interface {
 	HasKey() bool
 	// generate device key (will overwrite an already existing key)
 	GenerateKey() error
+	// returns the tenant token sent to the server
+	TenantToken(serverURL string) client.AuthToken
+	// sends the tenant token to the server, without storing it, until it
+	// is either kept or dropped
+	TryTenantToken(serverURL string, token client.AuthToken)
+	// stores the tenant token tried with the server, replacing the
+	// previous one
+	KeepTenantToken(serverURL string) error
+	// goes back to the tenant token sent to the server before the one tried
+	DropTenantToken(serverURL string)
 
 	client.AuthDataMessenger
 }
@@ -43,11 +55,34 @@ const (
 	noAuthToken = client.EmptyAuthToken
 )
 
+// MenderAuthManager is safe for concurrent use; the update and inventory loops
+// and the D-Bus and local API handlers all use it.
 type MenderAuthManager struct {
+	// Protects all fields below, and the device key.
+	lock sync.Mutex
+
 	store       store.Store
+	tokenStore  store.TokenStore
 	keyStore    *store.Keystore
 	idSrc       IdentityDataGetter
 	tenantToken client.AuthToken
+	// Identity attributes whose values are not logged.
+	sensitiveIdentity []string
+	// Tenant tokens of the servers which have their own, by server URL.
+	serverTenantTokens map[string]client.AuthToken
+	// Tenant tokens being tried with the servers, by server URL; they are
+	// stored only once the server accepts them.
+	triedTenantTokens map[string]client.AuthToken
+	// Where the tenant token is read from instead of the configuration, if
+	// anywhere; replaced tokens are written to it too.
+	tenantTokenFile string
+
+	// The token in tokenStore, cached so that the store is not read on
+	// every request. Valid if tokenCached is set. A missing token is not
+	// cached, as another process, such as "mender -bootstrap", may
+	// authorize the device.
+	token       client.AuthToken
+	tokenCached bool
 }
 
 type AuthManagerConfig struct {
@@ -55,6 +90,17 @@ type AuthManagerConfig struct {
 	KeyStore       *store.Keystore    // key storage
 	IdentitySource IdentityDataGetter // provider of identity data
 	TenantToken    []byte             // tenant token
+	// Identity attributes whose values are redacted in the logs, besides
+	// those named like tokens and passwords.
+	SensitiveIdentityAttributes []string
+	// Servers the device may authorize with; their tenant tokens
+	// override TenantToken.
+	Servers []client.MenderServer
+	// Storage of the authorization token; defaults to an entry of
+	// AuthDataStore.
+	TokenStore store.TokenStore
+	// File TenantToken was read from, if any.
+	TenantTokenFile string
 }
 
 func NewAuthManager(conf AuthManagerConfig) AuthManager {
@@ -64,11 +110,40 @@ func NewAuthManager(conf AuthManagerConfig) AuthManager {
 		return nil
 	}
 
+	tokenStore := conf.TokenStore
+	if tokenStore == nil {
+		tokenStore = store.NewEntryTokenStore(conf.AuthDataStore, datastore.AuthTokenName)
+	}
+
 	mgr := &MenderAuthManager{
 		store:       conf.AuthDataStore,
+		tokenStore:  tokenStore,
 		keyStore:    conf.KeyStore,
 		idSrc:       conf.IdentitySource,
 		tenantToken: client.AuthToken(conf.TenantToken),
+
+		sensitiveIdentity: conf.SensitiveIdentityAttributes,
+		tenantTokenFile:   conf.TenantTokenFile,
+	}
+	for _, server := range conf.Servers {
+		if server.TenantToken == "" {
+			continue
+		}
+		if mgr.serverTenantTokens == nil {
+			mgr.serverTenantTokens = make(map[string]client.AuthToken)
+		}
+		mgr.serverTenantTokens[server.ServerURL] = client.AuthToken(server.TenantToken)
+	}
+	// The tokens handed out by the servers replace the configured ones.
+	stored, err := loadTenantTokens(mgr.store)
+	if err != nil {
+		log.Errorf("failed to load the tenant tokens handed out by the servers: %v", err)
+	}
+	for serverURL, token := range stored {
+		if mgr.serverTenantTokens == nil {
+			mgr.serverTenantTokens = make(map[string]client.AuthToken)
+		}
+		mgr.serverTenantTokens[serverURL] = token
 	}
 
 	if err := mgr.keyStore.Load(); err != nil && !store.IsNoKeys(err) {
@@ -96,7 +171,9 @@ func (m *MenderAuthManager) IsAuthorized() bool {
 	return true
 }
 
-func (m *MenderAuthManager) MakeAuthRequest() (*client.AuthRequest, error) {
+func (m *MenderAuthManager) MakeAuthRequest(serverURL string) (*client.AuthRequest, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
 	var err error
 	authd := client.AuthReqData{}
@@ -114,14 +191,19 @@ func (m *MenderAuthManager) MakeAuthRequest() (*client.AuthRequest, error) {
 		return nil, errors.Wrapf(err, "failed to obtain device public key")
 	}
 
-	tentok := strings.TrimSpace(string(m.tenantToken))
-
-	log.Debugf("tenant token: %s", tentok)
+	tentok := m.tenantTokenOf(serverURL)
 
 	// fill tenant token
 	authd.TenantToken = string(tentok)
 
-	log.Debugf("authorization data: %v", authd)
+	logged := client.AuthReqData{
+		IdData: redactIdentity(authd.IdData, m.sensitiveIdentity),
+		Pubkey: authd.Pubkey,
+	}
+	if authd.TenantToken != "" {
+		logged.TenantToken = redacted
+	}
+	log.Debugf("authorization data: %v", logged)
 
 	reqdata, err := authd.ToBytes()
 	if err != nil {
@@ -134,49 +216,195 @@ func (m *MenderAuthManager) MakeAuthRequest() (*client.AuthRequest, error) {
 		return nil, errors.Wrapf(err, "failed to sign auth request")
 	}
 
+	sigAlg, err := m.keyStore.SignatureAlgorithm()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to obtain signature algorithm")
+	}
+
 	return &client.AuthRequest{
-		Data:      reqdata,
-		Token:     client.AuthToken(tentok),
-		Signature: sig,
+		Data:               reqdata,
+		Token:              client.AuthToken(tentok),
+		Signature:          sig,
+		SignatureAlgorithm: sigAlg,
 	}, nil
 }
 
+func (m *MenderAuthManager) TenantToken(serverURL string) client.AuthToken {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.tenantTokenOf(serverURL)
+}
+
+func (m *MenderAuthManager) tenantTokenOf(serverURL string) client.AuthToken {
+	if tried, ok := m.triedTenantTokens[serverURL]; ok {
+		return tried
+	}
+	return m.keptTenantTokenOf(serverURL)
+}
+
+// keptTenantTokenOf returns the tenant token of the server, ignoring the one
+// being tried.
+func (m *MenderAuthManager) keptTenantTokenOf(serverURL string) client.AuthToken {
+	tentok := m.tenantToken
+	if servtok, ok := m.serverTenantTokens[serverURL]; ok {
+		tentok = servtok
+	}
+	return client.AuthToken(strings.TrimSpace(string(tentok)))
+}
+
+// TryTenantToken sends the token to the server instead of its tenant token,
+// without storing it, until KeepTenantToken or DropTenantToken is called.
+func (m *MenderAuthManager) TryTenantToken(serverURL string, token client.AuthToken) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.triedTenantTokens == nil {
+		m.triedTenantTokens = make(map[string]client.AuthToken)
+	}
+	m.triedTenantTokens[serverURL] = token
+}
+
+// DropTenantToken goes back to the tenant token the server was sent before
+// the one tried; nothing is stored.
+func (m *MenderAuthManager) DropTenantToken(serverURL string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.triedTenantTokens, serverURL)
+}
+
+// KeepTenantToken replaces the tenant token of the server with the one tried,
+// keeping it in the store, where it takes precedence over the configuration,
+// and in the tenant token file, if the token of the server is read from it.
+// The token is used from now on even if it cannot be stored, as the server has
+// accepted it.
+func (m *MenderAuthManager) KeepTenantToken(serverURL string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	token, ok := m.triedTenantTokens[serverURL]
+	if !ok {
+		return errors.Errorf("no tenant token is being tried with %s", serverURL)
+	}
+	delete(m.triedTenantTokens, serverURL)
+	previous := m.keptTenantTokenOf(serverURL)
+	if m.serverTenantTokens == nil {
+		m.serverTenantTokens = make(map[string]client.AuthToken)
+	}
+	m.serverTenantTokens[serverURL] = token
+
+	// The file may hold the token of other servers.
+	if m.tenantTokenFile != "" {
+		current, err := readSecretFile(m.tenantTokenFile)
+		if err == nil && client.AuthToken(current) == previous {
+			err = writeSecretFile(m.tenantTokenFile, string(token))
+		}
+		if err != nil {
+			log.Errorf("failed to write the tenant token to %s: %v",
+				m.tenantTokenFile, err)
+		}
+	}
+
+	stored, err := loadTenantTokens(m.store)
+	if err != nil {
+		// Replaced rather than left unusable.
+		log.Errorf("failed to load the stored tenant tokens: %v", err)
+	}
+	if stored == nil {
+		stored = make(map[string]client.AuthToken)
+	}
+	stored[serverURL] = token
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := m.store.WriteAll(datastore.TenantTokensKey, data); err != nil {
+		return errors.Wrap(err, "failed to store the tenant token")
+	}
+	return nil
+}
+
+// loadTenantTokens returns the tenant tokens handed out by the servers, by
+// server URL.
+func loadTenantTokens(s store.Store) (map[string]client.AuthToken, error) {
+	data, err := s.ReadAll(datastore.TenantTokensKey)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var tokens map[string]client.AuthToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, errors.Wrap(err, "invalid stored tenant tokens")
+	}
+	return tokens, nil
+}
+
 func (m *MenderAuthManager) RecvAuthResponse(data []byte) error {
 	if len(data) == 0 {
 		return errors.New("empty auth response data")
 	}
 
-	if err := m.store.WriteAll(datastore.AuthTokenName, data); err != nil {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// Whatever happens, the store has to be read again.
+	m.tokenCached = false
+	if err := m.tokenStore.Save(data); err != nil {
 		return errors.Wrapf(err, "failed to save auth token")
 	}
+	m.token = client.AuthToken(data)
+	m.tokenCached = true
 	return nil
 }
 
 func (m *MenderAuthManager) AuthToken() (client.AuthToken, error) {
-	data, err := m.store.ReadAll(datastore.AuthTokenName)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.authToken()
+}
+
+func (m *MenderAuthManager) authToken() (client.AuthToken, error) {
+	if m.tokenCached {
+		return m.token, nil
+	}
+
+	data, err := m.tokenStore.Load()
 	if err != nil {
 		if os.IsNotExist(err) {
-			return noAuthToken, nil
+			data = nil
+		} else {
+			return noAuthToken, errors.Wrapf(err, "failed to read auth token data")
 		}
-		return noAuthToken, errors.Wrapf(err, "failed to read auth token data")
 	}
 
-	return client.AuthToken(data), nil
+	m.token = client.AuthToken(data)
+	m.tokenCached = m.token != noAuthToken
+	return m.token, nil
 }
 
 func (m *MenderAuthManager) RemoveAuthToken() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
 	// remove token only if we have one
-	if aToken, err := m.AuthToken(); err == nil && aToken != noAuthToken {
-		return m.store.Remove(datastore.AuthTokenName)
+	if aToken, err := m.authToken(); err == nil && aToken != noAuthToken {
+		m.tokenCached = false
+		return m.tokenStore.Remove()
 	}
 	return nil
 }
 
 func (m *MenderAuthManager) HasKey() bool {
-	return m.keyStore.Private() != nil
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.keyStore.HasKey()
 }
 
 func (m *MenderAuthManager) GenerateKey() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
 	if err := m.keyStore.Generate(); err != nil {
 		log.Errorf("failed to generate device key: %v", err)
 		return errors.Wrapf(err, "failed to generate device key")
@@ -15,6 +15,11 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/mendersoftware/mender/client"
@@ -22,6 +27,7 @@ import (
 	"github.com/mendersoftware/mender/store"
 	stest "github.com/mendersoftware/mender/system/testing"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewAuthManager(t *testing.T) {
@@ -98,6 +104,120 @@ func TestAuthManager(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestAuthManagerRequestECDSA(t *testing.T) {
+	ms := store.NewMemStore()
+	ks := store.NewKeystore(ms, "key")
+	ks.SetKeyOptions(store.KeyOptions{Type: store.KeyTypeECDSAP384})
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: stest.NewTestOSCalls("mac=foobar", 0),
+		},
+		KeyStore: ks,
+	})
+	require.NotNil(t, am)
+	require.NoError(t, am.GenerateKey())
+
+	req, err := am.MakeAuthRequest("")
+	require.NoError(t, err)
+	assert.Equal(t, "ecdsa-sha384", req.SignatureAlgorithm)
+	assert.NoError(t, store.Verify(ks.Public(), 0, req.Data, req.Signature))
+}
+
+func TestAuthManagerServerTenantTokens(t *testing.T) {
+	ms := store.NewMemStore()
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: stest.NewTestOSCalls("mac=foobar", 0),
+		},
+		KeyStore:    store.NewKeystore(ms, "key"),
+		TenantToken: []byte("default"),
+		Servers: []client.MenderServer{
+			{ServerURL: "https://hosted.mender.io", TenantToken: "hosted"},
+			{ServerURL: "https://mender.example.com"},
+		},
+	})
+	require.NotNil(t, am)
+	require.NoError(t, am.GenerateKey())
+
+	for server, tenantToken := range map[string]string{
+		"https://hosted.mender.io":   "hosted",
+		"https://mender.example.com": "default",
+		"":                           "default",
+	} {
+		req, err := am.MakeAuthRequest(server)
+		require.NoError(t, err)
+		assert.Equal(t, client.AuthToken(tenantToken), req.Token, server)
+
+		var ard client.AuthReqData
+		require.NoError(t, json.Unmarshal(req.Data, &ard))
+		assert.Equal(t, tenantToken, ard.TenantToken, server)
+	}
+}
+
+func TestAuthManagerKeepTenantToken(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	tokenFile := path.Join(tdir, "tenant-token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("default\n"), 0600))
+
+	ms := store.NewMemStore()
+	conf := AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: stest.NewTestOSCalls("mac=foobar", 0),
+		},
+		KeyStore:        store.NewKeystore(ms, "key"),
+		TenantToken:     []byte("default"),
+		TenantTokenFile: tokenFile,
+		Servers: []client.MenderServer{
+			{ServerURL: "https://hosted.mender.io", TenantToken: "hosted"},
+			{ServerURL: "https://mender.example.com", TenantToken: "default"},
+		},
+	}
+	am := NewAuthManager(conf)
+	require.NotNil(t, am)
+
+	// Tokens which are dropped are neither stored nor used any longer.
+	am.TryTenantToken("https://mender.example.com", "rejected")
+	assert.Equal(t, client.AuthToken("rejected"), am.TenantToken("https://mender.example.com"))
+	am.DropTenantToken("https://mender.example.com")
+	assert.Equal(t, client.AuthToken("default"), am.TenantToken("https://mender.example.com"))
+	_, err = ms.ReadAll(datastore.TenantTokensKey)
+	assert.True(t, os.IsNotExist(err))
+	assert.Error(t, am.KeepTenantToken("https://mender.example.com"))
+
+	// The file holds the token of the other server.
+	am.TryTenantToken("https://hosted.mender.io", "rotated-hosted")
+	require.NoError(t, am.KeepTenantToken("https://hosted.mender.io"))
+	assert.Equal(t, client.AuthToken("rotated-hosted"), am.TenantToken("https://hosted.mender.io"))
+	data, err := ioutil.ReadFile(tokenFile)
+	require.NoError(t, err)
+	assert.Equal(t, "default\n", string(data))
+
+	am.TryTenantToken("https://mender.example.com", "rotated")
+	require.NoError(t, am.KeepTenantToken("https://mender.example.com"))
+	assert.Equal(t, client.AuthToken("rotated"), am.TenantToken("https://mender.example.com"))
+	data, err = ioutil.ReadFile(tokenFile)
+	require.NoError(t, err)
+	assert.Equal(t, "rotated\n", string(data))
+	info, err := os.Stat(tokenFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// The stored tokens take precedence over the configured ones.
+	am = NewAuthManager(conf)
+	require.NotNil(t, am)
+	assert.Equal(t, client.AuthToken("rotated-hosted"), am.TenantToken("https://hosted.mender.io"))
+	assert.Equal(t, client.AuthToken("rotated"), am.TenantToken("https://mender.example.com"))
+	require.NoError(t, am.GenerateKey())
+	req, err := am.MakeAuthRequest("https://mender.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, client.AuthToken("rotated"), req.Token)
+}
+
 func TestAuthManagerRequest(t *testing.T) {
 	ms := store.NewMemStore()
 
@@ -114,7 +234,7 @@ func TestAuthManagerRequest(t *testing.T) {
 	})
 	assert.NotNil(t, am)
 
-	_, err = am.MakeAuthRequest()
+	_, err = am.MakeAuthRequest("")
 	assert.Error(t, err, "should fail, cannot obtain identity data")
 	assert.Contains(t, err.Error(), "identity data")
 
@@ -128,18 +248,19 @@ func TestAuthManagerRequest(t *testing.T) {
 		TenantToken: []byte("tenant"),
 	})
 	assert.NotNil(t, am)
-	_, err = am.MakeAuthRequest()
+	_, err = am.MakeAuthRequest("")
 	assert.Error(t, err, "should fail, no device keys are present")
 	assert.Contains(t, err.Error(), "device public key")
 
 	// generate key first
 	assert.NoError(t, am.GenerateKey())
 
-	req, err := am.MakeAuthRequest()
+	req, err := am.MakeAuthRequest("")
 	assert.NoError(t, err)
 	assert.NotEmpty(t, req.Data)
 	assert.Equal(t, client.AuthToken("tenant"), req.Token)
 	assert.NotEmpty(t, req.Signature)
+	assert.Equal(t, "rsa-pkcs1v15-sha256", req.SignatureAlgorithm)
 
 	var ard client.AuthReqData
 	err = json.Unmarshal(req.Data, &ard)
@@ -187,3 +308,134 @@ func TestAuthManagerResponse(t *testing.T) {
 	assert.Equal(t, []byte("fooresp"), tokdata)
 	assert.True(t, am.IsAuthorized())
 }
+
+func TestAuthManagerTokenStore(t *testing.T) {
+	ms := store.NewMemStore()
+	ts := store.NewMemTokenStore()
+
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: stest.NewTestOSCalls("mac=foobar", 0),
+		},
+		KeyStore:   store.NewKeystore(ms, "key"),
+		TokenStore: ts,
+	})
+	assert.NotNil(t, am)
+	assert.False(t, am.IsAuthorized())
+
+	assert.NoError(t, am.RecvAuthResponse([]byte("fooresp")))
+	assert.True(t, am.IsAuthorized())
+	tokdata, err := ts.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("fooresp"), tokdata)
+	// Not in the client database.
+	_, err = ms.ReadAll(datastore.AuthTokenName)
+	assert.Equal(t, os.ErrNotExist, err)
+
+	assert.NoError(t, am.RemoveAuthToken())
+	assert.False(t, am.IsAuthorized())
+}
+
+type countingTokenStore struct {
+	store.TokenStore
+	loads int32
+}
+
+func (c *countingTokenStore) Load() ([]byte, error) {
+	atomic.AddInt32(&c.loads, 1)
+	return c.TokenStore.Load()
+}
+
+func TestAuthManagerTokenCache(t *testing.T) {
+	ms := store.NewMemStore()
+	ts := &countingTokenStore{TokenStore: store.NewMemTokenStore()}
+	require.NoError(t, ts.Save([]byte("stored")))
+
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: stest.NewTestOSCalls("mac=foobar", 0),
+		},
+		KeyStore:   store.NewKeystore(ms, "key"),
+		TokenStore: ts,
+	})
+
+	for i := 0; i < 3; i++ {
+		tok, err := am.AuthToken()
+		assert.NoError(t, err)
+		assert.Equal(t, client.AuthToken("stored"), tok)
+	}
+	assert.True(t, am.IsAuthorized())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ts.loads))
+
+	// A new token replaces the cached one without reading the store.
+	assert.NoError(t, am.RecvAuthResponse([]byte("received")))
+	tok, err := am.AuthToken()
+	assert.NoError(t, err)
+	assert.Equal(t, client.AuthToken("received"), tok)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ts.loads))
+
+	// A missing token is looked up every time, as another process may
+	// authorize the device.
+	assert.NoError(t, am.RemoveAuthToken())
+	tok, err = am.AuthToken()
+	assert.NoError(t, err)
+	assert.Equal(t, noAuthToken, tok)
+	require.NoError(t, ts.Save([]byte("bootstrapped")))
+	tok, err = am.AuthToken()
+	assert.NoError(t, err)
+	assert.Equal(t, client.AuthToken("bootstrapped"), tok)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&ts.loads))
+}
+
+func TestAuthManagerConcurrentUse(t *testing.T) {
+	ms := store.NewMemStore()
+	am := NewAuthManager(AuthManagerConfig{
+		AuthDataStore: ms,
+		IdentitySource: IdentityDataRunner{
+			cmdr: stest.NewTestOSCalls("mac=foobar", 0),
+		},
+		KeyStore: store.NewKeystore(ms, "key"),
+	})
+	require.NoError(t, am.GenerateKey())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				switch (i + j) % 4 {
+				case 0:
+					am.RecvAuthResponse([]byte("token"))
+				case 1:
+					am.RemoveAuthToken()
+				case 2:
+					am.IsAuthorized()
+				case 3:
+					am.AuthToken()
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := am.MakeAuthRequest("")
+		assert.NoError(t, err)
+		assert.True(t, am.HasKey())
+	}()
+	wg.Wait()
+
+	// The cache agrees with the store.
+	tok, err := am.AuthToken()
+	assert.NoError(t, err)
+	stored, err := ms.ReadAll(datastore.AuthTokenName)
+	if os.IsNotExist(err) {
+		assert.Equal(t, noAuthToken, tok)
+	} else {
+		assert.Equal(t, client.AuthToken(stored), tok)
+	}
+}
@@ -15,17 +15,93 @@ package client
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 const (
 	EmptyAuthToken = AuthToken("")
+
+	// How long before the API token expires the client reauthorizes at
+	// the most, rather than waiting for the server to reject the token.
+	AuthTokenRefreshMargin = 5 * time.Minute
 )
 
 type AuthToken string
 
+// tokenClaims are the claims of the token which the client reads.
+type tokenClaims struct {
+	Exp *json.Number `json:"exp"`
+	Iat *json.Number `json:"iat"`
+}
+
+// claims returns the claims of the token, which is a JWT. The signature is not
+// checked; that is up to the server.
+func (t AuthToken) claims() (*tokenClaims, bool) {
+	parts := strings.Split(string(t), ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, false
+	}
+	var claims tokenClaims
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return nil, false
+	}
+	return &claims, true
+}
+
+// claimTime returns the time of a NumericDate claim.
+func claimTime(claim *json.Number) (time.Time, bool) {
+	if claim == nil {
+		return time.Time{}, false
+	}
+	secs, err := claim.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(secs), 0), true
+}
+
+// ExpiresAt returns the expiry time in the exp claim of the token, which is a
+// JWT. The signature is not checked; that is up to the server. The second
+// return value is false if the token has no expiry time which can be read.
+func (t AuthToken) ExpiresAt() (time.Time, bool) {
+	claims, ok := t.claims()
+	if !ok {
+		return time.Time{}, false
+	}
+	return claimTime(claims.Exp)
+}
+
+// expiresWithin tells whether the token expires within d from now, or within
+// a tenth of its lifetime, from the iat to the exp claim, if that is shorter.
+// Otherwise tokens with a lifetime shorter than d, or checked on a device
+// whose clock is ahead of the one of the server, would be renewed before
+// every request.
+func (t AuthToken) expiresWithin(d time.Duration) bool {
+	claims, ok := t.claims()
+	if !ok {
+		return false
+	}
+	exp, ok := claimTime(claims.Exp)
+	if !ok {
+		return false
+	}
+	if iat, ok := claimTime(claims.Iat); ok && exp.After(iat) {
+		if lifetime := exp.Sub(iat); lifetime/10 < d {
+			d = lifetime / 10
+		}
+	}
+	return time.Until(exp) < d
+}
+
 // Structure representing authorization request data. The caller must fill each
 // field.
 type AuthReqData struct {
@@ -59,13 +135,17 @@ type AuthRequest struct {
 	Token AuthToken
 	// request signature
 	Signature []byte
+	// algorithm of the signature, such as "ecdsa-sha256"; the server
+	// assumes "rsa-pkcs1v15-sha256" if empty
+	SignatureAlgorithm string
 }
 
 // Interface capturing a functionality of generating and parsing on
 // authorization messages
 type AuthDataMessenger interface {
-	// Build authorization request data, returns auth request or an error
-	MakeAuthRequest() (*AuthRequest, error)
+	// Build authorization request data for the given server, returns auth
+	// request or an error
+	MakeAuthRequest(serverURL string) (*AuthRequest, error)
 	// Receive authorization token. Normally, the recipient should store the token
 	// in a safe place, so that the token can be used in subsequent API requests.
 	RecvAuthResponse([]byte) error
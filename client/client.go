@@ -27,12 +27,16 @@ import (
 	"time"
 
 	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 	"golang.org/x/net/http2"
 )
 
 const (
-	apiPrefix = "/api/devices/v1/"
+	// The root of the device APIs, behind the path prefix of the server.
+	apiRoot     = "/api/devices/"
+	apiPrefix   = apiRoot + "v1/"
+	apiPrefixV2 = apiRoot + "v2/"
 )
 
 var (
@@ -71,13 +75,15 @@ type ApiRequester interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
-// MenderServer is a placeholder for a full server definition used when
-// multiple servers are given. The fields corresponds to the definitions
-// given in menderConfig.
+// MenderServer is a server definition used when multiple servers are given.
+// The fields corresponds to the definitions given in menderConfig, and
+// default to the values given there.
 type MenderServer struct {
 	ServerURL string
-	// TODO: Move all possible server specific configurations in
-	//       menderConfig over to this struct. (e.g. TenantToken?)
+	// Tenant token sent when authorizing with the server.
+	TenantToken string
+	// Path to the SSL certificate of the server.
+	ServerCertificate string
 }
 
 // APIError is an error type returned after receiving an error message from the
@@ -87,6 +93,9 @@ type APIError struct {
 	error
 	reqID        string
 	serverErrMsg string
+	// Machine readable code of the error, which the server gives for some
+	// errors.
+	serverErrCode string
 }
 
 func NewAPIError(err error, resp *http.Response) *APIError {
@@ -96,7 +105,7 @@ func NewAPIError(err error, resp *http.Response) *APIError {
 	}
 
 	if resp.StatusCode >= 400 && resp.StatusCode < 600 {
-		a.serverErrMsg = unmarshalErrorMessage(resp.Body)
+		a.serverErrMsg, a.serverErrCode = unmarshalErrorMessage(resp.Body)
 	}
 	return &a
 }
@@ -124,6 +133,8 @@ type RequestProcessingFunc func(response *http.Response) (interface{}, error)
 // wrapper for http.Client with additional methods
 type ApiClient struct {
 	http.Client
+	// Clients used for servers with their own certificate, by host.
+	servers map[string]*http.Client
 }
 
 // function type for reauthorization closure (see func reauthorize@mender.go)
@@ -132,16 +143,37 @@ type ClientReauthorizeFunc func(string) (AuthToken, error)
 // function type for setting server (in case of multiple fallover servers)
 type ServerManagementFunc func() *MenderServer
 
-// Return a new ApiRequest
-func (a *ApiClient) Request(code AuthToken, nextServerIterator ServerManagementFunc, reauth ClientReauthorizeFunc) *ApiRequest {
+// Return a new ApiRequest. authServer is the URL of the server which issued
+// code; the code is not sent to any other server.
+func (a *ApiClient) Request(code AuthToken, authServer string, nextServerIterator ServerManagementFunc, reauth ClientReauthorizeFunc) *ApiRequest {
 	return &ApiRequest{
 		api:                a,
 		auth:               code,
+		authServer:         authServer,
 		nextServerIterator: nextServerIterator,
 		revoke:             reauth,
 	}
 }
 
+// WithServerTokens makes the request use the tokens issued by other servers,
+// by server URL, when failing over to them.
+func (ar *ApiRequest) WithServerTokens(tokens map[string]AuthToken) *ApiRequest {
+	ar.serverTokens = make(map[string]AuthToken, len(tokens))
+	for serverURL, token := range tokens {
+		ar.serverTokens[serverURL] = token
+	}
+	return ar
+}
+
+// Do sends the request using the certificate settings of the server it is
+// addressed to.
+func (a *ApiClient) Do(req *http.Request) (*http.Response, error) {
+	if client, ok := a.servers[req.URL.Host]; ok {
+		return client.Do(req)
+	}
+	return a.Client.Do(req)
+}
+
 // ApiRequester compatible helper. The helper can be used for executing API
 // requests that require authorization as provided Do() method will automatically
 // setup authorization information in the request.
@@ -149,6 +181,11 @@ type ApiRequest struct {
 	api *ApiClient
 	// authorization code to use for requests
 	auth AuthToken
+	// server which issued the authorization code; any server if empty
+	authServer string
+	// tokens issued by the servers, by server URL, used instead of
+	// authorizing again when failing over to, or back from, a server
+	serverTokens map[string]AuthToken
 	// anonymous function to initiate reauthorization
 	revoke ClientReauthorizeFunc
 	// anonymous function to set server
@@ -156,24 +193,27 @@ type ApiRequest struct {
 }
 
 // tryDo is a wrapper around http.Do that also tries to reauthorize
-// on a 401 response (Unauthorized).
+// on a 401 response (Unauthorized), or before sending the request if the
+// token is about to expire.
 func (ar *ApiRequest) tryDo(req *http.Request, serverURL string) (*http.Response, error) {
+	if err := ar.authorizeServer(req, serverURL); err != nil {
+		return nil, err
+	}
+	ar.refreshExpiringAuth(req, serverURL)
 	r, err := ar.api.Do(req)
-	if err == nil && r.StatusCode == http.StatusUnauthorized {
+	if err == nil && r.StatusCode == http.StatusUnauthorized && ar.revoke != nil {
 		// invalid JWT; most likely the token is expired:
 		// Try to refresh it and reattempt sending the request
 		log.Info("Device unauthorized; attempting reauthorization")
 		if jwt, e := ar.revoke(serverURL); e == nil {
-			// retry API request with new JWT token
-			ar.auth = jwt
-			// check if request had a body
-			// (GetBody is optional, and nil if body is empty)
-			if req.GetBody != nil {
-				if body, e := req.GetBody(); e == nil {
-					req.Body = body
-				}
+			ar.setAuth(req, serverURL, jwt)
+			// retry API request with new JWT token, and the body
+			// once again
+			if e := rewindBody(req); e != nil {
+				log.Warnf("Not retrying request %q: %s", req.URL.Path, e.Error())
+				return r, err
 			}
-			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ar.auth))
+			r.Body.Close()
 			r, err = ar.api.Do(req)
 		} else {
 			log.Warnf("Reauthorization failed with error: %s", e.Error())
@@ -182,6 +222,66 @@ func (ar *ApiRequest) tryDo(req *http.Request, serverURL string) (*http.Response
 	return r, err
 }
 
+// authorizeServer makes sure that the request is not sent with a token issued
+// by another server, by switching to the token of serverURL, or authorizing
+// with serverURL first if there is none. This happens when failing over to,
+// or back from, another server; the token of each server is kept, so that
+// failing over back and forth does not authorize every time.
+func (ar *ApiRequest) authorizeServer(req *http.Request, serverURL string) error {
+	if ar.authServer == "" || ar.authServer == serverURL ||
+		req.Header.Get("Authorization") != fmt.Sprintf("Bearer %s", ar.auth) {
+		return nil
+	}
+	if ar.serverTokens == nil {
+		ar.serverTokens = make(map[string]AuthToken)
+	}
+	ar.serverTokens[ar.authServer] = ar.auth
+	if jwt, ok := ar.serverTokens[serverURL]; ok && jwt != EmptyAuthToken {
+		log.Debugf("API token was issued by %s; using the one issued by %s",
+			ar.authServer, serverURL)
+		ar.setAuth(req, serverURL, jwt)
+		return nil
+	}
+	if ar.revoke == nil {
+		return errors.Errorf("not authorized with server %s", serverURL)
+	}
+	log.Infof("API token was issued by %s; authorizing with %s", ar.authServer, serverURL)
+	jwt, err := ar.revoke(serverURL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to authorize with server %s", serverURL)
+	}
+	ar.setAuth(req, serverURL, jwt)
+	return nil
+}
+
+// setAuth sends the request with the token issued by serverURL.
+func (ar *ApiRequest) setAuth(req *http.Request, serverURL string, jwt AuthToken) {
+	ar.auth = jwt
+	ar.authServer = serverURL
+	if ar.serverTokens != nil {
+		ar.serverTokens[serverURL] = jwt
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ar.auth))
+}
+
+// refreshExpiringAuth reauthorizes if the token in the request is about to
+// expire, so that the request is not wasted on a 401 response. If
+// reauthorization fails the request is sent with the current token, which is
+// still valid.
+func (ar *ApiRequest) refreshExpiringAuth(req *http.Request, serverURL string) {
+	if ar.revoke == nil || !ar.auth.expiresWithin(AuthTokenRefreshMargin) ||
+		req.Header.Get("Authorization") != fmt.Sprintf("Bearer %s", ar.auth) {
+		return
+	}
+	log.Info("API token is about to expire; attempting reauthorization")
+	jwt, err := ar.revoke(serverURL)
+	if err != nil {
+		log.Warnf("Reauthorization failed with error: %s", err.Error())
+		return
+	}
+	ar.setAuth(req, serverURL, jwt)
+}
+
 // Do is a wrapper for http.Do function for ApiRequests. This function in
 // addition to calling http.Do handles client-server authorization header /
 // reauthorization, as well as attempting failover servers (if given) whenever
@@ -194,23 +294,31 @@ func (ar *ApiRequest) Do(req *http.Request) (*http.Response, error) {
 		// Add JWT to header
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", ar.auth))
 	}
+	// The body is sent again on every retry, to every server.
+	if err := makeBodyReplayable(req); err != nil {
+		return nil, err
+	}
 	var r *http.Response
-	var host string
 	var err error
 
 	server := ar.nextServerIterator()
-	for {
-		// Split host from URL
-		tmp := strings.Split(server.ServerURL, "://")
-		if len(tmp) == 1 {
-			host = tmp[0]
-		} else {
-			// (len >= 2) should usually be 2
-			host = tmp[1]
+	if server == nil {
+		return nil, errors.New("Empty server list!")
+	}
+	for sent := false; ; sent = true {
+		if sent {
+			if rerr := rewindBody(req); rerr != nil {
+				log.Warnf("Not attempting %q with request %q: %s",
+					server.ServerURL, req.URL.Path, rerr.Error())
+				break
+			}
+			if r != nil {
+				r.Body.Close()
+			}
 		}
-
-		req.URL.Host = host
-		req.Host = host
+		// The request goes to the server as addressed in its URL, with
+		// the token issued by it and with its certificate.
+		setRequestServer(req, server.ServerURL)
 		r, err = ar.tryDo(req, server.ServerURL)
 		if err == nil && r.StatusCode < 400 {
 			break
@@ -233,13 +341,101 @@ func (ar *ApiRequest) Do(req *http.Request) (*http.Response, error) {
 	return r, err
 }
 
+// splitServerURL splits the scheme, which is empty if not given, the host and
+// the path prefix, which is empty if the server is not behind one, from a
+// server URL.
+func splitServerURL(serverURL string) (scheme, host, prefix string) {
+	host = serverURL
+	if i := strings.Index(host, "://"); i >= 0 {
+		scheme, host = host[:i], host[i+len("://"):]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host, prefix = host[:i], strings.TrimSuffix(host[i:], "/")
+	}
+	return scheme, host, prefix
+}
+
+// serverHost splits the host from a server URL.
+func serverHost(serverURL string) string {
+	_, host, _ := splitServerURL(serverURL)
+	return host
+}
+
+// setRequestServer addresses the request to the server. The API path of the
+// request is kept, behind the path prefix of the server, if any, instead of
+// that of the server the request was made for.
+func setRequestServer(req *http.Request, serverURL string) {
+	scheme, host, prefix := splitServerURL(serverURL)
+	if scheme != "" {
+		req.URL.Scheme = scheme
+	}
+	req.URL.Host = host
+	req.Host = host
+	if i := strings.Index(req.URL.Path, apiRoot); i >= 0 {
+		req.URL.Path = prefix + req.URL.Path[i:]
+		req.URL.RawPath = ""
+	}
+}
+
+// ResolveServerLink returns the URL of a link given by the server, such as the
+// link of an artifact to download: absolute links as they are, and links
+// relative to the server behind its path prefix, whether the server included
+// the prefix in them or not.
+func ResolveServerLink(serverURL, link string) string {
+	if link == "" || serverURL == "" || strings.Contains(link, "://") {
+		return link
+	}
+	_, _, prefix := splitServerURL(serverURL)
+	if prefix != "" && strings.HasPrefix(link, prefix+"/") {
+		link = link[len(prefix):]
+	}
+	if !strings.HasPrefix(link, "/") {
+		link = "/" + link
+	}
+	return buildURL(serverURL) + link
+}
+
 func NewApiClient(conf Config) (*ApiClient, error) {
 	return New(conf)
 }
 
 // New initializes new client
 func New(conf Config) (*ApiClient, error) {
+	client, err := newClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &ApiClient{Client: *client}, nil
+}
 
+// NewWithServers initializes a new client, which uses the certificate of each
+// server given for the requests sent to it. Servers without a certificate
+// of their own use conf.
+func NewWithServers(conf Config, servers []MenderServer) (*ApiClient, error) {
+	api, err := New(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range servers {
+		if server.ServerCertificate == "" || server.ServerCertificate == conf.ServerCert {
+			continue
+		}
+		serverConf := conf
+		serverConf.ServerCert = server.ServerCertificate
+		client, err := newClient(serverConf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to set up the client of server %s",
+				server.ServerURL)
+		}
+		if api.servers == nil {
+			api.servers = make(map[string]*http.Client)
+		}
+		api.servers[serverHost(server.ServerURL)] = client
+	}
+	return api, nil
+}
+
+func newClient(conf Config) (*http.Client, error) {
 	var client *http.Client
 	if conf == (Config{}) {
 		client = newHttpClient()
@@ -253,7 +449,7 @@ func New(conf Config) (*ApiClient, error) {
 
 	if client.Transport == nil {
 		client.Transport = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
+			Proxy: proxyFunc(conf),
 		}
 	}
 	// set connection timeout
@@ -269,7 +465,7 @@ func New(conf Config) (*ApiClient, error) {
 		log.Warnf("failed to enable HTTP/2 for client: %v", err)
 	}
 
-	return &ApiClient{*client}, nil
+	return client, nil
 }
 
 func newHttpClient() *http.Client {
@@ -299,9 +495,20 @@ func newHttpsClient(conf Config) (*http.Client, error) {
 		RootCAs:            trustedcerts,
 		InsecureSkipVerify: conf.NoVerify,
 	}
+
+	rc, err := newRevocationChecker(conf)
+	if err != nil {
+		return nil, err
+	}
+	if rc != nil && conf.NoVerify {
+		log.Warn("revocation of the server certificate is not checked, " +
+			"as certificate verification is skipped")
+	} else if rc != nil {
+		setRevocationCheck(&tlsc, rc)
+	}
 	transport := http.Transport{
 		TLSClientConfig: &tlsc,
-		Proxy:           http.ProxyFromEnvironment,
+		Proxy:           proxyFunc(conf),
 	}
 
 	client.Transport = &transport
@@ -314,6 +521,13 @@ type Config struct {
 	ServerCert string
 	IsHttps    bool
 	NoVerify   bool
+	// Revocation checking of the server certificate; one of the
+	// RevocationCheck constants.
+	RevocationCheck string
+	// File with the CRLs checked, in PEM or DER format
+	CRLFile string
+	// Credentials, as "user:password", of the proxies given without any
+	ProxyCredentials string
 }
 
 func loadServerTrust(conf Config) (*x509.CertPool, error) {
@@ -364,7 +578,10 @@ func loadServerTrust(conf Config) (*x509.CertPool, error) {
 	return syscerts, nil
 }
 
+// buildURL returns the URL of the server, including its path prefix, if any,
+// without a trailing slash.
 func buildURL(server string) string {
+	server = strings.TrimSuffix(server, "/")
 	if strings.HasPrefix(server, "https://") || strings.HasPrefix(server, "http://") {
 		return server
 	}
@@ -378,49 +595,51 @@ func buildApiURL(server, url string) string {
 	return buildURL(server) + apiPrefix + url
 }
 
+func buildApiV2URL(server, url string) string {
+	if strings.HasPrefix(url, "/") {
+		url = url[1:]
+	}
+	return buildURL(server) + apiPrefixV2 + url
+}
+
 // Normally one minute, but used in tests to lower the interval to avoid
 // waiting.
 var ExponentialBackoffSmallestUnit time.Duration = time.Minute
 
+// The attempts made with every interval of the exponential backoff.
+const perIntervalAttempts = 3
+
+// ExponentialBackoffPolicy is the policy of GetExponentialBackoffTime, for
+// the retries which use a utils.Backoff.
+func ExponentialBackoffPolicy(maxInterval time.Duration) utils.BackoffPolicy {
+	intervals := 1
+	for i := ExponentialBackoffSmallestUnit; i > 0 && i < maxInterval; i *= 2 {
+		intervals++
+	}
+	return utils.BackoffPolicy{
+		MinInterval:      ExponentialBackoffSmallestUnit,
+		MaxInterval:      maxInterval,
+		IntervalAttempts: perIntervalAttempts,
+		MaxAttempts:      intervals * perIntervalAttempts,
+	}
+}
+
 // Simple algorithm: Start with one minute, and try three times, then double
 // interval (maxInterval is maximum) and try again. Repeat until we tried
 // three times with maxInterval.
 func GetExponentialBackoffTime(tried int, maxInterval time.Duration) (time.Duration, error) {
-	const perIntervalAttempts = 3
-
-	interval := 1 * ExponentialBackoffSmallestUnit
-	nextInterval := interval
-
-	for c := 0; c <= tried; c += perIntervalAttempts {
-		interval = nextInterval
-		nextInterval *= 2
-		if interval >= maxInterval {
-			if tried-c >= perIntervalAttempts {
-				// At max interval and already tried three
-				// times. Give up.
-				return 0, errors.New("Tried maximum amount of times")
-			}
-
-			// Don't use less than the smallest unit, usually one
-			// minute.
-			if maxInterval < ExponentialBackoffSmallestUnit {
-				return ExponentialBackoffSmallestUnit, nil
-			}
-			return maxInterval, nil
-		}
-	}
-
-	return interval, nil
+	return ExponentialBackoffPolicy(maxInterval).Interval(tried)
 }
 
-// unmarshalErrorMessage unmarshals the error message contained in an
-// error request from the server.
-func unmarshalErrorMessage(r io.Reader) string {
+// unmarshalErrorMessage unmarshals the error message, and the error code if
+// any, contained in an error request from the server.
+func unmarshalErrorMessage(r io.Reader) (string, string) {
 	e := new(struct {
 		Error string `json:"error"`
+		Code  string `json:"code"`
 	})
 	if err := json.NewDecoder(r).Decode(e); err != nil {
-		return fmt.Sprintf("failed to parse server response: %v", err)
+		return fmt.Sprintf("failed to parse server response: %v", err), ""
 	}
-	return e.Error
+	return e.Error, e.Code
 }
@@ -29,6 +29,11 @@ import (
 
 var AuthErrorUnauthorized = errors.New("authentication request rejected")
 
+// SignatureAlgorithmHeader advertises the algorithm of the signature of an
+// authorization request, so that the server can verify keys of other types
+// than RSA.
+const SignatureAlgorithmHeader = "X-MEN-Signature-Algorithm"
+
 type AuthRequester interface {
 	Request(api ApiRequester, server string, dataSrc AuthDataMessenger) ([]byte, error)
 }
@@ -65,7 +70,7 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 				log.Error("See https://docs.mender.io/troubleshooting/mender-client#" +
 					"certificate-signed-by-unknown-authority for more information.")
 
-				return nil, errors.Wrapf(err, "certificate signed by unknown authority")
+				return nil, &FatalError{errors.Wrapf(err, "certificate signed by unknown authority")}
 
 			case x509.CertificateInvalidError:
 				switch certErr.Reason {
@@ -77,16 +82,16 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 					log.Error("See https://docs.mender.io/troubleshooting/mender-client#" +
 						"certificate-expired-or-not-yet-valid for more information.")
 
-					return nil, errors.Wrapf(err, "certificate has expired")
+					return nil, &FatalError{errors.Wrapf(err, "certificate has expired")}
 				default:
 					log.Errorf("Server certificate is invalid, reason: %#v", certErr.Reason)
 				}
-				return nil, errors.Wrapf(err, "certificate exists, but is invalid")
+				return nil, &FatalError{errors.Wrapf(err, "certificate exists, but is invalid")}
 			default:
 				log.Errorf("authorization request error: %v", certErr)
 			}
 		}
-		return nil, errors.Wrapf(err,
+		return nil, newRequestError(err,
 			"generic error occurred while executing authorization request")
 	}
 	defer rsp.Body.Close()
@@ -95,25 +100,29 @@ func (u *AuthClient) Request(api ApiRequester, server string, dataSrc AuthDataMe
 
 	switch rsp.StatusCode {
 	case http.StatusUnauthorized:
-		return nil, NewAPIError(AuthErrorUnauthorized, rsp)
+		return nil, newResponseError(AuthErrorUnauthorized, rsp)
 	case http.StatusOK:
 		log.Debugf("receive response data")
 		data, err := ioutil.ReadAll(rsp.Body)
 		if err != nil {
-			return nil, NewAPIError(errors.Wrapf(err, "failed to receive authorization response data"), rsp)
+			return nil, &TransientNetworkError{NewAPIError(errors.Wrapf(err,
+				"failed to receive authorization response data"), rsp)}
+		}
+		if err := checkIntercepted(rsp, data); err != nil {
+			return nil, err
 		}
 
 		log.Debugf("received response data:  %v", data)
 		return data, nil
 	default:
-		return nil, NewAPIError(errors.Errorf("unexpected authorization status %v", rsp.StatusCode), rsp)
+		return nil, newResponseError(errors.Errorf("unexpected authorization status %v", rsp.StatusCode), rsp)
 	}
 }
 
 func makeAuthRequest(server string, dataSrc AuthDataMessenger) (*http.Request, error) {
 	url := buildApiURL(server, "/authentication/auth_requests")
 
-	req, err := dataSrc.MakeAuthRequest()
+	req, err := dataSrc.MakeAuthRequest(server)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to obtain authorization message data")
 	}
@@ -127,5 +136,8 @@ func makeAuthRequest(server string, dataSrc AuthDataMessenger) (*http.Request, e
 	hreq.Header.Add("Content-Type", "application/json")
 	hreq.Header.Add("Authorization", fmt.Sprintf("Bearer %s", req.Token))
 	hreq.Header.Add("X-MEN-Signature", base64.StdEncoding.EncodeToString(req.Signature))
+	if req.SignatureAlgorithm != "" {
+		hreq.Header.Add(SignatureAlgorithmHeader, req.SignatureAlgorithm)
+	}
 	return hreq, nil
 }
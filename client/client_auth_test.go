@@ -21,24 +21,28 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type testAuthDataMessenger struct {
 	reqData  []byte
 	sigData  []byte
 	code     AuthToken
+	sigAlg   string
 	reqError error
 	rspError error
 	rspData  []byte
 }
 
-func (t *testAuthDataMessenger) MakeAuthRequest() (*AuthRequest, error) {
+func (t *testAuthDataMessenger) MakeAuthRequest(serverURL string) (*AuthRequest, error) {
 	return &AuthRequest{
-		t.reqData,
-		t.code,
-		t.sigData,
+		Data:               t.reqData,
+		Token:              t.code,
+		Signature:          t.sigData,
+		SignatureAlgorithm: t.sigAlg,
 	}, t.reqError
 }
 
@@ -70,11 +74,21 @@ func TestClientAuthMakeReq(t *testing.T) {
 	assert.Equal(t, "Bearer tenanttoken", req.Header.Get("Authorization"))
 	expsignature := base64.StdEncoding.EncodeToString([]byte("foobar"))
 	assert.Equal(t, expsignature, req.Header.Get("X-MEN-Signature"))
+	// The algorithm is only advertised when known.
+	assert.Empty(t, req.Header.Get(SignatureAlgorithmHeader))
 	assert.NotNil(t, req.Body)
 	data, _ := ioutil.ReadAll(req.Body)
 	t.Logf("data: %v", string(data))
 
 	assert.Equal(t, []byte("foobar data"), data)
+
+	req, err = makeAuthRequest("mender.io", &testAuthDataMessenger{
+		reqData: []byte("foobar data"),
+		sigData: []byte("foobar"),
+		sigAlg:  "ecdsa-sha384",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "ecdsa-sha384", req.Header.Get(SignatureAlgorithmHeader))
 }
 
 func TestClientAuth(t *testing.T) {
@@ -98,7 +112,7 @@ func TestClientAuth(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -127,7 +141,7 @@ func TestClientAuthExpiredCert(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.expired.crt", true, false},
+		Config{ServerCert: "server.expired.crt", IsHttps: true},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -150,7 +164,7 @@ func TestClientAuthUnknownAuthorityCert(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.unknown-authority.crt", true, false},
+		Config{ServerCert: "server.unknown-authority.crt", IsHttps: true},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -173,9 +187,59 @@ func TestClientAuthNoCert(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.non-existing.crt", true, false},
+		Config{ServerCert: "server.non-existing.crt", IsHttps: true},
 	)
 	assert.Nil(t, ac)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "cannot initialize server trust")
 }
+
+func makeTestJWT(claims string) AuthToken {
+	enc := base64.RawURLEncoding
+	return AuthToken(enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." +
+		enc.EncodeToString([]byte(claims)) + "." + enc.EncodeToString([]byte("signature")))
+}
+
+func TestAuthTokenExpiresAt(t *testing.T) {
+	exp, ok := makeTestJWT(`{"sub":"device","exp":1565000000}`).ExpiresAt()
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1565000000, 0), exp)
+
+	for _, token := range []AuthToken{
+		EmptyAuthToken,
+		AuthToken("foobar"),
+		AuthToken("a.!!!.c"),
+		makeTestJWT(`{"sub":"device"}`),
+		makeTestJWT(`{"exp":"tomorrow"}`),
+		makeTestJWT(`not json`),
+	} {
+		_, ok = token.ExpiresAt()
+		assert.False(t, ok, string(token))
+	}
+
+	assert.True(t, makeTestJWT(fmt.Sprintf(`{"exp":%d}`,
+		time.Now().Add(time.Minute).Unix())).expiresWithin(AuthTokenRefreshMargin))
+	assert.False(t, makeTestJWT(fmt.Sprintf(`{"exp":%d}`,
+		time.Now().Add(time.Hour).Unix())).expiresWithin(AuthTokenRefreshMargin))
+	assert.False(t, AuthToken("foobar").expiresWithin(AuthTokenRefreshMargin))
+}
+
+func TestAuthTokenExpiresWithinClockSkew(t *testing.T) {
+	token := func(iat, exp time.Duration) AuthToken {
+		now := time.Now()
+		return makeTestJWT(fmt.Sprintf(`{"iat":%d,"exp":%d}`,
+			now.Add(iat).Unix(), now.Add(exp).Unix()))
+	}
+
+	// A token with a lifetime of an hour, with two minutes left.
+	assert.True(t, token(-58*time.Minute, 2*time.Minute).expiresWithin(AuthTokenRefreshMargin))
+	// Just issued with a lifetime shorter than the margin, or on a device
+	// whose clock is ahead of the server by four minutes.
+	assert.False(t, token(0, 4*time.Minute).expiresWithin(AuthTokenRefreshMargin))
+	assert.False(t, token(-4*time.Minute, time.Minute).expiresWithin(AuthTokenRefreshMargin))
+	// The last tenth of the lifetime of a short lived token.
+	assert.True(t, token(-4*time.Minute-40*time.Second, 20*time.Second).
+		expiresWithin(AuthTokenRefreshMargin))
+	// On a device whose clock is behind the server.
+	assert.False(t, token(10*time.Minute, 70*time.Minute).expiresWithin(AuthTokenRefreshMargin))
+}
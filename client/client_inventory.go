@@ -43,14 +43,17 @@ func (i *InventoryClient) Submit(api ApiRequester, url string, data interface{})
 	r, err := api.Do(req)
 	if err != nil {
 		log.Error("failed to submit inventory data: ", err)
-		return errors.Wrapf(err, "inventory submit failed")
+		return newRequestError(err, "inventory submit failed")
 	}
 
 	defer r.Body.Close()
 
 	if r.StatusCode != http.StatusOK {
 		log.Errorf("got unexpected HTTP status when submitting to inventory: %v", r.StatusCode)
-		return NewAPIError(errors.Errorf("inventory submit failed, bad status %v", r.StatusCode), r)
+		return newResponseError(errors.Errorf("inventory submit failed, bad status %v", r.StatusCode), r)
+	}
+	if err := checkIntercepted(r, nil); err != nil {
+		return err
 	}
 	log.Debugf("inventory update sent, response %v", r)
 
@@ -15,6 +15,8 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -31,48 +33,145 @@ type LogData struct {
 	Messages     []byte `json:"messages"`
 }
 
+// LogUploadConfig holds the options for uploading deployment logs.
+type LogUploadConfig struct {
+	// Compress the request body using gzip Content-Encoding.
+	Compress bool
+	// Maximum size, in bytes, of the (uncompressed) log messages sent in a
+	// single request. Larger logs are split into several requests, each
+	// carrying a subset of the messages. Zero means no limit.
+	MaxChunkSize int
+}
+
 type LogUploadClient struct {
+	conf LogUploadConfig
 }
 
 func NewLog() LogUploader {
 	return &LogUploadClient{}
 }
 
+func NewLogWithConfig(conf LogUploadConfig) LogUploader {
+	return &LogUploadClient{conf: conf}
+}
+
 // Report status information to the backend
 func (u *LogUploadClient) Upload(api ApiRequester, url string, logs LogData) error {
-	req, err := makeLogUploadRequest(url, &logs)
+	chunks, err := splitLogMessages(logs.Messages, u.conf.MaxChunkSize)
 	if err != nil {
-		return errors.Wrapf(err, "failed to prepare log upload request")
+		return errors.Wrapf(err, "failed to split logs into chunks")
 	}
 
-	r, err := api.Do(req)
-	if err != nil {
-		log.Error("failed to upload logs: ", err)
-		return errors.Wrapf(err, "uploading logs failed")
-	}
+	for i, chunk := range chunks {
+		req, err := makeLogUploadRequest(url, logs.DeploymentID, chunk, u.conf.Compress)
+		if err != nil {
+			return errors.Wrapf(err, "failed to prepare log upload request")
+		}
 
-	defer r.Body.Close()
+		r, err := api.Do(req)
+		if err != nil {
+			log.Error("failed to upload logs: ", err)
+			return newRequestError(err, "uploading logs failed")
+		}
 
-	// HTTP 204 No Content
-	if r.StatusCode != http.StatusNoContent {
-		log.Errorf("got unexpected HTTP status when uploading log: %v", r.StatusCode)
-		return NewAPIError(errors.Errorf("uploading logs failed, bad status %v", r.StatusCode), r)
+		if err := checkDeploymentAborted(r); err != nil {
+			r.Body.Close()
+			return err
+		}
+
+		// HTTP 204 No Content
+		if r.StatusCode != http.StatusNoContent {
+			log.Errorf("got unexpected HTTP status when uploading log: %v", r.StatusCode)
+			err = newResponseError(errors.Errorf("uploading logs failed, bad status %v", r.StatusCode), r)
+			r.Body.Close()
+			return err
+		}
+		r.Body.Close()
+		log.Debugf("logs uploaded (chunk %d of %d), response %v", i+1, len(chunks), r)
 	}
-	log.Debugf("logs uploaded, response %v", r)
 
 	return nil
 }
 
-func makeLogUploadRequest(server string, logs *LogData) (*http.Request, error) {
+// splitLogMessages splits the JSON encoded log messages (on the form
+// `{"messages": [...]}`) into chunks no larger than maxSize bytes. A single
+// message larger than maxSize is sent in a chunk of its own. Logs that are
+// not on the expected form are returned as a single chunk.
+func splitLogMessages(messages []byte, maxSize int) ([][]byte, error) {
+	if maxSize <= 0 || len(messages) <= maxSize {
+		return [][]byte{messages}, nil
+	}
+
+	type deploymentLogs struct {
+		Messages []json.RawMessage `json:"messages"`
+	}
+	var logs deploymentLogs
+	if err := json.Unmarshal(messages, &logs); err != nil || len(logs.Messages) == 0 {
+		log.Debug("deployment logs can not be split; uploading as one chunk")
+		return [][]byte{messages}, nil
+	}
+
+	// size of `{"messages":[]}`
+	const overhead = 15
+	chunks := [][]byte{}
+	current := deploymentLogs{}
+	currentSize := overhead
+	flush := func() error {
+		chunk, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, chunk)
+		current.Messages = nil
+		currentSize = overhead
+		return nil
+	}
+
+	for _, msg := range logs.Messages {
+		// account for the separating comma
+		msgSize := len(msg) + 1
+		if len(current.Messages) > 0 && currentSize+msgSize > maxSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+		current.Messages = append(current.Messages, msg)
+		currentSize += msgSize
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+func makeLogUploadRequest(server, deploymentID string, messages []byte,
+	compress bool) (*http.Request, error) {
+
 	path := fmt.Sprintf("/deployments/device/deployments/%s/log",
-		logs.DeploymentID)
+		deploymentID)
 	url := buildApiURL(server, path)
 
-	hreq, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(logs.Messages))
+	body := messages
+	if compress {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(messages); err != nil {
+			return nil, errors.Wrapf(err, "failed to compress logs")
+		}
+		if err := zw.Close(); err != nil {
+			return nil, errors.Wrapf(err, "failed to compress logs")
+		}
+		body = buf.Bytes()
+	}
+
+	hreq, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create log sending HTTP request")
 	}
 
 	hreq.Header.Add("Content-Type", "application/json")
+	if compress {
+		hreq.Header.Add("Content-Encoding", "gzip")
+	}
 	return hreq, nil
 }
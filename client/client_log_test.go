@@ -14,6 +14,8 @@
 package client
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -21,6 +23,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLogUploadClient(t *testing.T) {
@@ -44,7 +47,7 @@ func TestLogUploadClient(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -88,3 +91,77 @@ func TestLogUploadClient(t *testing.T) {
 	})
 	assert.Error(t, err)
 }
+
+func TestLogUploadClientChunkedCompressed(t *testing.T) {
+	var received [][]byte
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		zr, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(zr)
+		assert.NoError(t, err)
+		received = append(received, data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(
+		Config{ServerCert: "server.crt", IsHttps: true},
+	)
+	assert.NoError(t, err)
+
+	client := NewLogWithConfig(LogUploadConfig{
+		Compress:     true,
+		MaxChunkSize: 150,
+	})
+
+	ld := LogData{
+		DeploymentID: "deployment1",
+		Messages: []byte(`{ "messages":
+[{ "time": "12:12:12", "level": "error", "msg": "log foo" },
+{ "time": "12:12:13", "level": "debug", "msg": "log bar" },
+{ "time": "12:12:14", "level": "info", "msg": "log baz" }]
+}`),
+	}
+	err = client.Upload(ac, ts.URL, ld)
+	require.NoError(t, err)
+	require.Len(t, received, 2)
+
+	var messages []json.RawMessage
+	for _, chunk := range received {
+		assert.True(t, len(chunk) <= 150)
+		var logs struct {
+			Messages []json.RawMessage `json:"messages"`
+		}
+		assert.NoError(t, json.Unmarshal(chunk, &logs))
+		messages = append(messages, logs.Messages...)
+	}
+	require.Len(t, messages, 3)
+	assert.JSONEq(t, `{ "time": "12:12:14", "level": "info", "msg": "log baz" }`,
+		string(messages[2]))
+}
+
+func TestSplitLogMessages(t *testing.T) {
+	logs := []byte(`{"messages":[{"msg":"foo"},{"msg":"bar"}]}`)
+
+	chunks, err := splitLogMessages(logs, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{logs}, chunks)
+
+	chunks, err = splitLogMessages(logs, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"messages":[{"msg":"foo"}]}`),
+		[]byte(`{"messages":[{"msg":"bar"}]}`),
+	}, chunks)
+
+	// single message larger than the limit
+	chunks, err = splitLogMessages(logs, 5)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 2)
+
+	// malformed logs are sent as is
+	chunks, err = splitLogMessages([]byte(`[not json`), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`[not json`)}, chunks)
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotificationsUnsupported = errors.New("update notifications are not supported by the server")
+)
+
+type UpdateNotifier interface {
+	WaitForUpdate(api ApiRequester, server string, timeout time.Duration) (bool, error)
+}
+
+type UpdateNotifyClient struct {
+}
+
+func NewUpdateNotify() UpdateNotifier {
+	return &UpdateNotifyClient{}
+}
+
+// WaitForUpdate long-polls the server for a pending deployment. It returns
+// true as soon as the server reports a deployment for the device, or false
+// if none was scheduled before the timeout expired.
+func (u *UpdateNotifyClient) WaitForUpdate(api ApiRequester, server string,
+	timeout time.Duration) (bool, error) {
+
+	req, err := makeUpdateNotifyRequest(server, timeout)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to prepare update notification request")
+	}
+
+	r, err := api.Do(req)
+	if err != nil {
+		return false, newRequestError(err, "waiting for update notification failed")
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+		log.Debug("Server notified of a pending deployment")
+		return true, nil
+	case http.StatusNoContent:
+		return false, nil
+	case http.StatusNotFound, http.StatusNotImplemented:
+		return false, newResponseError(ErrNotificationsUnsupported, r)
+	default:
+		return false, newResponseError(errors.Errorf(
+			"waiting for update notification failed, bad status %v", r.StatusCode), r)
+	}
+}
+
+func makeUpdateNotifyRequest(server string, timeout time.Duration) (*http.Request, error) {
+	path := fmt.Sprintf("/deployments/device/deployments/next/notify?timeout=%d",
+		int(timeout.Seconds()))
+	url := buildApiURL(server, path)
+
+	hreq, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create update notification HTTP request")
+	}
+	return hreq, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateNotifyClient(t *testing.T) {
+	responder := &struct {
+		httpStatus int
+		path       string
+		timeout    string
+	}{
+		httpStatus: http.StatusOK,
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(responder.httpStatus)
+		responder.path = r.URL.Path
+		responder.timeout = r.URL.Query().Get("timeout")
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(
+		Config{ServerCert: "server.crt", IsHttps: true},
+	)
+	assert.NotNil(t, ac)
+	assert.NoError(t, err)
+
+	client := NewUpdateNotify()
+	assert.NotNil(t, client)
+
+	_, err = client.WaitForUpdate(NewMockApiClient(nil, errors.New("foo")),
+		ts.URL, time.Minute)
+	assert.Error(t, err)
+
+	pending, err := client.WaitForUpdate(ac, ts.URL, time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, pending)
+	assert.Equal(t, apiPrefix+"deployments/device/deployments/next/notify", responder.path)
+	assert.Equal(t, "60", responder.timeout)
+
+	responder.httpStatus = http.StatusNoContent
+	pending, err = client.WaitForUpdate(ac, ts.URL, time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, pending)
+
+	responder.httpStatus = http.StatusNotFound
+	_, err = client.WaitForUpdate(ac, ts.URL, time.Minute)
+	assert.Error(t, err)
+	assert.Equal(t, ErrNotificationsUnsupported, errors.Cause(err))
+
+	responder.httpStatus = http.StatusInternalServerError
+	_, err = client.WaitForUpdate(ac, ts.URL, time.Minute)
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrNotificationsUnsupported, errors.Cause(err))
+}
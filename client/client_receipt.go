@@ -0,0 +1,80 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// ReceiptUploader uploads the signed receipt of a deployment applied from an
+// offline bundle, so that the server can verify that the device applied it.
+type ReceiptUploader interface {
+	Upload(api ApiRequester, server string, receipt ReceiptData) error
+}
+
+type ReceiptData struct {
+	DeploymentID string
+	// The receipt and its signature, as stored on the device.
+	Receipt []byte
+}
+
+type ReceiptUploadClient struct {
+}
+
+func NewReceipt() ReceiptUploader {
+	return &ReceiptUploadClient{}
+}
+
+func (u *ReceiptUploadClient) Upload(api ApiRequester, url string, receipt ReceiptData) error {
+	req, err := makeReceiptUploadRequest(url, receipt)
+	if err != nil {
+		return errors.Wrapf(err, "failed to prepare receipt upload request")
+	}
+
+	r, err := api.Do(req)
+	if err != nil {
+		log.Error("failed to upload receipt: ", err)
+		return newRequestError(err, "uploading receipt failed")
+	}
+	defer r.Body.Close()
+
+	if err := checkDeploymentAborted(r); err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusNoContent {
+		log.Errorf("got unexpected HTTP status when uploading receipt: %v", r.StatusCode)
+		return newResponseError(errors.Errorf(
+			"uploading receipt failed, bad status %v", r.StatusCode), r)
+	}
+	log.Debugf("receipt uploaded, response %v", r)
+	return nil
+}
+
+func makeReceiptUploadRequest(server string, receipt ReceiptData) (*http.Request, error) {
+	path := fmt.Sprintf("/deployments/device/deployments/%s/receipt",
+		receipt.DeploymentID)
+	url := buildApiURL(server, path)
+
+	hreq, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(receipt.Receipt))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create receipt upload HTTP request")
+	}
+	hreq.Header.Add("Content-Type", "application/json")
+	return hreq, nil
+}
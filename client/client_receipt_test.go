@@ -0,0 +1,61 @@
+// Copyright 2018 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiptUploadClient(t *testing.T) {
+	status := http.StatusNoContent
+	var path, contentType string
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		contentType = r.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	client := NewReceipt()
+	receipt := ReceiptData{
+		DeploymentID: "deployment1",
+		Receipt:      []byte(`{"receipt":{"deployment_id":"deployment1"},"signature":"c2ln"}`),
+	}
+
+	err := client.Upload(NewMockApiClient(nil, errors.New("foo")), ts.URL, receipt)
+	assert.Error(t, err)
+
+	err = client.Upload(http.DefaultClient, ts.URL, receipt)
+	assert.NoError(t, err)
+	assert.Equal(t, "/api/devices/v1/deployments/device/deployments/deployment1/receipt", path)
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, receipt.Receipt, body)
+
+	status = http.StatusConflict
+	err = client.Upload(http.DefaultClient, ts.URL, receipt)
+	assert.True(t, IsDeploymentAborted(err))
+
+	status = http.StatusBadRequest
+	err = client.Upload(http.DefaultClient, ts.URL, receipt)
+	assert.Error(t, err)
+	assert.False(t, IsDeploymentAborted(err))
+}
@@ -36,6 +36,23 @@ var (
 	ErrDeploymentAborted = errors.New("deployment was aborted")
 )
 
+// IsDeploymentAborted returns whether the error tells that the deployment was
+// aborted on the server.
+func IsDeploymentAborted(err error) bool {
+	return errors.Cause(err) == ErrDeploymentAborted
+}
+
+// checkDeploymentAborted returns ErrDeploymentAborted if the server rejected
+// the request of a deployment because the deployment was aborted, and nil
+// otherwise.
+func checkDeploymentAborted(r *http.Response) error {
+	if r.StatusCode != http.StatusConflict {
+		return nil
+	}
+	log.Warnf("request rejected, deployment aborted at the backend")
+	return newResponseError(ErrDeploymentAborted, r)
+}
+
 type StatusReporter interface {
 	Report(api ApiRequester, server string, report StatusReport) error
 }
@@ -72,19 +89,20 @@ func (u *StatusClient) Report(api ApiRequester, url string, report StatusReport)
 	r, err := api.Do(req)
 	if err != nil {
 		log.Error("failed to report status: ", err)
-		return errors.Wrapf(err, "reporting status failed")
+		return newRequestError(err, "reporting status failed")
 	}
 
 	defer r.Body.Close()
 
+	if err := checkDeploymentAborted(r); err != nil {
+		return err
+	}
+
 	// HTTP 204 No Content
 	switch {
-	case r.StatusCode == http.StatusConflict:
-		log.Warnf("status report rejected, deployment aborted at the backend")
-		return NewAPIError(ErrDeploymentAborted, r)
 	case r.StatusCode != http.StatusNoContent:
 		log.Errorf("got unexpected HTTP status when reporting status: %v", r.StatusCode)
-		return NewAPIError(errors.Errorf("reporting status failed, bad status %v", r.StatusCode), r)
+		return newResponseError(errors.Errorf("reporting status failed, bad status %v", r.StatusCode), r)
 	}
 
 	log.Debugf("status reported, response %s", r.Status)
@@ -0,0 +1,115 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// TenantTokenGetter asks the server for the tenant token the device is to
+// authorize with from now on, when devices are moved to another tenant, or
+// the token of the tenant is replaced.
+type TenantTokenGetter interface {
+	// GetTenantToken returns the new tenant token, or EmptyAuthToken if
+	// there is none.
+	GetTenantToken(api ApiRequester, server string) (AuthToken, error)
+}
+
+type TenantTokenClient struct {
+}
+
+func NewTenantToken() TenantTokenGetter {
+	return &TenantTokenClient{}
+}
+
+func (t *TenantTokenClient) GetTenantToken(api ApiRequester, server string) (AuthToken, error) {
+	req, err := makeTenantTokenRequest(server)
+	if err != nil {
+		return EmptyAuthToken, errors.Wrapf(err, "failed to prepare tenant token request")
+	}
+
+	r, err := api.Do(req)
+	if err != nil {
+		return EmptyAuthToken, newRequestError(err, "tenant token request failed")
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusNotFound:
+		// No new token, or a server which does not hand them out.
+		log.Debugf("no new tenant token, status %v", r.StatusCode)
+		return EmptyAuthToken, nil
+	default:
+		return EmptyAuthToken, newResponseError(errors.Errorf(
+			"tenant token request failed, bad status %v", r.StatusCode), r)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return EmptyAuthToken, &TransientNetworkError{errors.Wrap(err,
+			"failed to read the tenant token response")}
+	}
+	if err := checkIntercepted(r, body); err != nil {
+		return EmptyAuthToken, err
+	}
+	var rsp struct {
+		TenantToken string `json:"tenant_token"`
+	}
+	if err := json.Unmarshal(body, &rsp); err != nil {
+		return EmptyAuthToken, &FatalError{errors.Wrap(err,
+			"failed to parse the tenant token response")}
+	}
+	return AuthToken(strings.TrimSpace(rsp.TenantToken)), nil
+}
+
+func makeTenantTokenRequest(server string) (*http.Request, error) {
+	url := buildApiURL(server, "/authentication/tenant_token")
+	return http.NewRequest(http.MethodGet, url, nil)
+}
+
+// ValidateTenantToken checks that the token is a JWT naming the tenant in its
+// mender.tenant claim, which has not expired. The signature is not checked;
+// that is up to the server.
+func ValidateTenantToken(token AuthToken) error {
+	parts := strings.Split(string(token), ".")
+	if len(parts) != 3 {
+		return errors.New("the tenant token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return errors.Wrap(err, "invalid claims of the tenant token")
+	}
+	var claims struct {
+		Tenant string `json:"mender.tenant"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return errors.Wrap(err, "invalid claims of the tenant token")
+	}
+	if claims.Tenant == "" {
+		return errors.New("the tenant token does not name a tenant")
+	}
+	if exp, ok := token.ExpiresAt(); ok && !exp.After(time.Now()) {
+		return errors.Errorf("the tenant token expired at %v", exp)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTenantToken(claims string) AuthToken {
+	enc := base64.RawURLEncoding
+	return AuthToken(enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." +
+		enc.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl")
+}
+
+func TestGetTenantToken(t *testing.T) {
+	token := makeTenantToken(`{"mender.tenant":"5c76a07ba3b5c8000198a29c"}`)
+	status := http.StatusOK
+	body := fmt.Sprintf(`{"tenant_token": "%s"}`, token)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/devices/v1/authentication/tenant_token", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	client := NewTenantToken()
+	tok, err := client.GetTenantToken(http.DefaultClient, ts.URL)
+	require.NoError(t, err)
+	assert.Equal(t, token, tok)
+
+	for _, status = range []int{http.StatusNoContent, http.StatusNotFound} {
+		tok, err = client.GetTenantToken(http.DefaultClient, ts.URL)
+		assert.NoError(t, err)
+		assert.Equal(t, EmptyAuthToken, tok)
+	}
+
+	status = http.StatusUnauthorized
+	_, err = client.GetTenantToken(http.DefaultClient, ts.URL)
+	assert.True(t, IsAuthError(err))
+
+	status, body = http.StatusOK, "not json"
+	_, err = client.GetTenantToken(http.DefaultClient, ts.URL)
+	assert.True(t, IsFatalError(err))
+}
+
+func TestValidateTenantToken(t *testing.T) {
+	assert.NoError(t, ValidateTenantToken(
+		makeTenantToken(`{"mender.tenant":"5c76a07ba3b5c8000198a29c"}`)))
+	assert.NoError(t, ValidateTenantToken(makeTenantToken(fmt.Sprintf(
+		`{"mender.tenant":"5c76a07ba3b5c8000198a29c","exp":%d}`,
+		time.Now().Add(time.Hour).Unix()))))
+
+	for _, token := range []AuthToken{
+		"",
+		"not-a-jwt",
+		"a.!!!.c",
+		makeTenantToken(`not json`),
+		makeTenantToken(`{"sub":"device"}`),
+		makeTenantToken(fmt.Sprintf(`{"mender.tenant":"5c76a07ba3b5c8000198a29c","exp":%d}`,
+			time.Now().Add(-time.Hour).Unix())),
+	} {
+		assert.Error(t, ValidateTenantToken(token), string(token))
+	}
+}
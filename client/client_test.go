@@ -16,12 +16,15 @@ package client
 import (
 	"bytes"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"runtime"
 	"strings"
 	"testing"
@@ -52,7 +55,7 @@ func dummy_srvMngmntFunc(url string) func() *MenderServer {
 
 func TestHttpClient(t *testing.T) {
 	cl, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, cl)
 
@@ -62,7 +65,7 @@ func TestHttpClient(t *testing.T) {
 
 	// missing cert in config should yield an error
 	cl, err = NewApiClient(
-		Config{"missing.crt", true, false},
+		Config{ServerCert: "missing.crt", IsHttps: true},
 	)
 	assert.Nil(t, cl)
 	assert.NotNil(t, err)
@@ -70,7 +73,7 @@ func TestHttpClient(t *testing.T) {
 
 func TestApiClientRequest(t *testing.T) {
 	cl, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, cl)
 
@@ -90,7 +93,7 @@ func TestApiClientRequest(t *testing.T) {
 	defer ts.Close()
 
 	auth := false
-	req := cl.Request("foobar", dummy_srvMngmntFunc(ts.URL),
+	req := cl.Request("foobar", "", dummy_srvMngmntFunc(ts.URL),
 		func(url string) (AuthToken, error) {
 			if !auth {
 				return AuthToken(""), errors.New("")
@@ -150,12 +153,12 @@ func TestClientConnectionTimeout(t *testing.T) {
 	}()
 
 	cl, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, cl)
 	assert.NoError(t, err)
 
-	req := cl.Request("foobar", dummy_srvMngmntFunc(ts.URL), dummy_reauthfunc)
+	req := cl.Request("foobar", "", dummy_srvMngmntFunc(ts.URL), dummy_reauthfunc)
 	assert.NotNil(t, req)
 
 	hreq, err := http.NewRequest(http.MethodGet, ts.URL, nil)
@@ -186,6 +189,23 @@ func TestHttpClientUrl(t *testing.T) {
 
 	u = buildApiURL("foo.bar", "zed")
 	assert.Equal(t, "https://foo.bar/api/devices/v1/zed", u)
+
+	u = buildApiURL("https://foo.bar/mender/", "/zed")
+	assert.Equal(t, "https://foo.bar/mender/api/devices/v1/zed", u)
+}
+
+func TestResolveServerLink(t *testing.T) {
+	const server = "https://foo.bar/mender"
+	assert.Equal(t, "https://s3.example.com/artifact?sig=1",
+		ResolveServerLink(server, "https://s3.example.com/artifact?sig=1"))
+	assert.Equal(t, "https://foo.bar/mender/api/devices/v1/download/1",
+		ResolveServerLink(server, "/api/devices/v1/download/1"))
+	assert.Equal(t, "https://foo.bar/mender/api/devices/v1/download/1",
+		ResolveServerLink(server, "/mender/api/devices/v1/download/1"))
+	assert.Equal(t, "https://foo.bar/mender/download/1",
+		ResolveServerLink(server+"/", "download/1"))
+	assert.Equal(t, "/api/devices/v1/download/1",
+		ResolveServerLink("", "/api/devices/v1/download/1"))
 }
 
 // Test that our loaded certificates include the system CAs, and our own.
@@ -315,7 +335,14 @@ func TestUnMarshalErrorMessage(t *testing.T) {
 	require.Nil(t, json.Unmarshal([]byte(jsonErrMsg), errData))
 
 	expected := "failed to decode device group data: JSON payload is empty"
-	assert.Equal(t, expected, unmarshalErrorMessage(bytes.NewReader([]byte(jsonErrMsg))))
+	msg, code := unmarshalErrorMessage(bytes.NewReader([]byte(jsonErrMsg)))
+	assert.Equal(t, expected, msg)
+	assert.Empty(t, code)
+
+	msg, code = unmarshalErrorMessage(bytes.NewReader([]byte(
+		`{"error": "device decommissioned", "code": "device_decommissioned"}`)))
+	assert.Equal(t, "device decommissioned", msg)
+	assert.Equal(t, ErrorCodeDeviceDecommissioned, code)
 }
 
 // Covers some special corner cases of the failover mechanism that is unique.
@@ -324,7 +351,7 @@ func TestUnMarshalErrorMessage(t *testing.T) {
 // In addition it also covers the case with a 'nil' ServerManagementFunc.
 func TestFailoverAPICall(t *testing.T) {
 	cl, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, cl)
 
@@ -359,7 +386,7 @@ func TestFailoverAPICall(t *testing.T) {
 			return ret
 		}
 	}
-	req := cl.Request("foobar", mulServerfunc(), dummy_reauthfunc) /* cl.Request */
+	req := cl.Request("foobar", "", mulServerfunc(), dummy_reauthfunc) /* cl.Request */
 	assert.NotNil(t, req)
 
 	hreq, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
@@ -371,9 +398,294 @@ func TestFailoverAPICall(t *testing.T) {
 	assert.NotNil(t, responder.headers)
 	assert.Equal(t, "Bearer foobar", responder.headers.Get("Authorization"))
 
-	req = cl.Request("foobar", nil, dummy_reauthfunc) /* cl.Request */
+	req = cl.Request("foobar", "", nil, dummy_reauthfunc) /* cl.Request */
 	assert.NotNil(t, req)
 
 	rsp, err = req.Do(hreq)
 	assert.Error(t, err)
 }
+
+func TestApiRequestAuthIsolation(t *testing.T) {
+	cl, err := NewApiClient(Config{})
+	require.NoError(t, err)
+
+	var hostedHeaders, onpremHeaders []string
+	hosted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostedHeaders = append(hostedHeaders, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer hosted.Close()
+	onprem := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		onpremHeaders = append(onpremHeaders, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer onprem" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer onprem.Close()
+
+	servers := []MenderServer{{ServerURL: hosted.URL}, {ServerURL: onprem.URL}}
+	idx := 0
+	nextServer := func() *MenderServer {
+		if idx == len(servers) {
+			idx = 0
+			return nil
+		}
+		idx++
+		return &servers[idx-1]
+	}
+	var reauths []string
+	reauth := func(url string) (AuthToken, error) {
+		reauths = append(reauths, url)
+		if url == onprem.URL {
+			return "onprem", nil
+		}
+		return EmptyAuthToken, errors.New("server unavailable")
+	}
+
+	// The token of Hosted Mender is replaced with one of the on-prem
+	// server before failing over.
+	req := cl.Request("hosted", hosted.URL, nextServer, reauth)
+	hreq, _ := http.NewRequest(http.MethodGet, hosted.URL, nil)
+	rsp, err := req.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, []string{onprem.URL}, reauths)
+
+	// The token of the on-prem server is not sent to Hosted Mender; the
+	// token of each server is kept, so failing over again does not
+	// authorize with either of them.
+	hreq, _ = http.NewRequest(http.MethodGet, hosted.URL, nil)
+	rsp, err = req.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, []string{onprem.URL}, reauths)
+
+	assert.Equal(t, []string{"Bearer hosted", "Bearer hosted"}, hostedHeaders)
+	assert.Equal(t, []string{"Bearer onprem", "Bearer onprem"}, onpremHeaders)
+
+	// Tokens issued by the servers earlier are used from the start.
+	hostedHeaders, onpremHeaders, reauths = nil, nil, nil
+	req = cl.Request("hosted", hosted.URL, nextServer, reauth).
+		WithServerTokens(map[string]AuthToken{onprem.URL: "onprem"})
+	hreq, _ = http.NewRequest(http.MethodGet, hosted.URL, nil)
+	rsp, err = req.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Empty(t, reauths)
+	assert.Equal(t, []string{"Bearer hosted"}, hostedHeaders)
+	assert.Equal(t, []string{"Bearer onprem"}, onpremHeaders)
+}
+
+func TestApiRequestFailoverAddressing(t *testing.T) {
+	cl, err := NewApiClient(Config{})
+	require.NoError(t, err)
+
+	var paths, headers []string
+	onprem := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		headers = append(headers, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer onprem.Close()
+
+	// The request is addressed to an https server which is down; the
+	// on-prem server is reached over http, and with its own token.
+	servers := []MenderServer{
+		{ServerURL: "https://127.0.0.1:1"},
+		{ServerURL: onprem.URL + "/"},
+	}
+	idx := 0
+	nextServer := func() *MenderServer {
+		if idx == len(servers) {
+			idx = 0
+			return nil
+		}
+		idx++
+		return &servers[idx-1]
+	}
+	var reauths []string
+	reauth := func(url string) (AuthToken, error) {
+		reauths = append(reauths, url)
+		return AuthToken("token of " + url), nil
+	}
+
+	req := cl.Request("hosted", "https://127.0.0.1:1", nextServer, reauth)
+	hreq, _ := http.NewRequest(http.MethodGet,
+		"https://127.0.0.1:1/api/devices/v1/inventory/device/attributes", nil)
+	rsp, err := req.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, []string{onprem.URL + "/"}, reauths)
+	assert.Equal(t, []string{"/api/devices/v1/inventory/device/attributes"}, paths)
+	assert.Equal(t, []string{"Bearer token of " + onprem.URL + "/"}, headers)
+	assert.Equal(t, "http", hreq.URL.Scheme)
+
+	req = cl.Request("hosted", "", func() *MenderServer { return nil }, reauth)
+	_, err = req.Do(hreq)
+	assert.Error(t, err)
+}
+
+func TestApiRequestPathPrefix(t *testing.T) {
+	cl, err := NewApiClient(Config{})
+	require.NoError(t, err)
+
+	var paths []string
+	handler := func(status int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.URL.Path)
+			w.WriteHeader(status)
+		})
+	}
+	proxied := httptest.NewServer(handler(http.StatusBadGateway))
+	defer proxied.Close()
+	root := httptest.NewServer(handler(http.StatusOK))
+	defer root.Close()
+
+	// The first server is behind a reverse proxy under /mender/, the other
+	// one is not.
+	servers := []MenderServer{
+		{ServerURL: proxied.URL + "/mender/"},
+		{ServerURL: root.URL},
+	}
+	idx := 0
+	nextServer := func() *MenderServer {
+		if idx == len(servers) {
+			idx = 0
+			return nil
+		}
+		idx++
+		return &servers[idx-1]
+	}
+
+	req := cl.Request("token", "", nextServer, nil)
+	hreq, err := makeInventorySubmitRequest(servers[0].ServerURL, nil)
+	require.NoError(t, err)
+	rsp, err := req.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, []string{
+		"/mender/api/devices/v1/inventory/device/attributes",
+		"/api/devices/v1/inventory/device/attributes",
+	}, paths)
+
+	// A request made for the server behind the proxy loses the prefix
+	// when sent to the other one.
+	paths = nil
+	servers[0], servers[1] = servers[1], servers[0]
+	hreq, err = makeInventorySubmitRequest(servers[1].ServerURL, nil)
+	require.NoError(t, err)
+	_, err = req.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/api/devices/v1/inventory/device/attributes"}, paths)
+}
+
+func TestServerHost(t *testing.T) {
+	assert.Equal(t, "mender.example.com", serverHost("https://mender.example.com"))
+	assert.Equal(t, "mender.example.com:8443", serverHost("https://mender.example.com:8443/"))
+	assert.Equal(t, "mender.example.com", serverHost("mender.example.com/mender"))
+}
+
+func TestNewWithServers(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	certFile := path.Join(tdir, "onprem.crt")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ts.Certificate().Raw,
+	}), 0600))
+
+	// Only the on-prem server trusts the certificate of the test server.
+	cl, err := NewWithServers(Config{}, []MenderServer{
+		{ServerURL: "https://hosted.mender.io"},
+		{ServerURL: ts.URL, ServerCertificate: certFile},
+	})
+	require.NoError(t, err)
+	assert.Len(t, cl.servers, 1)
+
+	hreq, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	rsp, err := cl.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	hreq, _ = http.NewRequest(http.MethodGet, ts.URL, nil)
+	_, err = cl.Client.Do(hreq)
+	assert.Error(t, err)
+
+	_, err = NewWithServers(Config{}, []MenderServer{
+		{ServerURL: ts.URL, ServerCertificate: path.Join(tdir, "missing.crt")},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot initialize server trust")
+}
+
+func TestApiClientRequestRefreshesExpiringToken(t *testing.T) {
+	cl, err := NewApiClient(Config{})
+	require.NoError(t, err)
+
+	var authHeaders []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	expiring := makeTestJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Minute).Unix()))
+	fresh := makeTestJWT(fmt.Sprintf(`{"exp":%d}`, time.Now().Add(time.Hour).Unix()))
+
+	var reauthErr error
+	reauths := 0
+	reauth := func(url string) (AuthToken, error) {
+		reauths++
+		assert.Equal(t, ts.URL, url)
+		if reauthErr != nil {
+			return EmptyAuthToken, reauthErr
+		}
+		return fresh, nil
+	}
+
+	// Failing to reauthorize sends the request with the current token,
+	// which is still valid.
+	reauthErr = errors.New("server unreachable")
+	hreq, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	rsp, err := cl.Request(expiring, "", dummy_srvMngmntFunc(ts.URL), reauth).Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, 1, reauths)
+
+	// Reauthorizes before the request is sent, without a 401 first.
+	reauthErr = nil
+	req := cl.Request(expiring, "", dummy_srvMngmntFunc(ts.URL), reauth)
+	hreq, _ = http.NewRequest(http.MethodGet, ts.URL, nil)
+	rsp, err = req.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, 2, reauths)
+
+	// The new token is used from then on.
+	hreq, _ = http.NewRequest(http.MethodGet, ts.URL, nil)
+	_, err = req.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, 2, reauths)
+
+	// An Authorization header set by the caller is left alone.
+	hreq, _ = http.NewRequest(http.MethodGet, ts.URL, nil)
+	hreq.Header.Set("Authorization", "Bearer other")
+	_, err = cl.Request(expiring, "", dummy_srvMngmntFunc(ts.URL), reauth).Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, 2, reauths)
+
+	assert.Equal(t, []string{
+		"Bearer " + string(expiring),
+		"Bearer " + string(fresh),
+		"Bearer " + string(fresh),
+		"Bearer other",
+	}, authHeaders)
+}
@@ -20,6 +20,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/mendersoftware/log"
@@ -34,14 +36,48 @@ const (
 type Updater interface {
 	GetScheduledUpdate(api ApiRequester, server string, current CurrentUpdate) (interface{}, error)
 	FetchUpdate(api ApiRequester, url string, maxWait time.Duration) (io.ReadCloser, int64, error)
+	// PollHints returns the poll interval hints of the last update check
+	// response, or nil if it had none.
+	PollHints() *PollHints
 }
 
 var (
 	ErrNotAuthorized = errors.New("client not authorized")
 )
 
+// Headers of deployments/next responses with which the server can
+// temporarily adjust how often devices check in, e.g. during incidents. The
+// intervals and the time to live are given in seconds.
+const (
+	UpdatePollIntervalHeader    = "X-Mender-Update-Poll-Interval"
+	InventoryPollIntervalHeader = "X-Mender-Inventory-Poll-Interval"
+	PollHintsTTLHeader          = "X-Mender-Poll-Hints-TTL"
+
+	// How long hints apply if the server does not say.
+	DefaultPollHintsTTL = time.Hour
+)
+
+// How long a server found not to support the v2 deployments API is asked
+// with the v1 API only, before v2 is tried again, in case it was upgraded.
+const v1OnlyRecheckInterval = 24 * time.Hour
+
+// PollHints are poll intervals suggested by the server, overriding the
+// configured ones for TTL. Zero intervals are not overridden.
+type PollHints struct {
+	UpdatePollInterval    time.Duration
+	InventoryPollInterval time.Duration
+	TTL                   time.Duration
+}
+
 type UpdateClient struct {
 	minImageSize int64
+
+	hintsLock sync.Mutex
+	hints     *PollHints
+
+	// When each server was found not to support the v2 deployments API.
+	v1OnlyLock sync.Mutex
+	v1Only     map[string]time.Time
 }
 
 func NewUpdate() *UpdateClient {
@@ -56,6 +92,10 @@ func NewUpdate() *UpdateClient {
 type CurrentUpdate struct {
 	Artifact   string
 	DeviceType string
+	// Provides of the currently installed artifact. These are only sent to
+	// servers supporting the v2 deployments API, which uses them for
+	// matching the depends of the artifacts.
+	Provides map[string]string
 }
 
 func (u *UpdateClient) GetScheduledUpdate(api ApiRequester, server string,
@@ -66,34 +106,124 @@ func (u *UpdateClient) GetScheduledUpdate(api ApiRequester, server string,
 
 func (u *UpdateClient) getUpdateInfo(api ApiRequester, process RequestProcessingFunc,
 	server string, current CurrentUpdate) (interface{}, error) {
-	req, err := makeUpdateCheckRequest(server, current)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create update check request")
+	var req *http.Request
+	var r *http.Response
+	var err error
+	if !u.isV1Only(server) {
+		req, err = makeUpdateCheckRequestV2(server, current)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create update check request")
+		}
+		r, err = api.Do(req)
+		if err == nil && r.StatusCode == http.StatusNotFound {
+			// Older servers do not support the v2 API; fall back to
+			// v1, and keep using it for a while.
+			log.Debug("deployments/next v2 API not supported by the server, " +
+				"falling back to v1")
+			r.Body.Close()
+			r = nil
+			u.setV1Only(server)
+		}
 	}
 
-	r, err := api.Do(req)
+	if err == nil && r == nil {
+		req, err = makeUpdateCheckRequest(server, current)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create update check request")
+		}
+		r, err = api.Do(req)
+	}
 
 	if err != nil {
 		log.Debug("Sending request error: ", err)
-		return nil, errors.Wrapf(err, "update check request failed")
+		return nil, newRequestError(err, "update check request failed")
 	}
 
 	defer r.Body.Close()
 
+	u.hintsLock.Lock()
+	u.hints = ParsePollHints(r.Header)
+	u.hintsLock.Unlock()
+
 	respdata, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to read the request body")
+		return nil, &TransientNetworkError{errors.Wrap(err, "failed to read the request body")}
+	}
+
+	if r.StatusCode == http.StatusOK {
+		if err := checkIntercepted(r, respdata); err != nil {
+			return nil, err
+		}
 	}
 
 	r.Body = ioutil.NopCloser(bytes.NewReader(respdata))
 	data, err := process(r)
 	if err != nil {
 		r.Body = ioutil.NopCloser(bytes.NewReader(respdata))
-		return data, NewAPIError(err, r)
+		return data, newResponseError(err, r)
 	}
 	return data, err
 }
 
+// isV1Only returns whether the server recently turned out not to support the
+// v2 deployments API.
+func (u *UpdateClient) isV1Only(server string) bool {
+	u.v1OnlyLock.Lock()
+	defer u.v1OnlyLock.Unlock()
+	since, ok := u.v1Only[server]
+	if ok && time.Since(since) >= v1OnlyRecheckInterval {
+		delete(u.v1Only, server)
+		return false
+	}
+	return ok
+}
+
+func (u *UpdateClient) setV1Only(server string) {
+	u.v1OnlyLock.Lock()
+	defer u.v1OnlyLock.Unlock()
+	if u.v1Only == nil {
+		u.v1Only = make(map[string]time.Time)
+	}
+	u.v1Only[server] = time.Now()
+}
+
+func (u *UpdateClient) PollHints() *PollHints {
+	u.hintsLock.Lock()
+	defer u.hintsLock.Unlock()
+	return u.hints
+}
+
+// ParsePollHints returns the poll interval hints in the response headers, or
+// nil if there are none. Values which are not positive numbers of seconds are
+// ignored.
+func ParsePollHints(header http.Header) *PollHints {
+	parse := func(name string) time.Duration {
+		value := header.Get(name)
+		if value == "" {
+			return 0
+		}
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			log.Warnf("Ignoring invalid %s header: %q", name, value)
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	hints := PollHints{
+		UpdatePollInterval:    parse(UpdatePollIntervalHeader),
+		InventoryPollInterval: parse(InventoryPollIntervalHeader),
+	}
+	if hints.UpdatePollInterval == 0 && hints.InventoryPollInterval == 0 {
+		return nil
+	}
+	hints.TTL = parse(PollHintsTTLHeader)
+	if hints.TTL == 0 {
+		hints.TTL = DefaultPollHintsTTL
+	}
+	return &hints
+}
+
 // FetchUpdate returns a byte stream which is a download of the given link.
 func (u *UpdateClient) FetchUpdate(api ApiRequester, url string, maxWait time.Duration) (io.ReadCloser, int64, error) {
 	req, err := makeUpdateFetchRequest(url)
@@ -104,24 +234,29 @@ func (u *UpdateClient) FetchUpdate(api ApiRequester, url string, maxWait time.Du
 	r, err := api.Do(req)
 	if err != nil {
 		log.Error("Can not fetch update image: ", err)
-		return nil, -1, errors.Wrapf(err, "update fetch request failed")
+		return nil, -1, newRequestError(err, "update fetch request failed")
 	}
 
 	log.Debugf("Received fetch update response %v+", r)
 
+	if err := checkDeploymentAborted(r); err != nil {
+		r.Body.Close()
+		return nil, -1, err
+	}
+
 	if r.StatusCode != http.StatusOK {
 		r.Body.Close()
 		log.Errorf("Error fetching shcheduled update info: code (%d)", r.StatusCode)
-		return nil, -1, NewAPIError(errors.New("error receiving scheduled update information"), r)
+		return nil, -1, newResponseError(errors.New("error receiving scheduled update information"), r)
 	}
 
 	if r.ContentLength < 0 {
 		r.Body.Close()
-		return nil, -1, errors.New("Will not continue with unknown image size.")
+		return nil, -1, &FatalError{errors.New("Will not continue with unknown image size.")}
 	} else if r.ContentLength < u.minImageSize {
 		r.Body.Close()
 		log.Errorf("Image smaller than expected. Expected: %d, received: %d", u.minImageSize, r.ContentLength)
-		return nil, -1, errors.New("Image size is smaller than expected. Aborting.")
+		return nil, -1, &FatalError{errors.New("Image size is smaller than expected. Aborting.")}
 	}
 
 	return NewUpdateResumer(r.Body, r.ContentLength, maxWait, api, req), r.ContentLength, nil
@@ -136,6 +271,10 @@ func validateGetUpdate(update datastore.UpdateInfo) error {
 		return errors.New("Missing parameters in encoded JSON update response")
 	}
 
+	if err := update.UpdateControlMap.Validate(); err != nil {
+		return errors.Wrap(err, "Invalid update control map in update response")
+	}
+
 	log.Infof("Correct request for getting image from: %s [name: %v; devices: %v]",
 		update.Artifact.Source.URI,
 		update.ArtifactName(),
@@ -174,6 +313,9 @@ func processUpdateResponse(response *http.Response) (interface{}, error) {
 		log.Warn("Client not authorized to get update schedule.")
 		return nil, ErrNotAuthorized
 
+	case http.StatusConflict:
+		return nil, checkDeploymentAborted(response)
+
 	default:
 		log.Warn("Client received invalid response status code: ", response.StatusCode)
 		return nil, errors.New("Invalid response received from server")
@@ -201,6 +343,38 @@ func makeUpdateCheckRequest(server string, current CurrentUpdate) (*http.Request
 	return req, nil
 }
 
+// makeUpdateCheckRequestV2 creates a request for the v2 deployments/next API,
+// which takes the full set of provides of the device in the request body.
+func makeUpdateCheckRequestV2(server string, current CurrentUpdate) (*http.Request, error) {
+	provides := make(map[string]string, len(current.Provides)+2)
+	for key, val := range current.Provides {
+		provides[key] = val
+	}
+	if current.DeviceType != "" {
+		provides["device_type"] = current.DeviceType
+	}
+	if current.Artifact != "" {
+		provides["artifact_name"] = current.Artifact
+	}
+
+	body, err := json.Marshal(struct {
+		DeviceProvides map[string]string `json:"device_provides"`
+	}{
+		DeviceProvides: provides,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode update check request data")
+	}
+
+	url := buildApiV2URL(server, "/deployments/device/deployments/next")
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	return req, nil
+}
+
 func makeUpdateFetchRequest(url string) (*http.Request, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
@@ -17,6 +17,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -124,6 +125,7 @@ var updateTest = []struct {
 	{500, []byte(`{
 	"error": "Invalid request"
 	}`), true, false, 0},
+	{409, []byte(""), true, true, http.StatusConflict},
 	{200, []byte(malformedUpdateResponse), true, false, 0},
 	{200, []byte(missingDevicesUpdateResponse), true, false, 0},
 	{200, []byte(missingNameUpdateResponse), true, false, 0},
@@ -181,7 +183,7 @@ func Test_GetScheduledUpdate_errorParsingResponse_UpdateFailing(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -206,7 +208,7 @@ func Test_GetScheduledUpdate_responseMissingParameters_UpdateFailing(t *testing.
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -230,7 +232,7 @@ func Test_GetScheduledUpdate_ParsingResponseOK_updateSuccess(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -256,7 +258,7 @@ func Test_FetchUpdate_noContent_UpdateFailing(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -279,7 +281,7 @@ func Test_FetchUpdate_invalidRequest_UpdateFailing(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -302,7 +304,7 @@ func Test_FetchUpdate_correctContent_UpdateFetched(t *testing.T) {
 	defer ts.Close()
 
 	ac, err := NewApiClient(
-		Config{"server.crt", true, false},
+		Config{ServerCert: "server.crt", IsHttps: true},
 	)
 	assert.NotNil(t, ac)
 	assert.NoError(t, err)
@@ -315,6 +317,23 @@ func Test_FetchUpdate_correctContent_UpdateFetched(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func Test_FetchUpdate_deploymentAborted_UpdateFailing(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(
+		Config{ServerCert: "server.crt", IsHttps: true},
+	)
+	assert.NotNil(t, ac)
+	assert.NoError(t, err)
+
+	client := NewUpdate()
+	_, _, err = client.FetchUpdate(ac, ts.URL, 1*time.Minute)
+	assert.True(t, IsDeploymentAborted(err))
+}
+
 func Test_UpdateApiClientError(t *testing.T) {
 	client := NewUpdate()
 
@@ -357,3 +376,176 @@ func TestMakeUpdateCheckRequest(t *testing.T) {
 		req.URL.String())
 	t.Logf("%s\n", req.URL.String())
 }
+
+func TestMakeUpdateCheckRequestV2(t *testing.T) {
+	req, err := makeUpdateCheckRequestV2("http://foo.bar", CurrentUpdate{
+		Artifact:   "foo",
+		DeviceType: "hammer",
+		Provides: map[string]string{
+			"artifact_group":        "tools",
+			"rootfs-image.checksum": "abcdef",
+		},
+	})
+	assert.NotNil(t, req)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "http://foo.bar/api/devices/v2/deployments/device/deployments/next",
+		req.URL.String())
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"device_provides": {
+		"artifact_name": "foo",
+		"device_type": "hammer",
+		"artifact_group": "tools",
+		"rootfs-image.checksum": "abcdef"}}`, string(body))
+}
+
+func Test_GetScheduledUpdate_V1Fallback(t *testing.T) {
+	var paths []string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		if strings.HasPrefix(r.URL.Path, apiPrefixV2) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, correctUpdateResponse)
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(
+		Config{ServerCert: "server.crt", IsHttps: true},
+	)
+	assert.NoError(t, err)
+
+	client := NewUpdate()
+	data, err := client.GetScheduledUpdate(ac, ts.URL, CurrentUpdate{
+		Artifact:   "foo",
+		DeviceType: "hammer",
+	})
+	assert.NoError(t, err)
+	update, ok := data.(datastore.UpdateInfo)
+	assert.True(t, ok)
+	assert.Equal(t, "deployment-123", update.ID)
+	assert.Equal(t, []string{
+		"POST /api/devices/v2/deployments/device/deployments/next",
+		"GET /api/devices/v1/deployments/device/deployments/next",
+	}, paths)
+
+	// The server is remembered not to support v2.
+	paths = nil
+	_, err = client.GetScheduledUpdate(ac, ts.URL, CurrentUpdate{
+		Artifact:   "foo",
+		DeviceType: "hammer",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"GET /api/devices/v1/deployments/device/deployments/next",
+	}, paths)
+
+	// Until it is time to check whether it has been upgraded.
+	client.v1Only[ts.URL] = time.Now().Add(-v1OnlyRecheckInterval)
+	paths = nil
+	_, err = client.GetScheduledUpdate(ac, ts.URL, CurrentUpdate{
+		Artifact:   "foo",
+		DeviceType: "hammer",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"POST /api/devices/v2/deployments/device/deployments/next",
+		"GET /api/devices/v1/deployments/device/deployments/next",
+	}, paths)
+}
+
+func TestParsePollHints(t *testing.T) {
+	tests := map[string]struct {
+		headers map[string]string
+		hints   *PollHints
+	}{
+		"none": {},
+		"update only": {
+			headers: map[string]string{UpdatePollIntervalHeader: "60"},
+			hints: &PollHints{
+				UpdatePollInterval: time.Minute,
+				TTL:                DefaultPollHintsTTL,
+			},
+		},
+		"all": {
+			headers: map[string]string{
+				UpdatePollIntervalHeader:    "3600",
+				InventoryPollIntervalHeader: "7200",
+				PollHintsTTLHeader:          "600",
+			},
+			hints: &PollHints{
+				UpdatePollInterval:    time.Hour,
+				InventoryPollInterval: 2 * time.Hour,
+				TTL:                   10 * time.Minute,
+			},
+		},
+		"invalid": {
+			headers: map[string]string{
+				UpdatePollIntervalHeader:    "soon",
+				InventoryPollIntervalHeader: "-5",
+			},
+		},
+		"ttl only": {
+			headers: map[string]string{PollHintsTTLHeader: "600"},
+		},
+		"invalid ttl": {
+			headers: map[string]string{
+				InventoryPollIntervalHeader: "120",
+				PollHintsTTLHeader:          "0",
+			},
+			hints: &PollHints{
+				InventoryPollInterval: 2 * time.Minute,
+				TTL:                   DefaultPollHintsTTL,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range test.headers {
+				header.Set(k, v)
+			}
+			assert.Equal(t, test.hints, ParsePollHints(header))
+		})
+	}
+}
+
+func TestGetScheduledUpdatePollHints(t *testing.T) {
+	var hint string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hint != "" {
+			w.Header().Set(UpdatePollIntervalHeader, hint)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	ac, err := NewApiClient(Config{})
+	assert.NoError(t, err)
+
+	client := NewUpdate()
+	assert.Nil(t, client.PollHints())
+
+	hint = "300"
+	data, err := client.GetScheduledUpdate(ac, ts.URL, CurrentUpdate{})
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	assert.Equal(t, &PollHints{
+		UpdatePollInterval: 5 * time.Minute,
+		TTL:                DefaultPollHintsTTL,
+	}, client.PollHints())
+
+	// Only the hints of the last response are returned.
+	hint = ""
+	_, err = client.GetScheduledUpdate(ac, ts.URL, CurrentUpdate{})
+	assert.NoError(t, err)
+	assert.Nil(t, client.PollHints())
+}
@@ -0,0 +1,47 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// contextRequester sends all the requests with a context, so that they can
+// be cancelled, including the reading of their response bodies.
+type contextRequester struct {
+	api ApiRequester
+	ctx context.Context
+}
+
+// WithContext returns an ApiRequester sending the requests of api with ctx.
+// Once ctx is done, requests in progress fail, as do the reads of their
+// response bodies, and new requests are not sent. The client functions taking
+// an ApiRequester, such as the update, status, log, inventory and
+// authorization requests, are all cancelled this way.
+func WithContext(api ApiRequester, ctx context.Context) ApiRequester {
+	return &contextRequester{api: api, ctx: ctx}
+}
+
+func (c *contextRequester) Do(req *http.Request) (*http.Response, error) {
+	return c.api.Do(req.WithContext(c.ctx))
+}
+
+// requestContext returns the context the requests of api are sent with.
+func requestContext(api ApiRequester) context.Context {
+	if c, ok := api.(*contextRequester); ok {
+		return c.ctx
+	}
+	return context.Background()
+}
@@ -0,0 +1,273 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"crypto/x509"
+	"mime"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// The errors returned by the client calls are of the types below, which tell
+// the callers whether to retry, to authorize again, or to give up. They wrap
+// the errors they classify, so errors.Cause still returns ErrNotAuthorized,
+// ErrDeploymentAborted and the like.
+
+// AuthError is returned when the server does not accept the authorization
+// of the device; the device must authorize again.
+type AuthError struct {
+	error
+}
+
+func (e *AuthError) Cause() error {
+	return e.error
+}
+
+// TransientNetworkError is returned when the server could not be reached,
+// or the connection failed; the request may succeed if retried later.
+type TransientNetworkError struct {
+	error
+}
+
+func (e *TransientNetworkError) Cause() error {
+	return e.error
+}
+
+// ServerError is returned when the server answers with an error status,
+// other than those of the errors above.
+type ServerError struct {
+	error
+	// The HTTP status of the response.
+	Code int
+}
+
+func (e *ServerError) Cause() error {
+	return e.error
+}
+
+// Temporary returns whether the request may succeed if retried later.
+func (e *ServerError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
+
+// AbortedError is returned when the server rejects a request of a
+// deployment, as the deployment was aborted.
+type AbortedError struct {
+	error
+}
+
+func (e *AbortedError) Cause() error {
+	return e.error
+}
+
+// InterceptedError is returned when the response did not come from the
+// server, but from a captive portal or a filtering proxy intercepting the
+// connection: a web page where the server answers with JSON or a token, or a
+// redirection to another host. The request may succeed once the network lets
+// the device through; until then the network, not the server, is at fault.
+type InterceptedError struct {
+	error
+}
+
+func (e *InterceptedError) Cause() error {
+	return e.error
+}
+
+// FatalError is returned when retrying the request would not help, such as
+// when the certificate of the server is not trusted, or the server sends a
+// response which can not be used.
+type FatalError struct {
+	error
+}
+
+func (e *FatalError) Cause() error {
+	return e.error
+}
+
+// findError returns the first error in the chain of causes of err which
+// matches. The chain is followed through the errors of this package and of
+// github.com/pkg/errors, and through those of the standard library, such as
+// url.Error, which wrap others.
+func findError(err error, match func(error) bool) error {
+	for err != nil {
+		if match(err) {
+			return err
+		}
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// IsAuthError returns whether the device must authorize again.
+func IsAuthError(err error) bool {
+	if cause := errors.Cause(err); cause == ErrNotAuthorized || cause == AuthErrorUnauthorized {
+		return true
+	}
+	return findError(err, func(e error) bool {
+		_, ok := e.(*AuthError)
+		return ok
+	}) != nil
+}
+
+// The codes of the errors, given in the "code" field of the error responses,
+// with which the server rejects the authorization of the device for good, as
+// the device was decommissioned or rejected, rather than because its token
+// expired, or it is not accepted yet. The error messages are meant for people,
+// and are not relied on.
+const (
+	ErrorCodeDeviceRejected       = "device_rejected"
+	ErrorCodeDeviceDecommissioned = "device_decommissioned"
+)
+
+// IsDeviceRejected returns whether the server rejected the authorization of
+// the device for good: with 401 Unauthorized, and one of the error codes
+// above.
+func IsDeviceRejected(err error) bool {
+	if !IsAuthError(err) {
+		return false
+	}
+	apiErr := findError(err, func(e error) bool {
+		_, ok := e.(*APIError)
+		return ok
+	})
+	if apiErr == nil {
+		return false
+	}
+	switch apiErr.(*APIError).serverErrCode {
+	case ErrorCodeDeviceRejected, ErrorCodeDeviceDecommissioned:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsTransientError returns whether the request may succeed if retried later.
+func IsTransientError(err error) bool {
+	return findError(err, func(e error) bool {
+		switch e := e.(type) {
+		case *TransientNetworkError, *InterceptedError:
+			return true
+		case *ServerError:
+			return e.Temporary()
+		}
+		return false
+	}) != nil
+}
+
+// IsInterceptedError returns whether the response came from a captive portal
+// or a proxy intercepting the connection, rather than from the server.
+func IsInterceptedError(err error) bool {
+	return findError(err, func(e error) bool {
+		_, ok := e.(*InterceptedError)
+		return ok
+	}) != nil
+}
+
+// IsFatalError returns whether retrying the request would not help.
+func IsFatalError(err error) bool {
+	return findError(err, func(e error) bool {
+		_, ok := e.(*FatalError)
+		return ok
+	}) != nil
+}
+
+// newRequestError classifies the error of sending a request, which did not
+// get a response: certificate errors are fatal, all others transient.
+func newRequestError(err error, message string) error {
+	wrapped := errors.Wrap(err, message)
+	if isCertificateError(err) {
+		return &FatalError{wrapped}
+	}
+	return &TransientNetworkError{wrapped}
+}
+
+func isCertificateError(err error) bool {
+	return findError(err, func(e error) bool {
+		switch e.(type) {
+		case x509.UnknownAuthorityError, x509.CertificateInvalidError,
+			x509.HostnameError, *ClientServerCertificateError:
+			return true
+		}
+		return false
+	}) != nil
+}
+
+// newResponseError classifies the error of a request by the status of its
+// response, which it is an APIError of.
+func newResponseError(err error, r *http.Response) error {
+	// Portals answer with their own pages, or redirect to them, whatever
+	// the request.
+	if r.StatusCode < 400 || redirectedHost(r) != "" {
+		if intercepted := checkIntercepted(r, nil); intercepted != nil {
+			return intercepted
+		}
+	}
+	apiErr := NewAPIError(err, r)
+	switch {
+	case r.StatusCode == http.StatusUnauthorized:
+		return &AuthError{apiErr}
+	case errors.Cause(err) == ErrDeploymentAborted:
+		return &AbortedError{apiErr}
+	case r.StatusCode >= 400:
+		return &ServerError{error: apiErr, Code: r.StatusCode}
+	default:
+		return &FatalError{apiErr}
+	}
+}
+
+// checkIntercepted returns an InterceptedError if the successful response r,
+// which the server answers with JSON or a token, does not seem to come from
+// the server: it was redirected to another host, or it is a web page. body is
+// the body of the response, or nil if it is not read.
+func checkIntercepted(r *http.Response, body []byte) error {
+	if host := redirectedHost(r); host != "" {
+		return &InterceptedError{NewAPIError(errors.Errorf(
+			"the request was redirected to %s; the network may require "+
+				"signing in to a captive portal", host), r)}
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/html" || mediaType == "application/xhtml+xml" ||
+		bytes.HasPrefix(bytes.TrimSpace(body), []byte("<")) {
+		return &InterceptedError{NewAPIError(errors.New(
+			"the response is a web page instead of an answer of the server; "+
+				"the network may require signing in to a captive portal"), r)}
+	}
+	return nil
+}
+
+// redirectedHost returns the host the request of r was redirected to, if it
+// is not the host it was sent to.
+func redirectedHost(r *http.Response) string {
+	if r.Request == nil {
+		return ""
+	}
+	first := r.Request
+	for first.Response != nil && first.Response.Request != nil {
+		first = first.Response.Request
+	}
+	if first.URL.Host == r.Request.URL.Host {
+		return ""
+	}
+	return r.Request.URL.Host
+}
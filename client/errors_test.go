@@ -0,0 +1,177 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func errorResponse(code int) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"error": "failed"}`)),
+	}
+}
+
+func TestResponseErrors(t *testing.T) {
+	err := newResponseError(ErrNotAuthorized, errorResponse(http.StatusUnauthorized))
+	assert.IsType(t, &AuthError{}, err)
+	assert.True(t, IsAuthError(errors.Wrap(err, "update check failed")))
+	assert.Equal(t, ErrNotAuthorized, errors.Cause(err))
+	assert.False(t, IsTransientError(err))
+	// The errors of the mocks of the clients.
+	assert.True(t, IsAuthError(AuthErrorUnauthorized))
+
+	err = newResponseError(ErrDeploymentAborted, errorResponse(http.StatusConflict))
+	assert.IsType(t, &AbortedError{}, err)
+	assert.True(t, IsDeploymentAborted(err))
+	assert.False(t, IsAuthError(err))
+
+	err = newResponseError(errors.New("bad status"), errorResponse(http.StatusServiceUnavailable))
+	require.IsType(t, &ServerError{}, err)
+	assert.Equal(t, http.StatusServiceUnavailable, err.(*ServerError).Code)
+	assert.True(t, IsTransientError(err))
+	assert.Contains(t, err.Error(), "server error message: failed")
+
+	err = newResponseError(errors.New("bad status"), errorResponse(http.StatusBadRequest))
+	assert.IsType(t, &ServerError{}, err)
+	assert.False(t, IsTransientError(err))
+	assert.False(t, IsFatalError(err))
+
+	err = newResponseError(errors.New("missing parameters"), errorResponse(http.StatusOK))
+	assert.True(t, IsFatalError(err))
+}
+
+func TestRequestErrors(t *testing.T) {
+	err := newRequestError(&url.Error{
+		Op:  "Post",
+		URL: "https://mender.example.com",
+		Err: x509.UnknownAuthorityError{},
+	}, "request failed")
+	assert.IsType(t, &FatalError{}, err)
+	assert.True(t, IsFatalError(err))
+	assert.False(t, IsTransientError(err))
+
+	err = newRequestError(&url.Error{
+		Op:  "Post",
+		URL: "https://mender.example.com",
+		Err: syscall.ECONNREFUSED,
+	}, "request failed")
+	assert.IsType(t, &TransientNetworkError{}, err)
+	assert.True(t, IsTransientError(err))
+	assert.Equal(t, syscall.ECONNREFUSED, errors.Cause(err).(*url.Error).Err)
+}
+
+func TestClientCallErrors(t *testing.T) {
+	status := http.StatusInternalServerError
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	client := NewInventory()
+	err := client.Submit(http.DefaultClient, ts.URL, nil)
+	require.IsType(t, &ServerError{}, err)
+	assert.Equal(t, http.StatusInternalServerError, err.(*ServerError).Code)
+
+	status = http.StatusUnauthorized
+	err = client.Submit(http.DefaultClient, ts.URL, nil)
+	assert.True(t, IsAuthError(err))
+
+	ts.Close()
+	err = client.Submit(http.DefaultClient, ts.URL, nil)
+	assert.IsType(t, &TransientNetworkError{}, err)
+}
+
+func TestInterceptedErrors(t *testing.T) {
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>Sign in to the guest network</body></html>"))
+	}))
+	defer portal.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, portal.URL+"/login", http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	client := NewInventory()
+	err := client.Submit(http.DefaultClient, portal.URL, nil)
+	require.IsType(t, &InterceptedError{}, err)
+	assert.True(t, IsInterceptedError(err))
+	assert.True(t, IsTransientError(err))
+	assert.False(t, IsFatalError(err))
+	assert.Contains(t, err.Error(), "captive portal")
+
+	err = client.Submit(http.DefaultClient, redirect.URL, nil)
+	require.IsType(t, &InterceptedError{}, err)
+	assert.Contains(t, err.Error(), "redirected to "+portal.Listener.Addr().String())
+
+	// A status report expects no content, and gets the page of the portal.
+	err = NewStatus().Report(http.DefaultClient, portal.URL,
+		StatusReport{DeploymentID: "1", Status: StatusSuccess})
+	assert.True(t, IsInterceptedError(err))
+
+	// Web pages as bodies of the errors of the server, or of reverse
+	// proxies in front of it, are errors of the server.
+	rsp := errorResponse(http.StatusBadGateway)
+	rsp.Header.Set("Content-Type", "text/html")
+	err = newResponseError(errors.New("bad status"), rsp)
+	assert.IsType(t, &ServerError{}, err)
+
+	rsp = errorResponse(http.StatusOK)
+	assert.NoError(t, checkIntercepted(rsp, []byte(`{"id": "1"}`)))
+	assert.Error(t, checkIntercepted(rsp, []byte("\n  <!DOCTYPE html>")))
+}
+
+func TestDeviceRejectedErrors(t *testing.T) {
+	rsp := func(status int, body string) *http.Response {
+		r := errorResponse(status)
+		r.Body = ioutil.NopCloser(bytes.NewBufferString(body))
+		return r
+	}
+
+	err := newResponseError(AuthErrorUnauthorized, rsp(http.StatusUnauthorized,
+		`{"error": "device decommissioned", "code": "device_decommissioned"}`))
+	assert.True(t, IsDeviceRejected(errors.Wrap(err, "authorization request failed")))
+	err = newResponseError(AuthErrorUnauthorized, rsp(http.StatusUnauthorized,
+		`{"error": "dev auth: unauthorized", "code": "device_rejected"}`))
+	assert.True(t, IsDeviceRejected(err))
+
+	// Devices which are not accepted yet, or whose token expired; the
+	// message alone does not count.
+	err = newResponseError(AuthErrorUnauthorized, rsp(http.StatusUnauthorized,
+		`{"error": "dev auth: unauthorized"}`))
+	assert.True(t, IsAuthError(err))
+	assert.False(t, IsDeviceRejected(err))
+	err = newResponseError(AuthErrorUnauthorized, rsp(http.StatusUnauthorized,
+		`{"error": "device rejected"}`))
+	assert.False(t, IsDeviceRejected(err))
+	assert.False(t, IsDeviceRejected(AuthErrorUnauthorized))
+
+	err = newResponseError(errors.New("bad status"), rsp(http.StatusForbidden,
+		`{"error": "device rejected", "code": "device_rejected"}`))
+	assert.False(t, IsDeviceRejected(err))
+}
@@ -0,0 +1,242 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// This file holds a minimal mDNS (RFC 6762) and DNS-SD (RFC 6763) browser,
+// enough to find the instances of a service on the local network. The query
+// is sent from an ephemeral port, so that responders answer it directly, as
+// a legacy unicast query.
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsClassIN  = 1
+)
+
+// Overridden in tests.
+var mdnsAddress = "224.0.0.251:5353"
+
+// DiscoverMDNSService returns the addresses, as host:port, of the instances
+// of the service, such as "_mender-cache._tcp", answering within the
+// timeout.
+func DiscoverMDNSService(service string, timeout time.Duration) ([]string, error) {
+	addr, err := net.ResolveUDPAddr("udp4", mdnsAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	name := strings.TrimSuffix(service, ".") + ".local."
+	if _, err = conn.WriteTo(mdnsQuery(name), addr); err != nil {
+		return nil, errors.Wrapf(err, "failed to send the mDNS query for %s", name)
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	records := &mdnsRecords{
+		srv:   map[string]string{},
+		addrs: map[string]net.IP{},
+	}
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		// Malformed responses are not ours to fix; skip them.
+		records.parse(buf[:n])
+	}
+	return records.instances(name), nil
+}
+
+// mdnsQuery returns a query of the PTR records of the name.
+func mdnsQuery(name string) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, dnsTypePTR, 0, dnsClassIN)
+	return msg
+}
+
+// mdnsRecords are the records of the responses relevant to finding the
+// instances of a service.
+type mdnsRecords struct {
+	ptr []struct{ name, instance string }
+	// host:port of each instance
+	srv map[string]string
+	// address of each host
+	addrs map[string]net.IP
+}
+
+func (m *mdnsRecords) parse(msg []byte) error {
+	if len(msg) < 12 {
+		return errors.New("short DNS message")
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < questions; i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return err
+		}
+		off = next + 4
+	}
+	for i := 0; i < records; i++ {
+		next, err := m.parseRecord(msg, off)
+		if err != nil {
+			return err
+		}
+		off = next
+	}
+	return nil
+}
+
+// parseRecord parses the resource record at the offset of the message,
+// returning the offset following it.
+func (m *mdnsRecords) parseRecord(msg []byte, off int) (int, error) {
+	name, next, err := readDNSName(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	if next+10 > len(msg) {
+		return 0, errors.New("short DNS record")
+	}
+	rrType := binary.BigEndian.Uint16(msg[next:])
+	length := int(binary.BigEndian.Uint16(msg[next+8:]))
+	data := next + 10
+	if data+length > len(msg) {
+		return 0, errors.New("short DNS record")
+	}
+	return data + length, m.addRecord(strings.ToLower(name), rrType, msg, data, length)
+}
+
+// addRecord records the data of the PTR, SRV, A and AAAA records, which is
+// the length bytes at the data offset of the message.
+func (m *mdnsRecords) addRecord(name string, rrType uint16, msg []byte,
+	data, length int) error {
+
+	switch rrType {
+	case dnsTypePTR:
+		instance, _, err := readDNSName(msg, data)
+		if err != nil {
+			return err
+		}
+		m.ptr = append(m.ptr, struct{ name, instance string }{name, instance})
+	case dnsTypeSRV:
+		if length < 7 {
+			return errors.New("short SRV record")
+		}
+		target, _, err := readDNSName(msg, data+6)
+		if err != nil {
+			return err
+		}
+		port := binary.BigEndian.Uint16(msg[data+4:])
+		m.srv[name] = strings.ToLower(target) + ":" + strconv.Itoa(int(port))
+	case dnsTypeA, dnsTypeAAAA:
+		if length == net.IPv4len || length == net.IPv6len {
+			// IPv4 addresses are preferred.
+			if ip, ok := m.addrs[name]; !ok || ip.To4() == nil {
+				m.addrs[name] = net.IP(msg[data : data+length])
+			}
+		}
+	}
+	return nil
+}
+
+// instances returns the addresses of the instances of the service found.
+func (m *mdnsRecords) instances(service string) []string {
+	var addrs []string
+	seen := map[string]bool{}
+	for _, ptr := range m.ptr {
+		if ptr.name != strings.ToLower(service) {
+			continue
+		}
+		hostPort, ok := m.srv[strings.ToLower(ptr.instance)]
+		if !ok {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(hostPort)
+		if ip, ok := m.addrs[host]; ok {
+			hostPort = net.JoinHostPort(ip.String(), port)
+		}
+		if !seen[hostPort] {
+			seen[hostPort] = true
+			addrs = append(addrs, hostPort)
+		}
+	}
+	return addrs
+}
+
+// readDNSName reads the possibly compressed name at the offset of the
+// message, returning it and the offset following it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("short DNS name")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("short DNS name")
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("DNS name compression loop")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errors.New("short DNS name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func dnsRecord(name []byte, rrType uint16, data []byte) []byte {
+	rr := append([]byte{}, name...)
+	fixed := make([]byte, 10)
+	binary.BigEndian.PutUint16(fixed, rrType)
+	binary.BigEndian.PutUint16(fixed[2:], dnsClassIN)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(data)))
+	return append(append(rr, fixed...), data...)
+}
+
+// mdnsTestResponse answers the query of _mender-cache._tcp.local with one
+// instance, using name compression like responders do.
+func mdnsTestResponse() []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400)
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	binary.BigEndian.PutUint16(msg[10:], 2)
+
+	// The service name is at offset 12, pointed to by the instance name.
+	service := dnsName("_mender-cache._tcp.local.")
+	instance := append(dnsName("gateway")[:8], 0xC0, 12)
+	msg = append(msg, dnsRecord(service, dnsTypePTR, instance)...)
+
+	srv := []byte{0, 0, 0, 0, 0x1F, 0x90}
+	srv = append(srv, dnsName("Gateway.local.")...)
+	msg = append(msg, dnsRecord(instance, dnsTypeSRV, srv)...)
+	msg = append(msg, dnsRecord(dnsName("gateway.local."), dnsTypeA,
+		[]byte{192, 168, 1, 10})...)
+	return msg
+}
+
+func TestMDNSRecords(t *testing.T) {
+	records := &mdnsRecords{srv: map[string]string{}, addrs: map[string]net.IP{}}
+	require.NoError(t, records.parse(mdnsTestResponse()))
+	assert.Equal(t, []string{"192.168.1.10:8080"},
+		records.instances("_mender-cache._tcp.local."))
+	assert.Empty(t, records.instances("_other._tcp.local."))
+
+	for _, msg := range [][]byte{
+		nil,
+		mdnsTestResponse()[:40],
+		// compression loop
+		append(append(make([]byte, 4), 0, 1, 0, 0, 0, 0, 0, 0), 0xC0, 12),
+	} {
+		records := &mdnsRecords{srv: map[string]string{}, addrs: map[string]net.IP{}}
+		assert.Error(t, records.parse(msg))
+	}
+}
+
+func TestDiscoverMDNSService(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if bytes.Equal(buf[:n], mdnsQuery("_mender-cache._tcp.local.")) {
+			conn.WriteTo(mdnsTestResponse(), addr)
+		}
+	}()
+
+	old := mdnsAddress
+	defer func() { mdnsAddress = old }()
+	mdnsAddress = conn.LocalAddr().String()
+
+	found, err := DiscoverMDNSService("_mender-cache._tcp", 500*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.168.1.10:8080"}, found)
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Artifacts are fetched from mirrors at <mirror URL>/<artifact name> plus
+// this suffix, the name of the artifacts kept in an artifact cache.
+const MirrorArtifactSuffix = ".mender"
+
+// The manifest is among the first entries of the artifact; reading more than
+// this to find it means the artifact is not a valid one.
+const maxManifestOffset = 1024 * 1024
+
+var ErrManifestMismatch = errors.New("the manifest of the artifact of the mirror " +
+	"is not that of the artifact of the server")
+
+// ReadArtifactManifest reads the artifact up to the end of its manifest,
+// returning what was read, for the artifact to be read again from the start,
+// and the manifest. The manifest lists the checksums of all the other files
+// of the artifact, which are verified against it when the artifact is
+// installed, so artifacts with the same manifest have the same content.
+func ReadArtifactManifest(r io.Reader) ([]byte, []byte, error) {
+	read := new(bytes.Buffer)
+	tr := tar.NewReader(io.TeeReader(io.LimitReader(r, maxManifestOffset), read))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil, errors.New("the artifact has no manifest")
+		} else if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read the artifact")
+		}
+		if hdr.Name != "manifest" {
+			continue
+		}
+		manifest, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to read the artifact manifest")
+		}
+		return read.Bytes(), manifest, nil
+	}
+}
+
+// FetchMirroredUpdate fetches the artifact with the given name from a mirror,
+// and returns it if it has the given manifest, that of the artifact of the
+// server. Like artifacts from the server, the download is resumed if it is
+// interrupted.
+func FetchMirroredUpdate(c *http.Client, mirror, artifactName string,
+	manifest []byte, maxWait time.Duration) (io.ReadCloser, int64, error) {
+
+	location := strings.TrimSuffix(mirror, "/") + "/" +
+		url.PathEscape(artifactName) + MirrorArtifactSuffix
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, -1, errors.Wrapf(err, "invalid mirror %s", mirror)
+	}
+	r, err := c.Do(req)
+	if err != nil {
+		return nil, -1, errors.Wrapf(err, "failed to fetch %s", location)
+	}
+	if r.StatusCode != http.StatusOK {
+		r.Body.Close()
+		return nil, -1, errors.Errorf("failed to fetch %s: %s", location, r.Status)
+	}
+	if r.ContentLength <= 0 {
+		r.Body.Close()
+		return nil, -1, errors.Errorf("failed to fetch %s: unknown size", location)
+	}
+
+	body := NewUpdateResumer(r.Body, r.ContentLength, maxWait, c, req)
+	read, mirrorManifest, err := ReadArtifactManifest(body)
+	if err != nil {
+		body.Close()
+		return nil, -1, errors.Wrapf(err, "failed to fetch %s", location)
+	}
+	if !bytes.Equal(manifest, mirrorManifest) {
+		body.Close()
+		return nil, -1, errors.Wrapf(ErrManifestMismatch, "failed to fetch %s", location)
+	}
+	return &mirroredArtifact{
+		Reader: io.MultiReader(bytes.NewReader(read), body),
+		Closer: body,
+	}, r.ContentLength, nil
+}
+
+type mirroredArtifact struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestArtifact(t *testing.T, files ...string) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for i := 0; i < len(files); i += 2 {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: files[i],
+			Mode: 0600,
+			Size: int64(len(files[i+1])),
+		}))
+		_, err := tw.Write([]byte(files[i+1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestReadArtifactManifest(t *testing.T) {
+	art := makeTestArtifact(t,
+		"version", `{"format":"mender","version":3}`,
+		"manifest", "1234  header.tar.gz\n",
+		"header.tar.gz", "header")
+	read, manifest, err := ReadArtifactManifest(bytes.NewReader(art))
+	require.NoError(t, err)
+	assert.Equal(t, "1234  header.tar.gz\n", string(manifest))
+	assert.Equal(t, art[:len(read)], read)
+
+	_, _, err = ReadArtifactManifest(bytes.NewReader(makeTestArtifact(t,
+		"version", `{"format":"mender","version":1}`)))
+	assert.Error(t, err)
+	_, _, err = ReadArtifactManifest(bytes.NewBufferString("garbage"))
+	assert.Error(t, err)
+}
+
+func TestFetchMirroredUpdate(t *testing.T) {
+	art := makeTestArtifact(t,
+		"version", `{"format":"mender","version":3}`,
+		"manifest", "1234  header.tar.gz\n",
+		"header.tar.gz", "header")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/artifacts/release%2F1.mender" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(art))
+	}))
+	defer srv.Close()
+
+	in, size, err := FetchMirroredUpdate(srv.Client(), srv.URL+"/artifacts/", "release/1",
+		[]byte("1234  header.tar.gz\n"), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(art)), size)
+	data, err := ioutil.ReadAll(in)
+	require.NoError(t, err)
+	assert.NoError(t, in.Close())
+	assert.Equal(t, art, data)
+
+	_, _, err = FetchMirroredUpdate(srv.Client(), srv.URL+"/artifacts", "release/1",
+		[]byte("5678  header.tar.gz\n"), time.Second)
+	assert.Equal(t, ErrManifestMismatch, errors.Cause(err))
+
+	_, _, err = FetchMirroredUpdate(srv.Client(), srv.URL+"/artifacts", "release-2",
+		[]byte("1234  header.tar.gz\n"), time.Second)
+	assert.Error(t, err)
+}
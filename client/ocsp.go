@@ -0,0 +1,77 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspStatus returns the status of cert in an OCSP response, which must be
+// signed by issuer or by a responder it delegated to.
+func ocspStatus(raw []byte, cert, issuer *x509.Certificate,
+	now time.Time) (revocationStatus, error) {
+
+	resp, err := ocsp.ParseResponseForCert(raw, cert, issuer)
+	if err != nil {
+		return revocationUnknown, errors.Wrap(err, "invalid OCSP response")
+	}
+	// The responder is only checked to be signed by issuer.
+	if resp.Certificate != nil {
+		if err := checkOCSPResponder(resp.Certificate, now); err != nil {
+			return revocationUnknown, err
+		}
+	}
+	if resp.ThisUpdate.After(now) {
+		return revocationUnknown, errors.New("OCSP response is not yet valid")
+	}
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(now) {
+		return revocationUnknown, errors.New("OCSP response is out of date")
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+		return revocationGood, nil
+	case ocsp.Revoked:
+		return revocationRevoked, nil
+	default:
+		return revocationUnknown, nil
+	}
+}
+
+// checkOCSPResponder checks that the certificate, which the issuer delegated
+// OCSP signing to, is valid for signing OCSP responses.
+func checkOCSPResponder(responder *x509.Certificate, now time.Time) error {
+	if !hasExtKeyUsage(responder, x509.ExtKeyUsageOCSPSigning) {
+		return errors.Errorf("OCSP responder %q is not allowed to sign OCSP responses",
+			responder.Subject.CommonName)
+	}
+	if now.Before(responder.NotBefore) || now.After(responder.NotAfter) {
+		return errors.Errorf("certificate of OCSP responder %q is not valid at %v",
+			responder.Subject.CommonName, now)
+	}
+	return nil
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
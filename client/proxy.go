@@ -0,0 +1,49 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyFunc returns the function selecting the proxy of each request, as given
+// by the environment.
+func proxyFunc(conf Config) func(*http.Request) (*url.URL, error) {
+	if conf.ProxyCredentials == "" {
+		return http.ProxyFromEnvironment
+	}
+	return withProxyCredentials(http.ProxyFromEnvironment, conf.ProxyCredentials)
+}
+
+// withProxyCredentials adds the credentials, given as "user:password", to the
+// proxies selected without any.
+func withProxyCredentials(proxy func(*http.Request) (*url.URL, error),
+	credentials string) func(*http.Request) (*url.URL, error) {
+
+	user := url.User(credentials)
+	if i := strings.Index(credentials, ":"); i >= 0 {
+		user = url.UserPassword(credentials[:i], credentials[i+1:])
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if err != nil || u == nil || u.User != nil {
+			return u, err
+		}
+		withUser := *u
+		withUser.User = user
+		return &withUser, nil
+	}
+}
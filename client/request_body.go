@@ -0,0 +1,96 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Request bodies up to this size, which http.NewRequest can not rewind, are
+// kept in memory to be sent again on retries; larger ones are sent once.
+const maxReplayBufferSize = 1024 * 1024
+
+var errBodyNotReplayable = errors.New("the request body can not be sent again")
+
+// makeBodyReplayable sets GetBody of a request which has a body, but not the
+// means to get it again, so that the request can be retried with another
+// token or server: files are opened again, at the offset they are read from,
+// and small bodies are buffered.
+func makeBodyReplayable(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return nil
+	}
+
+	if f, ok := req.Body.(*os.File); ok {
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err == nil {
+			name := f.Name()
+			req.GetBody = func() (io.ReadCloser, error) {
+				f, err := os.Open(name)
+				if err != nil {
+					return nil, err
+				}
+				if _, err = f.Seek(offset, io.SeekStart); err != nil {
+					f.Close()
+					return nil, err
+				}
+				return f, nil
+			}
+			return nil
+		}
+		// Not a regular file, such as a pipe; buffer it as any reader.
+	}
+
+	body := req.Body
+	buf, err := ioutil.ReadAll(io.LimitReader(body, maxReplayBufferSize+1))
+	if err != nil {
+		return errors.Wrap(err, "failed to read the request body")
+	}
+	if len(buf) > maxReplayBufferSize {
+		// Too large to keep; send what was read, and the rest, once.
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), body), body}
+		return nil
+	}
+	body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return nil
+}
+
+// rewindBody gives the request its body anew, after it has been sent.
+func rewindBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.GetBody == nil {
+		return errBodyNotReplayable
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return errors.Wrap(err, "failed to rewind the request body")
+	}
+	req.Body = body
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A body which http.NewRequest does not know how to get again.
+type streamBody struct {
+	io.Reader
+}
+
+func readBody(t *testing.T, req *http.Request) string {
+	data, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestMakeBodyReplayable(t *testing.T) {
+	// Small streams are buffered.
+	req, _ := http.NewRequest(http.MethodPut, "http://localhost/",
+		streamBody{strings.NewReader("status")})
+	require.Nil(t, req.GetBody)
+	require.NoError(t, makeBodyReplayable(req))
+	assert.Equal(t, "status", readBody(t, req))
+	require.NoError(t, rewindBody(req))
+	assert.Equal(t, "status", readBody(t, req))
+
+	// Files are opened again, where they were first read from.
+	f, err := ioutil.TempFile("", "mender-body")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("skipped;logs")
+	require.NoError(t, err)
+	_, err = f.Seek(int64(len("skipped;")), io.SeekStart)
+	require.NoError(t, err)
+	req, _ = http.NewRequest(http.MethodPut, "http://localhost/", f)
+	require.NoError(t, makeBodyReplayable(req))
+	assert.Equal(t, "logs", readBody(t, req))
+	req.Body.Close()
+	require.NoError(t, rewindBody(req))
+	assert.Equal(t, "logs", readBody(t, req))
+	req.Body.Close()
+
+	// Large streams are sent once, in full.
+	large := bytes.Repeat([]byte("x"), maxReplayBufferSize+10)
+	req, _ = http.NewRequest(http.MethodPut, "http://localhost/",
+		streamBody{bytes.NewReader(large)})
+	require.NoError(t, makeBodyReplayable(req))
+	assert.Equal(t, string(large), readBody(t, req))
+	assert.Equal(t, errBodyNotReplayable, rewindBody(req))
+
+	// Requests without a body need no replay.
+	req, _ = http.NewRequest(http.MethodGet, "http://localhost/", nil)
+	require.NoError(t, makeBodyReplayable(req))
+	assert.NoError(t, rewindBody(req))
+}
+
+func TestApiRequestReplaysBody(t *testing.T) {
+	cl, err := NewApiClient(Config{})
+	require.NoError(t, err)
+
+	var bodies []string
+	handler := func(status func(r *http.Request) int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(data))
+			w.WriteHeader(status(r))
+		}))
+	}
+	failing := handler(func(*http.Request) int { return http.StatusInternalServerError })
+	defer failing.Close()
+	// Accepts the request once reauthorized.
+	working := handler(func(r *http.Request) int {
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			return http.StatusUnauthorized
+		}
+		return http.StatusOK
+	})
+	defer working.Close()
+
+	servers := []MenderServer{{ServerURL: failing.URL}, {ServerURL: working.URL}}
+	idx := 0
+	nextServer := func() *MenderServer {
+		if idx == len(servers) {
+			idx = 0
+			return nil
+		}
+		idx++
+		return &servers[idx-1]
+	}
+	reauth := func(string) (AuthToken, error) {
+		return AuthToken("fresh"), nil
+	}
+
+	req := cl.Request("stale", "", nextServer, reauth)
+	hreq, _ := http.NewRequest(http.MethodPut, failing.URL+"/api/devices/v1/inventory",
+		streamBody{strings.NewReader(`{"status":"installing"}`)})
+	rsp, err := req.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	// Sent to the failing server, then to the working one before and
+	// after reauthorizing, in full every time.
+	assert.Equal(t, []string{
+		`{"status":"installing"}`,
+		`{"status":"installing"}`,
+		`{"status":"installing"}`,
+	}, bodies)
+
+	// A body too large to keep is not sent again.
+	bodies = nil
+	large := bytes.Repeat([]byte("x"), maxReplayBufferSize+10)
+	req = cl.Request("fresh", "", nextServer, reauth)
+	hreq, _ = http.NewRequest(http.MethodPut, failing.URL+"/api/devices/v1/inventory",
+		streamBody{bytes.NewReader(large)})
+	rsp, err = req.Do(hreq)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, rsp.StatusCode)
+	assert.Equal(t, []string{string(large)}, bodies)
+}
@@ -0,0 +1,276 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Modes of checking the revocation of the server certificate. A certificate
+// which is known to be revoked is always rejected; the modes differ in
+// whether a certificate with an unknown revocation status is accepted.
+const (
+	RevocationCheckOff      = ""
+	RevocationCheckSoftFail = "soft-fail"
+	RevocationCheckHardFail = "hard-fail"
+)
+
+type revocationStatus int
+
+const (
+	revocationUnknown revocationStatus = iota
+	revocationGood
+	revocationRevoked
+)
+
+// revocationChecker checks the server certificate against the CRLs in a local
+// file, and the OCSP response stapled by the server. The file is loaded again
+// whenever it changes, so that it can be kept up to date while the client
+// runs.
+type revocationChecker struct {
+	hardFail bool
+	crlFile  string
+	// Used in tests.
+	now func() time.Time
+
+	// Protects the fields below; the checker is shared by all the
+	// connections of the client.
+	lock sync.Mutex
+	crls []*pkix.CertificateList
+	// Modification time and size of crlFile when it was loaded.
+	crlModTime time.Time
+	crlSize    int64
+}
+
+func newRevocationChecker(conf Config) (*revocationChecker, error) {
+	rc := &revocationChecker{now: time.Now}
+	switch conf.RevocationCheck {
+	case RevocationCheckOff:
+		return nil, nil
+	case RevocationCheckSoftFail:
+	case RevocationCheckHardFail:
+		rc.hardFail = true
+	default:
+		return nil, errors.Errorf("unknown revocation check %q", conf.RevocationCheck)
+	}
+
+	if conf.CRLFile != "" {
+		rc.crlFile = conf.CRLFile
+		if err := rc.reloadCRLs(); err != nil {
+			return nil, err
+		}
+	} else if rc.hardFail {
+		log.Warn("Server certificate revocation is checked with hard-fail " +
+			"but without a CRL file; servers which do not staple an OCSP " +
+			"response will be refused")
+	}
+	return rc, nil
+}
+
+// reloadCRLs loads the CRL file again if it has changed since it was last
+// loaded.
+func (rc *revocationChecker) reloadCRLs() error {
+	info, err := os.Stat(rc.crlFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load CRL file %s", rc.crlFile)
+	}
+	if info.ModTime().Equal(rc.crlModTime) && info.Size() == rc.crlSize {
+		return nil
+	}
+	crls, err := loadCRLs(rc.crlFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load CRL file %s", rc.crlFile)
+	}
+	rc.crls = crls
+	rc.crlModTime = info.ModTime()
+	rc.crlSize = info.Size()
+	return nil
+}
+
+// currentCRLs returns the CRLs in the CRL file, loading it again if it has
+// changed. The CRLs loaded before are kept if it cannot be loaded.
+func (rc *revocationChecker) currentCRLs() []*pkix.CertificateList {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.crlFile != "" {
+		if err := rc.reloadCRLs(); err != nil {
+			log.Warnf("Using the CRLs loaded before: %v", err)
+		}
+	}
+	return rc.crls
+}
+
+// loadCRLs loads the CRLs in a file, which are either PEM encoded, or a single
+// DER encoded CRL.
+func loadCRLs(name string) ([]*pkix.CertificateList, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var crls []*pkix.CertificateList
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) > 0 {
+		return crls, nil
+	}
+
+	crl, err := x509.ParseDERCRL(data)
+	if err != nil {
+		return nil, err
+	}
+	return []*pkix.CertificateList{crl}, nil
+}
+
+// check checks the revocation of the certificates in the verified chains.
+// All but the root are checked against the CRLs, and the leaf also against
+// the stapled OCSP response, if any. The server certificate is accepted if it
+// is not revoked, and at least one of the chains has no revoked issuers.
+func (rc *revocationChecker) check(chains [][]*x509.Certificate, staple []byte) error {
+	if len(chains) == 0 {
+		// Not verified; there is nothing to check.
+		return nil
+	}
+	for _, chain := range chains {
+		if len(chain) == 1 && isSelfSigned(chain[0]) {
+			// There is nothing to check for a trusted, self-signed
+			// certificate.
+			return nil
+		}
+	}
+	leaf := chains[0][0]
+	crls := rc.currentCRLs()
+	now := rc.now()
+
+	var issuerErr error
+	trusted := false
+	leafStatus := revocationUnknown
+	for _, chain := range chains {
+		status, err := chainStatus(chain, crls, staple, now)
+		if status == revocationRevoked {
+			return errors.Errorf("certificate %q of the server is revoked",
+				leaf.Subject.CommonName)
+		}
+		if err != nil {
+			if issuerErr == nil {
+				issuerErr = err
+			}
+			continue
+		}
+		trusted = true
+		if status == revocationGood {
+			leafStatus = revocationGood
+		}
+	}
+	if !trusted {
+		return issuerErr
+	}
+
+	if leafStatus == revocationGood {
+		return nil
+	}
+	if rc.hardFail {
+		return errors.Errorf("revocation status of the server certificate %q is unknown",
+			leaf.Subject.CommonName)
+	}
+	log.Warnf("Revocation status of the server certificate %q is unknown",
+		leaf.Subject.CommonName)
+	return nil
+}
+
+// chainStatus returns the revocation status of the leaf of a verified chain,
+// or an error if one of its issuers is revoked.
+func chainStatus(chain []*x509.Certificate, crls []*pkix.CertificateList,
+	staple []byte, now time.Time) (revocationStatus, error) {
+
+	if len(chain) < 2 {
+		// A trusted certificate which is not self-signed; its issuer,
+		// and so its status, is not known.
+		return revocationUnknown, nil
+	}
+	leafStatus := crlStatus(crls, chain[0], chain[1], now)
+	if leafStatus == revocationRevoked {
+		return leafStatus, nil
+	}
+	for i := 1; i < len(chain)-1; i++ {
+		if crlStatus(crls, chain[i], chain[i+1], now) == revocationRevoked {
+			return revocationUnknown, errors.Errorf("certificate %q issuing "+
+				"the server certificate is revoked", chain[i].Subject.CommonName)
+		}
+	}
+
+	if staple != nil {
+		status, err := ocspStatus(staple, chain[0], chain[1], now)
+		if err != nil {
+			log.Warnf("Ignoring the OCSP response stapled by the server: %v", err)
+		} else if status != revocationUnknown {
+			leafStatus = status
+		}
+	}
+	return leafStatus, nil
+}
+
+// isSelfSigned returns whether the certificate is signed with its own key.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate,
+			cert.Signature) == nil
+}
+
+// crlStatus looks up the certificate in the CRLs issued by its issuer. The
+// status is unknown if there is no such CRL, or it is out of date.
+func crlStatus(crls []*pkix.CertificateList, cert, issuer *x509.Certificate,
+	now time.Time) revocationStatus {
+
+	status := revocationUnknown
+	for _, crl := range crls {
+		if issuer.CheckCRLSignature(crl) != nil {
+			continue
+		}
+		if crl.HasExpired(now) {
+			log.Warnf("CRL of %q is out of date", issuer.Subject.CommonName)
+			continue
+		}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return revocationRevoked
+			}
+		}
+		status = revocationGood
+	}
+	return status
+}
@@ -0,0 +1,352 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate signed by issuer, or a self-signed CA
+// certificate if issuer is nil.
+func newTestCert(t *testing.T, serial int64, issuer *testCert,
+	usage ...x509.ExtKeyUsage) *testCert {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: big.NewInt(serial).String()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  usage,
+	}
+	parent, parentKey := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key}
+}
+
+// makeTestOCSP makes an OCSP response for cert, issued by issuer and signed by
+// signer.
+func makeTestOCSP(t *testing.T, cert, issuer, signer *testCert, status revocationStatus,
+	nextUpdate time.Time) []byte {
+
+	now := time.Now().UTC().Truncate(time.Second)
+	template := ocsp.Response{
+		SerialNumber: cert.cert.SerialNumber,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   nextUpdate.UTC().Truncate(time.Second),
+	}
+	switch status {
+	case revocationGood:
+		template.Status = ocsp.Good
+	case revocationRevoked:
+		template.Status = ocsp.Revoked
+		template.RevokedAt = now.Add(-time.Minute)
+	default:
+		template.Status = ocsp.Unknown
+	}
+	if signer != issuer {
+		template.Certificate = signer.cert
+	}
+	resp, err := ocsp.CreateResponse(issuer.cert, signer.cert, template, signer.key)
+	require.NoError(t, err)
+	return resp
+}
+
+func makeTestCRL(t *testing.T, issuer *testCert, nextUpdate time.Time,
+	revoked ...*testCert) []byte {
+
+	var list []pkix.RevokedCertificate
+	for _, cert := range revoked {
+		list = append(list, pkix.RevokedCertificate{
+			SerialNumber:   cert.cert.SerialNumber,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	crl, err := issuer.cert.CreateCRL(rand.Reader, issuer.key, list,
+		time.Now().Add(-time.Minute), nextUpdate)
+	require.NoError(t, err)
+	return crl
+}
+
+func TestRevocationCheckOCSP(t *testing.T) {
+	ca := newTestCert(t, 1, nil)
+	leaf := newTestCert(t, 2, ca)
+	otherCA := newTestCert(t, 3, nil)
+	responder := newTestCert(t, 4, ca, x509.ExtKeyUsageOCSPSigning)
+	notResponder := newTestCert(t, 5, ca)
+	chains := [][]*x509.Certificate{{leaf.cert, ca.cert}}
+	later := time.Now().Add(time.Hour)
+
+	soft, err := newRevocationChecker(Config{RevocationCheck: RevocationCheckSoftFail})
+	require.NoError(t, err)
+	hard, err := newRevocationChecker(Config{RevocationCheck: RevocationCheckHardFail})
+	require.NoError(t, err)
+
+	// Without any revocation status, only hard-fail rejects the
+	// certificate.
+	assert.NoError(t, soft.check(chains, nil))
+	assert.Error(t, hard.check(chains, nil))
+
+	tcs := []struct {
+		name    string
+		staple  []byte
+		softErr bool
+		hardErr bool
+	}{
+		{"good", makeTestOCSP(t, leaf, ca, ca, revocationGood, later), false, false},
+		{"good without next update", makeTestOCSP(t, leaf, ca, ca, revocationGood, time.Time{}),
+			false, false},
+		{"revoked", makeTestOCSP(t, leaf, ca, ca, revocationRevoked, later), true, true},
+		{"unknown", makeTestOCSP(t, leaf, ca, ca, revocationUnknown, later), false, true},
+		{"out of date", makeTestOCSP(t, leaf, ca, ca, revocationGood,
+			time.Now().Add(-time.Minute)), false, true},
+		{"delegated responder", makeTestOCSP(t, leaf, ca, responder, revocationGood, later),
+			false, false},
+		{"not a responder", makeTestOCSP(t, leaf, ca, notResponder, revocationGood, later),
+			false, true},
+		{"signed by another CA", makeTestOCSP(t, leaf, ca, otherCA, revocationRevoked, later),
+			false, true},
+		{"another certificate", makeTestOCSP(t, notResponder, ca, ca, revocationRevoked, later),
+			false, true},
+		{"malformed", []byte("foobar"), false, true},
+	}
+	for _, tc := range tcs {
+		err := soft.check(chains, tc.staple)
+		assert.Equal(t, tc.softErr, err != nil, "soft-fail: %s: %v", tc.name, err)
+		err = hard.check(chains, tc.staple)
+		assert.Equal(t, tc.hardErr, err != nil, "hard-fail: %s: %v", tc.name, err)
+	}
+
+	// The certificate of a delegated responder must be valid.
+	hard.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	assert.NoError(t, hard.check(chains,
+		makeTestOCSP(t, leaf, ca, ca, revocationGood, time.Time{})))
+	assert.Error(t, hard.check(chains,
+		makeTestOCSP(t, leaf, ca, responder, revocationGood, time.Time{})))
+	hard.now = time.Now
+
+	// A trusted self-signed certificate has nothing to check.
+	assert.NoError(t, hard.check([][]*x509.Certificate{{ca.cert}}, nil))
+	// Nor does an unverified connection.
+	assert.NoError(t, hard.check(nil, nil))
+	// The status of a trusted certificate with an unknown issuer is
+	// unknown.
+	assert.NoError(t, soft.check([][]*x509.Certificate{{leaf.cert}}, nil))
+	assert.Error(t, hard.check([][]*x509.Certificate{{leaf.cert}}, nil))
+}
+
+func TestRevocationCheckCRL(t *testing.T) {
+	ca := newTestCert(t, 1, nil)
+	intermediate := newTestCert(t, 2, ca)
+	leaf := newTestCert(t, 3, intermediate)
+	other := newTestCert(t, 4, intermediate)
+	chains := [][]*x509.Certificate{{leaf.cert, intermediate.cert, ca.cert}}
+	later := time.Now().Add(time.Hour)
+
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	crlFile := path.Join(tdir, "crl.pem")
+
+	check := func(mode string, crls ...[]byte) error {
+		var data []byte
+		for _, crl := range crls {
+			data = append(data, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})...)
+		}
+		require.NoError(t, ioutil.WriteFile(crlFile, data, 0600))
+		rc, err := newRevocationChecker(Config{RevocationCheck: mode, CRLFile: crlFile})
+		require.NoError(t, err)
+		return rc.check(chains, nil)
+	}
+
+	// The leaf is not revoked.
+	assert.NoError(t, check(RevocationCheckHardFail,
+		makeTestCRL(t, intermediate, later, other), makeTestCRL(t, ca, later)))
+	// The leaf is revoked.
+	assert.Error(t, check(RevocationCheckSoftFail,
+		makeTestCRL(t, intermediate, later, leaf)))
+	// The intermediate is revoked.
+	assert.Error(t, check(RevocationCheckSoftFail,
+		makeTestCRL(t, intermediate, later), makeTestCRL(t, ca, later, intermediate)))
+	// An out of date CRL gives no status.
+	assert.NoError(t, check(RevocationCheckSoftFail,
+		makeTestCRL(t, intermediate, time.Now().Add(-time.Minute), leaf)))
+	assert.Error(t, check(RevocationCheckHardFail,
+		makeTestCRL(t, intermediate, time.Now().Add(-time.Minute))))
+	// Nor does a CRL of another issuer.
+	assert.Error(t, check(RevocationCheckHardFail, makeTestCRL(t, ca, later, leaf)))
+
+	// All the chains are checked; one without revoked issuers is enough,
+	// but a revoked leaf is rejected whatever the chain.
+	otherCA := newTestCert(t, 5, nil)
+	chains = [][]*x509.Certificate{
+		{leaf.cert, intermediate.cert, ca.cert},
+		{leaf.cert, intermediate.cert, otherCA.cert},
+	}
+	assert.NoError(t, check(RevocationCheckHardFail,
+		makeTestCRL(t, intermediate, later), makeTestCRL(t, ca, later, intermediate),
+		makeTestCRL(t, otherCA, later)))
+	assert.Error(t, check(RevocationCheckSoftFail,
+		makeTestCRL(t, intermediate, later), makeTestCRL(t, ca, later, intermediate),
+		makeTestCRL(t, otherCA, later, intermediate)))
+	chains = [][]*x509.Certificate{
+		{leaf.cert, ca.cert},
+		{leaf.cert, intermediate.cert, ca.cert},
+	}
+	assert.Error(t, check(RevocationCheckSoftFail,
+		makeTestCRL(t, ca, later), makeTestCRL(t, intermediate, later, leaf)))
+	chains = [][]*x509.Certificate{{leaf.cert, intermediate.cert, ca.cert}}
+
+	// DER encoded CRLs are read as well.
+	require.NoError(t, ioutil.WriteFile(crlFile, makeTestCRL(t, intermediate, later, leaf), 0600))
+	rc, err := newRevocationChecker(Config{RevocationCheck: RevocationCheckSoftFail,
+		CRLFile: crlFile})
+	require.NoError(t, err)
+	assert.Error(t, rc.check(chains, nil))
+}
+
+func TestRevocationCheckCRLReload(t *testing.T) {
+	ca := newTestCert(t, 1, nil)
+	leaf := newTestCert(t, 2, ca)
+	chains := [][]*x509.Certificate{{leaf.cert, ca.cert}}
+
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	crlFile := path.Join(tdir, "crl.der")
+	modTime := time.Now()
+	writeCRL := func(crl []byte) {
+		require.NoError(t, ioutil.WriteFile(crlFile, crl, 0600))
+		modTime = modTime.Add(time.Second)
+		require.NoError(t, os.Chtimes(crlFile, modTime, modTime))
+	}
+
+	writeCRL(makeTestCRL(t, ca, time.Now().Add(time.Hour)))
+	rc, err := newRevocationChecker(Config{RevocationCheck: RevocationCheckHardFail,
+		CRLFile: crlFile})
+	require.NoError(t, err)
+	assert.NoError(t, rc.check(chains, nil))
+
+	// The CRL goes out of date, until it is replaced by a current one.
+	rc.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	assert.Error(t, rc.check(chains, nil))
+	writeCRL(makeTestCRL(t, ca, time.Now().Add(3*time.Hour)))
+	assert.NoError(t, rc.check(chains, nil))
+	rc.now = time.Now
+
+	// A new CRL revoking the certificate.
+	writeCRL(makeTestCRL(t, ca, time.Now().Add(time.Hour), leaf))
+	assert.Error(t, rc.check(chains, nil))
+
+	// The CRLs are kept if the file is gone.
+	require.NoError(t, os.Remove(crlFile))
+	assert.Error(t, rc.check(chains, nil))
+}
+
+func TestNewRevocationChecker(t *testing.T) {
+	rc, err := newRevocationChecker(Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, rc)
+
+	_, err = newRevocationChecker(Config{RevocationCheck: "sometimes"})
+	assert.Error(t, err)
+
+	_, err = newRevocationChecker(Config{RevocationCheck: RevocationCheckHardFail,
+		CRLFile: "does-not-exist.crl"})
+	assert.Error(t, err)
+}
+
+func TestHttpsClientRevocationCheck(t *testing.T) {
+	ca := newTestCert(t, 1, nil)
+	leaf := newTestCert(t, 2, ca)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{leaf.cert.Raw},
+			PrivateKey:  leaf.key,
+		}},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	caFile := path.Join(tdir, "ca.crt")
+	require.NoError(t, ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+	crlFile := path.Join(tdir, "crl.der")
+
+	get := func(mode string, revoked ...*testCert) error {
+		require.NoError(t, ioutil.WriteFile(crlFile,
+			makeTestCRL(t, ca, time.Now().Add(time.Hour), revoked...), 0600))
+		client, err := newHttpsClient(Config{
+			ServerCert:      caFile,
+			IsHttps:         true,
+			RevocationCheck: mode,
+			CRLFile:         crlFile,
+		})
+		require.NoError(t, err)
+		rsp, err := client.Get(ts.URL)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		return err
+	}
+
+	assert.NoError(t, get(RevocationCheckHardFail))
+	assert.NoError(t, get(RevocationCheckOff, leaf))
+	err = get(RevocationCheckSoftFail, leaf)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "revoked")
+}
@@ -0,0 +1,30 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// +build !go1.15
+
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// Stapled OCSP responses are only available to the verification of the
+// connection from Go 1.15, so only CRLs are checked.
+func setRevocationCheck(tlsc *tls.Config, rc *revocationChecker) {
+	tlsc.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		return rc.check(chains, nil)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// +build go1.15
+
+package client
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHttpsClientStapledOCSP(t *testing.T) {
+	ca := newTestCert(t, 1, nil)
+	leaf := newTestCert(t, 2, ca)
+
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	caFile := path.Join(tdir, "ca.crt")
+	require.NoError(t, ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+
+	get := func(status revocationStatus) error {
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		ts.TLS = &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{leaf.cert.Raw},
+				PrivateKey:  leaf.key,
+				OCSPStaple: makeTestOCSP(t, leaf, ca, ca, status,
+					time.Now().Add(time.Hour)),
+			}},
+		}
+		ts.StartTLS()
+		defer ts.Close()
+
+		client, err := newHttpsClient(Config{
+			ServerCert:      caFile,
+			IsHttps:         true,
+			RevocationCheck: RevocationCheckHardFail,
+		})
+		require.NoError(t, err)
+		rsp, err := client.Get(ts.URL)
+		if err == nil {
+			rsp.Body.Close()
+		}
+		return err
+	}
+
+	assert.NoError(t, get(revocationGood))
+	err = get(revocationRevoked)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "revoked")
+}
@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 
@@ -35,6 +36,9 @@ type updateType struct {
 	Unauthorized bool
 	Called       bool
 	Current      client.CurrentUpdate
+	// Respond 404 to requests to the v2 deployments API, like servers
+	// predating it do.
+	V1Only bool
 }
 
 type updateDownloadType struct {
@@ -47,12 +51,15 @@ type authType struct {
 	Token     []byte
 	Called    bool
 	Verify    bool
+	// Tenant token the auth requests must carry, if set.
+	TenantToken []byte
 }
 
 type statusType struct {
-	Status  string
-	Aborted bool
-	Called  bool
+	Status   string
+	SubState string
+	Aborted  bool
+	Called   bool
 }
 
 type logType struct {
@@ -65,6 +72,12 @@ type inventoryType struct {
 	Attrs  []client.InventoryAttribute
 }
 
+type tenantTokenType struct {
+	Called bool
+	// The new tenant token, if any.
+	Token []byte
+}
+
 type ClientTestServer struct {
 	*httptest.Server
 
@@ -74,6 +87,7 @@ type ClientTestServer struct {
 	Status         statusType
 	Log            logType
 	Inventory      inventoryType
+	TenantToken    tenantTokenType
 }
 
 func NewClientTestServer() *ClientTestServer {
@@ -81,8 +95,10 @@ func NewClientTestServer() *ClientTestServer {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/devices/v1/authentication/auth_requests", cts.authReq)
+	mux.HandleFunc("/api/devices/v1/authentication/tenant_token", cts.tenantTokenReq)
 	mux.HandleFunc("/api/devices/v1/inventory/device/attributes", cts.inventoryReq)
 	mux.HandleFunc("/api/devices/v1/deployments/device/deployments/next", cts.updateReq)
+	mux.HandleFunc("/api/devices/v2/deployments/device/deployments/next", cts.updateReqV2)
 	// mux.HandleFunc("/api/devices/v1/deployments/device/deployments/%s/log", cts.logReq)
 	// mux.HandleFunc("/api/devices/v1/deployments/device/deployments/%s/status", cts.statusReq)
 	mux.HandleFunc("/api/devices/v1/deployments/device/deployments/", cts.deploymentsReq)
@@ -115,6 +131,7 @@ func (cts *ClientTestServer) Reset() {
 	cts.Log = logType{}
 	cts.Inventory = inventoryType{}
 	cts.Status = statusType{}
+	cts.TenantToken = tenantTokenType{}
 }
 
 func isMethod(method string, w http.ResponseWriter, r *http.Request) bool {
@@ -179,6 +196,13 @@ func (cts *ClientTestServer) authReq(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if cts.Auth.TenantToken != nil &&
+		r.Header.Get("Authorization") != "Bearer "+string(cts.Auth.TenantToken) {
+		log.Errorf("bad tenant token: %v", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	if cts.Auth.Authorize {
 		w.WriteHeader(http.StatusOK)
 		if cts.Auth.Token != nil {
@@ -191,6 +215,26 @@ func (cts *ClientTestServer) authReq(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (cts *ClientTestServer) tenantTokenReq(w http.ResponseWriter, r *http.Request) {
+	log.Infof("got tenant token request %v", r)
+	cts.TenantToken.Called = true
+
+	if !isMethod(http.MethodGet, w, r) {
+		return
+	}
+
+	if !cts.verifyAuth(w, r) {
+		return
+	}
+
+	if cts.TenantToken.Token == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, map[string]string{"tenant_token": string(cts.TenantToken.Token)})
+}
+
 func (cts *ClientTestServer) inventoryReq(w http.ResponseWriter, r *http.Request) {
 	log.Infof("got inventory request %v", r)
 	cts.Inventory.Called = true
@@ -301,6 +345,7 @@ func (cts *ClientTestServer) statusReq(w http.ResponseWriter, r *http.Request, i
 	}
 
 	cts.Status.Status = report.Status
+	cts.Status.SubState = report.SubState
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -313,6 +358,79 @@ func urlQueryToCurrentUpdate(vals url.Values) client.CurrentUpdate {
 	return cur
 }
 
+func providesToCurrentUpdate(provides map[string]string) client.CurrentUpdate {
+	cur := client.CurrentUpdate{
+		Artifact:   provides["artifact_name"],
+		DeviceType: provides["device_type"],
+	}
+	for key, val := range provides {
+		if key == "artifact_name" || key == "device_type" {
+			continue
+		}
+		if cur.Provides == nil {
+			cur.Provides = map[string]string{}
+		}
+		cur.Provides[key] = val
+	}
+	return cur
+}
+
+// isCurrentUpdate checks the current update info sent by the client. The v1
+// API does not carry provides, in which case these are not checked.
+func (cts *ClientTestServer) isCurrentUpdate(current client.CurrentUpdate,
+	checkProvides bool, w http.ResponseWriter) bool {
+
+	expected := cts.Update.Current
+	if !checkProvides || len(expected.Provides) == 0 {
+		expected.Provides = nil
+	}
+	if !reflect.DeepEqual(current, expected) {
+		log.Errorf("incorrect current update info, got %+v, expected %+v",
+			current, expected)
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (cts *ClientTestServer) updateReqV2(w http.ResponseWriter, r *http.Request) {
+	log.Infof("got update request (v2) %v", r)
+
+	if cts.Update.V1Only {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	cts.Update.Called = true
+
+	if !isMethod(http.MethodPost, w, r) {
+		return
+	}
+
+	if !isContentType("application/json", w, r) {
+		return
+	}
+
+	if !cts.verifyAuth(w, r) {
+		return
+	}
+
+	var body struct {
+		DeviceProvides map[string]string `json:"device_provides"`
+	}
+	if err := fromJSON(r.Body, &body); err != nil {
+		log.Errorf("failed to parse update request body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !cts.isCurrentUpdate(providesToCurrentUpdate(body.DeviceProvides), true, w) {
+		return
+	}
+
+	cts.writeUpdateResponse(w)
+}
+
 func (cts *ClientTestServer) updateReq(w http.ResponseWriter, r *http.Request) {
 	log.Infof("got update request %v", r)
 	cts.Update.Called = true
@@ -327,13 +445,14 @@ func (cts *ClientTestServer) updateReq(w http.ResponseWriter, r *http.Request) {
 
 	log.Infof("parsed URL query: %v", r.URL.Query())
 
-	if current := urlQueryToCurrentUpdate(r.URL.Query()); current != cts.Update.Current {
-		log.Errorf("incorrect current update info, got %+v, expected %+v",
-			current, cts.Update.Current)
-		w.WriteHeader(http.StatusBadRequest)
+	if !cts.isCurrentUpdate(urlQueryToCurrentUpdate(r.URL.Query()), false, w) {
 		return
 	}
 
+	cts.writeUpdateResponse(w)
+}
+
+func (cts *ClientTestServer) writeUpdateResponse(w http.ResponseWriter) {
 	switch {
 	case cts.Update.Unauthorized == true:
 		w.WriteHeader(http.StatusUnauthorized)
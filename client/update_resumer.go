@@ -17,6 +17,7 @@ package client
 import (
 	"fmt"
 	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
@@ -32,8 +33,16 @@ type UpdateResumer struct {
 	req           *http.Request
 	offset        int64
 	contentLength int64
-	retryAttempts int
-	maxWait       time.Duration
+	backoff       *utils.Backoff
+}
+
+// downloadResumePolicy is the exponential backoff of the download resumes,
+// with jitter, so that the devices cut off together do not all come back
+// to the server together.
+func downloadResumePolicy(maxWait time.Duration) utils.BackoffPolicy {
+	policy := ExponentialBackoffPolicy(maxWait)
+	policy.Jitter = 0.1
+	return policy
 }
 
 // Note: It is important that nothing has been read from the stream yet.
@@ -48,7 +57,7 @@ func NewUpdateResumer(stream io.ReadCloser,
 		apiReq:        apiReq,
 		req:           req,
 		contentLength: contentLength,
-		maxWait:       maxWait,
+		backoff:       utils.NewBackoff(downloadResumePolicy(maxWait)),
 	}
 }
 
@@ -76,16 +85,21 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 		for {
 			log.Errorf("Download connection broken: %s", err.Error())
 
-			waitTime, err := GetExponentialBackoffTime(h.retryAttempts, h.maxWait)
+			waitTime, err := h.backoff.Next()
 			if err != nil {
 				return int(h.offset - origOffset),
 					errors.Wrapf(err, "Cannot resume download")
 			}
 
 			log.Infof("Resuming download in %s", waitTime.String())
-			h.retryAttempts += 1
 
-			time.Sleep(waitTime)
+			ctx := requestContext(h.apiReq)
+			select {
+			case <-time.After(waitTime):
+			case <-ctx.Done():
+				return int(h.offset - origOffset),
+					errors.Wrapf(ctx.Err(), "Cannot resume download")
+			}
 
 			log.Infof("Attempting to resume artifact download from offset %d", h.offset)
 
@@ -94,6 +108,10 @@ func (h *UpdateResumer) Read(buf []byte) (int, error) {
 				log.Infof("Download resume request failed: %s", err.Error())
 				continue
 			}
+			if err = checkDeploymentAborted(res); err != nil {
+				res.Body.Close()
+				return int(h.offset - origOffset), err
+			}
 
 			stream, err := h.getStreamFromPartialContent(res)
 			if err != nil {
@@ -17,38 +17,217 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
 	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/store"
 	"github.com/pkg/errors"
 )
 
+// Upper limit of RootfsWriteBufferSizeKiB, as the buffer is held in memory.
+const maxRootfsWriteBufferSizeKiB = 16 * 1024
+
+// The progress of writing updates is recorded in this file, in the data
+// directory, with RootfsResumeInterruptedWrites.
+const rootfsWriteCheckpointFile = "rootfs-write-checkpoint"
+
 type menderConfigFromFile struct {
 	// ClientProtocol "https"
 	ClientProtocol string
 	// Path to the public key used to verify signed updates
 	ArtifactVerifyKey string
+	// Public keys used to verify signed updates, when artifacts may be
+	// signed by several parties (e.g. either vendor or operator)
+	ArtifactVerifyKeys []artifactVerifyKey
+	// Roles from ArtifactVerifyKeys of which the key that signed an
+	// artifact must have one
+	ArtifactVerifyRequiredRoles []string
 	// HTTPS client parameters
 	HttpsClient struct {
 		Certificate string
 		Key         string
 		SkipVerify  bool
 	}
-	// Rootfs device path
+	// OpenSSL engine holding the private key of the device, such as
+	// "ateccx08"; the key is kept in the data directory if empty
+	DeviceKeyEngine string
+	// ID of the private key in DeviceKeyEngine
+	DeviceKeyEngineKeyID string
+	// Type of the device key generated: "rsa" (default), "ecdsa-p256",
+	// "ecdsa-p384" or "ed25519"
+	DeviceKeyType string
+	// Digest signed in authorization requests: "sha256", "sha384" or
+	// "sha512"; depends on the key if empty
+	AuthSignatureDigest string
+	// Boot loader whose environment holds mender_boot_part and the other
+	// boot variables: "u-boot" (the default) or "grub"
+	BootEnvironment string
+	// Path to the GRUB environment block, if BootEnvironment is "grub";
+	// /boot/grub/grubenv if empty
+	GrubEnvPath string
+	// Name of the systemd-boot entry of each rootfs partition, if
+	// BootEnvironment is "systemd-boot", with %s in place of the partition
+	// number; mender-%s.conf if empty
+	SystemdBootEntryFormat string
+	// Path to the autoboot.txt of the Raspberry Pi firmware, if
+	// BootEnvironment is "rpi-tryboot"; /boot/firmware/autoboot.txt if empty
+	TrybootAutobootPath string
+	// The number of the boot partition of each rootfs partition number, if
+	// BootEnvironment is "rpi-tryboot" and they are not the same
+	TrybootBootPartitions map[string]string
+	// Rootfs device path, or PARTUUID=, PARTLABEL=, UUID= or LABEL=
+	// identifier of the partition
 	RootfsPartA string
 	RootfsPartB string
+	// Rootfs device paths which updates are installed to in turn, keeping
+	// the previous updates on the others; overrides RootfsPartA and
+	// RootfsPartB
+	RootfsParts []string
+	// Read back the update written to the inactive partition, and verify
+	// its checksum, before enabling the partition
+	RootfsVerifyWrite bool
+	// Size, in KiB, of the writes of updates to the inactive partition; at
+	// most 16384 (16 MiB), and 1024 if 0
+	RootfsWriteBufferSizeKiB int
+	// Write updates to the inactive partition with direct I/O (O_DIRECT),
+	// bypassing the page cache; buffered writes are used if the partition
+	// does not support it
+	RootfsDirectIO bool
+	// Only write the blocks of updates which differ from the content of the
+	// inactive partition, to reduce flash wear; overrides RootfsDirectIO
+	RootfsSkipIdenticalBlocks bool
+	// Discard the holes in the block map of sparse updates on the inactive
+	// partition, so that flash storage can erase them in the background
+	RootfsDiscardHoles bool
+	// Discard the whole inactive partition before writing an update to it,
+	// which can improve the performance and wear leveling of flash storage;
+	// not done with RootfsSkipIdenticalBlocks
+	RootfsDiscardBeforeWrite bool
+	// Resize the inactive UBI volume if the update does not fit it, from the
+	// free erase blocks of the UBI device
+	RootfsUbiAutoResize bool
+	// Record the progress of writing updates to the inactive partition in
+	// the data directory, so that a write interrupted by a failed download,
+	// or by a restart, is resumed where it stopped instead of from the
+	// start; not done for UBI volumes, raw MTD devices and block mapped
+	// updates
+	RootfsResumeInterruptedWrites bool
+	// Where the key of the LUKS containers on the rootfs partitions is
+	// taken from, "keyring" or "tpm2"; the partitions are not encrypted if
+	// empty. The LUKS UUID of the partition to boot is set in the boot
+	// variable mender_boot_luks_uuid, for the boot loader to give the
+	// kernel, as rd.luks.uuid= for instance
+	RootfsLUKSKeySource string
+	// Description of the key in the user keyring of the kernel, if
+	// RootfsLUKSKeySource is "keyring"
+	RootfsLUKSKeyDescription string
+	// The dm-verity hash partitions of the rootfs partitions, in the order
+	// of RootfsParts, or of RootfsPartA and RootfsPartB, for updates
+	// protected by dm-verity. The root hash of each partition is set in the
+	// boot variable mender_boot_verity_root_hash_<partition number>
+	RootfsVerityHashParts []string
 	// Path to the device type file
 	DeviceTypeFile string
 
+	// Constant identity attributes, such as {"serial": "A1234"}, added to
+	// those of the identity helper; they take precedence over the
+	// attributes of the helper
+	IdentityAttributes map[string]string
+	// Identity attributes whose values are redacted in the logs, such as
+	// "serial"; those named like tokens and passwords always are
+	IdentitySensitiveAttributes []string
+
 	// Poll interval for checking for new updates
 	UpdatePollIntervalSeconds int
 	// Poll interval for periodically sending inventory data
 	InventoryPollIntervalSeconds int
+	// Directory of the mender-inventory-* tools run to gather inventory
+	// data; the inventory directory of the data directory if empty
+	InventoryScriptsDir string
+	// Time each inventory tool is given to run before it is killed, and its
+	// output left out; 5 minutes if 0
+	InventoryScriptTimeoutSeconds int
+	// Constant inventory attributes, such as {"site": "plant-7"}, sent with
+	// every inventory update. They take precedence over the attributes
+	// of the inventory tools, but not over device_type, artifact_name and
+	// mender_client_version.
+	InventoryAttributes map[string]string
+	// Submit only the inventory attributes changed since the last inventory
+	// update, and all of them every this many inventory updates; all of
+	// them each time if 0 or 1
+	InventoryFullUpdateInterval int
+	// Where the coarse location of the device reported in the inventory is
+	// read from: a GPS device or file giving NMEA sentences, such as
+	// /dev/ttyUSB0, or gpsd, as "gpsd:localhost:2947" or
+	// "gpsd:/run/gpsd.sock"; not reported if empty
+	InventoryLocationSource string
+	// Report the free space of the data partition, the memory usage, the
+	// uptime and the CPU temperature in the inventory
+	InventoryHealthMetrics bool
+	// Randomize the update, inventory and retry poll intervals by up to
+	// this percentage either way, so that devices sharing a configuration do
+	// not poll the server in step
+	PollIntervalJitterPercent int
+	// Delay the first update check and inventory update after the start of
+	// the daemon by a random time of up to this many seconds, so that a
+	// fleet coming back from an outage does not reach the server all at once
+	PollStartupSplaySeconds int
+	// Wait for update notifications from the server, in addition to
+	// polling, so that new deployments are picked up right away
+	UpdateNotificationEnabled bool
+	// How long each update notification request is held by the server
+	UpdateNotificationTimeoutSeconds int
+
+	// Publish the io.mender.UpdateManager service on the system D-Bus
+	DBusEnabled bool
+	// Unix socket to serve the local API on; the API is disabled if empty
+	LocalAPISocket string
+	// Group, besides root, allowed to use the local API
+	LocalAPIGroup string
+	// Unix socket to serve the API token of the client on, for on-device
+	// processes talking to the server themselves; disabled if empty
+	LocalAuthSocket string
+	// Group, besides root, allowed to read the API token
+	LocalAuthGroup string
 
 	// Global retry polling max interval for fetching update, authorize wait and update status
 	RetryPollIntervalSeconds int
+	// Interval between the authorization attempts of a device the server
+	// rejects as decommissioned; 24 hours if 0
+	DecommissionedRetryIntervalSeconds int
+	// Remove the device key and the authorization token once the server
+	// has rejected the device as decommissioned for this long, so that
+	// the device authorizes as a new one; never if 0
+	DecommissionedWipeAfterSeconds int
+	// Interval between the substate reports sent to the server while a long
+	// running phase of a deployment is in progress; 0 disables them
+	SubstateReportIntervalSeconds int
+
+	// Minimum interval between the completion of one deployment and the
+	// start of the next one
+	DeploymentMinIntervalSeconds int
+	// Maximum number of deployments installed within 24 hours
+	DeploymentMaxPerDay int
+
+	// Maintenance windows, as "[<days>] HH:MM-HH:MM", such as
+	// "Mon-Fri 02:00-04:00", or as a cron expression and a duration, such
+	// as "30 1 * * Sat 3h", in which updates are installed, and in which
+	// the device reboots into them; any time if empty. Updates are
+	// downloaded any time.
+	InstallWindows []string
+	RebootWindows  []string
+	// Time zone of the maintenance windows, as a tz database name, such as
+	// "Europe/Oslo"; the local time zone if empty
+	MaintenanceWindowTimeZone string
+	// Wait for a confirmation on the device before rebooting into updates,
+	// and before committing them. Confirmations are given through the
+	// D-Bus API, the local API, or by creating the flag files
+	// confirm-reboot and confirm-commit in the data store directory.
+	RebootConfirmationRequired bool
+	CommitConfirmationRequired bool
 
 	// State script parameters
 	StateScriptTimeoutSeconds      int
@@ -62,18 +241,92 @@ type menderConfigFromFile struct {
 	// will be killed.
 	ModuleTimeoutSeconds int
 
-	// Path to server SSL certificate
+	// Where the configuration applied by mender-configure payloads is
+	// kept, and the directory of the scripts applying it; the same as
+	// those of mender-configure if empty
+	ConfigureDeviceConfigFile string
+	ConfigureApplyScriptsDir  string
+
+	// Minimum expected throughput, in KiB per second, when writing updates
+	// to the inactive partition. Lower throughput, which may be a sign of
+	// failing flash storage, is flagged in the inventory. 0 disables the
+	// check.
+	WriteThroughputMinKiBps int
+
+	// Directory the last artifact downloaded is kept in, so that a failed
+	// install can be retried, and nearby devices can fetch the artifact,
+	// without downloading it again; artifacts are not kept if empty
+	ArtifactCacheDir string
+	// Free space, in MiB, left on the file system of ArtifactCacheDir once
+	// an artifact is kept there; artifacts which would not leave this much
+	// are not kept
+	ArtifactCacheMinFreeMiB int
+
+	// Base URLs of mirrors of the artifacts on the local network, such as
+	// "http://gateway.local:8080/artifacts", tried before the server. The
+	// artifact is fetched from <URL>/<artifact name>.mender, and only if
+	// its manifest is that of the artifact of the server.
+	ArtifactMirrors []string
+	// mDNS service of the artifact mirrors discovered on the local
+	// network, such as "_mender-cache._tcp", tried after ArtifactMirrors;
+	// not discovered if empty
+	ArtifactMirrorMDNSService string
+
+	// Path to server SSL certificate; the default of entries in Servers
 	ServerCertificate string
+	// Revocation checking of the server certificate: "" (off),
+	// "soft-fail" to accept certificates of unknown revocation status, or
+	// "hard-fail" to reject them. The OCSP response stapled by the server
+	// and ServerCertificateCRL are checked.
+	ServerCertificateRevocation string
+	// File with CRLs of the server certificate and its issuers
+	ServerCertificateCRL string
+	// File holding the credentials, as "user:password", of the proxies
+	// given without any, readable by root only
+	ProxyCredentialsFile string
 	// Server URL (For single server conf)
 	ServerURL string
 	// Path to deployment log file
 	UpdateLogPath string
-	// Server JWT TenantToken
+	// Reject unknown options in the configuration files, which are
+	// otherwise ignored with a warning
+	StrictConfig bool
+	// Log level of the daemon, unless given on the command line: "debug",
+	// "info" (default), "warning", "error", "fatal" or "panic"
+	LogLevel string
+	// Maximum size in bytes of the log kept for a single deployment; the
+	// oldest entries are dropped when the limit is reached. 0 (default)
+	// means no limit.
+	DeploymentLogMaxSizeBytes int64
+	// Compress deployment logs (gzip) when uploading them to the server
+	DeploymentLogCompress bool
+	// Maximum size in bytes of deployment logs sent in a single request;
+	// larger logs are split into several requests. 0 means no limit.
+	DeploymentLogMaxChunkSize int
+	// Server JWT TenantToken; the default of entries in Servers
 	TenantToken string
+	// File holding the tenant token instead of TenantToken, readable by
+	// root only, so that mender.conf can be world-readable
+	TenantTokenFile string
+	// Where the authorization token is kept: "db" (default) in the client
+	// database, "memory" to keep it in memory only, "encrypted-file" or
+	// "systemd-creds"
+	AuthTokenStore string
+	// Token file of the "encrypted-file" and "systemd-creds" token stores
+	AuthTokenStorePath string
+	// Key file of the "encrypted-file" token store
+	AuthTokenKeyFile string
 	// List of available servers, to which client can fall over
 	Servers []client.MenderServer
 }
 
+type artifactVerifyKey struct {
+	// Path to the public key
+	Path string
+	// Role of the signing party, e.g. "vendor" or "operator"
+	Role string
+}
+
 type menderConfig struct {
 	menderConfigFromFile
 
@@ -85,6 +338,9 @@ type menderConfig struct {
 
 	ArtifactScriptsPath string
 	RootfsScriptsPath   string
+
+	// Read from ProxyCredentialsFile.
+	proxyCredentials string
 }
 
 func NewMenderConfig() *menderConfig {
@@ -105,29 +361,125 @@ func NewMenderConfig() *menderConfig {
 // values into the menderConfig structure defining high level client
 // configurations.
 func loadConfig(mainConfigFile string, fallbackConfigFile string) (*menderConfig, error) {
-	// Load fallback configuration first, then main configuration.
+	// Load fallback configuration first, then main configuration, then the
+	// *.json drop-in files of the directory named after the main
+	// configuration with ".d" appended, such as
+	// /etc/mender/mender.conf.d, in the order of their names.
 	// It is OK if either file does not exist, so long as the other one does exist.
 	// It is also OK if both files exist.
-	// Because the main configuration is loaded last, its option values
-	// override those from the fallback file, for options present in both files.
+	// Because the main configuration is loaded after the fallback one, its
+	// option values override those from the fallback file, for options
+	// present in both files. Likewise, the drop-in files override both,
+	// and the ones before them, and MENDER_ environment variables override
+	// all of them.
 
-	var filesLoadedCount int
 	config := NewMenderConfig()
+	sources := newConfigSources()
 
-	if loadErr := loadConfigFile(fallbackConfigFile, config, &filesLoadedCount); loadErr != nil {
-		return nil, loadErr
+	filesLoadedCount, err := loadConfigFiles(mainConfigFile, fallbackConfigFile,
+		config, sources)
+	if err != nil {
+		return nil, err
 	}
 
-	if loadErr := loadConfigFile(mainConfigFile, config, &filesLoadedCount); loadErr != nil {
-		return nil, loadErr
+	// MENDER_ environment variables override all the files.
+	envOverrides, err := loadConfigEnvironment(&config.menderConfigFromFile, sources)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid configuration in the environment")
 	}
 
-	if filesLoadedCount == 0 {
+	if filesLoadedCount == 0 && envOverrides == 0 {
 		log.Info("No configuration files present. Using defaults")
 		return config, nil
 	}
 
+	if err := checkUnknownConfigOptions(config, sources); err != nil {
+		return nil, err
+	}
+
+	if err := loadConfigSecrets(config, sources); err != nil {
+		return nil, err
+	}
+
+	if err := checkConfig(config, sources); err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Merged configuration = %#v", config)
+
+	return config, nil
+}
+
+// loadConfigFiles loads the fallback and main configuration files, and the
+// drop-in files, and returns how many of them there were.
+func loadConfigFiles(mainConfigFile string, fallbackConfigFile string,
+	config *menderConfig, sources *configSources) (int, error) {
+
+	var filesLoadedCount int
+
+	if loadErr := loadConfigFile(fallbackConfigFile, config, sources, &filesLoadedCount); loadErr != nil {
+		return 0, loadErr
+	}
+
+	if loadErr := loadConfigFile(mainConfigFile, config, sources, &filesLoadedCount); loadErr != nil {
+		return 0, loadErr
+	}
+
+	dropIns, err := filepath.Glob(filepath.Join(mainConfigFile+".d", "*.json"))
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid configuration directory")
+	}
+	for _, dropIn := range dropIns {
+		if loadErr := loadConfigFile(dropIn, config, sources, &filesLoadedCount); loadErr != nil {
+			return 0, loadErr
+		}
+	}
+	return filesLoadedCount, nil
+}
+
+// checkConfig checks the merged configuration, filling in the per server
+// options from the global ones.
+func checkConfig(config *menderConfig, sources *configSources) error {
+	if err := checkServerConfig(config, sources); err != nil {
+		return err
+	}
+
+	if err := checkArtifactVerifyConfig(config); err != nil {
+		return err
+	}
+
+	if err := checkRevocationConfig(config); err != nil {
+		return err
+	}
+
+	if err := checkRootfsConfig(config); err != nil {
+		return err
+	}
+
+	if err := checkConfigIntervals(config, sources); err != nil {
+		return err
+	}
+	checkConflictingConfigOptions(config, sources)
+
+	if err := checkConfigRanges(config, sources); err != nil {
+		return err
+	}
+
+	if err := checkDeviceKeyConfig(config); err != nil {
+		return err
+	}
+
+	if err := checkIdentityConfig(config, sources); err != nil {
+		return err
+	}
+
+	return checkMaintenanceConfig(config)
+}
+
+func checkServerConfig(config *menderConfig, sources *configSources) error {
+	serversOption := "Servers"
 	if config.Servers == nil {
+		serversOption = "ServerURL"
 		if config.ServerURL == "" {
 			log.Warn("No server URL(s) specified in mender configuration.")
 		}
@@ -138,8 +490,8 @@ func loadConfig(mainConfigFile string, fallbackConfigFile string) (*menderConfig
 			"AND the corresponding fields in base structure (i.e. " +
 			"ServerURL). The first server on the list on the" +
 			"list overwrites these fields.")
-		return nil, errors.New("Both Servers AND ServerURL given in " +
-			"mender.conf")
+		return errors.Errorf("Both %s AND %s given in mender.conf",
+			sources.describe("Servers"), sources.describe("ServerURL"))
 	}
 	for i := 0; i < len(config.Servers); i++ {
 		// Trim possible '/' suffix, which is added back in URL path
@@ -150,15 +502,147 @@ func loadConfig(mainConfigFile string, fallbackConfigFile string) (*menderConfig
 		}
 		if config.Servers[i].ServerURL == "" {
 			log.Warnf("Server entry %d has no associated server URL.", i+1)
+		} else if err := checkServerURL(config.Servers[i].ServerURL); err != nil {
+			return errors.Wrapf(err, "invalid server URL in %s in mender.conf",
+				sources.describe(serversOption))
+		}
+		if config.Servers[i].TenantToken == "" {
+			config.Servers[i].TenantToken = config.TenantToken
+		}
+		if config.Servers[i].ServerCertificate == "" {
+			config.Servers[i].ServerCertificate = config.ServerCertificate
 		}
 	}
+	return nil
+}
 
-	log.Debugf("Merged configuration = %#v", config)
+func checkRevocationConfig(config *menderConfig) error {
+	switch config.ServerCertificateRevocation {
+	case client.RevocationCheckOff, client.RevocationCheckSoftFail,
+		client.RevocationCheckHardFail:
+		return nil
+	default:
+		return errors.Errorf("unknown ServerCertificateRevocation %q in mender.conf",
+			config.ServerCertificateRevocation)
+	}
+}
 
-	return config, nil
+func checkRootfsConfig(config *menderConfig) error {
+	if _, err := installer.NewBootEnvironment(config.GetBootEnvironmentConfig(), nil); err != nil {
+		return errors.Wrap(err, "invalid BootEnvironment configuration in mender.conf")
+	}
+
+	if len(config.RootfsParts) == 1 {
+		return errors.New("RootfsParts in mender.conf must hold at least " +
+			"two partitions")
+	}
+
+	if err := installer.CheckLUKSConfig(config.RootfsLUKSKeySource,
+		config.RootfsLUKSKeyDescription); err != nil {
+		return errors.Wrap(err, "invalid RootfsLUKSKeySource configuration in mender.conf")
+	}
+
+	if len(config.RootfsVerityHashParts) > 0 {
+		rootfsParts := len(config.RootfsParts)
+		if rootfsParts == 0 {
+			rootfsParts = 2
+		}
+		if len(config.RootfsVerityHashParts) != rootfsParts {
+			return errors.Errorf("RootfsVerityHashParts in mender.conf must hold "+
+				"one hash partition for each of the %d rootfs partitions", rootfsParts)
+		}
+	}
+	return nil
+}
+
+// checkConfigRanges checks the options which must be within a range, or
+// one of a set of values.
+func checkConfigRanges(config *menderConfig, sources *configSources) error {
+	if config.PollIntervalJitterPercent < 0 || config.PollIntervalJitterPercent > 100 {
+		return errors.Errorf("%s in mender.conf must be between 0 and 100",
+			sources.describe("PollIntervalJitterPercent"))
+	}
+
+	if config.LogLevel != "" {
+		if _, err := log.ParseLevel(config.LogLevel); err != nil {
+			return errors.Wrapf(err, "invalid %s in mender.conf",
+				sources.describe("LogLevel"))
+		}
+	}
+
+	if config.RootfsWriteBufferSizeKiB < 0 ||
+		config.RootfsWriteBufferSizeKiB > maxRootfsWriteBufferSizeKiB {
+		return errors.Errorf("%s in mender.conf must be between 0 and %d",
+			sources.describe("RootfsWriteBufferSizeKiB"), maxRootfsWriteBufferSizeKiB)
+	}
+	return nil
 }
 
-func loadConfigFile(configFile string, config *menderConfig, filesLoadedCount *int) error {
+func checkDeviceKeyConfig(config *menderConfig) error {
+	if _, err := store.ParseKeyOptions(config.DeviceKeyType,
+		config.AuthSignatureDigest); err != nil {
+		return errors.Wrap(err, "invalid device key settings in mender.conf")
+	}
+
+	if config.DeviceKeyEngine != "" && config.DeviceKeyEngineKeyID == "" {
+		return errors.New("DeviceKeyEngine requires DeviceKeyEngineKeyID " +
+			"in mender.conf")
+	}
+	return nil
+}
+
+func checkIdentityConfig(config *menderConfig, sources *configSources) error {
+	identity := IdentityData{}
+	for name, value := range config.IdentityAttributes {
+		identity[name] = value
+	}
+	if err := identity.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid %s in mender.conf",
+			sources.describe("IdentityAttributes"))
+	}
+	return nil
+}
+
+func checkMaintenanceConfig(config *menderConfig) error {
+	for name, windows := range map[string][]string{
+		"InstallWindows": config.InstallWindows,
+		"RebootWindows":  config.RebootWindows,
+	} {
+		if _, err := parseMaintenanceWindows(windows,
+			config.MaintenanceWindowTimeZone); err != nil {
+			return errors.Wrapf(err, "invalid %s in mender.conf", name)
+		}
+	}
+	return nil
+}
+
+func checkArtifactVerifyConfig(config *menderConfig) error {
+	if len(config.ArtifactVerifyKeys) == 0 {
+		if len(config.ArtifactVerifyRequiredRoles) > 0 {
+			return errors.New("ArtifactVerifyRequiredRoles requires " +
+				"ArtifactVerifyKeys in mender.conf")
+		}
+		return nil
+	}
+	if config.ArtifactVerifyKey != "" {
+		return errors.New("Both ArtifactVerifyKey AND ArtifactVerifyKeys " +
+			"given in mender.conf")
+	}
+	roles := make(map[string]bool)
+	for _, key := range config.ArtifactVerifyKeys {
+		roles[key.Role] = true
+	}
+	for _, role := range config.ArtifactVerifyRequiredRoles {
+		if !roles[role] {
+			return errors.Errorf("no key in ArtifactVerifyKeys has the "+
+				"required role %q", role)
+		}
+	}
+	return nil
+}
+
+func loadConfigFile(configFile string, config *menderConfig, sources *configSources,
+	filesLoadedCount *int) error {
 	// Do not treat a single config file not existing as an error here.
 	// It is up to the caller to fail when both config files don't exist.
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
@@ -166,10 +650,16 @@ func loadConfigFile(configFile string, config *menderConfig, filesLoadedCount *i
 		return nil
 	}
 
-	if err := readConfigFile(&config.menderConfigFromFile, configFile); err != nil {
+	log.Debug("Reading Mender configuration from file " + configFile)
+	conf, err := ioutil.ReadFile(configFile)
+	if err == nil {
+		err = decodeConfig(&config.menderConfigFromFile, configFile, conf)
+	}
+	if err != nil {
 		log.Errorf("Error loading configuration from file: %s (%s)", configFile, err.Error())
 		return err
 	}
+	sources.scanFile(configFile, conf)
 
 	(*filesLoadedCount)++
 	log.Info("Loaded configuration file: ", configFile)
@@ -185,10 +675,20 @@ func readConfigFile(config interface{}, fileName string) error {
 		return err
 	}
 
+	return decodeConfig(config, fileName, conf)
+}
+
+// decodeConfig decodes a configuration file, giving the line of the error if it
+// is invalid.
+func decodeConfig(config interface{}, fileName string, conf []byte) error {
 	if err := json.Unmarshal(conf, &config); err != nil {
-		switch err.(type) {
+		switch err := err.(type) {
 		case *json.SyntaxError:
-			return errors.New("Error parsing mender configuration file: " + err.Error())
+			return errors.Errorf("Error parsing mender configuration file: %s:%d: %s",
+				fileName, configLine(conf, err.Offset), err.Error())
+		case *json.UnmarshalTypeError:
+			return errors.Errorf("Error parsing config file: %s:%d: invalid %s: %s",
+				fileName, configLine(conf, err.Offset), err.Field, err.Error())
 		}
 		return errors.New("Error parsing config file: " + err.Error())
 	}
@@ -198,16 +698,40 @@ func readConfigFile(config interface{}, fileName string) error {
 
 func (c *menderConfig) GetHttpConfig() client.Config {
 	return client.Config{
-		ServerCert: c.ServerCertificate,
-		IsHttps:    c.ClientProtocol == "https",
-		NoVerify:   c.HttpsClient.SkipVerify,
+		ServerCert:       c.ServerCertificate,
+		IsHttps:          c.ClientProtocol == "https",
+		NoVerify:         c.HttpsClient.SkipVerify,
+		RevocationCheck:  c.ServerCertificateRevocation,
+		CRLFile:          c.ServerCertificateCRL,
+		ProxyCredentials: c.proxyCredentials,
+	}
+}
+
+func (c *menderConfig) GetBootEnvironmentConfig() installer.BootEnvironmentConfig {
+	return installer.BootEnvironmentConfig{
+		BootLoader:             c.BootEnvironment,
+		GrubEnvPath:            c.GrubEnvPath,
+		SystemdBootEntryFormat: c.SystemdBootEntryFormat,
+		AutobootPath:           c.TrybootAutobootPath,
+		TrybootBootPartitions:  c.TrybootBootPartitions,
 	}
 }
 
 func (c *menderConfig) GetDeviceConfig() installer.DualRootfsDeviceConfig {
 	return installer.DualRootfsDeviceConfig{
-		RootfsPartA: c.RootfsPartA,
-		RootfsPartB: c.RootfsPartB,
+		RootfsPartA:         c.RootfsPartA,
+		RootfsPartB:         c.RootfsPartB,
+		RootfsParts:         c.RootfsParts,
+		VerifyWrite:         c.RootfsVerifyWrite,
+		WriteBufferSize:     c.RootfsWriteBufferSizeKiB * 1024,
+		DirectIO:            c.RootfsDirectIO,
+		SkipIdenticalBlocks: c.RootfsSkipIdenticalBlocks,
+		DiscardHoles:        c.RootfsDiscardHoles,
+		DiscardBeforeWrite:  c.RootfsDiscardBeforeWrite,
+		UbiAutoResize:       c.RootfsUbiAutoResize,
+		LUKSKeySource:       c.RootfsLUKSKeySource,
+		LUKSKeyDescription:  c.RootfsLUKSKeyDescription,
+		VerityHashParts:     c.RootfsVerityHashParts,
 	}
 }
 
@@ -215,6 +739,49 @@ func (c *menderConfig) GetDeploymentLogLocation() string {
 	return c.UpdateLogPath
 }
 
+func (c *menderConfig) GetLogUploadConfig() client.LogUploadConfig {
+	return client.LogUploadConfig{
+		Compress:     c.DeploymentLogCompress,
+		MaxChunkSize: c.DeploymentLogMaxChunkSize,
+	}
+}
+
+// GetTokenStore returns the storage of the authorization token, or nil if
+// the token is kept in the client database.
+func (c *menderConfig) GetTokenStore() (store.TokenStore, error) {
+	switch c.AuthTokenStore {
+	case "", "db":
+		return nil, nil
+	case "memory":
+		return store.NewMemTokenStore(), nil
+	case "encrypted-file":
+		if c.AuthTokenStorePath == "" || c.AuthTokenKeyFile == "" {
+			return nil, errors.New("the encrypted-file token store needs " +
+				"both AuthTokenStorePath and AuthTokenKeyFile")
+		}
+		return store.NewEncryptedFileTokenStore(c.AuthTokenStorePath,
+			c.AuthTokenKeyFile), nil
+	case "systemd-creds":
+		if c.AuthTokenStorePath == "" {
+			return nil, errors.New("the systemd-creds token store needs AuthTokenStorePath")
+		}
+		return store.NewSystemdCredsTokenStore(c.AuthTokenStorePath), nil
+	default:
+		return nil, errors.Errorf("unknown AuthTokenStore %q", c.AuthTokenStore)
+	}
+}
+
+// GetKeyOptions returns the type of the device key, and the digest signed
+// with it.
+func (c *menderConfig) GetKeyOptions() store.KeyOptions {
+	opts, err := store.ParseKeyOptions(c.DeviceKeyType, c.AuthSignatureDigest)
+	if err != nil {
+		log.Errorf("Using the default device key settings: %v", err)
+		return store.KeyOptions{}
+	}
+	return opts
+}
+
 // GetTenantToken returns a default tenant-token if
 // no custom token is set in local.conf
 func (c *menderConfig) GetTenantToken() []byte {
@@ -232,3 +799,32 @@ func (c *menderConfig) GetVerificationKey() []byte {
 	}
 	return key
 }
+
+// GetSignaturePolicy returns the policy used to verify artifact signatures,
+// or nil if no verification key is configured. The keys are read from their
+// files on every call.
+func (c *menderConfig) GetSignaturePolicy() *installer.SignaturePolicy {
+	if len(c.ArtifactVerifyKeys) == 0 {
+		return installer.NewSingleKeyPolicy(c.GetVerificationKey())
+	}
+
+	policy := &installer.SignaturePolicy{
+		RequiredRoles: c.ArtifactVerifyRequiredRoles,
+	}
+	for _, k := range c.ArtifactVerifyKeys {
+		key, err := ioutil.ReadFile(k.Path)
+		if err != nil {
+			// A missing key makes the policy harder to satisfy, never
+			// easier, so carry on with the remaining keys. A policy
+			// left without keys accepts no artifact.
+			log.Errorf("config: error reading artifact verify key %s: %v",
+				k.Path, err)
+			continue
+		}
+		policy.Keys = append(policy.Keys, installer.VerificationKey{
+			Role: k.Role,
+			Key:  key,
+		})
+	}
+	return policy
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Prefix of the environment variables overriding the configuration files.
+const configEnvironmentPrefix = "MENDER_"
+
+// Units and names spelled as a single word in the names of the environment
+// variables.
+var configEnvironmentWords = strings.NewReplacer("KiB", "Kib", "MiB", "Mib", "DBus", "Dbus")
+
+// configEnvironmentName returns the name of the environment variable of a
+// configuration option, such as MENDER_SERVER_URL for ServerURL, and
+// MENDER_UPDATE_POLL_INTERVAL_SECONDS for UpdatePollIntervalSeconds.
+func configEnvironmentName(option string) string {
+	runes := []rune(configEnvironmentWords.Replace(option))
+	var name strings.Builder
+	name.WriteString(configEnvironmentPrefix)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				name.WriteByte('_')
+			}
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// loadConfigEnvironment overrides the options of the configuration set in
+// MENDER_ environment variables. String options are taken as they are, and the
+// others are given as JSON, such as MENDER_SERVERS='[{"ServerURL": "..."}]'.
+// It returns how many options were overridden.
+func loadConfigEnvironment(config *menderConfigFromFile, sources *configSources) (int, error) {
+	var overridden int
+	options := reflect.ValueOf(config).Elem()
+	for i := 0; i < options.NumField(); i++ {
+		option := options.Type().Field(i).Name
+		name := configEnvironmentName(option)
+		value, set := os.LookupEnv(name)
+		if !set {
+			continue
+		}
+		field := options.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+		} else if err := json.Unmarshal([]byte(value), field.Addr().Interface()); err != nil {
+			return overridden, errors.Wrapf(err, "invalid %s", name)
+		}
+		log.Infof("Configuration option %s set by %s", option, name)
+		sources.origins[option] = "environment variable " + name
+		overridden++
+	}
+	return overridden, nil
+}
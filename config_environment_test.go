@@ -0,0 +1,99 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigEnvironmentName(t *testing.T) {
+	for option, name := range map[string]string{
+		"ServerURL":                 "MENDER_SERVER_URL",
+		"TenantToken":               "MENDER_TENANT_TOKEN",
+		"UpdatePollIntervalSeconds": "MENDER_UPDATE_POLL_INTERVAL_SECONDS",
+		"RootfsPartA":               "MENDER_ROOTFS_PART_A",
+		"DeviceKeyEngineKeyID":      "MENDER_DEVICE_KEY_ENGINE_KEY_ID",
+		"LocalAPISocket":            "MENDER_LOCAL_API_SOCKET",
+		"RootfsWriteBufferSizeKiB":  "MENDER_ROOTFS_WRITE_BUFFER_SIZE_KIB",
+		"ArtifactCacheMinFreeMiB":   "MENDER_ARTIFACT_CACHE_MIN_FREE_MIB",
+		"DBusEnabled":               "MENDER_DBUS_ENABLED",
+	} {
+		assert.Equal(t, name, configEnvironmentName(option))
+	}
+}
+
+func setConfigEnvironment(t *testing.T, env map[string]string) func() {
+	for name, value := range env {
+		require.NoError(t, os.Setenv(name, value))
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestConfigEnvironmentOverrides(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+		"ServerURL": "https://hosted.mender.io",
+		"TenantToken": "file-token",
+		"UpdatePollIntervalSeconds": 1800,
+		"RootfsPartA": "/dev/mmcblk0p2"
+	}`), 0600))
+
+	unset := setConfigEnvironment(t, map[string]string{
+		"MENDER_SERVER_URL":                   "https://mender.example.com",
+		"MENDER_TENANT_TOKEN":                 "env-token",
+		"MENDER_UPDATE_POLL_INTERVAL_SECONDS": "60",
+		"MENDER_DBUS_ENABLED":                 "true",
+		"MENDER_INVENTORY_ATTRIBUTES":         `{"site": "lab"}`,
+	})
+	defer unset()
+
+	config, err := loadConfig(confPath, path.Join(tdir, "does-not-exist.config"))
+	require.NoError(t, err)
+	assert.Equal(t, []client.MenderServer{{
+		ServerURL:   "https://mender.example.com",
+		TenantToken: "env-token",
+	}}, config.Servers)
+	assert.Equal(t, 60, config.UpdatePollIntervalSeconds)
+	assert.True(t, config.DBusEnabled)
+	assert.Equal(t, map[string]string{"site": "lab"}, config.InventoryAttributes)
+	assert.Equal(t, "/dev/mmcblk0p2", config.RootfsPartA)
+
+	// The environment is enough without configuration files, such as
+	// in a container.
+	config, err = loadConfig(path.Join(tdir, "does-not-exist.config"),
+		path.Join(tdir, "does-not-exist.config"))
+	require.NoError(t, err)
+	assert.Equal(t, "https://mender.example.com", config.Servers[0].ServerURL)
+
+	// Options other than strings must be valid JSON.
+	defer setConfigEnvironment(t, map[string]string{
+		"MENDER_UPDATE_POLL_INTERVAL_SECONDS": "soon",
+	})()
+	_, err = loadConfig(confPath, path.Join(tdir, "does-not-exist.config"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "MENDER_UPDATE_POLL_INTERVAL_SECONDS")
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// loadConfigSecrets reads the secrets kept in files of their own, so that the
+// configuration files can be world-readable and shipped in images.
+func loadConfigSecrets(config *menderConfig, sources *configSources) error {
+	if config.TenantTokenFile != "" {
+		if config.TenantToken != "" {
+			return errors.Errorf("Both %s AND %s given in mender.conf",
+				sources.describe("TenantToken"), sources.describe("TenantTokenFile"))
+		}
+		token, err := readSecretFile(config.TenantTokenFile)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s in mender.conf",
+				sources.describe("TenantTokenFile"))
+		}
+		config.TenantToken = token
+	}
+
+	if config.ProxyCredentialsFile != "" {
+		credentials, err := readSecretFile(config.ProxyCredentialsFile)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s in mender.conf",
+				sources.describe("ProxyCredentialsFile"))
+		}
+		config.proxyCredentials = credentials
+	}
+	return nil
+}
+
+// readSecretFile returns the secret held in a file, warning if the file can be
+// accessed by others than its owner.
+func readSecretFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Warnf("%s holds secrets, but can be accessed by others than its owner "+
+			"(mode %s)", name, info.Mode().Perm())
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", errors.Errorf("%s is empty", name)
+	}
+	return secret, nil
+}
+
+// writeSecretFile replaces the secret held in a file, which only its owner can
+// access.
+func writeSecretFile(name, secret string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(secret + "\n")
+	if serr := tmp.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
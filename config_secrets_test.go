@@ -0,0 +1,66 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigSecretFiles(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+	tokenPath := path.Join(tdir, "tenant-token")
+	credentialsPath := path.Join(tdir, "proxy-credentials")
+
+	require.NoError(t, ioutil.WriteFile(tokenPath, []byte("tenant-jwt\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(credentialsPath, []byte("mender:secret\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+		"Servers": [{"ServerURL": "https://hosted.mender.io"},
+			{"ServerURL": "https://mender.example.com", "TenantToken": "onprem-jwt"}],
+		"TenantTokenFile": "`+tokenPath+`",
+		"ProxyCredentialsFile": "`+credentialsPath+`"
+	}`), 0644))
+
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("tenant-jwt"), config.GetTenantToken())
+	assert.Equal(t, "tenant-jwt", config.Servers[0].TenantToken)
+	assert.Equal(t, "onprem-jwt", config.Servers[1].TenantToken)
+	assert.Equal(t, "mender:secret", config.GetHttpConfig().ProxyCredentials)
+
+	// Empty and missing files are errors.
+	require.NoError(t, ioutil.WriteFile(tokenPath, []byte("\n"), 0600))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+	require.NoError(t, os.Remove(tokenPath))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+
+	// The token can not be given twice.
+	require.NoError(t, ioutil.WriteFile(tokenPath, []byte("tenant-jwt"), 0600))
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+		"ServerURL": "https://hosted.mender.io",
+		"TenantToken": "tenant-jwt",
+		"TenantTokenFile": "`+tokenPath+`"
+	}`), 0644))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+}
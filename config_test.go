@@ -14,6 +14,7 @@
 package main
 
 import (
+	"crypto"
 	"io/ioutil"
 	"os"
 	"path"
@@ -21,7 +22,10 @@ import (
 	"testing"
 
 	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/store"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testConfig = `{
@@ -106,7 +110,10 @@ func validateConfiguration(t *testing.T, actual *menderConfig) {
 		ServerCertificate:            "/var/lib/mender/server.crt",
 		UpdateLogPath:                "/var/lib/mender/log/deployment.log",
 		DeviceTypeFile:               "/var/lib/mender/test_device_type",
-		Servers:                      []client.MenderServer{{ServerURL: "mender.io"}},
+		Servers: []client.MenderServer{{
+			ServerURL:         "mender.io",
+			ServerCertificate: "/var/lib/mender/server.crt",
+		}},
 	}
 	if !assert.True(t, reflect.DeepEqual(actual, expectedConfig)) {
 		t.Logf("got:      %+v", actual)
@@ -170,6 +177,35 @@ func TestMultipleServersConfig(t *testing.T) {
 	assert.Equal(t, "https://server.three", conf.Servers[2].ServerURL)
 }
 
+func TestServersConfigDefaults(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+    "TenantToken": "hosted-tenant",
+    "Servers": [
+        {"ServerURL": "https://hosted.mender.io"},
+        {"ServerURL": "https://mender.example.com",
+         "TenantToken": "onprem-tenant",
+         "ServerCertificate": "/etc/mender/onprem.crt"}
+    ]
+}`), 0600))
+
+	conf, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, []client.MenderServer{
+		{
+			ServerURL:   "https://hosted.mender.io",
+			TenantToken: "hosted-tenant",
+		},
+		{
+			ServerURL:         "https://mender.example.com",
+			TenantToken:       "onprem-tenant",
+			ServerCertificate: "/etc/mender/onprem.crt",
+		},
+	}, conf.Servers)
+}
+
 func TestConfigurationMergeSettings(t *testing.T) {
 	var mainConfigJson = `{
 		"RootfsPartA": "Eggplant",
@@ -205,8 +241,416 @@ func TestConfigurationMergeSettings(t *testing.T) {
 	assert.Equal(t, 375, config.UpdatePollIntervalSeconds)
 }
 
+func TestConfigurationDropInFiles(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	mainConfPath := path.Join(tdir, "mender.conf")
+	fallbackConfPath := path.Join(tdir, "fallback.conf")
+	dropInDir := mainConfPath + ".d"
+	require.NoError(t, os.Mkdir(dropInDir, 0700))
+
+	require.NoError(t, ioutil.WriteFile(fallbackConfPath,
+		[]byte(`{"RootfsPartA": "Spinach", "RootfsPartB": "Lettuce"}`), 0600))
+	require.NoError(t, ioutil.WriteFile(mainConfPath,
+		[]byte(`{"RootfsPartA": "Eggplant", "UpdatePollIntervalSeconds": 375}`), 0600))
+	require.NoError(t, ioutil.WriteFile(path.Join(dropInDir, "50-oem.json"),
+		[]byte(`{"RootfsPartB": "Kale", "UpdatePollIntervalSeconds": 600,
+			"InventoryPollIntervalSeconds": 3600}`), 0600))
+	require.NoError(t, ioutil.WriteFile(path.Join(dropInDir, "90-local.json"),
+		[]byte(`{"UpdatePollIntervalSeconds": 60}`), 0600))
+	// Only *.json files are loaded.
+	require.NoError(t, ioutil.WriteFile(path.Join(dropInDir, "99-local.json.orig"),
+		[]byte(`{"UpdatePollIntervalSeconds": 1}`), 0600))
+
+	// The drop-in files override the main and fallback files, and the
+	// ones before them.
+	config, err := loadConfig(mainConfPath, fallbackConfPath)
+	require.NoError(t, err)
+	assert.Equal(t, "Eggplant", config.RootfsPartA)
+	assert.Equal(t, "Kale", config.RootfsPartB)
+	assert.Equal(t, 60, config.UpdatePollIntervalSeconds)
+	assert.Equal(t, 3600, config.InventoryPollIntervalSeconds)
+
+	// They are loaded without a main configuration file too.
+	require.NoError(t, os.Remove(mainConfPath))
+	config, err = loadConfig(mainConfPath, fallbackConfPath)
+	require.NoError(t, err)
+	assert.Equal(t, "Spinach", config.RootfsPartA)
+	assert.Equal(t, 60, config.UpdatePollIntervalSeconds)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(dropInDir, "95-broken.json"),
+		[]byte(`{"UpdatePollIntervalSeconds": `), 0600))
+	_, err = loadConfig(mainConfPath, fallbackConfPath)
+	assert.Error(t, err)
+}
+
+func TestRootfsWriteConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "RootfsPartA": "/dev/mmcblk0p2",
+  "RootfsPartB": "/dev/mmcblk0p3",
+  "RootfsVerifyWrite": true,
+  "RootfsWriteBufferSizeKiB": 4096,
+  "RootfsDirectIO": true,
+  "RootfsSkipIdenticalBlocks": true,
+  "RootfsDiscardHoles": true,
+  "RootfsDiscardBeforeWrite": true,
+  "RootfsUbiAutoResize": true
+}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, installer.DualRootfsDeviceConfig{
+		RootfsPartA:         "/dev/mmcblk0p2",
+		RootfsPartB:         "/dev/mmcblk0p3",
+		VerifyWrite:         true,
+		WriteBufferSize:     4 * 1024 * 1024,
+		DirectIO:            true,
+		SkipIdenticalBlocks: true,
+		DiscardHoles:        true,
+		DiscardBeforeWrite:  true,
+		UbiAutoResize:       true,
+	}, config.GetDeviceConfig())
+
+	for _, size := range []string{"-1", "16385"} {
+		assert.NoError(t, ioutil.WriteFile(confPath,
+			[]byte(`{"RootfsWriteBufferSizeKiB": `+size+`}`), 0600))
+		_, err = loadConfig(confPath, "does-not-exist.config")
+		assert.Error(t, err, size)
+	}
+}
+
+func TestRootfsPartsConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "RootfsParts": ["/dev/mmcblk0p2", "/dev/mmcblk0p3", "/dev/mmcblk0p5"]
+}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/dev/mmcblk0p2", "/dev/mmcblk0p3", "/dev/mmcblk0p5"},
+		config.GetDeviceConfig().RootfsParts)
+
+	assert.NoError(t, ioutil.WriteFile(confPath,
+		[]byte(`{"RootfsParts": ["/dev/mmcblk0p2"]}`), 0600))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+}
+
+func TestRootfsVerityHashPartsConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "RootfsPartA": "/dev/mmcblk0p2",
+  "RootfsPartB": "/dev/mmcblk0p3",
+  "RootfsVerityHashParts": ["/dev/mmcblk0p5", "/dev/mmcblk0p6"]
+}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/dev/mmcblk0p5", "/dev/mmcblk0p6"},
+		config.GetDeviceConfig().VerityHashParts)
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "RootfsParts": ["/dev/mmcblk0p2", "/dev/mmcblk0p3", "/dev/mmcblk0p4"],
+  "RootfsVerityHashParts": ["/dev/mmcblk0p5", "/dev/mmcblk0p6"]
+}`), 0600))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+}
+
+func TestMaintenanceWindowsConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "InstallWindows": ["Mon-Fri 02:00-04:00", "Sat,Sun 22:00-06:00"],
+  "RebootWindows": ["03:00-04:00"],
+  "MaintenanceWindowTimeZone": "Europe/Oslo"
+}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Mon-Fri 02:00-04:00", "Sat,Sun 22:00-06:00"},
+		config.InstallWindows)
+	assert.Equal(t, []string{"03:00-04:00"}, config.RebootWindows)
+
+	for _, conf := range []string{
+		`{"InstallWindows": ["02:00"]}`,
+		`{"RebootWindows": ["Someday 02:00-04:00"]}`,
+		`{"InstallWindows": ["02:00-04:00"], "MaintenanceWindowTimeZone": "Nowhere/Town"}`,
+	} {
+		assert.NoError(t, ioutil.WriteFile(confPath, []byte(conf), 0600))
+		_, err = loadConfig(confPath, "does-not-exist.config")
+		assert.Error(t, err, conf)
+	}
+}
+
+func TestRootfsLUKSConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "RootfsLUKSKeySource": "keyring",
+  "RootfsLUKSKeyDescription": "mender:rootfs"
+}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, installer.LUKSKeySourceKeyring, config.GetDeviceConfig().LUKSKeySource)
+	assert.Equal(t, "mender:rootfs", config.GetDeviceConfig().LUKSKeyDescription)
+
+	assert.NoError(t, ioutil.WriteFile(confPath,
+		[]byte(`{"RootfsLUKSKeySource": "tpm2"}`), 0600))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(confPath,
+		[]byte(`{"RootfsLUKSKeySource": "keyring"}`), 0600))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(confPath,
+		[]byte(`{"RootfsLUKSKeySource": "passphrase"}`), 0600))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+}
+
+func TestBootEnvironmentConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "BootEnvironment": "grub",
+  "GrubEnvPath": "/boot/efi/EFI/BOOT/grubenv"
+}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, installer.BootEnvironmentConfig{
+		BootLoader:  installer.BootEnvironmentGrub,
+		GrubEnvPath: "/boot/efi/EFI/BOOT/grubenv",
+	}, config.GetBootEnvironmentConfig())
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "BootEnvironment": "systemd-boot",
+  "SystemdBootEntryFormat": "rootfs-%s.conf"
+}`), 0600))
+	config, err = loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, installer.BootEnvironmentConfig{
+		BootLoader:             installer.BootEnvironmentSystemdBoot,
+		SystemdBootEntryFormat: "rootfs-%s.conf",
+	}, config.GetBootEnvironmentConfig())
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "BootEnvironment": "rpi-tryboot",
+  "TrybootAutobootPath": "/boot/autoboot.txt",
+  "TrybootBootPartitions": {"5": "2", "6": "3"}
+}`), 0600))
+	config, err = loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, installer.BootEnvironmentConfig{
+		BootLoader:            installer.BootEnvironmentTryboot,
+		AutobootPath:          "/boot/autoboot.txt",
+		TrybootBootPartitions: map[string]string{"5": "2", "6": "3"},
+	}, config.GetBootEnvironmentConfig())
+
+	for _, conf := range []string{
+		`{"BootEnvironment": "lilo"}`,
+		`{"BootEnvironment": "systemd-boot", "SystemdBootEntryFormat": "rootfs.conf"}`,
+		`{"BootEnvironment": "rpi-tryboot", "TrybootBootPartitions": {"5": "boot"}}`,
+	} {
+		assert.NoError(t, ioutil.WriteFile(confPath, []byte(conf), 0600))
+		_, err = loadConfig(confPath, "does-not-exist.config")
+		assert.Error(t, err, conf)
+	}
+}
+
 func TestConfigurationNeitherFileExistsIsNotError(t *testing.T) {
 	config, err := loadConfig("does-not-exist", "also-does-not-exist")
 	assert.NoError(t, err)
 	assert.IsType(t, &menderConfig{}, config)
 }
+
+func TestArtifactVerifyKeysConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	vendorKey := path.Join(tdir, "vendor.pem")
+	operatorKey := path.Join(tdir, "operator.pem")
+	assert.NoError(t, ioutil.WriteFile(vendorKey, []byte("vendor key"), 0600))
+	assert.NoError(t, ioutil.WriteFile(operatorKey, []byte("operator key"), 0600))
+
+	tests := map[string]struct {
+		conf  string
+		valid bool
+	}{
+		"two keys": {
+			conf: `{"ArtifactVerifyKeys": [
+				{"Path": "` + vendorKey + `", "Role": "vendor"},
+				{"Path": "` + operatorKey + `", "Role": "operator"}],
+				"ArtifactVerifyRequiredRoles": ["operator"]}`,
+			valid: true,
+		},
+		"both single and multiple keys": {
+			conf: `{"ArtifactVerifyKey": "` + vendorKey + `",
+				"ArtifactVerifyKeys": [{"Path": "` + operatorKey + `"}]}`,
+		},
+		"unknown role": {
+			conf: `{"ArtifactVerifyKeys": [{"Path": "` + vendorKey + `", "Role": "vendor"}],
+				"ArtifactVerifyRequiredRoles": ["operator"]}`,
+		},
+		"policy without keys": {
+			conf: `{"ArtifactVerifyRequiredRoles": ["vendor"]}`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, ioutil.WriteFile(confPath, []byte(test.conf), 0600))
+			config, err := loadConfig(confPath, "does-not-exist.config")
+			if !test.valid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			policy := config.GetSignaturePolicy()
+			assert.Equal(t, []string{"operator"}, policy.RequiredRoles)
+			assert.Equal(t, []installer.VerificationKey{
+				{Role: "vendor", Key: []byte("vendor key")},
+				{Role: "operator", Key: []byte("operator key")},
+			}, policy.Keys)
+		})
+	}
+
+	// single key configuration
+	config := NewMenderConfig()
+	assert.Nil(t, config.GetSignaturePolicy())
+	config.ArtifactVerifyKey = vendorKey
+	assert.Equal(t, installer.NewSingleKeyPolicy([]byte("vendor key")),
+		config.GetSignaturePolicy())
+}
+
+func TestTokenStoreConfig(t *testing.T) {
+	config := NewMenderConfig()
+	ts, err := config.GetTokenStore()
+	assert.NoError(t, err)
+	assert.Nil(t, ts)
+
+	config.AuthTokenStore = "memory"
+	ts, err = config.GetTokenStore()
+	assert.NoError(t, err)
+	assert.IsType(t, &store.MemTokenStore{}, ts)
+
+	config.AuthTokenStore = "encrypted-file"
+	_, err = config.GetTokenStore()
+	assert.Error(t, err)
+	config.AuthTokenStorePath = "/run/mender/authtoken"
+	config.AuthTokenKeyFile = "/run/mender/authtoken.key"
+	ts, err = config.GetTokenStore()
+	assert.NoError(t, err)
+	assert.IsType(t, &store.EncryptedFileTokenStore{}, ts)
+
+	config.AuthTokenStore = "systemd-creds"
+	ts, err = config.GetTokenStore()
+	assert.NoError(t, err)
+	assert.IsType(t, &store.SystemdCredsTokenStore{}, ts)
+
+	config.AuthTokenStore = "floppy"
+	_, err = config.GetTokenStore()
+	assert.Error(t, err)
+}
+
+func TestDeviceKeyEngineConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{"DeviceKeyEngine": "ateccx08"}`), 0600))
+	_, err := loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(confPath,
+		[]byte(`{"DeviceKeyEngine": "ateccx08", "DeviceKeyEngineKeyID": "ATECCx08:00:02:C0:00"}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	assert.NoError(t, err)
+	assert.Equal(t, "ateccx08", config.DeviceKeyEngine)
+	assert.Equal(t, "ATECCx08:00:02:C0:00", config.DeviceKeyEngineKeyID)
+}
+
+func TestServerCertificateRevocationConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "ServerCertificateRevocation": "hard-fail",
+  "ServerCertificateCRL": "/etc/mender/server.crl"
+}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	httpConfig := config.GetHttpConfig()
+	assert.Equal(t, client.RevocationCheckHardFail, httpConfig.RevocationCheck)
+	assert.Equal(t, "/etc/mender/server.crl", httpConfig.CRLFile)
+
+	assert.NoError(t, ioutil.WriteFile(confPath,
+		[]byte(`{"ServerCertificateRevocation": "sometimes"}`), 0600))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+}
+
+func TestDeviceKeyTypeConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	config := NewMenderConfig()
+	assert.Equal(t, store.KeyOptions{}, config.GetKeyOptions())
+
+	assert.NoError(t, ioutil.WriteFile(confPath,
+		[]byte(`{"DeviceKeyType": "ecdsa-p384", "AuthSignatureDigest": "sha512"}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, store.KeyOptions{Type: store.KeyTypeECDSAP384, Digest: crypto.SHA512},
+		config.GetKeyOptions())
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{"DeviceKeyType": "dsa"}`), 0600))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{"AuthSignatureDigest": "md5"}`), 0600))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	assert.Error(t, err)
+}
+
+func TestIdentityAttributesConfig(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	assert.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "IdentityAttributes": {"serial": "A1234"},
+  "IdentitySensitiveAttributes": ["serial"]
+}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"serial": "A1234"}, config.IdentityAttributes)
+	assert.Equal(t, []string{"serial"}, config.IdentitySensitiveAttributes)
+
+	for _, conf := range []string{
+		`{"IdentityAttributes": {"": "A1234"}}`,
+		`{"IdentityAttributes": {"serial": ""}}`,
+	} {
+		assert.NoError(t, ioutil.WriteFile(confPath, []byte(conf), 0600))
+		_, err = loadConfig(confPath, "does-not-exist.config")
+		assert.Error(t, err, conf)
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// configSources records where each option of the configuration was last set,
+// to point at it in errors, and the options of the configuration files which
+// are unknown to the client.
+type configSources struct {
+	origins map[string]string
+	unknown []string
+}
+
+func newConfigSources() *configSources {
+	return &configSources{origins: make(map[string]string)}
+}
+
+// describe returns the name of the option, followed by where it was set, such
+// as "UpdatePollIntervalSeconds (/etc/mender/mender.conf:3)".
+func (s *configSources) describe(option string) string {
+	if origin, ok := s.origins[option]; ok {
+		return fmt.Sprintf("%s (%s)", option, origin)
+	}
+	return option
+}
+
+// scanFile records the options set in a configuration file holding valid
+// JSON, and the unknown ones, including those of nested objects such as the
+// entries of Servers.
+func (s *configSources) scanFile(fileName string, data []byte) {
+	var options interface{}
+	if err := json.Unmarshal(data, &options); err != nil {
+		return
+	}
+	var unknown []string
+	s.scanValue(fileName, data, "", options, reflect.TypeOf(menderConfigFromFile{}),
+		&unknown)
+	sort.Strings(unknown)
+	s.unknown = append(s.unknown, unknown...)
+}
+
+func (s *configSources) scanValue(fileName string, data []byte, prefix string,
+	value interface{}, typ reflect.Type, unknown *[]string) {
+
+	switch typ.Kind() {
+	case reflect.Ptr:
+		s.scanValue(fileName, data, prefix, value, typ.Elem(), unknown)
+
+	case reflect.Slice, reflect.Array:
+		elems, _ := value.([]interface{})
+		for i, elem := range elems {
+			s.scanValue(fileName, data, fmt.Sprintf("%s[%d]", prefix, i), elem,
+				typ.Elem(), unknown)
+		}
+
+	case reflect.Map:
+		entries, _ := value.(map[string]interface{})
+		for key, entry := range entries {
+			s.scanValue(fileName, data, prefix+"."+key, entry, typ.Elem(), unknown)
+		}
+
+	case reflect.Struct:
+		fields, _ := value.(map[string]interface{})
+		for key, fieldValue := range fields {
+			name := key
+			if prefix != "" {
+				name = prefix + "." + key
+			}
+			location := configKeyLocation(fileName, data, key)
+			field, ok := configField(typ, key)
+			if !ok {
+				*unknown = append(*unknown, fmt.Sprintf("%s (%s)", name, location))
+				continue
+			}
+			if prefix == "" {
+				s.origins[field.Name] = location
+			}
+			s.scanValue(fileName, data, name, fieldValue, field.Type, unknown)
+		}
+	}
+}
+
+// configField returns the field of the struct type a JSON key is decoded
+// into, matching the name case-insensitively as encoding/json does.
+func configField(typ reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath == "" && strings.EqualFold(field.Name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// configKeyLocation returns the file and the line of the first occurrence of
+// a key in a configuration file, such as "/etc/mender/mender.conf:3".
+func configKeyLocation(fileName string, data []byte, key string) string {
+	keyExp := regexp.MustCompile(`"` + regexp.QuoteMeta(key) + `"\s*:`)
+	loc := keyExp.FindIndex(data)
+	if loc == nil {
+		return fileName
+	}
+	return fmt.Sprintf("%s:%d", fileName, configLine(data, int64(loc[0])))
+}
+
+// configLine returns the line of an offset in a configuration file.
+func configLine(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// checkUnknownConfigOptions rejects the unknown options of the configuration
+// files with StrictConfig, and warns about them otherwise, as they are most
+// likely misspelled.
+func checkUnknownConfigOptions(config *menderConfig, sources *configSources) error {
+	if len(sources.unknown) == 0 {
+		return nil
+	}
+	if config.StrictConfig {
+		return errors.Errorf("unknown options in the configuration: %s",
+			strings.Join(sources.unknown, ", "))
+	}
+	for _, option := range sources.unknown {
+		log.Warnf("Ignoring unknown configuration option %s", option)
+	}
+	return nil
+}
+
+// checkConfigIntervals checks that none of the intervals and timeouts of the
+// configuration, given in seconds, are negative.
+func checkConfigIntervals(config *menderConfig, sources *configSources) error {
+	options := reflect.ValueOf(config.menderConfigFromFile)
+	for i := 0; i < options.NumField(); i++ {
+		option := options.Type().Field(i).Name
+		field := options.Field(i)
+		if !strings.HasSuffix(option, "Seconds") {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Int, reflect.Int64:
+			if field.Int() < 0 {
+				return errors.Errorf("%s in mender.conf must not be negative",
+					sources.describe(option))
+			}
+		}
+	}
+	return nil
+}
+
+// checkConflictingConfigOptions warns about options which override others
+// also given.
+func checkConflictingConfigOptions(config *menderConfig, sources *configSources) {
+	if len(config.RootfsParts) > 0 && (config.RootfsPartA != "" || config.RootfsPartB != "") {
+		log.Warnf("%s overrides RootfsPartA and RootfsPartB in mender.conf",
+			sources.describe("RootfsParts"))
+	}
+}
+
+// checkServerURL checks that a server URL is an http or https URL of a host
+// name, an IPv4 address or a bracketed IPv6 address, with an optional port
+// and path, the latter for servers behind a path prefix. The scheme may be
+// left out, as in "mender.example.com:8443".
+func checkServerURL(serverURL string) error {
+	full := serverURL
+	if !strings.Contains(serverURL, "://") {
+		full = "https://" + serverURL
+	}
+	u, err := url.Parse(full)
+	if err != nil {
+		return errors.Errorf("%q is not a valid URL", serverURL)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+	default:
+		return errors.Errorf("unsupported scheme %q of %q; must be http or https",
+			u.Scheme, serverURL)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return errors.Errorf("%q must not have credentials, a query or a fragment",
+			serverURL)
+	}
+
+	if err := checkServerHost(u, serverURL); err != nil {
+		return err
+	}
+	return checkServerPort(u, serverURL)
+}
+
+// checkServerHost checks that the host of the server URL is a host name, an
+// IPv4 address or a bracketed IPv6 address.
+func checkServerHost(u *url.URL, serverURL string) error {
+	host := u.Hostname()
+	switch {
+	case host == "":
+		return errors.Errorf("%q has no host", serverURL)
+	case strings.HasPrefix(u.Host, "["):
+		// Link local addresses are qualified by the zone, as in
+		// [fe80::1%25eth0].
+		if ip := net.ParseIP(strings.SplitN(host, "%", 2)[0]); ip == nil || ip.To4() != nil {
+			return errors.Errorf("%q is not a valid IPv6 address in %q", host, serverURL)
+		}
+	case net.ParseIP(host) != nil:
+	case !isHostName(host):
+		return errors.Errorf("%q is not a valid host name in %q; IPv6 addresses "+
+			"must be enclosed in brackets", host, serverURL)
+	}
+	return nil
+}
+
+func checkServerPort(u *url.URL, serverURL string) error {
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return errors.Errorf("%q is not a valid port in %q", port, serverURL)
+		}
+	}
+	return nil
+}
+
+// isHostName returns whether name is a host name of letters, digits, hyphens
+// and underscores, in dot separated labels of up to 63 characters.
+func isHostName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 ||
+			strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+				c == '-', c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
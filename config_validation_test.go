@@ -0,0 +1,173 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidation(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+	fallbackPath := path.Join(tdir, "does-not-exist.config")
+
+	defer func(oldLog *log.Logger) { log.Log = oldLog }(log.Log)
+	log.Log = log.New()
+	logBuf := bytes.NewBuffer(nil)
+	log.SetOutput(logBuf)
+
+	loadConf := func(conf string) (*menderConfig, error) {
+		require.NoError(t, ioutil.WriteFile(confPath, []byte(conf), 0600))
+		return loadConfig(confPath, fallbackPath)
+	}
+
+	// Unknown options are ignored with a warning, unless StrictConfig is
+	// set.
+	unknownOptions := `{
+  "ServerURL": "https://hosted.mender.io",
+  "UpdatePollIntervalSecs": 60,
+  "HttpsClient": {
+    "Certificate": "/data/client.crt",
+    "Keyfile": "/data/client.key"
+  }`
+	_, err := loadConf(unknownOptions + "}")
+	require.NoError(t, err)
+	assert.Contains(t, logBuf.String(), "UpdatePollIntervalSecs ("+confPath+":3)")
+	assert.Contains(t, logBuf.String(), "HttpsClient.Keyfile ("+confPath+":6)")
+
+	_, err = loadConf(unknownOptions + `, "StrictConfig": true}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "UpdatePollIntervalSecs ("+confPath+":3)")
+	assert.Contains(t, err.Error(), "HttpsClient.Keyfile ("+confPath+":6)")
+
+	// Options are matched case-insensitively, like they are decoded.
+	config, err := loadConf(`{"StrictConfig": true, "serverurl": "https://hosted.mender.io"}`)
+	require.NoError(t, err)
+	assert.Equal(t, "https://hosted.mender.io", config.Servers[0].ServerURL)
+
+	// Conflicting options are pointed at.
+	_, err = loadConf(`{
+  "ServerURL": "https://hosted.mender.io",
+  "Servers": [{"ServerURL": "https://mender.example.com"}]
+}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Servers ("+confPath+":3)")
+	assert.Contains(t, err.Error(), "ServerURL ("+confPath+":2)")
+
+	// And so are negative intervals, wherever they are set.
+	_, err = loadConf(`{
+  "ServerURL": "https://hosted.mender.io",
+  "RetryPollIntervalSeconds": -30
+}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "RetryPollIntervalSeconds ("+confPath+":3)")
+
+	defer setConfigEnvironment(t, map[string]string{
+		"MENDER_INVENTORY_POLL_INTERVAL_SECONDS": "-1",
+	})()
+	_, err = loadConf(`{"ServerURL": "https://hosted.mender.io"}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "InventoryPollIntervalSeconds (environment "+
+		"variable MENDER_INVENTORY_POLL_INTERVAL_SECONDS)")
+}
+
+func TestConfigDecodeErrorLine(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "ServerURL": "https://hosted.mender.io",
+  "UpdatePollIntervalSeconds": "1800"
+}`), 0600))
+	_, err := loadConfig(confPath, "does-not-exist.config")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), confPath+":3: invalid UpdatePollIntervalSeconds")
+
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "ServerURL": "https://hosted.mender.io",
+  "UpdatePollIntervalSeconds": 1800,
+}`), 0600))
+	_, err = loadConfig(confPath, "does-not-exist.config")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), confPath+":4:")
+}
+
+func TestCheckServerURL(t *testing.T) {
+	for _, serverURL := range []string{
+		"https://hosted.mender.io",
+		"mender.io",
+		"http://mender.example.com:8080",
+		"mender.example.com:8443",
+		"https://192.168.1.10",
+		"https://[2001:db8::1]:8443",
+		"[2001:db8::1]",
+		"https://[fe80::1%25eth0]",
+		"https://mender.example.com/mender",
+		"HTTPS://mender_server.local",
+	} {
+		assert.NoError(t, checkServerURL(serverURL), serverURL)
+	}
+
+	for serverURL, message := range map[string]string{
+		"ftp://mender.example.com":           "unsupported scheme",
+		"https://":                           "has no host",
+		"https://2001:db8::1":                "not a valid",
+		"https://[192.168.1.10]":             "not a valid",
+		"https://[2001:db8::zz]":             "not a valid",
+		"https://mender example.com":         "not a valid",
+		"https://-mender.example.com":        "not a valid host name",
+		"https://mender.example.com:0":       "not a valid port",
+		"https://mender.example.com:70000":   "not a valid port",
+		"https://user:pw@mender.example.com": "must not have credentials",
+		"https://mender.example.com/?a=b":    "must not have credentials",
+	} {
+		err := checkServerURL(serverURL)
+		if assert.Error(t, err, serverURL) {
+			assert.Contains(t, err.Error(), message, serverURL)
+		}
+	}
+}
+
+func TestServerURLConfigValidation(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+  "Servers": [
+    {"ServerURL": "https://[2001:db8::1]:8443/mender/"},
+    {"ServerURL": "ftp://mender.example.com"}
+  ]
+}`), 0600))
+	_, err := loadConfig(confPath, "does-not-exist.config")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Servers ("+confPath+":2)")
+	assert.Contains(t, err.Error(), "must be http or https")
+
+	require.NoError(t, ioutil.WriteFile(confPath,
+		[]byte(`{"ServerURL": "https://[2001:db8::1]:8443/mender/"}`), 0600))
+	config, err := loadConfig(confPath, "does-not-exist.config")
+	require.NoError(t, err)
+	assert.Equal(t, "https://[2001:db8::1]:8443/mender", config.Servers[0].ServerURL)
+}
@@ -14,10 +14,14 @@
 package main
 
 import (
+	"sync"
+	"time"
+
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/datastore"
 	"github.com/mendersoftware/mender/store"
 	"github.com/mendersoftware/mender/system"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 )
 
@@ -29,6 +33,17 @@ type menderDaemon struct {
 	sctx         StateContext
 	store        store.Store
 	forceToState chan State
+
+	// The state being handled, for on-device integrations running
+	// alongside the state machine.
+	stateLock     sync.Mutex
+	state         State
+	stateListener func(state string)
+
+	// Loads the configuration again when it is reloaded, and the
+	// configuration to apply once the current state is handled.
+	configLoader  func() (*menderConfig, error)
+	configUpdates chan *menderConfig
 }
 
 func NewDaemon(mender Controller, store store.Store) *menderDaemon {
@@ -36,18 +51,40 @@ func NewDaemon(mender Controller, store store.Store) *menderDaemon {
 	daemon := menderDaemon{
 		mender: mender,
 		sctx: StateContext{
-			store:      store,
-			rebooter:   system.NewSystemRebootCmd(system.OsCalls{}),
-			wakeupChan: make(chan bool, 1),
+			store:               store,
+			rebooter:            system.NewSystemRebootCmd(system.OsCalls{}),
+			wakeupChan:          make(chan bool, 1),
+			updateControlResume: make(chan string, 1),
+			deploymentPause:     new(deploymentPause),
+			downloadProgress:    new(downloadProgress),
+			writeProgress:       new(writeProgress),
 		},
-		store:        store,
-		forceToState: make(chan State, 1),
+		store:         store,
+		forceToState:  make(chan State, 1),
+		configUpdates: make(chan *menderConfig, 1),
 	}
 	return &daemon
 }
 
+// configReloader is implemented by controllers which can apply a newly
+// loaded configuration while running.
+type configReloader interface {
+	ReloadConfig(config *menderConfig) error
+}
+
+// requestCanceller is implemented by controllers which can cancel their
+// requests to the server in progress.
+type requestCanceller interface {
+	CancelRequests()
+}
+
+// StopDaemon stops the daemon once the current state is handled, cancelling
+// the requests to the server in progress so that this happens promptly.
 func (d *menderDaemon) StopDaemon() {
 	d.stop = true
+	if c, ok := d.mender.(requestCanceller); ok {
+		c.CancelRequests()
+	}
 }
 
 func (d *menderDaemon) Cleanup() {
@@ -63,11 +100,142 @@ func (d *menderDaemon) shouldStop() bool {
 	return d.stop
 }
 
+// notifyUpdates waits for update notifications from the server, and forces
+// an update check as soon as a deployment is pending. Regular polling is kept
+// as it is, so if notifications are unsupported by the server the daemon
+// simply falls back to polling. It is only started if notifications are
+// enabled in the configuration.
+func (d *menderDaemon) notifyUpdates() {
+	// Waiting fails mostly while the server is unreachable, or the device
+	// is not authorized yet, so wait ever longer before trying again, up
+	// to the update poll interval.
+	backoff := utils.NewBackoff(utils.BackoffPolicy{IntervalAttempts: 3, Jitter: 0.1})
+	for !d.shouldStop() {
+		pending, err := d.mender.WaitForUpdateNotification()
+		if err != nil {
+			if err.IsFatal() {
+				log.Infof("Update notifications not available, relying on polling: %v", err)
+				return
+			}
+			log.Warnf("Failed waiting for update notification: %v", err)
+			backoff.Policy.MinInterval = d.mender.GetRetryPollInterval()
+			backoff.Policy.MaxInterval = d.mender.GetUpdatePollInterval()
+			wait, _ := backoff.Next()
+			time.Sleep(wait)
+			continue
+		}
+		backoff.Reset()
+
+		if pending {
+			log.Info("Deployment pending; forcing update check")
+			d.forceState(updateCheckState)
+			// The deployment stays pending until it is over, so the
+			// server would notify of it right away again.
+			time.Sleep(d.mender.GetUpdatePollInterval())
+		}
+	}
+}
+
+// setState records the state about to be handled, and notifies the state
+// listener when the state changes.
+func (d *menderDaemon) setState(s State) {
+	d.stateLock.Lock()
+	changed := d.state == nil || d.state.Id() != s.Id()
+	d.state = s
+	listener := d.stateListener
+	d.stateLock.Unlock()
+
+	if changed && listener != nil {
+		listener(s.Id().String())
+	}
+}
+
+// currentState returns the state being handled, or nil if the daemon has
+// not started yet.
+func (d *menderDaemon) currentState() State {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	return d.state
+}
+
+// SetStateListener sets a function called each time the daemon enters a new
+// state.
+func (d *menderDaemon) SetStateListener(listener func(state string)) {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	d.stateListener = listener
+}
+
+// forceState forces the state machine to the given state, the same way as
+// the SIGUSR1 and SIGUSR2 signals do.
+func (d *menderDaemon) forceState(s State) {
+	select {
+	case d.forceToState <- s:
+	default:
+	}
+	select {
+	case d.sctx.wakeupChan <- true:
+	default:
+	}
+}
+
+// reloadConfig loads the configuration again, and has it applied once the
+// current state is handled, so that a deployment in progress is not disturbed.
+// The wait for the next poll is cut short, for new poll intervals to take
+// effect right away.
+func (d *menderDaemon) reloadConfig() {
+	if d.configLoader == nil {
+		log.Warn("The configuration can not be reloaded")
+		return
+	}
+	config, err := d.configLoader()
+	if err != nil {
+		log.Errorf("Failed to reload the configuration; keeping the current one: %v", err)
+		return
+	}
+	// Only the latest configuration is of interest.
+	select {
+	case <-d.configUpdates:
+	default:
+	}
+	select {
+	case d.configUpdates <- config:
+	default:
+	}
+	if _, ok := d.currentState().(*CheckWaitState); ok {
+		select {
+		case d.sctx.wakeupChan <- true:
+		default:
+		}
+	}
+}
+
+// applyConfig applies a reloaded configuration to the controller.
+func (d *menderDaemon) applyConfig(config *menderConfig) {
+	reloader, ok := d.mender.(configReloader)
+	if !ok {
+		return
+	}
+	if err := reloader.ReloadConfig(config); err != nil {
+		log.Errorf("Failed to apply the reloaded configuration; keeping the current one: %v", err)
+		return
+	}
+	log.Info("Applied the reloaded configuration")
+}
+
 func (d *menderDaemon) Run() error {
 	// set the first state transition
 	var toState State = d.mender.GetCurrentState()
 	cancelled := false
+	notifySystemdReady()
 	for {
+		// If signal SIGHUP is received, apply the reloaded configuration.
+		select {
+		case config := <-d.configUpdates:
+			d.applyConfig(config)
+		default:
+		}
+
 		// If signal SIGUSR1 or SIGUSR2 is received, force the state-machine to the correct state.
 		select {
 		case nState := <-d.forceToState:
@@ -82,7 +250,11 @@ func (d *menderDaemon) Run() error {
 		default:
 			// Identity op - do nothing.
 		}
+		d.setState(toState)
+		d.sctx.watchdog.pet()
+		stopWatchdog := d.sctx.watchdog.keepAlive()
 		toState, cancelled = d.mender.TransitionState(toState, &d.sctx)
+		stopWatchdog()
 		if toState.Id() == datastore.MenderStateError {
 			es, ok := toState.(*ErrorState)
 			if ok {
@@ -39,6 +39,21 @@ type fakeDevice struct {
 	retRollback    error
 	retHasUpdate   bool
 	consumeUpdate  bool
+	// capacity, in bytes, if checked before storing updates
+	capacity int64
+	// whether an interrupted write of the update can be resumed
+	canResumeStore bool
+}
+
+func (f fakeDevice) CheckCapacity(artifactSize int64) error {
+	if f.capacity > 0 && artifactSize > f.capacity {
+		return installer.ErrInsufficientSpace
+	}
+	return nil
+}
+
+func (f fakeDevice) CanResumeStore() bool {
+	return f.canResumeStore
 }
 
 func (f fakeDevice) NeedsReboot() (installer.RebootAction, error) {
@@ -123,6 +138,12 @@ func (f fakeDevice) GetInactive() (string, error) {
 	return "", errors.New("Not implemented")
 }
 
+func (f fakeDevice) SetWriteProgressReporter(installer.WriteProgressReporter) {
+}
+
+func (f fakeDevice) SetWriteThroughputRecorder(installer.WriteThroughputRecorder) {
+}
+
 func (f fakeDevice) NewUpdateStorer(string, int) (handlers.UpdateStorer, error) {
 	return &f, nil
 }
@@ -279,3 +300,44 @@ func TestDaemonRun(t *testing.T) {
 		assert.Equal(t, checkWaitState, daemon.mender.GetCurrentState())
 	})
 }
+
+type notifyTestController struct {
+	stateTestController
+	notifications []menderError
+	calls         int
+}
+
+func (n *notifyTestController) WaitForUpdateNotification() (bool, menderError) {
+	n.calls++
+	if len(n.notifications) == 0 {
+		return false, NewFatalError(client.ErrNotificationsUnsupported)
+	}
+	err := n.notifications[0]
+	n.notifications = n.notifications[1:]
+	return err == nil, err
+}
+
+func TestDaemonNotifyUpdates(t *testing.T) {
+	// Notifications not available; returns right away.
+	ntc := &notifyTestController{}
+	daemon := NewDaemon(ntc, store.NewMemStore())
+	daemon.notifyUpdates()
+	assert.Equal(t, 1, ntc.calls)
+	assert.Empty(t, daemon.forceToState)
+	assert.Empty(t, daemon.sctx.wakeupChan)
+
+	// A temporary failure, followed by a pending deployment.
+	ntc = &notifyTestController{
+		notifications: []menderError{
+			NewTransientError(errors.New("connection reset")),
+			nil,
+		},
+	}
+	ntc.retryIntvl = time.Millisecond
+	ntc.updatePollIntvl = time.Millisecond
+	daemon = NewDaemon(ntc, store.NewMemStore())
+	daemon.notifyUpdates()
+	assert.Equal(t, 3, ntc.calls)
+	assert.Equal(t, updateCheckState, <-daemon.forceToState)
+	assert.True(t, <-daemon.sctx.wakeupChan)
+}
@@ -24,9 +24,48 @@ const (
 	// Name of artifact currently installed. Introduced in Mender 2.0.0.
 	ArtifactNameKey = "artifact-name"
 
+	// Provides of the installed artifact, apart from its name, which the
+	// depends of new artifacts are checked against. Written when an
+	// artifact is committed. Uses a map of strings, marshalled to JSON.
+	ArtifactProvidesKey = "artifact-provides"
+
+	// Completion times of the recent deployments, used for rate limiting
+	// deployments. Uses the deploymentHistory structure, marshalled to
+	// JSON.
+	DeploymentHistoryKey = "deployment-history"
+
 	// Key used to store the auth token.
 	AuthTokenName = "authtoken"
 
+	// URL of the server which issued the auth token, so that the token is
+	// not sent to any other server when several servers are configured.
+	AuthServerKey = "auth-server"
+
+	// Tenant tokens handed out by the servers, replacing the configured
+	// ones. Uses a map of tenant tokens by server URL, marshalled to JSON.
+	TenantTokensKey = "tenant-tokens"
+
+	// Write throughput measured when the last update was written to the
+	// inactive partition, reported in the inventory. Uses the
+	// writeThroughput structure, marshalled to JSON.
+	WriteThroughputKey = "write-throughput"
+
+	// The inventory last submitted to the server, so that only the changed
+	// attributes are submitted next. Uses the submittedInventory
+	// structure, marshalled to JSON.
+	InventoryKey = "inventory"
+
+	// The last status reported for the deployment in progress, and whether
+	// the server acknowledged it, so that the same status is not reported
+	// twice, and statuses ending deployments are reported again after a
+	// restart. Uses the statusReportRecord structure, marshalled to JSON.
+	StatusReportKey = "status-report"
+
+	// The deployment bundle which is being installed, while it is waiting
+	// to be committed or rolled back. Uses the offlineDeployment
+	// structure, marshalled to JSON.
+	OfflineDeploymentKey = "offline-deployment"
+
 	// The key used by the standalone installer to track artifacts that have
 	// been started, but not committed. We don't want to use the
 	// StateDataKey for this, because it contains a lot less information.
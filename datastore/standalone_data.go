@@ -19,4 +19,7 @@ type StandaloneStateData struct {
 	Version      int
 	ArtifactName string
 	PayloadTypes []string
+	// See Artifact.
+	Provides               map[string]string `json:",omitempty"`
+	ClearsArtifactProvides []string          `json:",omitempty"`
 }
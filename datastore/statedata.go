@@ -105,6 +105,11 @@ const (
 	MenderStateUpdateCleanup
 	// exit state
 	MenderStateDone
+	// deployment paused by the update control map
+	MenderStateUpdateControlPause
+	// wait before authorization attempt of a device the server rejects
+	// as decommissioned
+	MenderStateDecommissionedWait
 )
 
 var (
@@ -140,6 +145,8 @@ var (
 		MenderStateUpdateError:                      "update-error",
 		MenderStateUpdateCleanup:                    "cleanup",
 		MenderStateDone:                             "finished",
+		MenderStateUpdateControlPause:               "update-control-pause",
+		MenderStateDecommissionedWait:               "decommissioned-wait",
 	}
 )
 
@@ -230,6 +237,83 @@ type Artifact struct {
 	CompatibleDevices []string `json:"device_types_compatible"`
 	ArtifactName      string   `json:"artifact_name"`
 	PayloadTypes      []string
+	// Provides of the artifact, and the patterns of the provides of the
+	// installed artifact which it replaces, stored once it is committed.
+	Provides               map[string]string `json:",omitempty"`
+	ClearsArtifactProvides []string          `json:",omitempty"`
+}
+
+// Points in the deployment flow where the update control map may pause the
+// deployment.
+const (
+	UpdateControlMapDownloadEnter = "ArtifactDownload_Enter"
+	UpdateControlMapInstallEnter  = "ArtifactInstall_Enter"
+	UpdateControlMapCommitEnter   = "ArtifactCommit_Enter"
+)
+
+// Actions the update control map may take at a pause point.
+const (
+	UpdateControlMapActionContinue = "continue"
+	UpdateControlMapActionPause    = "pause"
+	UpdateControlMapActionFail     = "fail"
+)
+
+// UpdateControlMap is sent by the server together with the update, and lets
+// the operator pause the deployment at given points until told to continue,
+// or fail it.
+type UpdateControlMap struct {
+	ID     string                           `json:"id"`
+	States map[string]UpdateControlMapState `json:"states,omitempty"`
+}
+
+type UpdateControlMapState struct {
+	Action string `json:"action"`
+}
+
+// Action returns the action to take at the given pause point. The default is
+// to continue.
+func (u *UpdateControlMap) Action(state string) string {
+	if u == nil {
+		return UpdateControlMapActionContinue
+	}
+	s, ok := u.States[state]
+	if !ok || s.Action == "" {
+		return UpdateControlMapActionContinue
+	}
+	return s.Action
+}
+
+// Validate checks that the update control map only holds known pause points
+// and actions.
+func (u *UpdateControlMap) Validate() error {
+	if u == nil {
+		return nil
+	}
+	for state, s := range u.States {
+		switch state {
+		case UpdateControlMapDownloadEnter,
+			UpdateControlMapInstallEnter,
+			UpdateControlMapCommitEnter:
+		default:
+			return errors.Errorf("unknown update control map state %q", state)
+		}
+		switch s.Action {
+		case "", UpdateControlMapActionContinue,
+			UpdateControlMapActionPause,
+			UpdateControlMapActionFail:
+		default:
+			return errors.Errorf("unknown update control map action %q for state %q",
+				s.Action, state)
+		}
+	}
+	return nil
+}
+
+// UpdateControlPause records the pause point a deployment is held at, and the
+// state it was held in, so that the pause outlasts a restart of the client.
+type UpdateControlPause struct {
+	Point string      `json:"point"`
+	State MenderState `json:"state"`
 }
 
 // Info about the update in progress.
@@ -237,10 +321,21 @@ type UpdateInfo struct {
 	Artifact Artifact
 	ID       string
 
+	// Update control map sent by the server, if any.
+	UpdateControlMap *UpdateControlMap `json:"update_control_map,omitempty"`
+
+	// Pause point the deployment is held at, if any.
+	UpdateControlPause *UpdateControlPause `json:"update_control_pause,omitempty"`
+
 	// Whether the currently running payloads asked for reboots. It is
 	// indexed the same as PayloadTypes above.
 	RebootRequested RebootRequestedType
 
+	// Whether the installation of the update has been started. Only
+	// deployments which got this far count towards the deployment rate
+	// limits.
+	InstallAttempted bool `json:",omitempty"`
+
 	// Whether the currently running update supports rollback. All payloads
 	// must either support rollback or not, so this is one global flag for
 	// all of them.
@@ -36,3 +36,35 @@ func TestMenderState(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, MenderStateInit, s)
 }
+
+func TestUpdateControlMap(t *testing.T) {
+	var m *UpdateControlMap
+	assert.Equal(t, UpdateControlMapActionContinue, m.Action(UpdateControlMapDownloadEnter))
+	assert.NoError(t, m.Validate())
+
+	var info UpdateInfo
+	err := json.Unmarshal([]byte(`{
+		"id": "deployment-id",
+		"update_control_map": {
+			"id": "map-id",
+			"states": {
+				"ArtifactInstall_Enter": {"action": "pause"},
+				"ArtifactCommit_Enter": {"action": "fail"}
+			}
+		}
+	}`), &info)
+	assert.NoError(t, err)
+	m = info.UpdateControlMap
+	assert.NoError(t, m.Validate())
+	assert.Equal(t, "map-id", m.ID)
+	assert.Equal(t, UpdateControlMapActionContinue, m.Action(UpdateControlMapDownloadEnter))
+	assert.Equal(t, UpdateControlMapActionPause, m.Action(UpdateControlMapInstallEnter))
+	assert.Equal(t, UpdateControlMapActionFail, m.Action(UpdateControlMapCommitEnter))
+
+	m.States["ArtifactReboot_Enter"] = UpdateControlMapState{Action: "pause"}
+	assert.Error(t, m.Validate())
+	delete(m.States, "ArtifactReboot_Enter")
+
+	m.States[UpdateControlMapDownloadEnter] = UpdateControlMapState{Action: "skip"}
+	assert.Error(t, m.Validate())
+}
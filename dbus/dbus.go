@@ -0,0 +1,112 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package dbus publishes the io.mender.UpdateManager service on the system
+// D-Bus, so that user interfaces and other on-device services can follow the
+// state of the client and trigger its operations.
+package dbus
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	ServiceName   = "io.mender.UpdateManager"
+	ObjectPath    = "/io/mender/UpdateManager"
+	InterfaceName = "io.mender.Update1"
+
+	// Name of the D-Bus error returned when an operation fails.
+	ErrorName = "io.mender.UpdateManager.Error"
+)
+
+// Introspection data of the UpdateManager object.
+const IntrospectionXML = `<node>
+  <interface name="io.mender.Update1">
+    <property name="State" type="s" access="read"/>
+    <property name="InstalledArtifact" type="s" access="read"/>
+    <property name="DeploymentID" type="s" access="read"/>
+    <method name="CheckUpdate"/>
+    <method name="TriggerInventory"/>
+    <method name="ConfirmReboot"/>
+    <method name="ConfirmCommit"/>
+    <signal name="StateChanged">
+      <arg name="state" type="s"/>
+    </signal>
+  </interface>
+</node>`
+
+var (
+	ErrNotSupported = errors.New("D-Bus support is not compiled in")
+	ErrStopped      = errors.New("the D-Bus service is stopped")
+)
+
+// UpdateManager is the part of the client exposed on D-Bus.
+type UpdateManager interface {
+	// State returns the name of the state the client is in.
+	State() string
+	// InstalledArtifact returns the name of the installed artifact.
+	InstalledArtifact() (string, error)
+	// DeploymentID returns the ID of the deployment in progress, if any.
+	DeploymentID() string
+
+	CheckUpdate() error
+	TriggerInventory() error
+	// ConfirmReboot confirms a deployment waiting for a confirmation from
+	// the device before installing and rebooting. The deployment still
+	// waits if it is paused or outside the maintenance window.
+	ConfirmReboot() error
+	// ConfirmCommit confirms a deployment waiting for a confirmation from
+	// the device before committing the update. The deployment still waits
+	// if it is paused.
+	ConfirmCommit() error
+}
+
+// Service is the UpdateManager published on the system bus.
+type Service interface {
+	// StateChanged emits the StateChanged signal.
+	StateChanged(state string)
+	// Stop releases the service name and disconnects from the bus.
+	Stop()
+}
+
+// property returns the value of the named property, or an error if there is
+// no such property.
+func property(manager UpdateManager, name string) (string, error) {
+	switch name {
+	case "State":
+		return manager.State(), nil
+	case "InstalledArtifact":
+		return manager.InstalledArtifact()
+	case "DeploymentID":
+		return manager.DeploymentID(), nil
+	default:
+		return "", errors.Errorf("unknown property %q", name)
+	}
+}
+
+// callMethod calls the named method of the UpdateManager.
+func callMethod(manager UpdateManager, name string) error {
+	switch name {
+	case "CheckUpdate":
+		return manager.CheckUpdate()
+	case "TriggerInventory":
+		return manager.TriggerInventory()
+	case "ConfirmReboot":
+		return manager.ConfirmReboot()
+	case "ConfirmCommit":
+		return manager.ConfirmCommit()
+	default:
+		return errors.Errorf("unknown method %q", name)
+	}
+}
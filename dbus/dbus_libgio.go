@@ -0,0 +1,263 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// +build dbus,cgo
+
+package dbus
+
+/*
+#cgo pkg-config: gio-2.0
+#include <stdlib.h>
+#include <gio/gio.h>
+
+extern void goHandleMethodCall(char *method, GDBusMethodInvocation *invocation);
+extern GVariant *goHandleGetProperty(char *property, GError **error);
+
+static void method_call_cb(GDBusConnection *connection, const gchar *sender,
+	const gchar *object_path, const gchar *interface_name,
+	const gchar *method_name, GVariant *parameters,
+	GDBusMethodInvocation *invocation, gpointer user_data)
+{
+	goHandleMethodCall((char *)method_name, invocation);
+}
+
+static GVariant *get_property_cb(GDBusConnection *connection,
+	const gchar *sender, const gchar *object_path,
+	const gchar *interface_name, const gchar *property_name,
+	GError **error, gpointer user_data)
+{
+	return goHandleGetProperty((char *)property_name, error);
+}
+
+static const GDBusInterfaceVTable interface_vtable = {
+	method_call_cb,
+	get_property_cb,
+	NULL,
+};
+
+static guint register_object(GDBusConnection *connection, const char *path,
+	GDBusInterfaceInfo *info, GError **error)
+{
+	return g_dbus_connection_register_object(connection, path, info,
+		&interface_vtable, NULL, NULL, error);
+}
+
+static gboolean emit_state_changed(GDBusConnection *connection,
+	const char *path, const char *iface, const char *state, GError **error)
+{
+	return g_dbus_connection_emit_signal(connection, NULL, path, iface,
+		"StateChanged", g_variant_new("(s)", state), error);
+}
+
+static void return_error(GDBusMethodInvocation *invocation, const char *name,
+	const char *message)
+{
+	g_dbus_method_invocation_return_dbus_error(invocation, name, message);
+}
+
+static void set_error(GError **error, const char *message)
+{
+	g_set_error_literal(error, G_DBUS_ERROR, G_DBUS_ERROR_FAILED, message);
+}
+*/
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+type libgioService struct {
+	manager    UpdateManager
+	connection *C.GDBusConnection
+	nodeInfo   *C.GDBusNodeInfo
+	ownerID    C.guint
+	objectID   C.guint
+	loop       *C.GMainLoop
+}
+
+// libgio calls back into Go through exported functions, which can not be
+// bound to a particular service; there is only ever one service per process.
+var (
+	serviceLock sync.Mutex
+	service     *libgioService
+)
+
+func gerror(err *C.GError) error {
+	defer C.g_error_free(err)
+	return errors.New(C.GoString(err.message))
+}
+
+// Start publishes the UpdateManager on the system bus.
+func Start(manager UpdateManager) (Service, error) {
+	serviceLock.Lock()
+	defer serviceLock.Unlock()
+	if service != nil {
+		return nil, errors.New("D-Bus service already started")
+	}
+
+	var gerr *C.GError
+	connection := C.g_bus_get_sync(C.G_BUS_TYPE_SYSTEM, nil, &gerr)
+	if connection == nil {
+		return nil, errors.Wrap(gerror(gerr), "failed to connect to the system bus")
+	}
+
+	xml := C.CString(IntrospectionXML)
+	defer C.free(unsafe.Pointer(xml))
+	nodeInfo := C.g_dbus_node_info_new_for_xml((*C.gchar)(xml), &gerr)
+	if nodeInfo == nil {
+		C.g_object_unref(C.gpointer(unsafe.Pointer(connection)))
+		return nil, errors.Wrap(gerror(gerr), "failed to parse introspection data")
+	}
+
+	s := &libgioService{
+		manager:    manager,
+		connection: connection,
+		nodeInfo:   nodeInfo,
+	}
+
+	path := C.CString(ObjectPath)
+	defer C.free(unsafe.Pointer(path))
+	iface := C.CString(InterfaceName)
+	defer C.free(unsafe.Pointer(iface))
+	info := C.g_dbus_node_info_lookup_interface(nodeInfo, (*C.gchar)(iface))
+	s.objectID = C.register_object(connection, path, info, &gerr)
+	if s.objectID == 0 {
+		s.release()
+		return nil, errors.Wrap(gerror(gerr), "failed to register D-Bus object")
+	}
+
+	name := C.CString(ServiceName)
+	defer C.free(unsafe.Pointer(name))
+	s.ownerID = C.g_bus_own_name_on_connection(connection, (*C.gchar)(name),
+		C.G_BUS_NAME_OWNER_FLAGS_NONE, nil, nil, nil, nil)
+
+	loop := C.g_main_loop_new(nil, C.FALSE)
+	s.loop = loop
+	go func() {
+		C.g_main_loop_run(loop)
+	}()
+
+	service = s
+	log.Infof("Published %s on the system bus", ServiceName)
+	return s, nil
+}
+
+func (s *libgioService) StateChanged(state string) {
+	path := C.CString(ObjectPath)
+	defer C.free(unsafe.Pointer(path))
+	iface := C.CString(InterfaceName)
+	defer C.free(unsafe.Pointer(iface))
+	cstate := C.CString(state)
+	defer C.free(unsafe.Pointer(cstate))
+
+	var gerr *C.GError
+	if C.emit_state_changed(s.connection, path, iface, cstate, &gerr) == C.FALSE {
+		log.Warnf("Failed to emit D-Bus StateChanged signal: %v", gerror(gerr))
+	}
+}
+
+func (s *libgioService) Stop() {
+	serviceLock.Lock()
+	defer serviceLock.Unlock()
+
+	if s.loop != nil {
+		C.g_main_loop_quit(s.loop)
+		C.g_main_loop_unref(s.loop)
+		s.loop = nil
+	}
+	if s.ownerID != 0 {
+		C.g_bus_unown_name(s.ownerID)
+		s.ownerID = 0
+	}
+	s.release()
+	service = nil
+}
+
+func (s *libgioService) release() {
+	if s.objectID != 0 {
+		C.g_dbus_connection_unregister_object(s.connection, s.objectID)
+		s.objectID = 0
+	}
+	if s.nodeInfo != nil {
+		C.g_dbus_node_info_unref(s.nodeInfo)
+		s.nodeInfo = nil
+	}
+	if s.connection != nil {
+		C.g_object_unref(C.gpointer(unsafe.Pointer(s.connection)))
+		s.connection = nil
+	}
+}
+
+func currentManager() UpdateManager {
+	serviceLock.Lock()
+	defer serviceLock.Unlock()
+	if service == nil {
+		return nil
+	}
+	return service.manager
+}
+
+//export goHandleMethodCall
+func goHandleMethodCall(method *C.char, invocation *C.GDBusMethodInvocation) {
+	manager := currentManager()
+	if manager == nil {
+		returnError(invocation, ErrStopped)
+		return
+	}
+
+	// Methods may block; don't hold up the main loop.
+	name := C.GoString(method)
+	go func() {
+		if err := callMethod(manager, name); err != nil {
+			returnError(invocation, err)
+			return
+		}
+		C.g_dbus_method_invocation_return_value(invocation, nil)
+	}()
+}
+
+// returnError answers the method call with the error. Every invocation must be
+// answered, or the caller waits until the call times out.
+func returnError(invocation *C.GDBusMethodInvocation, err error) {
+	errName := C.CString(ErrorName)
+	defer C.free(unsafe.Pointer(errName))
+	msg := C.CString(err.Error())
+	defer C.free(unsafe.Pointer(msg))
+	C.return_error(invocation, errName, msg)
+}
+
+//export goHandleGetProperty
+func goHandleGetProperty(prop *C.char, gerr **C.GError) *C.GVariant {
+	manager := currentManager()
+	var value string
+	var err error
+	if manager == nil {
+		err = ErrStopped
+	} else {
+		value, err = property(manager, C.GoString(prop))
+	}
+	if err != nil {
+		msg := C.CString(err.Error())
+		defer C.free(unsafe.Pointer(msg))
+		C.set_error(gerr, msg)
+		return nil
+	}
+	cvalue := C.CString(value)
+	defer C.free(unsafe.Pointer(cvalue))
+	return C.g_variant_new_string((*C.gchar)(cvalue))
+}
@@ -0,0 +1,23 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// +build !dbus !cgo
+
+package dbus
+
+// Start publishes the UpdateManager on the system bus. This build of the
+// client has no D-Bus support, so it always fails with ErrNotSupported.
+func Start(manager UpdateManager) (Service, error) {
+	return nil, ErrNotSupported
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package dbus
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeUpdateManager struct {
+	calls []string
+	err   error
+}
+
+func (f *fakeUpdateManager) State() string {
+	return "idle"
+}
+
+func (f *fakeUpdateManager) InstalledArtifact() (string, error) {
+	return "release-1", f.err
+}
+
+func (f *fakeUpdateManager) DeploymentID() string {
+	return ""
+}
+
+func (f *fakeUpdateManager) CheckUpdate() error {
+	f.calls = append(f.calls, "CheckUpdate")
+	return f.err
+}
+
+func (f *fakeUpdateManager) TriggerInventory() error {
+	f.calls = append(f.calls, "TriggerInventory")
+	return f.err
+}
+
+func (f *fakeUpdateManager) ConfirmReboot() error {
+	f.calls = append(f.calls, "ConfirmReboot")
+	return f.err
+}
+
+func (f *fakeUpdateManager) ConfirmCommit() error {
+	f.calls = append(f.calls, "ConfirmCommit")
+	return f.err
+}
+
+func TestProperty(t *testing.T) {
+	manager := &fakeUpdateManager{}
+
+	value, err := property(manager, "State")
+	assert.NoError(t, err)
+	assert.Equal(t, "idle", value)
+
+	value, err = property(manager, "InstalledArtifact")
+	assert.NoError(t, err)
+	assert.Equal(t, "release-1", value)
+
+	value, err = property(manager, "DeploymentID")
+	assert.NoError(t, err)
+	assert.Equal(t, "", value)
+
+	_, err = property(manager, "Bogus")
+	assert.Error(t, err)
+
+	manager.err = errors.New("no artifact name")
+	_, err = property(manager, "InstalledArtifact")
+	assert.Error(t, err)
+}
+
+func TestCallMethod(t *testing.T) {
+	manager := &fakeUpdateManager{}
+
+	assert.NoError(t, callMethod(manager, "CheckUpdate"))
+	assert.NoError(t, callMethod(manager, "TriggerInventory"))
+	assert.NoError(t, callMethod(manager, "ConfirmReboot"))
+	assert.NoError(t, callMethod(manager, "ConfirmCommit"))
+	assert.Error(t, callMethod(manager, "Reboot"))
+	assert.Equal(t, []string{"CheckUpdate", "TriggerInventory", "ConfirmReboot",
+		"ConfirmCommit"}, manager.calls)
+
+	manager.err = errors.New("failed")
+	assert.Error(t, callMethod(manager, "CheckUpdate"))
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+// errDeploymentDeferred is returned when a deployment is put off because of
+// the deployment rate limits.
+var errDeploymentDeferred = errors.New("deployment deferred")
+
+// deploymentHistory holds the completion times of recent deployments which
+// installed an update, successfully or not, and is used to limit how often
+// the device installs updates.
+type deploymentHistory struct {
+	Completed []time.Time
+}
+
+func loadDeploymentHistory(s store.Store) (*deploymentHistory, error) {
+	history := &deploymentHistory{}
+	data, err := s.ReadAll(datastore.DeploymentHistoryKey)
+	if err == os.ErrNotExist {
+		return history, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, history); err != nil {
+		return nil, errors.Wrap(err, "failed to parse deployment history")
+	}
+	return history, nil
+}
+
+// recordDeploymentCompletion adds a completed deployment, which attempted to
+// install the update, to the history kept in the store. Only the entries needed to enforce the rate limits are kept;
+// those of the last day, and the last one.
+func recordDeploymentCompletion(s store.Store, now time.Time) error {
+	history, err := loadDeploymentHistory(s)
+	if err != nil {
+		log.Warnf("Discarding deployment history: %v", err)
+		history = &deploymentHistory{}
+	}
+
+	completed := []time.Time{}
+	for _, t := range history.Completed {
+		if now.Sub(t) < 24*time.Hour {
+			completed = append(completed, t)
+		}
+	}
+	history.Completed = append(completed, now.UTC())
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return s.WriteAll(datastore.DeploymentHistoryKey, data)
+}
+
+// checkRateLimit returns an error if a new deployment started at `now` would
+// violate either the minimum interval between deployments, or the maximum
+// number of deployments per day. Zero values disable the respective limit.
+func (h *deploymentHistory) checkRateLimit(now time.Time,
+	minInterval time.Duration, maxPerDay int) error {
+
+	if len(h.Completed) == 0 {
+		return nil
+	}
+
+	last := h.Completed[len(h.Completed)-1]
+	if minInterval > 0 && now.Sub(last) < minInterval {
+		return errors.Errorf("last deployment completed at %s; "+
+			"next deployment allowed at %s",
+			last.Format(time.RFC3339),
+			last.Add(minInterval).Format(time.RFC3339))
+	}
+
+	if maxPerDay > 0 {
+		count := 0
+		for _, t := range h.Completed {
+			if now.Sub(t) < 24*time.Hour {
+				count++
+			}
+		}
+		if count >= maxPerDay {
+			return errors.Errorf("%d deployments completed during the "+
+				"last 24 hours, the maximum is %d", count, maxPerDay)
+		}
+	}
+	return nil
+}
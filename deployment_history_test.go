@@ -0,0 +1,65 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeploymentHistory(t *testing.T) {
+	ms := store.NewMemStore()
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	history, err := loadDeploymentHistory(ms)
+	assert.NoError(t, err)
+	assert.Empty(t, history.Completed)
+	assert.NoError(t, history.checkRateLimit(now, time.Hour, 1))
+
+	// entries older than a day are pruned
+	assert.NoError(t, recordDeploymentCompletion(ms, now.Add(-30*time.Hour)))
+	assert.NoError(t, recordDeploymentCompletion(ms, now.Add(-3*time.Hour)))
+	assert.NoError(t, recordDeploymentCompletion(ms, now.Add(-2*time.Hour)))
+	history, err = loadDeploymentHistory(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{
+		now.Add(-3 * time.Hour),
+		now.Add(-2 * time.Hour),
+	}, history.Completed)
+
+	// no limits
+	assert.NoError(t, history.checkRateLimit(now, 0, 0))
+
+	// minimum interval
+	assert.NoError(t, history.checkRateLimit(now, time.Hour, 0))
+	assert.Error(t, history.checkRateLimit(now, 3*time.Hour, 0))
+
+	// maximum per day
+	assert.NoError(t, history.checkRateLimit(now, 0, 3))
+	assert.Error(t, history.checkRateLimit(now, 0, 2))
+	assert.NoError(t, history.checkRateLimit(now.Add(22*time.Hour), 0, 2))
+
+	// broken history is discarded
+	ms.WriteAll(datastore.DeploymentHistoryKey, []byte("garbage"))
+	_, err = loadDeploymentHistory(ms)
+	assert.Error(t, err)
+	assert.NoError(t, recordDeploymentCompletion(ms, now))
+	history, err = loadDeploymentHistory(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{now}, history.Completed)
+}
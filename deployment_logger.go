@@ -15,10 +15,12 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
@@ -38,27 +40,99 @@ var (
 type FileLogger struct {
 	logFileName string
 	logFile     io.WriteCloser
+	// current size of the log file
+	size int64
+	// maximum size of the log file; once reached, the oldest log entries
+	// are dropped to make room for new ones. 0 means no limit.
+	maxSize int64
 }
 
 // NewFileLogger creates instance of file logger; it is initialized
 // just before logging is started
 func NewFileLogger(name string) *FileLogger {
+	return newBoundedFileLogger(name, 0)
+}
+
+// newBoundedFileLogger creates a file logger keeping at most maxSize bytes
+// of logs, acting as a ring buffer of log lines.
+func newBoundedFileLogger(name string, maxSize int64) *FileLogger {
 	// open log file
-	logFile, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0600)
+	logFile, err := openLogFile(name)
 	if err != nil {
 		// if we can not open file for logging; return nil
 		return nil
 	}
 
+	var size int64
+	if fi, err := logFile.Stat(); err == nil {
+		size = fi.Size()
+	}
+
 	// return FileLogger only when logging is possible (we can open log file)
 	return &FileLogger{
 		logFileName: name,
 		logFile:     logFile,
+		size:        size,
+		maxSize:     maxSize,
 	}
 }
 
+func openLogFile(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0600)
+}
+
 func (fl *FileLogger) Write(log []byte) (int, error) {
-	return fl.logFile.Write(log)
+	if fl.maxSize > 0 && fl.size+int64(len(log)) > fl.maxSize {
+		if err := fl.dropOldest(int64(len(log))); err != nil {
+			return 0, err
+		}
+	}
+	n, err := fl.logFile.Write(log)
+	fl.size += int64(n)
+	return n, err
+}
+
+// dropOldest removes the oldest log lines from the log file, so that there is
+// room for at least `needed` more bytes. To avoid rewriting the file on every
+// write, the file is shrunk to 3/4 of its maximum size.
+func (fl *FileLogger) dropOldest(needed int64) error {
+	content, err := ioutil.ReadFile(fl.logFileName)
+	if err != nil {
+		return err
+	}
+
+	keep := fl.maxSize*3/4 - needed
+	if keep < 0 {
+		keep = 0
+	}
+	if int64(len(content)) > keep {
+		start := int64(len(content)) - keep
+		// only keep complete log lines
+		if idx := bytes.IndexByte(content[start-1:], '\n'); idx >= 0 {
+			start += int64(idx)
+		} else {
+			start = int64(len(content))
+		}
+		content = content[start:]
+	}
+
+	tmpName := fl.logFileName + ".tmp"
+	if err = ioutil.WriteFile(tmpName, content, 0600); err != nil {
+		return err
+	}
+	if err = fl.logFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, fl.logFileName); err != nil {
+		return err
+	}
+	logFile, err := openLogFile(fl.logFileName)
+	if err != nil {
+		return err
+	}
+	fl.logFile = logFile
+	fl.size = int64(len(content))
+	return nil
 }
 
 func (fl *FileLogger) Deinit() error {
@@ -73,6 +147,9 @@ type DeploymentLogManager struct {
 	maxLogFiles int
 
 	minLogSizeBytes uint64
+	// maximum size of a single deployment log file; older log entries are
+	// dropped when the limit is reached, 0 means no limit
+	maxLogSizeBytes int64
 	// it is easy to add logging hook, but not so much remove it;
 	// we need a mechanism for emabling and disabling logging
 	loggingEnabled bool
@@ -93,6 +170,15 @@ func NewDeploymentLogManager(logDirLocation string) *DeploymentLogManager {
 	}
 }
 
+// SetMaxLogSize sets the maximum size of the log kept for a single
+// deployment. A size of 0 or less, the default, keeps the whole log.
+func (dlm *DeploymentLogManager) SetMaxLogSize(size int64) {
+	if size < 0 {
+		size = 0
+	}
+	dlm.maxLogSizeBytes = size
+}
+
 func (dlm DeploymentLogManager) WriteLog(log []byte) error {
 	if dlm.logger == nil {
 		return ErrLoggerNotInitialized
@@ -132,7 +218,8 @@ func (dlm *DeploymentLogManager) Enable(deploymentID string) error {
 
 	// instantiate logger
 	logFileName := fmt.Sprintf(logFileNameScheme, 1, deploymentID)
-	dlm.logger = NewFileLogger(filepath.Join(dlm.logLocation, logFileName))
+	dlm.logger = newBoundedFileLogger(filepath.Join(dlm.logLocation, logFileName),
+		dlm.maxLogSizeBytes)
 
 	if dlm.logger == nil {
 		return ErrLoggerNotInitialized
@@ -80,6 +80,54 @@ func TestFileLogger(t *testing.T) {
 	}
 }
 
+func TestBoundedFileLogger(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+
+	logFile := path.Join(tempDir, "logfile.log")
+	logger := newBoundedFileLogger(logFile, 100)
+	assert.NotNil(t, logger)
+	defer logger.Deinit()
+
+	for i := 0; i < 20; i++ {
+		_, err := logger.Write([]byte(fmt.Sprintf("log line %02d\n", i)))
+		assert.NoError(t, err)
+	}
+
+	content, err := ioutil.ReadFile(logFile)
+	assert.NoError(t, err)
+	assert.True(t, len(content) <= 100)
+	assert.Equal(t, int64(len(content)), logger.size)
+
+	// the newest entries are kept, and only complete lines
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	assert.Equal(t, "log line 19", lines[len(lines)-1])
+	for _, line := range lines {
+		assert.True(t, strings.HasPrefix(line, "log line "))
+	}
+	assert.NotContains(t, string(content), "log line 00")
+
+	// unbounded by default
+	manager := NewDeploymentLogManager(tempDir)
+	assert.Equal(t, int64(0), manager.maxLogSizeBytes)
+	manager.SetMaxLogSize(100)
+	assert.Equal(t, int64(100), manager.maxLogSizeBytes)
+	manager.SetMaxLogSize(0)
+	assert.Equal(t, int64(0), manager.maxLogSizeBytes)
+
+	unbounded := newBoundedFileLogger(path.Join(tempDir, "unbounded.log"), 0)
+	assert.NotNil(t, unbounded)
+	defer unbounded.Deinit()
+	for i := 0; i < 20; i++ {
+		_, err := unbounded.Write([]byte(fmt.Sprintf("log line %02d\n", i)))
+		assert.NoError(t, err)
+	}
+	content, err = ioutil.ReadFile(path.Join(tempDir, "unbounded.log"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "log line 00")
+	assert.Contains(t, string(content), "log line 19")
+}
+
 func TestLogManagerInit(t *testing.T) {
 	tempDir, _ := ioutil.TempDir("", "logs")
 	defer os.RemoveAll(tempDir)
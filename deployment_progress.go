@@ -0,0 +1,90 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// downloadProgress tracks how much of the artifact being installed has been
+// downloaded, for on-device integrations to show.
+type downloadProgress struct {
+	downloaded int64
+	total      int64
+}
+
+// start resets the progress for a new download of the given size.
+func (p *downloadProgress) start(total int64) {
+	atomic.StoreInt64(&p.downloaded, 0)
+	atomic.StoreInt64(&p.total, total)
+}
+
+func (p *downloadProgress) get() (downloaded, total int64) {
+	return atomic.LoadInt64(&p.downloaded), atomic.LoadInt64(&p.total)
+}
+
+// progressReader counts the bytes read from the artifact stream.
+type progressReader struct {
+	io.ReadCloser
+	progress *downloadProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.progress.downloaded, int64(n))
+	return n, err
+}
+
+// writeProgress tracks how much of the update being installed has been written
+// to the inactive partition, as reported by the dual rootfs device.
+type writeProgress struct {
+	written int64
+	total   int64
+}
+
+func (p *writeProgress) ReportWriteProgress(written, total int64) {
+	atomic.StoreInt64(&p.written, written)
+	atomic.StoreInt64(&p.total, total)
+}
+
+func (p *writeProgress) get() (written, total int64) {
+	return atomic.LoadInt64(&p.written), atomic.LoadInt64(&p.total)
+}
+
+// deploymentPause is set by on-device integrations to hold deployments at the
+// pause points of the update control map, whatever the server says, until
+// resumed.
+type deploymentPause struct {
+	lock   sync.Mutex
+	paused bool
+}
+
+func (p *deploymentPause) set(paused bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.paused = paused
+}
+
+// isSet returns false for a nil pause, so that state contexts without one
+// are never paused locally.
+func (p *deploymentPause) isSet() bool {
+	if p == nil {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused
+}
@@ -15,6 +15,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -51,6 +52,8 @@ type deviceManager struct {
 	artifactInfoFile    string
 	deviceTypeFile      string
 	store               store.Store
+	// Read once, rather than from the key files for every artifact.
+	signaturePolicy *installer.SignaturePolicy
 }
 
 func NewDeviceManager(dualRootfsDevice installer.DualRootfsDevice, config *menderConfig, store store.Store) *deviceManager {
@@ -60,12 +63,20 @@ func NewDeviceManager(dualRootfsDevice installer.DualRootfsDevice, config *mende
 		config:           *config,
 		stateScriptPath:  config.ArtifactScriptsPath,
 		store:            store,
+		signaturePolicy:  config.GetSignaturePolicy(),
 	}
 	d.installerFactories = installer.AllModules{
 		DualRootfs: dualRootfsDevice,
+		Directory:  installer.NewDirectoryInstallerFactory(config.ModulesWorkPath),
+		Container:  installer.NewContainerInstallerFactory(config.ModulesWorkPath),
+		Configure: installer.NewConfigureInstallerFactory(config.ModulesWorkPath,
+			config.ConfigureDeviceConfigFile, config.ConfigureApplyScriptsDir),
 		Modules: installer.NewModuleInstallerFactory(config.ModulesPath,
 			config.ModulesWorkPath, d, d, config.ModuleTimeoutSeconds),
 	}
+	if dualRootfsDevice != nil {
+		dualRootfsDevice.SetWriteThroughputRecorder(d)
+	}
 
 	return d
 }
@@ -142,9 +153,94 @@ func (d *deviceManager) GetCurrentArtifactName() (string, error) {
 }
 
 func (d *deviceManager) GetCurrentArtifactGroup() (string, error) {
+	if provides, err := loadArtifactProvides(d.store); err != nil {
+		return "", err
+	} else if provides != nil {
+		return provides["artifact_group"], nil
+	}
 	return getManifestData("artifact_group", d.artifactInfoFile)
 }
 
+// GetProvides returns the provides of the currently installed artifact, not
+// including the artifact name, which is returned by GetCurrentArtifactName.
+// They are stored in the database when an artifact is committed; until then
+// only the artifact group is known, from the artifact_info file.
+func (d *deviceManager) GetProvides() (map[string]string, error) {
+	provides, err := loadArtifactProvides(d.store)
+	if err != nil {
+		return nil, err
+	} else if provides != nil {
+		return provides, nil
+	}
+
+	provides = make(map[string]string)
+	group, err := d.GetCurrentArtifactGroup()
+	if err != nil {
+		return nil, err
+	}
+	if group != "" {
+		provides["artifact_group"] = group
+	}
+	return provides, nil
+}
+
+// checkArtifactDepends checks the depends of the artifact against the
+// provides of the currently installed one.
+func (d *deviceManager) checkArtifactDepends(i *installer.Installer) error {
+	// Devices whose current artifact can not be told can still install
+	// artifacts which do not depend on it.
+	if hasDepends, err := i.HasDepends(); err != nil || !hasDepends {
+		return err
+	}
+	provides, err := d.GetProvides()
+	if err != nil {
+		return err
+	}
+	if provides["artifact_name"], err = d.GetCurrentArtifactName(); err != nil {
+		return err
+	}
+	return i.CheckDepends(provides)
+}
+
+// loadArtifactProvides returns the provides stored when the installed
+// artifact was committed, or nil if there are none.
+func loadArtifactProvides(s store.Store) (map[string]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	data, err := s.ReadAll(datastore.ArtifactProvidesKey)
+	if err == os.ErrNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read the artifact provides")
+	}
+	var provides map[string]string
+	if err = json.Unmarshal(data, &provides); err != nil {
+		return nil, errors.Wrap(err, "could not parse the artifact provides")
+	}
+	return provides, nil
+}
+
+// commitArtifactProvides stores the provides of the device once the artifact
+// with the given provides, replacing the current provides which match the
+// clears patterns, is committed. Nothing is stored for artifacts which were
+// installed without reading their provides.
+func commitArtifactProvides(txn store.Transaction, current, provides map[string]string,
+	clears []string) error {
+
+	if provides == nil {
+		return nil
+	}
+	merged := installer.MergeProvides(current, provides, clears)
+	// The name has its own key.
+	delete(merged, "artifact_name")
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return txn.WriteAll(datastore.ArtifactProvidesKey, data)
+}
+
 func (d *deviceManager) GetDeviceType() (string, error) {
 	return GetDeviceType(d.deviceTypeFile)
 }
@@ -165,12 +261,15 @@ func (d *deviceManager) ReadArtifactHeaders(from io.ReadCloser) (*installer.Inst
 	}
 
 	var i *installer.Installer
-	i, d.installers, err = installer.ReadHeaders(from,
+	i, d.installers, err = installer.ReadHeadersWithPolicy(from,
 		deviceType,
-		d.GetArtifactVerifyKey(),
+		d.signaturePolicy,
 		d.stateScriptPath,
 		&d.installerFactories)
-	return i, err
+	if err != nil {
+		return i, err
+	}
+	return i, d.checkArtifactDepends(i)
 }
 
 func (d *deviceManager) GetInstallers() []installer.PayloadUpdatePerformer {
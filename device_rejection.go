@@ -0,0 +1,108 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+// After this many authorization attempts in a row rejected by the server for
+// good, the device is taken to be decommissioned.
+const decommissionedAfterRejections = 3
+
+// deviceRejection tracks the authorization attempts rejected by the server
+// for good, so that a decommissioned device stops asking to be authorized
+// every few minutes.
+type deviceRejection struct {
+	lock sync.Mutex
+	// Number of attempts in a row rejected, and the time of the first.
+	count int
+	since time.Time
+	// Whether the authorization set was wiped since the first.
+	wiped bool
+	// When the rejections began, the last time the device was taken to be
+	// decommissioned, and whether its authorization set was wiped then;
+	// kept after the device is accepted again, for the inventory.
+	lastDecommissioned time.Time
+	lastWiped          bool
+}
+
+// note records the result of an authorization attempt. Other errors than
+// authorization errors, such as network errors, neither count as rejections
+// nor end them.
+func (r *deviceRejection) note(err error, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch {
+	case err == nil || (client.IsAuthError(err) && !client.IsDeviceRejected(err)):
+		if r.count >= decommissionedAfterRejections {
+			log.Info("The server no longer rejects the device as decommissioned")
+		}
+		r.count, r.since, r.wiped = 0, time.Time{}, false
+	case client.IsDeviceRejected(err):
+		if r.count == 0 {
+			r.since = now
+		}
+		r.count++
+		if r.count == decommissionedAfterRejections {
+			r.lastDecommissioned, r.lastWiped = r.since, false
+			log.Errorf("The server rejected the device %d times in a row since %s; "+
+				"the device seems to be decommissioned, and asks to be "+
+				"authorized less often from now on",
+				r.count, r.since.Format(time.RFC3339))
+		}
+	}
+}
+
+func (r *deviceRejection) decommissioned() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.count >= decommissionedAfterRejections
+}
+
+// shouldWipe returns whether the device has been decommissioned for longer
+// than wipeAfter, and its authorization set was not wiped yet; it is taken
+// to be wiped from then on.
+func (r *deviceRejection) shouldWipe(wipeAfter time.Duration, now time.Time) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if wipeAfter <= 0 || r.wiped || r.count < decommissionedAfterRejections ||
+		now.Sub(r.since) < wipeAfter {
+		return false
+	}
+	r.wiped = true
+	r.lastWiped = true
+	return true
+}
+
+// attributes returns the inventory attributes of the last time the device was
+// taken to be decommissioned, if any, so that the server learns about it once
+// the device is accepted again.
+func (r *deviceRejection) attributes() []client.InventoryAttribute {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.lastDecommissioned.IsZero() {
+		return nil
+	}
+	return []client.InventoryAttribute{
+		{Name: "decommissioned_at", Value: r.lastDecommissioned.UTC().Format(time.RFC3339)},
+		{Name: "decommissioned_auth_wiped", Value: strconv.FormatBool(r.lastWiped)},
+	}
+}
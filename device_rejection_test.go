@@ -0,0 +1,103 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMenderDecommissioned(t *testing.T) {
+	body := `{"error": "device decommissioned", "code": "device_decommissioned"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body == "" {
+			w.Write([]byte("tokendata"))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			menderConfigFromFile: menderConfigFromFile{
+				Servers: []client.MenderServer{{ServerURL: srv.URL}},
+				// Wiped at the first rejection after being
+				// decommissioned.
+				DecommissionedWipeAfterSeconds: 1,
+			},
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+	require.NoError(t, mender.authMgr.GenerateKey())
+	key, err := ms.ReadAll(defaultKeyFile)
+	require.NoError(t, err)
+
+	for i := 1; i < decommissionedAfterRejections; i++ {
+		assert.Error(t, mender.Authorize())
+		assert.False(t, mender.IsDecommissioned())
+	}
+	assert.Error(t, mender.Authorize())
+	assert.True(t, mender.IsDecommissioned())
+	assert.False(t, mender.forceBootstrap)
+
+	// Network errors do not end the rejection.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	mender.config.Servers[0].ServerURL = closed.URL
+	assert.Error(t, mender.Authorize())
+	assert.True(t, mender.IsDecommissioned())
+	mender.config.Servers[0].ServerURL = srv.URL
+
+	mender.rejection.since = mender.rejection.since.Add(-2 * time.Second)
+	assert.Error(t, mender.Authorize())
+	assert.True(t, mender.forceBootstrap)
+
+	// A new key is generated at the next attempt, which the server
+	// accepts.
+	body = ""
+	assert.Nil(t, mender.Authorize())
+	assert.False(t, mender.IsDecommissioned())
+
+	// The inventory tells that the device was decommissioned.
+	assert.Equal(t, []client.InventoryAttribute{
+		{Name: "decommissioned_at",
+			Value: mender.rejection.lastDecommissioned.UTC().Format(time.RFC3339)},
+		{Name: "decommissioned_auth_wiped", Value: "true"},
+	}, mender.rejection.attributes())
+	newKey, err := ms.ReadAll(defaultKeyFile)
+	require.NoError(t, err)
+	assert.NotEqual(t, key, newKey)
+
+	// Devices not accepted yet are not decommissioned.
+	body = `{"error": "dev auth: unauthorized"}`
+	require.NoError(t, mender.authMgr.RemoveAuthToken())
+	for i := 0; i < decommissionedAfterRejections; i++ {
+		assert.Error(t, mender.Authorize())
+	}
+	assert.False(t, mender.IsDecommissioned())
+}
@@ -14,8 +14,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"path"
+	"sort"
+	"strings"
+	"unicode"
 
 	"github.com/mendersoftware/mender/system"
 	"github.com/mendersoftware/mender/utils"
@@ -37,13 +41,17 @@ type IdentityDataGetter interface {
 
 type IdentityDataRunner struct {
 	Helper string
-	cmdr   system.Commander
+	// Constant identity attributes, added to those of the helper; they
+	// take precedence over the attributes of the helper.
+	Attributes map[string]string
+	cmdr       system.Commander
 }
 
-func NewIdentityDataGetter() IdentityDataGetter {
+func NewIdentityDataGetter(attributes map[string]string) IdentityDataGetter {
 	return &IdentityDataRunner{
-		identityDataHelper,
-		&system.OsCalls{},
+		Helper:     identityDataHelper,
+		Attributes: attributes,
+		cmdr:       &system.OsCalls{},
 	}
 }
 
@@ -81,13 +89,19 @@ func (id IdentityDataRunner) Get() (string, error) {
 	}
 	data := IdentityData{}
 	data.AppendFromRaw(collected)
+	for name, value := range id.Attributes {
+		data[name] = value
+	}
+	if err := data.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid identity data")
+	}
 
-	encdata, err := json.Marshal(data)
+	encdata, err := data.Encode()
 	if err != nil {
 		return "", errors.Wrapf(err, "failed to encode identity data")
 	}
 
-	return string(encdata), nil
+	return encdata, nil
 }
 
 // Try to keep things simple and reuse InventoryData as identity data structure
@@ -102,3 +116,96 @@ func (id IdentityData) AppendFromRaw(raw map[string][]string) {
 		}
 	}
 }
+
+// Validate checks that the names of the attributes are not empty and have no
+// surrounding white space or control characters, and that their values are
+// strings, or lists of strings, which are not empty.
+func (id IdentityData) Validate() error {
+	for name, value := range id {
+		if name == "" || strings.TrimSpace(name) != name ||
+			strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			return errors.Errorf("invalid identity attribute name %q", name)
+		}
+		switch value := value.(type) {
+		case string:
+			if value == "" {
+				return errors.Errorf("identity attribute %q is empty", name)
+			}
+		case []string:
+			if len(value) == 0 {
+				return errors.Errorf("identity attribute %q is empty", name)
+			}
+			for _, v := range value {
+				if v == "" {
+					return errors.Errorf("identity attribute %q has an empty value", name)
+				}
+			}
+		default:
+			return errors.Errorf("identity attribute %q is not a string or a "+
+				"list of strings", name)
+		}
+	}
+	return nil
+}
+
+// Encode returns the JSON object of the identity, with the attributes sorted
+// by name, and the values of each attribute in the order given, so that the
+// same identity is always encoded the same way, and thus signed the same way.
+func (id IdentityData) Encode() (string, error) {
+	names := make([]string, 0, len(id))
+	for name := range id {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		encname, err := json.Marshal(name)
+		if err != nil {
+			return "", err
+		}
+		encvalue, err := json.Marshal(id[name])
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to encode identity attribute %q", name)
+		}
+		buf.Write(encname)
+		buf.WriteByte(':')
+		buf.Write(encvalue)
+	}
+	buf.WriteByte('}')
+	return buf.String(), nil
+}
+
+// redactIdentity returns the encoded identity data, for logging, with the
+// values of the sensitive attributes, and of those named like tokens and
+// passwords, replaced. Names are compared regardless of case.
+func redactIdentity(encoded string, sensitive []string) string {
+	data := IdentityData{}
+	if err := json.Unmarshal([]byte(encoded), &data); err != nil {
+		return redacted
+	}
+	for name := range data {
+		if sensitiveNamePattern.MatchString(name) {
+			data[name] = redacted
+			continue
+		}
+		for _, s := range sensitive {
+			if strings.EqualFold(name, s) {
+				data[name] = redacted
+				break
+			}
+		}
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	// Keep redacted readable.
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(data); err != nil {
+		return redacted
+	}
+	return strings.TrimSuffix(out.String(), "\n")
+}
@@ -109,3 +109,59 @@ keyvalue
 		}
 	}
 }
+
+func TestDeviceIdentityAttributes(t *testing.T) {
+	r := stest.NewTestOSCalls("mac=de:ad:be:ef:00:01\nserial=1\n", 0)
+	ir := IdentityDataRunner{
+		Attributes: map[string]string{
+			"serial": "A1234",
+			"site":   "plant-7",
+		},
+		cmdr: r,
+	}
+	id, err := ir.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, `{"mac":"de:ad:be:ef:00:01","serial":"A1234","site":"plant-7"}`, id)
+
+	ir.Attributes = map[string]string{" serial": "A1234"}
+	_, err = ir.Get()
+	assert.Error(t, err)
+}
+
+func TestIdentityDataValidate(t *testing.T) {
+	assert.NoError(t, IdentityData{"mac": "de:ad:be:ef:00:01",
+		"ip": []string{"10.0.0.1", "10.0.0.2"}}.Validate())
+
+	for _, id := range []IdentityData{
+		{"": "value"},
+		{"mac ": "de:ad:be:ef:00:01"},
+		{"mac\n": "de:ad:be:ef:00:01"},
+		{"mac": ""},
+		{"ip": []string{}},
+		{"ip": []string{"10.0.0.1", ""}},
+		{"count": 1},
+	} {
+		assert.Error(t, id.Validate(), "%v", id)
+	}
+}
+
+func TestIdentityDataEncode(t *testing.T) {
+	id := IdentityData{
+		"z":   "last",
+		"a":   []string{"2", "1"},
+		"mac": "de:ad",
+	}
+	for i := 0; i < 10; i++ {
+		enc, err := id.Encode()
+		assert.NoError(t, err)
+		assert.Equal(t, `{"a":["2","1"],"mac":"de:ad","z":"last"}`, enc)
+	}
+}
+
+func TestRedactIdentity(t *testing.T) {
+	assert.Equal(t,
+		`{"Serial":"<redacted>","api_token":"<redacted>","mac":"de:ad:be:ef:00:01"}`,
+		redactIdentity(`{"Serial":"A1234","api_token":"t","mac":"de:ad:be:ef:00:01"}`,
+			[]string{"serial"}))
+	assert.Equal(t, redacted, redactIdentity("not json", nil))
+}
@@ -14,8 +14,11 @@
 package installer
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"sync"
+	"syscall"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/system"
@@ -25,6 +28,7 @@ import (
 var (
 	BlockDeviceGetSizeOf       BlockDeviceGetSizeFunc       = system.GetBlockDeviceSize
 	BlockDeviceGetSectorSizeOf BlockDeviceGetSectorSizeFunc = system.GetBlockDeviceSectorSize
+	UbiResizeVolume            func(string, int64) error    = system.ResizeUbiVolume
 )
 
 // BlockDeviceGetSizeFunc is a helper for obtaining the size of a block device.
@@ -33,15 +37,122 @@ type BlockDeviceGetSizeFunc func(file *os.File) (uint64, error)
 // BlockDeviceGetSectorSizeFunc is a helper for obtaining the sector size of a block device.
 type BlockDeviceGetSectorSizeFunc func(file *os.File) (int, error)
 
+// BlockDeviceFile is an open block device, which BlockDevice reads and
+// writes. The devices are opened with os.OpenFile, unless BlockDevice.Open is
+// set, to use in-memory ones in tests for instance; see installer/testutils.
+type BlockDeviceFile interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Sync() error
+	// Size returns the size of the device.
+	Size() (uint64, error)
+	// SectorSize returns the logical sector size of the device.
+	SectorSize() (int, error)
+	// Discard tells the device that length bytes at offset are no longer
+	// in use.
+	Discard(offset, length uint64) error
+}
+
+// BlockDeviceOpenFunc opens a block device, with the flags of os.OpenFile.
+type BlockDeviceOpenFunc func(path string, flag int) (BlockDeviceFile, error)
+
+// osBlockDevice is a block device opened with os.OpenFile, the size of which
+// is read with BlockDeviceGetSizeOf and BlockDeviceGetSectorSizeOf.
+type osBlockDevice struct {
+	*os.File
+}
+
+func openOSBlockDevice(path string, flag int) (BlockDeviceFile, error) {
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	return osBlockDevice{f}, nil
+}
+
+func (f osBlockDevice) Size() (uint64, error) {
+	return BlockDeviceGetSizeOf(f.File)
+}
+
+func (f osBlockDevice) SectorSize() (int, error) {
+	return BlockDeviceGetSectorSizeOf(f.File)
+}
+
+func (f osBlockDevice) Discard(offset, length uint64) error {
+	return system.DiscardBlockDevice(f.File, offset, length)
+}
+
 // BlockDevice is a low-level wrapper for a block device. The wrapper implements
-// io.Writer and io.Closer interfaces.
+// io.Reader, io.Writer and io.Closer interfaces. The device is opened for
+// reading or writing by the first Read or Write, and stays in that mode until
+// it is closed; mixing the two without closing the device in between fails
+// with a *BlockDeviceModeError. It is safe for concurrent use.
 type BlockDevice struct {
 	Path               string               // device path, ex. /dev/mmcblk0p1
-	out                *os.File             // os.File for writing
+	Open               BlockDeviceOpenFunc  // opens Path; with os.OpenFile if nil
+	out                BlockDeviceFile      // the device open for reading or writing
 	w                  *utils.LimitedWriter // wrapper for `out` limited the number of bytes written
+	mode               blockDeviceMode      // what `out` is open for
+	lock               sync.Mutex           // protects the fields above
 	typeUBI            bool                 // Set to true if we are updating an UBI volume
+	typeMTD            bool                 // Set to true if we are updating a raw MTD device
+	mtd                *mtdWriter           // set when writing to a raw MTD device
 	ImageSize          int64                // image size
+	StartOffset        int64                // Start writing at this offset, to resume an interrupted write
 	FlushIntervalBytes uint64               // Force a flush to disk each time this many bytes are written
+	DirectIO           bool                 // Write with O_DIRECT, if the device supports it
+	direct             *directWriter        // set when writing with DirectIO
+	SkipIdentical      bool                 // Only write blocks differing from the device content; overrides DirectIO
+	compare            *compareWriter       // set when writing with SkipIdentical
+	BlockMap           *blockMap            // Only write the blocks mapped by it, if set
+	DiscardHoles       bool                 // Discard the holes of BlockMap on the device
+	holes              int64                // bytes of holes skipped when writing with BlockMap
+}
+
+type blockDeviceMode int
+
+const (
+	blockDeviceClosed blockDeviceMode = iota
+	blockDeviceReading
+	blockDeviceWriting
+)
+
+func (m blockDeviceMode) String() string {
+	switch m {
+	case blockDeviceReading:
+		return "reading"
+	case blockDeviceWriting:
+		return "writing"
+	default:
+		return "closed"
+	}
+}
+
+// BlockDeviceModeError is returned when reading from a block device open for
+// writing, or writing to one open for reading.
+type BlockDeviceModeError struct {
+	Path string
+	// Op is the attempted operation, "read" or "write".
+	Op string
+	// Mode is what the device is open for, "reading" or "writing".
+	Mode string
+}
+
+func (e *BlockDeviceModeError) Error() string {
+	return fmt.Sprintf("can not %s block device %s: it is open for %s, close it first",
+		e.Op, e.Path, e.Mode)
+}
+
+// open opens the device with the flags of os.OpenFile.
+func (bd *BlockDevice) open(flag int) (BlockDeviceFile, error) {
+	if bd.Open != nil {
+		return bd.Open(bd.Path, flag)
+	}
+	return openOSBlockDevice(bd.Path, flag)
 }
 
 // A WriteSyncer is an io.Writer that also implements a Sync() function which commits written data to stable storage.
@@ -94,104 +205,378 @@ func (fw *FlushingWriter) Sync() error {
 // Write writes data `p` to underlying block device. Will automatically open
 // the device in a write mode. Otherwise, behaves like io.Writer.
 func (bd *BlockDevice) Write(p []byte) (int, error) {
-	if bd.out == nil {
-		log.Infof("opening device %s for writing", bd.Path)
-		out, err := os.OpenFile(bd.Path, os.O_WRONLY, 0)
-		if err != nil {
+	bd.lock.Lock()
+	defer bd.lock.Unlock()
+
+	if bd.mode == blockDeviceReading {
+		return 0, &BlockDeviceModeError{Path: bd.Path, Op: "write", Mode: bd.mode.String()}
+	}
+
+	if bd.mode == blockDeviceClosed {
+		if err := bd.openForWriting(); err != nil {
 			return 0, err
 		}
+	}
 
-		var wrappedOut io.Writer
-
-		wrappedOut = out
-
-		// From <mtd/ubi-user.h>
-		//
-		// UBI volume update
-		// ~~~~~~~~~~~~~~~~~
-		//
-		// Volume update should be done via the UBI_IOCVOLUP ioctl command of the
-		// corresponding UBI volume character device. A pointer to a 64-bit update
-		// size should be passed to the ioctl. After this, UBI expects user to write
-		// this number of bytes to the volume character device. The update is finished
-		// when the claimed number of bytes is passed. So, the volume update sequence
-		// is something like:
-		//
-		// fd = open("/dev/my_volume");
-		// ioctl(fd, UBI_IOCVOLUP, &image_size);
-		// write(fd, buf, image_size);
-		// close(fd);
-		if bd.typeUBI {
-			err := system.SetUbiUpdateVolume(out, bd.ImageSize)
+	w, err := bd.w.Write(p)
+	if err != nil {
+		log.Errorf("written %v out of %v bytes to partition %s: %v",
+			w, len(p), bd.Path, err)
+	}
+	return w, err
+}
+
+// fullWrite returns whether the device is written in full, which UBI volumes
+// and raw MTD devices are.
+func (bd *BlockDevice) fullWrite() bool {
+	return bd.typeUBI || bd.typeMTD
+}
+
+// openForWriting opens the device for writing, and sets up the writers for
+// the kind of device and the options of the write. The device is closed
+// again if that fails.
+func (bd *BlockDevice) openForWriting() error {
+	log.Infof("opening device %s for writing", bd.Path)
+	out, direct, err := bd.openWriteFile()
+	if err != nil {
+		return err
+	}
+
+	w, size, err := bd.newWriters(out, direct)
+	if err != nil {
+		out.Close()
+		bd.compare = nil
+		bd.mtd = nil
+		bd.direct = nil
+		return err
+	}
+
+	bd.out = out
+	bd.w = &utils.LimitedWriter{
+		W: w,
+		N: size - uint64(bd.StartOffset),
+	}
+	bd.mode = blockDeviceWriting
+	return nil
+}
+
+// openWriteFile opens the device for writing, with O_DIRECT if it is to be
+// written with direct I/O and supports it, in which case direct is true.
+func (bd *BlockDevice) openWriteFile() (out BlockDeviceFile, direct bool, err error) {
+	compare := bd.SkipIdentical && !bd.fullWrite()
+	direct = bd.DirectIO && !bd.fullWrite() && !compare
+	flag := os.O_WRONLY
+	if compare {
+		flag = os.O_RDWR
+	} else if direct {
+		flag |= syscall.O_DIRECT
+	}
+	out, err = bd.open(flag)
+	if err != nil && direct && isInvalidArgument(err) {
+		log.Warnf("direct I/O is not supported by %s, using buffered writes",
+			bd.Path)
+		direct = false
+		out, err = bd.open(os.O_WRONLY)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// UBI volumes, raw MTD devices and direct I/O are only supported by
+	// the files of the devices.
+	_, isFile := out.(osBlockDevice)
+	if bd.fullWrite() && !isFile {
+		out.Close()
+		return nil, false, fmt.Errorf("can not write %s: UBI volumes and raw MTD "+
+			"devices can only be written as files", bd.Path)
+	}
+	return out, direct && isFile, nil
+}
+
+// newWriters returns the writer of the device open for writing in `out`,
+// and its size.
+func (bd *BlockDevice) newWriters(out BlockDeviceFile, direct bool) (io.Writer, uint64, error) {
+	size, err := out.Size()
+	if err != nil {
+		log.Errorf("failed to read block device size: %v", err)
+		return nil, 0, err
+	}
+	log.Infof("partition %s size: %v", bd.Path, size)
+
+	w, err := bd.newDeviceWriter(out, direct, size)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if bd.BlockMap != nil && bd.fullWrite() {
+		log.Info("UBI volumes and raw MTD devices are written in full; " +
+			"not using the block map")
+	} else if bd.BlockMap != nil {
+		w = bd.newSparseWriter(out, w)
+	}
+
+	if bd.StartOffset > 0 {
+		if err := bd.seekStartOffset(out); err != nil {
+			return nil, 0, err
+		}
+	}
+	return w, size, nil
+}
+
+// newDeviceWriter returns the writer for the kind of device, and for how it
+// is written.
+func (bd *BlockDevice) newDeviceWriter(out BlockDeviceFile, direct bool,
+	size uint64) (io.Writer, error) {
+
+	switch {
+	case bd.typeUBI:
+		return out, bd.startUbiUpdate(out.(osBlockDevice))
+	case bd.typeMTD:
+		return bd.newMtdDeviceWriter(out.(osBlockDevice), size)
+	case direct:
+		return bd.newDirectDeviceWriter(out.(osBlockDevice))
+	case bd.SkipIdentical:
+		return bd.newCompareDeviceWriter(out)
+	default:
+		return NewFlushingWriter(out, bd.FlushIntervalBytes), nil
+	}
+}
+
+// startUbiUpdate starts the update of the UBI volume.
+//
+// From <mtd/ubi-user.h>
+//
+// UBI volume update
+// ~~~~~~~~~~~~~~~~~
+//
+// Volume update should be done via the UBI_IOCVOLUP ioctl command of the
+// corresponding UBI volume character device. A pointer to a 64-bit update
+// size should be passed to the ioctl. After this, UBI expects user to write
+// this number of bytes to the volume character device. The update is finished
+// when the claimed number of bytes is passed. So, the volume update sequence
+// is something like:
+//
+// fd = open("/dev/my_volume");
+// ioctl(fd, UBI_IOCVOLUP, &image_size);
+// write(fd, buf, image_size);
+// close(fd);
+func (bd *BlockDevice) startUbiUpdate(file osBlockDevice) error {
+	err := system.SetUbiUpdateVolume(file.File, bd.ImageSize)
+	if err != nil {
+		log.Errorf("Failed to write images size to UBI_IOCVOLUP: %v", err)
+	}
+	return err
+}
+
+// newMtdDeviceWriter returns the writer of a raw MTD device, which writes an
+// erase block at a time, skipping bad blocks.
+func (bd *BlockDevice) newMtdDeviceWriter(file osBlockDevice, size uint64) (io.Writer, error) {
+	info, err := system.GetMtdInfo(file.File)
+	if err != nil {
+		log.Errorf("failed to read MTD device information: %v", err)
+		return nil, err
+	}
+	// MTD character devices can not be synced; the data is written to the
+	// flash as each block is written.
+	bd.mtd, err = newMtdWriter(mtdFile{file.File}, bd.Path, info, int64(size))
+	if err != nil {
+		return nil, err
+	}
+	return bd.mtd, nil
+}
+
+// newDirectDeviceWriter returns the writer of a device open with O_DIRECT.
+func (bd *BlockDevice) newDirectDeviceWriter(file osBlockDevice) (io.Writer, error) {
+	align, err := file.SectorSize()
+	if err != nil {
+		log.Errorf("failed to read block device sector size: %v", err)
+		return nil, err
+	}
+	bd.direct = newDirectWriter(file.File, align)
+	return NewFlushingWriter(bd.direct, bd.FlushIntervalBytes), nil
+}
+
+// newCompareDeviceWriter returns the writer of a device written with
+// SkipIdentical, which only writes the blocks differing from its content.
+func (bd *BlockDevice) newCompareDeviceWriter(out BlockDeviceFile) (io.Writer, error) {
+	ssz, err := out.SectorSize()
+	if err != nil {
+		log.Errorf("failed to read block device sector size: %v", err)
+		return nil, err
+	}
+	bd.compare = newCompareWriter(out, ssz)
+	return NewFlushingWriter(bd.compare, bd.FlushIntervalBytes), nil
+}
+
+// seekStartOffset moves to StartOffset, to resume an interrupted write.
+func (bd *BlockDevice) seekStartOffset(out BlockDeviceFile) error {
+	if bd.fullWrite() || bd.BlockMap != nil {
+		return fmt.Errorf("can not resume writing %s at offset %d",
+			bd.Path, bd.StartOffset)
+	}
+	if _, err := out.Seek(bd.StartOffset, io.SeekStart); err != nil {
+		return err
+	}
+	if bd.compare != nil {
+		bd.compare.skip(bd.StartOffset)
+	}
+	log.Infof("resuming writing partition %s at offset %d",
+		bd.Path, bd.StartOffset)
+	return nil
+}
+
+// newSparseWriter returns a writer which only writes the blocks mapped by
+// BlockMap to w, and moves past the holes in `out`.
+func (bd *BlockDevice) newSparseWriter(out BlockDeviceFile, w io.Writer) io.Writer {
+	discard := bd.DiscardHoles
+	compare := bd.compare
+	return newSparseWriter(w, bd.BlockMap, func(offset, length int64) error {
+		bd.holes += length
+		if discard {
+			err := out.Discard(uint64(offset), uint64(length))
 			if err != nil {
-				log.Errorf("Failed to write images size to UBI_IOCVOLUP: %v", err)
-				return 0, err
+				log.Warnf("failed to discard holes on %s, leaving them "+
+					"as they are: %v", bd.Path, err)
+				discard = false
 			}
-		} else {
-			wrappedOut = NewFlushingWriter(out, bd.FlushIntervalBytes)
 		}
+		if compare != nil {
+			compare.skip(length)
+			return nil
+		}
+		_, err := out.Seek(length, io.SeekCurrent)
+		return err
+	})
+}
 
-		size, err := BlockDeviceGetSizeOf(out)
+// Sync commits the data written so far to the underlying block device. It
+// does nothing unless the device is open for writing.
+func (bd *BlockDevice) Sync() error {
+	bd.lock.Lock()
+	defer bd.lock.Unlock()
+
+	if bd.mode != blockDeviceWriting || bd.mtd != nil {
+		return nil
+	}
+	return bd.syncOut()
+}
+
+// syncOut commits the data written to the device open for writing,
+// including the end of the data held back for direct I/O.
+func (bd *BlockDevice) syncOut() error {
+	if bd.direct != nil {
+		return bd.direct.Sync()
+	}
+	return bd.out.Sync()
+}
+
+// Read reads data from the underlying block device into `p`. Will
+// automatically open the device in a read mode. Otherwise, behaves like
+// io.Reader.
+func (bd *BlockDevice) Read(p []byte) (int, error) {
+	bd.lock.Lock()
+	defer bd.lock.Unlock()
+
+	if bd.mode == blockDeviceWriting {
+		return 0, &BlockDeviceModeError{Path: bd.Path, Op: "read", Mode: bd.mode.String()}
+	}
+
+	if bd.mode == blockDeviceClosed {
+		log.Infof("opening device %s for reading", bd.Path)
+		out, err := bd.open(os.O_RDONLY)
 		if err != nil {
-			log.Errorf("failed to read block device size: %v", err)
-			out.Close()
 			return 0, err
 		}
-		log.Infof("partition %s size: %v", bd.Path, size)
-
 		bd.out = out
-		bd.w = &utils.LimitedWriter{
-			W: wrappedOut,
-			N: size,
-		}
+		bd.mode = blockDeviceReading
 	}
 
-	w, err := bd.w.Write(p)
-	if err != nil {
-		log.Errorf("written %v out of %v bytes to partition %s: %v",
-			w, len(p), bd.Path, err)
-	}
-	return w, err
+	return bd.out.Read(p)
 }
 
 // Close closes underlying block device automatically syncing any unwritten
-// data. Othewise, behaves like io.Closer.
+// data. Othewise, behaves like io.Closer. The device is closed even if
+// syncing it fails, and the first error is returned.
 func (bd *BlockDevice) Close() error {
-	if bd.out != nil {
-		if err := bd.out.Sync(); err != nil {
+	bd.lock.Lock()
+	defer bd.lock.Unlock()
+
+	var err error
+	if bd.mtd != nil {
+		if err = bd.mtd.Close(); err != nil {
+			log.Errorf("failed to finish writing MTD device %s: %v", bd.Path, err)
+		}
+	} else if bd.mode == blockDeviceWriting {
+		if err = bd.syncOut(); err != nil {
 			log.Errorf("failed to fsync partition %s: %v", bd.Path, err)
-			return err
 		}
-		if err := bd.out.Close(); err != nil {
-			log.Errorf("failed to close partition %s: %v", bd.Path, err)
+	}
+	if bd.out != nil {
+		if cerr := bd.out.Close(); cerr != nil {
+			log.Errorf("failed to close partition %s: %v", bd.Path, cerr)
+			if err == nil && bd.mode == blockDeviceWriting {
+				err = cerr
+			}
 		}
-		bd.out = nil
-		bd.w = nil
 	}
+	if bd.compare != nil {
+		log.Infof("skipped writing %d of %d bytes to partition %s, "+
+			"as they were identical to its content",
+			bd.compare.skipped, bd.compare.total, bd.Path)
+	}
+	if bd.BlockMap != nil && bd.mode == blockDeviceWriting {
+		log.Infof("skipped writing %d bytes of holes to partition %s",
+			bd.holes, bd.Path)
+	}
+	bd.out = nil
+	bd.w = nil
+	bd.compare = nil
+	bd.mtd = nil
+	bd.direct = nil
+	bd.holes = 0
+	bd.mode = blockDeviceClosed
 
-	return nil
+	return err
+}
+
+// Discard tells the underlying block device that all of its content is no
+// longer in use. Automatically opens a new fd in O_WRONLY mode, and must not
+// be used while the device is being written.
+func (bd *BlockDevice) Discard() error {
+	out, err := bd.open(os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	size, err := out.Size()
+	if err != nil {
+		return err
+	}
+	log.Infof("discarding %d bytes of partition %s", size, bd.Path)
+	return out.Discard(0, size)
 }
 
 // Size queries the size of the underlying block device. Automatically opens a
 // new fd in O_RDONLY mode, thus can be used in parallel to other operations.
 func (bd *BlockDevice) Size() (uint64, error) {
-	out, err := os.OpenFile(bd.Path, os.O_RDONLY, 0)
+	out, err := bd.open(os.O_RDONLY)
 	if err != nil {
 		return 0, err
 	}
 	defer out.Close()
 
-	return BlockDeviceGetSizeOf(out)
+	return out.Size()
 }
 
 // SectorSize queries the logical sector size of the underlying block device. Automatically opens a
 // new fd in O_RDONLY mode, thus can be used in parallel to other operations.
 func (bd *BlockDevice) SectorSize() (int, error) {
-	out, err := os.OpenFile(bd.Path, os.O_RDONLY, 0)
+	out, err := bd.open(os.O_RDONLY)
 	if err != nil {
 		return 0, err
 	}
 	defer out.Close()
 
-	return BlockDeviceGetSectorSizeOf(out)
+	return out.SectorSize()
 }
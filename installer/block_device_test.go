@@ -17,9 +17,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"syscall"
 	"testing"
 
+	"github.com/mendersoftware/mender/system"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
@@ -106,6 +108,32 @@ func TestBlockDeviceWrite(t *testing.T) {
 	BlockDeviceGetSizeOf = old
 }
 
+func TestBlockDeviceWriteUBIFail(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-block-device-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	bdpath := path.Join(td, "ubi")
+	assert.NoError(t, createFile(bdpath))
+	old := BlockDeviceGetSizeOf
+	defer func() { BlockDeviceGetSizeOf = old }()
+	BlockDeviceGetSizeOf = makeBlockDeviceSize(t, 10, nil, bdpath)
+
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	assert.NoError(t, err)
+
+	// A regular file is not a UBI volume which can be updated.
+	bd := BlockDevice{Path: bdpath, typeUBI: true, ImageSize: 6}
+	_, err = bd.Write([]byte("foobar"))
+	assert.Error(t, err)
+
+	// The device is closed again.
+	after, err := ioutil.ReadDir("/proc/self/fd")
+	assert.NoError(t, err)
+	assert.Equal(t, len(fds), len(after))
+	assert.NoError(t, bd.Close())
+}
+
 func TestBlockDeviceSize(t *testing.T) {
 	td, err := ioutil.TempDir("", "mender-block-device-")
 	assert.NoError(t, err)
@@ -135,3 +163,114 @@ func TestBlockDeviceSize(t *testing.T) {
 
 	BlockDeviceGetSizeOf = old
 }
+
+func TestBlockDeviceReadWriteModes(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-block-device-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	bdpath := path.Join(td, "foo")
+	assert.NoError(t, ioutil.WriteFile(bdpath, []byte("foobar"), 0600))
+
+	old := BlockDeviceGetSizeOf
+	defer func() { BlockDeviceGetSizeOf = old }()
+	BlockDeviceGetSizeOf = makeBlockDeviceSize(t, 10, nil, bdpath)
+
+	bd := BlockDevice{Path: bdpath}
+	buf := make([]byte, 3)
+	n, err := bd.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(buf[:n]))
+
+	// Writing while open for reading.
+	n, err = bd.Write([]byte("baz"))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, &BlockDeviceModeError{Path: bdpath, Op: "write", Mode: "reading"}, err)
+	assert.EqualError(t, err, "can not write block device "+bdpath+
+		": it is open for reading, close it first")
+
+	// Reading continues where it left off.
+	n, err = bd.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", string(buf[:n]))
+	assert.NoError(t, bd.Close())
+
+	n, err = bd.Write([]byte("baz"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// Reading while open for writing.
+	_, err = bd.Read(buf)
+	assert.IsType(t, &BlockDeviceModeError{}, err)
+	assert.NoError(t, bd.Close())
+
+	data, err := ioutil.ReadAll(&bd)
+	assert.NoError(t, err)
+	assert.Equal(t, "bazbar", string(data))
+	assert.NoError(t, bd.Close())
+	assert.NoError(t, bd.Close())
+}
+
+func TestBlockDeviceConcurrentWrites(t *testing.T) {
+	td, err := ioutil.TempDir("", "mender-block-device-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	bdpath := path.Join(td, "foo")
+	assert.NoError(t, createFile(bdpath))
+
+	old := BlockDeviceGetSizeOf
+	defer func() { BlockDeviceGetSizeOf = old }()
+	BlockDeviceGetSizeOf = makeBlockDeviceSize(t, 1000, nil, bdpath)
+
+	bd := BlockDevice{Path: bdpath}
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for j := 0; j < 10; j++ {
+				_, err := bd.Write([]byte("0123456789"))
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	assert.NoError(t, bd.Close())
+
+	data, err := ioutil.ReadFile(bdpath)
+	assert.NoError(t, err)
+	assert.Len(t, data, 1000)
+}
+
+func TestBlockDeviceDiscard(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	old := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = old
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 16, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 512, nil }
+
+	part := path.Join(tdir, "inactivePart2")
+	assert.NoError(t, ioutil.WriteFile(part, []byte("old content"), 0600))
+
+	bd := &BlockDevice{Path: part}
+	assert.Equal(t, system.NotABlockDevice, bd.Discard())
+
+	// Failing to discard the partition does not fail the update.
+	testDevice := dualRootfsDeviceImpl{
+		partitions:   &partitions{inactive: part},
+		discardFirst: true,
+	}
+	err := testDevice.StoreUpdate(strings.NewReader("new"), &sizeOnlyFileInfo{3})
+	assert.NoError(t, err)
+	content, err := ioutil.ReadFile(part)
+	assert.NoError(t, err)
+	assert.Equal(t, "new content", string(content))
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Payload meta-data keys describing which blocks of the root file system image
+// hold data, like the block map (bmap) of bmaptool. Blocks outside of the
+// mapped ranges are holes, which are not written to the inactive partition.
+//
+// MetaDataRootfsImageMappedBlocks is a list of inclusive ranges of block
+// numbers, in ascending order, each either "first-last" or a single "block",
+// for instance ["0-1023", "1100", "2048-4095"].
+const (
+	MetaDataRootfsImageBlockSize    = "rootfs_image_block_size"
+	MetaDataRootfsImageMappedBlocks = "rootfs_image_mapped_blocks"
+)
+
+// blockRange is a range of the image, in bytes; end is exclusive.
+type blockRange struct {
+	start int64
+	end   int64
+}
+
+// blockMap holds the ranges of the root file system image which hold data.
+// The offsets are relative to the root file system image, also when it is
+// part of a full disk image.
+type blockMap struct {
+	blockSize int64
+	ranges    []blockRange
+}
+
+// blockMapFromMetaData returns the block map of the payload, or nil if the
+// payload does not have one.
+func blockMapFromMetaData(metaData map[string]interface{}) (*blockMap, error) {
+	_, hasBlockSize := metaData[MetaDataRootfsImageBlockSize]
+	mapped, hasMapped := metaData[MetaDataRootfsImageMappedBlocks]
+	if !hasBlockSize && !hasMapped {
+		return nil, nil
+	} else if !hasBlockSize || !hasMapped {
+		return nil, errors.Errorf("both %s and %s must be given in the payload meta-data",
+			MetaDataRootfsImageBlockSize, MetaDataRootfsImageMappedBlocks)
+	}
+
+	blockSize, err := metaDataInt(metaData, MetaDataRootfsImageBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	if blockSize <= 0 {
+		return nil, errors.Errorf("invalid block size in payload meta-data: %d",
+			blockSize)
+	}
+
+	list, ok := mapped.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("payload meta-data %s must be a list",
+			MetaDataRootfsImageMappedBlocks)
+	}
+	m := &blockMap{blockSize: blockSize}
+	for _, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, errors.Errorf("payload meta-data %s must be a list of strings",
+				MetaDataRootfsImageMappedBlocks)
+		}
+		first, last, err := parseBlockRange(s)
+		if err != nil {
+			return nil, err
+		}
+		r := blockRange{start: first * blockSize, end: (last + 1) * blockSize}
+		if n := len(m.ranges); n > 0 && r.start < m.ranges[n-1].end {
+			return nil, errors.Errorf("block ranges in payload meta-data %s "+
+				"must be in ascending order and not overlap: %q",
+				MetaDataRootfsImageMappedBlocks, s)
+		}
+		m.ranges = append(m.ranges, r)
+	}
+	return m, nil
+}
+
+func parseBlockRange(s string) (int64, int64, error) {
+	firstStr, lastStr := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		firstStr, lastStr = s[:i], s[i+1:]
+	}
+	first, err := strconv.ParseInt(strings.TrimSpace(firstStr), 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, errors.Errorf("invalid block range %q", s)
+	}
+	last, err := strconv.ParseInt(strings.TrimSpace(lastStr), 10, 64)
+	if err != nil || last < first {
+		return 0, 0, errors.Errorf("invalid block range %q", s)
+	}
+	return first, last, nil
+}
+
+// check verifies that the block map fits an image of the given size. Only the
+// last block may extend past the end of the image.
+func (m *blockMap) check(size int64) error {
+	if n := len(m.ranges); n > 0 && m.ranges[n-1].end-m.blockSize >= size {
+		return errors.Errorf("block map (%d bytes) exceeds the size of the "+
+			"root file system image (%d bytes)", m.ranges[n-1].end, size)
+	}
+	return nil
+}
+
+// mappedBytes returns how many bytes of an image of the given size are
+// mapped.
+func (m *blockMap) mappedBytes(size int64) int64 {
+	var mapped int64
+	for _, r := range m.ranges {
+		if r.end > size {
+			r.end = size
+		}
+		if r.end > r.start {
+			mapped += r.end - r.start
+		}
+	}
+	return mapped
+}
+
+// sparseWriter passes on only the mapped ranges of the image written to it.
+// skipHole, if set, is called for every hole instead, with its offset and
+// length, so that the underlying writer can move past it.
+type sparseWriter struct {
+	w        io.Writer
+	skipHole func(offset, length int64) error
+	ranges   []blockRange
+	offset   int64
+}
+
+func newSparseWriter(w io.Writer, m *blockMap,
+	skipHole func(offset, length int64) error) *sparseWriter {
+
+	return &sparseWriter{w: w, skipHole: skipHole, ranges: m.ranges}
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		for len(w.ranges) > 0 && w.ranges[0].end <= w.offset {
+			w.ranges = w.ranges[1:]
+		}
+
+		if len(w.ranges) == 0 || w.offset < w.ranges[0].start {
+			n := int64(len(p))
+			if len(w.ranges) > 0 && w.ranges[0].start-w.offset < n {
+				n = w.ranges[0].start - w.offset
+			}
+			if w.skipHole != nil {
+				if err := w.skipHole(w.offset, n); err != nil {
+					return written, err
+				}
+			}
+			written += int(n)
+			w.offset += n
+			p = p[n:]
+			continue
+		}
+
+		n := int64(len(p))
+		if w.ranges[0].end-w.offset < n {
+			n = w.ranges[0].end - w.offset
+		}
+		m, err := w.w.Write(p[:n])
+		written += m
+		w.offset += int64(m)
+		if err != nil {
+			return written, err
+		} else if int64(m) != n {
+			return written, io.ErrShortWrite
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockMapFromMetaData(t *testing.T) {
+	m, err := blockMapFromMetaData(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+
+	m, err = blockMapFromMetaData(map[string]interface{}{
+		MetaDataRootfsImageBlockSize:    float64(4096),
+		MetaDataRootfsImageMappedBlocks: []interface{}{"0-1", "5", "8-9"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &blockMap{
+		blockSize: 4096,
+		ranges: []blockRange{
+			{start: 0, end: 8192},
+			{start: 20480, end: 24576},
+			{start: 32768, end: 40960},
+		},
+	}, m)
+
+	for _, metaData := range []map[string]interface{}{
+		{MetaDataRootfsImageBlockSize: float64(4096)},
+		{MetaDataRootfsImageMappedBlocks: []interface{}{"0"}},
+		{MetaDataRootfsImageBlockSize: float64(0), MetaDataRootfsImageMappedBlocks: []interface{}{"0"}},
+		{MetaDataRootfsImageBlockSize: float64(4096), MetaDataRootfsImageMappedBlocks: "0-1"},
+		{MetaDataRootfsImageBlockSize: float64(4096), MetaDataRootfsImageMappedBlocks: []interface{}{float64(1)}},
+		{MetaDataRootfsImageBlockSize: float64(4096), MetaDataRootfsImageMappedBlocks: []interface{}{"2-1"}},
+		{MetaDataRootfsImageBlockSize: float64(4096), MetaDataRootfsImageMappedBlocks: []interface{}{"-1"}},
+		{MetaDataRootfsImageBlockSize: float64(4096), MetaDataRootfsImageMappedBlocks: []interface{}{"a-b"}},
+		{MetaDataRootfsImageBlockSize: float64(4096), MetaDataRootfsImageMappedBlocks: []interface{}{"4-5", "5-6"}},
+		{MetaDataRootfsImageBlockSize: float64(4096), MetaDataRootfsImageMappedBlocks: []interface{}{"4", "2"}},
+	} {
+		_, err = blockMapFromMetaData(metaData)
+		assert.Error(t, err, "%v", metaData)
+	}
+}
+
+func TestBlockMapFromArtifact(t *testing.T) {
+	art, err := makeRootfsImageArtifactWithMetaData(map[string]interface{}{
+		MetaDataRootfsImageBlockSize:    4096,
+		MetaDataRootfsImageMappedBlocks: []string{"0-1", "5"},
+	})
+	require.NoError(t, err)
+	payload, err := readRootfsImageArtifactHeaders(art)
+	require.NoError(t, err)
+
+	var d dualRootfsDeviceImpl
+	require.NoError(t, d.Initialize(nil, nil, payload))
+	assert.Equal(t, &blockMap{
+		blockSize: 4096,
+		ranges: []blockRange{
+			{start: 0, end: 8192},
+			{start: 20480, end: 24576},
+		},
+	}, d.blockMap)
+}
+
+func TestBlockMapCheck(t *testing.T) {
+	m := &blockMap{blockSize: 4, ranges: []blockRange{{0, 4}, {8, 16}}}
+	assert.NoError(t, m.check(16))
+	// The last block may be partial.
+	assert.NoError(t, m.check(13))
+	assert.Error(t, m.check(12))
+	assert.Equal(t, int64(9), m.mappedBytes(13))
+}
+
+func TestSparseWriter(t *testing.T) {
+	m := &blockMap{blockSize: 4, ranges: []blockRange{{4, 8}, {12, 20}}}
+	var out bytes.Buffer
+	var holes [][2]int64
+	w := newSparseWriter(&out, m, func(offset, length int64) error {
+		holes = append(holes, [2]int64{offset, length})
+		return nil
+	})
+
+	// Writes are split at the edges of the ranges, wherever they are.
+	for _, p := range []string{"hhhhdd", "ddhhhhDDDDDDD", "Dhhh"} {
+		n, err := w.Write([]byte(p))
+		assert.NoError(t, err)
+		assert.Equal(t, len(p), n)
+	}
+	assert.Equal(t, "ddddDDDDDDDD", out.String())
+	assert.Equal(t, [][2]int64{{0, 4}, {8, 4}, {20, 3}}, holes)
+}
+
+func TestStoreUpdateBlockMap(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	old := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = old
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 16, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 4, nil }
+
+	image := "AAAA\x00\x00\x00\x00CCCC\x00\x00"
+	m := &blockMap{blockSize: 4, ranges: []blockRange{{0, 4}, {8, 12}}}
+
+	for _, skipIdentical := range []bool{false, true} {
+		part := path.Join(tdir, "inactivePart2")
+		require.NoError(t, ioutil.WriteFile(part, []byte("oooooooooooooooo"), 0600))
+
+		env := &fakeBootEnv{}
+		testDevice := dualRootfsDeviceImpl{
+			BootEnvReadWriter: env,
+			partitions:        &partitions{inactive: part},
+			blockMap:          m,
+			skipIdentical:     skipIdentical,
+			verifyWrite:       true,
+			writeBufferSize:   4,
+		}
+
+		err := testDevice.StoreUpdate(strings.NewReader(image),
+			&sizeOnlyFileInfo{int64(len(image))})
+		require.NoError(t, err)
+
+		// The holes are left as they were.
+		content, err := ioutil.ReadFile(part)
+		require.NoError(t, err)
+		assert.Equal(t, "AAAAooooCCCCoooo", string(content), "%v", skipIdentical)
+
+		// Only the mapped blocks are verified.
+		assert.NoError(t, testDevice.InstallUpdate())
+		assert.Equal(t, "2", env.writeVars["mender_boot_part"])
+	}
+
+	// The block map must fit the image.
+	testDevice := dualRootfsDeviceImpl{
+		partitions: &partitions{inactive: path.Join(tdir, "inactivePart2")},
+		blockMap:   &blockMap{blockSize: 4, ranges: []blockRange{{16, 20}}},
+	}
+	err := testDevice.StoreUpdate(strings.NewReader(image),
+		&sizeOnlyFileInfo{int64(len(image))})
+	assert.Error(t, err)
+}
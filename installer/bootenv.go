@@ -36,6 +36,13 @@ type BootEnvReadWriter interface {
 	WriteEnv(BootVars) error
 }
 
+// RebootArgumentProvider is implemented by boot environments which must pass
+// an argument to the firmware on the reboot into a new update, such as
+// "0 tryboot" on the Raspberry Pi.
+type RebootArgumentProvider interface {
+	RebootArgument() (string, error)
+}
+
 func NewEnvironment(cmd system.Commander) *UBootEnv {
 	env := UBootEnv{cmd}
 	return &env
@@ -0,0 +1,144 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+// ErrInsufficientSpace is returned when the artifact can not fit where its
+// payload is stored, so that downloading it would never succeed.
+var ErrInsufficientSpace = errors.New("not enough space for the artifact")
+
+// The artifact headers and the compression overhead of incompressible
+// payloads are allowed for, so that the payload of an artifact is never
+// wrongly found too large: it is only if the artifact exceeds the capacity by
+// more than 1% plus this many bytes.
+const capacitySlack = 1024 * 1024
+
+// CapacityChecker is implemented by the payload installers which can tell,
+// once the artifact headers are read, whether the payload can fit the
+// device.
+type CapacityChecker interface {
+	// CheckCapacity returns an error wrapping ErrInsufficientSpace if the
+	// payload of an artifact of the given size can not fit the device.
+	CheckCapacity(artifactSize int64) error
+}
+
+// CheckCapacity checks, before the payload is downloaded, that an artifact of
+// the given size can fit the device. The payload is at least about as large
+// as the compressed artifact, so this only fails artifacts which could never
+// be installed. Artifacts with several payloads, and artifacts of unknown
+// size, are not checked, since the size of each payload is not known.
+func CheckCapacity(installers []PayloadUpdatePerformer, artifactSize int64) error {
+	if artifactSize <= 0 || len(installers) != 1 {
+		return nil
+	}
+	if checker, ok := installers[0].(CapacityChecker); ok {
+		return checker.CheckCapacity(artifactSize)
+	}
+	return nil
+}
+
+func exceedsCapacity(artifactSize int64, capacity uint64) bool {
+	return uint64(artifactSize) > capacity+capacity/100+capacitySlack
+}
+
+// CheckCapacity checks that the payload fits the inactive partition, and its
+// dm-verity hash partition if any. Disk images are not checked, since only a
+// region of them is written, nor are UBI volumes which are resized to fit.
+func (d *dualRootfsDeviceImpl) CheckCapacity(artifactSize int64) error {
+	if d.region != nil {
+		return nil
+	}
+	inactivePartition, err := d.GetInactive()
+	if err != nil {
+		return err
+	}
+	partitions := []string{inactivePartition}
+	if d.verity != nil {
+		hashPartition, err := d.verityHashPartition(inactivePartition)
+		if err != nil {
+			return err
+		}
+		partitions = append(partitions, hashPartition)
+	}
+
+	var capacity uint64
+	for _, part := range partitions {
+		if system.IsUbiBlockDevice(part) {
+			if d.ubiAutoResize {
+				return nil
+			}
+			part = filepath.Join("/dev", part)
+		}
+		size, err := (&BlockDevice{Path: part}).Size()
+		if err != nil {
+			// Whether the payload fits is found out when it is
+			// written.
+			log.Warnf("Could not read the size of %s to check that the "+
+				"update fits it: %v", part, err)
+			return nil
+		}
+		capacity += size
+	}
+	if exceedsCapacity(artifactSize, capacity) {
+		return errors.Wrapf(ErrInsufficientSpace,
+			"artifact (%d bytes) is larger than partition %s (%d bytes)",
+			artifactSize, inactivePartition, capacity)
+	}
+	return nil
+}
+
+// CheckCapacity checks that the payload files fit the free space of the work
+// directory, where they are stored until installed.
+func (d *DirectoryInstaller) CheckCapacity(artifactSize int64) error {
+	return checkFreeSpace(d.workPath, artifactSize)
+}
+
+// CheckCapacity checks that the payload files fit the free space of the work
+// directory, where they are stored until installed.
+func (c *ContainerInstaller) CheckCapacity(artifactSize int64) error {
+	return checkFreeSpace(c.workPath, artifactSize)
+}
+
+func checkFreeSpace(dir string, artifactSize int64) error {
+	// The directory may not be created yet; its file system is that of
+	// its closest existing parent.
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		log.Warnf("Could not read the free space of %s to check that the "+
+			"update fits it: %v", dir, err)
+		return nil
+	}
+	free := uint64(fs.Bavail) * uint64(fs.Bsize)
+	if exceedsCapacity(artifactSize, free) {
+		return errors.Wrapf(ErrInsufficientSpace,
+			"artifact (%d bytes) is larger than the free space of %s (%d bytes)",
+			artifactSize, dir, free)
+	}
+	return nil
+}
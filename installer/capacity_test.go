@@ -0,0 +1,88 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCapacityDualRootfs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "capacity")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	var parts []string
+	for _, name := range []string{"rootfs2", "rootfs3", "hash2", "hash3"} {
+		parts = append(parts, path.Join(tmp, name))
+		require.NoError(t, ioutil.WriteFile(parts[len(parts)-1], nil, 0600))
+	}
+
+	old := BlockDeviceGetSizeOf
+	defer func() { BlockDeviceGetSizeOf = old }()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 100 << 20, nil }
+
+	dev := &dualRootfsDeviceImpl{
+		partitions: &partitions{rootfsParts: parts[:2], inactive: parts[1]},
+	}
+	installers := []PayloadUpdatePerformer{dev}
+	assert.NoError(t, CheckCapacity(installers, 100<<20))
+	assert.NoError(t, CheckCapacity(installers, 101<<20))
+	err = CheckCapacity(installers, 110<<20)
+	assert.Equal(t, ErrInsufficientSpace, errors.Cause(err))
+	assert.Contains(t, err.Error(), parts[1])
+
+	// Unknown sizes and several payloads are not checked.
+	assert.NoError(t, CheckCapacity(installers, -1))
+	assert.NoError(t, CheckCapacity([]PayloadUpdatePerformer{dev, dev}, 110<<20))
+
+	// The hash tree is written to the hash partition.
+	dev.verity = &verityImage{hashOffset: 1}
+	dev.verityHashParts = parts[2:]
+	assert.NoError(t, CheckCapacity(installers, 110<<20))
+	dev.verity = nil
+
+	// Only a region of disk images is written.
+	dev.region = &diskImageRegion{offset: 1 << 20, length: 100 << 20}
+	assert.NoError(t, CheckCapacity(installers, 110<<20))
+	dev.region = nil
+
+	// Whether the payload fits is found out when it is written.
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) {
+		return 0, errors.New("no size")
+	}
+	assert.NoError(t, CheckCapacity(installers, 110<<20))
+}
+
+func TestCheckCapacityWorkDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "capacity")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	factory := NewDirectoryInstallerFactory(path.Join(tmp, "not", "created"))
+	storer, err := factory.NewUpdateStorer("directory", 0)
+	require.NoError(t, err)
+	installers := []PayloadUpdatePerformer{storer.(PayloadUpdatePerformer)}
+
+	assert.NoError(t, CheckCapacity(installers, 1024))
+	err = CheckCapacity(installers, 1<<62)
+	assert.Equal(t, ErrInsufficientSpace, errors.Cause(err))
+	assert.Contains(t, err.Error(), tmp)
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"io"
+)
+
+// Size of the blocks compared by compareWriter, unless the sector size is
+// larger.
+const compareBlockSize = 4096
+
+// compareWriter writes to a file only the blocks which differ from what the
+// file already holds. Updates of the root file system often share large
+// regions with the previous one, so this spares the flash storage a lot of
+// writes.
+type compareWriter struct {
+	file      compareFile
+	blockSize int
+	offset    int64
+	buf       []byte
+
+	// Statistics, logged when the device is closed.
+	total   int64
+	skipped int64
+}
+
+// compareFile is the device compareWriter reads and writes.
+type compareFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+}
+
+func newCompareWriter(file compareFile, sectorSize int) *compareWriter {
+	blockSize := sectorSize
+	for blockSize < compareBlockSize {
+		blockSize *= 2
+	}
+	return &compareWriter{file: file, blockSize: blockSize}
+}
+
+func (w *compareWriter) Write(p []byte) (int, error) {
+	if len(w.buf) < len(p) {
+		w.buf = make([]byte, len(p))
+	}
+	current := w.buf[:len(p)]
+	n, err := w.file.ReadAt(current, w.offset)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	// Write each run of consecutive blocks which differ.
+	runStart := -1
+	for start := 0; start < len(p); start += w.blockSize {
+		end := start + w.blockSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if end <= n && bytes.Equal(p[start:end], current[start:end]) {
+			w.skipped += int64(end - start)
+			if runStart >= 0 {
+				if err := w.writeRun(p, runStart, start); err != nil {
+					return 0, err
+				}
+				runStart = -1
+			}
+		} else if runStart < 0 {
+			runStart = start
+		}
+	}
+	if runStart >= 0 {
+		if err := w.writeRun(p, runStart, len(p)); err != nil {
+			return 0, err
+		}
+	}
+
+	w.offset += int64(len(p))
+	w.total += int64(len(p))
+	return len(p), nil
+}
+
+// writeRun writes p[start:end] at its place in the file. As it is not known
+// how much of p was written when it fails, nothing is reported as written.
+func (w *compareWriter) writeRun(p []byte, start, end int) error {
+	_, err := w.file.WriteAt(p[start:end], w.offset+int64(start))
+	return err
+}
+
+// skip moves past n bytes of the file without writing them.
+func (w *compareWriter) skip(n int64) {
+	w.offset += n
+}
+
+func (w *compareWriter) Sync() error {
+	return w.file.Sync()
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "compareWriter")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// The partition holds the old image; the new image differs in the
+	// second block, the end of the fourth block and is longer.
+	old := bytes.Repeat([]byte{'a'}, 4*4096+100)
+	_, err = f.Write(old)
+	require.NoError(t, err)
+
+	image := bytes.Repeat([]byte{'a'}, 5*4096+10)
+	image[4096] = 'b'
+	image[4*4096-1] = 'c'
+
+	w := newCompareWriter(f, 512)
+	assert.Equal(t, 4096, w.blockSize)
+	n, err := chunkedCopy(w, bytes.NewReader(image), 3*4096)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(image)), n)
+
+	content, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, image, content)
+	assert.Equal(t, int64(len(image)), w.total)
+	// The first and third blocks are identical.
+	assert.Equal(t, int64(2*4096), w.skipped)
+}
+
+func TestBlockDeviceSkipIdentical(t *testing.T) {
+	f, err := ioutil.TempFile("", "inactivePart")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	old := bytes.Repeat([]byte("old image "), 2000)
+	_, err = f.Write(old)
+	require.NoError(t, err)
+	f.Close()
+
+	oldSize := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = oldSize
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 1024 * 1024, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 512, nil }
+
+	image := append([]byte{}, old...)
+	copy(image[10000:], "new image")
+	bd := &BlockDevice{
+		Path:               f.Name(),
+		ImageSize:          int64(len(image)),
+		FlushIntervalBytes: 4096,
+		SkipIdentical:      true,
+		DirectIO:           true,
+	}
+	_, err = chunkedCopy(bd, bytes.NewReader(image), 8192)
+	assert.NoError(t, err)
+	require.NotNil(t, bd.compare)
+	assert.Equal(t, int64(len(image)-4096), bd.compare.skipped)
+	assert.NoError(t, bd.Close())
+	assert.Nil(t, bd.compare)
+
+	content, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, image, content)
+}
@@ -0,0 +1,246 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// +build zstd,cgo
+
+package installer
+
+/*
+#cgo LDFLAGS: -lzstd
+#include <zstd.h>
+
+static size_t go_zstd_decompress(ZSTD_DStream *ds,
+	void *dst, size_t dst_size, size_t *dst_pos,
+	const void *src, size_t src_size, size_t *src_pos)
+{
+	ZSTD_outBuffer out = { dst, dst_size, 0 };
+	ZSTD_inBuffer in = { src, src_size, 0 };
+	size_t ret = ZSTD_decompressStream(ds, &out, &in);
+	*dst_pos = out.pos;
+	*src_pos = in.pos;
+	return ret;
+}
+
+static size_t go_zstd_compress(ZSTD_CCtx *cs,
+	void *dst, size_t dst_size, size_t *dst_pos,
+	const void *src, size_t src_size, size_t *src_pos,
+	ZSTD_EndDirective end)
+{
+	ZSTD_outBuffer out = { dst, dst_size, 0 };
+	ZSTD_inBuffer in = { src, src_size, 0 };
+	size_t ret = ZSTD_compressStream2(cs, &out, &in, end);
+	*dst_pos = out.pos;
+	*src_pos = in.pos;
+	return ret;
+}
+*/
+import "C"
+
+import (
+	"io"
+	"unsafe"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+// Payloads compressed with Zstandard, in data/0000.tar.zst, are decompressed
+// while they are streamed to the device. The reader picks the decompressor
+// from the name of the payload file, so registering the compressor is all it
+// takes.
+func init() {
+	artifact.RegisterCompressor("zstd", &compressorZstd{})
+}
+
+type compressorZstd struct{}
+
+func (c *compressorZstd) GetFileExtension() string {
+	return ".zst"
+}
+
+func (c *compressorZstd) NewReader(r io.Reader) (io.ReadCloser, error) {
+	ds := C.ZSTD_createDStream()
+	if ds == nil {
+		return nil, errors.New("failed to create the zstd decompressor")
+	}
+	if ret := C.ZSTD_initDStream(ds); C.ZSTD_isError(ret) != 0 {
+		C.ZSTD_freeDStream(ds)
+		return nil, zstdError(ret)
+	}
+	return &zstdReader{
+		ds:  ds,
+		r:   r,
+		in:  make([]byte, C.ZSTD_DStreamInSize()),
+		out: make([]byte, C.ZSTD_DStreamOutSize()),
+	}, nil
+}
+
+func (c *compressorZstd) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	cs := C.ZSTD_createCCtx()
+	if cs == nil {
+		return nil, errors.New("failed to create the zstd compressor")
+	}
+	return &zstdWriter{
+		cs:  cs,
+		w:   w,
+		in:  make([]byte, C.ZSTD_CStreamInSize()),
+		out: make([]byte, C.ZSTD_CStreamOutSize()),
+	}, nil
+}
+
+func zstdError(ret C.size_t) error {
+	return errors.Errorf("zstd: %s", C.GoString(C.ZSTD_getErrorName(ret)))
+}
+
+// The buffers handed to C are the reader's and writer's own, since those of
+// their callers may be part of structures holding Go pointers, which cgo
+// forbids.
+type zstdReader struct {
+	ds *C.ZSTD_DStream
+	r  io.Reader
+
+	in           []byte
+	inOff, inLen int
+	eof          bool
+
+	out            []byte
+	outOff, outLen int
+
+	// Whether the last frame read was completed, so that a truncated
+	// stream is not taken for a complete one.
+	frameDone bool
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	if z.ds == nil {
+		return 0, errors.New("zstd: read from closed reader")
+	}
+	for z.outOff == z.outLen {
+		if err := z.decompress(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, z.out[z.outOff:z.outLen])
+	z.outOff += n
+	return n, nil
+}
+
+// decompress decompresses what it can of the input into the output buffer,
+// reading more input if it is all consumed.
+func (z *zstdReader) decompress() error {
+	if z.inOff == z.inLen && !z.eof {
+		n, err := z.r.Read(z.in)
+		z.inOff, z.inLen = 0, n
+		if err == io.EOF {
+			z.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	var src unsafe.Pointer
+	if z.inOff < z.inLen {
+		src = unsafe.Pointer(&z.in[z.inOff])
+	}
+	var dstPos, srcPos C.size_t
+	ret := C.go_zstd_decompress(z.ds,
+		unsafe.Pointer(&z.out[0]), C.size_t(len(z.out)), &dstPos,
+		src, C.size_t(z.inLen-z.inOff), &srcPos)
+	if C.ZSTD_isError(ret) != 0 {
+		return zstdError(ret)
+	}
+	z.inOff += int(srcPos)
+	z.outOff, z.outLen = 0, int(dstPos)
+	if srcPos > 0 || dstPos > 0 {
+		z.frameDone = ret == 0
+	} else if z.eof {
+		if !z.frameDone {
+			return io.ErrUnexpectedEOF
+		}
+		return io.EOF
+	}
+	return nil
+}
+
+// Close frees the decompressor. It does not close the underlying reader.
+func (z *zstdReader) Close() error {
+	if z.ds != nil {
+		C.ZSTD_freeDStream(z.ds)
+		z.ds = nil
+	}
+	return nil
+}
+
+type zstdWriter struct {
+	cs      *C.ZSTD_CCtx
+	w       io.Writer
+	in, out []byte
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.cs == nil {
+		return 0, errors.New("zstd: write to closed writer")
+	}
+	written := 0
+	for written < len(p) {
+		n := copy(z.in, p[written:])
+		for in := z.in[:n]; len(in) > 0; {
+			_, consumed, err := z.compress(in, C.ZSTD_e_continue)
+			if err != nil {
+				return written, err
+			}
+			in = in[consumed:]
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close flushes the end of the stream, and frees the compressor. It does not
+// close the underlying writer.
+func (z *zstdWriter) Close() error {
+	if z.cs == nil {
+		return nil
+	}
+	defer func() {
+		C.ZSTD_freeCCtx(z.cs)
+		z.cs = nil
+	}()
+	for {
+		remaining, _, err := z.compress(nil, C.ZSTD_e_end)
+		if err != nil || remaining == 0 {
+			return err
+		}
+	}
+}
+
+// compress compresses what it can of p, writing the output to the underlying
+// writer. It returns how many bytes are left to flush, and how many bytes of p
+// were consumed.
+func (z *zstdWriter) compress(p []byte, end C.ZSTD_EndDirective) (int, int, error) {
+	var src unsafe.Pointer
+	if len(p) > 0 {
+		src = unsafe.Pointer(&p[0])
+	}
+	var dstPos, srcPos C.size_t
+	ret := C.go_zstd_compress(z.cs,
+		unsafe.Pointer(&z.out[0]), C.size_t(len(z.out)), &dstPos,
+		src, C.size_t(len(p)), &srcPos, end)
+	if C.ZSTD_isError(ret) != 0 {
+		return 0, int(srcPos), zstdError(ret)
+	}
+	if _, err := z.w.Write(z.out[:dstPos]); err != nil {
+		return 0, int(srcPos), err
+	}
+	return int(ret), int(srcPos), nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// +build zstd,cgo
+
+package installer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressorZstd(t *testing.T) {
+	comp, err := artifact.NewCompressorFromFileName("data/0000.tar.zst")
+	require.NoError(t, err)
+	require.IsType(t, &compressorZstd{}, comp)
+
+	random := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+	for name, data := range map[string][]byte{
+		"empty":        nil,
+		"compressible": bytes.Repeat([]byte("mender "), 1<<20),
+		"random":       random,
+	} {
+		t.Run(name, func(t *testing.T) {
+			compressed := bytes.NewBuffer(nil)
+			w, err := comp.NewWriter(compressed)
+			require.NoError(t, err)
+			_, err = w.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			// The stream is decompressed however it is read.
+			r, err := comp.NewReader(iotest.OneByteReader(
+				bytes.NewReader(compressed.Bytes())))
+			require.NoError(t, err)
+			out, err := ioutil.ReadAll(iotest.HalfReader(r))
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			assert.True(t, bytes.Equal(data, out))
+
+			// Truncated streams are not taken for complete ones.
+			r, err = comp.NewReader(bytes.NewReader(
+				compressed.Bytes()[:compressed.Len()-1]))
+			require.NoError(t, err)
+			_, err = ioutil.ReadAll(r)
+			assert.Equal(t, io.ErrUnexpectedEOF, err)
+			r.Close()
+		})
+	}
+
+	r, err := comp.NewReader(bytes.NewBufferString("not zstd"))
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+}
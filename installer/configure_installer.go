@@ -0,0 +1,337 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+// ConfigurePayloadType is the payload type of the built-in configuration
+// installer, which applies the key/value configuration in the meta-data of
+// the payload to the device, the same way as the "mender-configure" update
+// module, which takes precedence over it if installed.
+const ConfigurePayloadType = "mender-configure"
+
+// Where the configuration of the device is kept, and the scripts applying it,
+// unless configured otherwise; the same as those of mender-configure.
+const (
+	DefaultConfigureDeviceConfigFile = "/var/lib/mender-configure/device-config.json"
+	DefaultConfigureApplyScriptsDir  = "/usr/lib/mender-configure/apply-device-config.d"
+)
+
+// The files of the work path which keep the update between the states,
+// which may run in different processes: the configuration of the update, and
+// the configuration it replaces.
+const (
+	configureUpdateFile   = "config.json"
+	configurePreviousFile = "previous-config.json"
+	// Marks that there was no configuration before the update.
+	configureNoPreviousMarker = "no-previous"
+)
+
+type ConfigureInstallerFactory struct {
+	system.Commander
+	workPath         string
+	deviceConfigFile string
+	applyScriptsDir  string
+}
+
+func NewConfigureInstallerFactory(workPath, deviceConfigFile,
+	applyScriptsDir string) *ConfigureInstallerFactory {
+
+	if deviceConfigFile == "" {
+		deviceConfigFile = DefaultConfigureDeviceConfigFile
+	}
+	if applyScriptsDir == "" {
+		applyScriptsDir = DefaultConfigureApplyScriptsDir
+	}
+	return &ConfigureInstallerFactory{
+		Commander:        system.OsCalls{},
+		workPath:         workPath,
+		deviceConfigFile: deviceConfigFile,
+		applyScriptsDir:  applyScriptsDir,
+	}
+}
+
+func (f *ConfigureInstallerFactory) NewUpdateStorer(updateType string,
+	payloadNum int) (handlers.UpdateStorer, error) {
+
+	if payloadNum < 0 || payloadNum > 9999 {
+		return nil, fmt.Errorf("Payload index out of range 0-9999: %d", payloadNum)
+	}
+	return &ConfigureInstaller{
+		Commander:        f.Commander,
+		updateType:       updateType,
+		deviceConfigFile: f.deviceConfigFile,
+		applyScriptsDir:  f.applyScriptsDir,
+		workPath: filepath.Join(f.workPath, "payloads",
+			fmt.Sprintf("%04d", payloadNum), "configure"),
+	}, nil
+}
+
+// ReadDeviceConfig returns the configuration applied to the device, which is
+// empty if none has been.
+func ReadDeviceConfig(deviceConfigFile string) (map[string]string, error) {
+	if deviceConfigFile == "" {
+		deviceConfigFile = DefaultConfigureDeviceConfigFile
+	}
+	data, err := ioutil.ReadFile(deviceConfigFile)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var config map[string]string
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(err, "invalid device configuration %s", deviceConfigFile)
+	}
+	return config, nil
+}
+
+// configureUpdateFromMetaData returns the configuration in the meta-data of
+// the payload, all the values of which must be strings.
+func configureUpdateFromMetaData(metaData map[string]interface{}) (map[string]string, error) {
+	config := make(map[string]string, len(metaData))
+	for key, value := range metaData {
+		str, ok := value.(string)
+		if !ok {
+			return nil, errors.Errorf("the value of the configuration key %q "+
+				"is not a string", key)
+		}
+		config[key] = str
+	}
+	return config, nil
+}
+
+// ConfigureInstaller writes the configuration of the payload to the device
+// configuration file, and runs the apply scripts with it, in the order of
+// their names. The configuration it replaces is kept until the update is
+// committed, so that it can be rolled back and applied again.
+type ConfigureInstaller struct {
+	system.Commander
+	updateType       string
+	deviceConfigFile string
+	applyScriptsDir  string
+	workPath         string
+}
+
+func (c *ConfigureInstaller) Initialize(artifactHeaders,
+	artifactAugmentedHeaders artifact.HeaderInfoer,
+	payloadHeaders handlers.ArtifactUpdateHeaders) error {
+
+	if err := MissingFeaturesCheck(artifactAugmentedHeaders, payloadHeaders); err != nil {
+		return err
+	}
+
+	metaData, err := payloadHeaders.GetUpdateMetaData()
+	if err != nil {
+		return err
+	}
+	config, err := configureUpdateFromMetaData(metaData)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(c.workPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.workPath, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.workPath, configureUpdateFile), data, 0600)
+}
+
+func (c *ConfigureInstaller) PrepareStoreUpdate() error {
+	return nil
+}
+
+func (c *ConfigureInstaller) StoreUpdate(r io.Reader, info os.FileInfo) error {
+	return errors.Errorf("unexpected file %q in %s payload; the configuration "+
+		"is given by the meta-data", info.Name(), c.updateType)
+}
+
+func (c *ConfigureInstaller) FinishStoreUpdate() error {
+	return nil
+}
+
+func (c *ConfigureInstaller) InstallUpdate() error {
+	data, err := ioutil.ReadFile(filepath.Join(c.workPath, configureUpdateFile))
+	if err != nil {
+		return errors.Wrap(err, "failed to read the configuration update")
+	}
+
+	// Kept once, so that installing again after an interruption does not
+	// lose the configuration to roll back to.
+	previous := filepath.Join(c.workPath, configurePreviousFile)
+	noPrevious := filepath.Join(c.workPath, configureNoPreviousMarker)
+	if _, err := os.Stat(previous); os.IsNotExist(err) {
+		if _, err := os.Stat(noPrevious); os.IsNotExist(err) {
+			if err := c.keepPrevious(previous, noPrevious); err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := c.applyConfig(data); err != nil {
+		return err
+	}
+	log.Infof("Applied the configuration of the %s payload", c.updateType)
+	return nil
+}
+
+func (c *ConfigureInstaller) keepPrevious(previous, noPrevious string) error {
+	data, err := ioutil.ReadFile(c.deviceConfigFile)
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(noPrevious, nil, 0600)
+	} else if err != nil {
+		return err
+	}
+	return writeFileSync(previous, data)
+}
+
+// applyConfig writes the configuration to the device configuration file, and
+// runs the apply scripts.
+func (c *ConfigureInstaller) applyConfig(data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(c.deviceConfigFile), 0755); err != nil {
+		return err
+	}
+	tmp := c.deviceConfigFile + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.deviceConfigFile); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(c.deviceConfigFile))
+	return c.runApplyScripts()
+}
+
+func (c *ConfigureInstaller) runApplyScripts() error {
+	entries, err := ioutil.ReadDir(c.applyScriptsDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		script := filepath.Join(c.applyScriptsDir, entry.Name())
+		output, err := c.Command(script, c.deviceConfigFile).CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "apply script %s failed: %s", script,
+				strings.TrimSpace(string(output)))
+		}
+		log.Debugf("Apply script %s: %s", script, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (c *ConfigureInstaller) NeedsReboot() (RebootAction, error) {
+	return NoReboot, nil
+}
+
+func (c *ConfigureInstaller) Reboot() error {
+	return nil
+}
+
+func (c *ConfigureInstaller) SupportsRollback() (bool, error) {
+	return true, nil
+}
+
+func (c *ConfigureInstaller) CommitUpdate() error {
+	return nil
+}
+
+func (c *ConfigureInstaller) Rollback() error {
+	data, err := ioutil.ReadFile(filepath.Join(c.workPath, configurePreviousFile))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(c.workPath,
+			configureNoPreviousMarker)); os.IsNotExist(err) {
+			// The configuration was never changed.
+			return nil
+		}
+		// There was no configuration before the update, so an
+		// empty one is applied.
+		data = []byte("{}")
+	} else if err != nil {
+		return err
+	}
+
+	if err := c.applyConfig(data); err != nil {
+		return err
+	}
+	log.Info("Applied the previous configuration again")
+	return nil
+}
+
+func (c *ConfigureInstaller) VerifyReboot() error {
+	return nil
+}
+
+func (c *ConfigureInstaller) RollbackReboot() error {
+	return nil
+}
+
+func (c *ConfigureInstaller) VerifyRollbackReboot() error {
+	return nil
+}
+
+func (c *ConfigureInstaller) Failure() error {
+	return nil
+}
+
+func (c *ConfigureInstaller) Cleanup() error {
+	return os.RemoveAll(c.workPath)
+}
+
+func (c *ConfigureInstaller) GetType() string {
+	return c.updateType
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConfigureInstaller(t *testing.T, tmpdir string,
+	metaData map[string]interface{}) *ConfigureInstaller {
+
+	factory := NewConfigureInstallerFactory(filepath.Join(tmpdir, "work"),
+		filepath.Join(tmpdir, "config", "device-config.json"),
+		filepath.Join(tmpdir, "apply.d"))
+	storer, err := factory.NewUpdateStorer(ConfigurePayloadType, 0)
+	require.NoError(t, err)
+	c := storer.(*ConfigureInstaller)
+
+	require.NoError(t, c.Initialize(nil, nil, &testContainerInfo{metaData: metaData}))
+	require.NoError(t, c.PrepareStoreUpdate())
+	require.NoError(t, c.FinishStoreUpdate())
+	return c
+}
+
+func TestConfigureInstaller(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestConfigureInstaller")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	// The scripts record the configuration they are given, in order.
+	applied := filepath.Join(tmpdir, "applied")
+	applyDir := filepath.Join(tmpdir, "apply.d")
+	require.NoError(t, os.MkdirAll(applyDir, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(applyDir, "10-first"),
+		[]byte("#!/bin/sh\necho first >> "+applied+"\ncat $1 >> "+applied+"\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(applyDir, "20-second"),
+		[]byte("#!/bin/sh\necho second >> "+applied+"\n"), 0755))
+	// Not executable, so not run.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(applyDir, "30-disabled"),
+		[]byte("#!/bin/sh\necho disabled >> "+applied+"\n"), 0644))
+
+	config, err := ReadDeviceConfig(filepath.Join(tmpdir, "config", "device-config.json"))
+	require.NoError(t, err)
+	assert.Empty(t, config)
+
+	c := newTestConfigureInstaller(t, tmpdir, map[string]interface{}{
+		"timezone": "Europe/Oslo",
+	})
+	assert.Error(t, c.StoreUpdate(bytes.NewReader(nil), &namedFileInfo{name: "file"}))
+	require.NoError(t, c.InstallUpdate())
+	config, err = ReadDeviceConfig(c.deviceConfigFile)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"timezone": "Europe/Oslo"}, config)
+	output, err := ioutil.ReadFile(applied)
+	require.NoError(t, err)
+	assert.Equal(t, "first\n{\"timezone\":\"Europe/Oslo\"}second\n", string(output))
+
+	reboot, err := c.NeedsReboot()
+	assert.NoError(t, err)
+	assert.Equal(t, RebootAction(NoReboot), reboot)
+	rollback, err := c.SupportsRollback()
+	assert.NoError(t, err)
+	assert.True(t, rollback)
+
+	// There was no configuration before the update.
+	require.NoError(t, c.Rollback())
+	config, err = ReadDeviceConfig(c.deviceConfigFile)
+	require.NoError(t, err)
+	assert.Empty(t, config)
+	require.NoError(t, c.Cleanup())
+
+	// The configuration replaced is applied again on rollback, even if
+	// installed more than once.
+	c = newTestConfigureInstaller(t, tmpdir, map[string]interface{}{
+		"timezone": "Europe/Oslo",
+	})
+	require.NoError(t, c.InstallUpdate())
+	require.NoError(t, c.CommitUpdate())
+	require.NoError(t, c.Cleanup())
+	c = newTestConfigureInstaller(t, tmpdir, map[string]interface{}{
+		"timezone": "UTC",
+		"hostname": "device",
+	})
+	require.NoError(t, c.InstallUpdate())
+	require.NoError(t, c.InstallUpdate())
+	config, err = ReadDeviceConfig(c.deviceConfigFile)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"timezone": "UTC", "hostname": "device"}, config)
+	require.NoError(t, c.Rollback())
+	config, err = ReadDeviceConfig(c.deviceConfigFile)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"timezone": "Europe/Oslo"}, config)
+	require.NoError(t, c.Cleanup())
+	_, err = os.Stat(c.workPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// A failing apply script fails the installation.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(applyDir, "20-second"),
+		[]byte("#!/bin/sh\necho broken\nexit 1\n"), 0755))
+	c = newTestConfigureInstaller(t, tmpdir, map[string]interface{}{
+		"timezone": "UTC",
+	})
+	err = c.InstallUpdate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "broken")
+}
+
+func TestConfigureInstallerInvalidMetaData(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestConfigureInstallerInvalidMetaData")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	factory := NewConfigureInstallerFactory(tmpdir, "", "")
+	storer, err := factory.NewUpdateStorer(ConfigurePayloadType, 0)
+	require.NoError(t, err)
+	c := storer.(*ConfigureInstaller)
+	assert.Equal(t, DefaultConfigureDeviceConfigFile, c.deviceConfigFile)
+
+	err = c.Initialize(nil, nil, &testContainerInfo{metaData: map[string]interface{}{
+		"port": 8080,
+	}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "port")
+}
@@ -0,0 +1,405 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+// ContainerPayloadType is the payload type of the built-in container
+// installer, which updates the image of a containerized application, and
+// restarts the application. An external update module of the type takes
+// precedence over it.
+const ContainerPayloadType = "container"
+
+// The meta-data keys of container payloads.
+const (
+	// The container engine: "docker" (the default) or "podman".
+	MetaDataContainerEngine = "container_engine"
+	// The reference of the image: as in the image tarball of the payload,
+	// or, if the payload has none, a reference by digest to pull.
+	MetaDataContainerImage = "container_image"
+	// The reference which the application runs, which is made to point to
+	// the image of the update.
+	MetaDataContainerTag = "container_tag"
+	// The systemd unit running the application, or the compose file
+	// defining it, exactly one of which must be given.
+	MetaDataContainerUnit        = "container_unit"
+	MetaDataContainerComposeFile = "container_compose_file"
+)
+
+// The container engines.
+const (
+	ContainerEngineDocker = "docker"
+	ContainerEnginePodman = "podman"
+)
+
+// The optional image tarball of container payloads, in the format of
+// "docker save", or an OCI archive.
+const containerPayloadImage = "image.tar"
+
+// The files of the work path which keep the update between the states,
+// which may run in different processes.
+const (
+	containerUpdateFile   = "container.json"
+	containerPreviousFile = "previous-image"
+)
+
+type ContainerInstallerFactory struct {
+	system.Commander
+	workPath string
+}
+
+func NewContainerInstallerFactory(workPath string) *ContainerInstallerFactory {
+	return &ContainerInstallerFactory{
+		Commander: system.OsCalls{},
+		workPath:  workPath,
+	}
+}
+
+func (f *ContainerInstallerFactory) NewUpdateStorer(updateType string,
+	payloadNum int) (handlers.UpdateStorer, error) {
+
+	if payloadNum < 0 || payloadNum > 9999 {
+		return nil, fmt.Errorf("Payload index out of range 0-9999: %d", payloadNum)
+	}
+	return &ContainerInstaller{
+		Commander:  f.Commander,
+		updateType: updateType,
+		workPath: filepath.Join(f.workPath, "payloads",
+			fmt.Sprintf("%04d", payloadNum), "container"),
+	}, nil
+}
+
+// containerUpdate is the update described by the meta-data of the payload.
+type containerUpdate struct {
+	Engine      string `json:"engine"`
+	Image       string `json:"image"`
+	Tag         string `json:"tag"`
+	Unit        string `json:"unit,omitempty"`
+	ComposeFile string `json:"compose_file,omitempty"`
+}
+
+func containerUpdateFromMetaData(metaData map[string]interface{}) (*containerUpdate, error) {
+	var update containerUpdate
+	for key, value := range map[string]*string{
+		MetaDataContainerEngine:      &update.Engine,
+		MetaDataContainerImage:       &update.Image,
+		MetaDataContainerTag:         &update.Tag,
+		MetaDataContainerUnit:        &update.Unit,
+		MetaDataContainerComposeFile: &update.ComposeFile,
+	} {
+		field, ok := metaData[key]
+		if !ok {
+			continue
+		}
+		str, ok := field.(string)
+		if !ok {
+			return nil, errors.Errorf("%s meta-data is not a string", key)
+		}
+		*value = str
+	}
+
+	switch update.Engine {
+	case "":
+		update.Engine = ContainerEngineDocker
+	case ContainerEngineDocker, ContainerEnginePodman:
+	default:
+		return nil, errors.Errorf("unknown container engine %q", update.Engine)
+	}
+	if update.Image == "" || update.Tag == "" {
+		return nil, errors.Errorf("%s and %s meta-data are required",
+			MetaDataContainerImage, MetaDataContainerTag)
+	}
+	if (update.Unit == "") == (update.ComposeFile == "") {
+		return nil, errors.Errorf("exactly one of %s and %s meta-data is required",
+			MetaDataContainerUnit, MetaDataContainerComposeFile)
+	}
+	return &update, nil
+}
+
+// ContainerInstaller installs the image of a containerized application,
+// loading it from the payload or pulling it by digest, points the reference
+// which the application runs to it, and restarts the application. The
+// image the reference pointed to before is kept until the update is
+// committed, so that it can be rolled back.
+type ContainerInstaller struct {
+	system.Commander
+	updateType string
+	workPath   string
+}
+
+func (c *ContainerInstaller) filesPath() string {
+	return filepath.Join(c.workPath, "files")
+}
+
+func (c *ContainerInstaller) update() (*containerUpdate, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.workPath, containerUpdateFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the container update")
+	}
+	var update containerUpdate
+	if err := json.Unmarshal(data, &update); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the container update")
+	}
+	return &update, nil
+}
+
+// run runs the command, returning its output, or an error with it.
+func (c *ContainerInstaller) run(name string, args ...string) (string, error) {
+	output, err := c.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s %s failed: %s", name, strings.Join(args, " "),
+			strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (c *ContainerInstaller) Initialize(artifactHeaders,
+	artifactAugmentedHeaders artifact.HeaderInfoer,
+	payloadHeaders handlers.ArtifactUpdateHeaders) error {
+
+	if err := MissingFeaturesCheck(artifactAugmentedHeaders, payloadHeaders); err != nil {
+		return err
+	}
+
+	metaData, err := payloadHeaders.GetUpdateMetaData()
+	if err != nil {
+		return err
+	}
+	update, err := containerUpdateFromMetaData(metaData)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(c.workPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.filesPath(), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(c.workPath, containerUpdateFile), data, 0600)
+}
+
+func (c *ContainerInstaller) PrepareStoreUpdate() error {
+	return nil
+}
+
+func (c *ContainerInstaller) StoreUpdate(r io.Reader, info os.FileInfo) error {
+	if info.Name() != containerPayloadImage {
+		return errors.Errorf("unexpected file %q in %s payload", info.Name(), c.updateType)
+	}
+
+	file, err := os.OpenFile(filepath.Join(c.filesPath(), containerPayloadImage),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return errors.Wrapf(err, "failed to store %s", containerPayloadImage)
+	}
+	return file.Sync()
+}
+
+func (c *ContainerInstaller) FinishStoreUpdate() error {
+	update, err := c.update()
+	if err != nil {
+		return err
+	}
+
+	tarball := filepath.Join(c.filesPath(), containerPayloadImage)
+	if _, err := os.Stat(tarball); err == nil {
+		_, err = c.run(update.Engine, "load", "-i", tarball)
+		if err != nil {
+			return errors.Wrap(err, "failed to load the container image")
+		}
+		// The engine has its own copy now.
+		return os.Remove(tarball)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Only pulling by digest guarantees that the image is the one the
+	// artifact was made with.
+	if !strings.Contains(update.Image, "@") {
+		return errors.Errorf("the %s payload has no image, and %q is not a "+
+			"reference by digest to pull", c.updateType, update.Image)
+	}
+	if _, err := c.run(update.Engine, "pull", update.Image); err != nil {
+		return errors.Wrap(err, "failed to pull the container image")
+	}
+	return nil
+}
+
+// imageID returns the ID of the image of the reference, or an empty string
+// if there is none.
+func (c *ContainerInstaller) imageID(engine, reference string) string {
+	id, err := c.run(engine, "image", "inspect", "--format", "{{.Id}}", reference)
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// restart restarts the application, so that it runs the image the tag
+// points to.
+func (c *ContainerInstaller) restart(update *containerUpdate) error {
+	var err error
+	if update.Unit != "" {
+		_, err = c.run("systemctl", "restart", update.Unit)
+	} else {
+		_, err = c.run(update.Engine, "compose", "-f", update.ComposeFile, "up", "-d")
+	}
+	return errors.Wrap(err, "failed to restart the containerized application")
+}
+
+// stop stops the application, when there is no image to run.
+func (c *ContainerInstaller) stop(update *containerUpdate) error {
+	var err error
+	if update.Unit != "" {
+		_, err = c.run("systemctl", "stop", update.Unit)
+	} else {
+		_, err = c.run(update.Engine, "compose", "-f", update.ComposeFile, "down")
+	}
+	return errors.Wrap(err, "failed to stop the containerized application")
+}
+
+func (c *ContainerInstaller) InstallUpdate() error {
+	update, err := c.update()
+	if err != nil {
+		return err
+	}
+
+	id := c.imageID(update.Engine, update.Image)
+	if id == "" {
+		return errors.Errorf("the container image %s is not available", update.Image)
+	}
+
+	// Written once, so that installing again after an interruption does
+	// not lose the image to roll back to.
+	previousFile := filepath.Join(c.workPath, containerPreviousFile)
+	if _, err := os.Stat(previousFile); os.IsNotExist(err) {
+		previous := c.imageID(update.Engine, update.Tag)
+		if err := ioutil.WriteFile(previousFile, []byte(previous), 0600); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := c.run(update.Engine, "tag", id, update.Tag); err != nil {
+		return err
+	}
+	if err := c.restart(update); err != nil {
+		return err
+	}
+
+	log.Infof("Installed the container image %s as %s", update.Image, update.Tag)
+	return nil
+}
+
+func (c *ContainerInstaller) NeedsReboot() (RebootAction, error) {
+	return NoReboot, nil
+}
+
+func (c *ContainerInstaller) Reboot() error {
+	return nil
+}
+
+func (c *ContainerInstaller) SupportsRollback() (bool, error) {
+	return true, nil
+}
+
+func (c *ContainerInstaller) CommitUpdate() error {
+	return nil
+}
+
+func (c *ContainerInstaller) Rollback() error {
+	update, err := c.update()
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(c.workPath, containerPreviousFile))
+	if os.IsNotExist(err) {
+		// The tag was never changed.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	previous := string(data)
+	if previous == "" {
+		// The tag did not exist before the update, so neither did the
+		// application.
+		if err := c.stop(update); err != nil {
+			return err
+		}
+		if _, err := c.run(update.Engine, "rmi", update.Tag); err != nil {
+			return err
+		}
+	} else {
+		if _, err := c.run(update.Engine, "tag", previous, update.Tag); err != nil {
+			return err
+		}
+		if err := c.restart(update); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Restored the previous container image of %s", update.Tag)
+	return nil
+}
+
+func (c *ContainerInstaller) VerifyReboot() error {
+	return nil
+}
+
+func (c *ContainerInstaller) RollbackReboot() error {
+	return nil
+}
+
+func (c *ContainerInstaller) VerifyRollbackReboot() error {
+	return nil
+}
+
+func (c *ContainerInstaller) Failure() error {
+	return nil
+}
+
+func (c *ContainerInstaller) Cleanup() error {
+	return os.RemoveAll(c.workPath)
+}
+
+func (c *ContainerInstaller) GetType() string {
+	return c.updateType
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	stest "github.com/mendersoftware/mender/system/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// containerTestCalls records the commands run, giving the outputs in
+// outputs, and failing those in fail.
+type containerTestCalls struct {
+	commands []string
+	outputs  map[string]string
+	fail     map[string]bool
+}
+
+func (c *containerTestCalls) Command(name string, args ...string) *exec.Cmd {
+	command := strings.Join(append([]string{name}, args...), " ")
+	c.commands = append(c.commands, command)
+	if c.fail[command] {
+		return stest.NewTestOSCalls("", 1).Command(name, args...)
+	}
+	return stest.NewTestOSCalls(c.outputs[command], 0).Command(name, args...)
+}
+
+type testContainerInfo struct {
+	testStreamsTreeInfo
+	metaData map[string]interface{}
+}
+
+func (i *testContainerInfo) GetUpdateMetaData() (map[string]interface{}, error) {
+	return i.metaData, nil
+}
+
+func TestContainerUpdateFromMetaData(t *testing.T) {
+	update, err := containerUpdateFromMetaData(map[string]interface{}{
+		MetaDataContainerImage: "app@sha256:0123",
+		MetaDataContainerTag:   "app:current",
+		MetaDataContainerUnit:  "app.service",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &containerUpdate{
+		Engine: ContainerEngineDocker,
+		Image:  "app@sha256:0123",
+		Tag:    "app:current",
+		Unit:   "app.service",
+	}, update)
+
+	for _, metaData := range []map[string]interface{}{
+		{},
+		{MetaDataContainerTag: "app:current", MetaDataContainerUnit: "app.service"},
+		{MetaDataContainerImage: "app:1.0", MetaDataContainerUnit: "app.service"},
+		{MetaDataContainerImage: "app:1.0", MetaDataContainerTag: "app:current"},
+		{
+			MetaDataContainerImage:       "app:1.0",
+			MetaDataContainerTag:         "app:current",
+			MetaDataContainerUnit:        "app.service",
+			MetaDataContainerComposeFile: "/etc/app/compose.yaml",
+		},
+		{
+			MetaDataContainerEngine: "lxc",
+			MetaDataContainerImage:  "app:1.0",
+			MetaDataContainerTag:    "app:current",
+			MetaDataContainerUnit:   "app.service",
+		},
+		{
+			MetaDataContainerImage: "app:1.0",
+			MetaDataContainerTag:   "app:current",
+			MetaDataContainerUnit:  float64(1),
+		},
+	} {
+		_, err := containerUpdateFromMetaData(metaData)
+		assert.Error(t, err, metaData)
+	}
+}
+
+func newTestContainerInstaller(t *testing.T, workPath string,
+	calls *containerTestCalls, metaData map[string]interface{}) *ContainerInstaller {
+
+	factory := NewContainerInstallerFactory(workPath)
+	factory.Commander = calls
+	storer, err := factory.NewUpdateStorer(ContainerPayloadType, 0)
+	require.NoError(t, err)
+	c := storer.(*ContainerInstaller)
+
+	require.NoError(t, c.Initialize(nil, nil, &testContainerInfo{metaData: metaData}))
+	require.NoError(t, c.PrepareStoreUpdate())
+	return c
+}
+
+func TestContainerInstallerLoad(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestContainerInstallerLoad")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	calls := &containerTestCalls{
+		outputs: map[string]string{
+			"podman image inspect --format {{.Id}} app:1.1":     "sha256:new",
+			"podman image inspect --format {{.Id}} app:current": "sha256:old",
+		},
+	}
+	c := newTestContainerInstaller(t, tmpdir, calls, map[string]interface{}{
+		MetaDataContainerEngine:      ContainerEnginePodman,
+		MetaDataContainerImage:       "app:1.1",
+		MetaDataContainerTag:         "app:current",
+		MetaDataContainerComposeFile: "/etc/app/compose.yaml",
+	})
+
+	image := []byte("image")
+	require.NoError(t, c.StoreUpdate(bytes.NewReader(image),
+		&namedFileInfo{sizeOnlyFileInfo{int64(len(image))}, containerPayloadImage}))
+	assert.Error(t, c.StoreUpdate(bytes.NewReader(image),
+		&namedFileInfo{sizeOnlyFileInfo{int64(len(image))}, "unexpected"}))
+	require.NoError(t, c.FinishStoreUpdate())
+	tarball := filepath.Join(c.filesPath(), containerPayloadImage)
+	_, err = os.Stat(tarball)
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, c.InstallUpdate())
+	reboot, err := c.NeedsReboot()
+	assert.NoError(t, err)
+	assert.Equal(t, RebootAction(NoReboot), reboot)
+	rollback, err := c.SupportsRollback()
+	assert.NoError(t, err)
+	assert.True(t, rollback)
+
+	require.NoError(t, c.Rollback())
+	assert.Equal(t, []string{
+		"podman load -i " + tarball,
+		"podman image inspect --format {{.Id}} app:1.1",
+		"podman image inspect --format {{.Id}} app:current",
+		"podman tag sha256:new app:current",
+		"podman compose -f /etc/app/compose.yaml up -d",
+		"podman tag sha256:old app:current",
+		"podman compose -f /etc/app/compose.yaml up -d",
+	}, calls.commands)
+
+	require.NoError(t, c.Cleanup())
+	_, err = os.Stat(c.workPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestContainerInstallerPull(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestContainerInstallerPull")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	metaData := map[string]interface{}{
+		MetaDataContainerImage: "registry.example.com/app@sha256:0123",
+		MetaDataContainerTag:   "app:current",
+		MetaDataContainerUnit:  "app.service",
+	}
+	calls := &containerTestCalls{
+		outputs: map[string]string{
+			"docker image inspect --format {{.Id}} registry.example.com/app@sha256:0123": "sha256:new",
+		},
+		fail: map[string]bool{
+			"docker image inspect --format {{.Id}} app:current": true,
+		},
+	}
+	c := newTestContainerInstaller(t, tmpdir, calls, metaData)
+	require.NoError(t, c.FinishStoreUpdate())
+	require.NoError(t, c.InstallUpdate())
+
+	// The application did not exist before the update.
+	require.NoError(t, c.Rollback())
+	assert.Equal(t, []string{
+		"docker pull registry.example.com/app@sha256:0123",
+		"docker image inspect --format {{.Id}} registry.example.com/app@sha256:0123",
+		"docker image inspect --format {{.Id}} app:current",
+		"docker tag sha256:new app:current",
+		"systemctl restart app.service",
+		"systemctl stop app.service",
+		"docker rmi app:current",
+	}, calls.commands)
+
+	// A failed restart fails the installation.
+	calls.commands = nil
+	calls.fail["systemctl restart app.service"] = true
+	c = newTestContainerInstaller(t, tmpdir, calls, metaData)
+	require.NoError(t, c.FinishStoreUpdate())
+	assert.Error(t, c.InstallUpdate())
+
+	// Images can only be pulled by digest.
+	metaData[MetaDataContainerImage] = "registry.example.com/app:latest"
+	c = newTestContainerInstaller(t, tmpdir, calls, metaData)
+	assert.Error(t, c.FinishStoreUpdate())
+}
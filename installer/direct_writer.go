@@ -0,0 +1,162 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/system"
+)
+
+// directWriter writes to a file opened with direct I/O (O_DIRECT), which
+// requires the memory and the size of every write to be aligned to the logical
+// block size of the device. Unaligned data is copied to an aligned buffer, and
+// the unaligned end of each write is held back until the next write completes
+// its block. Direct I/O is only turned off if the device turns out not to
+// support it.
+type directWriter struct {
+	file   *os.File
+	align  int
+	buf    []byte
+	tail   []byte // the start of the next block, not written with direct I/O yet
+	direct bool
+}
+
+func newDirectWriter(file *os.File, align int) *directWriter {
+	return &directWriter{
+		file:   file,
+		align:  align,
+		tail:   alignedBuffer(align, align)[:0],
+		direct: true,
+	}
+}
+
+// alignedBuffer allocates a buffer whose address is a multiple of align.
+func alignedBuffer(size, align int) []byte {
+	buf := make([]byte, size+align)
+	offset := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(align))
+	if offset != 0 {
+		offset = align - offset
+	}
+	return buf[offset : offset+size]
+}
+
+func isAligned(p []byte, align int) bool {
+	return uintptr(unsafe.Pointer(&p[0]))%uintptr(align) == 0
+}
+
+func isInvalidArgument(err error) bool {
+	pe, ok := err.(*os.PathError)
+	return ok && pe.Err == syscall.EINVAL
+}
+
+func (w *directWriter) disableDirectIO() error {
+	w.direct = false
+	w.buf = nil
+	return system.SetDirectIO(w.file, false)
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	if !w.direct {
+		return w.file.Write(p)
+	}
+
+	written := 0
+	if len(w.tail) > 0 {
+		n := copy(w.tail[len(w.tail):w.align], p)
+		w.tail = w.tail[:len(w.tail)+n]
+		written += n
+		p = p[n:]
+		if len(w.tail) < w.align {
+			return written, nil
+		}
+		if err := w.writeBlocks(w.tail); err != nil {
+			return written, err
+		}
+		w.tail = w.tail[:0]
+	}
+
+	aligned := len(p) - len(p)%w.align
+	if aligned > 0 {
+		if err := w.writeBlocks(p[:aligned]); err != nil {
+			return written, err
+		}
+		written += aligned
+		p = p[aligned:]
+	}
+
+	if !w.direct {
+		n, err := w.file.Write(p)
+		return written + n, err
+	}
+	w.tail = append(w.tail, p...)
+	return written + len(p), nil
+}
+
+// writeBlocks writes whole blocks, with direct I/O unless the device does not
+// support it.
+func (w *directWriter) writeBlocks(p []byte) error {
+	for len(p) > 0 {
+		chunk := p
+		if w.direct && !isAligned(chunk, w.align) {
+			if len(chunk) > len(w.buf) {
+				w.buf = alignedBuffer(len(chunk), w.align)
+			}
+			chunk = w.buf[:copy(w.buf, chunk)]
+		}
+		n, err := w.file.Write(chunk)
+		p = p[n:]
+		if err != nil && n == 0 && w.direct && isInvalidArgument(err) {
+			log.Warnf("direct I/O is not supported by %s, using buffered writes: %v",
+				w.file.Name(), err)
+			if err := w.disableDirectIO(); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTail writes the start of the next block held back by Write, which is
+// too short to be written with direct I/O. The file offset is moved back to
+// the start of the block, so that the next write rewrites it in full.
+func (w *directWriter) writeTail() error {
+	if len(w.tail) == 0 {
+		return nil
+	}
+	if err := system.SetDirectIO(w.file, false); err != nil {
+		return err
+	}
+	_, err := w.file.Write(w.tail)
+	if err == nil {
+		_, err = w.file.Seek(-int64(len(w.tail)), io.SeekCurrent)
+	}
+	if derr := system.SetDirectIO(w.file, true); err == nil {
+		err = derr
+	}
+	return err
+}
+
+func (w *directWriter) Sync() error {
+	if err := w.writeTail(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, align := range []int{512, 4096} {
+		buf := alignedBuffer(3*align, align)
+		assert.Len(t, buf, 3*align)
+		assert.True(t, isAligned(buf, align))
+	}
+}
+
+func TestDirectWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "directWriter")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	data := make([]byte, 3*512+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	w := newDirectWriter(f, 512)
+	// Aligned size, but not necessarily aligned memory.
+	n, err := w.Write(data[1 : 1+512])
+	assert.NoError(t, err)
+	assert.Equal(t, 512, n)
+	assert.True(t, w.direct)
+
+	// Aligned data followed by an unaligned end, which is held back.
+	n, err = w.Write(data[1+512:])
+	assert.NoError(t, err)
+	assert.Equal(t, len(data)-1-512, n)
+	assert.True(t, w.direct)
+	assert.Len(t, w.tail, 100-1)
+	assert.NoError(t, w.Sync())
+
+	content, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, data[1:], content)
+}
+
+func TestDirectWriterUnalignedWrites(t *testing.T) {
+	f, err := ioutil.TempFile("", "directWriter")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	data := make([]byte, 5*512+300)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	w := newDirectWriter(f, 512)
+	rest := data
+	for i, size := range []int{100, 300, 700, 12, 1000} {
+		n, err := w.Write(rest[:size])
+		require.NoError(t, err)
+		assert.Equal(t, size, n)
+		rest = rest[size:]
+		// Syncing in the middle writes the held back data, and the
+		// next write continues after it.
+		if i == 2 {
+			require.NoError(t, w.Sync())
+		}
+	}
+	n, err := w.Write(rest)
+	require.NoError(t, err)
+	assert.Equal(t, len(rest), n)
+	assert.True(t, w.direct)
+	require.NoError(t, w.Sync())
+
+	content, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, data, content)
+}
+
+func TestBlockDeviceDirectIO(t *testing.T) {
+	// O_DIRECT is supported by some file systems only; the block device
+	// falls back to buffered writes on the others, such as tmpfs.
+	tdir, err := ioutil.TempDir(".", "directio")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	part := path.Join(tdir, "inactivePart")
+	require.NoError(t, ioutil.WriteFile(part, nil, 0600))
+
+	old := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = old
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 1024 * 1024, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 4096, nil }
+
+	if f, err := os.OpenFile(part, os.O_WRONLY|syscall.O_DIRECT, 0); err != nil {
+		t.Logf("O_DIRECT is not supported in %s: %v", tdir, err)
+	} else {
+		f.Close()
+	}
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	data = append(data, "unaligned end"...)
+	bd := &BlockDevice{
+		Path:               part,
+		ImageSize:          int64(len(data)),
+		FlushIntervalBytes: 4096,
+		DirectIO:           true,
+	}
+	n, err := chunkedCopy(bd, bytes.NewReader(data), 3*4096)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.NoError(t, bd.Close())
+
+	content, err := ioutil.ReadFile(part)
+	require.NoError(t, err)
+	assert.Equal(t, data, content)
+}
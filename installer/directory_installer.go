@@ -0,0 +1,456 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+)
+
+// DirectoryPayloadType is the payload type of the built-in directory
+// installer, which replaces a directory with the tree of files in the
+// payload. Its payloads are the same as those of the "directory" update
+// module, which takes precedence over it if installed.
+const DirectoryPayloadType = "directory"
+
+// The files of directory payloads: a tar archive of the tree of files, and
+// the path of the directory to replace with it.
+const (
+	directoryPayloadTar     = "update.tar"
+	directoryPayloadDestDir = "dest_dir"
+)
+
+// Suffixes of the directories next to the destination directory, on the same
+// file system, so that they can be renamed into place.
+const (
+	directoryStagingSuffix = ".mender-new"
+	directoryBackupSuffix  = ".mender-backup"
+)
+
+// Marks that the destination directory did not exist before the update, so
+// that rolling back removes it.
+const directoryNoPreviousMarker = "no-previous"
+
+type DirectoryInstallerFactory struct {
+	workPath string
+}
+
+func NewDirectoryInstallerFactory(workPath string) *DirectoryInstallerFactory {
+	return &DirectoryInstallerFactory{workPath: workPath}
+}
+
+func (f *DirectoryInstallerFactory) NewUpdateStorer(updateType string,
+	payloadNum int) (handlers.UpdateStorer, error) {
+
+	if payloadNum < 0 || payloadNum > 9999 {
+		return nil, fmt.Errorf("Payload index out of range 0-9999: %d", payloadNum)
+	}
+	return &DirectoryInstaller{
+		updateType: updateType,
+		workPath: filepath.Join(f.workPath, "payloads",
+			fmt.Sprintf("%04d", payloadNum), "directory"),
+	}, nil
+}
+
+// DirectoryInstaller installs the tree of files of a payload in place of a
+// directory. The tree is extracted next to the directory, and renamed into
+// place, keeping the previous directory until the update is committed, so
+// that it can be rolled back.
+type DirectoryInstaller struct {
+	updateType string
+	// Holds the payload files, and the state kept between the states of
+	// the update, which may run in different processes.
+	workPath string
+}
+
+func (d *DirectoryInstaller) filesPath() string {
+	return filepath.Join(d.workPath, "files")
+}
+
+func (d *DirectoryInstaller) destDir() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.filesPath(), directoryPayloadDestDir))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the destination directory")
+	}
+	dest := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(dest) {
+		return "", errors.Errorf("the destination directory %q is not an absolute path", dest)
+	}
+	dest = filepath.Clean(dest)
+	if dest == "/" {
+		return "", errors.New("installing to the root directory is not supported")
+	}
+	return dest, nil
+}
+
+func (d *DirectoryInstaller) Initialize(artifactHeaders,
+	artifactAugmentedHeaders artifact.HeaderInfoer,
+	payloadHeaders handlers.ArtifactUpdateHeaders) error {
+
+	if err := MissingFeaturesCheck(artifactAugmentedHeaders, payloadHeaders); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(d.workPath); err != nil {
+		return err
+	}
+	return os.MkdirAll(d.filesPath(), 0700)
+}
+
+func (d *DirectoryInstaller) PrepareStoreUpdate() error {
+	return nil
+}
+
+func (d *DirectoryInstaller) StoreUpdate(r io.Reader, info os.FileInfo) error {
+	name := info.Name()
+	if name != directoryPayloadTar && name != directoryPayloadDestDir {
+		return errors.Errorf("unexpected file %q in %s payload", name, d.updateType)
+	}
+
+	file, err := os.OpenFile(filepath.Join(d.filesPath(), name),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return errors.Wrapf(err, "failed to store %s", name)
+	}
+	return file.Sync()
+}
+
+func (d *DirectoryInstaller) FinishStoreUpdate() error {
+	for _, name := range []string{directoryPayloadTar, directoryPayloadDestDir} {
+		if _, err := os.Stat(filepath.Join(d.filesPath(), name)); err != nil {
+			return errors.Errorf("%s payload is missing the file %s", d.updateType, name)
+		}
+	}
+	_, err := d.destDir()
+	return err
+}
+
+func (d *DirectoryInstaller) InstallUpdate() error {
+	dest, err := d.destDir()
+	if err != nil {
+		return err
+	}
+	staging := dest + directoryStagingSuffix
+	backup := dest + directoryBackupSuffix
+
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+	if err := extractTarFile(filepath.Join(d.filesPath(), directoryPayloadTar),
+		staging); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(backup); err != nil {
+		return err
+	}
+	noPrevious := filepath.Join(d.workPath, directoryNoPreviousMarker)
+	if _, err := os.Lstat(dest); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(noPrevious, nil, 0600); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if err := os.Rename(dest, backup); err != nil {
+		return errors.Wrapf(err, "failed to move %s aside", dest)
+	}
+
+	if err := os.Rename(staging, dest); err != nil {
+		return errors.Wrapf(err, "failed to move the update into %s", dest)
+	}
+	syncDir(filepath.Dir(dest))
+
+	log.Infof("Installed the %s payload to %s", d.updateType, dest)
+	return nil
+}
+
+func (d *DirectoryInstaller) NeedsReboot() (RebootAction, error) {
+	return NoReboot, nil
+}
+
+func (d *DirectoryInstaller) Reboot() error {
+	return nil
+}
+
+func (d *DirectoryInstaller) SupportsRollback() (bool, error) {
+	return true, nil
+}
+
+func (d *DirectoryInstaller) CommitUpdate() error {
+	dest, err := d.destDir()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dest + directoryBackupSuffix)
+}
+
+func (d *DirectoryInstaller) Rollback() error {
+	dest, err := d.destDir()
+	if err != nil {
+		return err
+	}
+	backup := dest + directoryBackupSuffix
+
+	if _, err := os.Lstat(backup); err == nil {
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+		if err := os.Rename(backup, dest); err != nil {
+			return errors.Wrapf(err, "failed to restore %s", dest)
+		}
+		syncDir(filepath.Dir(dest))
+		log.Infof("Restored the previous content of %s", dest)
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if _, err := os.Stat(filepath.Join(d.workPath,
+		directoryNoPreviousMarker)); err == nil {
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+		log.Infof("Removed %s, which did not exist before the update", dest)
+	}
+
+	return os.RemoveAll(dest + directoryStagingSuffix)
+}
+
+func (d *DirectoryInstaller) VerifyReboot() error {
+	return nil
+}
+
+func (d *DirectoryInstaller) RollbackReboot() error {
+	return nil
+}
+
+func (d *DirectoryInstaller) VerifyRollbackReboot() error {
+	return nil
+}
+
+func (d *DirectoryInstaller) Failure() error {
+	return nil
+}
+
+func (d *DirectoryInstaller) Cleanup() error {
+	if dest, err := d.destDir(); err == nil {
+		if err := os.RemoveAll(dest + directoryStagingSuffix); err != nil {
+			log.Errorf("Error removing the staging directory of %s: %s", dest, err)
+		}
+	}
+	return os.RemoveAll(d.workPath)
+}
+
+func (d *DirectoryInstaller) GetType() string {
+	return d.updateType
+}
+
+// syncDir makes renames in the directory durable, best effort.
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		log.Warnf("Failed to sync directory %s: %s", path, err)
+	}
+}
+
+func extractTarFile(path, dest string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return extractTar(file, dest)
+}
+
+// extractTar extracts the tar archive into the directory, refusing entries
+// which would end up outside of it.
+func extractTar(r io.Reader, dest string) error {
+	// The modes and times of directories are set last, since extracting
+	// into them changes their times, and their modes may forbid it.
+	var dirs []*tar.Header
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read the tar archive")
+		}
+
+		target, err := tarEntryTarget(hdr, dest)
+		if err != nil {
+			return err
+		} else if target == "" {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = extractTarDir(hdr, target)
+			dirs = append(dirs, hdr)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractTarRegular(tr, hdr, target)
+		case tar.TypeSymlink:
+			err = extractTarSymlink(hdr, target)
+		case tar.TypeLink:
+			err = extractTarLink(hdr, dest, target)
+		default:
+			err = errors.Errorf("unsupported type of tar entry %q", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setTarEntryAttributes(dirs[i].Name, dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tarEntryTarget returns the path the tar entry is extracted to, after
+// creating its parent directories, or "" if the entry is the directory
+// itself.
+func tarEntryTarget(hdr *tar.Header, dest string) (string, error) {
+	name := filepath.Clean(hdr.Name)
+	if name == "." {
+		return "", nil
+	}
+	if filepath.IsAbs(name) || name == ".." ||
+		strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("tar entry %q is outside of the directory", hdr.Name)
+	}
+	target := filepath.Join(dest, name)
+	if err := checkInsideDir(dest, filepath.Dir(target)); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// extractTarDir creates the directory of the tar entry, and records its path
+// in the header, for setting its attributes once it has been filled.
+func extractTarDir(hdr *tar.Header, target string) error {
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return err
+	}
+	hdr.Name = target
+	return nil
+}
+
+func extractTarRegular(r io.Reader, hdr *tar.Header, target string) error {
+	if err := extractTarFileEntry(r, target); err != nil {
+		return err
+	}
+	return setTarEntryAttributes(target, hdr)
+}
+
+func extractTarSymlink(hdr *tar.Header, target string) error {
+	if err := os.Symlink(hdr.Linkname, target); err != nil {
+		return err
+	}
+	return setTarEntryAttributes(target, hdr)
+}
+
+// extractTarLink creates the hard link of the tar entry, which shares the
+// owner, mode and times of the link target.
+func extractTarLink(hdr *tar.Header, dest, target string) error {
+	link := filepath.Join(dest, filepath.Clean(hdr.Linkname))
+	if err := checkInsideDir(dest, link); err != nil {
+		return err
+	}
+	return os.Link(link, target)
+}
+
+func setTarEntryAttributes(target string, hdr *tar.Header) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// After chown, which clears the setuid and setgid bits.
+	mode := hdr.FileInfo().Mode() &
+		(os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+func extractTarFileEntry(r io.Reader, target string) error {
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// checkInsideDir checks that the path, with symbolic links resolved, is
+// inside the directory, so that links in the archive can not be used to
+// write elsewhere. The part of the path which does not exist yet is created
+// as plain directories.
+func checkInsideDir(dir, path string) error {
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	existing := path
+	resolved, err := filepath.EvalSymlinks(existing)
+	for os.IsNotExist(err) && existing != filepath.Dir(existing) {
+		if _, err := os.Lstat(existing); err == nil {
+			return errors.Errorf("%s is a dangling link", existing)
+		}
+		existing = filepath.Dir(existing)
+		resolved, err = filepath.EvalSymlinks(existing)
+	}
+	if err != nil {
+		return err
+	}
+	if resolved != resolvedDir &&
+		!strings.HasPrefix(resolved, resolvedDir+string(filepath.Separator)) {
+		return errors.Errorf("%s is outside of %s", path, dir)
+	}
+	return nil
+}
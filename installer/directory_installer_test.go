@@ -0,0 +1,200 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type namedFileInfo struct {
+	sizeOnlyFileInfo
+	name string
+}
+
+func (n *namedFileInfo) Name() string {
+	return n.name
+}
+
+type testTarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func makeTestTar(t *testing.T, entries []testTarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+			ModTime:  time.Now(),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func storeDirectoryPayload(t *testing.T, d *DirectoryInstaller,
+	tarball []byte, dest string) error {
+
+	require.NoError(t, d.Initialize(nil, nil, &testStreamsTreeInfo{}))
+	require.NoError(t, d.PrepareStoreUpdate())
+	for name, data := range map[string][]byte{
+		directoryPayloadTar:     tarball,
+		directoryPayloadDestDir: []byte(dest + "\n"),
+	} {
+		info := &namedFileInfo{sizeOnlyFileInfo{int64(len(data))}, name}
+		require.NoError(t, d.StoreUpdate(bytes.NewReader(data), info))
+	}
+	return d.FinishStoreUpdate()
+}
+
+func newTestDirectoryInstaller(t *testing.T, workPath string) *DirectoryInstaller {
+	storer, err := NewDirectoryInstallerFactory(workPath).
+		NewUpdateStorer(DirectoryPayloadType, 0)
+	require.NoError(t, err)
+	return storer.(*DirectoryInstaller)
+}
+
+func TestDirectoryInstaller(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestDirectoryInstaller")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	dest := filepath.Join(tmpdir, "app")
+	require.NoError(t, os.MkdirAll(dest, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "old"), []byte("old"), 0644))
+
+	tarball := makeTestTar(t, []testTarEntry{
+		{name: "bin", typeflag: tar.TypeDir},
+		{name: "bin/app", typeflag: tar.TypeReg, content: "new"},
+		{name: "current", typeflag: tar.TypeSymlink, linkname: "bin/app"},
+	})
+
+	d := newTestDirectoryInstaller(t, filepath.Join(tmpdir, "work"))
+	require.NoError(t, storeDirectoryPayload(t, d, tarball, dest))
+	require.NoError(t, d.InstallUpdate())
+
+	data, err := ioutil.ReadFile(filepath.Join(dest, "current"))
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	_, err = os.Stat(filepath.Join(dest, "old"))
+	assert.True(t, os.IsNotExist(err))
+
+	reboot, err := d.NeedsReboot()
+	assert.NoError(t, err)
+	assert.Equal(t, RebootAction(NoReboot), reboot)
+
+	// Rolling back restores the previous content.
+	require.NoError(t, d.Rollback())
+	data, err = ioutil.ReadFile(filepath.Join(dest, "old"))
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+	_, err = os.Stat(dest + directoryBackupSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// Committing removes the previous content.
+	require.NoError(t, d.InstallUpdate())
+	require.NoError(t, d.CommitUpdate())
+	_, err = os.Stat(dest + directoryBackupSuffix)
+	assert.True(t, os.IsNotExist(err))
+	data, err = ioutil.ReadFile(filepath.Join(dest, "bin/app"))
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+
+	require.NoError(t, d.Cleanup())
+	_, err = os.Stat(d.workPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dest)
+	assert.NoError(t, err)
+}
+
+func TestDirectoryInstallerNoPrevious(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestDirectoryInstallerNoPrevious")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	dest := filepath.Join(tmpdir, "app")
+	tarball := makeTestTar(t, []testTarEntry{
+		{name: "file", typeflag: tar.TypeReg, content: "new"},
+	})
+
+	d := newTestDirectoryInstaller(t, filepath.Join(tmpdir, "work"))
+	require.NoError(t, storeDirectoryPayload(t, d, tarball, dest))
+	require.NoError(t, d.InstallUpdate())
+	_, err = os.Stat(filepath.Join(dest, "file"))
+	assert.NoError(t, err)
+
+	require.NoError(t, d.Rollback())
+	_, err = os.Stat(dest)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDirectoryInstallerErrors(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestDirectoryInstallerErrors")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	dest := filepath.Join(tmpdir, "app")
+	workPath := filepath.Join(tmpdir, "work")
+
+	for name, entries := range map[string][]testTarEntry{
+		"parent directory": {
+			{name: "../evil", typeflag: tar.TypeReg, content: "evil"},
+		},
+		"symlink escape": {
+			{name: "link", typeflag: tar.TypeSymlink, linkname: tmpdir},
+			{name: "link/evil", typeflag: tar.TypeReg, content: "evil"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := newTestDirectoryInstaller(t, workPath)
+			require.NoError(t, storeDirectoryPayload(t, d, makeTestTar(t, entries), dest))
+			assert.Error(t, d.InstallUpdate())
+			_, err := os.Stat(filepath.Join(tmpdir, "evil"))
+			assert.True(t, os.IsNotExist(err))
+			_, err = os.Stat(dest)
+			assert.True(t, os.IsNotExist(err))
+			assert.NoError(t, d.Cleanup())
+		})
+	}
+
+	d := newTestDirectoryInstaller(t, workPath)
+	assert.Error(t, storeDirectoryPayload(t, d, makeTestTar(t, nil), "/"))
+	assert.Error(t, storeDirectoryPayload(t, d, makeTestTar(t, nil), "relative/path"))
+
+	require.NoError(t, d.Initialize(nil, nil, &testStreamsTreeInfo{}))
+	assert.Error(t, d.StoreUpdate(bytes.NewReader(nil),
+		&namedFileInfo{sizeOnlyFileInfo{0}, "unexpected"}))
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Payload meta-data keys describing where the root file system is found
+// inside a payload which is a full disk image, with its own partition table.
+const (
+	MetaDataRootfsImageOffset = "rootfs_image_offset"
+	MetaDataRootfsImageLength = "rootfs_image_length"
+)
+
+// diskImageRegion is the part of a full disk image payload which holds the
+// root file system, and which is written to the inactive partition.
+type diskImageRegion struct {
+	offset int64
+	length int64
+}
+
+// diskImageRegionFromMetaData returns the root file system region of the
+// payload, or nil if the payload is a plain root file system image.
+func diskImageRegionFromMetaData(metaData map[string]interface{}) (*diskImageRegion, error) {
+	_, hasOffset := metaData[MetaDataRootfsImageOffset]
+	_, hasLength := metaData[MetaDataRootfsImageLength]
+	if !hasOffset && !hasLength {
+		return nil, nil
+	} else if !hasOffset || !hasLength {
+		return nil, errors.Errorf("both %s and %s must be given in the payload meta-data",
+			MetaDataRootfsImageOffset, MetaDataRootfsImageLength)
+	}
+
+	offset, err := metaDataInt(metaData, MetaDataRootfsImageOffset)
+	if err != nil {
+		return nil, err
+	}
+	length, err := metaDataInt(metaData, MetaDataRootfsImageLength)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || length <= 0 {
+		return nil, errors.Errorf("invalid root file system region in payload "+
+			"meta-data: offset %d, length %d", offset, length)
+	}
+	return &diskImageRegion{offset: offset, length: length}, nil
+}
+
+func metaDataInt(metaData map[string]interface{}, key string) (int64, error) {
+	// JSON numbers are decoded as float64.
+	value, ok := metaData[key].(float64)
+	if !ok || value != float64(int64(value)) {
+		return 0, errors.Errorf("payload meta-data %s must be an integer", key)
+	}
+	return int64(value), nil
+}
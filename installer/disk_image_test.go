@@ -0,0 +1,116 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskImageRegionFromMetaData(t *testing.T) {
+	region, err := diskImageRegionFromMetaData(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, region)
+
+	region, err = diskImageRegionFromMetaData(map[string]interface{}{
+		"other": "value",
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, region)
+
+	region, err = diskImageRegionFromMetaData(map[string]interface{}{
+		MetaDataRootfsImageOffset: float64(1048576),
+		MetaDataRootfsImageLength: float64(4096),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &diskImageRegion{offset: 1048576, length: 4096}, region)
+
+	for _, metaData := range []map[string]interface{}{
+		{MetaDataRootfsImageOffset: float64(512)},
+		{MetaDataRootfsImageLength: float64(512)},
+		{MetaDataRootfsImageOffset: "512", MetaDataRootfsImageLength: float64(512)},
+		{MetaDataRootfsImageOffset: float64(0.5), MetaDataRootfsImageLength: float64(512)},
+		{MetaDataRootfsImageOffset: float64(-1), MetaDataRootfsImageLength: float64(512)},
+		{MetaDataRootfsImageOffset: float64(512), MetaDataRootfsImageLength: float64(0)},
+	} {
+		_, err = diskImageRegionFromMetaData(metaData)
+		assert.Error(t, err, "%v", metaData)
+	}
+}
+
+func TestDiskImageRegionFromArtifact(t *testing.T) {
+	art, err := makeRootfsImageArtifactWithMetaData(map[string]interface{}{
+		MetaDataRootfsImageOffset: 1048576,
+		MetaDataRootfsImageLength: 4096,
+	})
+	require.NoError(t, err)
+	payload, err := readRootfsImageArtifactHeaders(art)
+	require.NoError(t, err)
+
+	var d dualRootfsDeviceImpl
+	require.NoError(t, d.Initialize(nil, nil, payload))
+	assert.Equal(t, &diskImageRegion{offset: 1048576, length: 4096}, d.region)
+
+	// Plain root file system images have no region.
+	art, err = makeRootfsImageArtifactWithMetaData(nil)
+	require.NoError(t, err)
+	payload, err = readRootfsImageArtifactHeaders(art)
+	require.NoError(t, err)
+
+	d = dualRootfsDeviceImpl{}
+	require.NoError(t, d.Initialize(nil, nil, payload))
+	assert.Nil(t, d.region)
+}
+
+func TestStoreUpdateDiskImageRegion(t *testing.T) {
+	part, err := ioutil.TempFile("", "inactivePart")
+	require.NoError(t, err)
+	part.Close()
+	defer os.Remove(part.Name())
+
+	testDevice := dualRootfsDeviceImpl{
+		partitions: &partitions{inactive: part.Name()},
+		region:     &diskImageRegion{offset: 4, length: 6},
+	}
+
+	old := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = old
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 6, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 512, nil }
+
+	diskImage := "MBR:rootfs:rest"
+	image := strings.NewReader(diskImage)
+	err = testDevice.StoreUpdate(image, &sizeOnlyFileInfo{int64(len(diskImage))})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, image.Len())
+
+	content, err := ioutil.ReadFile(part.Name())
+	require.NoError(t, err)
+	assert.Equal(t, "rootfs", string(content))
+
+	// The region must be inside the disk image.
+	testDevice.region = &diskImageRegion{offset: 10, length: 6}
+	err = testDevice.StoreUpdate(strings.NewReader(diskImage),
+		&sizeOnlyFileInfo{int64(len(diskImage))})
+	assert.Error(t, err)
+}
@@ -16,8 +16,12 @@ package installer
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -34,13 +38,93 @@ import (
 type DualRootfsDeviceConfig struct {
 	RootfsPartA string
 	RootfsPartB string
+	// The rootfs partitions which updates are installed to in turn, if
+	// there are more than two; overrides RootfsPartA and RootfsPartB.
+	RootfsParts []string
+	// Read back the update written to the inactive partition, and verify
+	// its checksum, before enabling the partition.
+	VerifyWrite bool
+	// Size of the writes of updates to the inactive partition, rounded up
+	// to a multiple of the sector size; DefaultWriteBufferSize if 0.
+	WriteBufferSize int
+	// Write updates with direct I/O (O_DIRECT), bypassing the page cache.
+	// Buffered writes are used if the partition does not support it.
+	DirectIO bool
+	// Compare the update with the content of the inactive partition, and
+	// only write the blocks which differ. Overrides DirectIO.
+	SkipIdenticalBlocks bool
+	// Discard the holes in the block map of sparse updates, which are
+	// otherwise left as they are.
+	DiscardHoles bool
+	// Discard the whole inactive partition before writing an update to it.
+	// Not done with SkipIdenticalBlocks, which needs the old content.
+	DiscardBeforeWrite bool
+	// Resize UBI volumes which are smaller than the update, from the free
+	// erase blocks of the UBI device, instead of failing.
+	UbiAutoResize bool
+	// The source of the key of the LUKS containers on the rootfs
+	// partitions, LUKSKeySourceKeyring or LUKSKeySourceTPM2; the
+	// partitions are not encrypted if empty.
+	LUKSKeySource string
+	// The description of the key in the user keyring of the kernel, with
+	// LUKSKeySourceKeyring.
+	LUKSKeyDescription string
+	// The dm-verity hash partitions of the rootfs partitions, in the order
+	// of RootfsParts, or of RootfsPartA and RootfsPartB, which the hash
+	// trees of payloads protected by dm-verity are written to.
+	VerityHashParts []string
+	// The file the progress of writing updates to the inactive partition
+	// is recorded in, so that an interrupted write is resumed where it
+	// stopped; not recorded if empty.
+	WriteCheckpointPath string
+	// Opens the partitions; with os.OpenFile if nil. Set to test installers
+	// with in-memory block devices, such as those of installer/testutils.
+	OpenBlockDevice BlockDeviceOpenFunc
 }
 
+// DefaultWriteBufferSize is the default size of the writes of updates to the
+// inactive partition.
+const DefaultWriteBufferSize = 1024 * 1024
+
 type dualRootfsDeviceImpl struct {
 	BootEnvReadWriter
 	system.Commander
 	*partitions
 	rebooter *system.SystemRebootCmd
+
+	// Set when the payload is a full disk image, in which case only this
+	// region of it is written to the inactive partition.
+	region *diskImageRegion
+	// Set when the payload has a block map, in which case only the mapped
+	// blocks are written.
+	blockMap *blockMap
+	// Set when the payload is protected by dm-verity, in which case its
+	// hash tree is written to the hash partition of the inactive partition.
+	verity *verityImage
+
+	throughputRecorder WriteThroughputRecorder
+	progressReporter   WriteProgressReporter
+
+	verifyWrite     bool
+	writeBufferSize int
+	directIO        bool
+	skipIdentical   bool
+	discardHoles    bool
+	discardFirst    bool
+	ubiAutoResize   bool
+	// Set if the rootfs partitions are LUKS containers.
+	luksKeySource      string
+	luksKeyDescription string
+	// The dm-verity hash partition of each of the rootfs partitions.
+	verityHashParts []string
+	// Where the progress of writing updates is recorded, if anywhere.
+	writeCheckpointPath string
+	// Opens the partitions; with os.OpenFile if nil.
+	openBlockDevice BlockDeviceOpenFunc
+	// Headers of the payload being installed.
+	payload handlers.ArtifactUpdateHeaders
+	// Set by StoreUpdate if verifyWrite is set.
+	written *writtenImage
 }
 
 // This interface is only here for tests.
@@ -49,6 +133,12 @@ type DualRootfsDevice interface {
 	handlers.UpdateStorerProducer
 	GetInactive() (string, error)
 	GetActive() (string, error)
+	// SetWriteThroughputRecorder sets the recorder told about the write
+	// throughput of every update written to the inactive partition.
+	SetWriteThroughputRecorder(r WriteThroughputRecorder)
+	// SetWriteProgressReporter sets the reporter told about the progress
+	// of writing updates to the inactive partition.
+	SetWriteProgressReporter(r WriteProgressReporter)
 }
 
 // checkMounted parses /proc/self/mounts to check
@@ -73,27 +163,58 @@ func checkMounted(part string) string {
 
 // Returns nil if config doesn't contain partition paths.
 func NewDualRootfsDevice(env BootEnvReadWriter, sc system.StatCommander, config DualRootfsDeviceConfig) DualRootfsDevice {
-	if config.RootfsPartA == "" || config.RootfsPartB == "" {
-		return nil
+	parts := config.RootfsParts
+	if len(parts) == 0 {
+		if config.RootfsPartA == "" || config.RootfsPartB == "" {
+			return nil
+		}
+		parts = []string{config.RootfsPartA, config.RootfsPartB}
 	}
 
+	rootfsParts := make([]string, len(parts))
+	for i, part := range parts {
+		rootfsParts[i] = resolvePartition(part)
+	}
+	verityHashParts := make([]string, len(config.VerityHashParts))
+	for i, part := range config.VerityHashParts {
+		verityHashParts[i] = resolvePartition(part)
+	}
 	partitions := partitions{
 		StatCommander:     sc,
 		BootEnvReadWriter: env,
-		rootfsPartA:       maybeResolveLink(config.RootfsPartA),
-		rootfsPartB:       maybeResolveLink(config.RootfsPartB),
+		rootfsParts:       rootfsParts,
 		active:            "",
 		inactive:          "",
 	}
 	dualRootfsDevice := dualRootfsDeviceImpl{
-		BootEnvReadWriter: env,
-		Commander:         sc,
-		partitions:        &partitions,
-		rebooter:          system.NewSystemRebootCmd(sc),
+		BootEnvReadWriter:   env,
+		Commander:           sc,
+		partitions:          &partitions,
+		rebooter:            system.NewSystemRebootCmd(sc),
+		verifyWrite:         config.VerifyWrite,
+		writeBufferSize:     config.WriteBufferSize,
+		directIO:            config.DirectIO,
+		skipIdentical:       config.SkipIdenticalBlocks,
+		discardHoles:        config.DiscardHoles,
+		discardFirst:        config.DiscardBeforeWrite,
+		ubiAutoResize:       config.UbiAutoResize,
+		luksKeySource:       config.LUKSKeySource,
+		luksKeyDescription:  config.LUKSKeyDescription,
+		verityHashParts:     verityHashParts,
+		writeCheckpointPath: config.WriteCheckpointPath,
+		openBlockDevice:     config.OpenBlockDevice,
 	}
 	return &dualRootfsDevice
 }
 
+func (d *dualRootfsDeviceImpl) SetWriteThroughputRecorder(r WriteThroughputRecorder) {
+	d.throughputRecorder = r
+}
+
+func (d *dualRootfsDeviceImpl) SetWriteProgressReporter(r WriteProgressReporter) {
+	d.progressReporter = r
+}
+
 func (d *dualRootfsDeviceImpl) NeedsReboot() (RebootAction, error) {
 	return RebootRequired, nil
 }
@@ -104,6 +225,13 @@ func (d *dualRootfsDeviceImpl) SupportsRollback() (bool, error) {
 
 func (d *dualRootfsDeviceImpl) Reboot() error {
 	log.Infof("Mender rebooting from active partition: %s", d.active)
+	if p, ok := d.BootEnvReadWriter.(RebootArgumentProvider); ok {
+		arg, err := p.RebootArgument()
+		if err != nil {
+			return err
+		}
+		return d.rebooter.RebootWithArgument(arg)
+	}
 	return d.rebooter.Reboot()
 }
 
@@ -121,18 +249,23 @@ func (d *dualRootfsDeviceImpl) Rollback() error {
 		return nil
 	}
 
-	// first get inactive partition
-	inactivePartition, inactivePartitionHex, err := d.getInactivePartition()
+	// first get the partition to roll back to
+	rollbackPartition, err := d.getRollbackPartition()
 	if err != nil {
 		return err
 	}
-	log.Infof("setting partition for rollback: %s", inactivePartition)
+	vars, err := d.bootVars(rollbackPartition)
+	if err != nil {
+		return err
+	}
+	log.Infof("setting partition for rollback: %s", vars["mender_boot_part"])
 
-	err = d.WriteEnv(BootVars{"mender_boot_part": inactivePartition, "mender_boot_part_hex": inactivePartitionHex, "upgrade_available": "0"})
+	vars["upgrade_available"] = "0"
+	err = d.WriteEnv(vars)
 	if err != nil {
 		return err
 	}
-	log.Debug("Marking inactive partition as a boot candidate successful.")
+	log.Debug("Marking rollback partition as a boot candidate successful.")
 	return nil
 }
 
@@ -140,7 +273,36 @@ func (d *dualRootfsDeviceImpl) Initialize(artifactHeaders,
 	artifactAugmentedHeaders artifact.HeaderInfoer,
 	payloadHeaders handlers.ArtifactUpdateHeaders) error {
 
-	return MissingFeaturesCheck(artifactAugmentedHeaders, payloadHeaders)
+	err := MissingFeaturesCheck(artifactAugmentedHeaders, payloadHeaders)
+	if err != nil {
+		return err
+	}
+
+	d.payload = payloadHeaders
+	metaData, err := payloadHeaders.GetUpdateMetaData()
+	if err != nil {
+		return err
+	}
+	d.region, err = diskImageRegionFromMetaData(metaData)
+	if err != nil {
+		return err
+	}
+	if d.region != nil {
+		log.Infof("Payload is a disk image; writing %d bytes from offset %d",
+			d.region.length, d.region.offset)
+	}
+	d.blockMap, err = blockMapFromMetaData(metaData)
+	if err != nil {
+		return err
+	}
+	d.verity, err = verityImageFromMetaData(metaData)
+	if err != nil {
+		return err
+	}
+	if d.verity != nil && d.blockMap != nil {
+		return errors.New("payloads protected by dm-verity can not have a block map")
+	}
+	return nil
 }
 
 func (d *dualRootfsDeviceImpl) PrepareStoreUpdate() error {
@@ -185,38 +347,215 @@ func chunkedCopy(out io.Writer, in io.Reader, chunkSize int64) (totalWritten int
 	}
 }
 
+// rootfsWrite is the state of writing one update to the inactive partition.
+type rootfsWrite struct {
+	// The whole payload, which is read to the end once the update is
+	// written, so that its checksum is verified.
+	payload io.Reader
+	// The part of the payload written to the inactive partition.
+	image io.Reader
+	size  int64
+	// The dm-verity hash tree, which is read from the payload once the
+	// file system is written, and where it is written to.
+	hashTree      io.Reader
+	hashTreeSize  int64
+	hashPartition string
+
+	checkpoint writeCheckpoint
+	resumable  bool
+
+	// The device the update is written to.
+	partition string
+	// The disk image standing in for the inactive partition, if any.
+	diskImage string
+	typeUBI   bool
+	typeMTD   bool
+	device    *BlockDevice
+	chunkSize int
+
+	// The checksum of what is written, if it is known up front, and
+	// otherwise the hash calculating it.
+	checksum string
+	hasher   hash.Hash
+}
+
 func (d *dualRootfsDeviceImpl) StoreUpdate(image io.Reader, info os.FileInfo) error {
 
 	size := info.Size()
+	d.written = nil
 
 	log.Debugf("Trying to install update of size: %d", size)
 	if image == nil || size < 0 {
 		return errors.New("Have invalid update. Aborting.")
 	}
 
+	wr := &rootfsWrite{
+		payload: image,
+		image:   image,
+		size:    size,
+	}
+	if err := d.selectImage(wr); err != nil {
+		return err
+	}
+
 	inactivePartition, err := d.GetInactive()
 	if err != nil {
 		return err
 	}
-
-	// Make sure the file system is not mounted (MEN-2084)
-	if mnt_pt := checkMounted(inactivePartition); mnt_pt != "" {
-		log.Warnf("Inactive partition %q is mounted at %q. "+
-			"This might be caused by some \"auto mount\" service "+
-			"(e.g udisks2) that mounts all block devices. It is "+
-			"recommended to blacklist the partitions used by "+
-			"Mender to avoid any issues.", inactivePartition, mnt_pt)
-		log.Warnf("Performing umount on %q.", mnt_pt)
-		err = syscall.Unmount(inactivePartition, 0)
+	wr.checkpoint = writeCheckpoint{
+		Partition: inactivePartition,
+		Payload:   payloadChecksum(d.payload, info.Name()),
+	}
+	if d.verity != nil {
+		wr.hashPartition, err = d.verityHashPartition(inactivePartition)
 		if err != nil {
-			log.Errorf("Error unmounting partition %s",
-				inactivePartition)
 			return err
 		}
 	}
 
-	typeUBI := system.IsUbiBlockDevice(inactivePartition)
-	if typeUBI {
+	if err := unmountPartition(inactivePartition); err != nil {
+		return err
+	}
+	release, err := d.attachPartition(wr, inactivePartition)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	d.setupBlockDevice(wr)
+	if err := d.checkDeviceSize(wr); err != nil {
+		return err
+	}
+	wr.chunkSize, err = writeChunkSize(wr.device, wr.partition, d.writeBufferSize)
+	if err != nil {
+		return err
+	}
+
+	d.prepareWrite(wr)
+	d.hashWritten(wr, info.Name())
+	return d.writeImage(wr)
+}
+
+// selectImage narrows the payload down to what is written to the inactive
+// partition: the root file system region of disk images, without the
+// dm-verity hash tree.
+func (d *dualRootfsDeviceImpl) selectImage(wr *rootfsWrite) error {
+	if d.region != nil {
+		if err := d.selectDiskImageRegion(wr); err != nil {
+			return err
+		}
+	}
+	if d.blockMap != nil {
+		if err := d.blockMap.check(wr.size); err != nil {
+			return err
+		}
+		log.Infof("Payload has a block map; writing %d of %d bytes",
+			d.blockMap.mappedBytes(wr.size), wr.size)
+	}
+	if d.verity != nil {
+		return d.splitVerityHashTree(wr)
+	}
+	return nil
+}
+
+// selectDiskImageRegion skips to the root file system region of a disk image
+// payload, and limits the image written to it.
+func (d *dualRootfsDeviceImpl) selectDiskImageRegion(wr *rootfsWrite) error {
+	if d.region.offset+d.region.length > wr.size {
+		return errors.Errorf("root file system region (offset %d, length %d) "+
+			"exceeds the size of the disk image (%d bytes)",
+			d.region.offset, d.region.length, wr.size)
+	}
+	if _, err := io.CopyN(ioutil.Discard, wr.image, d.region.offset); err != nil {
+		return errors.Wrap(err, "failed to skip to the root file system in the disk image")
+	}
+	wr.image = io.LimitReader(wr.image, d.region.length)
+	wr.size = d.region.length
+	return nil
+}
+
+// splitVerityHashTree limits the image written to the file system, leaving
+// the dm-verity hash tree after it to be written to the hash partition.
+func (d *dualRootfsDeviceImpl) splitVerityHashTree(wr *rootfsWrite) error {
+	if d.verity.hashOffset >= wr.size {
+		return errors.Errorf("dm-verity hash offset %d is beyond the end "+
+			"of the image (%d bytes)", d.verity.hashOffset, wr.size)
+	}
+	wr.hashTree = wr.image
+	wr.hashTreeSize = wr.size - d.verity.hashOffset
+	wr.image = io.LimitReader(wr.image, d.verity.hashOffset)
+	wr.size = d.verity.hashOffset
+	log.Infof("Payload is protected by dm-verity; writing %d bytes of "+
+		"hash tree to the hash partition", wr.hashTreeSize)
+	return nil
+}
+
+// unmountPartition makes sure the file system of the partition is not
+// mounted (MEN-2084).
+func unmountPartition(partition string) error {
+	mnt_pt := checkMounted(partition)
+	if mnt_pt == "" {
+		return nil
+	}
+	log.Warnf("Inactive partition %q is mounted at %q. "+
+		"This might be caused by some \"auto mount\" service "+
+		"(e.g udisks2) that mounts all block devices. It is "+
+		"recommended to blacklist the partitions used by "+
+		"Mender to avoid any issues.", partition, mnt_pt)
+	log.Warnf("Performing umount on %q.", mnt_pt)
+	if err := syscall.Unmount(partition, 0); err != nil {
+		log.Errorf("Error unmounting partition %s", partition)
+		return err
+	}
+	return nil
+}
+
+// attachPartition attaches a loop device to the disk image standing in for
+// the inactive partition, if it is one, and opens its LUKS container, if it
+// is encrypted, and sets the device the update is written to. The returned
+// function detaches and closes them again.
+func (d *dualRootfsDeviceImpl) attachPartition(wr *rootfsWrite,
+	partition string) (func(), error) {
+
+	var releases []func() error
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			if err := releases[i](); err != nil {
+				log.Error(err.Error())
+			}
+		}
+	}
+
+	var err error
+	if d.openBlockDevice == nil && needsLoopDevice(partition) {
+		loop := &loopDevice{Commander: d.Commander, image: partition}
+		partition, err = loop.attach()
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, loop.detach)
+		wr.diskImage = loop.image
+	}
+
+	if luks := d.luksContainer(partition); luks != nil {
+		// The update is written into the container, through its device
+		// mapper device.
+		partition, err = luks.open()
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, luks.close)
+	}
+
+	wr.partition = partition
+	return release, nil
+}
+
+// setupBlockDevice sets up the block device the update is written to.
+func (d *dualRootfsDeviceImpl) setupBlockDevice(wr *rootfsWrite) {
+	wr.typeUBI = system.IsUbiBlockDevice(wr.partition)
+	if wr.typeUBI {
 		// UBI block devices are not prefixed with /dev due to the fact
 		// that the kernel root= argument does not handle UBI block
 		// devices which are prefixed with /dev
@@ -224,100 +563,348 @@ func (d *dualRootfsDeviceImpl) StoreUpdate(image io.Reader, info os.FileInfo) er
 		// Kernel root= only accepts:
 		// - ubi0_0
 		// - ubi:rootfsa
-		inactivePartition = filepath.Join("/dev", inactivePartition)
+		wr.partition = filepath.Join("/dev", wr.partition)
 	}
-
-	b := &BlockDevice{
-		Path:               inactivePartition,
-		typeUBI:            typeUBI,
-		ImageSize:          size,
+	// Raw MTD devices, such as NAND flash without UBI, are written an erase
+	// block at a time, skipping bad blocks.
+	wr.typeMTD = !wr.typeUBI && system.IsMtdCharDevice(wr.partition)
+
+	wr.device = &BlockDevice{
+		Path:               wr.partition,
+		Open:               d.openBlockDevice,
+		typeUBI:            wr.typeUBI,
+		typeMTD:            wr.typeMTD,
+		ImageSize:          wr.size,
 		FlushIntervalBytes: 4 * 1024 * 1024,
+		DirectIO:           d.directIO,
+		SkipIdentical:      d.skipIdentical,
+		BlockMap:           d.blockMap,
+		DiscardHoles:       d.discardHoles,
 	}
+}
 
-	if bsz, err := b.Size(); err != nil {
+// checkDeviceSize checks that the update fits on the device, resizing UBI
+// volumes if UbiAutoResize is set.
+func (d *dualRootfsDeviceImpl) checkDeviceSize(wr *rootfsWrite) error {
+	bsz, err := wr.device.Size()
+	if err == nil && bsz < uint64(wr.size) && wr.typeUBI && d.ubiAutoResize {
+		log.Infof("Resizing UBI volume %s (%v bytes) to fit the update (%v bytes)",
+			wr.partition, bsz, wr.size)
+		if err := UbiResizeVolume(wr.partition, wr.size); err != nil {
+			log.Errorf("failed to resize UBI volume %s: %v", wr.partition, err)
+			return err
+		}
+		bsz, err = wr.device.Size()
+	}
+	if err != nil {
 		log.Errorf("failed to read size of block device %s: %v",
-			inactivePartition, err)
+			wr.partition, err)
 		return err
-	} else if bsz < uint64(size) {
+	} else if bsz < uint64(wr.size) {
 		log.Errorf("update (%v bytes) is larger than the size of device %s (%v bytes)",
-			size, inactivePartition, bsz)
+			wr.size, wr.partition, bsz)
 		return syscall.ENOSPC
 	}
+	return nil
+}
 
+// writeChunkSize returns the size of the writes to the device.
+func writeChunkSize(b *BlockDevice, partition string, bufferSize int) (int, error) {
 	native_ssz, err := b.SectorSize()
 	if err != nil {
 		log.Errorf("failed to read sector size of block device %s: %v",
-			inactivePartition, err)
-		return err
+			partition, err)
+		return 0, err
 	}
 
 	// The size of an individual sector tends to be quite small.  Rather than
 	// doing a zillion small writes, do medium-size-ish writes that are still
 	// sector aligned.  (Doing too many small writes can put pressure on the
 	// DMA subsystem (unless writes are able to be coalesced) by requiring large numbers of scatter-gather descriptors to be allocated.)
-	chunk_size := native_ssz
-
-	// Pick a multiple of the sector size that's around 1 MiB.
-	for chunk_size < 1*1024*1024 {
-		chunk_size = chunk_size * 2 // avoid doing logarithms...
+	if bufferSize <= 0 {
+		bufferSize = DefaultWriteBufferSize
 	}
 
+	// Pick the smallest multiple of the sector size that's at least the
+	// buffer size.
+	chunk_size := (bufferSize + native_ssz - 1) / native_ssz * native_ssz
+
 	log.Infof("native sector size of block device %s is %v, we will write in chunks of %v",
-		inactivePartition,
+		partition,
 		native_ssz,
 		chunk_size,
 	)
+	return chunk_size, nil
+}
+
+// prepareWrite decides whether the write is resumed, and discards the
+// inactive partition if it is written from the start.
+func (d *dualRootfsDeviceImpl) prepareWrite(wr *rootfsWrite) {
+	// Interrupted writes of raw flash and sparse images are written again
+	// from the start.
+	wr.resumable = d.writeCheckpointPath != "" && wr.checkpoint.Payload != "" &&
+		!wr.typeUBI && !wr.typeMTD && d.blockMap == nil
+	if !wr.resumable && d.writeCheckpointPath != "" {
+		removeWriteCheckpoint(d.writeCheckpointPath)
+	}
+
+	resuming := wr.resumable && canResumeWrite(loadWriteCheckpoint(d.writeCheckpointPath),
+		wr.checkpoint, wr.size, wr.chunkSize)
+	if d.discardFirst {
+		d.discardInactive(wr, resuming)
+	}
+}
+
+// discardInactive discards the inactive partition before writing to it,
+// unless its content is needed.
+func (d *dualRootfsDeviceImpl) discardInactive(wr *rootfsWrite, resuming bool) {
+	if d.skipIdentical {
+		log.Info("Not discarding the inactive partition, as identical " +
+			"blocks are skipped")
+	} else if resuming {
+		log.Info("Not discarding the inactive partition, as writing it is resumed")
+	} else if !wr.typeUBI && !wr.typeMTD {
+		if err := wr.device.Discard(); err != nil {
+			log.Warnf("failed to discard partition %s before writing to it, "+
+				"leaving it as it is: %v", wr.partition, err)
+		}
+	}
+}
+
+// hashWritten sets up the checksum of what is written, if it is verified.
+func (d *dualRootfsDeviceImpl) hashWritten(wr *rootfsWrite, name string) {
+	if !d.verifyWrite {
+		return
+	}
+	// The checksum of the payload covers the whole disk image, and the
+	// holes of sparse images, so the checksum of what is written is
+	// calculated while writing it.
+	if d.region == nil && d.blockMap == nil && d.verity == nil {
+		wr.checksum = payloadChecksum(d.payload, name)
+	}
+	if wr.checksum != "" {
+		return
+	}
+	wr.hasher = sha256.New()
+	if d.blockMap != nil {
+		wr.image = io.TeeReader(wr.image, newSparseWriter(wr.hasher, d.blockMap, nil))
+	} else {
+		wr.image = io.TeeReader(wr.image, wr.hasher)
+	}
+}
+
+// writeImage writes the image to the device.
+func (d *dualRootfsDeviceImpl) writeImage(wr *rootfsWrite) error {
+	// The image up to where an interrupted write stopped is read first,
+	// so that it is part of the checksum verified.
+	var checkpoints *checkpointWriter
+	var err error
+	if wr.resumable {
+		checkpoints, err = resumeWrite(d.writeCheckpointPath, wr.device, wr.image,
+			wr.checkpoint, wr.chunkSize)
+		if err != nil {
+			log.Errorf("failed to resume writing device %v: %v",
+				wr.partition, err)
+			return err
+		}
+	}
 
-	w, err := chunkedCopy(b, image, int64(chunk_size))
+	tw := &timedWriter{w: wr.device}
+	var out io.Writer = tw
+	if d.progressReporter != nil {
+		out = newProgressWriter(tw, wr.size-wr.device.StartOffset, d.progressReporter)
+	}
+	if checkpoints != nil {
+		checkpoints.w = out
+		out = checkpoints
+	}
+	w, err := chunkedCopy(out, wr.image, int64(wr.chunkSize))
+	w += wr.device.StartOffset
 	if err != nil {
 		log.Errorf("failed to write image data to device %v: %v",
-			inactivePartition, err)
+			wr.partition, err)
 	}
 
 	log.Infof("wrote %v/%v bytes of update to device %v",
-		w, size, inactivePartition)
+		w, wr.size, wr.partition)
+
+	if err == nil {
+		err = d.finishImage(wr)
+	}
 
-	if cerr := b.Close(); cerr != nil {
-		log.Errorf("closing device %v failed: %v", inactivePartition, cerr)
+	if cerr := tw.Close(); cerr != nil {
+		log.Errorf("closing device %v failed: %v", wr.partition, cerr)
 		return cerr
 	}
+	if err != nil {
+		return err
+	}
+	if wr.resumable {
+		removeWriteCheckpoint(d.writeCheckpointPath)
+	}
+	if d.throughputRecorder != nil {
+		d.throughputRecorder.RecordWriteThroughput(tw.throughput)
+	}
+	d.recordWritten(wr, w)
+	return nil
+}
+
+// finishImage writes the dm-verity hash tree, and reads the rest of the
+// payload, once the file system is written.
+func (d *dualRootfsDeviceImpl) finishImage(wr *rootfsWrite) error {
+	if d.verity != nil {
+		err := writeVerityHashTree(wr.hashPartition, d.openBlockDevice,
+			io.LimitReader(wr.hashTree, wr.hashTreeSize),
+			wr.hashTreeSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	if d.region != nil {
+		// Read the rest of the disk image, so that the checksum of the
+		// whole payload is verified.
+		if _, err := io.Copy(ioutil.Discard, wr.payload); err != nil {
+			log.Errorf("failed to read the rest of the disk image: %v", err)
+			return err
+		}
+	}
+	return nil
+}
 
-	return err
+// recordWritten records what was written, for InstallUpdate to verify.
+func (d *dualRootfsDeviceImpl) recordWritten(wr *rootfsWrite, size int64) {
+	if !d.verifyWrite {
+		return
+	} else if wr.typeMTD {
+		// Bad blocks skipped when writing would be read back.
+		log.Warn("Verifying updates written to raw MTD devices is not " +
+			"supported; the update will not be verified")
+		return
+	}
+
+	checksum := wr.checksum
+	if wr.hasher != nil {
+		checksum = hex.EncodeToString(wr.hasher.Sum(nil))
+	}
+	path := wr.partition
+	if wr.diskImage != "" && d.luksKeySource == "" {
+		// The loop device is detached by the time it is verified.
+		path = wr.diskImage
+	}
+	d.written = &writtenImage{
+		path:     path,
+		open:     d.openBlockDevice,
+		size:     size,
+		checksum: checksum,
+		blockMap: d.blockMap,
+	}
 }
 
 func (d *dualRootfsDeviceImpl) FinishStoreUpdate() error {
 	return nil
 }
 
-func (d *dualRootfsDeviceImpl) getInactivePartition() (string, string, error) {
-	inactivePartition, err := d.GetInactive()
+// getRollbackPartition returns the partition installed to before the active
+// one; the inactive one, unless there are more than two rootfs partitions.
+func (d *dualRootfsDeviceImpl) getRollbackPartition() (string, error) {
+	if len(d.rootfsParts) <= 2 {
+		inactivePartition, err := d.GetInactive()
+		if err != nil {
+			return "", errors.New("Error obtaining inactive partition: " + err.Error())
+		}
+		return inactivePartition, nil
+	}
+
+	previousPartition, err := d.GetPrevious()
 	if err != nil {
-		return "", "", errors.New("Error obtaining inactive partition: " + err.Error())
+		return "", errors.New("Error obtaining previous partition: " + err.Error())
 	}
+	return previousPartition, nil
+}
 
-	log.Debugf("Marking inactive partition (%s) as the new boot candidate.", inactivePartition)
+// luksContainer returns the LUKS container on the rootfs partition, or nil
+// if the rootfs partitions are not encrypted.
+func (d *dualRootfsDeviceImpl) luksContainer(partition string) *luksContainer {
+	if d.luksKeySource == "" {
+		return nil
+	}
+	return &luksContainer{
+		Commander:      d.Commander,
+		device:         partition,
+		keySource:      d.luksKeySource,
+		keyDescription: d.luksKeyDescription,
+	}
+}
 
-	partitionNumberDecStr := inactivePartition[len(strings.TrimRight(inactivePartition, "0123456789")):]
-	partitionNumberDec, err := strconv.Atoi(partitionNumberDecStr)
+// bootVars returns the boot variables which make the rootfs partition the
+// one to boot: its number, and the UUID of its LUKS container if the
+// partitions are encrypted.
+func (d *dualRootfsDeviceImpl) bootVars(partition string) (BootVars, error) {
+	partitionNumber, partitionNumberHex, err := partitionNumbers(partition)
 	if err != nil {
-		return "", "", errors.New("Invalid inactive partition: " + inactivePartition)
+		return nil, err
+	}
+	vars := BootVars{
+		"mender_boot_part":     partitionNumber,
+		"mender_boot_part_hex": partitionNumberHex,
+	}
+	if d.luksKeySource != "" {
+		uuid, err := luksUUID(d, partition)
+		if err != nil {
+			return nil, err
+		}
+		vars[luksUUIDBootVar] = uuid
 	}
+	return vars, nil
+}
 
-	partitionNumberHexStr := fmt.Sprintf("%X", partitionNumberDec)
+// partitionNumbers returns the index of the partition device, in decimal
+// and hexadecimal.
+func partitionNumbers(partition string) (string, string, error) {
+	index, err := partitionIndex(partition)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Invalid inactive partition: %s", partition)
+	}
 
-	return partitionNumberDecStr, partitionNumberHexStr, nil
+	return strconv.Itoa(index), fmt.Sprintf("%X", index), nil
 }
 
 func (d *dualRootfsDeviceImpl) InstallUpdate() error {
 
-	inactivePartition, inactivePartitionHex, err := d.getInactivePartition()
+	inactivePartition, err := d.GetInactive()
 	if err != nil {
-		return err
+		return errors.New("Error obtaining inactive partition: " + err.Error())
 	}
 
-	log.Info("Enabling partition with new image installed to be a boot candidate: ", string(inactivePartition))
+	if d.verifyWrite {
+		if d.written == nil {
+			log.Warn("The update was not written by this process; " +
+				"skipping the verification of the inactive partition")
+		} else if err := d.verifyWritten(inactivePartition); err != nil {
+			return err
+		}
+	}
+
+	vars, err := d.bootVars(inactivePartition)
+	if err != nil {
+		return errors.Wrap(err, "Error obtaining inactive partition")
+	}
+	if len(d.verityHashParts) > 0 {
+		// Unset if the update is not protected by dm-verity.
+		rootHash := ""
+		if d.verity != nil {
+			rootHash = d.verity.rootHash
+		}
+		vars[verityRootHashBootVar(vars["mender_boot_part"])] = rootHash
+	}
+	log.Debugf("Marking inactive partition (%s) as the new boot candidate.", inactivePartition)
+
+	log.Info("Enabling partition with new image installed to be a boot candidate: ", vars["mender_boot_part"])
 	// For now we are only setting boot variables
-	err = d.WriteEnv(BootVars{"upgrade_available": "1", "mender_boot_part": inactivePartition, "mender_boot_part_hex": inactivePartitionHex, "bootcount": "0"})
+	vars["upgrade_available"] = "1"
+	vars["bootcount"] = "0"
+	err = d.WriteEnv(vars)
 	if err != nil {
 		return err
 	}
@@ -327,6 +914,22 @@ func (d *dualRootfsDeviceImpl) InstallUpdate() error {
 	return nil
 }
 
+// verifyWritten verifies the update written to the inactive partition,
+// opening its LUKS container again if it is encrypted.
+func (d *dualRootfsDeviceImpl) verifyWritten(inactivePartition string) error {
+	if luks := d.luksContainer(inactivePartition); luks != nil {
+		if _, err := luks.open(); err != nil {
+			return err
+		}
+		defer func() {
+			if err := luks.close(); err != nil {
+				log.Error(err.Error())
+			}
+		}()
+	}
+	return d.written.verify()
+}
+
 func (d *dualRootfsDeviceImpl) CommitUpdate() error {
 	// Check if the user has an upgrade to commit, if not, throw an error
 	hasUpdate, err := d.HasUpdate()
@@ -382,10 +985,22 @@ func (d *dualRootfsDeviceImpl) Failure() error {
 }
 
 func (d *dualRootfsDeviceImpl) Cleanup() error {
-	// Nothing to do for rootfs updates.
+	if d.writeCheckpointPath != "" {
+		removeWriteCheckpoint(d.writeCheckpointPath)
+	}
 	return nil
 }
 
+// CanResumeStore returns whether writing an update to the inactive partition
+// was interrupted, and can be resumed where it stopped.
+func (d *dualRootfsDeviceImpl) CanResumeStore() bool {
+	if d.writeCheckpointPath == "" {
+		return false
+	}
+	checkpoint := loadWriteCheckpoint(d.writeCheckpointPath)
+	return checkpoint != nil && checkpoint.Offset > 0
+}
+
 func (d *dualRootfsDeviceImpl) GetType() string {
 	return "rootfs-image"
 }
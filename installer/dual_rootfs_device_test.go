@@ -168,7 +168,10 @@ func Test_installUpdate_existingAndNonInactivePartition(t *testing.T) {
 		t.FailNow()
 	}
 
+	// Partitions which can not be sized are disk images, attached to a
+	// loop device.
 	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 0, errors.New("") }
+	testDevice.Commander = stest.NewTestOSCalls("", 1)
 	if err := testDevice.StoreUpdate(image, &sizeOnlyFileInfo{int64(len(imageContent))}); err == nil {
 		t.FailNow()
 	}
@@ -207,10 +210,30 @@ func Test_Rollback_OK(t *testing.T) {
 	}
 }
 
+func TestRollbackMoreThanTwoPartitions(t *testing.T) {
+	env := &fakeBootEnv{readVars: BootVars{"upgrade_available": "1"}}
+	testDevice := NewDualRootfsDevice(env, nil, DualRootfsDeviceConfig{
+		RootfsParts: []string{"/dev/mmc2", "/dev/mmc3", "/dev/mmc5"},
+	}).(*dualRootfsDeviceImpl)
+	testDevice.active = "/dev/mmc3"
+
+	inactive, err := testDevice.GetInactive()
+	assert.NoError(t, err)
+	assert.Equal(t, "/dev/mmc5", inactive)
+
+	// The update on the active partition is rolled back to the one which
+	// was installed before it.
+	assert.NoError(t, testDevice.Rollback())
+	assert.Equal(t, BootVars{"mender_boot_part": "2", "mender_boot_part_hex": "2",
+		"upgrade_available": "0"}, env.writeVars)
+
+	assert.Nil(t, NewDualRootfsDevice(env, nil, DualRootfsDeviceConfig{}))
+}
+
 func TestDeviceVerifyReboot(t *testing.T) {
 	config := DualRootfsDeviceConfig{
-		"part1",
-		"part2",
+		RootfsPartA: "part1",
+		RootfsPartB: "part2",
 	}
 
 	runner := stest.NewTestOSCalls("", 255)
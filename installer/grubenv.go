@@ -0,0 +1,259 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+// The boot loaders whose environment is supported; see NewBootEnvironment.
+const (
+	BootEnvironmentUBoot       = "u-boot"
+	BootEnvironmentGrub        = "grub"
+	BootEnvironmentSystemdBoot = "systemd-boot"
+	BootEnvironmentTryboot     = "rpi-tryboot"
+)
+
+type BootEnvironmentConfig struct {
+	// One of the BootEnvironment constants; U-Boot if empty.
+	BootLoader string
+	// DefaultGrubEnvPath if empty.
+	GrubEnvPath string
+	// DefaultSystemdBootEntryFormat if empty.
+	SystemdBootEntryFormat string
+	// DefaultAutobootPath if empty.
+	AutobootPath string
+	// See TrybootEnv.BootPartitions.
+	TrybootBootPartitions map[string]string
+}
+
+// DefaultGrubEnvPath is where the GRUB environment block is expected, unless
+// configured otherwise.
+const DefaultGrubEnvPath = "/boot/grub/grubenv"
+
+const (
+	grubEnvHeader = "# GRUB Environment Block\n"
+	// GRUB refuses to write environment blocks of other sizes than the
+	// existing one, which is normally this.
+	grubEnvBlockSize = 1024
+)
+
+// GrubEnv reads and writes the environment block of GRUB, as grub-editenv
+// does, and the load_env and save_env commands of GRUB do at boot. The GRUB
+// configuration is expected to use mender_boot_part, upgrade_available and
+// bootcount as the U-Boot integration does.
+type GrubEnv struct {
+	Path string
+}
+
+func NewGrubEnvironment(path string) *GrubEnv {
+	if path == "" {
+		path = DefaultGrubEnvPath
+	}
+	return &GrubEnv{Path: path}
+}
+
+// NewBootEnvironment returns the environment of the configured boot loader.
+func NewBootEnvironment(config BootEnvironmentConfig, cmd system.Commander) (BootEnvReadWriter, error) {
+	switch config.BootLoader {
+	case "", BootEnvironmentUBoot:
+		return NewEnvironment(cmd), nil
+	case BootEnvironmentGrub:
+		return NewGrubEnvironment(config.GrubEnvPath), nil
+	case BootEnvironmentSystemdBoot:
+		return NewSystemdBootEnvironment(config.SystemdBootEntryFormat)
+	case BootEnvironmentTryboot:
+		return NewTrybootEnvironment(config.AutobootPath, config.TrybootBootPartitions)
+	default:
+		return nil, errors.Errorf("unknown boot environment %q", config.BootLoader)
+	}
+}
+
+// Backslashes and newlines in values are escaped with a backslash.
+var grubEnvEscaper = strings.NewReplacer(`\`, `\\`, "\n", "\\\n")
+
+func grubEnvUnescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseGrubEnv parses an environment block; lines are only ended by
+// newlines which are not escaped.
+func parseGrubEnv(block []byte) (BootVars, error) {
+	if !bytes.HasPrefix(block, []byte(grubEnvHeader)) {
+		return nil, errors.New("invalid GRUB environment block: missing header")
+	}
+	vars := make(BootVars)
+	rest := string(block[len(grubEnvHeader):])
+	for len(rest) > 0 {
+		end := 0
+		for end < len(rest) && rest[end] != '\n' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end > len(rest) {
+			end = len(rest)
+		}
+		line := rest[:end]
+		if end < len(rest) {
+			end++
+		}
+		rest = rest[end:]
+
+		// The block is padded with '#'.
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			return nil, errors.Errorf("invalid GRUB environment variable: %q", line)
+		}
+		vars[line[:eq]] = grubEnvUnescape(line[eq+1:])
+	}
+	return vars, nil
+}
+
+// formatGrubEnv returns an environment block of the given size, holding the
+// variables in alphabetical order.
+func formatGrubEnv(vars BootVars, size int) ([]byte, error) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBufferString(grubEnvHeader)
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, "=\n#") {
+			return nil, errors.Errorf("invalid GRUB environment variable name %q", name)
+		}
+		buf.WriteString(name + "=" + grubEnvEscaper.Replace(vars[name]) + "\n")
+	}
+	if buf.Len() > size {
+		return nil, errors.Errorf("GRUB environment does not fit in its block "+
+			"of %d bytes", size)
+	}
+	buf.Write(bytes.Repeat([]byte{'#'}, size-buf.Len()))
+	return buf.Bytes(), nil
+}
+
+func (e *GrubEnv) read() (BootVars, int, error) {
+	block, err := ioutil.ReadFile(e.Path)
+	if err != nil {
+		if os.IsPermission(err) && os.Geteuid() != 0 {
+			return nil, 0, errors.Wrap(err, "requires root privileges")
+		}
+		return nil, 0, errors.Wrap(err, "failed to read the GRUB environment")
+	}
+	vars, err := parseGrubEnv(block)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to parse %s", e.Path)
+	}
+	return vars, len(block), nil
+}
+
+// ReadEnv returns the given variables which are set, or all of them if none
+// are given.
+func (e *GrubEnv) ReadEnv(names ...string) (BootVars, error) {
+	vars, _, err := e.read()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return vars, nil
+	}
+	found := make(BootVars)
+	for _, name := range names {
+		if value, ok := vars[name]; ok {
+			found[name] = value
+		}
+	}
+	return found, nil
+}
+
+// WriteEnv sets the variables, and unsets those with empty values, as
+// fw_setenv does. The environment block is replaced atomically.
+func (e *GrubEnv) WriteEnv(vars BootVars) error {
+	current, size, err := e.read()
+	if err != nil {
+		return err
+	}
+	for name, value := range vars {
+		if value == "" {
+			delete(current, name)
+		} else {
+			current[name] = value
+		}
+	}
+	block, err := formatGrubEnv(current, size)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceFile(e.Path, block); err != nil {
+		if os.IsPermission(err) && os.Geteuid() != 0 {
+			return errors.Wrap(err, "requires root privileges")
+		}
+		return errors.Wrap(err, "failed to write the GRUB environment")
+	}
+	return nil
+}
+
+// replaceFile replaces the content of the file atomically, by writing it to a
+// temporary file which is renamed over it.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		if err := dir.Sync(); err != nil {
+			log.Debugf("Failed to sync the directory of %s: %v", path, err)
+		}
+		dir.Close()
+	}
+	return nil
+}
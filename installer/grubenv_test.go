@@ -0,0 +1,123 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender/system"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// As written by grub-editenv.
+func grubEnvBlock(vars string) string {
+	block := grubEnvHeader + vars
+	return block + strings.Repeat("#", grubEnvBlockSize-len(block))
+}
+
+func TestGrubEnvReadWrite(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	envPath := path.Join(tdir, "grubenv")
+	require.NoError(t, ioutil.WriteFile(envPath, []byte(grubEnvBlock(
+		"mender_boot_part=2\nupgrade_available=0\nbootcount=0\n"+
+			"escaped=back\\\\slash and new\\\nline\n")), 0644))
+
+	env := NewGrubEnvironment(envPath)
+	vars, err := env.ReadEnv("mender_boot_part", "not_set")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "2"}, vars)
+
+	vars, err = env.ReadEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{
+		"mender_boot_part":  "2",
+		"upgrade_available": "0",
+		"bootcount":         "0",
+		"escaped":           "back\\slash and new\nline",
+	}, vars)
+
+	assert.NoError(t, env.WriteEnv(BootVars{
+		"mender_boot_part":  "3",
+		"upgrade_available": "1",
+		"bootcount":         "",
+	}))
+	block, err := ioutil.ReadFile(envPath)
+	require.NoError(t, err)
+	assert.Equal(t, grubEnvBlock("escaped=back\\\\slash and new\\\nline\n"+
+		"mender_boot_part=3\nupgrade_available=1\n"), string(block))
+	_, err = os.Stat(envPath + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	// The environment must fit the block.
+	err = env.WriteEnv(BootVars{"too_long": strings.Repeat("x", grubEnvBlockSize)})
+	assert.Error(t, err)
+	block2, err := ioutil.ReadFile(envPath)
+	require.NoError(t, err)
+	assert.Equal(t, block, block2)
+}
+
+func TestGrubEnvInvalid(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	envPath := path.Join(tdir, "grubenv")
+
+	env := NewGrubEnvironment(envPath)
+	_, err := env.ReadEnv()
+	assert.Error(t, err)
+	assert.Error(t, env.WriteEnv(BootVars{"upgrade_available": "1"}))
+
+	for _, block := range []string{
+		"mender_boot_part=2\n",
+		grubEnvBlock("no value\n"),
+		grubEnvBlock("=2\n"),
+	} {
+		require.NoError(t, ioutil.WriteFile(envPath, []byte(block), 0644))
+		_, err = env.ReadEnv()
+		assert.Error(t, err, block)
+	}
+
+	require.NoError(t, ioutil.WriteFile(envPath, []byte(grubEnvBlock("")), 0644))
+	assert.Error(t, env.WriteEnv(BootVars{"a=b": "1"}))
+}
+
+func TestNewBootEnvironment(t *testing.T) {
+	env, err := NewBootEnvironment(BootEnvironmentConfig{}, new(system.OsCalls))
+	assert.NoError(t, err)
+	assert.IsType(t, &UBootEnv{}, env)
+
+	env, err = NewBootEnvironment(BootEnvironmentConfig{BootLoader: BootEnvironmentUBoot}, new(system.OsCalls))
+	assert.NoError(t, err)
+	assert.IsType(t, &UBootEnv{}, env)
+
+	env, err = NewBootEnvironment(BootEnvironmentConfig{BootLoader: BootEnvironmentGrub}, new(system.OsCalls))
+	assert.NoError(t, err)
+	assert.Equal(t, &GrubEnv{Path: DefaultGrubEnvPath}, env)
+
+	env, err = NewBootEnvironment(BootEnvironmentConfig{
+		BootLoader:             BootEnvironmentSystemdBoot,
+		SystemdBootEntryFormat: "rootfs-%s.conf",
+	}, new(system.OsCalls))
+	assert.NoError(t, err)
+	assert.Equal(t, &SystemdBootEnv{EntryFormat: "rootfs-%s.conf",
+		StatePath: DefaultSystemdBootStatePath}, env)
+
+	_, err = NewBootEnvironment(BootEnvironmentConfig{BootLoader: "lilo"}, new(system.OsCalls))
+	assert.Error(t, err)
+}
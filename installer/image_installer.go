@@ -0,0 +1,100 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+// ImageInstaller installs root file system images on a device with two root
+// file system partitions (A/B), using the same logic as the client daemon. It
+// is meant for other tools, such as factory flashers and recovery agents, to
+// use without running the daemon.
+//
+// An installation goes through PrepareTarget, WriteImage and Activate, and,
+// after rebooting into the new image, either Commit or Rollback.
+type ImageInstaller interface {
+	// PrepareTarget returns the inactive partition, which is the one
+	// WriteImage writes to.
+	PrepareTarget() (string, error)
+	// WriteImage writes an image of the given size to the inactive
+	// partition.
+	WriteImage(image io.Reader, size int64) error
+	// Activate makes the bootloader try the inactive partition on the next
+	// boot.
+	Activate() error
+	// Commit makes the partition booted after Activate permanent. It
+	// returns ErrorNothingToCommit if there is no activated image.
+	Commit() error
+	// Rollback makes the bootloader boot the partition that was active
+	// before Activate again, if the new image was not committed.
+	Rollback() error
+}
+
+type imageInstaller struct {
+	device *dualRootfsDeviceImpl
+}
+
+// NewImageInstaller returns an ImageInstaller for the root file system
+// partitions of the configuration. The boot environment is typically
+// NewEnvironment(new(system.OsCalls)).
+func NewImageInstaller(env BootEnvReadWriter, sc system.StatCommander,
+	config DualRootfsDeviceConfig) (ImageInstaller, error) {
+
+	device := NewDualRootfsDevice(env, sc, config)
+	if device == nil {
+		return nil, errors.New("both root file system partitions must be configured")
+	}
+	return &imageInstaller{
+		device: device.(*dualRootfsDeviceImpl),
+	}, nil
+}
+
+func (i *imageInstaller) PrepareTarget() (string, error) {
+	return i.device.GetInactive()
+}
+
+func (i *imageInstaller) WriteImage(image io.Reader, size int64) error {
+	return i.device.StoreUpdate(image, &imageInfo{size: size})
+}
+
+func (i *imageInstaller) Activate() error {
+	return i.device.InstallUpdate()
+}
+
+func (i *imageInstaller) Commit() error {
+	return i.device.CommitUpdate()
+}
+
+func (i *imageInstaller) Rollback() error {
+	return i.device.Rollback()
+}
+
+// imageInfo describes an image by its size only, which is all StoreUpdate
+// needs to know.
+type imageInfo struct {
+	size int64
+}
+
+func (i *imageInfo) Name() string       { return "image" }
+func (i *imageInfo) Size() int64        { return i.size }
+func (i *imageInfo) Mode() os.FileMode  { return 0444 }
+func (i *imageInfo) ModTime() time.Time { return time.Time{} }
+func (i *imageInfo) IsDir() bool        { return false }
+func (i *imageInfo) Sys() interface{}   { return nil }
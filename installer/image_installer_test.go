@@ -0,0 +1,98 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewImageInstaller(t *testing.T) {
+	_, err := NewImageInstaller(&fakeBootEnv{}, nil, DualRootfsDeviceConfig{})
+	assert.Error(t, err)
+
+	i, err := NewImageInstaller(&fakeBootEnv{}, nil, DualRootfsDeviceConfig{
+		RootfsPartA: "/dev/mmcblk0p2",
+		RootfsPartB: "/dev/mmcblk0p3",
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, i)
+}
+
+func TestImageInstaller(t *testing.T) {
+	td, err := ioutil.TempDir("", "image-installer")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+	part := path.Join(td, "part3")
+	require.NoError(t, createFile(part))
+
+	old := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = old
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 1024, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 512, nil }
+
+	env := &fakeBootEnv{}
+	var i ImageInstaller = &imageInstaller{
+		device: &dualRootfsDeviceImpl{
+			BootEnvReadWriter: env,
+			partitions:        &partitions{inactive: part},
+		},
+	}
+
+	target, err := i.PrepareTarget()
+	assert.NoError(t, err)
+	assert.Equal(t, part, target)
+
+	image := "rootfs image"
+	assert.NoError(t, i.WriteImage(strings.NewReader(image), int64(len(image))))
+	data, err := ioutil.ReadFile(part)
+	require.NoError(t, err)
+	assert.Equal(t, image, string(data))
+
+	assert.NoError(t, i.Activate())
+	assert.Equal(t, BootVars{
+		"upgrade_available":    "1",
+		"mender_boot_part":     "3",
+		"mender_boot_part_hex": "3",
+		"bootcount":            "0",
+	}, env.writeVars)
+
+	// Nothing activated.
+	env.readVars = BootVars{"upgrade_available": "0"}
+	assert.Equal(t, ErrorNothingToCommit, i.Commit())
+
+	env.readVars = BootVars{"upgrade_available": "1"}
+	assert.NoError(t, i.Commit())
+	assert.Equal(t, BootVars{"upgrade_available": "0"}, env.writeVars)
+
+	// After rebooting into the new image, the old one is the inactive
+	// partition to roll back to.
+	env.writeVars = nil
+	assert.NoError(t, i.Rollback())
+	assert.Equal(t, BootVars{
+		"mender_boot_part":     "3",
+		"mender_boot_part_hex": "3",
+		"upgrade_available":    "0",
+	}, env.writeVars)
+}
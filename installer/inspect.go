@@ -0,0 +1,174 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mendersoftware/mender-artifact/areader"
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+)
+
+// ArtifactSummary is the header information of an artifact, together with the
+// files of its payloads.
+type ArtifactSummary struct {
+	Name              string
+	Version           int
+	CompatibleDevices []string
+	// Only present in version 3 artifacts.
+	Provides *artifact.ArtifactProvides
+	Depends  *artifact.ArtifactDepends
+	Payloads []PayloadSummary
+
+	Signed bool
+	// Set if the artifact is signed and a signature policy was given.
+	SignatureChecked bool
+	SignatureError   error
+}
+
+type PayloadSummary struct {
+	Type     string
+	MetaData map[string]interface{}
+	Files    []PayloadFile
+}
+
+type PayloadFile struct {
+	Name string
+	Size int64
+}
+
+// InspectArtifact reads the artifact, without installing anything, and
+// returns a summary of it. The payload checksums are verified, and the
+// signature too, if a policy is given; a signature which does not match is
+// reported in the summary rather than as an error.
+func InspectArtifact(art io.ReadSeeker, policy *SignaturePolicy) (*ArtifactSummary, error) {
+	// Payload types are only known once the headers are read, and each of
+	// them needs a handler to have its files passed on to us; so read the
+	// headers once to find the types, and then the whole artifact.
+	ar := areader.NewReader(art)
+	ar.VerifySignatureCallback = func(message, sig []byte) error {
+		return nil
+	}
+	if err := ar.ReadArtifactHeaders(); err != nil {
+		return nil, errors.Wrap(err, "installer: failed to read Artifact")
+	}
+	updates := ar.GetUpdates()
+
+	if _, err := art.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	summary := &ArtifactSummary{
+		Payloads: make([]PayloadSummary, len(updates)),
+	}
+	producer := &inspectStorerProducer{payloads: summary.Payloads}
+
+	ar = areader.NewReader(art)
+	registered := make(map[string]bool)
+	for _, update := range updates {
+		if registered[update.Type] {
+			continue
+		}
+		registered[update.Type] = true
+
+		var handler handlers.Installer
+		if update.Type == "rootfs-image" {
+			handler = newRootfsInstaller()
+		} else {
+			handler = handlers.NewModuleImage(update.Type)
+		}
+		handler.SetUpdateStorerProducer(producer)
+		if err := ar.RegisterHandler(handler); err != nil {
+			return nil, errors.Wrapf(err, "failed to register '%s' handler", update.Type)
+		}
+	}
+
+	ar.VerifySignatureCallback = func(message, sig []byte) error {
+		summary.Signed = true
+		if policy != nil {
+			summary.SignatureChecked = true
+			summary.SignatureError = policy.Verify(message, sig)
+		}
+		return nil
+	}
+
+	if err := ar.ReadArtifact(); err != nil {
+		return nil, errors.Wrap(err, "installer: failed to read Artifact")
+	}
+
+	summary.Name = ar.GetArtifactName()
+	summary.Version = ar.GetInfo().Version
+	summary.CompatibleDevices = ar.GetCompatibleDevices()
+	if summary.Version >= 3 {
+		summary.Provides = ar.GetArtifactProvides()
+		summary.Depends = ar.GetArtifactDepends()
+	}
+	return summary, nil
+}
+
+type inspectStorerProducer struct {
+	payloads []PayloadSummary
+}
+
+func (p *inspectStorerProducer) NewUpdateStorer(updateType string,
+	payloadNum int) (handlers.UpdateStorer, error) {
+
+	if payloadNum < 0 || payloadNum >= len(p.payloads) {
+		return nil, errors.Errorf("unexpected payload number %d", payloadNum)
+	}
+	p.payloads[payloadNum].Type = updateType
+	return &inspectStorer{payload: &p.payloads[payloadNum]}, nil
+}
+
+// inspectStorer records the payload instead of storing it.
+type inspectStorer struct {
+	payload *PayloadSummary
+}
+
+func (s *inspectStorer) Initialize(artifactHeaders,
+	artifactAugmentedHeaders artifact.HeaderInfoer,
+	payloadHeaders handlers.ArtifactUpdateHeaders) error {
+
+	metaData, err := payloadHeaders.GetUpdateMetaData()
+	if err != nil {
+		return err
+	}
+	s.payload.MetaData = metaData
+	return nil
+}
+
+func (s *inspectStorer) PrepareStoreUpdate() error {
+	return nil
+}
+
+func (s *inspectStorer) StoreUpdate(r io.Reader, info os.FileInfo) error {
+	// Read the file to the end, so that its checksum is verified.
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return err
+	}
+	s.payload.Files = append(s.payload.Files, PayloadFile{
+		Name: info.Name(),
+		Size: n,
+	})
+	return nil
+}
+
+func (s *inspectStorer) FinishStoreUpdate() error {
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func inspectTestArtifact(t *testing.T, version int, signed bool,
+	policy *SignaturePolicy) (*ArtifactSummary, error) {
+
+	art, err := MakeRootfsImageArtifact(version, signed, false)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(art)
+	require.NoError(t, err)
+	return InspectArtifact(bytes.NewReader(data), policy)
+}
+
+func TestInspectArtifact(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		summary, err := inspectTestArtifact(t, version, false, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "mender-1.1", summary.Name)
+		assert.Equal(t, version, summary.Version)
+		assert.Equal(t, []string{"vexpress-qemu"}, summary.CompatibleDevices)
+		assert.Nil(t, summary.Provides)
+		assert.False(t, summary.Signed)
+		require.Len(t, summary.Payloads, 1)
+		assert.Equal(t, "rootfs-image", summary.Payloads[0].Type)
+		require.Len(t, summary.Payloads[0].Files, 1)
+		assert.Equal(t, int64(len("test update")), summary.Payloads[0].Files[0].Size)
+	}
+}
+
+func TestInspectArtifactSignature(t *testing.T) {
+	// Signed, but no key to check it with.
+	summary, err := inspectTestArtifact(t, 2, true, nil)
+	require.NoError(t, err)
+	assert.True(t, summary.Signed)
+	assert.False(t, summary.SignatureChecked)
+
+	summary, err = inspectTestArtifact(t, 2, true,
+		NewSingleKeyPolicy([]byte(PublicRSAKey)))
+	require.NoError(t, err)
+	assert.True(t, summary.Signed)
+	assert.True(t, summary.SignatureChecked)
+	assert.NoError(t, summary.SignatureError)
+
+	_, otherKey := generateKeyPair(t)
+	summary, err = inspectTestArtifact(t, 2, true, NewSingleKeyPolicy(otherKey))
+	require.NoError(t, err)
+	assert.True(t, summary.Signed)
+	assert.True(t, summary.SignatureChecked)
+	assert.Error(t, summary.SignatureError)
+}
+
+func TestInspectCorruptedArtifact(t *testing.T) {
+	art, err := MakeCorruptedRootfsImageArtifact(2, corruptChecksum)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(art)
+	require.NoError(t, err)
+
+	_, err = InspectArtifact(bytes.NewReader(data), nil)
+	assert.Error(t, err)
+}
@@ -53,6 +53,12 @@ type PayloadUpdatePerformer interface {
 type AllModules struct {
 	// Built-in module.
 	DualRootfs handlers.UpdateStorerProducer
+	// Built-in installers of DirectoryPayloadType, ContainerPayloadType
+	// and ConfigurePayloadType payloads, unless there are external modules
+	// of the types.
+	Directory handlers.UpdateStorerProducer
+	Container handlers.UpdateStorerProducer
+	Configure handlers.UpdateStorerProducer
 	// External modules.
 	Modules *ModuleInstallerFactory
 }
@@ -97,12 +103,21 @@ func Install(art io.ReadCloser, dt string, key []byte, scrDir string,
 func ReadHeaders(art io.ReadCloser, dt string, key []byte, scrDir string,
 	inst *AllModules) (*Installer, []PayloadUpdatePerformer, error) {
 
+	return ReadHeadersWithPolicy(art, dt, NewSingleKeyPolicy(key), scrDir, inst)
+}
+
+// ReadHeadersWithPolicy reads the artifact headers, verifying the artifact
+// signatures according to the given policy. If policy is nil, the signatures
+// are not verified.
+func ReadHeadersWithPolicy(art io.ReadCloser, dt string, policy *SignaturePolicy,
+	scrDir string, inst *AllModules) (*Installer, []PayloadUpdatePerformer, error) {
+
 	var ar *areader.Reader
 	var installers []PayloadUpdatePerformer
 	var err error
 
 	// if there is a verification key artifact must be signed
-	if key != nil {
+	if policy != nil {
 		ar = areader.NewReaderSigned(art)
 	} else {
 		ar = areader.NewReader(art)
@@ -139,15 +154,14 @@ func ReadHeaders(art io.ReadCloser, dt string, key []byte, scrDir string,
 		// MEN-1196 skip verification of the signature if there is no key
 		// provided. This means signed artifact will be installed on all
 		// devices having no key specified.
-		if key == nil {
+		if policy == nil {
 			log.Warn("installer: installing signed artifact without verification " +
 				"as verification key is missing")
 			return nil
 		}
 
 		// Do the verification only if the key is provided.
-		s := artifact.NewVerifier(key)
-		err := s.Verify(message, sig)
+		err := policy.Verify(message, sig)
 		if err == nil {
 			// MEN-2152 Provide confirmation in log that digital signature was authenticated.
 			log.Info("installer: authenticated digital signature of artifact")
@@ -212,19 +226,31 @@ func registerHandlers(ar *areader.Reader, inst *AllModules) error {
 
 	// Built-in rootfs handler.
 	if inst.DualRootfs != nil {
-		rootfs := handlers.NewRootfsInstaller()
+		rootfs := newRootfsInstaller()
 		rootfs.SetUpdateStorerProducer(inst.DualRootfs)
 		if err := ar.RegisterHandler(rootfs); err != nil {
 			return errors.Wrap(err, "failed to register rootfs install handler")
 		}
 	}
 
-	if inst.Modules == nil {
-		return nil
+	var updateTypes []string
+	if inst.Modules != nil {
+		updateTypes = inst.Modules.GetModuleTypes()
+	}
+
+	for updateType, producer := range inst.builtinModules() {
+		if stringInList(updateType, updateTypes) {
+			continue
+		}
+		moduleImage := handlers.NewModuleImage(updateType)
+		moduleImage.SetUpdateStorerProducer(producer)
+		if err := ar.RegisterHandler(moduleImage); err != nil {
+			return errors.Wrapf(err, "failed to register '%s' install handler",
+				updateType)
+		}
 	}
 
 	// Update modules.
-	updateTypes := inst.Modules.GetModuleTypes()
 	for _, updateType := range updateTypes {
 		if updateType == "rootfs-image" {
 			log.Errorf("Found update module called %s, which "+
@@ -262,7 +288,10 @@ func CreateInstallersFromList(inst *AllModules,
 	desiredTypes []string) ([]PayloadUpdatePerformer, error) {
 
 	payloadStorers := make([]handlers.UpdateStorer, len(desiredTypes))
-	typesFromDisk := inst.Modules.GetModuleTypes()
+	var typesFromDisk []string
+	if inst.Modules != nil {
+		typesFromDisk = inst.Modules.GetModuleTypes()
+	}
 
 	for n, desired := range desiredTypes {
 		var err error
@@ -280,14 +309,14 @@ func CreateInstallersFromList(inst *AllModules,
 			continue
 		}
 
-		found := false
-		for _, fromDisk := range typesFromDisk {
-			if fromDisk == desired {
-				found = true
-				break
+		found := stringInList(desired, typesFromDisk)
+		builtin := inst.builtinModules()[desired]
+		if !found && builtin != nil {
+			payloadStorers[n], err = builtin.NewUpdateStorer(desired, n)
+			if err != nil {
+				return nil, err
 			}
-		}
-		if found {
+		} else if found {
 			payloadStorers[n], err = inst.Modules.NewUpdateStorer(desired, n)
 			if err != nil {
 				return nil, err
@@ -302,29 +331,40 @@ func CreateInstallersFromList(inst *AllModules,
 	return getInstallerList(payloadStorers)
 }
 
-func MissingFeaturesCheck(artifactAugmentedHeaders artifact.HeaderInfoer,
-	payloadHeaders handlers.ArtifactUpdateHeaders) error {
-
-	if artifactAugmentedHeaders != nil {
-		return errors.New("Augmented artifacts are not supported yet!")
+// builtinModules returns the built-in installers of module payload types,
+// which external modules of the same types take precedence over.
+func (inst *AllModules) builtinModules() map[string]handlers.UpdateStorerProducer {
+	builtin := make(map[string]handlers.UpdateStorerProducer)
+	if inst.Directory != nil {
+		builtin[DirectoryPayloadType] = inst.Directory
 	}
-
-	deps, err := payloadHeaders.GetUpdateDepends()
-	if err != nil {
-		return err
+	if inst.Container != nil {
+		builtin[ContainerPayloadType] = inst.Container
 	}
-	if deps != nil && len(*deps) != 0 {
-		return errors.New("type_info depends values not yet supported")
+	if inst.Configure != nil {
+		builtin[ConfigurePayloadType] = inst.Configure
 	}
+	return builtin
+}
 
-	provs, err := payloadHeaders.GetUpdateProvides()
-	if err != nil {
-		return err
+func stringInList(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
 	}
-	if provs != nil && len(*provs) != 0 {
-		return errors.New("type_info provides values not yet supported")
+	return false
+}
+
+func MissingFeaturesCheck(artifactAugmentedHeaders artifact.HeaderInfoer,
+	payloadHeaders handlers.ArtifactUpdateHeaders) error {
+
+	if artifactAugmentedHeaders != nil {
+		return errors.New("Augmented artifacts are not supported yet!")
 	}
 
+	// Type info depends and provides are checked against the provides of
+	// the device, see Installer.CheckDepends.
 	return nil
 }
 
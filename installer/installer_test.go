@@ -15,12 +15,17 @@
 package installer
 
 import (
+	"archive/tar"
 	"bytes"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/mendersoftware/mender-artifact/areader"
 	"github.com/mendersoftware/mender-artifact/artifact"
 	"github.com/mendersoftware/mender-artifact/awriter"
 	"github.com/mendersoftware/mender-artifact/handlers"
@@ -103,6 +108,50 @@ func TestInstallNoSignature(t *testing.T) {
 		"expecting signed artifact, but no signature file found")
 }
 
+func TestReadHeadersWithPolicy(t *testing.T) {
+	updateProducers := AllModules{
+		DualRootfs: new(fDevice),
+	}
+	scrDir, err := ioutil.TempDir("", "TestReadHeadersWithPolicy")
+	require.NoError(t, err)
+	defer os.RemoveAll(scrDir)
+
+	_, vendorPub := generateKeyPair(t)
+	_, otherPub := generateKeyPair(t)
+
+	// signed by one of the keys, whichever it is
+	policy := &SignaturePolicy{
+		Keys: []VerificationKey{
+			{Role: "vendor", Key: vendorPub},
+			{Role: "operator", Key: []byte(PublicRSAKey)},
+		},
+	}
+	art, err := MakeRootfsImageArtifact(2, true, false)
+	require.NoError(t, err)
+	_, _, err = ReadHeadersWithPolicy(art, "vexpress-qemu", policy, scrDir, &updateProducers)
+	assert.NoError(t, err)
+
+	// signed by a key not in the policy
+	policy = &SignaturePolicy{
+		Keys: []VerificationKey{
+			{Role: "vendor", Key: vendorPub},
+			{Role: "operator", Key: otherPub},
+		},
+	}
+	art, err = MakeRootfsImageArtifact(2, true, false)
+	require.NoError(t, err)
+	_, _, err = ReadHeadersWithPolicy(art, "vexpress-qemu", policy, scrDir, &updateProducers)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(),
+		"artifact is not signed with any of the verification keys")
+
+	// unsigned
+	art, err = MakeRootfsImageArtifact(2, false, false)
+	require.NoError(t, err)
+	_, _, err = ReadHeadersWithPolicy(art, "vexpress-qemu", policy, scrDir, &updateProducers)
+	assert.Error(t, err)
+}
+
 func TestInstallWithScripts(t *testing.T) {
 	updateProducers := AllModules{
 		DualRootfs: new(fDevice),
@@ -120,6 +169,56 @@ func TestInstallWithScripts(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestInstallCorruptedArtifact(t *testing.T) {
+	updateProducers := AllModules{
+		DualRootfs: new(fDevice),
+	}
+
+	tests := map[string]struct {
+		version    int
+		corruption artifactCorruption
+		errMsg     string
+	}{
+		"bad checksum": {2, corruptChecksum, "invalid checksum"},
+		"truncated v1": {1, corruptTruncated, ""},
+		"truncated v2": {2, corruptTruncated, ""},
+		"bad version":  {2, corruptVersion, "unsupported version"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			art, err := MakeCorruptedRootfsImageArtifact(test.version, test.corruption)
+			require.NoError(t, err)
+
+			_, err = Install(art, "vexpress-qemu", nil, "", &updateProducers)
+			require.Error(t, err)
+			if test.errMsg != "" {
+				assert.Contains(t, err.Error(), test.errMsg)
+			}
+		})
+	}
+}
+
+func TestInstallCompressedArtifacts(t *testing.T) {
+	updateProducers := AllModules{
+		DualRootfs: new(fDevice),
+	}
+
+	// Payloads are decompressed, and their checksum verified, while they
+	// are streamed to the device, with any of the compressors built in.
+	for _, id := range artifact.GetRegisteredCompressorIds() {
+		t.Run(id, func(t *testing.T) {
+			comp, err := artifact.NewCompressorFromId(id)
+			require.NoError(t, err)
+			art, err := makeRootfsImageArtifact(2, false, false, comp)
+			require.NoError(t, err)
+
+			_, err = Install(art, "vexpress-qemu", nil, "", &updateProducers)
+			assert.NoError(t, err)
+		})
+	}
+}
+
 func TestCorrectUpdateProducerReturned(t *testing.T) {
 	updateProducers := AllModules{
 		DualRootfs: new(fDevice),
@@ -161,23 +260,17 @@ func TestMissingFeaturesRejected(t *testing.T) {
 	_, err = Install(art, "vexpress-qemu", nil, "", &updateProducers)
 	assert.NoError(t, err)
 
+	// Type info depends and provides are supported, and checked by
+	// CheckDepends.
 	art, err = MakeUnsupportedRootfsImageArtifact(3, &artifact.TypeInfoDepends{
 		"rootfs_image_checksum": "00",
-	}, &artifact.TypeInfoProvides{}, false)
-	require.NoError(t, err)
-
-	_, err = Install(art, "vexpress-qemu", nil, "", &updateProducers)
-	require.Error(t, err)
-	assert.Contains(t, err.Error(), "type_info depends values not yet supported")
-
-	art, err = MakeUnsupportedRootfsImageArtifact(3, &artifact.TypeInfoDepends{}, &artifact.TypeInfoProvides{
-		"rootfs_image_checksum": "00",
+	}, &artifact.TypeInfoProvides{
+		"rootfs_image_checksum": "11",
 	}, false)
 	require.NoError(t, err)
 
 	_, err = Install(art, "vexpress-qemu", nil, "", &updateProducers)
-	require.Error(t, err)
-	assert.Contains(t, err.Error(), "type_info provides values not yet supported")
+	assert.NoError(t, err)
 
 	art, err = MakeUnsupportedRootfsImageArtifact(3, &artifact.TypeInfoDepends{}, &artifact.TypeInfoProvides{}, true)
 	require.NoError(t, err)
@@ -285,6 +378,12 @@ r3rtT0ysHWd7l+Kx/SUCQGlitd5RDfdHl+gKrCwhNnRG7FzRLv5YOQV81+kh7SkU
 
 func MakeRootfsImageArtifact(version int, signed bool,
 	hasScripts bool) (io.ReadCloser, error) {
+	return makeRootfsImageArtifact(version, signed, hasScripts,
+		artifact.NewCompressorGzip())
+}
+
+func makeRootfsImageArtifact(version int, signed bool,
+	hasScripts bool, comp artifact.Compressor) (io.ReadCloser, error) {
 	upd, err := MakeFakeUpdate("test update")
 	if err != nil {
 		return nil, err
@@ -293,7 +392,6 @@ func MakeRootfsImageArtifact(version int, signed bool,
 
 	art := bytes.NewBuffer(nil)
 	var aw *awriter.Writer
-	comp := artifact.NewCompressorGzip()
 	if !signed {
 		aw = awriter.NewWriter(art, comp)
 	} else {
@@ -380,6 +478,91 @@ func MakeDoubleRootfsImageArtifact(version int) (io.ReadCloser, error) {
 	return &rc{art}, nil
 }
 
+// rootfsMetaDataComposer writes the header of a version 3 rootfs-image
+// payload with meta-data, which the mender-artifact composer refuses.
+type rootfsMetaDataComposer struct {
+	*handlers.Rootfs
+}
+
+func (c *rootfsMetaDataComposer) ComposeHeader(args *handlers.ComposeHeaderArgs) error {
+	path := artifact.UpdateHeaderPath(args.No)
+	sw := artifact.NewTarWriterStream(args.TarWriter)
+
+	typeInfo, err := json.Marshal(args.TypeInfoV3)
+	if err != nil {
+		return err
+	}
+	if err := sw.Write(typeInfo, filepath.Join(path, "type-info")); err != nil {
+		return err
+	}
+
+	var metaData []byte
+	if len(args.MetaData) != 0 {
+		metaData, err = json.Marshal(args.MetaData)
+		if err != nil {
+			return err
+		}
+	}
+	return sw.Write(metaData, filepath.Join(path, "meta-data"))
+}
+
+// makeRootfsImageArtifactWithMetaData makes a version 3 rootfs-image artifact
+// whose payload carries the given meta-data.
+func makeRootfsImageArtifactWithMetaData(
+	metaData map[string]interface{}) (io.ReadCloser, error) {
+
+	upd, err := MakeFakeUpdate("test update")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(upd)
+
+	art := bytes.NewBuffer(nil)
+	aw := awriter.NewWriter(art, artifact.NewCompressorGzip())
+	updates := &awriter.Updates{
+		Updates: []handlers.Composer{&rootfsMetaDataComposer{handlers.NewRootfsV3(upd)}},
+	}
+	err = aw.WriteArtifact(&awriter.WriteArtifactArgs{
+		Format:  "mender",
+		Version: 3,
+		Devices: []string{"vexpress-qemu"},
+		Name:    "mender-1.1",
+		Updates: updates,
+		Scripts: &artifact.Scripts{},
+		Depends: &artifact.ArtifactDepends{
+			CompatibleDevices: []string{"vexpress-qemu"},
+		},
+		Provides: &artifact.ArtifactProvides{
+			ArtifactName: "artifact-name",
+		},
+		TypeInfoV3: &artifact.TypeInfoV3{
+			Type: "rootfs-image",
+		},
+		MetaData: metaData,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rc{art}, nil
+}
+
+// readRootfsImageArtifactHeaders reads the headers of a rootfs-image
+// artifact, and returns those of its payload.
+func readRootfsImageArtifactHeaders(art io.Reader) (handlers.ArtifactUpdateHeaders, error) {
+	ar := areader.NewReader(art)
+	if err := ar.RegisterHandler(newRootfsInstaller()); err != nil {
+		return nil, err
+	}
+	if err := ar.ReadArtifactHeaders(); err != nil {
+		return nil, err
+	}
+	payloads := ar.GetHandlers()
+	if len(payloads) != 1 {
+		return nil, errors.Errorf("expected one payload, got %d", len(payloads))
+	}
+	return payloads[0], nil
+}
+
 func MakeUnsupportedRootfsImageArtifact(version int,
 	dep *artifact.TypeInfoDepends, prov *artifact.TypeInfoProvides,
 	augmented bool) (io.ReadCloser, error) {
@@ -436,6 +619,118 @@ func MakeUnsupportedRootfsImageArtifact(version int,
 	return &rc{art}, nil
 }
 
+// Ways in which MakeCorruptedRootfsImageArtifact breaks an artifact.
+type artifactCorruption int
+
+const (
+	// The checksum of the payload in the manifest does not match.
+	corruptChecksum artifactCorruption = iota
+	// The artifact ends in the middle of the payload data.
+	corruptTruncated
+	// The version header has an unsupported version.
+	corruptVersion
+)
+
+// MakeCorruptedRootfsImageArtifact returns a rootfs-image artifact which is
+// deliberately broken, to test how installation failures are handled. Version
+// 1 artifacts have no manifest, so corruptChecksum needs version 2 or later.
+func MakeCorruptedRootfsImageArtifact(version int,
+	corruption artifactCorruption) (io.ReadCloser, error) {
+
+	art, err := MakeRootfsImageArtifact(version, false, false)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(art)
+	if err != nil {
+		return nil, err
+	}
+
+	switch corruption {
+	case corruptChecksum:
+		data, err = rewriteArtifact(data, "manifest", func(content []byte) []byte {
+			lines := strings.Split(string(content), "\n")
+			for n, line := range lines {
+				if strings.Contains(line, "data/") {
+					// Flip the first digit of the checksum.
+					if line[0] == '0' {
+						lines[n] = "1" + line[1:]
+					} else {
+						lines[n] = "0" + line[1:]
+					}
+				}
+			}
+			return []byte(strings.Join(lines, "\n"))
+		})
+	case corruptTruncated:
+		data, err = truncateArtifact(data, "data/0000.tar.gz")
+	case corruptVersion:
+		data, err = rewriteArtifact(data, "version", func([]byte) []byte {
+			return []byte(`{"format": "mender", "version": 42}`)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rc{bytes.NewBuffer(data)}, nil
+}
+
+// truncateArtifact cuts the artifact in the middle of the named file in its
+// outer tar archive.
+func truncateArtifact(data []byte, name string) ([]byte, error) {
+	r := bytes.NewReader(data)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.Errorf("%s not found in artifact", name)
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			// The reader is positioned at the start of the content.
+			start := len(data) - r.Len()
+			return data[:start+int(hdr.Size/2)], nil
+		}
+	}
+}
+
+// rewriteArtifact replaces the content of the named file in the outer tar
+// archive of the artifact.
+func rewriteArtifact(data []byte, name string,
+	rewrite func(content []byte) []byte) ([]byte, error) {
+
+	out := bytes.NewBuffer(nil)
+	tr := tar.NewReader(bytes.NewReader(data))
+	tw := tar.NewWriter(out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			content = rewrite(content)
+			hdr.Size = int64(len(content))
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err = tw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
 func MakeFakeUpdate(data string) (string, error) {
 	f, err := ioutil.TempFile("", "test_update")
 	if err != nil {
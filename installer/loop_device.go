@@ -0,0 +1,101 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+// isDiskImage returns whether the rootfs partition is a disk image file
+// rather than a device, as when the updates are tried out in QEMU or CI
+// without real block devices.
+func isDiskImage(partition string) bool {
+	info, err := os.Stat(partition)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// needsLoopDevice returns whether the rootfs partition is a disk image which
+// can not be written like a block device, and so is attached to a loop device.
+func needsLoopDevice(partition string) bool {
+	if !isDiskImage(partition) {
+		return false
+	}
+	f, err := os.Open(partition)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = BlockDeviceGetSizeOf(f)
+	return err != nil
+}
+
+// diskImagePartitionName returns the name of a disk image file without its
+// extension, so that rootfs2.img is numbered as partition 2.
+func diskImagePartitionName(partition string) string {
+	name := filepath.Base(partition)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// loopDevice is a loop device attached to a disk image standing in for a
+// rootfs partition, which the update is written into like into a partition.
+type loopDevice struct {
+	system.Commander
+	image  string
+	device string
+}
+
+// attach attaches the disk image to the first free loop device, detaching
+// any left attached by an update which was interrupted, and returns the path
+// of the loop device.
+func (l *loopDevice) attach() (string, error) {
+	output, err := l.Command("losetup", "--noheadings", "--output", "NAME",
+		"--associated", l.image).Output()
+	if err == nil {
+		for _, device := range strings.Fields(string(output)) {
+			log.Infof("Detaching the loop device %s left by a previous update",
+				device)
+			if err := (&loopDevice{Commander: l.Commander, device: device}).detach(); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	output, err = l.Command("losetup", "--find", "--show", l.image).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to attach the disk image %s to a loop device",
+			l.image)
+	}
+	l.device = strings.TrimSpace(string(output))
+	if l.device == "" {
+		return "", errors.Errorf("no loop device was attached to the disk image %s",
+			l.image)
+	}
+	log.Infof("Attached the disk image %s to %s", l.image, l.device)
+	return l.device, nil
+}
+
+func (l *loopDevice) detach() error {
+	output, err := l.Command("losetup", "--detach", l.device).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to detach the loop device %s: %s",
+			l.device, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoopDeviceAttach(t *testing.T) {
+	calls := &containerTestCalls{
+		outputs: map[string]string{
+			"losetup --find --show /images/rootfs3.img": "/dev/loop0\n",
+		},
+	}
+	loop := &loopDevice{Commander: calls, image: "/images/rootfs3.img"}
+	device, err := loop.attach()
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/loop0", device)
+	require.NoError(t, loop.detach())
+	assert.Equal(t, []string{
+		"losetup --noheadings --output NAME --associated /images/rootfs3.img",
+		"losetup --find --show /images/rootfs3.img",
+		"losetup --detach /dev/loop0",
+	}, calls.commands)
+
+	// Loop devices left by an interrupted update are detached first.
+	calls.commands = nil
+	calls.outputs["losetup --noheadings --output NAME --associated /images/rootfs3.img"] =
+		"/dev/loop1\n"
+	_, err = loop.attach()
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"losetup --noheadings --output NAME --associated /images/rootfs3.img",
+		"losetup --detach /dev/loop1",
+		"losetup --find --show /images/rootfs3.img",
+	}, calls.commands)
+
+	calls.fail = map[string]bool{"losetup --find --show /images/rootfs3.img": true}
+	_, err = loop.attach()
+	assert.Error(t, err)
+}
+
+func TestDiskImagePartitions(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestDiskImagePartitions")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	image := filepath.Join(tmpdir, "rootfs3.img")
+	require.NoError(t, ioutil.WriteFile(image, nil, 0600))
+	assert.True(t, isDiskImage(image))
+	assert.False(t, isDiskImage(tmpdir))
+	assert.False(t, isDiskImage(filepath.Join(tmpdir, "rootfs2.img")))
+
+	// Disk images are numbered by their names, without the extension.
+	number, hex, err := partitionNumbers(image)
+	require.NoError(t, err)
+	assert.Equal(t, "3", number)
+	assert.Equal(t, "3", hex)
+	assert.True(t, checkBootEnvAndRootPartitionMatch("3", image))
+	assert.False(t, checkBootEnvAndRootPartitionMatch("2", image))
+}
+
+func TestNeedsLoopDevice(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestNeedsLoopDevice")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	image := filepath.Join(tmpdir, "rootfs2.img")
+	require.NoError(t, ioutil.WriteFile(image, nil, 0600))
+	assert.True(t, needsLoopDevice(image))
+	assert.False(t, needsLoopDevice(tmpdir))
+
+	// Nor if it can be written like a block device.
+	oldSizeOf := BlockDeviceGetSizeOf
+	defer func() { BlockDeviceGetSizeOf = oldSizeOf }()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 1 << 20, nil }
+	assert.False(t, needsLoopDevice(image))
+}
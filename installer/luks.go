@@ -0,0 +1,133 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+// The sources of the key of LUKS encrypted rootfs partitions.
+const (
+	// The key is read from the user keyring of the kernel, by its
+	// description.
+	LUKSKeySourceKeyring = "keyring"
+	// The key is unsealed by the TPM, with the systemd-tpm2 token of the
+	// LUKS header.
+	LUKSKeySourceTPM2 = "tpm2"
+)
+
+// The device mapper name under which the LUKS container of the inactive
+// partition is opened while the update is written to it.
+const luksMappingName = "mender-update"
+
+// The boot variable holding the LUKS UUID of the rootfs partition to boot,
+// for the boot loader to give the initramfs, as rd.luks.uuid= for instance.
+const luksUUIDBootVar = "mender_boot_luks_uuid"
+
+var luksMapperDir = "/dev/mapper"
+
+// luksContainer is a LUKS (dm-crypt) container on a rootfs partition, which
+// the update is written into through its device mapper device.
+type luksContainer struct {
+	system.Commander
+	device         string
+	keySource      string
+	keyDescription string
+}
+
+// CheckLUKSConfig checks the source and description of the key of LUKS
+// encrypted rootfs partitions.
+func CheckLUKSConfig(keySource, keyDescription string) error {
+	switch keySource {
+	case "", LUKSKeySourceTPM2:
+	case LUKSKeySourceKeyring:
+		if keyDescription == "" {
+			return errors.New("the description of the key in the keyring " +
+				"of LUKS encrypted rootfs partitions is not set")
+		}
+	default:
+		return errors.Errorf("unknown LUKS key source %q", keySource)
+	}
+	return nil
+}
+
+// mapperPath returns the path of the device mapper device of the opened
+// container.
+func (l *luksContainer) mapperPath() string {
+	return filepath.Join(luksMapperDir, luksMappingName)
+}
+
+// open opens the container, closing any mapping left behind by an update
+// which was interrupted, and returns the path of the device mapper device.
+func (l *luksContainer) open() (string, error) {
+	if err := l.Command("cryptsetup", "status", luksMappingName).Run(); err == nil {
+		log.Infof("Closing the LUKS mapping %s left by a previous update",
+			luksMappingName)
+		if err := l.close(); err != nil {
+			return "", err
+		}
+	}
+
+	args := []string{"open", "--type", "luks", "--allow-discards"}
+	var key []byte
+	switch l.keySource {
+	case LUKSKeySourceKeyring:
+		var err error
+		key, err = l.Command("keyctl", "pipe", "%user:"+l.keyDescription).Output()
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read the LUKS key %q from the keyring",
+				l.keyDescription)
+		}
+		args = append(args, "--key-file", "-")
+	case LUKSKeySourceTPM2:
+		args = append(args, "--token-only", "--token-type", "systemd-tpm2")
+	}
+	args = append(args, l.device, luksMappingName)
+
+	cmd := l.Command("cryptsetup", args...)
+	if key != nil {
+		cmd.Stdin = bytes.NewReader(key)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.Wrapf(err, "failed to open the LUKS container on %s: %s",
+			l.device, strings.TrimSpace(string(output)))
+	}
+	log.Infof("Opened the LUKS container on %s as %s", l.device, l.mapperPath())
+	return l.mapperPath(), nil
+}
+
+func (l *luksContainer) close() error {
+	output, err := l.Command("cryptsetup", "close", luksMappingName).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "failed to close the LUKS mapping %s: %s",
+			luksMappingName, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// luksUUID returns the LUKS UUID of the container on the partition, by which the
+// initramfs finds and opens it.
+func luksUUID(cmd system.Commander, partition string) (string, error) {
+	output, err := cmd.Command("cryptsetup", "luksUUID", partition).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read the LUKS UUID of %s", partition)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	stest "github.com/mendersoftware/mender/system/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// luksTestCalls records the commands run, and fails those in fail.
+type luksTestCalls struct {
+	*stest.TestOSCalls
+	commands []string
+	fail     map[string]bool
+}
+
+func (c *luksTestCalls) Command(name string, args ...string) *exec.Cmd {
+	command := strings.Join(append([]string{name}, args...), " ")
+	c.commands = append(c.commands, command)
+	if c.fail[command] {
+		return stest.NewTestOSCalls("", 1).Command(name, args...)
+	}
+	return c.TestOSCalls.Command(name, args...)
+}
+
+func TestCheckLUKSConfig(t *testing.T) {
+	assert.NoError(t, CheckLUKSConfig("", ""))
+	assert.NoError(t, CheckLUKSConfig(LUKSKeySourceTPM2, ""))
+	assert.NoError(t, CheckLUKSConfig(LUKSKeySourceKeyring, "mender:rootfs"))
+	assert.Error(t, CheckLUKSConfig(LUKSKeySourceKeyring, ""))
+	assert.Error(t, CheckLUKSConfig("passphrase", ""))
+}
+
+func TestLUKSContainerOpen(t *testing.T) {
+	calls := &luksTestCalls{
+		TestOSCalls: stest.NewTestOSCalls("", 0),
+		fail:        map[string]bool{"cryptsetup status mender-update": true},
+	}
+	luks := &luksContainer{
+		Commander:      calls,
+		device:         "/dev/mmcblk0p3",
+		keySource:      LUKSKeySourceKeyring,
+		keyDescription: "mender:rootfs",
+	}
+	mapped, err := luks.open()
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/mapper/mender-update", mapped)
+	assert.Equal(t, []string{
+		"cryptsetup status mender-update",
+		"keyctl pipe %user:mender:rootfs",
+		"cryptsetup open --type luks --allow-discards --key-file - " +
+			"/dev/mmcblk0p3 mender-update",
+	}, calls.commands)
+
+	// A mapping left by an interrupted update is closed first.
+	calls.commands = nil
+	calls.fail = nil
+	luks.keySource = LUKSKeySourceTPM2
+	_, err = luks.open()
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"cryptsetup status mender-update",
+		"cryptsetup close mender-update",
+		"cryptsetup open --type luks --allow-discards --token-only " +
+			"--token-type systemd-tpm2 /dev/mmcblk0p3 mender-update",
+	}, calls.commands)
+
+	calls.commands = nil
+	require.NoError(t, luks.close())
+	assert.Equal(t, []string{"cryptsetup close mender-update"}, calls.commands)
+
+	// Failing to read the key.
+	calls.fail = map[string]bool{
+		"cryptsetup status mender-update": true,
+		"keyctl pipe %user:mender:rootfs": true,
+	}
+	luks.keySource = LUKSKeySourceKeyring
+	_, err = luks.open()
+	assert.Error(t, err)
+}
+
+func TestLUKSBootVars(t *testing.T) {
+	calls := &luksTestCalls{
+		TestOSCalls: stest.NewTestOSCalls("6d1e8f5c-2b1a-4c3e-9a55-0e5f4b1f2d7c", 0),
+	}
+	d := &dualRootfsDeviceImpl{Commander: calls}
+
+	vars, err := d.bootVars("/dev/nvme0n1p3")
+	require.NoError(t, err)
+	assert.Equal(t, BootVars{
+		"mender_boot_part":     "3",
+		"mender_boot_part_hex": "3",
+	}, vars)
+	assert.Empty(t, calls.commands)
+
+	d.luksKeySource = LUKSKeySourceTPM2
+	vars, err = d.bootVars("/dev/nvme0n1p3")
+	require.NoError(t, err)
+	assert.Equal(t, BootVars{
+		"mender_boot_part":      "3",
+		"mender_boot_part_hex":  "3",
+		"mender_boot_luks_uuid": "6d1e8f5c-2b1a-4c3e-9a55-0e5f4b1f2d7c",
+	}, vars)
+	assert.Equal(t, []string{"cryptsetup luksUUID /dev/nvme0n1p3"}, calls.commands)
+
+	calls.fail = map[string]bool{"cryptsetup luksUUID /dev/nvme0n1p3": true}
+	_, err = d.bootVars("/dev/nvme0n1p3")
+	assert.Error(t, err)
+}
@@ -356,6 +356,7 @@ const (
 type namedReader struct {
 	r    io.Reader
 	name string
+	size int64
 }
 
 type moduleDownload struct {
@@ -371,6 +372,11 @@ type moduleDownload struct {
 
 	finishChannel chan bool
 
+	// Set if the module answered "Yes" to the ProvidePayloadFileSizes
+	// query, in which case the size of each stream follows its name in
+	// "stream-next".
+	payloadFileSizes bool
+
 	////////////////////////////////////////////////////////////////////////
 	// Status variables for mail loop.
 	////////////////////////////////////////////////////////////////////////
@@ -469,7 +475,8 @@ func (d *moduleDownload) handleNextArtifactStream() error {
 		// Download new stream to update module using "stream-next" and
 		// "streams" directory.
 		var err error
-		d.streamNext, err = d.publishNameInStreamNext(d.currentStream.name)
+		d.streamNext, err = d.publishNameInStreamNext(d.currentStream.name,
+			d.currentStream.size)
 		if err != nil {
 			return err
 		}
@@ -532,7 +539,7 @@ func (d *moduleDownload) handleFinishChannel() error {
 	if d.downloaderType != menderDownloader {
 		// Publish empty entry to signal end of streams.
 		var err error
-		d.streamNext, err = d.publishNameInStreamNext("")
+		d.streamNext, err = d.publishNameInStreamNext("", 0)
 		if err != nil {
 			return err
 		}
@@ -616,7 +623,7 @@ func (d *moduleDownload) downloadProcessLoop() error {
 	}
 }
 
-func (d *moduleDownload) publishNameInStreamNext(name string) (*stream, error) {
+func (d *moduleDownload) publishNameInStreamNext(name string, size int64) (*stream, error) {
 	if name != "" {
 		streamName := path.Join(d.payloadPath, "streams", name)
 		err := syscall.Mkfifo(streamName, 0600)
@@ -628,6 +635,8 @@ func (d *moduleDownload) publishNameInStreamNext(name string) (*stream, error) {
 	var streamNextStr string
 	if name == "" {
 		streamNextStr = ""
+	} else if d.payloadFileSizes {
+		streamNextStr = fmt.Sprintf("streams/%s %d\n", name, size)
 	} else {
 		streamNextStr = fmt.Sprintf("streams/%s\n", name)
 	}
@@ -653,8 +662,8 @@ func (d *moduleDownload) initializeMenderDownload() error {
 	return err
 }
 
-func (d *moduleDownload) downloadStream(r io.Reader, name string) error {
-	d.nextArtifactStream <- &namedReader{r, name}
+func (d *moduleDownload) downloadStream(r io.Reader, name string, size int64) error {
+	d.nextArtifactStream <- &namedReader{r, name, size}
 	err := <-d.status
 	return err
 }
@@ -698,6 +707,11 @@ func (mod *ModuleInstaller) Initialize(artifactHeaders,
 func (mod *ModuleInstaller) PrepareStoreUpdate() error {
 	log.Debug("Executing ModuleInstaller.PrepareStoreUpdate")
 
+	payloadFileSizes, err := mod.providesPayloadFileSizes()
+	if err != nil {
+		return err
+	}
+
 	payloadPath := mod.payloadPath()
 
 	log.Debugf("Calling module: %s Download %s", mod.programPath, payloadPath)
@@ -713,7 +727,7 @@ func (mod *ModuleInstaller) PrepareStoreUpdate() error {
 		Setpgid: true,
 	}
 
-	err := storeUpdateCmd.Start()
+	err = storeUpdateCmd.Start()
 	if err != nil {
 		log.Errorf("Module could not be executed: %s", err.Error())
 		return errors.Wrap(err, "Module could not be executed")
@@ -723,12 +737,30 @@ func (mod *ModuleInstaller) PrepareStoreUpdate() error {
 	// One extra minute to clean up before sending SIGKILL
 	mod.processKiller = newDelayKiller(storeUpdateCmd.Process, timeout, 1*time.Minute)
 	mod.downloader = newModuleDownload(mod.payloadPath(), storeUpdateCmd)
+	mod.downloader.payloadFileSizes = payloadFileSizes
 
 	go mod.downloader.detachedDownloadProcess()
 
 	return nil
 }
 
+// providesPayloadFileSizes asks the module whether it wants the size of each
+// stream along with its name in "stream-next".
+func (mod *ModuleInstaller) providesPayloadFileSizes() (bool, error) {
+	output, err := mod.callModule("ProvidePayloadFileSizes", true)
+	if err != nil {
+		return false, err
+	} else if output == "" || output == "No" {
+		return false, nil
+	} else if output == "Yes" {
+		log.Debug("Module wants the sizes of the payload files")
+		return true, nil
+	} else {
+		return false, fmt.Errorf("Unexpected reply from update module ProvidePayloadFileSizes query: %s",
+			output)
+	}
+}
+
 func (mod *ModuleInstaller) StoreUpdate(r io.Reader, info os.FileInfo) error {
 	log.Debug("Executing ModuleInstaller.StoreUpdate")
 
@@ -736,7 +768,7 @@ func (mod *ModuleInstaller) StoreUpdate(r io.Reader, info os.FileInfo) error {
 		return errors.New("Internal error: StoreUpdate() called when download is inactive")
 	}
 
-	return mod.downloader.downloadStream(r, info.Name())
+	return mod.downloader.downloadStream(r, info.Name(), info.Size())
 }
 
 func (mod *ModuleInstaller) FinishStoreUpdate() error {
@@ -245,7 +245,8 @@ func TestStreamsTree(t *testing.T) {
 	assert.Equal(t, 0, len(dirlist))
 }
 
-func moduleDownloadSetup(t *testing.T, tmpdir, helperArg string) (*moduleDownload, *delayKiller) {
+func moduleDownloadSetup(t *testing.T, tmpdir, helperArg string,
+	payloadFileSizes bool) (*moduleDownload, *delayKiller) {
 	require.NoError(t, os.MkdirAll(path.Join(tmpdir, "streams"), 0700))
 	require.NoError(t, os.MkdirAll(path.Join(tmpdir, "tmp"), 0700))
 	require.NoError(t, syscall.Mkfifo(path.Join(tmpdir, "stream-next"), 0600))
@@ -264,6 +265,7 @@ func moduleDownloadSetup(t *testing.T, tmpdir, helperArg string) (*moduleDownloa
 	delayKiller := newDelayKiller(cmd.Process, 5*time.Second, time.Second)
 
 	download := newModuleDownload(tmpdir, cmd)
+	download.payloadFileSizes = payloadFileSizes
 	go download.detachedDownloadProcess()
 
 	return download, delayKiller
@@ -272,12 +274,16 @@ func moduleDownloadSetup(t *testing.T, tmpdir, helperArg string) (*moduleDownloa
 type modulesDownloadTestCase struct {
 	testName  string
 	scriptArg string
+	// Give the size of each stream in "stream-next"
+	payloadFileSizes bool
 
 	// Must be same length
 	streamContents []string
 	streamNames    []string
 	verifyFiles    []string
 
+	// Files with other content than the streams
+	verifyContent  map[string]string
 	verifyNotExist []string
 	remove         []string
 	create         []string
@@ -302,6 +308,28 @@ var modulesDownloadTestCases []modulesDownloadTestCase = []modulesDownloadTestCa
 		// Check that Mender doesn't also create the file.
 		verifyNotExist: []string{"files/test-name"},
 	},
+	modulesDownloadTestCase{
+		testName:         "Module download with payload file sizes",
+		scriptArg:        "moduleDownloadStreamNextEntries",
+		payloadFileSizes: true,
+		streamContents:   []string{"Test content", "more content!"},
+		streamNames:      []string{"test-name", "another-name"},
+		verifyFiles:      []string{"tmp/module-downloaded-file0", "tmp/module-downloaded-file1"},
+		verifyContent: map[string]string{
+			"tmp/stream-next-entry0": "streams/test-name 12",
+			"tmp/stream-next-entry1": "streams/another-name 13",
+		},
+	},
+	modulesDownloadTestCase{
+		testName:       "Module download stream-next entries",
+		scriptArg:      "moduleDownloadStreamNextEntries",
+		streamContents: []string{"Test content"},
+		streamNames:    []string{"test-name"},
+		verifyFiles:    []string{"tmp/module-downloaded-file0"},
+		verifyContent: map[string]string{
+			"tmp/stream-next-entry0": "streams/test-name",
+		},
+	},
 	modulesDownloadTestCase{
 		testName:       "Module download failure",
 		scriptArg:      "moduleDownloadFailure",
@@ -428,7 +456,7 @@ func subTestModulesDownload(t *testing.T, c *modulesDownloadTestCase) {
 
 	goRoutines := runtime.NumGoroutine()
 
-	download, delayKiller := moduleDownloadSetup(t, tmpdir, c.scriptArg)
+	download, delayKiller := moduleDownloadSetup(t, tmpdir, c.scriptArg, c.payloadFileSizes)
 
 	for _, file := range c.remove {
 		require.NoError(t, os.RemoveAll(path.Join(tmpdir, file)))
@@ -441,7 +469,7 @@ func subTestModulesDownload(t *testing.T, c *modulesDownloadTestCase) {
 
 	for n := range c.streamContents {
 		buf := bytes.NewBuffer([]byte(c.streamContents[n]))
-		err = download.downloadStream(buf, c.streamNames[n])
+		err = download.downloadStream(buf, c.streamNames[n], int64(buf.Len()))
 		if n < len(c.downloadErr) {
 			assertIsError(t, c.downloadErr[n], err)
 		} else {
@@ -456,6 +484,9 @@ func subTestModulesDownload(t *testing.T, c *modulesDownloadTestCase) {
 	for n := range c.verifyFiles {
 		verifyFileContent(t, path.Join(tmpdir, c.verifyFiles[n]), c.streamContents[n])
 	}
+	for file, content := range c.verifyContent {
+		verifyFileContent(t, path.Join(tmpdir, file), content)
+	}
 
 	for _, file := range c.verifyNotExist {
 		_, err = os.Stat(path.Join(tmpdir, file))
@@ -28,6 +28,18 @@ case "$1" in
         esac
         exit 0
         ;;
+    moduleDownloadStreamNextEntries)
+        count=0
+        while entry=$(cat stream-next); do
+            if [ -z "$entry" ]; then
+                break
+            fi
+            printf "%s" "$entry" > tmp/stream-next-entry$count
+            cat ${entry%% *} > tmp/module-downloaded-file$count
+            count=$(($count+1))
+        done
+        exit 0
+        ;;
     moduleDownloadHang)
         sleep 60
         exit 0
@@ -0,0 +1,171 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+// mtdDevice is a raw MTD device, which must be erased before it is written,
+// one erase block at a time.
+type mtdDevice interface {
+	io.WriterAt
+	isBadBlock(offset int64) (bool, error)
+	eraseBlock(offset, length int64) error
+}
+
+// mtdFile is an MTD character device, such as /dev/mtd3.
+type mtdFile struct {
+	*os.File
+}
+
+func (f mtdFile) isBadBlock(offset int64) (bool, error) {
+	return system.IsMtdBadBlock(f.File, offset)
+}
+
+func (f mtdFile) eraseBlock(offset, length int64) error {
+	return system.EraseMtd(f.File, offset, length)
+}
+
+// mtdWriter writes an image to a raw MTD device, such as NAND flash without
+// UBI. The image is written an erase block at a time, each erased first, and
+// blocks marked bad are skipped, as by nandwrite. The rest of the device is
+// erased when the writer is closed, so that nothing is left from earlier
+// images.
+type mtdWriter struct {
+	dev       mtdDevice
+	name      string
+	eraseSize int64
+	writeSize int64
+	size      int64
+	// Offset of the next erase block to write.
+	offset int64
+	// Data of the next erase block; n bytes of it are filled.
+	buf []byte
+	n   int
+
+	badBlocks int
+}
+
+func newMtdWriter(dev mtdDevice, name string, info system.MtdInfo, size int64) (*mtdWriter, error) {
+	if info.EraseSize == 0 || info.WriteSize == 0 ||
+		info.EraseSize%info.WriteSize != 0 {
+		return nil, errors.Errorf("invalid geometry of MTD device %s: erase "+
+			"block size %d, page size %d", name, info.EraseSize, info.WriteSize)
+	}
+	log.Infof("MTD device %s has erase blocks of %d bytes and pages of %d bytes",
+		name, info.EraseSize, info.WriteSize)
+	return &mtdWriter{
+		dev:       dev,
+		name:      name,
+		eraseSize: int64(info.EraseSize),
+		writeSize: int64(info.WriteSize),
+		size:      size,
+		buf:       make([]byte, info.EraseSize),
+	}, nil
+}
+
+func (w *mtdWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		written += n
+		p = p[n:]
+		if w.n == len(w.buf) {
+			if err := w.writeBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// nextGoodBlock moves the offset past any bad erase blocks.
+func (w *mtdWriter) nextGoodBlock() error {
+	for ; w.offset+w.eraseSize <= w.size; w.offset += w.eraseSize {
+		bad, err := w.dev.isBadBlock(w.offset)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check erase block at %d of %s",
+				w.offset, w.name)
+		} else if !bad {
+			return nil
+		}
+		log.Warnf("skipping bad erase block at %d of %s", w.offset, w.name)
+		w.badBlocks++
+	}
+	return errors.Wrapf(syscall.ENOSPC, "no good erase blocks left on %s, "+
+		"after skipping %d bad ones", w.name, w.badBlocks)
+}
+
+// writeBlock erases the next good erase block, and writes the buffered data
+// to it, padded to whole pages.
+func (w *mtdWriter) writeBlock() error {
+	if err := w.nextGoodBlock(); err != nil {
+		return err
+	}
+	if err := w.dev.eraseBlock(w.offset, w.eraseSize); err != nil {
+		return errors.Wrapf(err, "failed to erase block at %d of %s",
+			w.offset, w.name)
+	}
+
+	// Erased flash reads as 0xff.
+	end := (int64(w.n) + w.writeSize - 1) / w.writeSize * w.writeSize
+	for i := w.n; i < int(end); i++ {
+		w.buf[i] = 0xff
+	}
+	if _, err := w.dev.WriteAt(w.buf[:end], w.offset); err != nil {
+		return errors.Wrapf(err, "failed to write erase block at %d of %s",
+			w.offset, w.name)
+	}
+
+	w.offset += w.eraseSize
+	w.n = 0
+	return nil
+}
+
+// Close writes what is left of the image, and erases the rest of the device.
+func (w *mtdWriter) Close() error {
+	if w.n > 0 {
+		if err := w.writeBlock(); err != nil {
+			return err
+		}
+	}
+
+	erased := 0
+	for ; w.offset+w.eraseSize <= w.size; w.offset += w.eraseSize {
+		bad, err := w.dev.isBadBlock(w.offset)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check erase block at %d of %s",
+				w.offset, w.name)
+		} else if bad {
+			w.badBlocks++
+			continue
+		}
+		if err := w.dev.eraseBlock(w.offset, w.eraseSize); err != nil {
+			return errors.Wrapf(err, "failed to erase block at %d of %s",
+				w.offset, w.name)
+		}
+		erased++
+	}
+	log.Infof("erased %d unused erase blocks of %s; skipped %d bad ones",
+		erased, w.name, w.badBlocks)
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMtd is an MTD device of erase blocks of 8 bytes, with pages of 4 bytes.
+type fakeMtd struct {
+	data   []byte
+	bad    map[int64]bool
+	erased []int64
+}
+
+func newFakeMtd(blocks int) *fakeMtd {
+	return &fakeMtd{
+		data: bytes.Repeat([]byte{'o'}, blocks*8),
+		bad:  map[int64]bool{},
+	}
+}
+
+func (m *fakeMtd) isBadBlock(offset int64) (bool, error) {
+	return m.bad[offset], nil
+}
+
+func (m *fakeMtd) eraseBlock(offset, length int64) error {
+	for i := offset; i < offset+length; i++ {
+		m.data[i] = 0xff
+	}
+	m.erased = append(m.erased, offset)
+	return nil
+}
+
+func (m *fakeMtd) WriteAt(p []byte, offset int64) (int, error) {
+	if m.data[offset] != 0xff {
+		return 0, errors.New("writing to a block which is not erased")
+	}
+	if len(p)%4 != 0 {
+		return 0, errors.New("writing a partial page")
+	}
+	return copy(m.data[offset:], p), nil
+}
+
+func TestMtdWriter(t *testing.T) {
+	dev := newFakeMtd(5)
+	dev.bad[8] = true
+	w, err := newMtdWriter(dev, "mtd3",
+		system.MtdInfo{EraseSize: 8, WriteSize: 4}, int64(len(dev.data)))
+	require.NoError(t, err)
+
+	for _, p := range []string{"AAAAAA", "AABBBBBBBBC"} {
+		n, err := w.Write([]byte(p))
+		assert.NoError(t, err)
+		assert.Equal(t, len(p), n)
+	}
+	assert.NoError(t, w.Close())
+
+	// The bad block is skipped, the last page is padded, and the rest of
+	// the device is erased.
+	assert.Equal(t, "AAAAAAAA"+"oooooooo"+"BBBBBBBB"+"C\xff\xff\xff\xff\xff\xff\xff"+
+		"\xff\xff\xff\xff\xff\xff\xff\xff", string(dev.data))
+	assert.Equal(t, []int64{0, 16, 24, 32}, dev.erased)
+	assert.Equal(t, 1, w.badBlocks)
+}
+
+func TestMtdWriterNoSpace(t *testing.T) {
+	dev := newFakeMtd(2)
+	dev.bad[0] = true
+	w, err := newMtdWriter(dev, "mtd3",
+		system.MtdInfo{EraseSize: 8, WriteSize: 4}, int64(len(dev.data)))
+	require.NoError(t, err)
+
+	_, err = w.Write([]byte("AAAAAAAABBBBBBBB"))
+	assert.Error(t, err)
+	assert.Equal(t, syscall.ENOSPC, errors.Cause(err))
+}
+
+func TestMtdWriterGeometry(t *testing.T) {
+	for _, info := range []system.MtdInfo{
+		{EraseSize: 0, WriteSize: 4},
+		{EraseSize: 8, WriteSize: 0},
+		{EraseSize: 8, WriteSize: 3},
+	} {
+		_, err := newMtdWriter(newFakeMtd(1), "mtd3", info, 8)
+		assert.Error(t, err, "%v", info)
+	}
+}
@@ -14,9 +14,11 @@
 package installer
 
 import (
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -28,20 +30,57 @@ import (
 var (
 	RootPartitionDoesNotMatchMount = errors.New("Can not match active partition and any of mounted devices.")
 	ErrorNoMatchBootPartRootPart   = errors.New("No match between boot and root partitions.")
-	ErrorPartitionNumberNotSet     = errors.New("RootfsPartA and RootfsPartB settings are not both set.")
-	ErrorPartitionNumberSame       = errors.New("RootfsPartA and RootfsPartB cannot be set to the same value.")
-	ErrorPartitionNoMatchActive    = errors.New("Active root partition matches neither RootfsPartA nor RootfsPartB.")
+	ErrorPartitionNumberNotSet     = errors.New("At least two rootfs partitions must be set.")
+	ErrorPartitionNumberSame       = errors.New("The rootfs partitions cannot be set to the same value.")
+	ErrorPartitionNoMatchActive    = errors.New("Active root partition matches none of the rootfs partitions.")
 )
 
 type partitions struct {
 	system.StatCommander
 	BootEnvReadWriter
-	rootfsPartA string
-	rootfsPartB string
+	// Updates are installed to each of these in turn, so that the ones
+	// before the active one hold the last known good updates.
+	rootfsParts []string
 	active      string
 	inactive    string
 }
 
+func (p *partitions) checkRootfsParts() error {
+	if len(p.rootfsParts) < 2 {
+		return ErrorPartitionNumberNotSet
+	}
+	for i, part := range p.rootfsParts {
+		if part == "" {
+			return ErrorPartitionNumberNotSet
+		}
+		for _, other := range p.rootfsParts[:i] {
+			if part == other {
+				return ErrorPartitionNumberSame
+			}
+		}
+	}
+	return nil
+}
+
+// activeIndex returns the index of the active partition in rootfsParts.
+func (p *partitions) activeIndex() (int, error) {
+	if err := p.checkRootfsParts(); err != nil {
+		return 0, err
+	}
+
+	active, err := p.GetActive()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, part := range p.rootfsParts {
+		if maybeResolveLink(active) == part {
+			return i, nil
+		}
+	}
+	return 0, ErrorPartitionNoMatchActive
+}
+
 func (p *partitions) GetInactive() (string, error) {
 	if p.inactive != "" {
 		log.Debug("Inactive partition: ", p.inactive)
@@ -58,28 +97,29 @@ func (p *partitions) GetActive() (string, error) {
 	return p.getAndCacheActivePartition(isMountedRoot, getAllMountedDevices)
 }
 
-func (p *partitions) getAndCacheInactivePartition() (string, error) {
-	if p.rootfsPartA == "" || p.rootfsPartB == "" {
-		return "", ErrorPartitionNumberNotSet
-	}
-	if p.rootfsPartA == p.rootfsPartB {
-		return "", ErrorPartitionNumberSame
-	}
-
-	active, err := p.GetActive()
+// GetPrevious returns the partition which was installed to before the
+// active one, which is where a rollback returns to. With only two rootfs
+// partitions it is the inactive one.
+func (p *partitions) GetPrevious() (string, error) {
+	i, err := p.activeIndex()
 	if err != nil {
 		return "", err
 	}
+	n := len(p.rootfsParts)
+	return p.rootfsParts[(i+n-1)%n], nil
+}
 
-	if maybeResolveLink(active) == p.rootfsPartA {
-		p.inactive = p.rootfsPartB
-	} else if maybeResolveLink(active) == p.rootfsPartB {
-		p.inactive = p.rootfsPartA
-	} else {
-		return "", ErrorPartitionNoMatchActive
+// The inactive partition, which the next update is installed to, is the one
+// after the active one.
+func (p *partitions) getAndCacheInactivePartition() (string, error) {
+	i, err := p.activeIndex()
+	if err != nil {
+		return "", err
 	}
 
-	log.Debugf("Detected inactive partition %s, based on active partition %s", p.inactive, active)
+	p.inactive = p.rootfsParts[(i+1)%len(p.rootfsParts)]
+	log.Debugf("Detected inactive partition %s, based on active partition %s",
+		p.inactive, p.rootfsParts[i])
 	return p.inactive, nil
 }
 
@@ -197,15 +237,12 @@ func (p *partitions) getAndCacheActivePartition(rootChecker func(system.StatComm
 		// based on mounted device.
 		//
 		// Fall-back to configuration and environment only!
-		if checkBootEnvAndRootPartitionMatch(bootEnvBootPart, p.rootfsPartA) {
-			p.active = p.rootfsPartA
-			log.Debug("Setting active partition from configuration and environment: ", p.active)
-			return p.active, nil
-		}
-		if checkBootEnvAndRootPartitionMatch(bootEnvBootPart, p.rootfsPartB) {
-			p.active = p.rootfsPartB
-			log.Debug("Setting active partition from configuration and environment: ", p.active)
-			return p.active, nil
+		for _, part := range p.rootfsParts {
+			if checkBootEnvAndRootPartitionMatch(bootEnvBootPart, part) {
+				p.active = part
+				log.Debug("Setting active partition from configuration and environment: ", p.active)
+				return p.active, nil
+			}
 		}
 		return "", err
 	}
@@ -228,8 +265,128 @@ func getBootEnvActivePartition(env BootEnvReadWriter) (string, error) {
 	return bootEnv["mender_boot_part"], nil
 }
 
+// checkBootEnvAndRootPartitionMatch returns whether the partition is the one
+// with the index mender_boot_part gives, so that partition 2 doesn't match
+// mmcblk0p12.
 func checkBootEnvAndRootPartitionMatch(bootPartNum string, rootPart string) bool {
-	return strings.HasSuffix(rootPart, bootPartNum)
+	bootIndex, err := strconv.Atoi(strings.TrimSpace(bootPartNum))
+	if err != nil {
+		return false
+	}
+	index, err := partitionIndex(rootPart)
+	if err != nil {
+		log.Debugf("Could not get the index of %s: %s", rootPart, err.Error())
+		return false
+	}
+	return index == bootIndex
+}
+
+// The directory holding the /dev/disk/by-* links to partitions, which the
+// partition identifiers below are looked up in.
+var diskLinksDir = "/dev/disk"
+
+// The links directory of each of the identifiers which the rootfs partitions
+// can be given by, on the form IDENTIFIER=value, as in fstab.
+var partitionIdentifierDirs = map[string]string{
+	"PARTUUID":  "by-partuuid",
+	"PARTLABEL": "by-partlabel",
+	"UUID":      "by-uuid",
+	"LABEL":     "by-label",
+}
+
+// resolvePartition returns the device path of a rootfs partition given
+// either by path or by identifier, such as PARTUUID=<uuid> or
+// PARTLABEL=<label>, so that the partitions need not be enumerated the
+// same on every boot. If the identifier can not be resolved, it is returned
+// as is.
+func resolvePartition(part string) string {
+	fields := strings.SplitN(part, "=", 2)
+	if len(fields) != 2 {
+		return maybeResolveLink(part)
+	}
+	dir, ok := partitionIdentifierDirs[fields[0]]
+	if !ok {
+		return maybeResolveLink(part)
+	}
+
+	value := fields[1]
+	if fields[0] == "PARTUUID" {
+		// udev names the links by the lower case PARTUUID.
+		value = strings.ToLower(value)
+	}
+	resolvedPath, err := filepath.EvalSymlinks(filepath.Join(diskLinksDir, dir, value))
+	if err != nil {
+		log.Errorf("Could not resolve the partition %s: %s", part, err.Error())
+		return part
+	}
+	log.Debugf("Resolved the partition %s to %s", part, resolvedPath)
+	return resolvedPath
+}
+
+// The sysfs directory of the block devices, in which the kernel gives the
+// index of each partition.
+var sysClassBlockDir = "/sys/class/block"
+
+// Disks named with a trailing number, whose partitions are named by the disk
+// followed by "p" and the partition index.
+var numberedDiskPrefixes = []string{"mmcblk", "nvme", "loop", "nbd", "md"}
+
+// partitionIndex returns the kernel index of the partition device, read
+// from sysfs, or else parsed from the device name. The index of UBI
+// volumes, such as ubi0_1, is the volume ID.
+func partitionIndex(partition string) (int, error) {
+	name := filepath.Base(partition)
+	if resolvedPath, err := filepath.EvalSymlinks(partition); err == nil {
+		name = filepath.Base(resolvedPath)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(sysClassBlockDir, name, "partition"))
+	if err == nil {
+		index, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil || index < 1 {
+			return 0, errors.Errorf("Invalid partition index %q of %s",
+				strings.TrimSpace(string(data)), partition)
+		}
+		return index, nil
+	}
+
+	if isDiskImage(partition) {
+		// Disk images are numbered like partitions, by the number their
+		// name ends with.
+		name = diskImagePartitionName(partition)
+	}
+	return parsePartitionIndex(name)
+}
+
+func parsePartitionIndex(name string) (int, error) {
+	if strings.HasPrefix(name, "ubi") {
+		sep := strings.LastIndex(name, "_")
+		if sep < 0 {
+			return 0, errors.Errorf("%s is not a UBI volume", name)
+		}
+		index, err := strconv.Atoi(name[sep+1:])
+		if err != nil || index < 0 {
+			return 0, errors.Errorf("%s is not a UBI volume", name)
+		}
+		return index, nil
+	}
+
+	disk := strings.TrimRight(name, "0123456789")
+	index, err := strconv.Atoi(name[len(disk):])
+	if err != nil || index < 1 {
+		return 0, errors.Errorf("%s is not a partition", name)
+	}
+	for _, prefix := range numberedDiskPrefixes {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		// mmcblk0p3, but not the disk mmcblk0.
+		if len(disk) < 2 || !strings.HasSuffix(disk, "p") ||
+			!strings.ContainsAny(disk[len(disk)-2:len(disk)-1], "0123456789") {
+			return 0, errors.Errorf("%s is not a partition", name)
+		}
+	}
+	return index, nil
 }
 
 func maybeResolveLink(unresolvedPath string) string {
@@ -52,8 +52,7 @@ func Test_GetInactive_HaveActivePartitionSet_ReturnsInactive(t *testing.T) {
 		fakePartitions := partitions{
 			StatCommander:     new(system.OsCalls),
 			BootEnvReadWriter: new(UBootEnv),
-			rootfsPartA:       testData.rootfsPartA,
-			rootfsPartB:       testData.rootfsPartB,
+			rootfsParts:       []string{testData.rootfsPartA, testData.rootfsPartB},
 			active:            testData.active,
 			inactive:          testData.inactive,
 		}
@@ -65,6 +64,43 @@ func Test_GetInactive_HaveActivePartitionSet_ReturnsInactive(t *testing.T) {
 
 }
 
+func TestMoreThanTwoRootfsPartitions(t *testing.T) {
+	parts := []string{"/dev/mmc2", "/dev/mmc3", "/dev/mmc5"}
+	for _, test := range []struct {
+		active   string
+		inactive string
+		previous string
+	}{
+		{"/dev/mmc2", "/dev/mmc3", "/dev/mmc5"},
+		{"/dev/mmc3", "/dev/mmc5", "/dev/mmc2"},
+		{"/dev/mmc5", "/dev/mmc2", "/dev/mmc3"},
+	} {
+		fakePartitions := partitions{
+			StatCommander:     new(system.OsCalls),
+			BootEnvReadWriter: new(UBootEnv),
+			rootfsParts:       parts,
+			active:            test.active,
+		}
+		inactive, err := fakePartitions.GetInactive()
+		assert.NoError(t, err)
+		assert.Equal(t, test.inactive, inactive)
+		previous, err := fakePartitions.GetPrevious()
+		assert.NoError(t, err)
+		assert.Equal(t, test.previous, previous)
+	}
+
+	fakePartitions := partitions{
+		StatCommander:     new(system.OsCalls),
+		BootEnvReadWriter: new(UBootEnv),
+		rootfsParts:       []string{"/dev/mmc2", "/dev/mmc3", "/dev/mmc2"},
+		active:            "/dev/mmc2",
+	}
+	_, err := fakePartitions.GetInactive()
+	assert.Equal(t, ErrorPartitionNumberSame, err)
+	_, err = fakePartitions.GetPrevious()
+	assert.Equal(t, ErrorPartitionNumberSame, err)
+}
+
 type fakeStatCommander struct {
 	file     os.FileInfo
 	cmd      *exec.Cmd
@@ -161,8 +197,7 @@ func Test_getActivePartition_noActiveInactiveSet(t *testing.T) {
 	fakePartitions := partitions{
 		StatCommander:     testOS,
 		BootEnvReadWriter: &fakeEnv,
-		rootfsPartA:       "/dev/mmcblk0p2",
-		rootfsPartB:       "/dev/mmcblk0p3",
+		rootfsParts:       []string{"/dev/mmcblk0p2", "/dev/mmcblk0p3"},
 		active:            "",
 		inactive:          "",
 	}
@@ -245,3 +280,113 @@ func TestMaybeResolveLink(t *testing.T) {
 	// Does not resolve link path, as it is not /dev/disk/by-partuuid.
 	assert.Equal(t, tmpsym, resolvedPath)
 }
+
+func TestResolvePartition(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "resolvePartition")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	oldDiskLinksDir := diskLinksDir
+	diskLinksDir = tmp
+	defer func() { diskLinksDir = oldDiskLinksDir }()
+
+	dev := filepath.Join(tmp, "nvme0n1p3")
+	require.NoError(t, ioutil.WriteFile(dev, nil, 0600))
+	for _, link := range []string{
+		"by-partuuid/2f0b5d7e-03",
+		"by-partlabel/rootfs-b",
+		"by-uuid/ABCD-1234",
+		"by-label/root",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(tmp, filepath.Dir(link)), 0755))
+		require.NoError(t, os.Symlink(dev, filepath.Join(tmp, link)))
+	}
+
+	assert.Equal(t, dev, resolvePartition("PARTUUID=2f0b5d7e-03"))
+	assert.Equal(t, dev, resolvePartition("PARTUUID=2F0B5D7E-03"))
+	assert.Equal(t, dev, resolvePartition("PARTLABEL=rootfs-b"))
+	assert.Equal(t, dev, resolvePartition("UUID=ABCD-1234"))
+	assert.Equal(t, dev, resolvePartition("LABEL=root"))
+
+	// Unresolvable identifiers are returned as is.
+	assert.Equal(t, "PARTLABEL=rootfs-c", resolvePartition("PARTLABEL=rootfs-c"))
+
+	// As are paths, and unknown identifiers.
+	assert.Equal(t, "/dev/mmcblk0p2", resolvePartition("/dev/mmcblk0p2"))
+	assert.Equal(t, "FOO=bar", resolvePartition("FOO=bar"))
+}
+
+func TestPartitionNumbers(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "partitionNumbers")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	oldSysClassBlockDir := sysClassBlockDir
+	sysClassBlockDir = tmp
+	defer func() { sysClassBlockDir = oldSysClassBlockDir }()
+
+	tc := []struct {
+		partition string
+		dec       string
+		hex       string
+		fail      bool
+	}{
+		{partition: "/dev/mmcblk0p3", dec: "3", hex: "3"},
+		{partition: "/dev/mmcblk1p12", dec: "12", hex: "C"},
+		{partition: "/dev/nvme0n1p2", dec: "2", hex: "2"},
+		{partition: "/dev/nvme10n1p15", dec: "15", hex: "F"},
+		{partition: "/dev/sda2", dec: "2", hex: "2"},
+		{partition: "/dev/sdb10", dec: "10", hex: "A"},
+		{partition: "/dev/ubi0_1", dec: "1", hex: "1"},
+		{partition: "/dev/ubi0_0", dec: "0", hex: "0"},
+		{partition: "/dev/ubiblock0_11", dec: "11", hex: "B"},
+		{partition: "/dev/mmcblk0", fail: true},
+		{partition: "/dev/nvme0n1", fail: true},
+		{partition: "/dev/sda", fail: true},
+		{partition: "/dev/ubi0", fail: true},
+	}
+
+	for _, c := range tc {
+		dec, hex, err := partitionNumbers(c.partition)
+		if c.fail {
+			assert.Error(t, err, c.partition)
+			continue
+		}
+		assert.NoError(t, err, c.partition)
+		assert.Equal(t, c.dec, dec, c.partition)
+		assert.Equal(t, c.hex, hex, c.partition)
+	}
+
+	// The index given by the kernel wins over the device name.
+	require.NoError(t, os.MkdirAll(filepath.Join(tmp, "mmcblk0p3"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "mmcblk0p3", "partition"),
+		[]byte("5\n"), 0644))
+	dec, hex, err := partitionNumbers("/dev/mmcblk0p3")
+	assert.NoError(t, err)
+	assert.Equal(t, "5", dec)
+	assert.Equal(t, "5", hex)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(tmp, "sda12"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "sda12", "partition"),
+		[]byte("12\n"), 0644))
+	dec, hex, err = partitionNumbers("/dev/sda12")
+	assert.NoError(t, err)
+	assert.Equal(t, "12", dec)
+	assert.Equal(t, "C", hex)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(tmp, "sda4"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmp, "sda4", "partition"),
+		[]byte("garbage\n"), 0644))
+	_, _, err = partitionNumbers("/dev/sda4")
+	assert.Error(t, err)
+
+	// The boot partition given by the boot environment must match the
+	// index, not just the end of the name.
+	assert.True(t, checkBootEnvAndRootPartitionMatch("2", "/dev/mmcblk1p2"))
+	assert.False(t, checkBootEnvAndRootPartitionMatch("2", "/dev/mmcblk1p12"))
+	assert.True(t, checkBootEnvAndRootPartitionMatch("12", "/dev/mmcblk1p12"))
+	assert.False(t, checkBootEnvAndRootPartitionMatch("2", "/dev/mmcblk0p3"))
+	assert.True(t, checkBootEnvAndRootPartitionMatch("5", "/dev/mmcblk0p3"))
+	assert.False(t, checkBootEnvAndRootPartitionMatch("2", "/dev/sda"))
+	assert.False(t, checkBootEnvAndRootPartitionMatch("", "/dev/sda2"))
+}
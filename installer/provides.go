@@ -0,0 +1,175 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"path"
+	"sort"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+)
+
+// ErrDependsNotSatisfied is returned when the device does not provide what
+// the artifact depends on, so that installing it would never succeed.
+var ErrDependsNotSatisfied = errors.New("artifact depends not satisfied by the device")
+
+// GetArtifactProvides returns the provides of the artifact: its name and
+// group, and the type info provides of its payloads.
+func (i *Installer) GetArtifactProvides() (map[string]string, error) {
+	provides := map[string]string{
+		"artifact_name": i.ar.GetArtifactName(),
+	}
+	if p := i.ar.GetArtifactProvides(); p != nil && p.ArtifactGroup != "" {
+		provides["artifact_group"] = p.ArtifactGroup
+	}
+	for _, payload := range i.payloadHeaders() {
+		typeProvides, err := payload.GetUpdateProvides()
+		if err != nil {
+			return nil, err
+		}
+		if typeProvides == nil {
+			continue
+		}
+		for key, value := range *typeProvides {
+			provides[key] = value
+		}
+	}
+	return provides, nil
+}
+
+// GetClearsArtifactProvides returns the patterns of the provides of the
+// installed artifact which the artifact replaces. The artifact headers do
+// not carry them yet, so these are the defaults of its payload types.
+func (i *Installer) GetClearsArtifactProvides() []string {
+	var clears []string
+	for _, payload := range i.payloadHeaders() {
+		updateType := payload.GetUpdateType()
+		if updateType == "rootfs-image" {
+			// A new root filesystem replaces everything the old one
+			// provided.
+			clears = append(clears, "artifact_group",
+				"rootfs_image_checksum", "rootfs-image.*")
+		} else {
+			clears = append(clears, "rootfs-image."+updateType+".*")
+		}
+	}
+	return clears
+}
+
+// HasDepends returns whether the artifact depends on any provides of the
+// device, so that they need to be read to check its depends.
+func (i *Installer) HasDepends() (bool, error) {
+	if depends := i.ar.GetArtifactDepends(); depends != nil &&
+		(len(depends.ArtifactName) > 0 || len(depends.ArtifactGroup) > 0) {
+		return true, nil
+	}
+	for _, payload := range i.payloadHeaders() {
+		depends, err := payload.GetUpdateDepends()
+		if err != nil {
+			return false, err
+		}
+		if depends != nil && len(*depends) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CheckDepends returns ErrDependsNotSatisfied, with the reason, if the given
+// provides of the device, including its artifact name, do not satisfy the
+// depends of the artifact.
+func (i *Installer) CheckDepends(provides map[string]string) error {
+	var typeDepends []artifact.TypeInfoDepends
+	for _, payload := range i.payloadHeaders() {
+		depends, err := payload.GetUpdateDepends()
+		if err != nil {
+			return err
+		}
+		if depends != nil {
+			typeDepends = append(typeDepends, *depends)
+		}
+	}
+	return checkDepends(i.ar.GetArtifactDepends(), typeDepends, provides)
+}
+
+func checkDepends(depends *artifact.ArtifactDepends,
+	typeDepends []artifact.TypeInfoDepends, provides map[string]string) error {
+
+	if depends != nil {
+		if len(depends.ArtifactName) > 0 &&
+			!stringInList(provides["artifact_name"], depends.ArtifactName) {
+			return errors.Wrapf(ErrDependsNotSatisfied,
+				"artifact depends on artifact_name %v, device has %q",
+				depends.ArtifactName, provides["artifact_name"])
+		}
+		if len(depends.ArtifactGroup) > 0 &&
+			!stringInList(provides["artifact_group"], depends.ArtifactGroup) {
+			return errors.Wrapf(ErrDependsNotSatisfied,
+				"artifact depends on artifact_group %v, device has %q",
+				depends.ArtifactGroup, provides["artifact_group"])
+		}
+	}
+	for _, d := range typeDepends {
+		for key, value := range d {
+			if have, ok := provides[key]; !ok || have != value {
+				return errors.Wrapf(ErrDependsNotSatisfied,
+					"artifact depends on %s %q, device has %q",
+					key, value, have)
+			}
+		}
+	}
+	return nil
+}
+
+// MergeProvides returns the provides of the device once an artifact with the
+// given provides is installed, replacing the current provides which match
+// the clears patterns.
+func MergeProvides(current, provides map[string]string,
+	clears []string) map[string]string {
+
+	merged := make(map[string]string, len(current)+len(provides))
+	for key, value := range current {
+		cleared := false
+		for _, pattern := range clears {
+			if ok, _ := path.Match(pattern, key); ok {
+				cleared = true
+				break
+			}
+		}
+		if !cleared {
+			merged[key] = value
+		}
+	}
+	for key, value := range provides {
+		merged[key] = value
+	}
+	return merged
+}
+
+// payloadHeaders returns the headers of the payloads, in payload order.
+func (i *Installer) payloadHeaders() []handlers.ArtifactUpdateHeaders {
+	installers := i.ar.GetHandlers()
+	indexes := make([]int, 0, len(installers))
+	for n := range installers {
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+	headers := make([]handlers.ArtifactUpdateHeaders, len(indexes))
+	for n, index := range indexes {
+		headers[n] = installers[index]
+	}
+	return headers
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArtifactProvidesAndDepends(t *testing.T) {
+	art, err := MakeUnsupportedRootfsImageArtifact(3, &artifact.TypeInfoDepends{
+		"rootfs_image_checksum": "00",
+	}, &artifact.TypeInfoProvides{
+		"rootfs_image_checksum": "11",
+	}, false)
+	require.NoError(t, err)
+
+	i, _, err := ReadHeaders(art, "vexpress-qemu", nil, "",
+		&AllModules{DualRootfs: new(fDevice)})
+	require.NoError(t, err)
+
+	provides, err := i.GetArtifactProvides()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"artifact_name":         "artifact-name",
+		"rootfs_image_checksum": "11",
+	}, provides)
+	assert.Equal(t, []string{"artifact_group", "rootfs_image_checksum", "rootfs-image.*"},
+		i.GetClearsArtifactProvides())
+
+	hasDepends, err := i.HasDepends()
+	require.NoError(t, err)
+	assert.True(t, hasDepends)
+	assert.NoError(t, i.CheckDepends(map[string]string{
+		"artifact_name":         "release-1",
+		"rootfs_image_checksum": "00",
+	}))
+	err = i.CheckDepends(map[string]string{
+		"artifact_name":         "release-1",
+		"rootfs_image_checksum": "22",
+	})
+	assert.Equal(t, ErrDependsNotSatisfied, errors.Cause(err))
+	err = i.CheckDepends(map[string]string{"artifact_name": "release-1"})
+	assert.Equal(t, ErrDependsNotSatisfied, errors.Cause(err))
+}
+
+func TestCheckDepends(t *testing.T) {
+	depends := &artifact.ArtifactDepends{
+		ArtifactName:  []string{"release-1", "release-2"},
+		ArtifactGroup: []string{"stable"},
+	}
+	assert.NoError(t, checkDepends(depends, nil, map[string]string{
+		"artifact_name":  "release-2",
+		"artifact_group": "stable",
+	}))
+	assert.Error(t, checkDepends(depends, nil, map[string]string{
+		"artifact_name":  "release-3",
+		"artifact_group": "stable",
+	}))
+	assert.Error(t, checkDepends(depends, nil, map[string]string{
+		"artifact_name": "release-1",
+	}))
+	assert.NoError(t, checkDepends(nil, nil, map[string]string{}))
+}
+
+func TestMergeProvides(t *testing.T) {
+	current := map[string]string{
+		"artifact_group":             "stable",
+		"rootfs_image_checksum":      "00",
+		"rootfs-image.app.version":   "1",
+		"rootfs-image.other.version": "3",
+	}
+
+	assert.Equal(t, map[string]string{
+		"artifact_group":             "stable",
+		"rootfs_image_checksum":      "00",
+		"rootfs-image.app.version":   "2",
+		"rootfs-image.other.version": "3",
+	}, MergeProvides(current, map[string]string{
+		"rootfs-image.app.version": "2",
+	}, []string{"rootfs-image.app.*"}))
+
+	assert.Equal(t, map[string]string{
+		"rootfs_image_checksum": "11",
+	}, MergeProvides(current, map[string]string{
+		"rootfs_image_checksum": "11",
+	}, []string{"artifact_group", "rootfs_image_checksum", "rootfs-image.*"}))
+}
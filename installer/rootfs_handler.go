@@ -0,0 +1,118 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+)
+
+// rootfsInstaller is the rootfs-image handler of mender-artifact, extended
+// with the payload meta-data, which the artifact library ignores for this
+// payload type. The meta-data describes, among other things, disk image
+// regions and block maps.
+type rootfsInstaller struct {
+	*handlers.Rootfs
+
+	metaData map[string]interface{}
+
+	// If this is an augmented instance: The original instance.
+	original handlers.ArtifactUpdate
+}
+
+func newRootfsInstaller() *rootfsInstaller {
+	return &rootfsInstaller{
+		Rootfs: handlers.NewRootfsInstaller(),
+	}
+}
+
+func (r *rootfsInstaller) NewInstance() handlers.Installer {
+	return &rootfsInstaller{
+		Rootfs: r.Rootfs.NewInstance().(*handlers.Rootfs),
+	}
+}
+
+func (r *rootfsInstaller) NewAugmentedInstance(
+	orig handlers.ArtifactUpdate) (handlers.Installer, error) {
+
+	inst, err := r.Rootfs.NewAugmentedInstance(orig)
+	if err != nil {
+		return nil, err
+	}
+	return &rootfsInstaller{
+		Rootfs:   inst.(*handlers.Rootfs),
+		original: orig,
+	}, nil
+}
+
+func (r *rootfsInstaller) ReadHeader(rd io.Reader, path string,
+	version int, augmented bool) error {
+
+	// The artifact library leaves the meta-data unread.
+	if err := r.Rootfs.ReadHeader(rd, path, version, augmented); err != nil {
+		return err
+	} else if filepath.Base(path) != "meta-data" {
+		return nil
+	}
+
+	var data interface{}
+	err := json.NewDecoder(rd).Decode(&data)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "error reading meta-data")
+	}
+	metaData, ok := data.(map[string]interface{})
+	if !ok {
+		return errors.New("top level object in meta-data must be a JSON object")
+	}
+	r.metaData = metaData
+	return nil
+}
+
+// GetUpdateMetaData returns the original meta-data, with the top level keys
+// of the augmented meta-data taking precedence.
+func (r *rootfsInstaller) GetUpdateMetaData() (map[string]interface{}, error) {
+	orig := r.GetUpdateOriginalMetaData()
+	augment := r.GetUpdateAugmentMetaData()
+	if len(augment) == 0 {
+		return orig, nil
+	}
+	merged := make(map[string]interface{}, len(orig)+len(augment))
+	for key, value := range orig {
+		merged[key] = value
+	}
+	for key, value := range augment {
+		merged[key] = value
+	}
+	return merged, nil
+}
+
+func (r *rootfsInstaller) GetUpdateOriginalMetaData() map[string]interface{} {
+	if r.original != nil {
+		return r.original.GetUpdateOriginalMetaData()
+	}
+	return r.metaData
+}
+
+func (r *rootfsInstaller) GetUpdateAugmentMetaData() map[string]interface{} {
+	if r.original != nil {
+		return r.metaData
+	}
+	return nil
+}
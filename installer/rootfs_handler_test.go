@@ -0,0 +1,56 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootfsInstallerMetaData(t *testing.T) {
+	orig := newRootfsInstaller()
+
+	err := orig.ReadHeader(strings.NewReader(`[1, 2]`),
+		"headers/0000/meta-data", 3, false)
+	assert.Error(t, err)
+
+	err = orig.ReadHeader(strings.NewReader(""), "headers/0000/meta-data", 3, false)
+	require.NoError(t, err)
+	metaData, err := orig.GetUpdateMetaData()
+	require.NoError(t, err)
+	assert.Empty(t, metaData)
+
+	err = orig.ReadHeader(strings.NewReader(`{"a": 1, "b": "orig"}`),
+		"headers/0000/meta-data", 3, false)
+	require.NoError(t, err)
+	metaData, err = orig.GetUpdateMetaData()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": float64(1), "b": "orig"}, metaData)
+	assert.Nil(t, orig.GetUpdateAugmentMetaData())
+
+	inst, err := newRootfsInstaller().NewAugmentedInstance(orig)
+	require.NoError(t, err)
+	err = inst.ReadHeader(strings.NewReader(`{"b": "augment"}`),
+		"headers/0000/meta-data", 3, true)
+	require.NoError(t, err)
+
+	metaData, err = inst.GetUpdateMetaData()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": float64(1), "b": "augment"}, metaData)
+	assert.Equal(t, orig.GetUpdateOriginalMetaData(), inst.GetUpdateOriginalMetaData())
+	assert.Equal(t, map[string]interface{}{"b": "augment"}, inst.GetUpdateAugmentMetaData())
+}
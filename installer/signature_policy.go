@@ -0,0 +1,84 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/pkg/errors"
+)
+
+// VerificationKey is a public key used for verifying artifact signatures,
+// together with the role of the signing party (e.g. "vendor" or "operator").
+type VerificationKey struct {
+	Role string
+	Key  []byte
+}
+
+// SignaturePolicy describes the keys an artifact may be signed with in order
+// to be installed. An artifact carries a single signature, in its manifest.sig
+// file, which must have been made with one of the keys of the policy.
+type SignaturePolicy struct {
+	Keys []VerificationKey
+	// Roles of which the key that signed the artifact must have one, if
+	// any are given.
+	RequiredRoles []string
+}
+
+// NewSingleKeyPolicy returns a policy accepting artifacts signed with the
+// given key, or nil if no key is given.
+func NewSingleKeyPolicy(key []byte) *SignaturePolicy {
+	if key == nil {
+		return nil
+	}
+	return &SignaturePolicy{
+		Keys: []VerificationKey{{Key: key}},
+	}
+}
+
+// Verify checks that sig, the signature of the artifact, was made over
+// message with one of the keys of the policy.
+func (p *SignaturePolicy) Verify(message, sig []byte) error {
+	var err, roleErr error
+	for _, key := range p.Keys {
+		if err = artifact.NewVerifier(key.Key).Verify(message, sig); err != nil {
+			continue
+		}
+		if p.hasRequiredRole(key.Role) {
+			return nil
+		}
+		roleErr = errors.Errorf("artifact is signed by a key with role %q, "+
+			"none of %q", key.Role, p.RequiredRoles)
+	}
+	if roleErr != nil {
+		return roleErr
+	}
+	// Keep the error from a single key setup, as it is the most
+	// descriptive one.
+	if len(p.Keys) == 1 {
+		return err
+	}
+	return errors.New("artifact is not signed with any of the verification keys")
+}
+
+func (p *SignaturePolicy) hasRequiredRole(role string) bool {
+	if len(p.RequiredRoles) == 0 {
+		return true
+	}
+	for _, required := range p.RequiredRoles {
+		if role == required {
+			return true
+		}
+	}
+	return false
+}
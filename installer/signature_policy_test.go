@@ -0,0 +1,89 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func generateKeyPair(t *testing.T) (private, public []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	private = pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	public = pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pub,
+	})
+	return private, public
+}
+
+func TestSignaturePolicy(t *testing.T) {
+	message := []byte("manifest")
+
+	// The signature as found in the manifest.sig file of an artifact.
+	sign := func(privateKey []byte) []byte {
+		sig, err := artifact.NewSigner(privateKey).Sign(message)
+		require.NoError(t, err)
+		return sig
+	}
+
+	vendorPriv, vendorPub := generateKeyPair(t)
+	operatorPriv, operatorPub := generateKeyPair(t)
+	otherPriv, _ := generateKeyPair(t)
+
+	assert.Nil(t, NewSingleKeyPolicy(nil))
+
+	// single key
+	policy := NewSingleKeyPolicy(vendorPub)
+	assert.NoError(t, policy.Verify(message, sign(vendorPriv)))
+	assert.Error(t, policy.Verify(message, sign(operatorPriv)))
+
+	// any of the keys
+	policy = &SignaturePolicy{
+		Keys: []VerificationKey{
+			{Role: "vendor", Key: vendorPub},
+			{Role: "operator", Key: operatorPub},
+		},
+	}
+	assert.NoError(t, policy.Verify(message, sign(vendorPriv)))
+	assert.NoError(t, policy.Verify(message, sign(operatorPriv)))
+	err := policy.Verify(message, sign(otherPriv))
+	assert.EqualError(t, err, "artifact is not signed with any of the verification keys")
+	// signature of another message
+	assert.Error(t, policy.Verify([]byte("other"), sign(vendorPriv)))
+	// several signatures are not one the artifact can carry
+	twice := append(append(sign(vendorPriv), '\n'), sign(operatorPriv)...)
+	assert.Error(t, policy.Verify(message, twice))
+
+	// a key with a specific role
+	policy.RequiredRoles = []string{"operator"}
+	assert.NoError(t, policy.Verify(message, sign(operatorPriv)))
+	err = policy.Verify(message, sign(vendorPriv))
+	assert.EqualError(t, err, `artifact is signed by a key with role "vendor", `+
+		`none of ["operator"]`)
+}
@@ -0,0 +1,267 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultSystemdBootEntryFormat is the name of the boot loader entry of
+	// each root file system partition, with %s in place of the partition
+	// number, unless configured otherwise.
+	DefaultSystemdBootEntryFormat = "mender-%s.conf"
+	// DefaultSystemdBootStatePath is where the boot variables which are not
+	// kept by systemd-boot are stored.
+	DefaultSystemdBootStatePath = "/var/lib/mender/systemd-boot-env"
+
+	// Vendor GUID of the EFI variables of systemd-boot.
+	systemdBootVendorGUID = "4a67b082-0a4c-41cf-b6c7-440b29bb8c4f"
+)
+
+// SystemdBootEnv selects the root file system partition to boot with the
+// EFI variables of systemd-boot, which has a boot loader entry for each
+// partition.
+//
+// A new update is booted once, with LoaderEntryOneShot, and made the default
+// entry, LoaderEntryDefault, when it is committed. If the new entry fails to
+// boot, the firmware boots the default entry instead, which is detected by
+// the entry booted, LoaderEntrySelected, not being the new one; the update is
+// then reported as rolled back by upgrade_available being 0, as the U-Boot
+// integration does.
+//
+// upgrade_available and any other variables are stored in StatePath.
+type SystemdBootEnv struct {
+	EntryFormat string
+	StatePath   string
+}
+
+func NewSystemdBootEnvironment(entryFormat string) (*SystemdBootEnv, error) {
+	if entryFormat == "" {
+		entryFormat = DefaultSystemdBootEntryFormat
+	}
+	if strings.Count(entryFormat, "%s") != 1 {
+		return nil, errors.Errorf("systemd-boot entry format %q must hold %%s "+
+			"exactly once", entryFormat)
+	}
+	return &SystemdBootEnv{
+		EntryFormat: entryFormat,
+		StatePath:   DefaultSystemdBootStatePath,
+	}, nil
+}
+
+func (e *SystemdBootEnv) entry(part string) string {
+	return strings.Replace(e.EntryFormat, "%s", part, 1)
+}
+
+// partition returns the partition number of the entry, or "" if it is not
+// one of the root file system partitions.
+func (e *SystemdBootEnv) partition(entry string) string {
+	i := strings.Index(e.EntryFormat, "%s")
+	prefix, suffix := e.EntryFormat[:i], e.EntryFormat[i+2:]
+	if len(entry) <= len(prefix)+len(suffix) ||
+		!strings.HasPrefix(entry, prefix) || !strings.HasSuffix(entry, suffix) {
+		return ""
+	}
+	return entry[len(prefix) : len(entry)-len(suffix)]
+}
+
+func readLoaderVariable(name string) (string, error) {
+	value, err := system.ReadEfiStringVariable(name, systemdBootVendorGUID)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "failed to read the EFI variable %s", name)
+	}
+	return value, nil
+}
+
+// readBootState reads the boot variables stored by boot environments which
+// do not have a place to store them in the boot loader.
+func readBootState(path string) (BootVars, error) {
+	vars := make(BootVars)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return vars, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "failed to read the boot environment")
+	}
+	if err := json.Unmarshal(data, &vars); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return vars, nil
+}
+
+func writeBootState(path string, vars BootVars) error {
+	data, err := json.Marshal(vars)
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(path, data); err != nil {
+		return errors.Wrap(err, "failed to write the boot environment")
+	}
+	return nil
+}
+
+// filterBootVars returns the given variables which are set, or all of them if
+// none are given, as ReadEnv does.
+func filterBootVars(vars BootVars, names []string) BootVars {
+	if len(names) == 0 {
+		return vars
+	}
+	found := make(BootVars)
+	for _, name := range names {
+		if value, ok := vars[name]; ok {
+			found[name] = value
+		}
+	}
+	return found
+}
+
+// setBootPart sets mender_boot_part, and mender_boot_part_hex which follows
+// it, or unsets them if part is empty.
+func setBootPart(vars BootVars, part string) {
+	if part == "" {
+		delete(vars, "mender_boot_part")
+		delete(vars, "mender_boot_part_hex")
+		return
+	}
+	vars["mender_boot_part"] = part
+	if n, err := strconv.Atoi(part); err == nil {
+		vars["mender_boot_part_hex"] = fmt.Sprintf("%X", n)
+	}
+}
+
+// bootVars returns the stored variables, with mender_boot_part set to the
+// partition which is or will be booted.
+func (e *SystemdBootEnv) bootVars() (BootVars, error) {
+	vars, err := readBootState(e.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	oneShot, err := readLoaderVariable("LoaderEntryOneShot")
+	if err != nil {
+		return nil, err
+	}
+	defaultEntry, err := readLoaderVariable("LoaderEntryDefault")
+	if err != nil {
+		return nil, err
+	}
+	selected, err := readLoaderVariable("LoaderEntrySelected")
+	if err != nil {
+		return nil, err
+	}
+	if defaultEntry == "" {
+		defaultEntry = selected
+	}
+
+	part := vars["mender_boot_part"]
+	switch {
+	case oneShot != "":
+		// The update has not been booted yet.
+		part = e.partition(oneShot)
+
+	case vars["upgrade_available"] == "1" && selected != e.entry(part):
+		// The update was booted once, but the firmware fell back to
+		// the default entry.
+		part = e.partition(defaultEntry)
+		log.Warnf("Booting %s failed; %s was booted instead",
+			e.entry(vars["mender_boot_part"]), selected)
+		vars["upgrade_available"] = "0"
+		vars["mender_boot_part"] = part
+		if err := writeBootState(e.StatePath, vars); err != nil {
+			log.Errorf("Failed to store the fallback to %s: %v", defaultEntry, err)
+		}
+
+	case vars["upgrade_available"] == "1":
+		// The update was booted, and waits to be committed.
+
+	case defaultEntry != "":
+		part = e.partition(defaultEntry)
+	}
+
+	setBootPart(vars, part)
+	return vars, nil
+}
+
+// ReadEnv returns the given variables which are set, or all of them if none
+// are given.
+func (e *SystemdBootEnv) ReadEnv(names ...string) (BootVars, error) {
+	vars, err := e.bootVars()
+	if err != nil {
+		return nil, err
+	}
+	return filterBootVars(vars, names), nil
+}
+
+// WriteEnv sets the variables, and unsets those with empty values. Setting
+// upgrade_available to 1 arms a single boot of the entry of mender_boot_part,
+// and setting it to 0 makes that entry the default.
+func (e *SystemdBootEnv) WriteEnv(vars BootVars) error {
+	state, err := e.bootVars()
+	if err != nil {
+		return err
+	}
+	for name, value := range vars {
+		if value == "" {
+			delete(state, name)
+		} else {
+			state[name] = value
+		}
+	}
+	// It follows mender_boot_part.
+	delete(state, "mender_boot_part_hex")
+
+	_, setPart := vars["mender_boot_part"]
+	_, setUpgrade := vars["upgrade_available"]
+	part := state["mender_boot_part"]
+	if (!setPart && !setUpgrade) || part == "" {
+		return writeBootState(e.StatePath, state)
+	}
+
+	// Either way the update is not booted unless both the state and the
+	// EFI variables say so, should writing them be interrupted.
+	entry := e.entry(part)
+	if state["upgrade_available"] == "1" {
+		if err := writeBootState(e.StatePath, state); err != nil {
+			return err
+		}
+		log.Infof("Booting %s once", entry)
+		if err := system.WriteEfiStringVariable("LoaderEntryOneShot",
+			systemdBootVendorGUID, entry); err != nil {
+			return errors.Wrap(err, "failed to set LoaderEntryOneShot")
+		}
+		return nil
+	}
+
+	log.Infof("Making %s the default boot loader entry", entry)
+	if err := system.DeleteEfiVariable("LoaderEntryOneShot",
+		systemdBootVendorGUID); err != nil {
+		return errors.Wrap(err, "failed to unset LoaderEntryOneShot")
+	}
+	if err := system.WriteEfiStringVariable("LoaderEntryDefault",
+		systemdBootVendorGUID, entry); err != nil {
+		return errors.Wrap(err, "failed to set LoaderEntryDefault")
+	}
+	return writeBootState(e.StatePath, state)
+}
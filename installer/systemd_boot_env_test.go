@@ -0,0 +1,114 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/system"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setLoaderVariable(t *testing.T, name, value string) {
+	if value == "" {
+		require.NoError(t, system.DeleteEfiVariable(name, systemdBootVendorGUID))
+	} else {
+		require.NoError(t, system.WriteEfiStringVariable(name, systemdBootVendorGUID, value))
+	}
+}
+
+func TestSystemdBootEnv(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	oldEfiVarsDir := system.EfiVarsDir
+	defer func() { system.EfiVarsDir = oldEfiVarsDir }()
+	system.EfiVarsDir = tdir
+
+	env, err := NewSystemdBootEnvironment("")
+	require.NoError(t, err)
+	env.StatePath = path.Join(tdir, "state")
+
+	// Booted from the default entry.
+	setLoaderVariable(t, "LoaderEntryDefault", "mender-2.conf")
+	setLoaderVariable(t, "LoaderEntrySelected", "mender-2.conf")
+	vars, err := env.ReadEnv("mender_boot_part", "mender_boot_part_hex", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "2", "mender_boot_part_hex": "2"}, vars)
+
+	// An update is installed, and booted once.
+	assert.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "3",
+		"mender_boot_part_hex": "3", "upgrade_available": "1", "bootcount": "0"}))
+	oneShot, err := system.ReadEfiStringVariable("LoaderEntryOneShot", systemdBootVendorGUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "mender-3.conf", oneShot)
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "upgrade_available": "1"}, vars)
+
+	// The update boots, and is committed.
+	setLoaderVariable(t, "LoaderEntryOneShot", "")
+	setLoaderVariable(t, "LoaderEntrySelected", "mender-3.conf")
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "upgrade_available": "1"}, vars)
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "0"}))
+	defaultEntry, err := system.ReadEfiStringVariable("LoaderEntryDefault", systemdBootVendorGUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "mender-3.conf", defaultEntry)
+	vars, err = env.ReadEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "mender_boot_part_hex": "3",
+		"upgrade_available": "0", "bootcount": "0"}, vars)
+
+	// Another update fails to boot, and the default entry is booted
+	// instead.
+	assert.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "2",
+		"upgrade_available": "1"}))
+	setLoaderVariable(t, "LoaderEntryOneShot", "")
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "upgrade_available": "0"}, vars)
+	state, err := readBootState(env.StatePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "0", state["upgrade_available"])
+
+	// Rolling back an update which has not been booted.
+	assert.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "2",
+		"upgrade_available": "1"}))
+	assert.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "3",
+		"upgrade_available": "0"}))
+	_, err = system.ReadEfiStringVariable("LoaderEntryOneShot", systemdBootVendorGUID)
+	assert.True(t, os.IsNotExist(err))
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "3", "upgrade_available": "0"}, vars)
+}
+
+func TestSystemdBootEntryFormat(t *testing.T) {
+	env, err := NewSystemdBootEnvironment("rootfs-%s-x.conf")
+	require.NoError(t, err)
+	assert.Equal(t, "rootfs-5-x.conf", env.entry("5"))
+	assert.Equal(t, "5", env.partition("rootfs-5-x.conf"))
+	assert.Equal(t, "", env.partition("rootfs--x.conf"))
+	assert.Equal(t, "", env.partition("other.conf"))
+
+	for _, format := range []string{"mender.conf", "mender-%s-%s.conf"} {
+		_, err = NewSystemdBootEnvironment(format)
+		assert.Error(t, err, format)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package testutils provides in-memory block devices for testing installers,
+// without real block devices or temporary files.
+package testutils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/mendersoftware/mender/installer"
+)
+
+// DefaultSectorSize is the logical sector size of the devices, unless given.
+const DefaultSectorSize = 512
+
+// BlockDevice is an in-memory block device of a fixed size, which is opened
+// by the installers through Devices.
+type BlockDevice struct {
+	lock       sync.Mutex
+	data       []byte
+	sectorSize int
+	syncs      int
+
+	// If set, the writes reaching WriteErrorOffset fail with
+	// WriteError, after writing up to it; set before the device is
+	// opened.
+	WriteError       error
+	WriteErrorOffset int64
+	// If set, syncing the device fails with it.
+	SyncError error
+}
+
+// NewBlockDevice returns a zeroed device of the size, with the sector size,
+// or DefaultSectorSize if 0.
+func NewBlockDevice(size uint64, sectorSize int) *BlockDevice {
+	if sectorSize == 0 {
+		sectorSize = DefaultSectorSize
+	}
+	return &BlockDevice{
+		data:       make([]byte, size),
+		sectorSize: sectorSize,
+	}
+}
+
+// NewBlockDeviceWithContent returns a device holding the content, and as
+// large.
+func NewBlockDeviceWithContent(content []byte, sectorSize int) *BlockDevice {
+	d := NewBlockDevice(uint64(len(content)), sectorSize)
+	copy(d.data, content)
+	return d
+}
+
+// Bytes returns a copy of the content of the device.
+func (d *BlockDevice) Bytes() []byte {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]byte(nil), d.data...)
+}
+
+// Syncs returns how many times the device has been synced.
+func (d *BlockDevice) Syncs() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.syncs
+}
+
+// Devices are the in-memory block devices by path.
+type Devices map[string]*BlockDevice
+
+// Open opens the device at the path, with the flags of os.OpenFile; it is an
+// installer.BlockDeviceOpenFunc, to set as BlockDevice.Open or
+// DualRootfsDeviceConfig.OpenBlockDevice.
+func (d Devices) Open(path string, flag int) (installer.BlockDeviceFile, error) {
+	dev, ok := d[path]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return &blockDeviceFile{dev: dev, path: path, flag: flag}, nil
+}
+
+// blockDeviceFile is a device opened by Devices.Open, with its own offset.
+type blockDeviceFile struct {
+	dev    *BlockDevice
+	path   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+var errClosed = errors.New("block device already closed")
+
+func (f *blockDeviceFile) check(op string, write bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.path, Err: errClosed}
+	}
+	mode := f.flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	if (write && mode == os.O_RDONLY) || (!write && mode == os.O_WRONLY) {
+		return &os.PathError{Op: op, Path: f.path, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *blockDeviceFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *blockDeviceFile) ReadAt(p []byte, offset int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	f.dev.lock.Lock()
+	defer f.dev.lock.Unlock()
+
+	if offset >= int64(len(f.dev.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.dev.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *blockDeviceFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *blockDeviceFile) WriteAt(p []byte, offset int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	f.dev.lock.Lock()
+	defer f.dev.lock.Unlock()
+
+	end := offset + int64(len(p))
+	var err error
+	if f.dev.WriteError != nil && end > f.dev.WriteErrorOffset {
+		end = f.dev.WriteErrorOffset
+		err = f.dev.WriteError
+	}
+	if end > int64(len(f.dev.data)) {
+		end = int64(len(f.dev.data))
+		err = &os.PathError{Op: "write", Path: f.path, Err: syscall.ENOSPC}
+	}
+	if end <= offset {
+		return 0, err
+	}
+	return copy(f.dev.data[offset:end], p), err
+}
+
+func (f *blockDeviceFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.path, Err: errClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.dev.lock.Lock()
+		offset += int64(len(f.dev.data))
+		f.dev.lock.Unlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.path, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *blockDeviceFile) Sync() error {
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.path, Err: errClosed}
+	}
+	f.dev.lock.Lock()
+	defer f.dev.lock.Unlock()
+	if f.dev.SyncError != nil {
+		return f.dev.SyncError
+	}
+	f.dev.syncs++
+	return nil
+}
+
+func (f *blockDeviceFile) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.path, Err: errClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *blockDeviceFile) Size() (uint64, error) {
+	f.dev.lock.Lock()
+	defer f.dev.lock.Unlock()
+	return uint64(len(f.dev.data)), nil
+}
+
+func (f *blockDeviceFile) SectorSize() (int, error) {
+	return f.dev.sectorSize, nil
+}
+
+// Discard zeroes the range, as the discarded blocks of most devices read.
+func (f *blockDeviceFile) Discard(offset, length uint64) error {
+	if err := f.check("discard", true); err != nil {
+		return err
+	}
+	f.dev.lock.Lock()
+	defer f.dev.lock.Unlock()
+
+	if offset+length > uint64(len(f.dev.data)) {
+		return &os.PathError{Op: "discard", Path: f.path, Err: syscall.EINVAL}
+	}
+	for i := range f.dev.data[offset : offset+length] {
+		f.dev.data[offset+uint64(i)] = 0
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package testutils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mendersoftware/mender/installer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockDeviceWrite(t *testing.T) {
+	dev := NewBlockDevice(8192, 0)
+	devices := Devices{"/dev/mmcblk0p3": dev}
+	image := bytes.Repeat([]byte("mender"), 1000)
+
+	bd := &installer.BlockDevice{
+		Path:               "/dev/mmcblk0p3",
+		Open:               devices.Open,
+		ImageSize:          int64(len(image)),
+		FlushIntervalBytes: 1024,
+	}
+	size, err := bd.Size()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8192), size)
+	sectorSize, err := bd.SectorSize()
+	require.NoError(t, err)
+	assert.Equal(t, DefaultSectorSize, sectorSize)
+
+	n, err := io.Copy(bd, bytes.NewReader(image))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(image)), n)
+	require.NoError(t, bd.Close())
+	assert.Equal(t, image, dev.Bytes()[:len(image)])
+	assert.True(t, dev.Syncs() > 1)
+
+	read, err := ioutil.ReadAll(io.LimitReader(bd, int64(len(image))))
+	require.NoError(t, err)
+	assert.Equal(t, image, read)
+	require.NoError(t, bd.Close())
+
+	// Only the blocks which differ are written.
+	bd.SkipIdentical = true
+	image[100] = 'M'
+	_, err = io.Copy(bd, bytes.NewReader(image))
+	require.NoError(t, err)
+	require.NoError(t, bd.Close())
+	assert.Equal(t, image, dev.Bytes()[:len(image)])
+
+	require.NoError(t, bd.Discard())
+	assert.Equal(t, make([]byte, 8192), dev.Bytes())
+
+	_, err = (&installer.BlockDevice{Path: "/dev/mmcblk0p2", Open: devices.Open}).Size()
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBlockDeviceErrors(t *testing.T) {
+	dev := NewBlockDeviceWithContent(make([]byte, 4096), 4096)
+	devices := Devices{"/dev/sda3": dev}
+	dev.WriteError = errors.New("I/O error")
+	dev.WriteErrorOffset = 1024
+
+	bd := &installer.BlockDevice{Path: "/dev/sda3", Open: devices.Open, ImageSize: 2048}
+	n, err := bd.Write(bytes.Repeat([]byte{1}, 2048))
+	assert.EqualError(t, err, "I/O error")
+	assert.Equal(t, 1024, n)
+	assert.NoError(t, bd.Close())
+	assert.Equal(t, bytes.Repeat([]byte{1}, 1024), dev.Bytes()[:1024])
+	assert.Equal(t, make([]byte, 3072), dev.Bytes()[1024:])
+
+	// The writes are synced as often as FlushIntervalBytes, here every
+	// write.
+	dev.WriteError = nil
+	dev.SyncError = errors.New("sync failed")
+	_, err = bd.Write(bytes.Repeat([]byte{1}, 2048))
+	assert.EqualError(t, err, "sync failed")
+	assert.EqualError(t, bd.Close(), "sync failed")
+	dev.SyncError = nil
+	// The device is closed nonetheless, so that it can be opened again.
+	_, err = bd.Read(make([]byte, 1))
+	assert.NoError(t, err)
+	assert.NoError(t, bd.Close())
+
+	// Files opened for reading can not be written.
+	f, err := devices.Open("/dev/sda3", os.O_RDONLY)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1})
+	assert.Error(t, err)
+	require.NoError(t, f.Close())
+	_, err = f.Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	// Nor beyond the end of the device.
+	f, err = devices.Open("/dev/sda3", os.O_WRONLY)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{1, 2}, 4095)
+	assert.Error(t, err)
+}
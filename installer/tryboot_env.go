@@ -0,0 +1,296 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultAutobootPath is where the autoboot.txt of the Raspberry Pi
+	// firmware is expected, unless configured otherwise.
+	DefaultAutobootPath = "/boot/firmware/autoboot.txt"
+	// DefaultTrybootStatePath is where the boot variables which are not
+	// kept by the firmware are stored.
+	DefaultTrybootStatePath = "/var/lib/mender/tryboot-env"
+
+	// The boot during which the update was installed, so that it is known
+	// whether the device has rebooted into it since.
+	trybootBootIDVar = "tryboot_boot_id"
+)
+
+// Overridable for tests.
+var (
+	// Where the Raspberry Pi firmware tells how the system was booted.
+	piBootloaderDir = "/proc/device-tree/chosen/bootloader"
+	bootIDPath      = "/proc/sys/kernel/random/boot_id"
+)
+
+// TrybootEnv selects the partition to boot with the tryboot mechanism of the
+// Raspberry Pi firmware, without U-Boot. The firmware boots the partition
+// given by the [all] section of autoboot.txt, unless rebooted with
+// "reboot '0 tryboot'", which boots the partition of the [tryboot] section
+// once. Should that fail, the firmware boots the [all] partition again.
+//
+// A new update is installed to the [tryboot] section, and moved to the [all]
+// section when it is committed. If it was not booted with tryboot, the update
+// is reported as rolled back by upgrade_available being 0, as the U-Boot
+// integration does.
+//
+// upgrade_available and any other variables are stored in StatePath.
+type TrybootEnv struct {
+	AutobootPath string
+	// The boot partition of each root file system partition, if they are
+	// not the same, both given by their numbers.
+	BootPartitions map[string]string
+	StatePath      string
+}
+
+func NewTrybootEnvironment(autobootPath string, bootPartitions map[string]string) (*TrybootEnv, error) {
+	if autobootPath == "" {
+		autobootPath = DefaultAutobootPath
+	}
+	for rootfs, boot := range bootPartitions {
+		if _, err := strconv.Atoi(rootfs); err != nil {
+			return nil, errors.Errorf("invalid root file system partition %q", rootfs)
+		}
+		if _, err := strconv.Atoi(boot); err != nil {
+			return nil, errors.Errorf("invalid boot partition %q", boot)
+		}
+	}
+	return &TrybootEnv{
+		AutobootPath:   autobootPath,
+		BootPartitions: bootPartitions,
+		StatePath:      DefaultTrybootStatePath,
+	}, nil
+}
+
+func (e *TrybootEnv) bootPartition(rootfs string) string {
+	if boot, ok := e.BootPartitions[rootfs]; ok {
+		return boot
+	}
+	return rootfs
+}
+
+func (e *TrybootEnv) rootfsPartition(boot string) string {
+	for rootfs, b := range e.BootPartitions {
+		if b == boot {
+			return rootfs
+		}
+	}
+	return boot
+}
+
+// readBootloaderValue reads a value the firmware put in the device tree,
+// which is a big endian 32 bit integer; ok is false if it is not there.
+func readBootloaderValue(name string) (value uint32, ok bool, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(piBootloaderDir, name))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, errors.Wrapf(err, "failed to read the boot loader %s", name)
+	} else if len(data) != 4 {
+		return 0, false, errors.Errorf("invalid boot loader %s", name)
+	}
+	return binary.BigEndian.Uint32(data), true, nil
+}
+
+func readBootID() (string, error) {
+	data, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the boot ID")
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// defaultBootPartition returns the boot partition of the [all] section of
+// autoboot.txt, or the partition booted if it does not give one.
+func (e *TrybootEnv) defaultBootPartition() (string, error) {
+	data, err := ioutil.ReadFile(e.AutobootPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "failed to read autoboot.txt")
+	}
+	section := "all"
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line[1 : len(line)-1])
+		} else if section == "all" && strings.HasPrefix(line, "boot_partition=") {
+			return strings.TrimPrefix(line, "boot_partition="), nil
+		}
+	}
+
+	booted, ok, err := readBootloaderValue("partition")
+	if err != nil || !ok {
+		return "", err
+	}
+	return strconv.Itoa(int(booted)), nil
+}
+
+func (e *TrybootEnv) writeAutoboot(defaultBoot, tryBoot string) error {
+	content := fmt.Sprintf("[all]\ntryboot_a_b=1\nboot_partition=%s\n"+
+		"[tryboot]\nboot_partition=%s\n", defaultBoot, tryBoot)
+	if err := replaceFile(e.AutobootPath, []byte(content)); err != nil {
+		return errors.Wrap(err, "failed to write autoboot.txt")
+	}
+	return nil
+}
+
+// bootVars returns the stored variables, with mender_boot_part set to the
+// partition which is or will be booted, and the internal trybootBootIDVar.
+func (e *TrybootEnv) bootVars() (BootVars, error) {
+	vars, err := readBootState(e.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	defaultBoot, err := e.defaultBootPartition()
+	if err != nil {
+		return nil, err
+	}
+
+	part := vars["mender_boot_part"]
+	if vars["upgrade_available"] == "1" {
+		bootID, err := readBootID()
+		if err != nil {
+			return nil, err
+		}
+		tryboot, _, err := readBootloaderValue("tryboot")
+		if err != nil {
+			return nil, err
+		}
+		booted, _, err := readBootloaderValue("partition")
+		if err != nil {
+			return nil, err
+		}
+
+		if vars[trybootBootIDVar] != bootID &&
+			(tryboot != 1 || strconv.Itoa(int(booted)) != e.bootPartition(part)) {
+			// The firmware fell back to the [all] partition.
+			log.Warnf("Booting partition %s with tryboot failed; partition "+
+				"%d was booted instead", e.bootPartition(part), booted)
+			part = e.rootfsPartition(defaultBoot)
+			vars["upgrade_available"] = "0"
+			vars["mender_boot_part"] = part
+			delete(vars, trybootBootIDVar)
+			if err := writeBootState(e.StatePath, vars); err != nil {
+				log.Errorf("Failed to store the fallback to partition %s: %v",
+					defaultBoot, err)
+			}
+		}
+	} else if defaultBoot != "" {
+		part = e.rootfsPartition(defaultBoot)
+	}
+
+	setBootPart(vars, part)
+	return vars, nil
+}
+
+// ReadEnv returns the given variables which are set, or all of them if none
+// are given.
+func (e *TrybootEnv) ReadEnv(names ...string) (BootVars, error) {
+	vars, err := e.bootVars()
+	if err != nil {
+		return nil, err
+	}
+	delete(vars, trybootBootIDVar)
+	return filterBootVars(vars, names), nil
+}
+
+// WriteEnv sets the variables, and unsets those with empty values. Setting
+// upgrade_available to 1 sets the partition of mender_boot_part to be booted
+// with tryboot, and setting it to 0 makes it the partition booted otherwise.
+func (e *TrybootEnv) WriteEnv(vars BootVars) error {
+	state, err := e.bootVars()
+	if err != nil {
+		return err
+	}
+	for name, value := range vars {
+		if value == "" {
+			delete(state, name)
+		} else {
+			state[name] = value
+		}
+	}
+	// It follows mender_boot_part.
+	delete(state, "mender_boot_part_hex")
+
+	_, setPart := vars["mender_boot_part"]
+	_, setUpgrade := vars["upgrade_available"]
+	part := state["mender_boot_part"]
+	if (!setPart && !setUpgrade) || part == "" {
+		return writeBootState(e.StatePath, state)
+	}
+
+	// Either way the update is not booted unless both the state and
+	// autoboot.txt say so, should writing them be interrupted.
+	boot := e.bootPartition(part)
+	if state["upgrade_available"] == "1" {
+		bootID, err := readBootID()
+		if err != nil {
+			return err
+		}
+		defaultBoot, err := e.defaultBootPartition()
+		if err != nil {
+			return err
+		}
+		if defaultBoot == "" {
+			return errors.New("unable to tell which partition is booted by default")
+		}
+		state[trybootBootIDVar] = bootID
+		if err := writeBootState(e.StatePath, state); err != nil {
+			return err
+		}
+		log.Infof("Booting partition %s once with tryboot", boot)
+		return e.writeAutoboot(defaultBoot, boot)
+	}
+
+	delete(state, trybootBootIDVar)
+	log.Infof("Making partition %s the partition booted by default", boot)
+	if err := e.writeAutoboot(boot, boot); err != nil {
+		return err
+	}
+	return writeBootState(e.StatePath, state)
+}
+
+// RebootArgument tells the firmware to boot the update with tryboot, if one
+// has been installed since the last boot.
+func (e *TrybootEnv) RebootArgument() (string, error) {
+	state, err := readBootState(e.StatePath)
+	if err != nil {
+		return "", err
+	}
+	if state["upgrade_available"] != "1" {
+		return "", nil
+	}
+	bootID, err := readBootID()
+	if err != nil {
+		return "", err
+	}
+	if state[trybootBootIDVar] != bootID {
+		return "", nil
+	}
+	return "0 tryboot", nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setBoot sets how the firmware booted the system.
+func setBoot(t *testing.T, dir, bootID string, tryboot, partition uint32) {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, tryboot)
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "tryboot"), value, 0644))
+	binary.BigEndian.PutUint32(value, partition)
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "partition"), value, 0644))
+	require.NoError(t, ioutil.WriteFile(bootIDPath, []byte(bootID+"\n"), 0644))
+}
+
+func TestTrybootEnv(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+	oldBootloaderDir, oldBootIDPath := piBootloaderDir, bootIDPath
+	defer func() { piBootloaderDir, bootIDPath = oldBootloaderDir, oldBootIDPath }()
+	piBootloaderDir = tdir
+	bootIDPath = path.Join(tdir, "boot_id")
+
+	env, err := NewTrybootEnvironment(path.Join(tdir, "autoboot.txt"),
+		map[string]string{"5": "2", "6": "3"})
+	require.NoError(t, err)
+	env.StatePath = path.Join(tdir, "state")
+	autoboot := func() string {
+		content, err := ioutil.ReadFile(env.AutobootPath)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	// Without autoboot.txt, the partition booted is the default.
+	setBoot(t, tdir, "boot1", 0, 2)
+	vars, err := env.ReadEnv("mender_boot_part", "mender_boot_part_hex", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "5", "mender_boot_part_hex": "5"}, vars)
+	arg, err := env.RebootArgument()
+	assert.NoError(t, err)
+	assert.Equal(t, "", arg)
+
+	// An update is installed, to be booted with tryboot.
+	assert.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "6",
+		"mender_boot_part_hex": "6", "upgrade_available": "1", "bootcount": "0"}))
+	assert.Equal(t, "[all]\ntryboot_a_b=1\nboot_partition=2\n"+
+		"[tryboot]\nboot_partition=3\n", autoboot())
+	arg, err = env.RebootArgument()
+	assert.NoError(t, err)
+	assert.Equal(t, "0 tryboot", arg)
+	vars, err = env.ReadEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "6", "mender_boot_part_hex": "6",
+		"upgrade_available": "1", "bootcount": "0"}, vars)
+
+	// The update boots, and is committed.
+	setBoot(t, tdir, "boot2", 1, 3)
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "6", "upgrade_available": "1"}, vars)
+	arg, err = env.RebootArgument()
+	assert.NoError(t, err)
+	assert.Equal(t, "", arg)
+	assert.NoError(t, env.WriteEnv(BootVars{"upgrade_available": "0"}))
+	assert.Equal(t, "[all]\ntryboot_a_b=1\nboot_partition=3\n"+
+		"[tryboot]\nboot_partition=3\n", autoboot())
+
+	setBoot(t, tdir, "boot3", 0, 3)
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "6", "upgrade_available": "0"}, vars)
+
+	// Another update fails to boot, and the firmware falls back.
+	assert.NoError(t, env.WriteEnv(BootVars{"mender_boot_part": "5",
+		"upgrade_available": "1"}))
+	setBoot(t, tdir, "boot4", 0, 3)
+	vars, err = env.ReadEnv("mender_boot_part", "upgrade_available")
+	assert.NoError(t, err)
+	assert.Equal(t, BootVars{"mender_boot_part": "6", "upgrade_available": "0"}, vars)
+	state, err := readBootState(env.StatePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "0", state["upgrade_available"])
+	assert.NotContains(t, state, trybootBootIDVar)
+}
+
+func TestNewTrybootEnvironment(t *testing.T) {
+	env, err := NewTrybootEnvironment("", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultAutobootPath, env.AutobootPath)
+	assert.Equal(t, "2", env.bootPartition("2"))
+	assert.Equal(t, "3", env.rootfsPartition("3"))
+
+	for _, partitions := range []map[string]string{
+		{"a": "2"},
+		{"2": "b"},
+	} {
+		_, err = NewTrybootEnvironment("", partitions)
+		assert.Error(t, err, "%v", partitions)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"encoding/hex"
+	"io"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// Payload meta-data keys of read-only root file system images protected by
+// dm-verity, whose hash tree is appended to the image at the hash offset.
+const (
+	MetaDataRootfsImageVerityRootHash   = "rootfs_image_verity_root_hash"
+	MetaDataRootfsImageVerityHashOffset = "rootfs_image_verity_hash_offset"
+)
+
+// The prefix of the boot variables holding the dm-verity root hash of each
+// rootfs partition, by partition number, for the boot loader to give the
+// kernel along with mender_boot_part; so that rolling back needs no change
+// of them.
+const verityRootHashBootVarPrefix = "mender_boot_verity_root_hash_"
+
+// verityImage is the dm-verity layout of a payload: the file system up to the
+// hash offset is written to the inactive partition, and the hash tree after
+// it to the hash partition of the inactive partition.
+type verityImage struct {
+	rootHash   string
+	hashOffset int64
+}
+
+// verityImageFromMetaData returns the dm-verity layout of the payload, or
+// nil if it is not protected by dm-verity.
+func verityImageFromMetaData(metaData map[string]interface{}) (*verityImage, error) {
+	_, hasRootHash := metaData[MetaDataRootfsImageVerityRootHash]
+	_, hasHashOffset := metaData[MetaDataRootfsImageVerityHashOffset]
+	if !hasRootHash && !hasHashOffset {
+		return nil, nil
+	} else if !hasRootHash || !hasHashOffset {
+		return nil, errors.Errorf("both %s and %s must be given in the payload meta-data",
+			MetaDataRootfsImageVerityRootHash, MetaDataRootfsImageVerityHashOffset)
+	}
+
+	rootHash, ok := metaData[MetaDataRootfsImageVerityRootHash].(string)
+	if !ok {
+		return nil, errors.Errorf("payload meta-data %s must be a string",
+			MetaDataRootfsImageVerityRootHash)
+	}
+	if decoded, err := hex.DecodeString(rootHash); err != nil || len(decoded) == 0 {
+		return nil, errors.Errorf("payload meta-data %s must be a hex encoded hash, not %q",
+			MetaDataRootfsImageVerityRootHash, rootHash)
+	}
+	hashOffset, err := metaDataInt(metaData, MetaDataRootfsImageVerityHashOffset)
+	if err != nil {
+		return nil, err
+	}
+	if hashOffset <= 0 {
+		return nil, errors.Errorf("invalid %s %d in payload meta-data",
+			MetaDataRootfsImageVerityHashOffset, hashOffset)
+	}
+	return &verityImage{rootHash: rootHash, hashOffset: hashOffset}, nil
+}
+
+// verityRootHashBootVar returns the boot variable holding the dm-verity root
+// hash of the rootfs partition with the number.
+func verityRootHashBootVar(partitionNumber string) string {
+	return verityRootHashBootVarPrefix + partitionNumber
+}
+
+// verityHashPartition returns the dm-verity hash partition of the rootfs
+// partition.
+func (d *dualRootfsDeviceImpl) verityHashPartition(partition string) (string, error) {
+	if len(d.verityHashParts) == 0 {
+		return "", errors.New("the payload is protected by dm-verity, but no " +
+			"hash partitions are configured")
+	}
+	if len(d.verityHashParts) != len(d.rootfsParts) {
+		return "", errors.Errorf("%d dm-verity hash partitions are configured "+
+			"for %d rootfs partitions", len(d.verityHashParts), len(d.rootfsParts))
+	}
+	for i, part := range d.rootfsParts {
+		if part == partition {
+			return d.verityHashParts[i], nil
+		}
+	}
+	return "", errors.Errorf("no dm-verity hash partition of %s", partition)
+}
+
+// writeVerityHashTree writes the hash tree of the payload to the hash
+// partition.
+func writeVerityHashTree(hashPartition string, open BlockDeviceOpenFunc,
+	hashTree io.Reader, size int64) error {
+
+	b := &BlockDevice{
+		Path:               hashPartition,
+		Open:               open,
+		ImageSize:          size,
+		FlushIntervalBytes: 4 * 1024 * 1024,
+	}
+	if bsz, err := b.Size(); err != nil {
+		return errors.Wrapf(err, "failed to read size of dm-verity hash partition %s",
+			hashPartition)
+	} else if bsz < uint64(size) {
+		log.Errorf("dm-verity hash tree (%v bytes) is larger than the hash partition "+
+			"%s (%v bytes)", size, hashPartition, bsz)
+		return syscall.ENOSPC
+	}
+
+	w, err := chunkedCopy(b, hashTree, DefaultWriteBufferSize)
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && w != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to write the dm-verity hash tree to %s",
+			hashPartition)
+	}
+	log.Infof("wrote %v bytes of dm-verity hash tree to device %v", w, hashPartition)
+	return nil
+}
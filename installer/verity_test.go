@@ -0,0 +1,132 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerityImageFromMetaData(t *testing.T) {
+	verity, err := verityImageFromMetaData(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, verity)
+
+	verity, err = verityImageFromMetaData(map[string]interface{}{
+		MetaDataRootfsImageVerityRootHash:   "4d8f0b6a1c",
+		MetaDataRootfsImageVerityHashOffset: float64(1048576),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &verityImage{rootHash: "4d8f0b6a1c", hashOffset: 1048576}, verity)
+
+	for _, metaData := range []map[string]interface{}{
+		{MetaDataRootfsImageVerityRootHash: "4d8f0b6a1c"},
+		{MetaDataRootfsImageVerityHashOffset: float64(4096)},
+		{MetaDataRootfsImageVerityRootHash: "", MetaDataRootfsImageVerityHashOffset: float64(4096)},
+		{MetaDataRootfsImageVerityRootHash: "xyz", MetaDataRootfsImageVerityHashOffset: float64(4096)},
+		{MetaDataRootfsImageVerityRootHash: float64(1), MetaDataRootfsImageVerityHashOffset: float64(4096)},
+		{MetaDataRootfsImageVerityRootHash: "4d8f", MetaDataRootfsImageVerityHashOffset: float64(0)},
+		{MetaDataRootfsImageVerityRootHash: "4d8f", MetaDataRootfsImageVerityHashOffset: "4096"},
+	} {
+		_, err = verityImageFromMetaData(metaData)
+		assert.Error(t, err, "%v", metaData)
+	}
+}
+
+func TestStoreUpdateVerity(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "verity")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	var parts, hashParts []string
+	for _, name := range []string{"rootfs2", "rootfs3", "hash2", "hash3"} {
+		path := tmp + "/" + name
+		require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+		if strings.HasPrefix(name, "rootfs") {
+			parts = append(parts, path)
+		} else {
+			hashParts = append(hashParts, path)
+		}
+	}
+
+	env := &fakeBootEnv{}
+	testDevice := dualRootfsDeviceImpl{
+		BootEnvReadWriter: env,
+		partitions:        &partitions{rootfsParts: parts, inactive: parts[1]},
+		verity:            &verityImage{rootHash: "4d8f0b6a1c", hashOffset: 6},
+		verityHashParts:   hashParts,
+		verifyWrite:       true,
+	}
+
+	old := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = old
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 8, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 512, nil }
+
+	image := "rootfs:hashes"
+	err = testDevice.StoreUpdate(strings.NewReader(image),
+		&sizeOnlyFileInfo{int64(len(image))})
+	require.NoError(t, err)
+
+	content, err := ioutil.ReadFile(parts[1])
+	require.NoError(t, err)
+	assert.Equal(t, "rootfs", string(content))
+	content, err = ioutil.ReadFile(hashParts[1])
+	require.NoError(t, err)
+	assert.Equal(t, ":hashes", string(content))
+	content, err = ioutil.ReadFile(hashParts[0])
+	require.NoError(t, err)
+	assert.Empty(t, content)
+
+	// The root hash is set by partition number, and unset if the update
+	// is not protected by dm-verity.
+	require.NoError(t, testDevice.InstallUpdate())
+	assert.Equal(t, "3", env.writeVars["mender_boot_part"])
+	assert.Equal(t, "4d8f0b6a1c", env.writeVars["mender_boot_verity_root_hash_3"])
+
+	testDevice.verity = nil
+	testDevice.written = nil
+	require.NoError(t, testDevice.InstallUpdate())
+	rootHash, ok := env.writeVars["mender_boot_verity_root_hash_3"]
+	assert.True(t, ok)
+	assert.Equal(t, "", rootHash)
+
+	// The hash tree must fit the hash partition.
+	testDevice.verity = &verityImage{rootHash: "4d8f0b6a1c", hashOffset: 2}
+	err = testDevice.StoreUpdate(strings.NewReader(image),
+		&sizeOnlyFileInfo{int64(len(image))})
+	assert.Error(t, err)
+
+	// The hash offset must be inside the image.
+	testDevice.verity = &verityImage{rootHash: "4d8f0b6a1c", hashOffset: 13}
+	err = testDevice.StoreUpdate(strings.NewReader(image),
+		&sizeOnlyFileInfo{int64(len(image))})
+	assert.Error(t, err)
+
+	// Hash partitions must be configured.
+	testDevice.verity = &verityImage{rootHash: "4d8f0b6a1c", hashOffset: 6}
+	testDevice.verityHashParts = nil
+	err = testDevice.StoreUpdate(strings.NewReader(image),
+		&sizeOnlyFileInfo{int64(len(image))})
+	assert.Error(t, err)
+}
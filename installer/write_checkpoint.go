@@ -0,0 +1,253 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// How often, in bytes written, the progress of writing an update to the
+// inactive partition is recorded; rounded up to a multiple of the size of the
+// writes. Overridden in tests.
+var writeCheckpointInterval int64 = 16 * 1024 * 1024
+
+// How much of what was written before the write was interrupted is read back
+// from the partition when resuming, to check that it is really there.
+const writeCheckpointOverlap = 64 * 1024
+
+// StoreResumer is implemented by the payload installers which can resume
+// storing a payload where an interrupted attempt stopped, rather than from the
+// start.
+type StoreResumer interface {
+	// CanResumeStore returns whether storing a payload was interrupted
+	// after part of it was stored, and can be resumed.
+	CanResumeStore() bool
+}
+
+// CanResumeStore returns whether storing the payload of the artifact was
+// interrupted, and can be resumed by fetching the artifact again.
+func CanResumeStore(installers []PayloadUpdatePerformer) bool {
+	for _, inst := range installers {
+		if resumer, ok := inst.(StoreResumer); ok && resumer.CanResumeStore() {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCheckpoint is the progress of writing a payload to the inactive
+// partition, recorded so that the write can be resumed at the same offset if it
+// is interrupted.
+type writeCheckpoint struct {
+	Partition string
+	// Checksum of the payload file, from the artifact manifest.
+	Payload string
+	// Bytes of the image written, and synced to the partition.
+	Offset int64
+	// The state of the SHA-256 hash of the image up to Offset, with which
+	// the image read when resuming is checked to be the one written.
+	HashState []byte
+}
+
+func loadWriteCheckpoint(path string) *writeCheckpoint {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Failed to read the write checkpoint %s: %v", path, err)
+		}
+		return nil
+	}
+	var checkpoint writeCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		log.Warnf("Ignoring the invalid write checkpoint %s: %v", path, err)
+		return nil
+	}
+	return &checkpoint
+}
+
+// save writes the checkpoint to a temporary file first, so that a checkpoint
+// is never left half written.
+func (c *writeCheckpoint) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func removeWriteCheckpoint(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove the write checkpoint %s: %v", path, err)
+	}
+}
+
+// checkpointWriter records the progress of writing an image to a partition
+// every interval bytes, once what was written is synced to it.
+type checkpointWriter struct {
+	w          io.Writer
+	dev        *BlockDevice
+	path       string
+	interval   int64
+	hasher     hash.Hash
+	checkpoint writeCheckpoint
+	unsaved    int64
+}
+
+func (w *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.hasher.Write(p[:n])
+	w.checkpoint.Offset += int64(n)
+	w.unsaved += int64(n)
+	if err == nil && w.unsaved >= w.interval {
+		w.unsaved = 0
+		// Not recording the progress only makes resuming start earlier.
+		if serr := w.save(); serr != nil {
+			log.Warnf("Failed to record the progress of writing %s: %v",
+				w.checkpoint.Partition, serr)
+		}
+	}
+	return n, err
+}
+
+func (w *checkpointWriter) save() error {
+	if err := w.dev.Sync(); err != nil {
+		return err
+	}
+	state, err := w.hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.checkpoint.HashState = state
+	return w.checkpoint.save(w.path)
+}
+
+// resumeWrite returns a writer recording the progress of writing the image to
+// the partition. If a write of the same image to the same partition was
+// interrupted, the image is read up to where it stopped, and checked against
+// what was written, and dev set to resume writing there.
+func resumeWrite(path string, dev *BlockDevice, image io.Reader,
+	checkpoint writeCheckpoint, chunkSize int) (*checkpointWriter, error) {
+
+	chunk := int64(chunkSize)
+	w := &checkpointWriter{
+		dev:        dev,
+		path:       path,
+		interval:   (writeCheckpointInterval + chunk - 1) / chunk * chunk,
+		hasher:     sha256.New(),
+		checkpoint: checkpoint,
+	}
+	w.checkpoint.Offset = 0
+	w.checkpoint.HashState = nil
+
+	saved := loadWriteCheckpoint(path)
+	if !canResumeWrite(saved, checkpoint, dev.ImageSize, chunkSize) {
+		return w, nil
+	}
+	log.Infof("Writing %s was interrupted after %d bytes; reading the update "+
+		"up to there to resume it", checkpoint.Partition, saved.Offset)
+
+	// The image up to the checkpoint is checked against the hash of what
+	// was written, and its last bytes against the partition.
+	overlap := int64(writeCheckpointOverlap)
+	if overlap > saved.Offset {
+		overlap = saved.Offset
+	}
+	if _, err := io.CopyN(w.hasher, image, saved.Offset-overlap); err != nil {
+		return nil, errors.Wrap(err, "failed to read the update up to where writing it stopped")
+	}
+	tail := make([]byte, overlap)
+	if _, err := io.ReadFull(image, tail); err != nil {
+		return nil, errors.Wrap(err, "failed to read the update up to where writing it stopped")
+	}
+	w.hasher.Write(tail)
+
+	// The image can not be read again, so writing it from the start
+	// is left to the next attempt.
+	removeWriteCheckpoint(path)
+	written := sha256.New()
+	if err := written.(encoding.BinaryUnmarshaler).UnmarshalBinary(saved.HashState); err != nil {
+		return nil, errors.Wrap(err, "invalid write checkpoint")
+	}
+	if !bytes.Equal(written.Sum(nil), w.hasher.Sum(nil)) {
+		return nil, errors.Errorf("the update read differs from the one partly "+
+			"written to %s; can not resume writing it", checkpoint.Partition)
+	}
+	onDevice := make([]byte, overlap)
+	if err := readAt(dev, onDevice, saved.Offset-overlap); err != nil {
+		return nil, errors.Wrapf(err, "failed to read back the update partly "+
+			"written to %s", checkpoint.Partition)
+	}
+	if !bytes.Equal(onDevice, tail) {
+		return nil, errors.Errorf("%s does not hold the update partly written "+
+			"to it; can not resume writing it", checkpoint.Partition)
+	}
+
+	w.checkpoint.Offset = saved.Offset
+	w.checkpoint.HashState = saved.HashState
+	if err := w.checkpoint.save(path); err != nil {
+		log.Warnf("Failed to record the progress of writing %s: %v",
+			checkpoint.Partition, err)
+	}
+	dev.StartOffset = saved.Offset
+	return w, nil
+}
+
+// canResumeWrite returns whether the saved checkpoint is one of writing the
+// same image to the same partition.
+func canResumeWrite(saved *writeCheckpoint, checkpoint writeCheckpoint,
+	size int64, chunkSize int) bool {
+
+	return saved != nil &&
+		saved.Partition == checkpoint.Partition &&
+		saved.Payload == checkpoint.Payload &&
+		saved.Offset > 0 && saved.Offset <= size &&
+		saved.Offset%int64(chunkSize) == 0 &&
+		len(saved.HashState) > 0
+}
+
+func readAt(dev *BlockDevice, p []byte, offset int64) error {
+	f, err := dev.open(os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(p, offset)
+	return err
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreUpdateResumesInterruptedWrite(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	part := path.Join(tdir, "inactivePart2")
+	require.NoError(t, ioutil.WriteFile(part, nil, 0600))
+	image := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(image)
+	imagePath := path.Join(tdir, "rootfs.ext4")
+	require.NoError(t, ioutil.WriteFile(imagePath, image, 0600))
+	info, err := os.Stat(imagePath)
+	require.NoError(t, err)
+
+	oldSizeOf := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	oldInterval := writeCheckpointInterval
+	defer func() {
+		BlockDeviceGetSizeOf = oldSizeOf
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+		writeCheckpointInterval = oldInterval
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 1 << 20, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 512, nil }
+	writeCheckpointInterval = 8 * 1024
+
+	sum := sha256.Sum256(image)
+	payload := handlers.NewRootfsV3("rootfs.ext4")
+	payload.GetUpdateFiles()[0].Checksum = []byte(hex.EncodeToString(sum[:]))
+
+	reporter := &testProgressReporter{}
+	testDevice := dualRootfsDeviceImpl{
+		BootEnvReadWriter:   &fakeBootEnv{},
+		partitions:          &partitions{inactive: part},
+		writeBufferSize:     4096,
+		verifyWrite:         true,
+		payload:             payload,
+		progressReporter:    reporter,
+		writeCheckpointPath: path.Join(tdir, "checkpoint"),
+	}
+	interrupted := func(after int) io.Reader {
+		return io.MultiReader(bytes.NewReader(image[:after]),
+			failingReader{errors.New("connection reset")})
+	}
+	assert.False(t, testDevice.CanResumeStore())
+
+	// The write is resumed at the last checkpoint before it was
+	// interrupted.
+	err = testDevice.StoreUpdate(interrupted(45*1024), info)
+	require.Error(t, err)
+	assert.True(t, testDevice.CanResumeStore())
+	assert.True(t, CanResumeStore([]PayloadUpdatePerformer{&testDevice}))
+
+	reporter.reported = nil
+	err = testDevice.StoreUpdate(bytes.NewReader(image), info)
+	require.NoError(t, err)
+	assert.Equal(t, [2]int64{0, int64(len(image) - 40*1024)}, reporter.reported[0])
+	assert.False(t, testDevice.CanResumeStore())
+	content, err := ioutil.ReadFile(part)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(image, content))
+	assert.NoError(t, testDevice.InstallUpdate())
+
+	// Writes are not resumed unless the partition holds what was written.
+	err = testDevice.StoreUpdate(interrupted(20*1024), info)
+	require.Error(t, err)
+	require.NoError(t, ioutil.WriteFile(part, make([]byte, len(image)), 0600))
+	err = testDevice.StoreUpdate(bytes.NewReader(image), info)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "can not resume")
+	// The next attempt writes it from the start.
+	assert.False(t, testDevice.CanResumeStore())
+	reporter.reported = nil
+	err = testDevice.StoreUpdate(bytes.NewReader(image), info)
+	require.NoError(t, err)
+	assert.Equal(t, [2]int64{0, int64(len(image))}, reporter.reported[0])
+
+	// Nor if the payload is another one.
+	err = testDevice.StoreUpdate(interrupted(20*1024), info)
+	require.Error(t, err)
+	payload.GetUpdateFiles()[0].Checksum = []byte("other")
+	reporter.reported = nil
+	err = testDevice.StoreUpdate(bytes.NewReader(image), info)
+	require.NoError(t, err)
+	assert.Equal(t, [2]int64{0, int64(len(image))}, reporter.reported[0])
+
+	// The checkpoint is removed when the deployment is over.
+	err = testDevice.StoreUpdate(interrupted(20*1024), info)
+	require.Error(t, err)
+	assert.True(t, testDevice.CanResumeStore())
+	assert.NoError(t, testDevice.Cleanup())
+	assert.False(t, testDevice.CanResumeStore())
+}
+
+// failingReader fails every read, like a broken connection.
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io"
+)
+
+// WriteProgressReporter is told the progress of writing an update to the
+// storage of the device: at the start of the write, and after every chunk
+// written.
+type WriteProgressReporter interface {
+	ReportWriteProgress(written, total int64)
+}
+
+// progressWriter reports the bytes written through it.
+type progressWriter struct {
+	w        io.Writer
+	reporter WriteProgressReporter
+	written  int64
+	total    int64
+}
+
+func newProgressWriter(w io.Writer, total int64, reporter WriteProgressReporter) *progressWriter {
+	reporter.ReportWriteProgress(0, total)
+	return &progressWriter{w: w, reporter: reporter, total: total}
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	n, err := p.w.Write(data)
+	p.written += int64(n)
+	p.reporter.ReportWriteProgress(p.written, p.total)
+	return n, err
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testProgressReporter struct {
+	reported [][2]int64
+}
+
+func (r *testProgressReporter) ReportWriteProgress(written, total int64) {
+	r.reported = append(r.reported, [2]int64{written, total})
+}
+
+func TestStoreUpdateReportsWriteProgress(t *testing.T) {
+	part, err := ioutil.TempFile("", "inactivePart")
+	require.NoError(t, err)
+	part.Close()
+	defer os.Remove(part.Name())
+
+	reporter := &testProgressReporter{}
+	testDevice := dualRootfsDeviceImpl{
+		partitions:      &partitions{inactive: part.Name()},
+		writeBufferSize: 1024,
+	}
+	testDevice.SetWriteProgressReporter(reporter)
+
+	old := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = old
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 4096, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 512, nil }
+
+	image := bytes.Repeat([]byte{'x'}, 2500)
+	err = testDevice.StoreUpdate(bytes.NewReader(image),
+		&sizeOnlyFileInfo{int64(len(image))})
+	require.NoError(t, err)
+	assert.Equal(t, [][2]int64{
+		{0, 2500},
+		{1024, 2500},
+		{2048, 2500},
+		{2500, 2500},
+	}, reporter.reported)
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io"
+	"time"
+)
+
+// WriteThroughput is the effective throughput of writing an update to the
+// storage of the device, flushing included. Time spent waiting for the update
+// data to arrive is not included.
+type WriteThroughput struct {
+	Bytes    int64
+	Duration time.Duration
+}
+
+// BytesPerSecond returns the throughput in bytes per second, or 0 if nothing
+// was measured.
+func (t WriteThroughput) BytesPerSecond() int64 {
+	if t.Duration <= 0 {
+		return 0
+	}
+	return int64(float64(t.Bytes) / t.Duration.Seconds())
+}
+
+// WriteThroughputRecorder is told the write throughput of every update
+// written to the storage of the device.
+type WriteThroughputRecorder interface {
+	RecordWriteThroughput(t WriteThroughput)
+}
+
+// timedWriter measures the time spent writing to, and closing, a writer.
+type timedWriter struct {
+	w          io.WriteCloser
+	throughput WriteThroughput
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	t.throughput.Duration += time.Since(start)
+	t.throughput.Bytes += int64(n)
+	return n, err
+}
+
+func (t *timedWriter) Close() error {
+	start := time.Now()
+	err := t.w.Close()
+	t.throughput.Duration += time.Since(start)
+	return err
+}
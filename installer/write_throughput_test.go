@@ -0,0 +1,78 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testThroughputRecorder struct {
+	recorded []WriteThroughput
+}
+
+func (r *testThroughputRecorder) RecordWriteThroughput(t WriteThroughput) {
+	r.recorded = append(r.recorded, t)
+}
+
+func TestWriteThroughputBytesPerSecond(t *testing.T) {
+	assert.Equal(t, int64(0), WriteThroughput{Bytes: 100}.BytesPerSecond())
+	assert.Equal(t, int64(2048), WriteThroughput{
+		Bytes:    1024,
+		Duration: 500 * time.Millisecond,
+	}.BytesPerSecond())
+}
+
+func TestStoreUpdateRecordsWriteThroughput(t *testing.T) {
+	part, err := ioutil.TempFile("", "inactivePart")
+	require.NoError(t, err)
+	part.Close()
+	defer os.Remove(part.Name())
+
+	recorder := &testThroughputRecorder{}
+	testDevice := dualRootfsDeviceImpl{
+		partitions: &partitions{inactive: part.Name()},
+	}
+	testDevice.SetWriteThroughputRecorder(recorder)
+
+	old := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = old
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 1024, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 512, nil }
+
+	image := "rootfs image"
+	err = testDevice.StoreUpdate(strings.NewReader(image),
+		&sizeOnlyFileInfo{int64(len(image))})
+	assert.NoError(t, err)
+	require.Len(t, recorder.recorded, 1)
+	assert.Equal(t, int64(len(image)), recorder.recorded[0].Bytes)
+	assert.True(t, recorder.recorded[0].Duration > 0)
+
+	// Failed writes are not recorded.
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 4, nil }
+	err = testDevice.StoreUpdate(strings.NewReader(image),
+		&sizeOnlyFileInfo{int64(len(image))})
+	assert.Error(t, err)
+	assert.Len(t, recorder.recorded, 1)
+}
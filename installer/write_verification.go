@@ -0,0 +1,109 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+// writtenImage is the image last written to the inactive partition, which is
+// read back to verify that it was written correctly before the partition is
+// enabled.
+type writtenImage struct {
+	path string
+	// Opens path; with os.OpenFile if nil.
+	open BlockDeviceOpenFunc
+	size int64
+	// Hex encoded SHA-256 checksum of the image, or only of its mapped
+	// blocks if it has a block map.
+	checksum string
+	blockMap *blockMap
+}
+
+// payloadChecksum returns the checksum in the artifact manifest of the named
+// payload file, or "" if it is not known.
+func payloadChecksum(payload handlers.ArtifactUpdateHeaders, name string) string {
+	update, ok := payload.(handlers.ArtifactUpdate)
+	if !ok {
+		return ""
+	}
+	for _, file := range update.GetUpdateAllFiles() {
+		if filepath.Base(file.Name) == name {
+			return string(file.Checksum)
+		}
+	}
+	return ""
+}
+
+// verify reads the image back, bypassing the page cache, and compares its
+// checksum with the expected one.
+func (img *writtenImage) verify() error {
+	log.Infof("Reading back the update written to %s to verify it", img.path)
+
+	f, err := (&BlockDevice{Path: img.path, Open: img.open}).open(os.O_RDONLY)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s to verify the update", img.path)
+	}
+	defer f.Close()
+
+	// Otherwise what was written would be read from memory, rather than
+	// from the storage.
+	if file, ok := f.(osBlockDevice); ok {
+		if err := system.DropPageCache(file.File); err != nil {
+			log.Warnf("Failed to drop the page cache of %s; the update may be "+
+				"verified from memory: %v", img.path, err)
+		}
+	}
+
+	// The holes of sparse images were not written.
+	var image io.Reader = io.LimitReader(f, img.size)
+	size := img.size
+	if img.blockMap != nil {
+		var mapped []io.Reader
+		for _, r := range img.blockMap.ranges {
+			if r.end > img.size {
+				r.end = img.size
+			}
+			if r.end > r.start {
+				mapped = append(mapped, io.NewSectionReader(f, r.start, r.end-r.start))
+			}
+		}
+		image = io.MultiReader(mapped...)
+		size = img.blockMap.mappedBytes(img.size)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(h, image)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read back the update from %s", img.path)
+	} else if n != size {
+		return errors.Errorf("read back only %d of %d bytes of the update from %s",
+			n, size, img.path)
+	}
+	if checksum := hex.EncodeToString(h.Sum(nil)); checksum != img.checksum {
+		return errors.Errorf("the update written to %s is corrupt: checksum %s, "+
+			"expected %s", img.path, checksum, img.checksum)
+	}
+	log.Infof("Update written to %s verified", img.path)
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package installer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyWrittenUpdate(t *testing.T) {
+	tdir, _ := ioutil.TempDir("", "mendertest")
+	defer os.RemoveAll(tdir)
+
+	part := path.Join(tdir, "inactivePart2")
+	require.NoError(t, ioutil.WriteFile(part, nil, 0600))
+	imageContent := "rootfs image content"
+	imagePath := path.Join(tdir, "rootfs.ext4")
+	require.NoError(t, ioutil.WriteFile(imagePath, []byte(imageContent), 0600))
+	info, err := os.Stat(imagePath)
+	require.NoError(t, err)
+
+	old := BlockDeviceGetSizeOf
+	oldSectorSizeOf := BlockDeviceGetSectorSizeOf
+	defer func() {
+		BlockDeviceGetSizeOf = old
+		BlockDeviceGetSectorSizeOf = oldSectorSizeOf
+	}()
+	BlockDeviceGetSizeOf = func(file *os.File) (uint64, error) { return 1024, nil }
+	BlockDeviceGetSectorSizeOf = func(file *os.File) (int, error) { return 512, nil }
+
+	sum := sha256.Sum256([]byte(imageContent))
+	payload := handlers.NewRootfsV3("rootfs.ext4")
+	payload.GetUpdateFiles()[0].Checksum = []byte(hex.EncodeToString(sum[:]))
+
+	env := &fakeBootEnv{}
+	testDevice := dualRootfsDeviceImpl{
+		BootEnvReadWriter: env,
+		partitions:        &partitions{inactive: part},
+		verifyWrite:       true,
+		payload:           payload,
+	}
+
+	err = testDevice.StoreUpdate(strings.NewReader(imageContent), info)
+	require.NoError(t, err)
+	assert.NoError(t, testDevice.InstallUpdate())
+	assert.Equal(t, "2", env.writeVars["mender_boot_part"])
+
+	// Corruption of the written data is detected, and the partition is not
+	// enabled.
+	env.writeVars = nil
+	err = testDevice.StoreUpdate(strings.NewReader(imageContent), info)
+	require.NoError(t, err)
+	f, err := os.OpenFile(part, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("R"), 0)
+	require.NoError(t, err)
+	f.Close()
+	err = testDevice.InstallUpdate()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "corrupt")
+	assert.Nil(t, env.writeVars)
+
+	// The payload checksum must match the data, which is not the case for
+	// the region of a disk image; its checksum is calculated while writing.
+	testDevice.region = &diskImageRegion{offset: 0, length: 6}
+	err = testDevice.StoreUpdate(strings.NewReader(imageContent), info)
+	require.NoError(t, err)
+	assert.NoError(t, testDevice.InstallUpdate())
+	sum = sha256.Sum256([]byte(imageContent[:6]))
+	assert.Equal(t, hex.EncodeToString(sum[:]), testDevice.written.checksum)
+
+	// Nothing is verified without a record of the written update.
+	testDevice.written = nil
+	assert.NoError(t, testDevice.InstallUpdate())
+}
+
+func TestPayloadChecksum(t *testing.T) {
+	payload := handlers.NewRootfsV3("rootfs.ext4")
+	payload.GetUpdateFiles()[0].Checksum = []byte("abcd")
+	assert.Equal(t, "abcd", payloadChecksum(payload, "rootfs.ext4"))
+	assert.Equal(t, "", payloadChecksum(payload, "other.ext4"))
+	assert.Equal(t, "", payloadChecksum(nil, "rootfs.ext4"))
+}
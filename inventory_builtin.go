@@ -0,0 +1,182 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/installer"
+)
+
+var (
+	osReleaseFiles  = []string{"/etc/os-release", "/usr/lib/os-release"}
+	procVersionFile = "/proc/version"
+)
+
+// builtinInventory gathers the network and OS inventory data natively, for
+// devices without the inventory tools. The attributes are named as the ones
+// of the tools shipped with the client.
+type builtinInventory struct {
+	bootEnvironment string
+	interfaces      func() ([]net.Interface, error)
+}
+
+func newBuiltinInventory(bootEnvironment string) *builtinInventory {
+	return &builtinInventory{
+		bootEnvironment: bootEnvironment,
+		interfaces:      net.Interfaces,
+	}
+}
+
+func (b *builtinInventory) Get() map[string][]string {
+	data := map[string][]string{}
+	b.network(data)
+	osRelease(data)
+
+	if version, err := ioutil.ReadFile(procVersionFile); err == nil {
+		data["kernel"] = []string{strings.TrimSpace(string(version))}
+	} else {
+		log.Debugf("Failed to read the kernel version: %v", err)
+	}
+
+	bootEnvironment := b.bootEnvironment
+	if bootEnvironment == "" {
+		bootEnvironment = installer.BootEnvironmentUBoot
+	}
+	data["mender_boot_environment"] = []string{bootEnvironment}
+	return data
+}
+
+// network adds the MAC and IP addresses of the network interfaces, but the
+// loopback ones.
+func (b *builtinInventory) network(data map[string][]string) {
+	ifaces, err := b.interfaces()
+	if err != nil {
+		log.Errorf("Failed to list the network interfaces: %v", err)
+		return
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		data["network_interfaces"] = append(data["network_interfaces"], iface.Name)
+		if len(iface.HardwareAddr) > 0 {
+			data["mac_"+iface.Name] = []string{iface.HardwareAddr.String()}
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			log.Errorf("Failed to list the addresses of %s: %v", iface.Name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			name := "ipv6_" + iface.Name
+			if ipnet.IP.To4() != nil {
+				name = "ipv4_" + iface.Name
+			}
+			data[name] = append(data[name], ipnet.String())
+		}
+	}
+}
+
+// osRelease adds the name of the OS, and its ID and version ID, from the
+// first os-release file found.
+func osRelease(data map[string][]string) {
+	for _, file := range osReleaseFiles {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		fields := parseOSRelease(f)
+		f.Close()
+
+		switch {
+		case fields["PRETTY_NAME"] != "":
+			data["os"] = []string{fields["PRETTY_NAME"]}
+		case fields["NAME"] != "" && fields["VERSION"] != "":
+			data["os"] = []string{fields["NAME"] + " " + fields["VERSION"]}
+		}
+		if fields["ID"] != "" {
+			data["os_id"] = []string{fields["ID"]}
+		}
+		if fields["VERSION_ID"] != "" {
+			data["os_version_id"] = []string{fields["VERSION_ID"]}
+		}
+		return
+	}
+}
+
+// parseOSRelease parses the shell-like variable assignments of an os-release
+// file.
+func parseOSRelease(f *os.File) map[string]string {
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		value := kv[1]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		fields[kv[0]] = value
+	}
+	return fields
+}
+
+// deviceConfigInventory returns the configuration applied by mender-configure
+// payloads as config_<key> attributes.
+func deviceConfigInventory(config map[string]string) map[string][]string {
+	data := make(map[string][]string, len(config))
+	for key, value := range config {
+		data["config_"+key] = []string{value}
+	}
+	return data
+}
+
+// appendMissingAttributes adds the attributes which are not in the inventory
+// data already, so that the inventory tools take precedence.
+func appendMissingAttributes(idata client.InventoryData,
+	raw map[string][]string) client.InventoryData {
+
+	present := make(map[string]bool, len(idata))
+	for _, attr := range idata {
+		present[attr.Name] = true
+	}
+	missing := make(map[string][]string, len(raw))
+	for name, values := range raw {
+		if !present[name] {
+			missing[name] = values
+		}
+	}
+
+	idec := NewInventoryDataDecoder()
+	idec.AppendFromRaw(missing)
+	return append(idata, idec.GetInventoryData()...)
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltinInventory(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "inventory")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	oldOSReleaseFiles, oldProcVersionFile := osReleaseFiles, procVersionFile
+	defer func() {
+		osReleaseFiles, procVersionFile = oldOSReleaseFiles, oldProcVersionFile
+	}()
+	osReleaseFiles = []string{path.Join(tdir, "missing"), path.Join(tdir, "os-release")}
+	procVersionFile = path.Join(tdir, "version")
+
+	require.NoError(t, ioutil.WriteFile(osReleaseFiles[1], []byte(`# comment
+NAME="Poky (Yocto Project Reference Distro)"
+VERSION="3.1 (dunfell)"
+ID=poky
+VERSION_ID='3.1'
+`), 0644))
+	require.NoError(t, ioutil.WriteFile(procVersionFile,
+		[]byte("Linux version 5.4.0 (gcc version 9.3.0)\n"), 0644))
+
+	b := newBuiltinInventory("")
+	b.interfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Name: "lo", Flags: net.FlagLoopback}}, nil
+	}
+	data := b.Get()
+	assert.Equal(t, map[string][]string{
+		"os":                      {"Poky (Yocto Project Reference Distro) 3.1 (dunfell)"},
+		"os_id":                   {"poky"},
+		"os_version_id":           {"3.1"},
+		"kernel":                  {"Linux version 5.4.0 (gcc version 9.3.0)"},
+		"mender_boot_environment": {"u-boot"},
+	}, data)
+
+	require.NoError(t, ioutil.WriteFile(osReleaseFiles[1],
+		[]byte("PRETTY_NAME=\"Debian GNU/Linux 10 (buster)\"\nNAME=Debian\n"), 0644))
+	data = newBuiltinInventory("grub").Get()
+	assert.Equal(t, []string{"Debian GNU/Linux 10 (buster)"}, data["os"])
+	assert.Equal(t, []string{"grub"}, data["mender_boot_environment"])
+	assert.NotContains(t, data, "mac_lo")
+}
+
+func TestAppendMissingAttributes(t *testing.T) {
+	idata := client.InventoryData{
+		{Name: "os", Value: "from the tool"},
+	}
+	idata = appendMissingAttributes(idata, map[string][]string{
+		"os":                 {"builtin"},
+		"network_interfaces": {"eth0", "wlan0"},
+	})
+	assert.Len(t, idata, 2)
+	assert.Contains(t, idata, client.InventoryAttribute{Name: "os", Value: "from the tool"})
+	assert.Contains(t, idata, client.InventoryAttribute{
+		Name: "network_interfaces", Value: []string{"eth0", "wlan0"}})
+
+	assert.Len(t, appendMissingAttributes(nil, map[string][]string{"os": {"builtin"}}), 1)
+}
+
+func TestDeviceConfigInventory(t *testing.T) {
+	assert.Equal(t, map[string][]string{
+		"config_timezone": {"UTC"},
+		"config_hostname": {"device"},
+	}, deviceConfigInventory(map[string]string{"timezone": "UTC", "hostname": "device"}))
+	assert.Empty(t, deviceConfigInventory(map[string]string{}))
+}
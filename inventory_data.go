@@ -14,11 +14,14 @@
 package main
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -31,16 +34,24 @@ const (
 	inventoryToolPrefix = "mender-inventory-"
 )
 
-func NewInventoryDataRunner(scriptsDir string) InventoryDataRunner {
+// Time an inventory tool is given to run, unless configured.
+const defaultInventoryToolTimeout = 5 * time.Minute
+
+func NewInventoryDataRunner(scriptsDir string, timeout time.Duration) InventoryDataRunner {
+	if timeout <= 0 {
+		timeout = defaultInventoryToolTimeout
+	}
 	return InventoryDataRunner{
 		scriptsDir,
 		&system.OsCalls{},
+		timeout,
 	}
 }
 
 type InventoryDataRunner struct {
-	dir string
-	cmd system.Commander
+	dir     string
+	cmd     system.Commander
+	timeout time.Duration
 }
 
 func listRunnable(dpath string) ([]string, error) {
@@ -67,6 +78,9 @@ func listRunnable(dpath string) ([]string, error) {
 	return runnable, nil
 }
 
+// Get runs the inventory tools one by one, and merges their output. The
+// output of a tool which cannot be run or parsed, or does not finish in time,
+// is left out, without affecting the other tools.
 func (id *InventoryDataRunner) Get() (client.InventoryData, error) {
 	tools, err := listRunnable(id.dir)
 	if err != nil {
@@ -75,31 +89,59 @@ func (id *InventoryDataRunner) Get() (client.InventoryData, error) {
 
 	idec := NewInventoryDataDecoder()
 	for _, t := range tools {
-		cmd := id.cmd.Command(t)
-		out, err := cmd.StdoutPipe()
+		data, err := id.run(t)
 		if err != nil {
-			log.Errorf("failed to open stdout for inventory tool %s: %v", t, err)
-			continue
-		}
-
-		if err := cmd.Start(); err != nil {
-			log.Errorf("inventory tool %s failed with status: %v", t, err)
+			log.Warnf("inventory tool %s failed: %v", t, err)
 			continue
 		}
+		idec.AppendFromRaw(data)
+	}
+	return idec.GetInventoryData(), nil
+}
 
-		p := utils.KeyValParser{}
-		if err := p.Parse(out); err != nil {
-			log.Warnf("inventory tool %s returned unparsable output: %v", t, err)
-			continue
-		}
+// run runs the inventory tool, killing it, and any process it started,
+// after the timeout.
+func (id *InventoryDataRunner) run(tool string) (map[string][]string, error) {
+	cmd := id.cmd.Command(tool)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open stdout")
+	}
 
-		if err := cmd.Wait(); err != nil {
-			log.Warnf("inventory tool %s wait failed: %v", t, err)
-		}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "failed to start")
+	}
 
-		idec.AppendFromRaw(p.Collect())
+	var timedOut int32
+	killer := time.AfterFunc(id.timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	defer killer.Stop()
+
+	p := utils.KeyValParser{}
+	parseErr := p.Parse(out)
+	if parseErr != nil {
+		// Read the rest of the output, so that the tool is not blocked
+		// writing it.
+		_, _ = io.Copy(ioutil.Discard, out)
 	}
-	return idec.GetInventoryData(), nil
+	err = cmd.Wait()
+
+	switch {
+	case atomic.LoadInt32(&timedOut) != 0:
+		return nil, errors.Errorf("timed out after %v", id.timeout)
+	case parseErr != nil:
+		return nil, errors.Wrap(parseErr, "unparsable output")
+	case err != nil:
+		// As before the timeout, the output of a tool exiting with an
+		// error is kept.
+		log.Warnf("inventory tool %s wait failed: %v", tool, err)
+	}
+	return p.Collect(), nil
 }
 
 type InventoryDataDecoder struct {
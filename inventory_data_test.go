@@ -14,10 +14,15 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/mendersoftware/mender/client"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestInventoryDataDecoder(t *testing.T) {
@@ -50,3 +55,41 @@ func TestInventoryDataDecoder(t *testing.T) {
 	assert.Contains(t, idata, client.InventoryAttribute{"foo", []string{"bar", "baz"}})
 	assert.Contains(t, idata, client.InventoryAttribute{"bar", "zen"})
 }
+
+func TestInventoryDataRunner(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "inventory")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	tools := map[string]string{
+		"mender-inventory-good":        "echo foo=bar\necho foo=baz\necho size=1",
+		"mender-inventory-failing":     "echo failing=yes\nexit 1",
+		"mender-inventory-unparsable":  "echo garbage",
+		"mender-inventory-hanging":     "echo hanging=yes\nsleep 10",
+		"other-inventory-not-a-tool":   "echo other=yes",
+		"mender-inventory-second-good": "echo second=yes",
+	}
+	for name, script := range tools {
+		require.NoError(t, ioutil.WriteFile(path.Join(tdir, name),
+			[]byte("#!/bin/sh\n"+script+"\n"), 0755))
+	}
+	require.NoError(t, ioutil.WriteFile(path.Join(tdir, "mender-inventory-not-executable"),
+		[]byte("#!/bin/sh\necho executable=no\n"), 0644))
+
+	runner := NewInventoryDataRunner(tdir, 500*time.Millisecond)
+	start := time.Now()
+	data, err := runner.Get()
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	assert.Len(t, data, 4)
+	assert.Contains(t, data, client.InventoryAttribute{
+		Name: "foo", Value: []string{"bar", "baz"}})
+	assert.Contains(t, data, client.InventoryAttribute{Name: "failing", Value: "yes"})
+	assert.Contains(t, data, client.InventoryAttribute{Name: "size", Value: "1"})
+	assert.Contains(t, data, client.InventoryAttribute{Name: "second", Value: "yes"})
+
+	runner = NewInventoryDataRunner(path.Join(tdir, "missing"), 0)
+	_, err = runner.Get()
+	assert.Error(t, err)
+}
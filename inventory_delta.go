@@ -0,0 +1,97 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+)
+
+// submittedInventory is the inventory last submitted to the server, so that
+// only the attributes changed since can be submitted.
+type submittedInventory struct {
+	Server string
+	// The values of the attributes, marshalled to JSON.
+	Attributes map[string]json.RawMessage
+	// Inventory updates which submitted the changed attributes only, since
+	// all of them were last submitted.
+	DeltaUpdates int
+}
+
+func loadSubmittedInventory(s store.Store) *submittedInventory {
+	data, err := s.ReadAll(datastore.InventoryKey)
+	if err == os.ErrNotExist {
+		return nil
+	} else if err != nil {
+		log.Errorf("Could not read the last submitted inventory: %v", err)
+		return nil
+	}
+	submitted := &submittedInventory{}
+	if err = json.Unmarshal(data, submitted); err != nil {
+		log.Errorf("Could not parse the last submitted inventory: %v", err)
+		return nil
+	}
+	return submitted
+}
+
+func storeSubmittedInventory(s store.Store, submitted *submittedInventory) {
+	data, err := json.Marshal(submitted)
+	if err == nil {
+		err = s.WriteAll(datastore.InventoryKey, data)
+	}
+	if err != nil {
+		log.Errorf("Could not store the submitted inventory: %v", err)
+	}
+}
+
+// inventoryDelta returns the attributes of the inventory which changed since
+// the inventory last submitted to the server, or all of them every
+// fullInterval inventory updates, along with the record of the inventory to
+// store once submitted.
+func inventoryDelta(last *submittedInventory, server string, idata client.InventoryData,
+	fullInterval int) (client.InventoryData, *submittedInventory) {
+
+	next := &submittedInventory{
+		Server:     server,
+		Attributes: make(map[string]json.RawMessage, len(idata)),
+	}
+	for _, attr := range idata {
+		value, err := json.Marshal(attr.Value)
+		if err != nil {
+			// Submitted in full, and never taken as unchanged.
+			continue
+		}
+		next.Attributes[attr.Name] = value
+	}
+
+	if last == nil || last.Server != server || last.DeltaUpdates+1 >= fullInterval {
+		return idata, next
+	}
+
+	next.DeltaUpdates = last.DeltaUpdates + 1
+	changed := client.InventoryData{}
+	for _, attr := range idata {
+		value, ok := next.Attributes[attr.Name]
+		if !ok || !bytes.Equal(value, last.Attributes[attr.Name]) {
+			changed = append(changed, attr)
+		}
+	}
+	return changed, next
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInventoryDelta(t *testing.T) {
+	ms := store.NewMemStore()
+	assert.Nil(t, loadSubmittedInventory(ms))
+
+	idata := client.InventoryData{
+		{Name: "artifact_name", Value: "release-1"},
+		{Name: "network_interfaces", Value: []string{"eth0", "wlan0"}},
+	}
+
+	// nothing submitted yet; all of it is
+	delta, submitted := inventoryDelta(loadSubmittedInventory(ms), "https://a", idata, 3)
+	assert.Equal(t, idata, delta)
+	assert.Equal(t, 0, submitted.DeltaUpdates)
+	storeSubmittedInventory(ms, submitted)
+
+	// unchanged
+	delta, submitted = inventoryDelta(loadSubmittedInventory(ms), "https://a", idata, 3)
+	assert.Empty(t, delta)
+	assert.Equal(t, 1, submitted.DeltaUpdates)
+	storeSubmittedInventory(ms, submitted)
+
+	// changed and added attributes
+	idata = client.InventoryData{
+		{Name: "artifact_name", Value: "release-2"},
+		{Name: "network_interfaces", Value: []string{"eth0", "wlan0"}},
+		{Name: "site", Value: "plant-7"},
+	}
+	delta, submitted = inventoryDelta(loadSubmittedInventory(ms), "https://a", idata, 3)
+	assert.Equal(t, client.InventoryData{idata[0], idata[2]}, delta)
+	assert.Equal(t, 2, submitted.DeltaUpdates)
+	storeSubmittedInventory(ms, submitted)
+
+	// all of it, every third update
+	delta, submitted = inventoryDelta(loadSubmittedInventory(ms), "https://a", idata, 3)
+	assert.Equal(t, idata, delta)
+	assert.Equal(t, 0, submitted.DeltaUpdates)
+	storeSubmittedInventory(ms, submitted)
+
+	// all of it, to another server
+	delta, _ = inventoryDelta(loadSubmittedInventory(ms), "https://b", idata, 3)
+	assert.Equal(t, idata, delta)
+
+	require.NoError(t, ms.WriteAll(datastore.InventoryKey, []byte("garbage")))
+	assert.Nil(t, loadSubmittedInventory(ms))
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+)
+
+var (
+	procMeminfoFile    = "/proc/meminfo"
+	procUptimeFile     = "/proc/uptime"
+	cpuTemperatureFile = "/sys/class/thermal/thermal_zone0/temp"
+)
+
+// healthInventory reports the free space of the data partition, the memory
+// usage, the uptime and the CPU temperature of the device, so that devices
+// about to fail an update can be spotted.
+type healthInventory struct {
+	dataDir string
+}
+
+func (h *healthInventory) Get() map[string][]string {
+	data := map[string][]string{}
+	add := func(name string, value int64) {
+		data[name] = []string{strconv.FormatInt(value, 10)}
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(h.dataDir, &fs); err == nil {
+		add("data_free_kB", int64(fs.Bavail)*int64(fs.Bsize)/1024)
+		add("data_total_kB", int64(fs.Blocks)*int64(fs.Bsize)/1024)
+	} else {
+		log.Errorf("Failed to read the free space of %s: %v", h.dataDir, err)
+	}
+
+	if mem, err := readMeminfo(); err == nil {
+		if total, ok := mem["MemTotal"]; ok {
+			add("mem_used_kB", total-mem["MemAvailable"])
+		}
+		if available, ok := mem["MemAvailable"]; ok {
+			add("mem_available_kB", available)
+		}
+	} else {
+		log.Errorf("Failed to read the memory usage: %v", err)
+	}
+
+	if uptime, err := ioutil.ReadFile(procUptimeFile); err == nil {
+		fields := strings.Fields(string(uptime))
+		if len(fields) > 0 {
+			if secs, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				add("uptime_s", int64(secs))
+			}
+		}
+	} else {
+		log.Errorf("Failed to read the uptime: %v", err)
+	}
+
+	// Not all devices have a thermal zone.
+	if temp, err := ioutil.ReadFile(cpuTemperatureFile); err == nil {
+		if milli, err := strconv.ParseInt(strings.TrimSpace(string(temp)), 10, 64); err == nil {
+			add("cpu_temperature_C", milli/1000)
+		}
+	}
+	return data
+}
+
+// readMeminfo returns the fields of /proc/meminfo, in kB.
+func readMeminfo() (map[string]int64, error) {
+	f, err := os.Open(procMeminfoFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mem := map[string]int64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		mem[strings.TrimSuffix(fields[0], ":")] = value
+	}
+	return mem, scanner.Err()
+}
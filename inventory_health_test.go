@@ -0,0 +1,58 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthInventory(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "health")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	oldMeminfo, oldUptime, oldTemperature :=
+		procMeminfoFile, procUptimeFile, cpuTemperatureFile
+	defer func() {
+		procMeminfoFile, procUptimeFile, cpuTemperatureFile =
+			oldMeminfo, oldUptime, oldTemperature
+	}()
+	procMeminfoFile = path.Join(tdir, "meminfo")
+	procUptimeFile = path.Join(tdir, "uptime")
+	cpuTemperatureFile = path.Join(tdir, "temp")
+
+	require.NoError(t, ioutil.WriteFile(procMeminfoFile, []byte(
+		"MemTotal:        1000000 kB\nMemFree:          200000 kB\n"+
+			"MemAvailable:     600000 kB\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(procUptimeFile, []byte("3600.52 7000.10\n"), 0644))
+
+	data := (&healthInventory{dataDir: tdir}).Get()
+	assert.Equal(t, []string{"400000"}, data["mem_used_kB"])
+	assert.Equal(t, []string{"600000"}, data["mem_available_kB"])
+	assert.Equal(t, []string{"3600"}, data["uptime_s"])
+	assert.Contains(t, data, "data_free_kB")
+	assert.Contains(t, data, "data_total_kB")
+	assert.NotContains(t, data, "cpu_temperature_C")
+
+	require.NoError(t, ioutil.WriteFile(cpuTemperatureFile, []byte("47312\n"), 0644))
+	data = (&healthInventory{dataDir: path.Join(tdir, "missing")}).Get()
+	assert.Equal(t, []string{"47"}, data["cpu_temperature_C"])
+	assert.NotContains(t, data, "data_free_kB")
+}
@@ -0,0 +1,223 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Prefix of location sources which are gpsd sockets, rather than NMEA
+	// devices or files.
+	gpsdLocationPrefix = "gpsd:"
+	// The location is rounded to this many decimals of degrees, about a
+	// kilometer.
+	locationDecimals = 2
+)
+
+// How long the location source is read for a position fix.
+var locationFixTimeout = 10 * time.Second
+
+// locationInventory reports the coarse location of the device, from a GPS
+// device or file giving NMEA sentences, or from gpsd.
+type locationInventory struct {
+	source string
+}
+
+func (l *locationInventory) Get() (map[string][]string, error) {
+	var lat, lon float64
+	var err error
+	if strings.HasPrefix(l.source, gpsdLocationPrefix) {
+		lat, lon, err = gpsdLocation(strings.TrimPrefix(l.source, gpsdLocationPrefix))
+	} else {
+		lat, lon, err = nmeaLocation(l.source)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the location from %s", l.source)
+	}
+
+	round := func(deg float64) string {
+		scale := math.Pow(10, locationDecimals)
+		return strconv.FormatFloat(math.Round(deg*scale)/scale, 'f', locationDecimals, 64)
+	}
+	return map[string][]string{
+		"location_latitude":  {round(lat)},
+		"location_longitude": {round(lon)},
+	}, nil
+}
+
+func nmeaLocation(path string) (float64, float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	// Serial devices do not support deadlines; the fix is then waited for
+	// until the device gives one, or is closed below.
+	if err := f.SetReadDeadline(time.Now().Add(locationFixTimeout)); err != nil {
+		timer := time.AfterFunc(locationFixTimeout, func() { f.Close() })
+		defer timer.Stop()
+	}
+	return scanLocation(f, parseNMEALocation)
+}
+
+func gpsdLocation(address string) (float64, float64, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, address, locationFixTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(locationFixTimeout)); err != nil {
+		return 0, 0, err
+	}
+	if _, err = io.WriteString(conn, `?WATCH={"enable":true,"json":true};`+"\n"); err != nil {
+		return 0, 0, err
+	}
+	return scanLocation(conn, parseGpsdLocation)
+}
+
+// scanLocation reads lines until one of them gives a position fix.
+func scanLocation(r io.Reader,
+	parse func(line string) (float64, float64, bool)) (float64, float64, error) {
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if lat, lon, ok := parse(scanner.Text()); ok {
+			return lat, lon, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, errors.New("no position fix")
+}
+
+// parseNMEALocation parses the position of the GGA and RMC sentences with a
+// fix.
+func parseNMEALocation(line string) (float64, float64, bool) {
+	sentence, ok := nmeaSentence(line)
+	if !ok {
+		return 0, 0, false
+	}
+	pos, ok := nmeaPosition(strings.Split(sentence, ","))
+	if !ok {
+		return 0, 0, false
+	}
+	lat, latOk := nmeaDegrees(pos[0], pos[1], "N", "S")
+	lon, lonOk := nmeaDegrees(pos[2], pos[3], "E", "W")
+	return lat, lon, latOk && lonOk
+}
+
+// nmeaSentence returns the sentence of an NMEA line without the leading "$"
+// and the checksum, if it has a valid one.
+func nmeaSentence(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "$") {
+		return "", false
+	}
+	sentence := line[1:]
+	i := strings.LastIndex(sentence, "*")
+	if i < 0 {
+		return sentence, true
+	}
+	sum, err := strconv.ParseUint(sentence[i+1:], 16, 8)
+	if err != nil {
+		return "", false
+	}
+	sentence = sentence[:i]
+	var computed byte
+	for j := 0; j < len(sentence); j++ {
+		computed ^= sentence[j]
+	}
+	return sentence, uint64(computed) == sum
+}
+
+// nmeaPosition returns the latitude, its hemisphere, the longitude and its
+// hemisphere of a GGA or RMC sentence with a fix.
+func nmeaPosition(fields []string) ([]string, bool) {
+	if len(fields[0]) != 5 {
+		return nil, false
+	}
+	switch fields[0][2:] {
+	case "GGA":
+		if len(fields) < 7 || fields[6] == "" || fields[6] == "0" {
+			return nil, false
+		}
+		return fields[2:6], true
+	case "RMC":
+		if len(fields) < 7 || fields[2] != "A" {
+			return nil, false
+		}
+		return fields[3:7], true
+	default:
+		return nil, false
+	}
+}
+
+// nmeaDegrees converts a [d]ddmm.mmmm NMEA coordinate to degrees.
+func nmeaDegrees(value, hemisphere, positive, negative string) (float64, bool) {
+	dot := strings.Index(value, ".")
+	if dot < 0 {
+		dot = len(value)
+	}
+	if dot < 3 {
+		return 0, false
+	}
+	deg, err := strconv.ParseFloat(value[:dot-2], 64)
+	if err != nil {
+		return 0, false
+	}
+	min, err := strconv.ParseFloat(value[dot-2:], 64)
+	if err != nil {
+		return 0, false
+	}
+	deg += min / 60
+	switch hemisphere {
+	case positive:
+		return deg, true
+	case negative:
+		return -deg, true
+	}
+	return 0, false
+}
+
+// parseGpsdLocation parses the position of the TPV reports of gpsd with a 2D
+// or 3D fix.
+func parseGpsdLocation(line string) (float64, float64, bool) {
+	var tpv struct {
+		Class string
+		Mode  int
+		Lat   *float64
+		Lon   *float64
+	}
+	if err := json.Unmarshal([]byte(line), &tpv); err != nil ||
+		tpv.Class != "TPV" || tpv.Mode < 2 || tpv.Lat == nil || tpv.Lon == nil {
+		return 0, 0, false
+	}
+	return *tpv.Lat, *tpv.Lon, true
+}
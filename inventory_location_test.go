@@ -0,0 +1,103 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNMEALocation(t *testing.T) {
+	lat, lon, ok := parseNMEALocation(
+		"$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47")
+	assert.True(t, ok)
+	assert.InDelta(t, 48.1173, lat, 0.0001)
+	assert.InDelta(t, 11.5167, lon, 0.0001)
+
+	lat, lon, ok = parseNMEALocation(
+		"$GNRMC,123519,A,3351.000,S,15112.000,W,022.4,084.4,230394,003.1,W")
+	assert.True(t, ok)
+	assert.InDelta(t, -33.85, lat, 0.0001)
+	assert.InDelta(t, -151.2, lon, 0.0001)
+
+	for _, line := range []string{
+		// bad checksum
+		"$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*48",
+		// no fix
+		"$GPGGA,123519,4807.038,N,01131.000,E,0,08,0.9,545.4,M,46.9,M,,",
+		"$GPRMC,123519,V,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W",
+		// other sentences
+		"$GPGSV,2,1,08,01,40,083,46,02,17,308,41,12,07,344,39,14,22,228,45",
+		"garbage",
+		"$GPGGA,123519,4807.038,X,01131.000,E,1",
+	} {
+		_, _, ok = parseNMEALocation(line)
+		assert.False(t, ok, line)
+	}
+}
+
+func TestLocationInventory(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "location")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	nmea := path.Join(tdir, "nmea")
+	require.NoError(t, ioutil.WriteFile(nmea, []byte(
+		"$GPGSV,2,1,08,01,40,083,46,02,17,308,41,12,07,344,39,14,22,228,45\n"+
+			"$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,*47\n"), 0644))
+
+	data, err := (&locationInventory{source: nmea}).Get()
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"location_latitude":  {"48.12"},
+		"location_longitude": {"11.52"},
+	}, data)
+
+	require.NoError(t, ioutil.WriteFile(nmea, []byte("garbage\n"), 0644))
+	_, err = (&locationInventory{source: nmea}).Get()
+	assert.Error(t, err)
+
+	// gpsd
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if line != `?WATCH={"enable":true,"json":true};`+"\n" {
+			return
+		}
+		conn.Write([]byte(`{"class":"VERSION","release":"3.17"}` + "\n" +
+			`{"class":"TPV","mode":1}` + "\n" +
+			`{"class":"TPV","mode":3,"lat":59.913,"lon":10.7522}` + "\n"))
+	}()
+
+	data, err = (&locationInventory{source: "gpsd:" + l.Addr().String()}).Get()
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"location_latitude":  {"59.91"},
+		"location_longitude": {"10.75"},
+	}, data)
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package localapi
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuthWaitTimeout = time.Minute
+	maxAuthWaitTimeout     = 10 * time.Minute
+)
+
+// AuthToken is the API token of the client and the server it is valid for.
+// The generation is increased on every change of either, so that consumers
+// can wait for the next change.
+type AuthToken struct {
+	ServerURL  string `json:"server_url"`
+	Token      string `json:"token"`
+	Generation uint64 `json:"generation"`
+}
+
+// AuthServer serves the API token of the client to on-device processes that
+// talk to the server on their own, such as troubleshooting add-ons. It listens
+// on a socket of its own, so that it can be restricted to fewer consumers than
+// the rest of the local API.
+type AuthServer struct {
+	lock    sync.Mutex
+	token   AuthToken
+	changed chan struct{}
+	closed  chan struct{}
+
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewAuthServer starts listening on the socket; call Serve to handle
+// requests, and TokenChanged whenever the client is (re)authorized.
+func NewAuthServer(conf Config) (*AuthServer, error) {
+	l, err := listen(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &AuthServer{
+		changed:  make(chan struct{}),
+		closed:   make(chan struct{}),
+		listener: l,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"auth/token", s.handleToken)
+	s.server = &http.Server{Handler: mux}
+	return s, nil
+}
+
+// TokenChanged updates the token served, and wakes up the consumers waiting
+// for it to change. An empty token means the client is not authorized.
+func (s *AuthServer) TokenChanged(serverURL, token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.token.ServerURL == serverURL && s.token.Token == token {
+		return
+	}
+	s.token = AuthToken{
+		ServerURL:  serverURL,
+		Token:      token,
+		Generation: s.token.Generation + 1,
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// current returns the token, and a channel closed on its next change.
+func (s *AuthServer) current() (AuthToken, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.token, s.changed
+}
+
+// Serve handles requests until the server is closed.
+func (s *AuthServer) Serve() error {
+	err := s.server.Serve(s.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *AuthServer) Close() error {
+	close(s.closed)
+	return s.server.Close()
+}
+
+// handleToken returns the current token. With the "after" parameter set to
+// a generation, it waits for a newer token, for at most "timeout" seconds,
+// and answers 204 No Content if there was none.
+func (s *AuthServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, changed := s.current()
+	after := r.URL.Query().Get("after")
+	if after == "" {
+		writeJSON(w, http.StatusOK, &token)
+		return
+	}
+	generation, err := strconv.ParseUint(after, 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest,
+			map[string]string{"error": "invalid generation: " + after})
+		return
+	}
+	timeout := defaultAuthWaitTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		seconds, err := strconv.Atoi(t)
+		if err != nil || seconds < 0 {
+			writeJSON(w, http.StatusBadRequest,
+				map[string]string{"error": "invalid timeout: " + t})
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > maxAuthWaitTimeout {
+			timeout = maxAuthWaitTimeout
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for token.Generation <= generation {
+		select {
+		case <-changed:
+			token, changed = s.current()
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-s.closed:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, &token)
+}
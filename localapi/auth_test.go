@@ -0,0 +1,115 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package localapi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startTestAuthServer(t *testing.T) (*AuthServer, *http.Client, func()) {
+	td, err := ioutil.TempDir("", "localapi")
+	require.NoError(t, err)
+	socket := path.Join(td, "auth.sock")
+
+	s, err := NewAuthServer(Config{SocketPath: socket})
+	require.NoError(t, err)
+	go s.Serve()
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	return s, unixClient(socket), func() {
+		s.Close()
+		os.RemoveAll(td)
+	}
+}
+
+func getToken(t *testing.T, c *http.Client, url string) (int, AuthToken) {
+	rsp, err := c.Get(url)
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+
+	var token AuthToken
+	if rsp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(rsp.Body).Decode(&token))
+	}
+	return rsp.StatusCode, token
+}
+
+func TestAuthServerToken(t *testing.T) {
+	s, c, done := startTestAuthServer(t)
+	defer done()
+
+	status, token := getToken(t, c, "http://localhost/v1/auth/token")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, AuthToken{}, token)
+
+	s.TokenChanged("https://mender.io", "token1")
+	s.TokenChanged("https://mender.io", "token1")
+	status, token = getToken(t, c, "http://localhost/v1/auth/token")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, AuthToken{
+		ServerURL:  "https://mender.io",
+		Token:      "token1",
+		Generation: 1,
+	}, token)
+
+	// Already newer.
+	status, token = getToken(t, c, "http://localhost/v1/auth/token?after=0")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "token1", token.Token)
+
+	// No change within the timeout.
+	status, _ = getToken(t, c, "http://localhost/v1/auth/token?after=1&timeout=0")
+	assert.Equal(t, http.StatusNoContent, status)
+
+	status, _ = getToken(t, c, "http://localhost/v1/auth/token?after=foo")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = getToken(t, c, "http://localhost/v1/auth/token?after=1&timeout=-1")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	rsp, err := c.Post("http://localhost/v1/auth/token", "", nil)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+}
+
+func TestAuthServerTokenChange(t *testing.T) {
+	s, c, done := startTestAuthServer(t)
+	defer done()
+
+	s.TokenChanged("https://mender.io", "token1")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.TokenChanged("https://mender.io", "token2")
+	}()
+	status, token := getToken(t, c, "http://localhost/v1/auth/token?after=1&timeout=10")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, AuthToken{
+		ServerURL:  "https://mender.io",
+		Token:      "token2",
+		Generation: 2,
+	}, token)
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package localapi serves a small HTTP API on a unix socket, for container
+// based companion applications and other on-device integrations. The API
+// never exposes the credentials the client uses towards the server; those are
+// only served by the AuthServer, on a socket of its own.
+package localapi
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	apiPrefix = "/v1/"
+)
+
+// Manager is the part of the client exposed through the local API.
+type Manager interface {
+	State() string
+	InstalledArtifact() (string, error)
+	DeploymentID() string
+	Progress() (downloaded, total int64)
+	Paused() bool
+
+	CheckUpdate() error
+	TriggerInventory() error
+	Pause() error
+	Resume() error
+	ConfirmReboot() error
+	ConfirmCommit() error
+}
+
+type Config struct {
+	// Path of the unix socket.
+	SocketPath string
+	// Group allowed to use the API, besides root and the user the client
+	// runs as. Empty if none.
+	Group string
+}
+
+type Status struct {
+	State        string `json:"state"`
+	ArtifactName string `json:"artifact_name"`
+	DeploymentID string `json:"deployment_id,omitempty"`
+	Paused       bool   `json:"paused"`
+}
+
+type Progress struct {
+	DeploymentID    string `json:"deployment_id,omitempty"`
+	State           string `json:"state"`
+	DownloadedBytes int64  `json:"downloaded_bytes"`
+	TotalBytes      int64  `json:"total_bytes"`
+}
+
+type Server struct {
+	manager  Manager
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewServer starts listening on the socket; call Serve to handle requests.
+func NewServer(conf Config, manager Manager) (*Server, error) {
+	l, err := listen(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		manager:  manager,
+		listener: l,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"status", s.handleStatus)
+	mux.HandleFunc(apiPrefix+"progress", s.handleProgress)
+	mux.HandleFunc(apiPrefix+"check-update", s.handleAction(manager.CheckUpdate))
+	mux.HandleFunc(apiPrefix+"send-inventory", s.handleAction(manager.TriggerInventory))
+	mux.HandleFunc(apiPrefix+"pause", s.handleAction(manager.Pause))
+	mux.HandleFunc(apiPrefix+"resume", s.handleAction(manager.Resume))
+	mux.HandleFunc(apiPrefix+"confirm-reboot", s.handleAction(manager.ConfirmReboot))
+	mux.HandleFunc(apiPrefix+"confirm-commit", s.handleAction(manager.ConfirmCommit))
+	s.server = &http.Server{Handler: mux}
+	return s, nil
+}
+
+// Serve handles requests until the server is closed.
+func (s *Server) Serve() error {
+	err := s.server.Serve(s.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// listen listens on the socket of the configuration, accepting connections
+// from root, the user the client runs as and the configured group only.
+func listen(conf Config) (net.Listener, error) {
+	gid := -1
+	if conf.Group != "" {
+		g, err := lookupGroupID(conf.Group)
+		if err != nil {
+			return nil, err
+		}
+		gid = g
+	}
+
+	if err := removeStaleSocket(conf.SocketPath); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", conf.SocketPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can not listen on %s", conf.SocketPath)
+	}
+	mode := os.FileMode(0600)
+	if gid >= 0 {
+		mode = 0660
+		err = os.Chown(conf.SocketPath, -1, gid)
+	}
+	if err == nil {
+		err = os.Chmod(conf.SocketPath, mode)
+	}
+	if err != nil {
+		l.Close()
+		return nil, errors.Wrapf(err, "can not set permissions of %s", conf.SocketPath)
+	}
+
+	return &peerCredListener{
+		Listener: l,
+		allowed: func(cred *syscall.Ucred) bool {
+			return cred.Uid == 0 ||
+				int(cred.Uid) == os.Getuid() ||
+				(gid >= 0 && inGroup(cred, gid))
+		},
+	}, nil
+}
+
+// removeStaleSocket removes a socket left behind by an earlier run. Any other
+// file at the path is left alone, and is an error.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "can not stat %s", path)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "can not remove old socket %s", path)
+	}
+	return nil
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, err := s.manager.InstalledArtifact()
+	if err != nil {
+		log.Errorf("Local API: could not read the artifact name: %v", err)
+	}
+	writeJSON(w, http.StatusOK, &Status{
+		State:        s.manager.State(),
+		ArtifactName: name,
+		DeploymentID: s.manager.DeploymentID(),
+		Paused:       s.manager.Paused(),
+	})
+}
+
+func (s *Server) handleProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	progress := &Progress{
+		DeploymentID: s.manager.DeploymentID(),
+		State:        s.manager.State(),
+	}
+	if progress.DeploymentID != "" {
+		progress.DownloadedBytes, progress.TotalBytes = s.manager.Progress()
+	}
+	writeJSON(w, http.StatusOK, progress)
+}
+
+func (s *Server) handleAction(action func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := action(); err != nil {
+			log.Errorf("Local API: %s failed: %v", r.URL.Path, err)
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Local API: could not write response: %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package localapi
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeManager struct {
+	deploymentID string
+	paused       bool
+	calls        []string
+	err          error
+}
+
+func (f *fakeManager) State() string {
+	return "update-fetch"
+}
+
+func (f *fakeManager) InstalledArtifact() (string, error) {
+	return "release-1", nil
+}
+
+func (f *fakeManager) DeploymentID() string {
+	return f.deploymentID
+}
+
+func (f *fakeManager) Progress() (int64, int64) {
+	return 512, 2048
+}
+
+func (f *fakeManager) Paused() bool {
+	return f.paused
+}
+
+func (f *fakeManager) CheckUpdate() error {
+	f.calls = append(f.calls, "CheckUpdate")
+	return f.err
+}
+
+func (f *fakeManager) TriggerInventory() error {
+	f.calls = append(f.calls, "TriggerInventory")
+	return f.err
+}
+
+func (f *fakeManager) Pause() error {
+	f.calls = append(f.calls, "Pause")
+	return f.err
+}
+
+func (f *fakeManager) Resume() error {
+	f.calls = append(f.calls, "Resume")
+	return f.err
+}
+
+func (f *fakeManager) ConfirmReboot() error {
+	f.calls = append(f.calls, "ConfirmReboot")
+	return f.err
+}
+
+func (f *fakeManager) ConfirmCommit() error {
+	f.calls = append(f.calls, "ConfirmCommit")
+	return f.err
+}
+
+func unixClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+}
+
+func startTestServer(t *testing.T, manager Manager,
+	allowed func(*syscall.Ucred) bool) (*http.Client, func()) {
+
+	td, err := ioutil.TempDir("", "localapi")
+	require.NoError(t, err)
+	socket := path.Join(td, "mender.sock")
+
+	s, err := NewServer(Config{SocketPath: socket}, manager)
+	require.NoError(t, err)
+	if allowed != nil {
+		s.listener.(*peerCredListener).allowed = allowed
+	}
+	go s.Serve()
+
+	return unixClient(socket), func() {
+		s.Close()
+		os.RemoveAll(td)
+	}
+}
+
+func TestLocalAPIStatus(t *testing.T) {
+	manager := &fakeManager{deploymentID: "deployment-1", paused: true}
+	c, done := startTestServer(t, manager, nil)
+	defer done()
+
+	rsp, err := c.Get("http://localhost/v1/status")
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	var status Status
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&status))
+	assert.Equal(t, Status{
+		State:        "update-fetch",
+		ArtifactName: "release-1",
+		DeploymentID: "deployment-1",
+		Paused:       true,
+	}, status)
+
+	rsp, err = c.Get("http://localhost/v1/progress")
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	var progress Progress
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&progress))
+	assert.Equal(t, Progress{
+		DeploymentID:    "deployment-1",
+		State:           "update-fetch",
+		DownloadedBytes: 512,
+		TotalBytes:      2048,
+	}, progress)
+
+	rsp, err = c.Post("http://localhost/v1/status", "", nil)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+}
+
+func TestLocalAPIActions(t *testing.T) {
+	manager := &fakeManager{}
+	c, done := startTestServer(t, manager, nil)
+	defer done()
+
+	for _, action := range []string{"check-update", "send-inventory", "pause", "resume",
+		"confirm-reboot", "confirm-commit"} {
+		rsp, err := c.Post("http://localhost/v1/"+action, "", nil)
+		require.NoError(t, err)
+		rsp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, rsp.StatusCode, action)
+	}
+	assert.Equal(t, []string{"CheckUpdate", "TriggerInventory", "Pause", "Resume",
+		"ConfirmReboot", "ConfirmCommit"}, manager.calls)
+
+	rsp, err := c.Get("http://localhost/v1/pause")
+	require.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+
+	manager.err = errors.New("not now")
+	rsp, err = c.Post("http://localhost/v1/check-update", "", nil)
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusConflict, rsp.StatusCode)
+	body, _ := ioutil.ReadAll(rsp.Body)
+	assert.JSONEq(t, `{"error": "not now"}`, string(body))
+}
+
+func TestLocalAPIRejectsPeer(t *testing.T) {
+	peers := make(chan *syscall.Ucred, 1)
+	c, done := startTestServer(t, &fakeManager{}, func(cred *syscall.Ucred) bool {
+		select {
+		case peers <- cred:
+		default:
+		}
+		return false
+	})
+	defer done()
+
+	_, err := c.Get("http://localhost/v1/status")
+	assert.Error(t, err)
+	peer := <-peers
+	assert.Equal(t, uint32(os.Getuid()), peer.Uid)
+}
+
+func TestLocalAPIPeerGroups(t *testing.T) {
+	td, err := ioutil.TempDir("", "localapi")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	oldProcDir := procDir
+	procDir = td
+	defer func() { procDir = oldProcDir }()
+
+	require.NoError(t, os.MkdirAll(path.Join(td, "42"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(td, "42", "status"),
+		[]byte("Name:\tapp\nGid:\t100\t100\t100\t100\nGroups:\t27 1001 \nNSpid:\t42\n"), 0644))
+
+	// primary group
+	assert.True(t, inGroup(&syscall.Ucred{Pid: 42, Gid: 1001}, 1001))
+	// supplementary group
+	assert.True(t, inGroup(&syscall.Ucred{Pid: 42, Gid: 100}, 1001))
+	assert.False(t, inGroup(&syscall.Ucred{Pid: 42, Gid: 100}, 1002))
+	// unknown process
+	assert.False(t, inGroup(&syscall.Ucred{Pid: 43, Gid: 100}, 1001))
+}
+
+func TestLocalAPIKeepsOtherFiles(t *testing.T) {
+	td, err := ioutil.TempDir("", "localapi")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	// not a socket; left alone
+	file := path.Join(td, "mender.sock")
+	require.NoError(t, ioutil.WriteFile(file, []byte("data"), 0644))
+	_, err = NewServer(Config{SocketPath: file}, &fakeManager{})
+	assert.Error(t, err)
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	// a socket left behind is replaced
+	socket := path.Join(td, "stale.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	s, err := NewServer(Config{SocketPath: socket}, &fakeManager{})
+	require.NoError(t, err)
+	s.listener.Close()
+}
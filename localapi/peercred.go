@@ -0,0 +1,132 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package localapi
+
+import (
+	"io/ioutil"
+	"net"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/pkg/errors"
+)
+
+// peerCredListener only accepts connections from the peers allowed to use
+// the API, judging by the credentials of the connecting process.
+type peerCredListener struct {
+	net.Listener
+	allowed func(cred *syscall.Ucred) bool
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		cred, err := peerCred(conn)
+		if err != nil {
+			log.Errorf("Local API: could not read peer credentials: %v", err)
+		} else if l.allowed(cred) {
+			return conn, nil
+		} else {
+			log.Warnf("Local API: rejected connection from uid %d, gid %d",
+				cred.Uid, cred.Gid)
+		}
+		conn.Close()
+	}
+}
+
+func peerCred(conn net.Conn) (*syscall.Ucred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd),
+			syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+func lookupGroupID(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, errors.Wrapf(err, "unknown group %s", name)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// The proc filesystem, in which the supplementary groups of the peers are
+// looked up.
+var procDir = "/proc"
+
+// inGroup returns whether the peer has the group as either its primary or one
+// of its supplementary groups.
+func inGroup(cred *syscall.Ucred, gid int) bool {
+	if int(cred.Gid) == gid {
+		return true
+	}
+	groups, err := peerGroups(int(cred.Pid))
+	if err != nil {
+		log.Errorf("Local API: could not read the groups of pid %d: %v", cred.Pid, err)
+		return false
+	}
+	for _, g := range groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// peerGroups returns the supplementary groups of the process, which the peer
+// credentials of the socket leave out.
+func peerGroups(pid int) ([]int, error) {
+	status := filepath.Join(procDir, strconv.Itoa(pid), "status")
+	data, err := ioutil.ReadFile(status)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		var groups []int
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			g, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, errors.Errorf("invalid group %q in %s", field, status)
+			}
+			groups = append(groups, g)
+		}
+		return groups, nil
+	}
+	return nil, errors.Errorf("no groups in %s", status)
+}
@@ -20,13 +20,17 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/dbus"
 	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/localapi"
 	"github.com/mendersoftware/mender/store"
 	"github.com/mendersoftware/mender/system"
 
@@ -43,25 +47,43 @@ type logOptionsType struct {
 }
 
 type runOptionsType struct {
-	version         *bool
-	config          *string
-	fallbackConfig  *string
-	dataStore       *string
-	imageFile       *string
-	commit          *bool
-	rollback        *bool
-	bootstrap       *bool
-	daemon          *bool
-	bootstrapForce  *bool
-	showArtifact    *bool
-	updateCheck     *bool
-	updateInventory *bool
+	version             *bool
+	config              *string
+	fallbackConfig      *string
+	dataStore           *string
+	imageFile           *string
+	commit              *bool
+	rollback            *bool
+	bootstrap           *bool
+	daemon              *bool
+	bootstrapForce      *bool
+	showArtifact        *bool
+	inspectArtifact     *string
+	updateCheck         *bool
+	updateInventory     *bool
+	exportBundle        *string
+	bundleArtifact      *string
+	bundleID            *string
+	installBundle       *string
+	uploadReceipts      *bool
+	provisionBatch      *string
+	provisionOutput     *string
+	supportBundle       *string
+	snapshotDump        *string
+	snapshotCompression *string
+	snapshotFreeze      *bool
+	snapshotArtifact    *string
+	snapshotName        *string
+	// Whether the log level is given on the command line, overriding the
+	// one of the configuration.
+	logLevelGiven bool
 	client.Config
 }
 
 var (
 	actionArguments = "-install, -commit, -rollback, -daemon, -bootstrap, -version -check-update," +
-		"-send-inventory or -show-artifact"
+		"-send-inventory, -show-artifact, -inspect-artifact, -export-bundle, -install-bundle, " +
+		"-upload-receipts, -provision-batch, -support-bundle, -snapshot-dump or -snapshot-artifact"
 
 	errMsgNoArgumentsGiven        = errors.Errorf("Must give one of %s arguments", actionArguments)
 	errMsgAmbiguousArgumentsGiven = errors.Errorf("Ambiguous parameters given "+
@@ -93,7 +115,8 @@ func argsParse(args []string) (runOptionsType, error) {
 		"Mender state data location.")
 
 	imageFile := parsing.String("install", "",
-		"Mender Artifact to install. Can be either a local file or a URL.")
+		"Mender Artifact to install. Can be either a local file or a URL, "+
+			"or - to read it from standard input.")
 
 	commit := parsing.Bool("commit", false,
 		"Commit current Artifact. Returns (2) if no update in progress")
@@ -105,12 +128,64 @@ func argsParse(args []string) (runOptionsType, error) {
 
 	showArtifact := parsing.Bool("show-artifact", false, "print the current artifact name to the command line and exit")
 
+	inspectArtifact := parsing.String("inspect-artifact", "",
+		"Print the header information of a local Mender Artifact and exit, without installing it.")
+
 	daemon := parsing.Bool("daemon", false, "Run as a daemon.")
 
 	updateCheck := parsing.Bool("check-update", false, "force update check")
 
 	updateInventory := parsing.Bool("send-inventory", false, "force inventory update")
 
+	exportBundle := parsing.String("export-bundle", "",
+		"Write a deployment bundle, for installing on devices without a server connection, "+
+			"to the given file and exit. Needs -bundle-artifact and -bundle-deployment-id.")
+
+	bundleArtifact := parsing.String("bundle-artifact", "",
+		"Mender Artifact to put in the deployment bundle.")
+
+	bundleID := parsing.String("bundle-deployment-id", "",
+		"ID of the server deployment the deployment bundle belongs to.")
+
+	installBundle := parsing.String("install-bundle", "",
+		"Deployment bundle to install. A signed receipt with the outcome is stored once the "+
+			"deployment is finished.")
+
+	uploadReceipts := parsing.Bool("upload-receipts", false,
+		"Report the outcome of installed deployment bundles to the server and exit.")
+
+	provisionBatch := parsing.String("provision-batch", "",
+		"Generate configuration files and device keys for all the devices in the given CSV file, "+
+			"based on the -config file, and exit. The header names the identity attributes, "+
+			"and \"config:<option>\" columns set configuration options.")
+
+	provisionOutput := parsing.String("provision-output", "provisioned",
+		"Directory to write the device trees generated by -provision-batch to.")
+
+	supportBundle := parsing.String("support-bundle", "",
+		"Collect the configuration, state, recent logs and connectivity test results, "+
+			"redacted, into the given tarball and exit.")
+
+	snapshotDump := parsing.String("snapshot-dump", "",
+		"Dump the active root filesystem partition, for capturing a golden image, and exit. "+
+			"Written to the given file, - for standard output, or ssh://[user@]host[:port]/path.")
+
+	snapshotArtifact := parsing.String("snapshot-artifact", "",
+		"Package a snapshot of the active root filesystem partition into a rootfs-image Artifact, "+
+			"providing what the installed Artifact provides, written to the given file, and exit. "+
+			"Needs -snapshot-artifact-name.")
+
+	snapshotName := parsing.String("snapshot-artifact-name", "",
+		"Name of the Artifact written by -snapshot-artifact.")
+
+	snapshotCompression := parsing.String("snapshot-compression", "",
+		"Compression of -snapshot-dump: none (default), gzip or zstd; "+
+			"or of the payload of -snapshot-artifact: gzip (default), none or lzma.")
+
+	snapshotFreeze := parsing.Bool("snapshot-freeze", false,
+		"Freeze the root filesystem while taking a snapshot of it with -snapshot-dump or "+
+			"-snapshot-artifact, for a consistent snapshot.")
+
 	// add bootstrap related command line options
 	serverCert := parsing.String("trusted-certs", "", "Trusted server certificates")
 	forcebootstrap := parsing.Bool("forcebootstrap", false, "Force bootstrap")
@@ -126,19 +201,33 @@ func argsParse(args []string) (runOptionsType, error) {
 	}
 
 	runOptions := runOptionsType{
-		version:         version,
-		config:          config,
-		fallbackConfig:  fallbackConfig,
-		dataStore:       data,
-		imageFile:       imageFile,
-		commit:          commit,
-		rollback:        rollback,
-		bootstrap:       bootstrap,
-		daemon:          daemon,
-		bootstrapForce:  forcebootstrap,
-		showArtifact:    showArtifact,
-		updateCheck:     updateCheck,
-		updateInventory: updateInventory,
+		version:             version,
+		config:              config,
+		fallbackConfig:      fallbackConfig,
+		dataStore:           data,
+		imageFile:           imageFile,
+		commit:              commit,
+		rollback:            rollback,
+		bootstrap:           bootstrap,
+		daemon:              daemon,
+		bootstrapForce:      forcebootstrap,
+		showArtifact:        showArtifact,
+		inspectArtifact:     inspectArtifact,
+		updateCheck:         updateCheck,
+		updateInventory:     updateInventory,
+		exportBundle:        exportBundle,
+		bundleArtifact:      bundleArtifact,
+		bundleID:            bundleID,
+		installBundle:       installBundle,
+		uploadReceipts:      uploadReceipts,
+		provisionBatch:      provisionBatch,
+		provisionOutput:     provisionOutput,
+		supportBundle:       supportBundle,
+		snapshotDump:        snapshotDump,
+		snapshotCompression: snapshotCompression,
+		snapshotFreeze:      snapshotFreeze,
+		snapshotArtifact:    snapshotArtifact,
+		snapshotName:        snapshotName,
 		Config: client.Config{
 			ServerCert: *serverCert,
 			NoVerify:   *skipVerify,
@@ -156,7 +245,7 @@ func argsParse(args []string) (runOptionsType, error) {
 		return runOptions, errMsgAmbiguousArgumentsGiven
 	}
 
-	if *version || *showArtifact {
+	if *version || *showArtifact || *inspectArtifact != "" {
 		// Limit informational output for pure information queries, to
 		// make it easier to use in scripts. This can still be
 		// overridden by dedicated log arguments.
@@ -173,6 +262,7 @@ func argsParse(args []string) (runOptionsType, error) {
 	if err := parseLogFlags(logFlags); err != nil {
 		return runOptions, err
 	}
+	runOptions.logLevelGiven = *logFlags.logLevel != "" || *logFlags.info || *logFlags.debug
 
 	return runOptions, nil
 }
@@ -180,39 +270,12 @@ func argsParse(args []string) (runOptionsType, error) {
 func moreThanOneActionSelected(runOptions runOptionsType) bool {
 	// check if more than one command line action is selected
 	var runOptionsCount int
-
-	if *runOptions.imageFile != "" {
-		runOptionsCount++
-	}
-	if *runOptions.commit {
-		runOptionsCount++
-	}
-	if *runOptions.rollback {
-		runOptionsCount++
-	}
-	if *runOptions.daemon {
-		runOptionsCount++
-	}
-	if *runOptions.bootstrap {
-		runOptionsCount++
-	}
-	if *runOptions.version {
-		runOptionsCount++
-	}
-	if *runOptions.showArtifact {
-		runOptionsCount++
-	}
-	if *runOptions.updateCheck {
-		runOptionsCount++
-	}
-	if *runOptions.updateInventory {
-		runOptionsCount++
-	}
-
-	if runOptionsCount > 1 {
-		return true
+	for _, action := range cliActions {
+		if action.selected(runOptions) {
+			runOptionsCount++
+		}
 	}
-	return false
+	return runOptionsCount > 1
 }
 
 func addLogFlags(f *flag.FlagSet) logOptionsType {
@@ -342,16 +405,54 @@ func doBootstrapAuthorize(config *menderConfig, opts *runOptionsType) error {
 	return nil
 }
 
+// doUploadReceipts authorizes with the server and reports the outcome of the
+// deployment bundles installed while the device was offline.
+func doUploadReceipts(config *menderConfig, opts *runOptionsType) error {
+	mp, err := commonInit(config, opts)
+	if err != nil {
+		return err
+	}
+	defer mp.store.Close()
+
+	controller, err := NewMender(config, *mp)
+	if err != nil {
+		return errors.Wrap(err, "error initializing mender controller")
+	}
+	if merr := controller.Authorize(); merr != nil {
+		return merr.Cause()
+	}
+
+	receipts := newReceiptWriter(*opts.dataStore, getDeviceKeyStore(config, *opts.dataStore))
+	n, err := receipts.Upload(controller)
+	fmt.Printf("Uploaded %d deployment receipt(s)\n", n)
+	return err
+}
+
 func getKeyStore(datastore string, keyName string) *store.Keystore {
 	dirstore := store.NewDirStore(datastore)
 	return store.NewKeystore(dirstore, keyName)
 }
 
+// getDeviceKeyStore returns the keystore of the device key, which is either in
+// the data directory or in the configured OpenSSL engine.
+func getDeviceKeyStore(config *menderConfig, datastore string) *store.Keystore {
+	var ks *store.Keystore
+	if config.DeviceKeyEngine != "" {
+		ks = store.NewEngineKeystore(config.DeviceKeyEngine, config.DeviceKeyEngineKeyID)
+	} else {
+		ks = getKeyStore(datastore, defaultKeyFile)
+	}
+	if ks != nil {
+		ks.SetKeyOptions(config.GetKeyOptions())
+	}
+	return ks
+}
+
 func commonInit(config *menderConfig, opts *runOptionsType) (*MenderPieces, error) {
 
 	tentok := config.GetTenantToken()
 
-	ks := getKeyStore(*opts.dataStore, defaultKeyFile)
+	ks := getDeviceKeyStore(config, *opts.dataStore)
 	if ks == nil {
 		return nil, errors.New("failed to setup key storage")
 	}
@@ -369,6 +470,11 @@ func commonInit(config *menderConfig, opts *runOptionsType) (*MenderPieces, erro
 		return nil, errors.Errorf("%s is not a directory", *opts.dataStore)
 	}
 
+	tokenStore, err := config.GetTokenStore()
+	if err != nil {
+		return nil, err
+	}
+
 	dbstore := store.NewDBStore(*opts.dataStore)
 	if dbstore == nil {
 		return nil, errors.New("failed to initialize DB store")
@@ -377,8 +483,13 @@ func commonInit(config *menderConfig, opts *runOptionsType) (*MenderPieces, erro
 	authmgr := NewAuthManager(AuthManagerConfig{
 		AuthDataStore:  dbstore,
 		KeyStore:       ks,
-		IdentitySource: NewIdentityDataGetter(),
+		IdentitySource: NewIdentityDataGetter(config.IdentityAttributes),
 		TenantToken:    tentok,
+		Servers:        config.Servers,
+		TokenStore:     tokenStore,
+
+		TenantTokenFile:             config.TenantTokenFile,
+		SensitiveIdentityAttributes: config.IdentitySensitiveAttributes,
 	})
 	if authmgr == nil {
 		// close DB store explicitly
@@ -396,6 +507,8 @@ func commonInit(config *menderConfig, opts *runOptionsType) (*MenderPieces, erro
 func initDaemon(config *menderConfig, dev installer.DualRootfsDevice, env installer.BootEnvReadWriter,
 	opts *runOptionsType) (*menderDaemon, error) {
 
+	setupProxyEnvironment()
+
 	mp, err := commonInit(config, opts)
 	if err != nil {
 		return nil, err
@@ -418,6 +531,14 @@ func initDaemon(config *menderConfig, dev installer.DualRootfsDevice, env instal
 	}
 
 	daemon := NewDaemon(controller, mp.store)
+	daemon.sctx.pollsNotBefore = time.Now().Add(
+		randomDuration(time.Duration(config.PollStartupSplaySeconds) * time.Second))
+	daemon.sctx.watchdog = newSystemdWatchdog()
+	daemon.sctx.artifactCache = newArtifactCache(config)
+	daemon.sctx.artifactMirrors = newArtifactMirrors(config)
+	if dev != nil {
+		dev.SetWriteProgressReporter(daemon.sctx.writeProgress)
+	}
 
 	// add logging hook; only daemon needs this
 	log.AddHook(NewDeploymentLogHook(DeploymentLogger))
@@ -447,8 +568,17 @@ func doMain(args []string) error {
 		config.HttpsClient.SkipVerify = true
 	}
 
-	env := installer.NewEnvironment(new(system.OsCalls))
-	dualRootfsDevice := installer.NewDualRootfsDevice(env, new(system.OsCalls), config.GetDeviceConfig())
+	env, err := installer.NewBootEnvironment(config.GetBootEnvironmentConfig(),
+		new(system.OsCalls))
+	if err != nil {
+		return err
+	}
+	deviceConfig := config.GetDeviceConfig()
+	if config.RootfsResumeInterruptedWrites {
+		deviceConfig.WriteCheckpointPath = path.Join(*runOptions.dataStore,
+			rootfsWriteCheckpointFile)
+	}
+	dualRootfsDevice := installer.NewDualRootfsDevice(env, new(system.OsCalls), deviceConfig)
 	if dualRootfsDevice == nil {
 		log.Info("No dual rootfs configuration present")
 	} else {
@@ -461,39 +591,197 @@ func doMain(args []string) error {
 	}
 
 	DeploymentLogger = NewDeploymentLogManager(*runOptions.dataStore)
+	DeploymentLogger.SetMaxLogSize(config.DeploymentLogMaxSizeBytes)
 
 	return handleCLIOptions(runOptions, env, dualRootfsDevice, config)
 }
 
-func handleCLIOptions(runOptions runOptionsType, env *installer.UBootEnv,
-	dualRootfsDevice installer.DualRootfsDevice, config *menderConfig) error {
+// cliAction is an action selected on the command line.
+type cliAction struct {
+	selected func(runOptions runOptionsType) bool
+	// run runs the action; nil for the actions which doMain runs before
+	// loading the configuration.
+	run func(runOptions runOptionsType, env installer.BootEnvReadWriter,
+		dualRootfsDevice installer.DualRootfsDevice, config *menderConfig) error
+}
 
-	switch {
+// cliActions are the actions which can be selected on the command line, in
+// the order they are looked for.
+var cliActions = []cliAction{
+	{
+		selected: func(o runOptionsType) bool { return *o.version },
+		run: func(o runOptionsType, env installer.BootEnvReadWriter,
+			dev installer.DualRootfsDevice, config *menderConfig) error {
+			ShowVersion()
+			return nil
+		},
+	},
+	{selected: func(o runOptionsType) bool { return *o.updateCheck }},
+	{selected: func(o runOptionsType) bool { return *o.updateInventory }},
+	{
+		selected: func(o runOptionsType) bool { return *o.inspectArtifact != "" },
+		run: func(o runOptionsType, env installer.BootEnvReadWriter,
+			dev installer.DualRootfsDevice, config *menderConfig) error {
+			return doInspectArtifact(*o.inspectArtifact,
+				config.GetSignaturePolicy(), os.Stdout)
+		},
+	},
+	{
+		selected: func(o runOptionsType) bool { return *o.exportBundle != "" },
+		run: func(o runOptionsType, env installer.BootEnvReadWriter,
+			dev installer.DualRootfsDevice, config *menderConfig) error {
+			return doExportBundle(*o.bundleArtifact, *o.bundleID,
+				*o.exportBundle, config.GetSignaturePolicy())
+		},
+	},
+	{
+		selected: func(o runOptionsType) bool { return *o.supportBundle != "" },
+		run: func(o runOptionsType, env installer.BootEnvReadWriter,
+			dev installer.DualRootfsDevice, config *menderConfig) error {
+			return doSupportBundle(*o.supportBundle, &o, config, env, dev)
+		},
+	},
+	{
+		selected: func(o runOptionsType) bool { return *o.snapshotDump != "" },
+		run: func(o runOptionsType, env installer.BootEnvReadWriter,
+			dev installer.DualRootfsDevice, config *menderConfig) error {
+			return doSnapshotDump(dev, snapshotOptions{
+				output:      *o.snapshotDump,
+				compression: *o.snapshotCompression,
+				freeze:      *o.snapshotFreeze,
+			}, new(system.OsCalls))
+		},
+	},
+	{
+		selected: func(o runOptionsType) bool { return *o.provisionBatch != "" },
+		run: func(o runOptionsType, env installer.BootEnvReadWriter,
+			dev installer.DualRootfsDevice, config *menderConfig) error {
+			return doProvisionBatch(*o.provisionBatch, *o.config, *o.provisionOutput)
+		},
+	},
+	{selected: func(o runOptionsType) bool { return *o.showArtifact }, run: runArtifactOperation},
+	{selected: func(o runOptionsType) bool { return *o.imageFile != "" }, run: runArtifactOperation},
+	{selected: func(o runOptionsType) bool { return *o.installBundle != "" }, run: runArtifactOperation},
+	{selected: func(o runOptionsType) bool { return *o.snapshotArtifact != "" }, run: runArtifactOperation},
+	{selected: func(o runOptionsType) bool { return *o.commit }, run: runArtifactOperation},
+	{selected: func(o runOptionsType) bool { return *o.rollback }, run: runArtifactOperation},
+	{
+		selected: func(o runOptionsType) bool { return *o.bootstrap },
+		run: func(o runOptionsType, env installer.BootEnvReadWriter,
+			dev installer.DualRootfsDevice, config *menderConfig) error {
+			return doBootstrapAuthorize(config, &o)
+		},
+	},
+	{
+		selected: func(o runOptionsType) bool { return *o.uploadReceipts },
+		run: func(o runOptionsType, env installer.BootEnvReadWriter,
+			dev installer.DualRootfsDevice, config *menderConfig) error {
+			return doUploadReceipts(config, &o)
+		},
+	},
+	{selected: func(o runOptionsType) bool { return *o.daemon }, run: runDaemonAction},
+}
 
-	case *runOptions.version:
-		ShowVersion()
-		return nil
+func handleCLIOptions(runOptions runOptionsType, env installer.BootEnvReadWriter,
+	dualRootfsDevice installer.DualRootfsDevice, config *menderConfig) error {
 
-	case *runOptions.showArtifact,
-		*runOptions.imageFile != "",
-		*runOptions.commit,
-		*runOptions.rollback:
+	for _, action := range cliActions {
+		if action.run != nil && action.selected(runOptions) {
+			return action.run(runOptions, env, dualRootfsDevice, config)
+		}
+	}
+	return errMsgNoArgumentsGiven
+}
+
+func runArtifactOperation(runOptions runOptionsType, env installer.BootEnvReadWriter,
+	dualRootfsDevice installer.DualRootfsDevice, config *menderConfig) error {
 
-		return handleArtifactOperations(runOptions, dualRootfsDevice, config)
+	return handleArtifactOperations(runOptions, dualRootfsDevice, config)
+}
 
-	case *runOptions.bootstrap:
-		return doBootstrapAuthorize(config, &runOptions)
+// runDaemonAction runs the daemon, together with the services it is
+// configured to provide.
+func runDaemonAction(runOptions runOptionsType, env installer.BootEnvReadWriter,
+	dualRootfsDevice installer.DualRootfsDevice, config *menderConfig) error {
 
-	case *runOptions.daemon:
-		d, err := initDaemon(config, dualRootfsDevice, env, &runOptions)
+	setConfigLogLevel(config, &runOptions)
+	d, err := initDaemon(config, dualRootfsDevice, env, &runOptions)
+	if err != nil {
+		return err
+	}
+	defer d.Cleanup()
+	d.configLoader = func() (*menderConfig, error) {
+		return reloadConfig(&runOptions)
+	}
+	manager := NewUpdateManager(d)
+	if config.DBusEnabled {
+		if srv, err := dbus.Start(manager); err != nil {
+			log.Errorf("Failed to start the D-Bus service: %v", err)
+		} else {
+			d.SetStateListener(srv.StateChanged)
+			defer srv.Stop()
+		}
+	}
+	if config.LocalAPISocket != "" {
+		api, err := localapi.NewServer(localapi.Config{
+			SocketPath: config.LocalAPISocket,
+			Group:      config.LocalAPIGroup,
+		}, manager)
 		if err != nil {
-			return err
+			log.Errorf("Failed to start the local API: %v", err)
+		} else {
+			go func() {
+				if err := api.Serve(); err != nil {
+					log.Errorf("Local API stopped: %v", err)
+				}
+			}()
+			defer api.Close()
 		}
-		defer d.Cleanup()
-		return runDaemon(d)
-	default:
-		return errMsgNoArgumentsGiven
 	}
+	if config.LocalAuthSocket != "" {
+		if srv, err := startLocalAuthServer(config, d); err != nil {
+			log.Errorf("Failed to start the local auth token API: %v", err)
+		} else {
+			defer srv.Close()
+		}
+	}
+	// Pick up pending deployments as soon as the server notifies
+	// of them.
+	if config.UpdateNotificationEnabled {
+		go d.notifyUpdates()
+	}
+	return runDaemon(d)
+}
+
+// setConfigLogLevel sets the log level of the configuration, unless one is
+// given on the command line.
+func setConfigLogLevel(config *menderConfig, opts *runOptionsType) {
+	if opts.logLevelGiven {
+		return
+	}
+	level := log.InfoLevel
+	if config.LogLevel != "" {
+		var err error
+		if level, err = log.ParseLevel(config.LogLevel); err != nil {
+			log.Warnf("Ignoring the invalid LogLevel %q: %v", config.LogLevel, err)
+			return
+		}
+	}
+	log.SetLevel(level)
+}
+
+// reloadConfig loads the configuration files again for the running daemon,
+// and sets the log level of it right away.
+func reloadConfig(opts *runOptionsType) (*menderConfig, error) {
+	config, err := loadConfig(*opts.config, *opts.fallbackConfig)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Config.NoVerify {
+		config.HttpsClient.SkipVerify = true
+	}
+	setConfigLogLevel(config, opts)
+	return config, nil
 }
 
 func handleArtifactOperations(runOptions runOptionsType, dualRootfsDevice installer.DualRootfsDevice,
@@ -505,20 +793,46 @@ func handleArtifactOperations(runOptions runOptionsType, dualRootfsDevice instal
 	}
 	stateExec := newStateScriptExecutor(config)
 	deviceManager := NewDeviceManager(dualRootfsDevice, config, menderPieces.store)
+	receipts := newReceiptWriter(*runOptions.dataStore,
+		getDeviceKeyStore(config, *runOptions.dataStore))
 
 	switch {
 	case *runOptions.showArtifact:
 		return PrintArtifactName(deviceManager)
 
 	case *runOptions.imageFile != "":
-		vKey := config.GetVerificationKey()
-		return doStandaloneInstall(deviceManager, runOptions, vKey, stateExec)
+		vPolicy := config.GetSignaturePolicy()
+		return doStandaloneInstall(deviceManager, runOptions, vPolicy, stateExec)
+
+	case *runOptions.installBundle != "":
+		vPolicy := config.GetSignaturePolicy()
+		return doInstallBundle(deviceManager, *runOptions.installBundle, vPolicy, stateExec, receipts)
+
+	case *runOptions.snapshotArtifact != "":
+		return doSnapshotArtifact(deviceManager, dualRootfsDevice, snapshotArtifactOptions{
+			output:       *runOptions.snapshotArtifact,
+			artifactName: *runOptions.snapshotName,
+			compression:  *runOptions.snapshotCompression,
+			freeze:       *runOptions.snapshotFreeze,
+		}, new(system.OsCalls))
 
 	case *runOptions.commit:
-		return doStandaloneCommit(deviceManager, stateExec)
+		err := doStandaloneCommit(deviceManager, stateExec)
+		if err != installer.ErrorNothingToCommit {
+			if ferr := finishOfflineDeployment(menderPieces.store, receipts, err == nil); ferr != nil {
+				log.Errorf("Could not write the deployment receipt: %s", ferr.Error())
+			}
+		}
+		return err
 
 	case *runOptions.rollback:
-		return doStandaloneRollback(deviceManager, stateExec)
+		err := doStandaloneRollback(deviceManager, stateExec)
+		if err != installer.ErrorNothingToCommit {
+			if ferr := finishOfflineDeployment(menderPieces.store, receipts, false); ferr != nil {
+				log.Errorf("Could not write the deployment receipt: %s", ferr.Error())
+			}
+		}
+		return err
 
 	default:
 		return errors.New("handleArtifactOperations: Should never get here")
@@ -559,11 +873,25 @@ func runDaemon(d *menderDaemon) error {
 		c := make(chan os.Signal, 2)
 		signal.Notify(c, syscall.SIGUSR1) // SIGUSR1 forces an update check.
 		signal.Notify(c, syscall.SIGUSR2) // SIGUSR2 forces an inventory update.
+		signal.Notify(c, syscall.SIGTERM) // SIGTERM stops the daemon.
+		signal.Notify(c, syscall.SIGHUP)  // SIGHUP reloads the configuration.
 		defer signal.Stop(c)
 
 		for {
 			s := <-c // Block until a signal is received.
-			if s == syscall.SIGUSR1 {
+			if s == syscall.SIGTERM {
+				log.Info("SIGTERM signal received; shutting down.")
+				d.StopDaemon()
+				select {
+				case d.sctx.wakeupChan <- true:
+				default:
+				}
+				return
+			} else if s == syscall.SIGHUP {
+				log.Info("SIGHUP signal received; reloading the configuration.")
+				d.reloadConfig()
+				continue
+			} else if s == syscall.SIGUSR1 {
 				log.Debug("SIGUSR1 signal received.")
 				d.forceToState <- updateCheckState
 			} else if s == syscall.SIGUSR2 {
@@ -505,3 +505,61 @@ func TestInvalidServerCertificateBoot(t *testing.T) {
 
 	assert.Contains(t, logBuf.String(), "IGNORING ERROR")
 }
+
+func TestDaemonReloadConfig(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	confPath := path.Join(tdir, "mender.conf")
+
+	defer func(oldLog *log.Logger) { log.Log = oldLog }(log.Log)
+	log.Log = log.New()
+
+	writeConf := func(conf string) {
+		require.NoError(t, ioutil.WriteFile(confPath, []byte(conf), 0600))
+	}
+	writeConf(`{"ServerURL": "https://hosted.mender.io", "UpdatePollIntervalSeconds": 1800}`)
+	runOpts, err := argsParse([]string{"-daemon", "-config", confPath,
+		"-fallback-config", path.Join(tdir, "does-not-exist.config")})
+	require.NoError(t, err)
+
+	mender := newDefaultTestMender()
+	d := NewDaemon(mender, store.NewMemStore())
+	d.configLoader = func() (*menderConfig, error) {
+		return reloadConfig(&runOpts)
+	}
+	d.setState(checkWaitState)
+
+	// The configuration is applied once the current state is handled,
+	// and the wait for the next poll is cut short.
+	writeConf(`{"ServerURL": "https://onprem.example.com/",
+		"UpdatePollIntervalSeconds": 300, "LogLevel": "debug",
+		"ClientProtocol": "https", "HttpsClient": {"SkipVerify": true}}`)
+	d.reloadConfig()
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+	assert.Len(t, d.sctx.wakeupChan, 1)
+	assert.Equal(t, []client.MenderServer{{}}, mender.config.Servers)
+
+	mender.state = &fakePreDoneState{baseState{id: datastore.MenderStateIdle}}
+	require.NoError(t, d.Run())
+	assert.Equal(t, 300*time.Second, mender.GetUpdatePollInterval())
+	assert.Equal(t, "https://onprem.example.com", mender.config.Servers[0].ServerURL)
+	assert.Equal(t, "https://onprem.example.com", mender.authServer)
+	// The client is set up with the HTTP settings of the new configuration.
+	transport, ok := mender.api.Transport.(*http.Transport)
+	require.True(t, ok)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+
+	// An invalid configuration is not applied.
+	writeConf(`{"ServerURL": "https://onprem.example.com", "LogLevel": "loud"}`)
+	d.reloadConfig()
+	assert.Empty(t, d.configUpdates)
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+
+	// Nor is the log level if it is given on the command line.
+	runOpts.logLevelGiven = true
+	writeConf(`{"ServerURL": "https://onprem.example.com", "LogLevel": "error"}`)
+	d.reloadConfig()
+	assert.Len(t, d.configUpdates, 1)
+	assert.Equal(t, log.DebugLevel, log.Log.Level)
+}
@@ -0,0 +1,379 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maintenanceWindow is a daily time range, on some days of the week, which
+// may cross midnight, in which case it belongs to the day it starts on. Or, if
+// cron is set, it opens at the times of the cron schedule, for a duration.
+type maintenanceWindow struct {
+	days       [7]bool
+	start, end int // minutes into the day
+
+	cron     *cronSchedule
+	duration time.Duration
+}
+
+// cronSchedule is a set of times, given as in crontab(5).
+type cronSchedule struct {
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool // days of the month, from 1
+	months   [13]bool // from 1
+	weekdays [7]bool
+	// Whether the days of the month, or of the week, are all of them. If
+	// neither is, a day matching either is enough, as in cron.
+	anyDay, anyWeekday bool
+}
+
+// The longest duration of a window opened by a cron schedule.
+const maxCronWindowDuration = 7 * 24 * time.Hour
+
+// maintenanceWindows restricts updates to the times of any of the windows,
+// in the given time zone. No windows means no restriction.
+type maintenanceWindows struct {
+	windows  []maintenanceWindow
+	location *time.Location
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+var monthNames = map[string]int{
+	"jan": 1,
+	"feb": 2,
+	"mar": 3,
+	"apr": 4,
+	"may": 5,
+	"jun": 6,
+	"jul": 7,
+	"aug": 8,
+	"sep": 9,
+	"oct": 10,
+	"nov": 11,
+	"dec": 12,
+}
+
+// parseMaintenanceWindows parses windows given as "[<days>] HH:MM-HH:MM",
+// where the days are a comma separated list of days or ranges of days, such
+// as "Mon-Fri" or "Sat,Sun", every day if omitted, or as a cron expression of
+// five fields followed by a duration, such as "30 1 * * Sat 3h", opening the
+// window for the duration at the times of the expression. The time zone is a
+// tz database name, the local time zone if empty.
+func parseMaintenanceWindows(specs []string, timeZone string) (*maintenanceWindows, error) {
+	location := time.Local
+	if timeZone != "" {
+		var err error
+		location, err = time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid time zone %q", timeZone)
+		}
+	}
+
+	windows := &maintenanceWindows{location: location}
+	for _, spec := range specs {
+		window, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid maintenance window %q", spec)
+		}
+		windows.windows = append(windows.windows, window)
+	}
+	return windows, nil
+}
+
+func parseMaintenanceWindow(spec string) (maintenanceWindow, error) {
+	var window maintenanceWindow
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 6:
+		return parseCronWindow(fields)
+	case 1:
+		for day := range window.days {
+			window.days[day] = true
+		}
+	case 2:
+		if err := parseWeekdays(fields[0], &window.days); err != nil {
+			return window, err
+		}
+		fields = fields[1:]
+	default:
+		return window, errors.New(
+			"expected \"[<days>] HH:MM-HH:MM\" or \"<cron expression> <duration>\"")
+	}
+
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return window, errors.New("expected a time range as HH:MM-HH:MM")
+	}
+	var err error
+	if window.start, err = parseTimeOfDay(times[0]); err != nil {
+		return window, err
+	}
+	if window.end, err = parseTimeOfDay(times[1]); err != nil {
+		return window, err
+	}
+	if window.start == window.end {
+		return window, errors.New("the time range is empty")
+	}
+	return window, nil
+}
+
+func parseCronWindow(fields []string) (maintenanceWindow, error) {
+	var window maintenanceWindow
+
+	duration, err := time.ParseDuration(fields[5])
+	if err != nil {
+		return window, errors.Wrap(err, "invalid duration")
+	}
+	if duration < time.Minute || duration > maxCronWindowDuration {
+		return window, errors.Errorf("the duration %s is not between 1m and %s",
+			fields[5], maxCronWindowDuration)
+	}
+
+	var cron cronSchedule
+	var weekdays [8]bool // Sunday is both 0 and 7
+	for _, field := range []struct {
+		name     string
+		spec     string
+		min, max int
+		names    map[string]int
+		set      []bool
+		any      *bool
+	}{
+		{"minute", fields[0], 0, 59, nil, cron.minutes[:], nil},
+		{"hour", fields[1], 0, 23, nil, cron.hours[:], nil},
+		{"day of month", fields[2], 1, 31, nil, cron.days[:], &cron.anyDay},
+		{"month", fields[3], 1, 12, monthNames, cron.months[:], nil},
+		{"day of week", fields[4], 0, 7, cronWeekdayNames(), weekdays[:], &cron.anyWeekday},
+	} {
+		if err := parseCronField(field.spec, field.min, field.max, field.names,
+			field.set); err != nil {
+			return window, errors.Wrapf(err, "invalid %s", field.name)
+		}
+		if field.any != nil {
+			*field.any = strings.HasPrefix(field.spec, "*")
+		}
+	}
+	copy(cron.weekdays[:], weekdays[:7])
+	cron.weekdays[time.Sunday] = cron.weekdays[time.Sunday] || weekdays[7]
+
+	window.cron = &cron
+	window.duration = duration
+	return window, nil
+}
+
+func cronWeekdayNames() map[string]int {
+	names := make(map[string]int, len(weekdayNames))
+	for name, day := range weekdayNames {
+		names[name] = int(day)
+	}
+	return names
+}
+
+// parseCronField sets the values of a field of a cron expression, given as a
+// comma separated list of "*", values or ranges of values, each optionally
+// followed by a step, as in "*/15" or "1-5/2".
+func parseCronField(spec string, min, max int, names map[string]int, set []bool) error {
+	for _, item := range strings.Split(spec, ",") {
+		item, step, err := parseCronStep(item)
+		if err != nil {
+			return err
+		}
+		first, last, err := parseCronRange(item, step, min, max, names)
+		if err != nil {
+			return err
+		}
+		for n := first; n <= last; n += step {
+			set[n] = true
+		}
+	}
+	return nil
+}
+
+// parseCronStep splits the step off an item of a cron field, returning the
+// rest of the item and the step, which is 1 if none is given.
+func parseCronStep(item string) (string, int, error) {
+	i := strings.Index(item, "/")
+	if i < 0 {
+		return item, 1, nil
+	}
+	step, err := strconv.Atoi(item[i+1:])
+	if err != nil || step < 1 {
+		return "", 0, errors.Errorf("invalid step in %q", item)
+	}
+	return item[:i], step, nil
+}
+
+// parseCronRange returns the first and last value of "*", a value or a range
+// of values in a cron field.
+func parseCronRange(item string, step, min, max int,
+	names map[string]int) (int, int, error) {
+
+	if item == "*" {
+		return min, max, nil
+	}
+	bounds := strings.Split(item, "-")
+	if len(bounds) > 2 {
+		return 0, 0, errors.Errorf("invalid range %q", item)
+	}
+	first, err := parseCronValue(bounds[0], min, max, names)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case len(bounds) == 2:
+		last, err := parseCronValue(bounds[1], min, max, names)
+		if err != nil {
+			return 0, 0, err
+		}
+		if last < first {
+			return 0, 0, errors.Errorf("invalid range %q", item)
+		}
+		return first, last, nil
+	case step == 1:
+		// A single value, unless a step makes it the start of a range,
+		// as in "5/10".
+		return first, first, nil
+	default:
+		return first, max, nil
+	}
+}
+
+func parseCronValue(item string, min, max int, names map[string]int) (int, error) {
+	if n, ok := names[strings.ToLower(item)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(item)
+	if err != nil || n < min || n > max {
+		return 0, errors.Errorf("invalid value %q", item)
+	}
+	return n, nil
+}
+
+func parseWeekdays(spec string, days *[7]bool) error {
+	for _, item := range strings.Split(spec, ",") {
+		bounds := strings.Split(item, "-")
+		if len(bounds) > 2 {
+			return errors.Errorf("invalid range of days %q", item)
+		}
+		first, ok := weekdayNames[strings.ToLower(bounds[0])]
+		if !ok {
+			return errors.Errorf("unknown day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, ok = weekdayNames[strings.ToLower(bounds[1])]
+			if !ok {
+				return errors.Errorf("unknown day %q", bounds[1])
+			}
+		}
+		// Ranges may wrap around the end of the week, as in "Fri-Mon".
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseTimeOfDay(spec string) (int, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 2 {
+		return 0, errors.Errorf("invalid time %q, expected HH:MM", spec)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, errors.Errorf("invalid hour in %q", spec)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, errors.Errorf("invalid minute in %q", spec)
+	}
+	return hours*60 + minutes, nil
+}
+
+// isOpen returns whether the time is in any of the windows.
+func (w *maintenanceWindows) isOpen(t time.Time) bool {
+	if w == nil || len(w.windows) == 0 {
+		return true
+	}
+	t = t.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, window := range w.windows {
+		if window.cron != nil {
+			if window.cron.openedWithin(t, window.duration) {
+				return true
+			}
+			continue
+		}
+		if window.start < window.end {
+			if window.days[today] && minute >= window.start && minute < window.end {
+				return true
+			}
+			continue
+		}
+		// Crossing midnight: open from the start until midnight on the
+		// days of the window, and from midnight until the end on the
+		// days after.
+		if window.days[today] && minute >= window.start {
+			return true
+		}
+		if window.days[yesterday] && minute < window.end {
+			return true
+		}
+	}
+	return false
+}
+
+// openedWithin returns whether the schedule has a time in the duration up to
+// and including t, to the minute.
+func (c *cronSchedule) openedWithin(t time.Time, duration time.Duration) bool {
+	for start := t.Truncate(time.Minute); t.Sub(start) < duration; start = start.Add(-time.Minute) {
+		if c.matches(start) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minutes[t.Minute()] || !c.hours[t.Hour()] || !c.months[t.Month()] {
+		return false
+	}
+	day, weekday := c.days[t.Day()], c.weekdays[t.Weekday()]
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
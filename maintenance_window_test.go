@@ -0,0 +1,192 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	windows, err := parseMaintenanceWindows([]string{
+		"Mon-Wed,Fri 02:00-04:30",
+		"Sat-Sun 22:00-06:00",
+	}, "UTC")
+	require.NoError(t, err)
+	assert.Equal(t, []maintenanceWindow{
+		{
+			days:  [7]bool{false, true, true, true, false, true, false},
+			start: 120,
+			end:   270,
+		},
+		{
+			days:  [7]bool{true, false, false, false, false, false, true},
+			start: 1320,
+			end:   360,
+		},
+	}, windows.windows)
+
+	windows, err = parseMaintenanceWindows([]string{"fri-mon 00:00-24:00"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, [7]bool{true, true, false, false, false, true, true},
+		windows.windows[0].days)
+	assert.Equal(t, time.Local, windows.location)
+
+	for _, spec := range []string{
+		"",
+		"02:00",
+		"02:00-04:00-06:00",
+		"2-4",
+		"25:00-04:00",
+		"02:60-04:00",
+		"24:30-04:00",
+		"02:00-02:00",
+		"Funday 02:00-04:00",
+		"Mon-Tue-Wed 02:00-04:00",
+		"Mon 02:00-04:00 UTC",
+	} {
+		_, err := parseMaintenanceWindows([]string{spec}, "")
+		assert.Error(t, err, spec)
+	}
+
+	_, err = parseMaintenanceWindows(nil, "Nowhere/Town")
+	assert.Error(t, err)
+}
+
+func TestMaintenanceWindowsOpen(t *testing.T) {
+	var windows *maintenanceWindows
+	assert.True(t, windows.isOpen(time.Now()))
+
+	windows, err := parseMaintenanceWindows(nil, "UTC")
+	require.NoError(t, err)
+	assert.True(t, windows.isOpen(time.Now()))
+
+	windows, err = parseMaintenanceWindows([]string{
+		"Mon-Fri 02:00-04:00",
+		"Sat 22:00-06:00",
+	}, "Europe/Oslo")
+	require.NoError(t, err)
+
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		time time.Time
+		open bool
+	}{
+		// Monday 2 March 2020.
+		{time.Date(2020, 3, 2, 1, 59, 0, 0, oslo), false},
+		{time.Date(2020, 3, 2, 2, 0, 0, 0, oslo), true},
+		{time.Date(2020, 3, 2, 3, 59, 0, 0, oslo), true},
+		{time.Date(2020, 3, 2, 4, 0, 0, 0, oslo), false},
+		// The time zone of the windows applies.
+		{time.Date(2020, 3, 2, 1, 30, 0, 0, time.UTC), true},
+		// Saturday, until Sunday morning.
+		{time.Date(2020, 3, 7, 3, 0, 0, 0, oslo), false},
+		{time.Date(2020, 3, 7, 21, 59, 0, 0, oslo), false},
+		{time.Date(2020, 3, 7, 22, 0, 0, 0, oslo), true},
+		{time.Date(2020, 3, 8, 5, 59, 0, 0, oslo), true},
+		{time.Date(2020, 3, 8, 6, 0, 0, 0, oslo), false},
+		{time.Date(2020, 3, 8, 22, 30, 0, 0, oslo), false},
+		// The weekday window does not apply on Saturday.
+		{time.Date(2020, 3, 7, 2, 30, 0, 0, oslo), false},
+	} {
+		assert.Equal(t, tc.open, windows.isOpen(tc.time), tc.time.String())
+	}
+}
+
+func TestParseCronMaintenanceWindows(t *testing.T) {
+	windows, err := parseMaintenanceWindows([]string{
+		"*/20 1-3,23 * jan-mar,Dec 1-5/2 90m",
+		"0 0 1,15 * * 24h",
+		"0 4 * * 7 1h",
+	}, "UTC")
+	require.NoError(t, err)
+	require.Len(t, windows.windows, 3)
+
+	cron := windows.windows[0].cron
+	require.NotNil(t, cron)
+	assert.Equal(t, 90*time.Minute, windows.windows[0].duration)
+	for minute := range cron.minutes {
+		assert.Equal(t, minute%20 == 0, cron.minutes[minute], minute)
+	}
+	assert.Equal(t, [24]bool{1: true, 2: true, 3: true, 23: true}, cron.hours)
+	assert.Equal(t, [13]bool{1: true, 2: true, 3: true, 12: true}, cron.months)
+	assert.Equal(t, [7]bool{1: true, 3: true, 5: true}, cron.weekdays)
+	assert.True(t, cron.anyDay)
+	assert.False(t, cron.anyWeekday)
+
+	cron = windows.windows[1].cron
+	assert.Equal(t, [32]bool{1: true, 15: true}, cron.days)
+	assert.False(t, cron.anyDay)
+	assert.True(t, cron.anyWeekday)
+
+	assert.Equal(t, [7]bool{time.Sunday: true}, windows.windows[2].cron.weekdays)
+
+	for _, spec := range []string{
+		"0 2 * * 1",
+		"0 2 * * * * 1h",
+		"60 2 * * * 1h",
+		"0 24 * * * 1h",
+		"0 2 0 * * 1h",
+		"0 2 * 13 * 1h",
+		"0 2 * * 8 1h",
+		"0 2 * * Funday 1h",
+		"0 5-2 * * * 1h",
+		"*/0 2 * * * 1h",
+		"0 2 * * * 30s",
+		"0 2 * * * 169h",
+		"0 2 * * * soon",
+	} {
+		_, err := parseMaintenanceWindows([]string{spec}, "")
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCronMaintenanceWindowsOpen(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	require.NoError(t, err)
+
+	windows, err := parseMaintenanceWindows([]string{
+		// Saturdays from 23:30, until Sunday 02:30.
+		"30 23 * * Sat 3h",
+		// The 1st of the month, or any Tuesday, from 12:00 until 12:15.
+		"0 12 1 * Tue 15m",
+	}, "Europe/Oslo")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		time time.Time
+		open bool
+	}{
+		// Saturday 7 March 2020.
+		{time.Date(2020, 3, 7, 23, 29, 0, 0, oslo), false},
+		{time.Date(2020, 3, 7, 23, 30, 0, 0, oslo), true},
+		{time.Date(2020, 3, 8, 2, 29, 59, 0, oslo), true},
+		{time.Date(2020, 3, 8, 2, 30, 0, 0, oslo), false},
+		// The time zone of the windows applies.
+		{time.Date(2020, 3, 7, 22, 45, 0, 0, time.UTC), true},
+		// Tuesday 3 March 2020.
+		{time.Date(2020, 3, 3, 12, 0, 0, 0, oslo), true},
+		{time.Date(2020, 3, 3, 12, 15, 0, 0, oslo), false},
+		// Sunday 1 March 2020, not a Tuesday.
+		{time.Date(2020, 3, 1, 12, 14, 0, 0, oslo), true},
+		// Monday 2 March 2020.
+		{time.Date(2020, 3, 2, 12, 5, 0, 0, oslo), false},
+	} {
+		assert.Equal(t, tc.open, windows.isOpen(tc.time), tc.time.String())
+	}
+}
@@ -14,10 +14,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/mendersoftware/log"
@@ -27,6 +29,7 @@ import (
 	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/statescript"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 )
 
@@ -35,16 +38,25 @@ type Controller interface {
 	Authorize() menderError
 
 	GetCurrentArtifactName() (string, error)
+	GetProvides() (map[string]string, error)
 	GetUpdatePollInterval() time.Duration
 	GetInventoryPollInterval() time.Duration
 	GetRetryPollInterval() time.Duration
+	GetSubstateReportInterval() time.Duration
+	GetDecommissionedRetryInterval() time.Duration
+	IsDecommissioned() bool
+	MaintenanceWindowOpen(point string) bool
+	AwaitsConfirmation(point string) bool
 
 	CheckUpdate() (*datastore.UpdateInfo, menderError)
+	GetUpdateControlMap(update *datastore.UpdateInfo) (*datastore.UpdateControlMap, menderError)
+	WaitForUpdateNotification() (bool, menderError)
 	FetchUpdate(url string) (io.ReadCloser, int64, error)
 
 	NewStatusReportWrapper(updateId string,
 		stateId datastore.MenderState) *client.StatusReportWrapper
 	ReportUpdateStatus(update *datastore.UpdateInfo, status string) menderError
+	ReportUpdateSubstate(update *datastore.UpdateInfo, status, substate string) menderError
 	UploadLog(update *datastore.UpdateInfo, logs []byte) menderError
 	InventoryRefresh() error
 
@@ -67,6 +79,13 @@ var (
 	errNoArtifactName = errors.New("cannot determine current artifact name")
 )
 
+var (
+	// Flag files confirming the reboot into, and the commit of, the update
+	// on the device.
+	rebootConfirmationFile = path.Join(getStateDirPath(), "confirm-reboot")
+	commitConfirmationFile = path.Join(getStateDirPath(), "confirm-commit")
+)
+
 var (
 	//IMPORTANT: make sure that all the statuses that require
 	// the report to be sent to the backend are assigned here.
@@ -100,13 +119,47 @@ type mender struct {
 	*deviceManager
 
 	updater             client.Updater
+	notifier            client.UpdateNotifier
+	tenantTokens        client.TenantTokenGetter
 	state               State
 	stateScriptExecutor statescript.Executor
-	forceBootstrap      bool
 	authReq             client.AuthRequester
 	authMgr             AuthManager
-	api                 *client.ApiClient
-	authToken           client.AuthToken
+
+	// Protects api, authToken and authServer, and the server list and
+	// poll intervals of config which ReloadConfig replaces, as the substate
+	// heartbeat and the update notifications use them alongside the state
+	// machine.
+	lock      sync.Mutex
+	api       *client.ApiClient
+	authToken client.AuthToken
+	// Server the client last authorized with.
+	authServer string
+	// Tokens issued by the servers the client authorized with, by server
+	// URL, so that failing over between them does not authorize every
+	// time.
+	serverTokens map[string]client.AuthToken
+	// Held while authorizing, so that one authorization request is sent
+	// at a time; also protects forceBootstrap.
+	authLock       sync.Mutex
+	forceBootstrap bool
+
+	sharedAuth sharedAuth
+	pollHints  pollHints
+	// The last response intercepted by the network.
+	interception networkInterception
+	// The authorization attempts rejected as those of a decommissioned
+	// device.
+	rejection deviceRejection
+	// Maintenance windows of installing and rebooting into updates.
+	installWindows *maintenanceWindows
+	rebootWindows  *maintenanceWindows
+	// Limits the substate reports sent by the heartbeat.
+	substateLimiter substateLimiter
+	// Context of all the requests to the server, cancelled by
+	// CancelRequests.
+	ctx            context.Context
+	cancelRequests context.CancelFunc
 }
 
 type MenderPieces struct {
@@ -116,23 +169,40 @@ type MenderPieces struct {
 }
 
 func NewMender(config *menderConfig, pieces MenderPieces) (*mender, error) {
-	api, err := client.New(config.GetHttpConfig())
+	api, err := client.NewWithServers(config.GetHttpConfig(), config.Servers)
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating HTTP client")
 	}
 
+	installWindows, err := parseMaintenanceWindows(config.InstallWindows,
+		config.MaintenanceWindowTimeZone)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid InstallWindows")
+	}
+	rebootWindows, err := parseMaintenanceWindows(config.RebootWindows,
+		config.MaintenanceWindowTimeZone)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid RebootWindows")
+	}
+
 	stateScrExec := newStateScriptExecutor(config)
 
 	m := &mender{
 		deviceManager:       NewDeviceManager(pieces.dualRootfsDevice, config, pieces.store),
 		updater:             client.NewUpdate(),
+		notifier:            client.NewUpdateNotify(),
+		tenantTokens:        client.NewTenantToken(),
 		state:               initState,
 		stateScriptExecutor: stateScrExec,
 		authMgr:             pieces.authMgr,
 		authReq:             client.NewAuth(),
 		api:                 api,
 		authToken:           noAuthToken,
+		installWindows:      installWindows,
+		rebootWindows:       rebootWindows,
 	}
+	m.ctx, m.cancelRequests = context.WithCancel(context.Background())
+	m.authServer = m.loadAuthServer()
 
 	if m.authMgr != nil {
 		if err := m.loadAuth(); err != nil {
@@ -143,7 +213,125 @@ func NewMender(config *menderConfig, pieces MenderPieces) (*mender, error) {
 	return m, nil
 }
 
+// request returns an authorized ApiRequester, sending the requests with the
+// context of the mender.
+func (m *mender) request() client.ApiRequester {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.withContext(m.api.Request(m.authToken, m.authServer,
+		serverIterator(m.config.Servers, m.firstServer()), reauthorize(m)).
+		WithServerTokens(m.serverTokens))
+}
+
+// authorizedRequest returns an ApiRequester like request, which sends the
+// requests with the current token and never authorizes, or nil if the client
+// is not authorized.
+func (m *mender) authorizedRequest() client.ApiRequester {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.authToken == noAuthToken {
+		return nil
+	}
+	return m.withContext(m.api.Request(m.authToken, m.authServer,
+		serverIterator(m.config.Servers, m.firstServer()), nil).
+		WithServerTokens(m.serverTokens))
+}
+
+// apiClient returns the client sending the requests to the server, with the
+// context of the mender.
+func (m *mender) apiClient() client.ApiRequester {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.withContext(m.api)
+}
+
+// requestServer returns the server the requests are sent to first: the one
+// which issued the authorization token, so that the token is not replaced
+// before failing over, or the first server if it is not known.
+func (m *mender) requestServer() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.firstServer()
+}
+
+// firstServer is requestServer, with the lock held.
+func (m *mender) firstServer() string {
+	for _, server := range m.config.Servers {
+		if server.ServerURL == m.authServer {
+			return server.ServerURL
+		}
+	}
+	if len(m.config.Servers) == 0 {
+		return ""
+	}
+	return m.config.Servers[0].ServerURL
+}
+
+func (m *mender) withContext(api client.ApiRequester) client.ApiRequester {
+	if m.ctx == nil {
+		return api
+	}
+	return client.WithContext(api, m.ctx)
+}
+
+// ReadArtifactHeaders reads the artifact from a stream which fails once the
+// requests are cancelled, so that the writing of an update does not hold up
+// the daemon shutting down.
+func (m *mender) ReadArtifactHeaders(from io.ReadCloser) (*installer.Installer, error) {
+	if m.ctx != nil {
+		from = utils.NewContextReadCloser(m.ctx, from)
+	}
+	return m.deviceManager.ReadArtifactHeaders(from)
+}
+
+// CancelRequests cancels the requests in progress, and any later ones, such as
+// when the daemon shuts down.
+func (m *mender) CancelRequests() {
+	if m.cancelRequests != nil {
+		m.cancelRequests()
+	}
+}
+
+// ReloadConfig applies the poll intervals, the server list and the HTTP client
+// settings of a newly loaded configuration. The rest of the configuration, and
+// the state of the client, such as a deployment in progress, are left as they
+// are.
+func (m *mender) ReloadConfig(config *menderConfig) error {
+	if len(config.Servers) == 0 {
+		return errors.New("empty server list")
+	}
+	api, err := client.NewWithServers(config.GetHttpConfig(), config.Servers)
+	if err != nil {
+		return errors.Wrap(err, "error creating HTTP client")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.config.UpdatePollIntervalSeconds = config.UpdatePollIntervalSeconds
+	m.config.InventoryPollIntervalSeconds = config.InventoryPollIntervalSeconds
+	m.config.RetryPollIntervalSeconds = config.RetryPollIntervalSeconds
+	m.config.PollIntervalJitterPercent = config.PollIntervalJitterPercent
+	m.config.Servers = config.Servers
+	m.api = api
+	// The token is kept if the server which issued it is still listed;
+	// otherwise the client authorizes again once the first server
+	// rejects it.
+	m.authServer = m.loadAuthServer()
+	listed := make(map[string]bool, len(config.Servers))
+	for _, server := range config.Servers {
+		listed[server.ServerURL] = true
+	}
+	for serverURL := range m.serverTokens {
+		if !listed[serverURL] {
+			delete(m.serverTokens, serverURL)
+		}
+	}
+	return nil
+}
+
 func (m *mender) ForceBootstrap() {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
 	m.forceBootstrap = true
 }
 
@@ -161,6 +349,13 @@ func (m *mender) needsBootstrap() bool {
 }
 
 func (m *mender) Bootstrap() menderError {
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+	return m.bootstrap()
+}
+
+// bootstrap is Bootstrap, with the authorization lock held.
+func (m *mender) bootstrap() menderError {
 	if !m.needsBootstrap() {
 		return nil
 	}
@@ -168,8 +363,51 @@ func (m *mender) Bootstrap() menderError {
 	return m.doBootstrap()
 }
 
+// loadAuthServer returns the server the client last authorized with, or the
+// first server if it is not known. Called with the lock held.
+func (m *mender) loadAuthServer() string {
+	if len(m.config.Servers) == 0 {
+		return ""
+	}
+	if m.store != nil {
+		data, err := m.store.ReadAll(datastore.AuthServerKey)
+		if err == nil {
+			for _, server := range m.config.Servers {
+				if server.ServerURL == string(data) {
+					return server.ServerURL
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			log.Warnf("Failed to read the server of the authorization token: %v", err)
+		}
+	}
+	return m.config.Servers[0].ServerURL
+}
+
+// authServerURL returns the server which issued the authorization token.
+func (m *mender) authServerURL() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.authServer
+}
+
+// setAuthServer sets the server which issued the authorization token.
+func (m *mender) setAuthServer(serverURL string) {
+	m.lock.Lock()
+	m.authServer = serverURL
+	m.lock.Unlock()
+	if m.store == nil {
+		return
+	}
+	if err := m.store.WriteAll(datastore.AuthServerKey, []byte(serverURL)); err != nil {
+		log.Warnf("Failed to store the server of the authorization token: %v", err)
+	}
+}
+
 // cache authorization code
 func (m *mender) loadAuth() menderError {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if m.authToken != noAuthToken {
 		return nil
 	}
@@ -180,9 +418,51 @@ func (m *mender) loadAuth() menderError {
 	}
 
 	m.authToken = code
+	if m.serverTokens == nil {
+		m.serverTokens = make(map[string]client.AuthToken)
+	}
+	m.serverTokens[m.authServer] = code
+	m.sharedAuth.set(m.authServer, code)
 	return nil
 }
 
+// clearAuth drops the cached authorization code, and tells the local
+// consumers of the token of the server that it is no longer valid if
+// rejected is set.
+func (m *mender) clearAuth(serverURL string, rejected bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.authToken = noAuthToken
+	if rejected {
+		delete(m.serverTokens, serverURL)
+		m.sharedAuth.set(serverURL, noAuthToken)
+	}
+}
+
+// forgetServerToken drops the token issued by the server, which rejected the
+// device, or all of them if serverURL is empty.
+func (m *mender) forgetServerToken(serverURL string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if serverURL == "" {
+		m.serverTokens = nil
+		return
+	}
+	delete(m.serverTokens, serverURL)
+}
+
+// CurrentAuthToken returns the API token of the client, and the server it is
+// valid for. The token is empty if the client is not authorized.
+func (m *mender) CurrentAuthToken() (string, client.AuthToken) {
+	return m.sharedAuth.get()
+}
+
+// SetAuthTokenListener sets a function called whenever the API token of the
+// client changes, to share it with other on-device processes.
+func (m *mender) SetAuthTokenListener(listener func(serverURL string, token client.AuthToken)) {
+	m.sharedAuth.setListener(listener)
+}
+
 func (m *mender) IsAuthorized() bool {
 	if m.authMgr.IsAuthorized() {
 		// AuthToken is present in store
@@ -201,18 +481,21 @@ func (m *mender) Authorize() menderError {
 	var err error
 	var server *client.MenderServer
 
+	m.authLock.Lock()
+	defer m.authLock.Unlock()
+
 	if m.authMgr.IsAuthorized() {
 		log.Info("authorization data present and valid, skipping authorization attempt")
 		return m.loadAuth()
 	}
 
-	if err := m.Bootstrap(); err != nil {
+	if err := m.bootstrap(); err != nil {
 		log.Errorf("bootstrap failed: %s", err)
 		return err
 	}
 
 	// Cycle through servers and attempt to authorize.
-	m.authToken = noAuthToken
+	m.clearAuth("", false)
 	serverIterator := nextServerIterator(m)
 	if serverIterator == nil {
 		return NewFatalError(errors.New("Empty server list in mender.conf!"))
@@ -221,7 +504,7 @@ func (m *mender) Authorize() menderError {
 		return NewFatalError(errors.New("Empty server list in mender.conf!"))
 	}
 	for {
-		rsp, err = m.authReq.Request(m.api, server.ServerURL, m.authMgr)
+		rsp, err = m.authReq.Request(m.apiClient(), server.ServerURL, m.authMgr)
 
 		if err == nil {
 			// SUCCESS!
@@ -235,15 +518,18 @@ func (m *mender) Authorize() menderError {
 		log.Warnf("Failed to authorize %q; attempting %q.",
 			prevHost, server.ServerURL)
 	}
+	m.rejection.note(err, time.Now())
 	if err != nil {
+		m.interception.note(err, time.Now())
 		// Generate and report error.
-		errCause := errors.Cause(err)
-		if errCause == client.AuthErrorUnauthorized {
+		if client.IsAuthError(err) {
 			// make sure to remove auth token once device is rejected
 			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
 				log.Warn("can not remove rejected authentication token")
 			}
+			m.clearAuth(m.authServerURL(), true)
 		}
+		m.wipeDecommissionedAuth()
 		return NewTransientError(errors.Wrap(err, "authorization request failed"))
 	}
 
@@ -254,6 +540,7 @@ func (m *mender) Authorize() menderError {
 
 	log.Info("successfully received new authorization data")
 
+	m.setAuthServer(server.ServerURL)
 	return m.loadAuth()
 }
 
@@ -271,8 +558,11 @@ func (m *mender) doBootstrap() menderError {
 	return nil
 }
 
+// FetchUpdate downloads the artifact of the link, which may be relative to the
+// server, when it is behind a path prefix.
 func (m *mender) FetchUpdate(url string) (io.ReadCloser, int64, error) {
-	return m.updater.FetchUpdate(m.api, url, m.GetRetryPollInterval())
+	url = client.ResolveServerLink(m.requestServer(), url)
+	return m.updater.FetchUpdate(m.apiClient(), url, m.GetRetryPollInterval())
 }
 
 // Check if new update is available. In case of errors, returns nil and error
@@ -292,16 +582,22 @@ func (m *mender) CheckUpdate() (*datastore.UpdateInfo, menderError) {
 	if err != nil {
 		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", m.config.DeviceTypeFile, err)
 	}
-	haveUpdate, err := m.updater.GetScheduledUpdate(m.api.Request(m.authToken, nextServerIterator(m), reauthorize(m)),
-		m.config.Servers[0].ServerURL, client.CurrentUpdate{
+	provides, err := m.GetProvides()
+	if err != nil {
+		log.Errorf("Unable to read the provides of the current artifact: %v", err)
+	}
+	haveUpdate, err := m.updater.GetScheduledUpdate(m.request(),
+		m.requestServer(), client.CurrentUpdate{
 			Artifact:   currentArtifactName,
 			DeviceType: deviceType,
+			Provides:   provides,
 		})
+	m.pollHints.set(m.updater.PollHints(), time.Now())
 
 	if err != nil {
+		m.interception.note(err, time.Now())
 		// remove authentication token if device is not authorized
-		errCause := errors.Cause(err)
-		if errCause == client.ErrNotAuthorized {
+		if client.IsAuthError(err) {
 			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
 				log.Warn("can not remove rejected authentication token")
 			}
@@ -325,15 +621,101 @@ func (m *mender) CheckUpdate() (*datastore.UpdateInfo, menderError) {
 		log.Info("Attempting to upgrade to currently installed artifact name, not performing upgrade.")
 		return &update, NewTransientError(os.ErrExist)
 	}
+
+	if err := m.checkDeploymentRateLimit(); err != nil {
+		log.Warnf("Deferring deployment %s: %v", update.ID, err)
+		return &update, NewTransientError(errDeploymentDeferred)
+	}
 	return &update, nil
 }
 
+// GetUpdateControlMap fetches the current update control map of the given
+// deployment from the server. It returns an error if the deployment is no
+// longer pending for the device.
+func (m *mender) GetUpdateControlMap(update *datastore.UpdateInfo) (*datastore.UpdateControlMap, menderError) {
+	currentArtifactName, err := m.GetCurrentArtifactName()
+	if err != nil {
+		return nil, NewTransientError(errors.Wrap(err, "could not read the artifact name"))
+	}
+	deviceType, err := m.GetDeviceType()
+	if err != nil {
+		log.Errorf("Unable to verify the existing hardware: %v : %v", m.config.DeviceTypeFile, err)
+	}
+	provides, err := m.GetProvides()
+	if err != nil {
+		log.Errorf("Unable to read the provides of the current artifact: %v", err)
+	}
+
+	haveUpdate, err := m.updater.GetScheduledUpdate(m.request(),
+		m.requestServer(), client.CurrentUpdate{
+			Artifact:   currentArtifactName,
+			DeviceType: deviceType,
+			Provides:   provides,
+		})
+	m.pollHints.set(m.updater.PollHints(), time.Now())
+	if err != nil {
+		return nil, NewTransientError(errors.Wrap(err, "failed to refresh the update control map"))
+	}
+
+	current, ok := haveUpdate.(datastore.UpdateInfo)
+	if !ok || current.ID != update.ID {
+		return nil, NewFatalError(errors.Errorf(
+			"deployment %s is no longer pending on the server", update.ID))
+	}
+	return current.UpdateControlMap, nil
+}
+
+// WaitForUpdateNotification blocks until the server notifies of a pending
+// deployment, or the notification timeout expires. A fatal error is returned
+// if notifications are disabled or not supported by the server, in which case
+// the client only relies on polling. The client does not authorize while
+// waiting, this is left to the state machine; a transient error is returned
+// if it is not authorized.
+func (m *mender) WaitForUpdateNotification() (bool, menderError) {
+	if !m.config.UpdateNotificationEnabled {
+		return false, NewFatalError(client.ErrNotificationsUnsupported)
+	}
+
+	api := m.authorizedRequest()
+	if api == nil {
+		return false, NewTransientError(errors.New("not authorized"))
+	}
+	pending, err := m.notifier.WaitForUpdate(api,
+		m.requestServer(), m.GetUpdateNotificationTimeout())
+	if err != nil {
+		if errors.Cause(err) == client.ErrNotificationsUnsupported {
+			return false, NewFatalError(err)
+		}
+		return false, NewTransientError(err)
+	}
+	return pending, nil
+}
+
+// checkDeploymentRateLimit returns an error if starting a new deployment now
+// would exceed the configured deployment rate limits.
+func (m *mender) checkDeploymentRateLimit() error {
+	if m.store == nil || (m.config.DeploymentMinIntervalSeconds <= 0 &&
+		m.config.DeploymentMaxPerDay <= 0) {
+		return nil
+	}
+
+	history, err := loadDeploymentHistory(m.store)
+	if err != nil {
+		// Don't let a broken history block updates forever.
+		log.Errorf("Could not load deployment history: %v", err)
+		return nil
+	}
+	return history.checkRateLimit(time.Now(),
+		time.Duration(m.config.DeploymentMinIntervalSeconds)*time.Second,
+		m.config.DeploymentMaxPerDay)
+}
+
 func (m *mender) NewStatusReportWrapper(updateId string,
 	stateId datastore.MenderState) *client.StatusReportWrapper {
 
 	return &client.StatusReportWrapper{
-		API: m.api.Request(m.authToken, nextServerIterator(m), reauthorize(m)),
-		URL: m.config.Servers[0].ServerURL,
+		API: m.request(),
+		URL: m.requestServer(),
 		Report: client.StatusReport{
 			DeploymentID: updateId,
 			Status:       StateStatus(stateId),
@@ -341,22 +723,61 @@ func (m *mender) NewStatusReportWrapper(updateId string,
 	}
 }
 
+// ReportUpdateStatus reports the status of the deployment, unless the server
+// has acknowledged it already. Statuses ending the deployment are recorded
+// before they are sent, so that they are sent again after a restart.
 func (m *mender) ReportUpdateStatus(update *datastore.UpdateInfo, status string) menderError {
+	last := loadStatusReportRecord(m.store)
+	if last != nil && last.DeploymentID == update.ID && last.Status == status &&
+		last.Acknowledged {
+		log.Debugf("Status %s of deployment %s already reported", status, update.ID)
+		return nil
+	}
+
+	record := &statusReportRecord{DeploymentID: update.ID, Status: status}
+	if isTerminalStatus(status) {
+		storeStatusReportRecord(m.store, record)
+	}
+	err := m.reportUpdateStatus(client.StatusReport{
+		DeploymentID: update.ID,
+		Status:       status,
+	})
+	if err == nil {
+		record.Acknowledged = true
+		storeStatusReportRecord(m.store, record)
+	}
+	return err
+}
+
+// ReportUpdateSubstate reports the status of the deployment together with a
+// human readable description of what the device is currently doing. Reports
+// identical to the last one, or too soon after it, are dropped.
+func (m *mender) ReportUpdateSubstate(update *datastore.UpdateInfo, status, substate string) menderError {
+	report := client.StatusReport{
+		DeploymentID: update.ID,
+		Status:       status,
+		SubState:     substate,
+	}
+	if !m.substateLimiter.allow(report, time.Now()) {
+		log.Debugf("Dropping the substate report %q", substate)
+		return nil
+	}
+	return m.reportUpdateStatus(report)
+}
+
+func (m *mender) reportUpdateStatus(report client.StatusReport) menderError {
 	s := client.NewStatus()
-	err := s.Report(m.api.Request(m.authToken, nextServerIterator(m), reauthorize(m)), m.config.Servers[0].ServerURL,
-		client.StatusReport{
-			DeploymentID: update.ID,
-			Status:       status,
-		})
+	err := s.Report(m.request(), m.requestServer(),
+		report)
 	if err != nil {
 		log.Error("error reporting update status: ", err)
+		m.interception.note(err, time.Now())
 		// remove authentication token if device is not authorized
-		errCause := errors.Cause(err)
-		if errCause == client.ErrNotAuthorized {
+		if client.IsAuthError(err) {
 			if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
 				log.Warn("can not remove rejected authentication token")
 			}
-		} else if errCause == client.ErrDeploymentAborted {
+		} else if client.IsDeploymentAborted(err) {
 			return NewFatalError(err)
 		}
 		return NewTransientError(err)
@@ -376,34 +797,45 @@ func reauthorize(m *mender) func(string) (client.AuthToken, error) {
 		var rsp []byte
 		var err error
 
-		if err := m.Bootstrap(); err != nil {
+		m.authLock.Lock()
+		defer m.authLock.Unlock()
+
+		if err := m.bootstrap(); err != nil {
 			log.Errorf("bootstrap failed: %s", err)
 			return noAuthToken, err
 		}
-		// assume token is invalid - remove from storage
-		if err := m.authMgr.RemoveAuthToken(); err != nil {
-			return noAuthToken, errors.New("Failed to remove auth token")
-		}
 
-		m.authToken = noAuthToken
-		rsp, err = m.authReq.Request(m.api, serverURL, m.authMgr)
+		// The current token is kept until the server answers, as this
+		// is also called before the token expires, when it is still
+		// valid.
+		rsp, err = m.authReq.Request(m.apiClient(), serverURL, m.authMgr)
 		if err != nil {
 			// Generate and report error.
-			errCause := errors.Cause(err)
-			if errCause == client.AuthErrorUnauthorized {
-				// make sure to remove auth token once device is rejected
+			if client.IsAuthError(err) && serverURL == m.authServerURL() {
+				// make sure to remove auth token once device is
+				// rejected; a token issued by another server
+				// is still valid there
 				if remErr := m.authMgr.RemoveAuthToken(); remErr != nil {
 					log.Warn("can not remove rejected authentication token")
 				}
+				m.clearAuth(serverURL, true)
+			} else if client.IsAuthError(err) {
+				m.forgetServerToken(serverURL)
 			}
 			return noAuthToken, NewTransientError(errors.Wrap(err, "authorization request failed"))
 		}
 
+		// replace the token in storage with the new one
+		if err := m.authMgr.RemoveAuthToken(); err != nil {
+			return noAuthToken, errors.New("Failed to remove auth token")
+		}
+		m.clearAuth(serverURL, false)
 		err = m.authMgr.RecvAuthResponse(rsp)
 		if err != nil {
 			return noAuthToken, NewTransientError(errors.Wrap(err, "failed to parse authorization response"))
 		}
 
+		m.setAuthServer(serverURL)
 		err = m.loadAuth()
 		if err == nil {
 			return m.authMgr.AuthToken()
@@ -415,24 +847,39 @@ func reauthorize(m *mender) func(string) (client.AuthToken, error) {
 // nextServerIterator returns an iterator like function that cycles through the
 // list of available servers in mender.menderConfig.Servers
 func nextServerIterator(m *mender) func() *client.MenderServer {
-	numServers := len(m.config.Servers)
-	if m.config.Servers == nil || numServers == 0 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return serverIterator(m.config.Servers, "")
+}
+
+// serverIterator returns an iterator like function that cycles through the
+// servers once, starting with the one with the URL first, or else with the
+// first server.
+func serverIterator(servers []client.MenderServer, first string) func() *client.MenderServer {
+	if len(servers) == 0 {
 		log.Error("Empty server list! Make sure at least one server" +
 			"is specified in /etc/mender/mender.conf")
 		return nil
 	}
 
-	idx := 0
+	start := 0
+	for i, server := range servers {
+		if server.ServerURL == first {
+			start = i
+			break
+		}
+	}
+	tried := 0
 	return func() (server *client.MenderServer) {
 		var ret *client.MenderServer
-		if idx < numServers {
-			ret = &m.config.Servers[idx]
-			idx++
+		if tried < len(servers) {
+			ret = &servers[(start+tried)%len(servers)]
+			tried++
 		} else {
 			// return nil which terminates Do()
 			// and reset index (for reuse of request)
 			ret = nil
-			idx = 0
+			tried = 0
 		}
 		return ret
 	}
@@ -441,44 +888,167 @@ func nextServerIterator(m *mender) func() *client.MenderServer {
 /* client closures END */
 
 func (m *mender) UploadLog(update *datastore.UpdateInfo, logs []byte) menderError {
-	s := client.NewLog()
-	err := s.Upload(m.api.Request(m.authToken, nextServerIterator(m), reauthorize(m)), m.config.Servers[0].ServerURL,
+	s := client.NewLogWithConfig(m.config.GetLogUploadConfig())
+	err := s.Upload(m.request(), m.requestServer(),
 		client.LogData{
 			DeploymentID: update.ID,
 			Messages:     logs,
 		})
 	if err != nil {
 		log.Error("error uploading logs: ", err)
+		if client.IsDeploymentAborted(err) {
+			return NewFatalError(err)
+		}
+		return NewTransientError(err)
+	}
+	return nil
+}
+
+// UploadReceipt uploads the signed receipt of a deployment applied from an
+// offline bundle.
+func (m *mender) UploadReceipt(deploymentID string, receipt []byte) menderError {
+	u := client.NewReceipt()
+	err := u.Upload(m.request(), m.requestServer(),
+		client.ReceiptData{
+			DeploymentID: deploymentID,
+			Receipt:      receipt,
+		})
+	if err != nil {
+		log.Error("error uploading receipt: ", err)
+		if client.IsDeploymentAborted(err) {
+			return NewFatalError(err)
+		}
 		return NewTransientError(err)
 	}
 	return nil
 }
 
 func (m *mender) GetUpdatePollInterval() time.Duration {
-	t := time.Duration(m.config.UpdatePollIntervalSeconds) * time.Second
+	t, _ := m.pollHints.get(time.Now())
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if t == 0 {
+		t = time.Duration(m.config.UpdatePollIntervalSeconds) * time.Second
+	}
 	if t == 0 {
 		log.Warn("UpdatePollIntervalSeconds is not defined")
 		t = 30 * time.Minute
 	}
-	return t
+	return jitterPollInterval(t, m.config.PollIntervalJitterPercent)
 }
 
 func (m *mender) GetInventoryPollInterval() time.Duration {
-	t := time.Duration(m.config.InventoryPollIntervalSeconds) * time.Second
+	_, t := m.pollHints.get(time.Now())
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if t == 0 {
+		t = time.Duration(m.config.InventoryPollIntervalSeconds) * time.Second
+	}
 	if t == 0 {
 		log.Warn("InventoryPollIntervalSeconds is not defined")
 		t = 30 * time.Minute
 	}
+	return jitterPollInterval(t, m.config.PollIntervalJitterPercent)
+}
+
+func (m *mender) GetUpdateNotificationTimeout() time.Duration {
+	t := time.Duration(m.config.UpdateNotificationTimeoutSeconds) * time.Second
+	if t == 0 {
+		t = 5 * time.Minute
+	}
 	return t
 }
 
+// GetDecommissionedRetryInterval returns the interval between the
+// authorization attempts of a device the server rejects as decommissioned.
+func (m *mender) GetDecommissionedRetryInterval() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t := time.Duration(m.config.DecommissionedRetryIntervalSeconds) * time.Second
+	if t == 0 {
+		t = 24 * time.Hour
+	}
+	return jitterPollInterval(t, m.config.PollIntervalJitterPercent)
+}
+
+// IsDecommissioned returns whether the last authorization attempts were all
+// rejected by the server for good.
+func (m *mender) IsDecommissioned() bool {
+	return m.rejection.decommissioned()
+}
+
+// wipeDecommissionedAuth removes the authorization token, and has a new device
+// key generated at the next authorization attempt, once the device has been
+// decommissioned for DecommissionedWipeAfterSeconds, so that it asks to be
+// authorized as a new device. Called with the authorization lock held.
+func (m *mender) wipeDecommissionedAuth() {
+	wipeAfter := time.Duration(m.config.DecommissionedWipeAfterSeconds) * time.Second
+	if !m.rejection.shouldWipe(wipeAfter, time.Now()) {
+		return
+	}
+	log.Warnf("The device has been decommissioned for more than %v; removing "+
+		"its authorization token and key, to authorize as a new device", wipeAfter)
+	if err := m.authMgr.RemoveAuthToken(); err != nil {
+		log.Errorf("Could not remove the authorization token: %v", err)
+	}
+	m.clearAuth("", false)
+	// The tokens of the other servers were issued for the old key.
+	m.forgetServerToken("")
+	m.forceBootstrap = true
+}
+
+// GetSubstateReportInterval returns the interval between substate reports
+// during long running phases of a deployment, or 0 if they are disabled.
+func (m *mender) GetSubstateReportInterval() time.Duration {
+	return time.Duration(m.config.SubstateReportIntervalSeconds) * time.Second
+}
+
+// MaintenanceWindowOpen returns whether the deployment may proceed from the
+// pause point now, according to the maintenance windows.
+func (m *mender) MaintenanceWindowOpen(point string) bool {
+	switch point {
+	case datastore.UpdateControlMapInstallEnter:
+		return m.installWindows.isOpen(time.Now())
+	case deploymentRebootEnter:
+		return m.rebootWindows.isOpen(time.Now())
+	default:
+		return true
+	}
+}
+
+// AwaitsConfirmation returns whether the deployment must wait at the pause
+// point for a confirmation on the device. A confirmation flag file found
+// meanwhile is consumed.
+func (m *mender) AwaitsConfirmation(point string) bool {
+	var flag string
+	switch {
+	case point == deploymentRebootEnter && m.config.RebootConfirmationRequired:
+		flag = rebootConfirmationFile
+	case point == datastore.UpdateControlMapCommitEnter && m.config.CommitConfirmationRequired:
+		flag = commitConfirmationFile
+	default:
+		return false
+	}
+
+	err := os.Remove(flag)
+	if err == nil {
+		log.Infof("Deployment confirmed at %s by %s", point, flag)
+		return false
+	} else if !os.IsNotExist(err) {
+		log.Errorf("Failed to consume the confirmation flag file: %s", err)
+	}
+	return true
+}
+
 func (m *mender) GetRetryPollInterval() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	t := time.Duration(m.config.RetryPollIntervalSeconds) * time.Second
 	if t == 0 {
 		log.Warn("RetryPollIntervalSeconds is not defined")
 		t = 5 * time.Minute
 	}
-	return t
+	return jitterPollInterval(t, m.config.PollIntervalJitterPercent)
 }
 
 func (m *mender) SetNextState(s State) {
@@ -586,7 +1156,12 @@ func transitionState(to State, ctx *StateContext, c Controller) (State, bool) {
 
 func (m *mender) InventoryRefresh() error {
 	ic := client.NewInventory()
-	idg := NewInventoryDataRunner(path.Join(getDataDirPath(), "inventory"))
+	scriptsDir := m.config.InventoryScriptsDir
+	if scriptsDir == "" {
+		scriptsDir = path.Join(getDataDirPath(), "inventory")
+	}
+	idg := NewInventoryDataRunner(scriptsDir,
+		time.Duration(m.config.InventoryScriptTimeoutSeconds)*time.Second)
 
 	artifactName, err := m.GetCurrentArtifactName()
 	if err != nil || artifactName == "" {
@@ -602,16 +1177,26 @@ func (m *mender) InventoryRefresh() error {
 		// at least report device type
 		log.Errorf("failed to obtain inventory data: %s", err.Error())
 	}
+	idata = m.appendBuiltinInventory(idata)
 
 	deviceType, err := m.GetDeviceType()
 	if err != nil {
 		log.Errorf("Unable to verify the existing hardware. Update will continue anyways: %v : %v", m.config.DeviceTypeFile, err)
 	}
+	staticAttr := make([]client.InventoryAttribute, 0, len(m.config.InventoryAttributes))
+	for name, value := range m.config.InventoryAttributes {
+		staticAttr = append(staticAttr, client.InventoryAttribute{Name: name, Value: value})
+	}
+	_ = idata.ReplaceAttributes(staticAttr)
+
 	reqAttr := []client.InventoryAttribute{
 		{Name: "device_type", Value: deviceType},
 		{Name: "artifact_name", Value: artifactName},
 		{Name: "mender_client_version", Value: VersionString()},
 	}
+	reqAttr = append(reqAttr, m.writeThroughputAttributes()...)
+	reqAttr = append(reqAttr, m.interception.attributes()...)
+	reqAttr = append(reqAttr, m.rejection.attributes()...)
 
 	if idata == nil {
 		idata = make(client.InventoryData, 0, len(reqAttr))
@@ -623,14 +1208,98 @@ func (m *mender) InventoryRefresh() error {
 		return nil
 	}
 
-	err = ic.Submit(m.api.Request(m.authToken, nextServerIterator(m), reauthorize(m)), m.config.Servers[0].ServerURL, idata)
+	server := m.requestServer()
+	idata, submitted := m.inventoryDelta(server, idata)
+	if submitted != nil && len(idata) == 0 {
+		log.Debug("inventory unchanged; not submitting it")
+		storeSubmittedInventory(m.store, submitted)
+		return nil
+	}
+
+	err = ic.Submit(m.request(), server, idata)
 	if err != nil {
+		m.interception.note(err, time.Now())
 		return errors.Wrapf(err, "failed to submit inventory data")
 	}
+	if submitted != nil {
+		storeSubmittedInventory(m.store, submitted)
+	}
 
+	m.rotateTenantToken(server)
 	return nil
 }
 
+// appendBuiltinInventory appends the inventory collected by the client itself
+// to the one of the inventory scripts, which takes precedence.
+func (m *mender) appendBuiltinInventory(idata client.InventoryData) client.InventoryData {
+	idata = appendMissingAttributes(idata,
+		newBuiltinInventory(m.config.BootEnvironment).Get())
+	if config, err := installer.ReadDeviceConfig(m.config.ConfigureDeviceConfigFile); err != nil {
+		log.Errorf("failed to obtain the device configuration: %v", err)
+	} else {
+		idata = appendMissingAttributes(idata, deviceConfigInventory(config))
+	}
+	if m.config.InventoryHealthMetrics {
+		health := &healthInventory{dataDir: getDataDirPath()}
+		idata = appendMissingAttributes(idata, health.Get())
+	}
+	if m.config.InventoryLocationSource != "" {
+		location := &locationInventory{source: m.config.InventoryLocationSource}
+		if data, err := location.Get(); err != nil {
+			log.Errorf("failed to obtain the location: %v", err)
+		} else {
+			idata = appendMissingAttributes(idata, data)
+		}
+	}
+	return idata
+}
+
+// inventoryDelta returns the part of the inventory to submit to the server,
+// and what is recorded as submitted once it has been; nil if only full
+// inventories are submitted.
+func (m *mender) inventoryDelta(server string,
+	idata client.InventoryData) (client.InventoryData, *submittedInventory) {
+
+	if m.config.InventoryFullUpdateInterval <= 1 || m.store == nil {
+		return idata, nil
+	}
+	return inventoryDelta(loadSubmittedInventory(m.store), server,
+		idata, m.config.InventoryFullUpdateInterval)
+}
+
+// rotateTenantToken asks the server for a new tenant token, and authorizes
+// with it if there is one, so that devices can be moved to another tenant
+// without being touched. If the server does not accept the new token, the
+// current one is kept; the server hands out the new one again next time.
+func (m *mender) rotateTenantToken(server string) {
+	token, err := m.tenantTokens.GetTenantToken(m.request(), server)
+	if err != nil {
+		log.Warnf("Could not check for a new tenant token: %v", err)
+		return
+	}
+	current := m.authMgr.TenantToken(server)
+	if token == client.EmptyAuthToken || token == current {
+		return
+	}
+	if err := client.ValidateTenantToken(token); err != nil {
+		log.Errorf("Ignoring the new tenant token given by %s: %v", server, err)
+		return
+	}
+
+	log.Infof("Received a new tenant token from %s; authorizing with it", server)
+	m.authMgr.TryTenantToken(server, token)
+	if _, err := reauthorize(m)(server); err != nil {
+		log.Errorf("Could not authorize with the new tenant token, keeping "+
+			"the previous one: %v", err)
+		m.authMgr.DropTenantToken(server)
+		return
+	}
+	if err := m.authMgr.KeepTenantToken(server); err != nil {
+		log.Errorf("Could not store the new tenant token: %v", err)
+	}
+	log.Info("Authorized with the new tenant token")
+}
+
 func (m *mender) CheckScriptsCompatibility() error {
 	return m.stateScriptExecutor.CheckRootfsScriptsVersion()
 }
@@ -14,12 +14,17 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -93,6 +98,47 @@ func Test_getArtifactName_haveArtifactName_returnsName(t *testing.T) {
 	assert.Equal(t, "mender-image", artName)
 }
 
+func TestArtifactProvides(t *testing.T) {
+	mender := newDefaultTestMender()
+
+	artifactInfoFile, _ := os.Create("artifact_info")
+	defer os.Remove("artifact_info")
+	artifactInfoFile.WriteString("artifact_name=mender-image\nartifact_group=stable")
+	mender.artifactInfoFile = "artifact_info"
+
+	// Nothing committed yet; only the group is known.
+	provides, err := mender.GetProvides()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"artifact_group": "stable"}, provides)
+
+	err = mender.store.WriteTransaction(func(txn store.Transaction) error {
+		return commitArtifactProvides(txn, provides, map[string]string{
+			"artifact_name":            "release-2",
+			"rootfs-image.app.version": "2",
+		}, []string{"rootfs-image.app.*"})
+	})
+	require.NoError(t, err)
+
+	provides, err = mender.GetProvides()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"artifact_group":           "stable",
+		"rootfs-image.app.version": "2",
+	}, provides)
+	group, err := mender.GetCurrentArtifactGroup()
+	require.NoError(t, err)
+	assert.Equal(t, "stable", group)
+
+	// Artifacts installed without reading their provides leave them.
+	err = mender.store.WriteTransaction(func(txn store.Transaction) error {
+		return commitArtifactProvides(txn, nil, nil, nil)
+	})
+	require.NoError(t, err)
+	provides, err = mender.GetProvides()
+	require.NoError(t, err)
+	assert.Len(t, provides, 2)
+}
+
 func newTestMender(runner *stest.TestOSCalls, config menderConfig, pieces testMenderPieces) *mender {
 	// fill out missing pieces
 
@@ -115,6 +161,7 @@ func newTestMender(runner *stest.TestOSCalls, config menderConfig, pieces testMe
 			IdentitySource: &IdentityDataRunner{
 				cmdr: cmdr,
 			},
+			Servers: config.Servers,
 		})
 	}
 
@@ -313,6 +360,35 @@ func Test_CheckUpdateSimple(t *testing.T) {
 	up, err = mender.CheckUpdate()
 	assert.NoError(t, err)
 	assert.Nil(t, up)
+
+	// the artifact group is sent along with the other provides
+	ioutil.WriteFile(artifactInfo,
+		[]byte("artifact_name=fake-id\nartifact_group=tools"), 0600)
+	srv.Update.Has = true
+	up, err = mender.CheckUpdate()
+	assert.Error(t, err)
+	assert.Nil(t, up)
+
+	srv.Update.Current.Provides = map[string]string{"artifact_group": "tools"}
+	up, err = mender.CheckUpdate()
+	assert.NoError(t, err)
+	assert.NotNil(t, up)
+
+	// servers not supporting the v2 API get the v1 request, without provides
+	srv.Update.V1Only = true
+	srv.Update.Current.Provides = nil
+	up, err = mender.CheckUpdate()
+	assert.NoError(t, err)
+	assert.NotNil(t, up)
+
+	// deployments are deferred while rate limited
+	mender.config.DeploymentMaxPerDay = 1
+	assert.NoError(t, recordDeploymentCompletion(mender.store, time.Now()))
+	up, err = mender.CheckUpdate()
+	require.Error(t, err)
+	assert.False(t, err.IsFatal())
+	assert.Equal(t, errDeploymentDeferred, err.Cause())
+	assert.NotNil(t, up)
 }
 
 func TestMenderGetUpdatePollInterval(t *testing.T) {
@@ -337,6 +413,44 @@ func TestMenderGetInventoryPollInterval(t *testing.T) {
 	assert.Equal(t, time.Duration(10)*time.Second, intvl)
 }
 
+func TestMenderAwaitsConfirmation(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	oldReboot, oldCommit := rebootConfirmationFile, commitConfirmationFile
+	rebootConfirmationFile = path.Join(tdir, "confirm-reboot")
+	commitConfirmationFile = path.Join(tdir, "confirm-commit")
+	defer func() {
+		rebootConfirmationFile, commitConfirmationFile = oldReboot, oldCommit
+	}()
+
+	mender := newTestMender(nil, menderConfig{}, testMenderPieces{})
+	assert.False(t, mender.AwaitsConfirmation(deploymentRebootEnter))
+	assert.False(t, mender.AwaitsConfirmation(datastore.UpdateControlMapCommitEnter))
+
+	mender = newTestMender(nil, menderConfig{
+		menderConfigFromFile: menderConfigFromFile{
+			RebootConfirmationRequired: true,
+			CommitConfirmationRequired: true,
+		},
+	}, testMenderPieces{})
+	assert.True(t, mender.AwaitsConfirmation(deploymentRebootEnter))
+	assert.True(t, mender.AwaitsConfirmation(datastore.UpdateControlMapCommitEnter))
+	assert.False(t, mender.AwaitsConfirmation(datastore.UpdateControlMapInstallEnter))
+
+	// The flag files confirm once.
+	require.NoError(t, ioutil.WriteFile(rebootConfirmationFile, nil, 0600))
+	assert.True(t, mender.AwaitsConfirmation(datastore.UpdateControlMapCommitEnter))
+	assert.False(t, mender.AwaitsConfirmation(deploymentRebootEnter))
+	assert.True(t, mender.AwaitsConfirmation(deploymentRebootEnter))
+
+	require.NoError(t, ioutil.WriteFile(commitConfirmationFile, nil, 0600))
+	assert.False(t, mender.AwaitsConfirmation(datastore.UpdateControlMapCommitEnter))
+	_, err = os.Stat(commitConfirmationFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
 type testAuthDataMessenger struct {
 	reqData  []byte
 	sigData  []byte
@@ -346,7 +460,7 @@ type testAuthDataMessenger struct {
 	rspData  []byte
 }
 
-func (t *testAuthDataMessenger) MakeAuthRequest() (*client.AuthRequest, error) {
+func (t *testAuthDataMessenger) MakeAuthRequest(serverURL string) (*client.AuthRequest, error) {
 	return &client.AuthRequest{
 		Data:      t.reqData,
 		Token:     t.code,
@@ -360,11 +474,13 @@ func (t *testAuthDataMessenger) RecvAuthResponse(data []byte) error {
 }
 
 type testAuthManager struct {
-	authorized     bool
-	authtoken      client.AuthToken
-	authtokenErr   error
-	haskey         bool
-	generatekeyErr error
+	authorized       bool
+	authtoken        client.AuthToken
+	authtokenErr     error
+	haskey           bool
+	generatekeyErr   error
+	tenantToken      client.AuthToken
+	triedTenantToken client.AuthToken
 	testAuthDataMessenger
 }
 
@@ -388,6 +504,27 @@ func (a *testAuthManager) RemoveAuthToken() error {
 	return nil
 }
 
+func (a *testAuthManager) TenantToken(serverURL string) client.AuthToken {
+	if a.triedTenantToken != client.EmptyAuthToken {
+		return a.triedTenantToken
+	}
+	return a.tenantToken
+}
+
+func (a *testAuthManager) TryTenantToken(serverURL string, token client.AuthToken) {
+	a.triedTenantToken = token
+}
+
+func (a *testAuthManager) KeepTenantToken(serverURL string) error {
+	a.tenantToken = a.triedTenantToken
+	a.triedTenantToken = client.EmptyAuthToken
+	return nil
+}
+
+func (a *testAuthManager) DropTenantToken(serverURL string) {
+	a.triedTenantToken = client.EmptyAuthToken
+}
+
 func TestMenderAuthorize(t *testing.T) {
 	runner := stest.NewTestOSCalls("", -1)
 
@@ -508,6 +645,45 @@ func TestMenderReportStatus(t *testing.T) {
 	)
 	assert.Nil(t, err)
 	assert.Equal(t, client.StatusSuccess, srv.Status.Status)
+	assert.Equal(t, "", srv.Status.SubState)
+
+	// successful substate report
+	err = mender.ReportUpdateSubstate(
+		&datastore.UpdateInfo{
+			ID: "foobar",
+		},
+		client.StatusDownloading,
+		"downloading 42%",
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, client.StatusDownloading, srv.Status.Status)
+	assert.Equal(t, "downloading 42%", srv.Status.SubState)
+
+	// the same status is not reported twice
+	srv.Reset()
+	srv.Auth.Verify = true
+	srv.Auth.Token = []byte("tokendata")
+	err = mender.ReportUpdateStatus(
+		&datastore.UpdateInfo{
+			ID: "foobar",
+		},
+		client.StatusSuccess,
+	)
+	assert.Nil(t, err)
+	assert.False(t, srv.Status.Called)
+
+	// nor the same substate, or another one too soon
+	for _, substate := range []string{"downloading 42%", "downloading 43%"} {
+		err = mender.ReportUpdateSubstate(
+			&datastore.UpdateInfo{
+				ID: "foobar",
+			},
+			client.StatusDownloading,
+			substate,
+		)
+		assert.Nil(t, err)
+		assert.False(t, srv.Status.Called)
+	}
 
 	// 2. pretend authorization fails, server expects a different token
 	srv.Reset()
@@ -515,7 +691,7 @@ func TestMenderReportStatus(t *testing.T) {
 	srv.Auth.Verify = true
 	err = mender.ReportUpdateStatus(
 		&datastore.UpdateInfo{
-			ID: "foobar",
+			ID: "foobar-2",
 		},
 		client.StatusSuccess,
 	)
@@ -530,12 +706,20 @@ func TestMenderReportStatus(t *testing.T) {
 	srv.Status.Aborted = true
 	err = mender.ReportUpdateStatus(
 		&datastore.UpdateInfo{
-			ID: "foobar",
+			ID: "foobar-2",
 		},
 		client.StatusSuccess,
 	)
 	assert.NotNil(t, err)
 	assert.True(t, err.IsFatal())
+
+	// the unacknowledged terminal status is kept for a restart
+	record := loadStatusReportRecord(ms)
+	require.NotNil(t, record)
+	assert.Equal(t, statusReportRecord{
+		DeploymentID: "foobar-2",
+		Status:       client.StatusSuccess,
+	}, *record)
 }
 
 func TestMenderLogUpload(t *testing.T) {
@@ -626,8 +810,8 @@ func TestAuthToken(t *testing.T) {
 
 	ts.Update.Unauthorized = true
 	ts.Update.Current = client.CurrentUpdate{
-		"fake-id",
-		"foo-bar",
+		Artifact:   "fake-id",
+		DeviceType: "foo-bar",
 	}
 
 	td, _ := ioutil.TempDir("", "mender-install-update-")
@@ -648,6 +832,83 @@ func TestAuthToken(t *testing.T) {
 	assert.Empty(t, token)
 }
 
+func TestMenderTenantTokenRotation(t *testing.T) {
+	td, _ := ioutil.TempDir("", "mender-tenant-token-")
+	defer os.RemoveAll(td)
+	artifactInfo := path.Join(td, "artifact_info")
+	ioutil.WriteFile(artifactInfo, []byte("artifact_name=fake-id"), 0600)
+	deviceType := path.Join(td, "device_type")
+	ioutil.WriteFile(deviceType, []byte("device_type=foo-bar"), 0600)
+	// No inventory scripts.
+	oldDefaultPathDataDir := defaultPathDataDir
+	defaultPathDataDir = td
+	defer func() {
+		defaultPathDataDir = oldDefaultPathDataDir
+	}()
+
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	ms := store.NewMemStore()
+	mender := newTestMender(nil,
+		menderConfig{
+			menderConfigFromFile: menderConfigFromFile{
+				Servers: []client.MenderServer{
+					{ServerURL: srv.URL, TenantToken: "old-tenant"},
+				},
+			},
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				store: ms,
+			},
+		},
+	)
+	mender.artifactInfoFile = artifactInfo
+	mender.deviceTypeFile = deviceType
+	ms.WriteAll(datastore.AuthTokenName, []byte("tokendata"))
+	require.Nil(t, mender.Authorize())
+
+	enc := base64.RawURLEncoding
+	newTenant := enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." +
+		enc.EncodeToString([]byte(`{"mender.tenant":"new"}`)) + ".c2ln"
+
+	// The server accepts the new token.
+	srv.TenantToken.Token = []byte(newTenant)
+	srv.Auth.Authorize = true
+	srv.Auth.Token = []byte("newtokendata")
+	srv.Auth.TenantToken = []byte(newTenant)
+	assert.NoError(t, mender.InventoryRefresh())
+	assert.True(t, srv.TenantToken.Called)
+	assert.True(t, srv.Auth.Called)
+	assert.Equal(t, client.AuthToken(newTenant), mender.authMgr.TenantToken(srv.URL))
+	assert.Equal(t, client.AuthToken("newtokendata"), mender.authToken)
+	stored, err := ms.ReadAll(datastore.TenantTokensKey)
+	require.NoError(t, err)
+	assert.Contains(t, string(stored), newTenant)
+
+	// The server rejects the next one; the current one is kept, and the
+	// rejected one is never stored.
+	srv.Auth.Called = false
+	otherTenant := enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." +
+		enc.EncodeToString([]byte(`{"mender.tenant":"other"}`)) + ".c2ln"
+	srv.TenantToken.Token = []byte(otherTenant)
+	assert.NoError(t, mender.InventoryRefresh())
+	assert.True(t, srv.Auth.Called)
+	assert.Equal(t, client.AuthToken(newTenant), mender.authMgr.TenantToken(srv.URL))
+	stored, err = ms.ReadAll(datastore.TenantTokensKey)
+	require.NoError(t, err)
+	assert.Contains(t, string(stored), newTenant)
+	assert.NotContains(t, string(stored), otherTenant)
+
+	// Tokens which are not valid are not tried.
+	srv.Auth.Called = false
+	srv.TenantToken.Token = []byte("not-a-jwt")
+	assert.NoError(t, mender.InventoryRefresh())
+	assert.False(t, srv.Auth.Called)
+	assert.Equal(t, client.AuthToken(newTenant), mender.authMgr.TenantToken(srv.URL))
+}
+
 func TestMenderInventoryRefresh(t *testing.T) {
 	// create temp dir
 	td, _ := ioutil.TempDir("", "mender-install-update-")
@@ -668,6 +929,10 @@ func TestMenderInventoryRefresh(t *testing.T) {
 		menderConfig{
 			menderConfigFromFile: menderConfigFromFile{
 				Servers: []client.MenderServer{{ServerURL: srv.URL}},
+				InventoryAttributes: map[string]string{
+					"site":        "plant-7",
+					"device_type": "overridden",
+				},
 			},
 		},
 		testMenderPieces{
@@ -713,6 +978,8 @@ func TestMenderInventoryRefresh(t *testing.T) {
 		{Name: "device_type", Value: "foo-bar"},
 		{Name: "artifact_name", Value: "fake-id"},
 		{Name: "mender_client_version", Value: "unknown"},
+		{Name: "mender_boot_environment", Value: "u-boot"},
+		{Name: "site", Value: "plant-7"},
 	}
 	for _, a := range exp {
 		assert.Contains(t, srv.Inventory.Attrs, a)
@@ -735,10 +1002,13 @@ echo foo=bar`),
 		{Name: "artifact_name", Value: "fake-id"},
 		{Name: "mender_client_version", Value: "unknown"},
 		{Name: "foo", Value: "bar"},
+		{Name: "site", Value: "plant-7"},
 	}
 	for _, a := range exp {
 		assert.Contains(t, srv.Inventory.Attrs, a)
 	}
+	assert.NotContains(t, srv.Inventory.Attrs,
+		client.InventoryAttribute{Name: "device_type", Value: "overridden"})
 
 	// no artifact name should error
 	ioutil.WriteFile(artifactInfo, []byte(""), 0600)
@@ -846,6 +1116,118 @@ func MakeRootfsImageArtifact(version int, signed bool) (io.ReadCloser, error) {
 	return &rc{art}, nil
 }
 
+// Ways in which MakeCorruptedRootfsImageArtifact breaks an artifact.
+type artifactCorruption int
+
+const (
+	// The checksum of the payload in the manifest does not match.
+	corruptChecksum artifactCorruption = iota
+	// The artifact ends in the middle of the payload data.
+	corruptTruncated
+	// The version header has an unsupported version.
+	corruptVersion
+)
+
+// MakeCorruptedRootfsImageArtifact returns a rootfs-image artifact which is
+// deliberately broken, to test how installation failures are handled. Version
+// 1 artifacts have no manifest, so corruptChecksum needs version 2 or later.
+func MakeCorruptedRootfsImageArtifact(version int,
+	corruption artifactCorruption) (io.ReadCloser, error) {
+
+	art, err := MakeRootfsImageArtifact(version, false)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(art)
+	if err != nil {
+		return nil, err
+	}
+
+	switch corruption {
+	case corruptChecksum:
+		data, err = rewriteArtifact(data, "manifest", func(content []byte) []byte {
+			lines := strings.Split(string(content), "\n")
+			for n, line := range lines {
+				if strings.Contains(line, "data/") {
+					// Flip the first digit of the checksum.
+					if line[0] == '0' {
+						lines[n] = "1" + line[1:]
+					} else {
+						lines[n] = "0" + line[1:]
+					}
+				}
+			}
+			return []byte(strings.Join(lines, "\n"))
+		})
+	case corruptTruncated:
+		data, err = truncateArtifact(data, "data/0000.tar.gz")
+	case corruptVersion:
+		data, err = rewriteArtifact(data, "version", func([]byte) []byte {
+			return []byte(`{"format": "mender", "version": 42}`)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rc{bytes.NewBuffer(data)}, nil
+}
+
+// truncateArtifact cuts the artifact in the middle of the named file in its
+// outer tar archive.
+func truncateArtifact(data []byte, name string) ([]byte, error) {
+	r := bytes.NewReader(data)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.Errorf("%s not found in artifact", name)
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			// The reader is positioned at the start of the content.
+			start := len(data) - r.Len()
+			return data[:start+int(hdr.Size/2)], nil
+		}
+	}
+}
+
+// rewriteArtifact replaces the content of the named file in the outer tar
+// archive of the artifact.
+func rewriteArtifact(data []byte, name string,
+	rewrite func(content []byte) []byte) ([]byte, error) {
+
+	out := bytes.NewBuffer(nil)
+	tr := tar.NewReader(bytes.NewReader(data))
+	tw := tar.NewWriter(out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name {
+			content = rewrite(content)
+			hdr.Size = int64(len(content))
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err = tw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
 type mockReader struct {
 	mock.Mock
 }
@@ -1033,6 +1415,36 @@ func TestReauthorization(t *testing.T) {
 	assert.Error(t, err)
 }
 
+// TestReauthorizationKeepsToken checks that the current token is kept if the
+// server can not be reached, as reauthorization also happens before the token
+// expires, when it is still valid.
+func TestReauthorizationKeepsToken(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+	srv.Auth.Token = []byte(`foo`)
+	srv.Auth.Authorize = true
+
+	mender := newTestMender(nil,
+		menderConfig{
+			menderConfigFromFile: menderConfigFromFile{
+				Servers: []client.MenderServer{{ServerURL: srv.URL}},
+			},
+		},
+		testMenderPieces{})
+	assert.NoError(t, mender.Authorize())
+
+	_, err := reauthorize(mender)("http://127.0.0.1:1")
+	assert.Error(t, err)
+	assert.Equal(t, client.AuthToken("foo"), mender.authToken)
+	assert.True(t, mender.IsAuthorized())
+
+	srv.Auth.Token = []byte(`bar`)
+	token, err := reauthorize(mender)(srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, client.AuthToken("bar"), token)
+	assert.Equal(t, client.AuthToken("bar"), mender.authToken)
+}
+
 // TestFailbackServers tests the optional failover feature for which
 // a client can swap server if current server stops serving.
 //
@@ -1092,12 +1504,198 @@ func TestFailoverServers(t *testing.T) {
 	assert.True(t, srv1.Auth.Called)
 	assert.True(t, srv2.Auth.Called)
 
-	// Check for update: causes srv1 to return bad request (400) and trigger failover.
+	// Check for update: the request goes to srv2, which issued the
+	// token, first; srv1 is not contacted.
+	srv1.Auth.Called = false
 	rsp, err := mender.CheckUpdate()
 	assert.NoError(t, err)
-	// Both callbacks called, but only one returns 200
-	assert.True(t, srv1.Update.Called)
+	assert.False(t, srv1.Auth.Called)
+	assert.False(t, srv1.Update.Called)
 	assert.True(t, srv2.Update.Called)
 	assert.NotNil(t, rsp)
 	assert.Equal(t, rsp.ID, srv2.Update.Data.ID)
+	assert.True(t, mender.IsAuthorized())
+}
+
+func TestServerIterator(t *testing.T) {
+	servers := []client.MenderServer{
+		{ServerURL: "https://hosted.mender.io"},
+		{ServerURL: "https://onprem.example.com"},
+		{ServerURL: "https://backup.example.com"},
+	}
+	next := serverIterator(servers, "https://onprem.example.com")
+	for round := 0; round < 2; round++ {
+		var urls []string
+		for server := next(); server != nil; server = next() {
+			urls = append(urls, server.ServerURL)
+		}
+		assert.Equal(t, []string{"https://onprem.example.com",
+			"https://backup.example.com", "https://hosted.mender.io"}, urls)
+	}
+
+	assert.Equal(t, "https://hosted.mender.io", serverIterator(servers, "")().ServerURL)
+	assert.Nil(t, serverIterator(nil, ""))
+
+	// The requests go to the server which issued the token first.
+	mender := newTestMender(nil, menderConfig{
+		menderConfigFromFile: menderConfigFromFile{Servers: servers},
+	}, testMenderPieces{})
+	assert.Equal(t, "https://hosted.mender.io", mender.requestServer())
+	mender.authServer = "https://backup.example.com"
+	assert.Equal(t, "https://backup.example.com", mender.requestServer())
+	mender.authServer = "https://gone.example.com"
+	assert.Equal(t, "https://hosted.mender.io", mender.requestServer())
+}
+
+// TestFailoverServersAuthIsolation fails over from Hosted Mender to an on-prem
+// server, which have different tenant tokens and issue different API tokens.
+func TestFailoverServersAuthIsolation(t *testing.T) {
+	artifactInfoFile, _ := os.Create("artifact_info")
+	devInfoFile, _ := os.Create("device_type")
+	defer os.Remove("artifact_info")
+	defer os.Remove("device_type")
+	artifactInfoFile.WriteString("artifact_name=mender-image")
+	devInfoFile.WriteString("device_type=dev")
+
+	hosted := cltest.NewClientTestServer()
+	onprem := cltest.NewClientTestServer()
+	defer hosted.Close()
+	defer onprem.Close()
+	hosted.Auth.Authorize = true
+	hosted.Auth.Verify = true
+	hosted.Auth.Token = []byte("hosted-jwt")
+	hosted.Auth.TenantToken = []byte("hosted-tenant")
+	onprem.Auth.Authorize = true
+	onprem.Auth.Verify = true
+	onprem.Auth.Token = []byte("onprem-jwt")
+	onprem.Auth.TenantToken = []byte("onprem-tenant")
+	// Only the on-prem server knows the artifact of the device, Hosted
+	// Mender answers with 400.
+	onprem.Update.Current = client.CurrentUpdate{
+		Artifact:   "mender-image",
+		DeviceType: "dev",
+	}
+
+	ms := store.NewMemStore()
+	config := menderConfig{
+		menderConfigFromFile: menderConfigFromFile{
+			Servers: []client.MenderServer{
+				{ServerURL: hosted.URL, TenantToken: "hosted-tenant"},
+				{ServerURL: onprem.URL, TenantToken: "onprem-tenant"},
+			},
+		},
+	}
+	mender := newTestMender(nil, config, testMenderPieces{
+		MenderPieces: MenderPieces{store: ms},
+	})
+	mender.artifactInfoFile = "artifact_info"
+	mender.deviceTypeFile = "device_type"
+
+	require.NoError(t, mender.Authorize())
+	assert.True(t, hosted.Auth.Called)
+	assert.False(t, onprem.Auth.Called)
+	assert.Equal(t, client.AuthToken("hosted-jwt"), mender.authToken)
+
+	// Failing over authorizes with the on-prem server, using its tenant
+	// token, before the request is sent there.
+	_, err := mender.CheckUpdate()
+	require.NoError(t, err)
+	assert.True(t, hosted.Update.Called)
+	assert.True(t, onprem.Auth.Called)
+	assert.True(t, onprem.Update.Called)
+	assert.Equal(t, onprem.URL, mender.authServer)
+	assert.Equal(t, client.AuthToken("onprem-jwt"), mender.authToken)
+	data, rerr := ms.ReadAll(datastore.AuthServerKey)
+	require.NoError(t, rerr)
+	assert.Equal(t, onprem.URL, string(data))
+
+	// The server of the token is remembered across restarts.
+	restarted := newTestMender(nil, config, testMenderPieces{
+		MenderPieces: MenderPieces{store: ms},
+	})
+	assert.Equal(t, onprem.URL, restarted.authServer)
+
+	// Failing over back and forth uses the token each server issued,
+	// without authorizing again.
+	hosted.Auth.Called = false
+	onprem.Auth.Called = false
+	hosted.Update.Current, onprem.Update.Current = onprem.Update.Current, client.CurrentUpdate{}
+	_, err = mender.CheckUpdate()
+	require.NoError(t, err)
+	onprem.Update.Current, hosted.Update.Current = hosted.Update.Current, client.CurrentUpdate{}
+	_, err = mender.CheckUpdate()
+	require.NoError(t, err)
+	assert.False(t, hosted.Auth.Called)
+	assert.False(t, onprem.Auth.Called)
+	assert.Equal(t, client.AuthToken("onprem-jwt"), mender.authToken)
+
+	// Being rejected by Hosted Mender does not remove the token of the
+	// on-prem server.
+	hosted.Auth.Authorize = false
+	hosted.Update.Called = false
+	onprem.Update.Called = false
+	_, err = mender.CheckUpdate()
+	require.NoError(t, err)
+	assert.False(t, hosted.Update.Called)
+	assert.True(t, onprem.Update.Called)
+	assert.True(t, mender.IsAuthorized())
+	assert.Equal(t, client.AuthToken("onprem-jwt"), mender.authToken)
+}
+
+func TestWaitForUpdateNotification(t *testing.T) {
+	// Disabled in configuration.
+	mender := newTestMender(nil, menderConfig{
+		menderConfigFromFile: menderConfigFromFile{
+			Servers: []client.MenderServer{{ServerURL: "bogusurl"}},
+		},
+	}, testMenderPieces{})
+	pending, err := mender.WaitForUpdateNotification()
+	assert.False(t, pending)
+	require.Error(t, err)
+	assert.True(t, err.IsFatal())
+
+	// Server not reachable; worth retrying.
+	mender = newTestMender(nil, menderConfig{
+		menderConfigFromFile: menderConfigFromFile{
+			Servers:                          []client.MenderServer{{ServerURL: "bogusurl"}},
+			UpdateNotificationEnabled:        true,
+			UpdateNotificationTimeoutSeconds: 1,
+		},
+	}, testMenderPieces{})
+	mender.authToken = "tokendata"
+	pending, err = mender.WaitForUpdateNotification()
+	assert.False(t, pending)
+	require.Error(t, err)
+	assert.False(t, err.IsFatal())
+
+	// The client neither waits nor authorizes if it is not authorized,
+	// nor when the server rejects the token; authorizing is left to the
+	// state machine.
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	mender = newTestMender(nil, menderConfig{
+		menderConfigFromFile: menderConfigFromFile{
+			Servers:                   []client.MenderServer{{ServerURL: srv.URL}},
+			UpdateNotificationEnabled: true,
+		},
+	}, testMenderPieces{})
+	pending, err = mender.WaitForUpdateNotification()
+	assert.False(t, pending)
+	require.Error(t, err)
+	assert.False(t, err.IsFatal())
+	assert.Empty(t, paths)
+
+	mender.authToken = "tokendata"
+	pending, err = mender.WaitForUpdateNotification()
+	assert.False(t, pending)
+	require.Error(t, err)
+	assert.False(t, err.IsFatal())
+	assert.Equal(t, []string{
+		"/api/devices/v1/deployments/device/deployments/next/notify",
+	}, paths)
+	assert.Equal(t, client.AuthToken("tokendata"), mender.authToken)
 }
@@ -0,0 +1,61 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+// networkInterception is the last response which came from a captive portal,
+// or a proxy intercepting the connection, rather than from the server. It is
+// reported in the inventory once the device gets through, so that operators
+// can tell interception by the network from faults of the server.
+type networkInterception struct {
+	lock sync.Mutex
+	last time.Time
+	err  string
+}
+
+// note records err if it is an interception, and tells how to fix it.
+func (n *networkInterception) note(err error, now time.Time) {
+	if !client.IsInterceptedError(err) {
+		return
+	}
+	log.Warnf("The response did not come from the server, but from the "+
+		"network: %v. Check whether the network requires signing in to a "+
+		"captive portal, or blocks the server.", err)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.last = now
+	n.err = err.Error()
+}
+
+// attributes returns the inventory attributes of the last interception, if
+// any.
+func (n *networkInterception) attributes() []client.InventoryAttribute {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.last.IsZero() {
+		return nil
+	}
+	return []client.InventoryAttribute{
+		{Name: "network_intercepted_at", Value: n.last.UTC().Format(time.RFC3339)},
+		{Name: "network_interception", Value: n.err},
+	}
+}
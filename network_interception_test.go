@@ -0,0 +1,51 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkInterception(t *testing.T) {
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>Sign in</body></html>"))
+	}))
+	defer portal.Close()
+
+	var n networkInterception
+	assert.Nil(t, n.attributes())
+
+	n.note(errors.New("connection refused"), time.Now())
+	assert.Nil(t, n.attributes())
+
+	err := client.NewInventory().Submit(http.DefaultClient, portal.URL, nil)
+	require.True(t, client.IsInterceptedError(err))
+	now := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	n.note(err, now)
+	attrs := n.attributes()
+	require.Len(t, attrs, 2)
+	assert.Equal(t, "network_intercepted_at", attrs[0].Name)
+	assert.Equal(t, "2020-03-04T05:06:07Z", attrs[0].Value)
+	assert.Equal(t, "network_interception", attrs[1].Name)
+	assert.Contains(t, attrs[1].Value, "captive portal")
+}
@@ -0,0 +1,275 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/statescript"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+
+	log "github.com/mendersoftware/log"
+)
+
+// A deployment bundle carries a deployment to a device which can not reach the
+// server. It is a tar file with the bundle metadata as the first entry, and
+// the artifact as the second.
+const (
+	bundleFormatVersion = 1
+	bundleMetadataEntry = "bundle.json"
+	bundleArtifactEntry = "artifact.mender"
+)
+
+type bundleMetadata struct {
+	Version           int       `json:"version"`
+	DeploymentID      string    `json:"deployment_id"`
+	ArtifactName      string    `json:"artifact_name"`
+	CompatibleDevices []string  `json:"device_types_compatible"`
+	Created           time.Time `json:"created"`
+	// The statuses the device reports for the deployment when it
+	// succeeds; the last one is replaced with the failure status if it
+	// does not.
+	ExpectedStatuses []string `json:"expected_statuses"`
+}
+
+// offlineDeployment is the bundle deployment which is being installed, kept
+// under datastore.OfflineDeploymentKey until it is committed or rolled back.
+type offlineDeployment struct {
+	DeploymentID     string   `json:"deployment_id"`
+	ArtifactName     string   `json:"artifact_name"`
+	ExpectedStatuses []string `json:"expected_statuses"`
+}
+
+// doExportBundle writes a bundle with the artifact at artifactPath, for the
+// deployment with the given ID, to the file at out.
+func doExportBundle(artifactPath, deploymentID, out string, policy *installer.SignaturePolicy) error {
+	if deploymentID == "" {
+		return errors.New("a deployment ID is needed to export a deployment bundle")
+	}
+
+	art, err := os.Open(artifactPath)
+	if err != nil {
+		return errors.Wrapf(err, "can not open artifact %s", artifactPath)
+	}
+	defer art.Close()
+
+	summary, err := installer.InspectArtifact(art, policy)
+	if err != nil {
+		return err
+	}
+	if summary.SignatureError != nil {
+		return errors.Wrap(summary.SignatureError, "can not export artifact")
+	}
+	if _, err = art.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	info, err := art.Stat()
+	if err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(bundleMetadata{
+		Version:           bundleFormatVersion,
+		DeploymentID:      deploymentID,
+		ArtifactName:      summary.Name,
+		CompatibleDevices: summary.CompatibleDevices,
+		Created:           time.Now().UTC(),
+		ExpectedStatuses:  []string{client.StatusInstalling, client.StatusSuccess},
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "can not create deployment bundle %s", out)
+	}
+	tw := tar.NewWriter(f)
+	err = writeBundleEntry(tw, bundleMetadataEntry, int64(len(meta)), bytes.NewReader(meta))
+	if err == nil {
+		err = writeBundleEntry(tw, bundleArtifactEntry, info.Size(), art)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return errors.Wrapf(err, "can not write deployment bundle %s", out)
+	}
+	return nil
+}
+
+func writeBundleEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, r, size)
+	return err
+}
+
+// openBundle reads the metadata of the bundle at path, and returns it together
+// with the artifact in the bundle.
+func openBundle(path string) (*bundleMetadata, io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "can not open deployment bundle %s", path)
+	}
+	meta, art, err := readBundle(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.Wrapf(err, "invalid deployment bundle %s", path)
+	}
+	return meta, &bundleArtifact{Reader: art, f: f}, nil
+}
+
+func readBundle(r io.Reader) (*bundleMetadata, io.Reader, error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.Name != bundleMetadataEntry {
+		return nil, nil, errors.Errorf("expected %s, found %s", bundleMetadataEntry, hdr.Name)
+	}
+	var meta bundleMetadata
+	if err = json.NewDecoder(tr).Decode(&meta); err != nil {
+		return nil, nil, errors.Wrap(err, "can not parse bundle metadata")
+	}
+	if meta.Version != bundleFormatVersion {
+		return nil, nil, errors.Errorf("unsupported bundle version %d", meta.Version)
+	}
+	if meta.DeploymentID == "" {
+		return nil, nil, errors.New("bundle has no deployment ID")
+	}
+	if len(meta.ExpectedStatuses) == 0 {
+		meta.ExpectedStatuses = []string{client.StatusSuccess}
+	}
+
+	hdr, err = tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.Name != bundleArtifactEntry {
+		return nil, nil, errors.Errorf("expected %s, found %s", bundleArtifactEntry, hdr.Name)
+	}
+	return &meta, tr, nil
+}
+
+type bundleArtifact struct {
+	io.Reader
+	f *os.File
+}
+
+func (b *bundleArtifact) Close() error {
+	return b.f.Close()
+}
+
+// doInstallBundle installs the artifact in the bundle at path, the same way
+// as -install does, and writes a receipt with the outcome once the deployment
+// is finished. If the artifact needs to be committed, the receipt is written by
+// -commit or -rollback.
+func doInstallBundle(device *deviceManager, path string, policy *installer.SignaturePolicy,
+	stateExec statescript.Executor, receipts *receiptWriter) error {
+
+	meta, art, err := openBundle(path)
+	if err != nil {
+		return err
+	}
+	defer art.Close()
+
+	fmt.Printf("Installing deployment %s (Artifact %s) from bundle\n",
+		meta.DeploymentID, meta.ArtifactName)
+
+	deployment := offlineDeployment{
+		DeploymentID:     meta.DeploymentID,
+		ArtifactName:     meta.ArtifactName,
+		ExpectedStatuses: meta.ExpectedStatuses,
+	}
+	if err = storeOfflineDeployment(device.store, &deployment); err != nil {
+		return errors.Wrap(err, "can not store the bundle deployment")
+	}
+
+	err = doStandaloneInstallStates(art, policy, device, stateExec)
+
+	// If the artifact is waiting to be committed, the deployment is
+	// finished by -commit or -rollback.
+	if _, serr := device.store.ReadAll(datastore.StandaloneStateKey); serr == nil {
+		return err
+	}
+	if ferr := finishOfflineDeployment(device.store, receipts, err == nil); ferr != nil {
+		log.Errorf("Could not write the deployment receipt: %s", ferr.Error())
+		if err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+func storeOfflineDeployment(s store.Store, deployment *offlineDeployment) error {
+	data, err := json.Marshal(deployment)
+	if err != nil {
+		return err
+	}
+	return s.WriteAll(datastore.OfflineDeploymentKey, data)
+}
+
+// finishOfflineDeployment writes the receipt for the bundle deployment in
+// progress, if there is one, and forgets about the deployment.
+func finishOfflineDeployment(s store.Store, receipts *receiptWriter, success bool) error {
+	data, err := s.ReadAll(datastore.OfflineDeploymentKey)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var deployment offlineDeployment
+	if err = json.Unmarshal(data, &deployment); err != nil {
+		return errors.Wrap(err, "can not parse the bundle deployment")
+	}
+
+	statuses := append([]string{}, deployment.ExpectedStatuses...)
+	if !success {
+		statuses[len(statuses)-1] = client.StatusFailure
+	}
+	err = receipts.Write(&offlineReceipt{
+		DeploymentID: deployment.DeploymentID,
+		ArtifactName: deployment.ArtifactName,
+		Statuses:     statuses,
+		Finished:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return s.Remove(datastore.OfflineDeploymentKey)
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupBundleTest(t *testing.T, tmpdir string, attr *testModuleAttr) (*deviceManager, *receiptWriter) {
+	updateModulesSetup(t, attr, tmpdir)
+
+	config := menderConfig{
+		menderConfigFromFile: menderConfigFromFile{
+			ModuleTimeoutSeconds: 5,
+		},
+		ModulesPath:         path.Join(tmpdir, "modules"),
+		ModulesWorkPath:     path.Join(tmpdir, "work"),
+		ArtifactScriptsPath: path.Join(tmpdir, "scripts"),
+		RootfsScriptsPath:   path.Join(tmpdir, "scriptdir"),
+	}
+	dbstorePath := path.Join(tmpdir, "store")
+	require.NoError(t, os.MkdirAll(dbstorePath, 0755))
+	device := NewDeviceManager(nil, &config, store.NewDBStore(dbstorePath))
+	device.deviceTypeFile = path.Join(tmpdir, "device_type")
+	device.artifactInfoFile = path.Join(tmpdir, "artifact_info")
+
+	keys := store.NewKeystore(store.NewDirStore(tmpdir), "mender-agent.pem")
+	return device, newReceiptWriter(tmpdir, keys)
+}
+
+func readTestReceipt(t *testing.T, receipts *receiptWriter, deploymentID string) *offlineReceipt {
+	receipt, err := readReceipt(path.Join(receipts.dir, receiptFileName(deploymentID)),
+		receipts.keys)
+	require.NoError(t, err)
+	return receipt
+}
+
+func TestExportBundle(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestExportBundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	updateModulesSetup(t, &testModuleAttr{}, tmpdir)
+	artPath := path.Join(tmpdir, "artifact.mender")
+	bundlePath := path.Join(tmpdir, "bundle.tar")
+
+	err = doExportBundle(artPath, "", bundlePath, nil)
+	assert.EqualError(t, err, "a deployment ID is needed to export a deployment bundle")
+
+	require.NoError(t, doExportBundle(artPath, "deployment-1", bundlePath, nil))
+
+	meta, art, err := openBundle(bundlePath)
+	require.NoError(t, err)
+	defer art.Close()
+	assert.Equal(t, bundleFormatVersion, meta.Version)
+	assert.Equal(t, "deployment-1", meta.DeploymentID)
+	assert.Equal(t, "artifact-name", meta.ArtifactName)
+	assert.Equal(t, []string{"test-device"}, meta.CompatibleDevices)
+	assert.Equal(t, []string{client.StatusInstalling, client.StatusSuccess}, meta.ExpectedStatuses)
+
+	original, err := ioutil.ReadFile(artPath)
+	require.NoError(t, err)
+	bundled, err := ioutil.ReadAll(art)
+	require.NoError(t, err)
+	assert.Equal(t, original, bundled)
+}
+
+func TestOpenBundleInvalid(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestOpenBundleInvalid")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	writeBundle := func(name string, meta interface{}) string {
+		data, err := json.Marshal(meta)
+		require.NoError(t, err)
+		bundlePath := path.Join(tmpdir, name)
+		f, err := os.Create(bundlePath)
+		require.NoError(t, err)
+		defer f.Close()
+		tw := tar.NewWriter(f)
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: bundleMetadataEntry, Mode: 0644, Size: int64(len(data)),
+		}))
+		_, err = tw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+		return bundlePath
+	}
+
+	_, _, err = openBundle(path.Join(tmpdir, "missing.tar"))
+	assert.Error(t, err)
+
+	_, _, err = openBundle(writeBundle("version.tar", bundleMetadata{
+		Version:      2,
+		DeploymentID: "deployment-1",
+	}))
+	assert.Contains(t, err.Error(), "unsupported bundle version 2")
+
+	_, _, err = openBundle(writeBundle("noid.tar", bundleMetadata{
+		Version: bundleFormatVersion,
+	}))
+	assert.Contains(t, err.Error(), "bundle has no deployment ID")
+
+	_, _, err = openBundle(writeBundle("noartifact.tar", bundleMetadata{
+		Version:      bundleFormatVersion,
+		DeploymentID: "deployment-1",
+	}))
+	assert.Error(t, err)
+}
+
+func TestInstallBundle(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestInstallBundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	// Without rollback support the artifact is committed right away, and
+	// the receipt is written by the install.
+	device, receipts := setupBundleTest(t, tmpdir, &testModuleAttr{rollbackDisabled: true})
+	bundlePath := path.Join(tmpdir, "bundle.tar")
+	require.NoError(t, doExportBundle(path.Join(tmpdir, "artifact.mender"), "deployment-1",
+		bundlePath, nil))
+
+	stateExec := newStateScriptExecutor(&device.config)
+	require.NoError(t, doInstallBundle(device, bundlePath, nil, stateExec, receipts))
+
+	receipt := readTestReceipt(t, receipts, "deployment-1")
+	assert.Equal(t, "deployment-1", receipt.DeploymentID)
+	assert.Equal(t, "artifact-name", receipt.ArtifactName)
+	assert.Equal(t, []string{client.StatusInstalling, client.StatusSuccess}, receipt.Statuses)
+
+	_, err = device.store.ReadAll(datastore.OfflineDeploymentKey)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInstallBundleCommitAndRollback(t *testing.T) {
+	for _, commit := range []bool{true, false} {
+		tmpdir, err := ioutil.TempDir("", "TestInstallBundleCommitAndRollback")
+		require.NoError(t, err)
+		defer os.RemoveAll(tmpdir)
+
+		device, receipts := setupBundleTest(t, tmpdir, &testModuleAttr{})
+		bundlePath := path.Join(tmpdir, "bundle.tar")
+		require.NoError(t, doExportBundle(path.Join(tmpdir, "artifact.mender"), "deployment-1",
+			bundlePath, nil))
+
+		stateExec := newStateScriptExecutor(&device.config)
+		require.NoError(t, doInstallBundle(device, bundlePath, nil, stateExec, receipts))
+
+		// Waiting for commit; no receipt yet.
+		_, err = os.Stat(path.Join(receipts.dir, receiptFileName("deployment-1")))
+		assert.True(t, os.IsNotExist(err))
+		_, err = device.store.ReadAll(datastore.OfflineDeploymentKey)
+		require.NoError(t, err)
+
+		expected := []string{client.StatusInstalling, client.StatusSuccess}
+		if commit {
+			require.NoError(t, doStandaloneCommit(device, stateExec))
+			require.NoError(t, finishOfflineDeployment(device.store, receipts, true))
+		} else {
+			require.NoError(t, doStandaloneRollback(device, stateExec))
+			require.NoError(t, finishOfflineDeployment(device.store, receipts, false))
+			expected = []string{client.StatusInstalling, client.StatusFailure}
+		}
+
+		receipt := readTestReceipt(t, receipts, "deployment-1")
+		assert.Equal(t, expected, receipt.Statuses)
+
+		_, err = device.store.ReadAll(datastore.OfflineDeploymentKey)
+		assert.True(t, os.IsNotExist(err))
+
+		// Nothing left to finish.
+		require.NoError(t, finishOfflineDeployment(device.store, receipts, true))
+		device.store.Close()
+	}
+}
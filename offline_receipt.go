@@ -0,0 +1,208 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+
+	log "github.com/mendersoftware/log"
+)
+
+// Receipts of bundle deployments are kept in this directory, below the data
+// directory, until they are uploaded.
+const offlineReceiptsDir = "offline-receipts"
+
+// offlineReceipt is the outcome of a bundle deployment. The signed receipt is
+// uploaded to the server, and the statuses reported, in order, after it.
+type offlineReceipt struct {
+	DeploymentID string    `json:"deployment_id"`
+	ArtifactName string    `json:"artifact_name"`
+	Statuses     []string  `json:"statuses"`
+	Finished     time.Time `json:"finished"`
+}
+
+// signedReceipt is the receipt as stored on disk, signed with the device key
+// the same way as authorization requests are.
+type signedReceipt struct {
+	Receipt   json.RawMessage `json:"receipt"`
+	Signature []byte          `json:"signature"`
+}
+
+type receiptWriter struct {
+	dir  string
+	keys *store.Keystore
+}
+
+func newReceiptWriter(dataStore string, keys *store.Keystore) *receiptWriter {
+	return &receiptWriter{
+		dir:  path.Join(dataStore, offlineReceiptsDir),
+		keys: keys,
+	}
+}
+
+// Write signs the receipt and stores it, replacing any earlier receipt for the
+// same deployment.
+func (w *receiptWriter) Write(receipt *offlineReceipt) error {
+	if err := w.loadKey(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	sig, err := w.keys.Sign(data)
+	if err != nil {
+		return errors.Wrap(err, "can not sign the deployment receipt")
+	}
+	signed, err := json.Marshal(signedReceipt{Receipt: data, Signature: sig})
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(w.dir, 0700); err != nil {
+		return err
+	}
+	name := path.Join(w.dir, receiptFileName(receipt.DeploymentID))
+	if err = ioutil.WriteFile(name+".tmp", signed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// loadKey loads the device key, generating it if the device has never been
+// bootstrapped; it is the same key which is later used to authorize with the
+// server.
+func (w *receiptWriter) loadKey() error {
+	if w.keys.HasKey() {
+		return nil
+	}
+	err := w.keys.Load()
+	if err == nil {
+		return nil
+	} else if !store.IsNoKeys(err) {
+		return errors.Wrap(err, "failed to load device keys")
+	}
+	if err = w.keys.Generate(); err != nil {
+		return errors.Wrap(err, "failed to generate device key")
+	}
+	return errors.Wrap(w.keys.Save(), "failed to save device key")
+}
+
+func receiptFileName(deploymentID string) string {
+	// Deployment IDs are UUIDs, but make sure that whatever is in the
+	// bundle stays inside the receipt directory.
+	return filepath.Base(deploymentID) + ".json"
+}
+
+// readReceipt reads the receipt at path, and checks that it is signed with
+// the given key.
+func readReceipt(path string, keys *store.Keystore) (*offlineReceipt, error) {
+	receipt, _, err := readSignedReceipt(path, keys)
+	return receipt, err
+}
+
+// readSignedReceipt reads the receipt at path, as readReceipt does, and also
+// returns the signed receipt as stored.
+func readSignedReceipt(path string, keys *store.Keystore) (*offlineReceipt, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var signed signedReceipt
+	if err = json.Unmarshal(data, &signed); err != nil {
+		return nil, nil, errors.Wrapf(err, "can not parse receipt %s", path)
+	}
+
+	if err = keys.Verify(signed.Receipt, signed.Signature); err != nil {
+		return nil, nil, errors.Wrapf(err, "receipt %s is not signed by this device", path)
+	}
+
+	var receipt offlineReceipt
+	if err = json.Unmarshal(signed.Receipt, &receipt); err != nil {
+		return nil, nil, errors.Wrapf(err, "can not parse receipt %s", path)
+	}
+	return &receipt, data, nil
+}
+
+type receiptReporter interface {
+	UploadReceipt(deploymentID string, receipt []byte) menderError
+	ReportUpdateStatus(update *datastore.UpdateInfo, status string) menderError
+}
+
+// Upload uploads all the stored receipts, signed, to the server, followed by
+// the statuses of each, and removes the receipts which have been uploaded.
+// Receipts which can not be verified are left in place. It returns the number
+// of receipts uploaded.
+func (w *receiptWriter) Upload(reporter receiptReporter) (int, error) {
+	if err := w.loadKey(); err != nil {
+		return 0, err
+	}
+	names, err := filepath.Glob(path.Join(w.dir, "*.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	var uploaded int
+	for _, name := range names {
+		receipt, signed, err := readSignedReceipt(name, w.keys)
+		if err != nil {
+			log.Errorf("Skipping deployment receipt: %s", err.Error())
+			continue
+		}
+		if err = uploadReceipt(reporter, receipt, signed); err != nil {
+			return uploaded, err
+		}
+		if err = os.Remove(name); err != nil {
+			return uploaded, err
+		}
+		log.Infof("Uploaded the receipt of deployment %s", receipt.DeploymentID)
+		uploaded++
+	}
+	return uploaded, nil
+}
+
+// uploadReceipt uploads the signed receipt, and then reports its statuses. A
+// receipt the server rejects, typically because the deployment has been
+// aborted, is as good as uploaded; there is no point in keeping it.
+func uploadReceipt(reporter receiptReporter, receipt *offlineReceipt, signed []byte) error {
+	rejected := func(merr menderError) error {
+		if !merr.IsFatal() {
+			return errors.Wrapf(merr.Cause(),
+				"failed to upload the receipt of deployment %s", receipt.DeploymentID)
+		}
+		log.Warnf("Server rejected the receipt of deployment %s: %s",
+			receipt.DeploymentID, merr.Error())
+		return nil
+	}
+
+	if merr := reporter.UploadReceipt(receipt.DeploymentID, signed); merr != nil {
+		return rejected(merr)
+	}
+	update := &datastore.UpdateInfo{ID: receipt.DeploymentID}
+	for _, status := range receipt.Statuses {
+		if merr := reporter.ReportUpdateStatus(update, status); merr != nil {
+			return rejected(merr)
+		}
+	}
+	return nil
+}
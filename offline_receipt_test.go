@@ -0,0 +1,196 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeReceiptReporter struct {
+	receipts   map[string][]byte
+	reported   []string
+	err        map[string]menderError
+	receiptErr map[string]menderError
+}
+
+func (f *fakeReceiptReporter) UploadReceipt(deploymentID string, receipt []byte) menderError {
+	if err := f.receiptErr[deploymentID]; err != nil {
+		return err
+	}
+	if f.receipts == nil {
+		f.receipts = make(map[string][]byte)
+	}
+	f.receipts[deploymentID] = receipt
+	return nil
+}
+
+func (f *fakeReceiptReporter) ReportUpdateStatus(update *datastore.UpdateInfo, status string) menderError {
+	if err := f.err[update.ID]; err != nil {
+		return err
+	}
+	f.reported = append(f.reported, update.ID+":"+status)
+	return nil
+}
+
+func TestReceiptWriteAndRead(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestReceiptWriteAndRead")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	keys := store.NewKeystore(store.NewDirStore(tmpdir), "mender-agent.pem")
+	w := newReceiptWriter(tmpdir, keys)
+
+	receipt := offlineReceipt{
+		DeploymentID: "deployment-1",
+		ArtifactName: "artifact-name",
+		Statuses:     []string{client.StatusInstalling, client.StatusSuccess},
+		Finished:     time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC),
+	}
+	require.NoError(t, w.Write(&receipt))
+
+	// The device key is generated if there is none, and saved.
+	_, err = os.Stat(path.Join(tmpdir, "mender-agent.pem"))
+	assert.NoError(t, err)
+
+	name := path.Join(tmpdir, offlineReceiptsDir, "deployment-1.json")
+	read, err := readReceipt(name, keys)
+	require.NoError(t, err)
+	assert.Equal(t, receipt, *read)
+
+	// Tampering with the receipt breaks the signature.
+	data, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	var signed signedReceipt
+	require.NoError(t, json.Unmarshal(data, &signed))
+	receipt.Statuses = []string{client.StatusSuccess}
+	signed.Receipt, err = json.Marshal(receipt)
+	require.NoError(t, err)
+	data, err = json.Marshal(signed)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(name, data, 0600))
+
+	_, err = readReceipt(name, keys)
+	assert.Contains(t, err.Error(), "is not signed by this device")
+
+	// So does signing with another key.
+	other := store.NewKeystore(store.NewDirStore(tmpdir), "other.pem")
+	require.NoError(t, other.Generate())
+	require.NoError(t, newReceiptWriter(tmpdir, other).Write(&receipt))
+	_, err = readReceipt(name, keys)
+	assert.Contains(t, err.Error(), "is not signed by this device")
+}
+
+func TestReceiptFileName(t *testing.T) {
+	assert.Equal(t, "deployment-1.json", receiptFileName("deployment-1"))
+	assert.Equal(t, "passwd.json", receiptFileName("../../etc/passwd"))
+}
+
+func TestReceiptUpload(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestReceiptUpload")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	keys := store.NewKeystore(store.NewDirStore(tmpdir), "mender-agent.pem")
+	w := newReceiptWriter(tmpdir, keys)
+
+	for _, id := range []string{"aborted", "rejected", "failed", "succeeded"} {
+		status := client.StatusSuccess
+		if id == "failed" {
+			status = client.StatusFailure
+		}
+		require.NoError(t, w.Write(&offlineReceipt{
+			DeploymentID: id,
+			ArtifactName: "artifact-name",
+			Statuses:     []string{client.StatusInstalling, status},
+		}))
+	}
+	// Receipts which do not verify are skipped and left in place.
+	bogus := path.Join(w.dir, "bogus.json")
+	require.NoError(t, ioutil.WriteFile(bogus, []byte("{}"), 0600))
+
+	reporter := &fakeReceiptReporter{
+		err: map[string]menderError{
+			"aborted": NewFatalError(client.ErrDeploymentAborted),
+		},
+		receiptErr: map[string]menderError{
+			"rejected": NewFatalError(client.ErrDeploymentAborted),
+		},
+	}
+	n, err := w.Upload(reporter)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	// The receipts are uploaded as signed on the device.
+	assert.Len(t, reporter.receipts, 3)
+	for _, id := range []string{"aborted", "failed", "succeeded"} {
+		var signed signedReceipt
+		require.NoError(t, json.Unmarshal(reporter.receipts[id], &signed), id)
+		assert.NoError(t, keys.Verify(signed.Receipt, signed.Signature), id)
+		var receipt offlineReceipt
+		require.NoError(t, json.Unmarshal(signed.Receipt, &receipt), id)
+		assert.Equal(t, id, receipt.DeploymentID)
+	}
+	assert.Equal(t, []string{
+		"failed:" + client.StatusInstalling,
+		"failed:" + client.StatusFailure,
+		"succeeded:" + client.StatusInstalling,
+		"succeeded:" + client.StatusSuccess,
+	}, reporter.reported)
+
+	names, err := ioutil.ReadDir(w.dir)
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+	assert.Equal(t, "bogus.json", names[0].Name())
+	require.NoError(t, os.Remove(bogus))
+
+	// A transient error stops the upload, and keeps the receipt.
+	require.NoError(t, w.Write(&offlineReceipt{
+		DeploymentID: "offline",
+		Statuses:     []string{client.StatusSuccess},
+	}))
+	reporter = &fakeReceiptReporter{
+		err: map[string]menderError{
+			"offline": NewTransientError(errors.New("connection refused")),
+		},
+	}
+	n, err = w.Upload(reporter)
+	assert.Equal(t, 0, n)
+	assert.Contains(t, err.Error(), "failed to upload the receipt of deployment offline")
+	_, err = os.Stat(path.Join(w.dir, "offline.json"))
+	assert.NoError(t, err)
+
+	reporter = &fakeReceiptReporter{
+		receiptErr: map[string]menderError{
+			"offline": NewTransientError(errors.New("connection refused")),
+		},
+	}
+	n, err = w.Upload(reporter)
+	assert.Equal(t, 0, n)
+	assert.Contains(t, err.Error(), "failed to upload the receipt of deployment offline")
+	assert.Empty(t, reporter.reported)
+	_, err = os.Stat(path.Join(w.dir, "offline.json"))
+	assert.NoError(t, err)
+}
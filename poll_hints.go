@@ -0,0 +1,82 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+)
+
+// Bounds of the poll intervals the server can set through hints, so that a
+// misbehaving server can neither make the fleet flood it, nor silence it for
+// days. The time to live of the hints is capped the same way.
+const (
+	minPollHintInterval = time.Minute
+	maxPollHintInterval = 24 * time.Hour
+)
+
+// pollHints are the poll intervals most recently suggested by the server,
+// which override the configured ones until they expire.
+type pollHints struct {
+	lock    sync.Mutex
+	hints   client.PollHints
+	expires time.Time
+}
+
+func clampPollHint(d time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return 0
+	case d < minPollHintInterval:
+		return minPollHintInterval
+	case d > maxPollHintInterval:
+		return maxPollHintInterval
+	}
+	return d
+}
+
+// set replaces the current hints with the ones given, if any.
+func (p *pollHints) set(hints *client.PollHints, now time.Time) {
+	if hints == nil {
+		return
+	}
+	clamped := client.PollHints{
+		UpdatePollInterval:    clampPollHint(hints.UpdatePollInterval),
+		InventoryPollInterval: clampPollHint(hints.InventoryPollInterval),
+		TTL:                   clampPollHint(hints.TTL),
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.hints != clamped || now.After(p.expires) {
+		log.Infof("Poll interval hints from the server: update %v, inventory %v, for %v",
+			clamped.UpdatePollInterval, clamped.InventoryPollInterval, clamped.TTL)
+	}
+	p.hints = clamped
+	p.expires = now.Add(clamped.TTL)
+}
+
+// get returns the hinted update and inventory poll intervals, which are zero
+// if they are not hinted, or the hints have expired.
+func (p *pollHints) get(now time.Time) (update, inventory time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !now.Before(p.expires) {
+		return 0, 0
+	}
+	return p.hints.UpdatePollInterval, p.hints.InventoryPollInterval
+}
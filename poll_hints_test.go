@@ -0,0 +1,123 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pollHintsUpdater struct {
+	hints *client.PollHints
+}
+
+func (u *pollHintsUpdater) GetScheduledUpdate(api client.ApiRequester, server string,
+	current client.CurrentUpdate) (interface{}, error) {
+	return nil, nil
+}
+
+func (u *pollHintsUpdater) FetchUpdate(api client.ApiRequester, url string,
+	maxWait time.Duration) (io.ReadCloser, int64, error) {
+	return nil, 0, nil
+}
+
+func (u *pollHintsUpdater) PollHints() *client.PollHints {
+	return u.hints
+}
+
+func TestPollHints(t *testing.T) {
+	var p pollHints
+	now := time.Now()
+
+	update, inventory := p.get(now)
+	assert.Zero(t, update)
+	assert.Zero(t, inventory)
+
+	p.set(&client.PollHints{
+		UpdatePollInterval:    5 * time.Minute,
+		InventoryPollInterval: time.Hour,
+		TTL:                   10 * time.Minute,
+	}, now)
+	update, inventory = p.get(now.Add(time.Minute))
+	assert.Equal(t, 5*time.Minute, update)
+	assert.Equal(t, time.Hour, inventory)
+
+	// No hints in a response leave the current ones in place.
+	p.set(nil, now.Add(time.Minute))
+	update, _ = p.get(now.Add(2 * time.Minute))
+	assert.Equal(t, 5*time.Minute, update)
+
+	// Hints expire.
+	update, inventory = p.get(now.Add(10 * time.Minute))
+	assert.Zero(t, update)
+	assert.Zero(t, inventory)
+
+	// Hints are kept within bounds.
+	p.set(&client.PollHints{
+		UpdatePollInterval: time.Second,
+		TTL:                30 * 24 * time.Hour,
+	}, now)
+	update, inventory = p.get(now.Add(23 * time.Hour))
+	assert.Equal(t, minPollHintInterval, update)
+	assert.Zero(t, inventory)
+	update, _ = p.get(now.Add(maxPollHintInterval))
+	assert.Zero(t, update)
+
+	p.set(&client.PollHints{
+		InventoryPollInterval: 30 * 24 * time.Hour,
+		TTL:                   time.Hour,
+	}, now)
+	_, inventory = p.get(now)
+	assert.Equal(t, maxPollHintInterval, inventory)
+}
+
+func TestMenderPollHints(t *testing.T) {
+	td, err := ioutil.TempDir("", "TestMenderPollHints")
+	require.NoError(t, err)
+	defer os.RemoveAll(td)
+
+	m := newTestMender(nil, menderConfig{
+		menderConfigFromFile: menderConfigFromFile{
+			Servers:                      []client.MenderServer{{ServerURL: "https://not-used"}},
+			UpdatePollIntervalSeconds:    1800,
+			InventoryPollIntervalSeconds: 3600,
+		},
+	}, testMenderPieces{})
+	m.artifactInfoFile = path.Join(td, "artifact_info")
+	require.NoError(t, ioutil.WriteFile(m.artifactInfoFile, []byte("artifact_name=release-1\n"), 0644))
+	updater := &pollHintsUpdater{}
+	m.updater = updater
+
+	_, merr := m.CheckUpdate()
+	assert.Nil(t, merr)
+	assert.Equal(t, 30*time.Minute, m.GetUpdatePollInterval())
+	assert.Equal(t, time.Hour, m.GetInventoryPollInterval())
+
+	updater.hints = &client.PollHints{
+		UpdatePollInterval: 4 * time.Hour,
+		TTL:                time.Hour,
+	}
+	_, merr = m.CheckUpdate()
+	assert.Nil(t, merr)
+	assert.Equal(t, 4*time.Hour, m.GetUpdatePollInterval())
+	assert.Equal(t, time.Hour, m.GetInventoryPollInterval())
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var pollJitterRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{
+	Rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+}
+
+// randomDuration returns a random duration in [0, max], so that devices
+// sharing a configuration spread their requests to the server over time.
+var randomDuration = func(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	pollJitterRand.Lock()
+	defer pollJitterRand.Unlock()
+	return time.Duration(pollJitterRand.Int63n(int64(max) + 1))
+}
+
+// jitterPollInterval randomizes the poll interval by up to percent of it,
+// either way.
+func jitterPollInterval(intvl time.Duration, percent int) time.Duration {
+	if percent <= 0 {
+		return intvl
+	}
+	spread := intvl / 100 * time.Duration(percent)
+	return intvl - spread + randomDuration(2*spread)
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJitterPollInterval(t *testing.T) {
+	assert.Equal(t, time.Minute, jitterPollInterval(time.Minute, 0))
+
+	for i := 0; i < 100; i++ {
+		intvl := jitterPollInterval(time.Minute, 10)
+		assert.True(t, intvl >= 54*time.Second, intvl)
+		assert.True(t, intvl <= 66*time.Second, intvl)
+	}
+
+	mender := newTestMender(nil, menderConfig{
+		menderConfigFromFile: menderConfigFromFile{
+			UpdatePollIntervalSeconds: 100,
+			PollIntervalJitterPercent: 50,
+		},
+	}, testMenderPieces{})
+	for i := 0; i < 100; i++ {
+		intvl := mender.GetUpdatePollInterval()
+		assert.True(t, intvl >= 50*time.Second, intvl)
+		assert.True(t, intvl <= 150*time.Second, intvl)
+	}
+}
+
+func TestCheckWaitStateSplay(t *testing.T) {
+	cws := NewCheckWaitState()
+	ctx := &StateContext{
+		pollsNotBefore: time.Now().Add(30 * time.Millisecond),
+	}
+
+	// the first update check waits for the splay
+	tstart := time.Now()
+	s, c := cws.Handle(ctx, &stateTestController{
+		updatePollIntvl: 10 * time.Millisecond,
+		inventPollIntvl: 20 * time.Millisecond,
+	})
+	assert.IsType(t, &UpdateCheckState{}, s)
+	assert.False(t, c)
+	assert.True(t, time.Since(tstart) >= 25*time.Millisecond)
+
+	// and so does the first inventory update, but no longer
+	tstart = time.Now()
+	s, c = cws.Handle(ctx, &stateTestController{
+		updatePollIntvl: 10 * time.Millisecond,
+		inventPollIntvl: 20 * time.Millisecond,
+	})
+	assert.IsType(t, &InventoryUpdateState{}, s)
+	assert.False(t, c)
+	assert.WithinDuration(t, time.Now(), tstart, 15*time.Millisecond)
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+// Columns of a provisioning CSV whose header starts with this prefix set the
+// configuration option with the rest of the name for the device, such as
+// "config:TenantToken". All other columns are identity attributes.
+const provisionConfigPrefix = "config:"
+
+// Written at the top of the output tree, in the format the server takes for
+// preauthorizing devices.
+const provisionPreauthFile = "preauthorized-devices.json"
+
+type preauthorizedDevice struct {
+	IdentityData map[string]string `json:"identity_data"`
+	Pubkey       string            `json:"pubkey"`
+}
+
+// doProvisionBatch generates a tree for every device in the CSV file at
+// csvPath, below outDir, with the configuration file and device key laid out
+// the way they are on the device, ready to be copied into its image. The
+// configuration is the one in baseConfig, if it exists, with the options
+// given for the device applied. The public keys are collected, together with
+// the identity of the devices, so they can be preauthorized on the server.
+//
+// The first column of the CSV file names the output directory of the device.
+func doProvisionBatch(csvPath, baseConfig, outDir string) error {
+	f, err := os.Open(csvPath)
+	if err != nil {
+		return errors.Wrapf(err, "can not open provisioning file %s", csvPath)
+	}
+	defer f.Close()
+
+	base, err := readProvisionBaseConfig(baseConfig)
+	if err != nil {
+		return err
+	}
+
+	r := csv.NewReader(f)
+	r.TrimLeadingSpace = true
+	header, err := readProvisionHeader(r, csvPath)
+	if err != nil {
+		return err
+	}
+
+	var devices []preauthorizedDevice
+	names := make(map[string]bool)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "can not read provisioning file %s", csvPath)
+		}
+
+		name := record[0]
+		if err := checkProvisionDeviceName(name, names); err != nil {
+			return err
+		}
+		device, err := provisionDevice(path.Join(outDir, name), header, record, base)
+		if err != nil {
+			return errors.Wrapf(err, "can not provision device %s", name)
+		}
+		devices = append(devices, *device)
+	}
+
+	data, err := json.MarshalIndent(devices, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path.Join(outDir, provisionPreauthFile), data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Provisioned %d device(s) in %s\n", len(devices), outDir)
+	return nil
+}
+
+// readProvisionHeader reads the header of the provisioning file, which names
+// the identity attributes and configuration options in its columns.
+func readProvisionHeader(r *csv.Reader, csvPath string) ([]string, error) {
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, errors.Errorf("provisioning file %s is empty", csvPath)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "can not read provisioning file %s", csvPath)
+	}
+	if strings.HasPrefix(header[0], provisionConfigPrefix) {
+		return nil, errors.New("the first column of the provisioning file must be an identity attribute")
+	}
+	return header, nil
+}
+
+// checkProvisionDeviceName checks that the device name can be used as the
+// name of its output directory, and that it has not been seen before.
+func checkProvisionDeviceName(name string, seen map[string]bool) error {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return errors.Errorf("invalid device name %q", name)
+	}
+	if seen[name] {
+		return errors.Errorf("device %s is listed more than once", name)
+	}
+	seen[name] = true
+	return nil
+}
+
+func readProvisionBaseConfig(name string) (map[string]interface{}, error) {
+	config := make(map[string]interface{})
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(err, "can not parse configuration file %s", name)
+	}
+	return config, nil
+}
+
+func provisionDevice(root string, header, record []string,
+	base map[string]interface{}) (*preauthorizedDevice, error) {
+
+	identity := make(map[string]string)
+	config := make(map[string]interface{}, len(base))
+	for k, v := range base {
+		config[k] = v
+	}
+	for i, column := range header {
+		if strings.HasPrefix(column, provisionConfigPrefix) {
+			if record[i] != "" {
+				config[strings.TrimPrefix(column, provisionConfigPrefix)] =
+					provisionConfigValue(record[i])
+			}
+		} else {
+			identity[column] = record[i]
+		}
+	}
+
+	confFile := path.Join(root, defaultConfFile)
+	if err := os.MkdirAll(path.Dir(confFile), 0755); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(confFile, data, 0600); err != nil {
+		return nil, err
+	}
+
+	dataStore := path.Join(root, defaultDataStore)
+	if err = os.MkdirAll(dataStore, 0700); err != nil {
+		return nil, err
+	}
+	keyType, _ := config["DeviceKeyType"].(string)
+	keyOpts, err := store.ParseKeyOptions(keyType, "")
+	if err != nil {
+		return nil, err
+	}
+	ks := getKeyStore(dataStore, defaultKeyFile)
+	ks.SetKeyOptions(keyOpts)
+	if err = ks.Generate(); err != nil {
+		return nil, errors.Wrap(err, "failed to generate device key")
+	}
+	if err = ks.Save(); err != nil {
+		return nil, errors.Wrap(err, "failed to save device key")
+	}
+	pubkey, err := ks.PublicPEM()
+	if err != nil {
+		return nil, err
+	}
+
+	return &preauthorizedDevice{
+		IdentityData: identity,
+		Pubkey:       pubkey,
+	}, nil
+}
+
+// provisionConfigValue parses a configuration value from the CSV file as JSON,
+// so that numbers, booleans and lists can be given, and takes it as a plain
+// string otherwise.
+func provisionConfigValue(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	return v
+}
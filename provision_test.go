@@ -0,0 +1,114 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvisionBatch(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestProvisionBatch")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	baseConfig := path.Join(tmpdir, "mender.conf")
+	require.NoError(t, ioutil.WriteFile(baseConfig, []byte(`{
+  "ServerURL": "https://hosted.mender.io",
+  "UpdatePollIntervalSeconds": 1800
+}`), 0644))
+
+	csvPath := path.Join(tmpdir, "devices.csv")
+	require.NoError(t, ioutil.WriteFile(csvPath, []byte(
+		"serial, mac, config:TenantToken, config:InventoryPollIntervalSeconds, config:DeviceKeyType\n"+
+			"SN001, 00:11:22:33:44:55, tenant-a, 600, ecdsa-p256\n"+
+			"SN002, 00:11:22:33:44:56, , ,\n"), 0644))
+
+	outDir := path.Join(tmpdir, "out")
+	require.NoError(t, doProvisionBatch(csvPath, baseConfig, outDir))
+
+	data, err := ioutil.ReadFile(path.Join(outDir, provisionPreauthFile))
+	require.NoError(t, err)
+	var devices []preauthorizedDevice
+	require.NoError(t, json.Unmarshal(data, &devices))
+	require.Len(t, devices, 2)
+	assert.Equal(t, map[string]string{"serial": "SN001", "mac": "00:11:22:33:44:55"},
+		devices[0].IdentityData)
+	assert.Equal(t, map[string]string{"serial": "SN002", "mac": "00:11:22:33:44:56"},
+		devices[1].IdentityData)
+	assert.NotEqual(t, devices[0].Pubkey, devices[1].Pubkey)
+
+	for i, name := range []string{"SN001", "SN002"} {
+		root := path.Join(outDir, name)
+
+		ks := store.NewKeystore(store.NewDirStore(path.Join(root, defaultDataStore)), defaultKeyFile)
+		require.NoError(t, ks.Load())
+		pubkey, err := ks.PublicPEM()
+		require.NoError(t, err)
+		assert.Equal(t, devices[i].Pubkey, pubkey)
+		algorithm, err := ks.SignatureAlgorithm()
+		require.NoError(t, err)
+
+		config := menderConfig{}
+		require.NoError(t, readConfigFile(&config.menderConfigFromFile,
+			path.Join(root, defaultConfFile)))
+		assert.Equal(t, "https://hosted.mender.io", config.ServerURL)
+		assert.Equal(t, 1800, config.UpdatePollIntervalSeconds)
+		if name == "SN001" {
+			assert.Equal(t, "tenant-a", config.TenantToken)
+			assert.Equal(t, 600, config.InventoryPollIntervalSeconds)
+			assert.Equal(t, "ecdsa-sha256", algorithm)
+		} else {
+			assert.Equal(t, "", config.TenantToken)
+			assert.Equal(t, 0, config.InventoryPollIntervalSeconds)
+			assert.Equal(t, "rsa-pkcs1v15-sha256", algorithm)
+		}
+	}
+}
+
+func TestProvisionBatchErrors(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestProvisionBatchErrors")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	outDir := path.Join(tmpdir, "out")
+	csvPath := path.Join(tmpdir, "devices.csv")
+
+	err = doProvisionBatch(csvPath, "", outDir)
+	assert.Contains(t, err.Error(), "can not open provisioning file")
+
+	for _, c := range []struct {
+		csv string
+		err string
+	}{
+		{"", "is empty"},
+		{"config:TenantToken,serial\nfoo,SN001\n", "must be an identity attribute"},
+		{"serial\n../SN001\n", `invalid device name "../SN001"`},
+		{"serial\n\n..\n", `invalid device name ".."`},
+		{"serial,mac\nSN001\n", "wrong number of fields"},
+		{"serial\nSN001\nSN001\n", "listed more than once"},
+	} {
+		require.NoError(t, ioutil.WriteFile(csvPath, []byte(c.csv), 0644))
+		err = doProvisionBatch(csvPath, path.Join(tmpdir, "missing.conf"), outDir)
+		require.Error(t, err, c.csv)
+		assert.Contains(t, err.Error(), c.err)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mendersoftware/log"
+)
+
+// Environment variables with the proxy settings honored by the client.
+var proxyEnvironmentVariables = []string{
+	"http_proxy", "HTTP_PROXY",
+	"https_proxy", "HTTPS_PROXY",
+	"no_proxy", "NO_PROXY",
+}
+
+// The system wide environment, which is not inherited by the daemon when it is
+// started by systemd.
+var systemEnvironmentFile = "/etc/environment"
+
+func isProxyEnvironmentVariable(name string) bool {
+	for _, v := range proxyEnvironmentVariables {
+		if name == v {
+			return true
+		}
+	}
+	return false
+}
+
+// loadProxyEnvironment sets the proxy variables found in the environment file,
+// which are not already set in the environment of the process. The file holds
+// "NAME=value" lines, as /etc/environment does; a missing file is ignored.
+func loadProxyEnvironment(name string) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') &&
+			value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if !isProxyEnvironmentVariable(key) {
+			continue
+		}
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// redactProxyURL hides the password in a proxy URL.
+func redactProxyURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, set := u.User.Password(); set {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// setupProxyEnvironment loads the proxy settings of the system wide
+// environment, and logs the settings in use. It must be called before any
+// request is made, as the environment is only read once.
+func setupProxyEnvironment() {
+	if err := loadProxyEnvironment(systemEnvironmentFile); err != nil {
+		log.Warnf("Failed to read the proxy settings in %s: %v",
+			systemEnvironmentFile, err)
+	}
+	for _, name := range proxyEnvironmentVariables {
+		if value := os.Getenv(name); value != "" {
+			log.Infof("Using proxy setting %s=%s", name, redactProxyURL(value))
+		}
+	}
+}
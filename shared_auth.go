@@ -0,0 +1,90 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"sync"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/localapi"
+	"github.com/pkg/errors"
+)
+
+// sharedAuth is the API token of the client, and the server it was issued
+// by, as shared with other on-device processes.
+type sharedAuth struct {
+	lock      sync.Mutex
+	serverURL string
+	token     client.AuthToken
+	listener  func(serverURL string, token client.AuthToken)
+}
+
+// set updates the shared token, notifying the listener if it changed.
+func (a *sharedAuth) set(serverURL string, token client.AuthToken) {
+	a.lock.Lock()
+	if a.serverURL == serverURL && a.token == token {
+		a.lock.Unlock()
+		return
+	}
+	a.serverURL = serverURL
+	a.token = token
+	listener := a.listener
+	a.lock.Unlock()
+
+	if listener != nil {
+		listener(serverURL, token)
+	}
+}
+
+func (a *sharedAuth) get() (string, client.AuthToken) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.serverURL, a.token
+}
+
+func (a *sharedAuth) setListener(listener func(serverURL string, token client.AuthToken)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.listener = listener
+}
+
+// startLocalAuthServer serves the API token of the daemon's client on the
+// local auth socket, keeping it up to date on every re-authorization.
+func startLocalAuthServer(config *menderConfig, d *menderDaemon) (*localapi.AuthServer, error) {
+	m, ok := d.mender.(*mender)
+	if !ok {
+		return nil, errors.New("the controller does not share its API token")
+	}
+	srv, err := localapi.NewAuthServer(localapi.Config{
+		SocketPath: config.LocalAuthSocket,
+		Group:      config.LocalAuthGroup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.SetAuthTokenListener(func(serverURL string, token client.AuthToken) {
+		srv.TokenChanged(serverURL, string(token))
+	})
+	serverURL, token := m.CurrentAuthToken()
+	srv.TokenChanged(serverURL, string(token))
+
+	go func() {
+		if err := srv.Serve(); err != nil {
+			log.Errorf("Local auth token API stopped: %v", err)
+		}
+	}()
+	return srv, nil
+}
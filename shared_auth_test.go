@@ -0,0 +1,95 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	cltest "github.com/mendersoftware/mender/client/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedAuth(t *testing.T) {
+	var a sharedAuth
+	var changes []string
+	a.set("https://one", "token")
+	a.setListener(func(serverURL string, token client.AuthToken) {
+		changes = append(changes, serverURL+" "+string(token))
+	})
+
+	a.set("https://one", "token")
+	a.set("https://one", "token2")
+	a.set("https://two", "token2")
+	a.set("https://two", noAuthToken)
+	assert.Equal(t, []string{
+		"https://one token2",
+		"https://two token2",
+		"https://two ",
+	}, changes)
+
+	serverURL, token := a.get()
+	assert.Equal(t, "https://two", serverURL)
+	assert.Equal(t, noAuthToken, token)
+}
+
+func TestMenderSharedAuthToken(t *testing.T) {
+	srv := cltest.NewClientTestServer()
+	defer srv.Close()
+
+	atok := client.AuthToken("authorized")
+	authMgr := &testAuthManager{
+		authorized: false,
+		authtoken:  atok,
+	}
+	mender := newTestMender(nil,
+		menderConfig{
+			menderConfigFromFile: menderConfigFromFile{
+				Servers: []client.MenderServer{{ServerURL: srv.URL}},
+			},
+		},
+		testMenderPieces{
+			MenderPieces: MenderPieces{
+				authMgr: authMgr,
+			},
+		})
+
+	// Loaded from the store at startup.
+	serverURL, token := mender.CurrentAuthToken()
+	assert.Equal(t, srv.URL, serverURL)
+	assert.Equal(t, atok, token)
+
+	var tokens []client.AuthToken
+	mender.SetAuthTokenListener(func(serverURL string, token client.AuthToken) {
+		assert.Equal(t, srv.URL, serverURL)
+		tokens = append(tokens, token)
+	})
+
+	newtok := client.AuthToken("reauthorized")
+	authMgr.authtoken = newtok
+	srv.Auth.Authorize = true
+	srv.Auth.Token = []byte("foobar")
+	assert.NoError(t, mender.Authorize())
+	_, token = mender.CurrentAuthToken()
+	assert.Equal(t, newtok, token)
+
+	// Rejected on re-authorization.
+	srv.Auth.Authorize = false
+	mender.authToken = noAuthToken
+	assert.Error(t, mender.Authorize())
+	_, token = mender.CurrentAuthToken()
+	assert.Equal(t, noAuthToken, token)
+
+	assert.Equal(t, []client.AuthToken{newtok, noAuthToken}, tokens)
+}
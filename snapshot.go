@@ -0,0 +1,314 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/system"
+	"github.com/mendersoftware/mender/utils"
+	"github.com/pkg/errors"
+)
+
+// Compressions of the snapshots.
+const (
+	snapshotCompressionNone = "none"
+	snapshotCompressionGzip = "gzip"
+	snapshotCompressionZstd = "zstd"
+)
+
+// snapshotStdout is the output naming the standard output.
+const snapshotStdout = "-"
+
+// snapshotRootMount is where the active root filesystem is mounted, and
+// frozen; changed in tests.
+var snapshotRootMount = "/"
+
+type snapshotOptions struct {
+	// A file, snapshotStdout or ssh://[user@]host[:port]/path.
+	output      string
+	compression string
+	// Whether to freeze the root filesystem while dumping it, so that the
+	// snapshot is consistent.
+	freeze bool
+}
+
+// doSnapshotDump streams the active rootfs partition to the output of the
+// options, for capturing golden images from a reference device.
+func doSnapshotDump(device installer.DualRootfsDevice, opts snapshotOptions,
+	c system.Commander) error {
+
+	active, err := getSnapshotPartition(device)
+	if err != nil {
+		return err
+	}
+
+	if opts.freeze {
+		if err := checkSnapshotOutputNotFrozen(opts.output); err != nil {
+			return err
+		}
+	}
+	out, err := openSnapshotOutput(opts.output, c)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Dumping the active partition %s to %s", active,
+		describeSnapshotOutput(opts.output))
+	err = dumpSnapshot(active, out, opts, c, os.Stderr)
+	if cerr := out.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "failed to write the snapshot")
+	}
+	return err
+}
+
+// getSnapshotPartition returns the active rootfs partition, which the
+// snapshots are taken of.
+func getSnapshotPartition(device installer.DualRootfsDevice) (string, error) {
+	if device == nil {
+		return "", errors.New("No dual rootfs configuration present; there is no partition to dump")
+	}
+	active, err := device.GetActive()
+	if err != nil {
+		return "", errors.Wrap(err, "could not find the active partition")
+	}
+	return active, nil
+}
+
+// dumpSnapshot copies the partition to out, compressed and frozen as in the
+// options, with the progress shown on progress.
+func dumpSnapshot(partition string, out io.Writer, opts snapshotOptions,
+	c system.Commander, progress io.Writer) error {
+
+	w, err := newSnapshotCompressor(out, opts.compression, c)
+	if err != nil {
+		return err
+	}
+
+	if opts.freeze {
+		thaw, err := freezeFilesystem(c, snapshotRootMount)
+		if err != nil {
+			w.Close()
+			return err
+		}
+		defer thaw()
+	}
+
+	dev := &installer.BlockDevice{Path: partition}
+	size, err := dev.Size()
+	if err != nil {
+		log.Debugf("Could not get the size of %s, the progress is shown without it: %v",
+			partition, err)
+		size = 0
+	}
+	bar := utils.NewProgressBar(progress, int64(size))
+	defer bar.Finish()
+
+	_, err = io.Copy(w, io.TeeReader(dev, bar))
+	if cerr := dev.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		w.Close()
+		return errors.Wrapf(err, "failed to dump %s", partition)
+	}
+	return errors.Wrap(w.Close(), "failed to compress the snapshot")
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newSnapshotCompressor(out io.Writer, compression string,
+	c system.Commander) (io.WriteCloser, error) {
+
+	switch compression {
+	case snapshotCompressionNone, "":
+		return nopWriteCloser{out}, nil
+	case snapshotCompressionGzip:
+		return gzip.NewWriter(out), nil
+	case snapshotCompressionZstd:
+		// There is no zstd in Go's standard library, so the zstd tool
+		// compresses the snapshot.
+		return newCommandWriter(c.Command("zstd", "--quiet", "--stdout"), out)
+	default:
+		return nil, errors.Errorf("unknown snapshot compression %q; must be one of %s, %s or %s",
+			compression, snapshotCompressionNone, snapshotCompressionGzip, snapshotCompressionZstd)
+	}
+}
+
+// openSnapshotOutput opens the file, the standard output, or an ssh
+// connection, to write the snapshot to.
+func openSnapshotOutput(output string, c system.Commander) (io.WriteCloser, error) {
+	if output == snapshotStdout {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	if strings.HasPrefix(output, "ssh://") {
+		target, err := url.Parse(output)
+		if err != nil || target.Host == "" || target.Path == "" {
+			return nil, errors.Errorf("invalid ssh target %q; must be ssh://[user@]host[:port]/path",
+				output)
+		}
+		args := []string{}
+		if target.Port() != "" {
+			args = append(args, "-p", target.Port())
+		}
+		host := target.Hostname()
+		if target.User != nil {
+			host = target.User.Username() + "@" + host
+		}
+		args = append(args, host, "cat > "+shellQuote(target.Path))
+		return newCommandWriter(c.Command("ssh", args...), os.Stderr)
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the snapshot file")
+	}
+	return f, nil
+}
+
+// shellQuote quotes s for a POSIX shell, such as the one ssh runs the remote
+// command with.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// commandWriter writes to the standard input of a command.
+type commandWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// newCommandWriter starts the command, writing its output to out.
+func newCommandWriter(cmd *exec.Cmd, out io.Writer) (*commandWriter, error) {
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "failed to start %s", cmd.Path)
+	}
+	return &commandWriter{WriteCloser: stdin, cmd: cmd}, nil
+}
+
+// Close ends the input of the command, and waits for it to exit.
+func (w *commandWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if werr := w.cmd.Wait(); werr != nil {
+		return errors.Wrapf(werr, "%s failed", w.cmd.Path)
+	}
+	return err
+}
+
+// checkSnapshotOutputNotFrozen fails if the output is on the root
+// filesystem, writing to which would block once it is frozen.
+func checkSnapshotOutputNotFrozen(output string) error {
+	var fi os.FileInfo
+	var err error
+	switch {
+	case strings.HasPrefix(output, "ssh://"):
+		return nil
+	case output == snapshotStdout:
+		fi, err = os.Stdout.Stat()
+	default:
+		// The output, if it is an existing pipe, or else the directory it
+		// is created in.
+		if fi, err = os.Stat(output); err != nil {
+			fi, err = os.Stat(filepath.Dir(output))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	root, err := os.Stat(snapshotRootMount)
+	if err != nil {
+		return err
+	}
+	outStat, ok := fi.Sys().(*syscall.Stat_t)
+	rootStat, rok := root.Sys().(*syscall.Stat_t)
+	if ok && rok && outStat.Dev == rootStat.Dev && fi.Mode()&os.ModeNamedPipe == 0 {
+		return errors.Errorf("can not write the snapshot to %s while freezing the filesystem "+
+			"it is on; write it to another filesystem, or to a pipe", output)
+	}
+	return nil
+}
+
+// freezeFilesystem freezes the filesystem mounted at mount, and returns the
+// function thawing it. The filesystem is thawed as well if the client is
+// interrupted, which would otherwise leave the device hanging.
+func freezeFilesystem(c system.Commander, mount string) (func(), error) {
+	log.Infof("Freezing the filesystem mounted at %s", mount)
+	if out, err := c.Command("fsfreeze", "--freeze", mount).CombinedOutput(); err != nil {
+		return nil, errors.Wrapf(err, "failed to freeze %s: %s", mount, out)
+	}
+
+	var once sync.Once
+	thaw := func() {
+		once.Do(func() {
+			log.Infof("Thawing the filesystem mounted at %s", mount)
+			out, err := c.Command("fsfreeze", "--unfreeze", mount).CombinedOutput()
+			if err != nil {
+				log.Errorf("Failed to thaw %s: %v: %s", mount, err, out)
+			}
+		})
+	}
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		select {
+		case sig := <-signals:
+			thaw()
+			// Die of the signal, as without the handler.
+			signal.Stop(signals)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(sig)
+			}
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+		thaw()
+	}, nil
+}
+
+// describeSnapshotOutput names the output in messages.
+func describeSnapshotOutput(output string) string {
+	if output == snapshotStdout {
+		return "standard output"
+	}
+	return fmt.Sprintf("%q", output)
+}
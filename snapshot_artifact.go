@@ -0,0 +1,177 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender-artifact/artifact"
+	"github.com/mendersoftware/mender-artifact/awriter"
+	"github.com/mendersoftware/mender-artifact/handlers"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/system"
+	"github.com/pkg/errors"
+)
+
+// The name of the payload file of the snapshot artifacts.
+const snapshotArtifactPayload = "rootfs.img"
+
+type snapshotArtifactOptions struct {
+	// The artifact file written.
+	output       string
+	artifactName string
+	// Compression of the payload: gzip if empty, none or lzma.
+	compression string
+	// Whether to freeze the root filesystem while taking the snapshot.
+	freeze bool
+}
+
+// doSnapshotArtifact packages a snapshot of the active rootfs partition into
+// a rootfs-image artifact for the device type, providing what the installed
+// artifact provides, so that golden artifacts can be made on a device,
+// without a build system or server at hand.
+func doSnapshotArtifact(dm *deviceManager, device installer.DualRootfsDevice,
+	opts snapshotArtifactOptions, c system.Commander) error {
+
+	if opts.artifactName == "" {
+		return errors.New("the artifact needs a name; give it with -snapshot-artifact-name")
+	}
+	if opts.compression == "" {
+		opts.compression = "gzip"
+	}
+	compressor, err := artifact.NewCompressorFromId(opts.compression)
+	if err != nil {
+		return errors.Wrapf(err, "unsupported artifact compression %q", opts.compression)
+	}
+	deviceType, err := dm.GetDeviceType()
+	if err != nil {
+		return errors.Wrap(err, "could not read the device type")
+	}
+	provides, err := dm.GetProvides()
+	if err != nil {
+		return err
+	}
+	active, err := getSnapshotPartition(device)
+	if err != nil {
+		return err
+	}
+
+	// The writer of the artifact reads the payload from a file, which is
+	// kept next to the artifact, as the partition would hardly fit in a
+	// temporary directory in memory.
+	tmpdir, err := ioutil.TempDir(filepath.Dir(opts.output), ".mender-snapshot")
+	if err != nil {
+		return errors.Wrap(err, "failed to create a directory for the snapshot")
+	}
+	defer os.RemoveAll(tmpdir)
+	payload := filepath.Join(tmpdir, snapshotArtifactPayload)
+	if opts.freeze {
+		if err := checkSnapshotOutputNotFrozen(payload); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Taking a snapshot of the active partition %s", active)
+	checksum, err := writeSnapshotPayload(active, payload, opts.freeze, c)
+	if err != nil {
+		return err
+	}
+
+	args := snapshotArtifactArgs(opts.artifactName, deviceType, provides,
+		payload, checksum)
+	log.Infof("Writing the artifact %s to %s", opts.artifactName, opts.output)
+	return writeSnapshotArtifact(opts.output, compressor, args)
+}
+
+// snapshotArtifactArgs describes the artifact of the snapshot payload, which
+// provides what the installed artifact provides.
+func snapshotArtifactArgs(name, deviceType string, provides map[string]string,
+	payload, checksum string) *awriter.WriteArtifactArgs {
+
+	typeProvides := artifact.TypeInfoProvides{
+		"rootfs-image.checksum": checksum,
+	}
+	for key, value := range provides {
+		if key != "artifact_name" && key != "artifact_group" {
+			typeProvides[key] = value
+		}
+	}
+	devices := []string{deviceType}
+	return &awriter.WriteArtifactArgs{
+		Format:  "mender",
+		Version: 3,
+		Devices: devices,
+		Name:    name,
+		Updates: &awriter.Updates{
+			Updates: []handlers.Composer{handlers.NewRootfsV3(payload)},
+		},
+		Scripts: &artifact.Scripts{},
+		Depends: &artifact.ArtifactDepends{CompatibleDevices: devices},
+		Provides: &artifact.ArtifactProvides{
+			ArtifactName:  name,
+			ArtifactGroup: provides["artifact_group"],
+		},
+		TypeInfoV3: &artifact.TypeInfoV3{
+			Type:             "rootfs-image",
+			ArtifactProvides: &typeProvides,
+		},
+	}
+}
+
+// writeSnapshotArtifact writes the artifact to the output file, removing it
+// again if it fails.
+func writeSnapshotArtifact(output string, compressor artifact.Compressor,
+	args *awriter.WriteArtifactArgs) error {
+
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to create the artifact file")
+	}
+	err = awriter.NewWriter(f, compressor).WriteArtifact(args)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		return errors.Wrap(err, "failed to write the artifact")
+	}
+	return nil
+}
+
+// writeSnapshotPayload dumps the partition, uncompressed, to the payload
+// file, and returns its checksum.
+func writeSnapshotPayload(partition, payload string, freeze bool,
+	c system.Commander) (string, error) {
+
+	f, err := os.Create(payload)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create the snapshot file")
+	}
+	hash := sha256.New()
+	err = dumpSnapshot(partition, io.MultiWriter(f, hash),
+		snapshotOptions{compression: snapshotCompressionNone, freeze: freeze}, c, os.Stderr)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
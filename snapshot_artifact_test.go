@@ -0,0 +1,73 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotArtifact(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestSnapshotArtifact")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	partition, content := newSnapshotTestPartition(t, tmpdir)
+	device := snapshotTestDevice{active: partition}
+
+	ms := store.NewMemStore()
+	require.NoError(t, ms.WriteAll(datastore.ArtifactProvidesKey,
+		[]byte(`{"artifact_group":"golden","rootfs-image.version":"1.0"}`)))
+	dm := NewDeviceManager(device, &menderConfig{}, ms)
+	dm.deviceTypeFile = path.Join(tmpdir, "device_type")
+	require.NoError(t, ioutil.WriteFile(dm.deviceTypeFile,
+		[]byte("device_type=raspberrypi4\n"), 0644))
+
+	output := path.Join(tmpdir, "golden.mender")
+	err = doSnapshotArtifact(dm, device, snapshotArtifactOptions{output: output}, nil)
+	assert.Error(t, err)
+
+	calls := &snapshotTestCalls{}
+	require.NoError(t, doSnapshotArtifact(dm, device, snapshotArtifactOptions{
+		output:       output,
+		artifactName: "golden-1",
+	}, calls))
+	assert.Empty(t, calls.commands)
+
+	f, err := os.Open(output)
+	require.NoError(t, err)
+	defer f.Close()
+	summary, err := installer.InspectArtifact(f, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "golden-1", summary.Name)
+	assert.Equal(t, 3, summary.Version)
+	assert.Equal(t, []string{"raspberrypi4"}, summary.CompatibleDevices)
+	assert.Equal(t, "golden", summary.Provides.ArtifactGroup)
+	require.Len(t, summary.Payloads, 1)
+	assert.Equal(t, "rootfs-image", summary.Payloads[0].Type)
+	assert.Equal(t, []installer.PayloadFile{{Name: snapshotArtifactPayload,
+		Size: int64(len(content))}}, summary.Payloads[0].Files)
+
+	// Only the artifact is left.
+	files, err := ioutil.ReadDir(tmpdir)
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type snapshotTestDevice struct {
+	fakeDevice
+	active string
+}
+
+func (d snapshotTestDevice) GetActive() (string, error) {
+	return d.active, nil
+}
+
+// snapshotTestCalls records the commands run, running true instead.
+type snapshotTestCalls struct {
+	commands []string
+}
+
+func (c *snapshotTestCalls) Command(name string, args ...string) *exec.Cmd {
+	c.commands = append(c.commands, strings.Join(append([]string{name}, args...), " "))
+	return exec.Command("true")
+}
+
+func newSnapshotTestPartition(t *testing.T, dir string) (string, []byte) {
+	content := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	partition := path.Join(dir, "rootfs")
+	require.NoError(t, ioutil.WriteFile(partition, content, 0600))
+	return partition, content
+}
+
+func TestSnapshotDump(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestSnapshotDump")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	partition, content := newSnapshotTestPartition(t, tmpdir)
+	device := snapshotTestDevice{active: partition}
+
+	output := path.Join(tmpdir, "snapshot")
+	calls := &snapshotTestCalls{}
+	require.NoError(t, doSnapshotDump(device, snapshotOptions{output: output}, calls))
+	dumped, err := ioutil.ReadFile(output)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(content, dumped))
+	assert.Empty(t, calls.commands)
+
+	require.NoError(t, doSnapshotDump(device, snapshotOptions{
+		output:      output,
+		compression: snapshotCompressionGzip,
+	}, calls))
+	f, err := os.Open(output)
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	dumped, err = ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(content, dumped))
+
+	err = doSnapshotDump(device, snapshotOptions{output: output, compression: "lz4"}, calls)
+	assert.Error(t, err)
+	err = doSnapshotDump(nil, snapshotOptions{output: output}, calls)
+	assert.Error(t, err)
+}
+
+func TestSnapshotDumpFreeze(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestSnapshotDumpFreeze")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	partition, _ := newSnapshotTestPartition(t, tmpdir)
+	device := snapshotTestDevice{active: partition}
+
+	oldRootMount := snapshotRootMount
+	defer func() { snapshotRootMount = oldRootMount }()
+	snapshotRootMount = tmpdir
+
+	// Writing to the filesystem frozen would hang.
+	calls := &snapshotTestCalls{}
+	err = doSnapshotDump(device, snapshotOptions{
+		output: path.Join(tmpdir, "snapshot"),
+		freeze: true,
+	}, calls)
+	assert.Contains(t, err.Error(), "while freezing the filesystem")
+	assert.Empty(t, calls.commands)
+
+	fifo := path.Join(tmpdir, "fifo")
+	require.NoError(t, exec.Command("mkfifo", fifo).Run())
+	go ioutil.ReadFile(fifo)
+	require.NoError(t, doSnapshotDump(device, snapshotOptions{output: fifo, freeze: true}, calls))
+	assert.Equal(t, []string{
+		"fsfreeze --freeze " + tmpdir,
+		"fsfreeze --unfreeze " + tmpdir,
+	}, calls.commands)
+}
+
+func TestSnapshotOutputSSH(t *testing.T) {
+	calls := &snapshotTestCalls{}
+	out, err := openSnapshotOutput("ssh://root@golden:2222/srv/images/rootfs's.img", calls)
+	require.NoError(t, err)
+	require.NoError(t, out.Close())
+	assert.Equal(t, []string{`ssh -p 2222 root@golden cat > '/srv/images/rootfs'\''s.img'`},
+		calls.commands)
+
+	_, err = openSnapshotOutput("ssh://golden", calls)
+	assert.Error(t, err)
+}
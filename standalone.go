@@ -18,8 +18,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/mendersoftware/log"
 	"github.com/mendersoftware/mender/client"
@@ -34,11 +36,38 @@ import (
 type standaloneData struct {
 	artifactName string
 	installers   []installer.PayloadUpdatePerformer
+	// Provides of the artifact, and the provides of the installed artifact
+	// which it replaces. Only stored if the artifact is committed.
+	provides               map[string]string
+	clearsArtifactProvides []string
+}
+
+// The artifact is read from standard input if given as this, so that it can
+// be piped from another command, such as ssh.
+const standaloneStdin = "-"
+
+// standaloneFilePath returns the path of the artifact given as a path or as a
+// file:// URL.
+func standaloneFilePath(location string) (string, error) {
+	if !strings.HasPrefix(location, "file:") {
+		return location, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid Artifact URL %s", location)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", errors.Errorf("Artifact URL %s is not on this device", location)
+	}
+	if u.Path == "" {
+		return "", errors.Errorf("Artifact URL %s has no path", location)
+	}
+	return u.Path, nil
 }
 
 // This will be run manually from command line ONLY
 func doStandaloneInstall(device *deviceManager, args runOptionsType,
-	vKey []byte, stateExec statescript.Executor) error {
+	vPolicy *installer.SignaturePolicy, stateExec statescript.Executor) error {
 
 	var image io.ReadCloser
 	var imageSize int64
@@ -68,10 +97,16 @@ func doStandaloneInstall(device *deviceManager, args runOptionsType,
 
 		image, imageSize, err = upclient.FetchUpdate(ac, updateLocation, 0)
 		log.Debugf("Image downloaded: %d [%v] [%v]", imageSize, image, err)
+	} else if updateLocation == standaloneStdin {
+		log.Info("Start updating from standard input")
+		image = ioutil.NopCloser(os.Stdin)
 	} else {
 		// perform update from local file
-		log.Infof("Start updating from local image file: [%s]", updateLocation)
-		image, imageSize, err = installer.FetchUpdateFromFile(updateLocation)
+		updateLocation, err = standaloneFilePath(updateLocation)
+		if err == nil {
+			log.Infof("Start updating from local image file: [%s]", updateLocation)
+			image, imageSize, err = installer.FetchUpdateFromFile(updateLocation)
+		}
 
 		log.Debugf("Fetching update from file results: [%v], %d, %v", image, imageSize, err)
 	}
@@ -81,17 +116,73 @@ func doStandaloneInstall(device *deviceManager, args runOptionsType,
 	}
 	defer image.Close()
 
-	fmt.Fprintf(os.Stdout, "Installing Artifact of size %d...\n", imageSize)
-	p := &utils.ProgressWriter{
-		Out: os.Stdout,
-		N:   imageSize,
+	if imageSize > 0 {
+		fmt.Fprintf(os.Stdout, "Installing Artifact of size %d...\n", imageSize)
+	} else {
+		fmt.Fprintf(os.Stdout, "Installing Artifact...\n")
+	}
+	p := newStandaloneProgress(os.Stdout, imageSize)
+	defer p.finish()
+	if dev, ok := device.installerFactories.DualRootfs.(installer.DualRootfsDevice); ok {
+		dev.SetWriteProgressReporter(p)
 	}
 	tr := io.TeeReader(image, p)
 
-	return doStandaloneInstallStates(ioutil.NopCloser(tr), vKey, device, stateExec)
+	return doStandaloneInstallStates(ioutil.NopCloser(tr), vPolicy, device, stateExec)
 }
 
-func doStandaloneInstallStatesDownload(art io.ReadCloser, key []byte,
+// standaloneProgress shows the progress of a standalone install: how much of
+// the artifact has been read, until an update is written to the inactive
+// partition, from when on the progress of writing it is shown instead.
+type standaloneProgress struct {
+	out     io.Writer
+	lock    sync.Mutex
+	read    *utils.ProgressBar
+	write   *utils.ProgressBar
+	written int64
+}
+
+func newStandaloneProgress(out io.Writer, size int64) *standaloneProgress {
+	return &standaloneProgress{
+		out:  out,
+		read: utils.NewProgressBar(out, size),
+	}
+}
+
+// Write is given the artifact as it is read.
+func (p *standaloneProgress) Write(data []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.write == nil {
+		return p.read.Write(data)
+	}
+	return len(data), nil
+}
+
+func (p *standaloneProgress) ReportWriteProgress(written, total int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.write == nil || written < p.written {
+		fmt.Fprintf(p.out, "\nWriting %d bytes to the inactive partition...\n", total)
+		p.write = utils.NewProgressBar(p.out, total)
+		p.written = 0
+	}
+	p.write.Add(int(written - p.written))
+	p.written = written
+}
+
+// finish ends the line of the progress bar shown last, if not ended yet.
+func (p *standaloneProgress) finish() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.write != nil {
+		p.write.Finish()
+	} else {
+		p.read.Finish()
+	}
+}
+
+func doStandaloneInstallStatesDownload(art io.ReadCloser, policy *installer.SignaturePolicy,
 	device *deviceManager, stateExec statescript.Executor) (*standaloneData, error) {
 
 	dt, err := device.GetDeviceType()
@@ -108,7 +199,7 @@ func doStandaloneInstallStatesDownload(art io.ReadCloser, key []byte,
 		// No doStandaloneFailureStates here, since we have not done anything yet.
 		return nil, err
 	}
-	installer, installers, err := installer.ReadHeaders(art, dt, key,
+	installer, installers, err := installer.ReadHeadersWithPolicy(art, dt, policy,
 		device.stateScriptPath, &device.installerFactories)
 	standaloneData := &standaloneData{
 		installers: installers,
@@ -122,6 +213,18 @@ func doStandaloneInstallStatesDownload(art io.ReadCloser, key []byte,
 
 	standaloneData.artifactName = installer.GetArtifactName()
 
+	err = device.checkArtifactDepends(installer)
+	if err == nil {
+		standaloneData.provides, err = installer.GetArtifactProvides()
+		standaloneData.clearsArtifactProvides = installer.GetClearsArtifactProvides()
+	}
+	if err != nil {
+		log.Errorf("Artifact can not be installed: %s", err.Error())
+		callErrorScript("Download", stateExec)
+		doStandaloneFailureStates(device, standaloneData, stateExec, false, false, true)
+		return nil, err
+	}
+
 	err = installer.StorePayloads()
 	if err != nil {
 		log.Errorf("Download failed: %s", err.Error())
@@ -140,10 +243,10 @@ func doStandaloneInstallStatesDownload(art io.ReadCloser, key []byte,
 	return standaloneData, nil
 }
 
-func doStandaloneInstallStates(art io.ReadCloser, key []byte,
+func doStandaloneInstallStates(art io.ReadCloser, policy *installer.SignaturePolicy,
 	device *deviceManager, stateExec statescript.Executor) error {
 
-	standaloneData, err := doStandaloneInstallStatesDownload(art, key, device, stateExec)
+	standaloneData, err := doStandaloneInstallStatesDownload(art, policy, device, stateExec)
 	if err != nil {
 		return err
 	}
@@ -188,7 +291,7 @@ func doStandaloneInstallStates(art io.ReadCloser, key []byte,
 		return err
 	}
 
-	err = standaloneStoreArtifactState(device.store, standaloneData.artifactName, installers)
+	err = standaloneStoreArtifactState(device.store, standaloneData)
 	if err != nil {
 		log.Errorf("Could not update database: %s", err.Error())
 		return err
@@ -250,6 +353,7 @@ func doStandaloneCommitStates(device *deviceManager, standaloneData *standaloneD
 		callErrorScript("ArtifactCommit", stateExec)
 		errorToReturn = err
 		standaloneData.artifactName += brokenArtifactSuffix
+		standaloneData.provides = nil
 		// Too late to roll back now. Continue.
 	}
 
@@ -407,6 +511,8 @@ func doStandaloneFailureStates(device *deviceManager, standaloneData *standalone
 		// Means keep old name.
 		standaloneData.artifactName = ""
 	}
+	// And the old provides, in either case.
+	standaloneData.provides = nil
 
 	if cleanup {
 		err = doStandaloneCleanup(device, standaloneData, stateExec)
@@ -433,15 +539,25 @@ func doStandaloneCleanup(device *deviceManager, standaloneData *standaloneData,
 		}
 	}
 
-	err := device.store.WriteTransaction(func(txn store.Transaction) error {
+	provides, err := device.GetProvides()
+	if err != nil {
+		log.Errorf("Could not read the provides of the installed artifact: %s", err.Error())
+	}
+
+	err = device.store.WriteTransaction(func(txn store.Transaction) error {
 		err := txn.Remove(datastore.StandaloneStateKey)
 		if err != nil {
 			return err
 		}
-		if standaloneData.artifactName != "" {
-			return txn.WriteAll(datastore.ArtifactNameKey, []byte(standaloneData.artifactName))
+		if standaloneData.artifactName == "" {
+			return nil
 		}
-		return nil
+		err = commitArtifactProvides(txn, provides, standaloneData.provides,
+			standaloneData.clearsArtifactProvides)
+		if err != nil {
+			return err
+		}
+		return txn.WriteAll(datastore.ArtifactNameKey, []byte(standaloneData.artifactName))
 	})
 	if err != nil {
 		if firstErr == nil {
@@ -500,16 +616,19 @@ func callErrorScript(state string, stateExec statescript.Executor) {
 	}
 }
 
-func standaloneStoreArtifactState(store store.Store, artifactName string, installers []installer.PayloadUpdatePerformer) error {
+func standaloneStoreArtifactState(store store.Store, standaloneData *standaloneData) error {
+	installers := standaloneData.installers
 	list := make([]string, len(installers))
 	for c := range installers {
 		list[c] = installers[c].GetType()
 	}
 
 	stateData := datastore.StandaloneStateData{
-		Version:      datastore.StandaloneStateDataVersion,
-		ArtifactName: artifactName,
-		PayloadTypes: list,
+		Version:                datastore.StandaloneStateDataVersion,
+		ArtifactName:           standaloneData.artifactName,
+		PayloadTypes:           list,
+		Provides:               standaloneData.provides,
+		ClearsArtifactProvides: standaloneData.clearsArtifactProvides,
 	}
 
 	data, err := json.Marshal(stateData)
@@ -584,7 +703,9 @@ func restoreStandaloneData(device *deviceManager) (*standaloneData, error) {
 	}
 
 	return &standaloneData{
-		artifactName: stateData.ArtifactName,
-		installers:   installers,
+		artifactName:           stateData.ArtifactName,
+		installers:             installers,
+		provides:               stateData.Provides,
+		clearsArtifactProvides: stateData.ClearsArtifactProvides,
 	}, nil
 }
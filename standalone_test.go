@@ -14,6 +14,7 @@
 package main
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"os"
@@ -195,6 +196,76 @@ func Test_doManualUpdate_existingFile_updateSuccess(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func Test_doManualUpdate_stdinAndFileURL_updateSuccess(t *testing.T) {
+	deviceType := zeroLengthDeviceTypeFile(t)
+	defer os.Remove(deviceType)
+
+	artifact, err := MakeRootfsImageArtifact(3, false)
+	require.NoError(t, err)
+
+	tmpdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	artdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(artdir)
+	artPath := path.Join(artdir, "artifact.mender")
+	f, err := os.Create(artPath)
+	require.NoError(t, err)
+	_, err = io.Copy(f, artifact)
+	require.NoError(t, err)
+	f.Close()
+
+	for _, location := range []string{"file://" + artPath, "file://localhost" + artPath, "-"} {
+		t.Run(location, func(t *testing.T) {
+			dbdir, err := ioutil.TempDir("", "menderDbdir")
+			require.NoError(t, err)
+			defer os.RemoveAll(dbdir)
+
+			if location == "-" {
+				stdin, err := os.Open(artPath)
+				require.NoError(t, err)
+				defer stdin.Close()
+				old := os.Stdin
+				defer func() { os.Stdin = old }()
+				os.Stdin = stdin
+			}
+
+			fakeRunOptions := runOptionsType{}
+			fakeRunOptions.dataStore = &tmpdir
+			fakeRunOptions.imageFile = &location
+			config := menderConfig{
+				ArtifactScriptsPath: tmpdir,
+			}
+			err = doStandaloneInstall(getTestDeviceManager(fakeDevice{consumeUpdate: true},
+				&config, deviceType, dbdir), fakeRunOptions, nil, newStateScriptExecutor(&config))
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestStandaloneFilePath(t *testing.T) {
+	for location, expected := range map[string]string{
+		"/data/artifact.mender":                 "/data/artifact.mender",
+		"artifact.mender":                       "artifact.mender",
+		"file:///data/artifact.mender":          "/data/artifact.mender",
+		"file://localhost/data/artifact.mender": "/data/artifact.mender",
+		"file:///media/usb/my%20update.mender":  "/media/usb/my update.mender",
+		"file://otherhost/data/artifact.mender": "",
+		"file://":                               "",
+		"file://%zz":                            "",
+	} {
+		path, err := standaloneFilePath(location)
+		if expected == "" {
+			assert.Error(t, err, location)
+		} else {
+			assert.NoError(t, err, location)
+			assert.Equal(t, expected, path, location)
+		}
+	}
+}
+
 type standaloneModuleInstallCase struct {
 	caseName    string
 	errInstall  string
@@ -221,6 +292,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Normal install, no rollback",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -244,6 +316,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Normal install",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -261,6 +334,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Normal commit",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -282,6 +356,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Normal rollback",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -318,6 +393,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in Download",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Error_00",
 			"Cleanup",
@@ -334,6 +410,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in Download_Leave_00",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"Download_Error_00",
@@ -351,6 +428,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactInstall_Enter_00",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -377,6 +455,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactInstall",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -404,6 +483,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactInstall_Leave_00",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -432,6 +512,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactCommit_Enter_00",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -462,6 +543,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactCommit",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -493,6 +575,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactCommit_Leave_00",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -518,6 +601,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactCommit_Enter_00, no rollback",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -546,6 +630,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactCommit, no rollback",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -575,6 +660,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactCommit_Leave_00, no rollback",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -601,6 +687,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactRollback_Enter_00",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -629,6 +716,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactRollback",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -657,6 +745,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in ArtifactRollback_Leave_00",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -685,6 +774,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in automatic ArtifactRollback_Enter_00",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -712,6 +802,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in automatic ArtifactRollback",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -739,6 +830,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Fail in automatic ArtifactRollback_Leave_00",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -766,6 +858,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Hang in Download",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Error_00",
 			"Cleanup",
@@ -782,6 +875,7 @@ var standaloneModuleInstallCases []standaloneModuleInstallCase = []standaloneMod
 		caseName: "Hang in ArtifactInstall",
 		expectedLog: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Leave_00",
 			"SupportsRollback",
@@ -912,3 +1006,27 @@ func maybeDoPostStandaloneInstall(t *testing.T, c *standaloneModuleInstallCase,
 		require.True(t, false, "Should not happen")
 	}
 }
+
+func TestStandaloneProgress(t *testing.T) {
+	out := &bytes.Buffer{}
+	p := newStandaloneProgress(out, 100)
+
+	n, err := p.Write(make([]byte, 40))
+	assert.NoError(t, err)
+	assert.Equal(t, 40, n)
+	assert.NotContains(t, out.String(), "Writing")
+
+	p.ReportWriteProgress(0, 64*1024)
+	assert.Contains(t, out.String(),
+		"Writing 65536 bytes to the inactive partition...")
+
+	// Reading further is no longer shown once writing has started.
+	before := out.Len()
+	_, err = p.Write(make([]byte, 60))
+	assert.NoError(t, err)
+	assert.Equal(t, before, out.Len())
+
+	p.ReportWriteProgress(32*1024, 64*1024)
+	p.ReportWriteProgress(64*1024, 64*1024)
+	assert.Contains(t, out.String(), "100%")
+}
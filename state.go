@@ -14,6 +14,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -25,6 +26,7 @@ import (
 	"github.com/mendersoftware/mender/datastore"
 	"github.com/mendersoftware/mender/installer"
 	"github.com/mendersoftware/mender/store"
+	"github.com/mendersoftware/mender/utils"
 	"github.com/pkg/errors"
 )
 
@@ -36,8 +38,29 @@ type StateContext struct {
 	lastUpdateCheckAttempt     time.Time
 	lastInventoryUpdateAttempt time.Time
 	lastAuthorizeAttempt       time.Time
-	fetchInstallAttempts       int
+	authorizeBackoff           utils.Backoff
+	fetchInstallBackoff        utils.Backoff
 	wakeupChan                 chan bool
+	// Pause points of the update control map confirmed locally, by an
+	// on-device integration.
+	updateControlResume chan string
+	// Deployments paused locally, by an on-device integration.
+	deploymentPause *deploymentPause
+	// Progress of the artifact download, if tracked.
+	downloadProgress *downloadProgress
+	// Progress of writing the update to the inactive partition, if
+	// tracked.
+	writeProgress *writeProgress
+	// No update check or inventory update is done before this time, to
+	// splay the polls of the fleet after the start of the daemon.
+	pollsNotBefore time.Time
+	// The systemd watchdog kept alive by the state machine, if any.
+	watchdog *systemdWatchdog
+	// Where the artifacts downloaded are kept, if anywhere.
+	artifactCache *artifactCache
+	// Where the artifacts are fetched from before the server, if
+	// anywhere.
+	artifactMirrors *artifactMirrors
 }
 
 type StateRunner interface {
@@ -66,6 +89,8 @@ var (
 
 	authorizeWaitState = NewAuthorizeWaitState()
 
+	decommissionedWaitState = NewDecommissionedWaitState()
+
 	authorizeState = &AuthorizeState{
 		baseState{
 			id: datastore.MenderStateAuthorize,
@@ -114,7 +139,7 @@ type State interface {
 type WaitState interface {
 	Cancel() bool
 	Wake() bool
-	Wait(next, same State, wait time.Duration, wakeup chan bool) (State, bool)
+	Wait(next, same State, wait time.Duration, ctx *StateContext) (State, bool)
 }
 
 type UpdateState interface {
@@ -170,9 +195,9 @@ func NewWaitState(id datastore.MenderState, t Transition) *waitState {
 // Wait performs wait for time `wait` and return state (`next`, false) after the wait
 // has completed. If wait was interrupted returns (`same`, true)
 func (ws *waitState) Wait(next, same State,
-	wait time.Duration, wakeup chan bool) (State, bool) {
+	wait time.Duration, ctx *StateContext) (State, bool) {
 	ticker := time.NewTicker(wait)
-	ws.wakeup = wakeup
+	ws.wakeup = ctx.wakeupChan
 
 	defer ticker.Stop()
 	select {
@@ -283,7 +308,8 @@ func (i *InitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	msg := fmt.Sprintf("Update was interrupted in state: %s", sd.Name)
 	switch sd.Name {
 	case datastore.MenderStateReboot:
-	case datastore.MenderStateRollbackReboot:
+	case datastore.MenderStateRollbackReboot,
+		datastore.MenderStateUpdateControlPause:
 		// Interruption is expected in these, don't produce error.
 		log.Info(msg)
 	default:
@@ -301,12 +327,24 @@ func (i *InitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 		return NewUpdateStatusReportState(&sd.UpdateInfo, client.StatusFailure), false
 	}
 
+	// The write of the update was interrupted, and can be resumed by
+	// fetching the artifact again, whose signature is checked again.
+	if sd.Name == datastore.MenderStateUpdateStore &&
+		installer.CanResumeStore(c.GetInstallers()) {
+		log.Info("Resuming the write of the update")
+		return NewFetchStoreRetryState(i, &sd.UpdateInfo, me), false
+	}
+
 	return i.getNextState(ctx, &sd, me)
 }
 
 func (i *InitState) getNextState(ctx *StateContext, sd *datastore.StateData,
 	maybeErr menderError) (State, bool) {
 
+	if state := resumeStatusReport(ctx, sd); state != nil {
+		return state, false
+	}
+
 	// check last known state
 	switch sd.Name {
 
@@ -347,6 +385,13 @@ func (i *InitState) getNextState(ctx *StateContext, sd *datastore.StateData,
 	case datastore.MenderStateUpdateAfterCommit:
 		return NewUpdateAfterCommitState(&sd.UpdateInfo), false
 
+	// The deployment is held at the same pause point again.
+	case datastore.MenderStateUpdateControlPause:
+		if ps := restoreUpdateControlPause(&sd.UpdateInfo); ps != nil {
+			return ps, false
+		}
+		return i.rollbackOrError(ctx, sd, maybeErr)
+
 	// Error state (ArtifactFailure) should be retried.
 	case datastore.MenderStateUpdateError:
 		return NewUpdateErrorState(maybeErr, &sd.UpdateInfo), false
@@ -358,12 +403,48 @@ func (i *InitState) getNextState(ctx *StateContext, sd *datastore.StateData,
 	// All other states go to either error or rollback state, depending on
 	// what's supported.
 	default:
-		if sd.UpdateInfo.SupportsRollback == datastore.RollbackSupported {
-			return NewUpdateRollbackState(&sd.UpdateInfo), false
-		} else {
-			setBrokenArtifactFlag(ctx.store, sd.UpdateInfo.ArtifactName())
-			return NewUpdateErrorState(maybeErr, &sd.UpdateInfo), false
-		}
+		return i.rollbackOrError(ctx, sd, maybeErr)
+	}
+}
+
+// resumeStatusReport returns the state to resume in if the deployment was
+// over while its status was being reported; the status is reported again,
+// unless the server acknowledged it. It returns nil otherwise.
+func resumeStatusReport(ctx *StateContext, sd *datastore.StateData) State {
+	if sd.Name != datastore.MenderStateUpdateStatusReport &&
+		sd.Name != datastore.MenderStatusReportRetryState {
+		return nil
+	}
+	record := loadStatusReportRecord(ctx.store)
+	if record == nil || record.DeploymentID != sd.UpdateInfo.ID ||
+		!isTerminalStatus(record.Status) {
+		return nil
+	}
+	if record.Acknowledged {
+		return idleState
+	}
+	return NewUpdateStatusReportState(&sd.UpdateInfo, record.Status)
+}
+
+func (i *InitState) rollbackOrError(ctx *StateContext, sd *datastore.StateData,
+	maybeErr menderError) (State, bool) {
+
+	if sd.UpdateInfo.SupportsRollback == datastore.RollbackSupported {
+		return NewUpdateRollbackState(&sd.UpdateInfo), false
+	} else {
+		setBrokenArtifactFlag(ctx.store, sd.UpdateInfo.ArtifactName())
+		return NewUpdateErrorState(maybeErr, &sd.UpdateInfo), false
+	}
+}
+
+// authorizeRetryPolicy is the backoff of the authorization retries: the
+// retry poll interval, doubled every three attempts up to the update poll
+// interval, and never given up.
+func authorizeRetryPolicy(c Controller) utils.BackoffPolicy {
+	return utils.BackoffPolicy{
+		MinInterval:      c.GetRetryPollInterval(),
+		MaxInterval:      c.GetUpdatePollInterval(),
+		IntervalAttempts: 3,
 	}
 }
 
@@ -389,7 +470,11 @@ func (a *AuthorizeWaitState) Cancel() bool {
 func (a *AuthorizeWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle authorize wait state")
 
-	attempt := ctx.lastAuthorizeAttempt.Add(c.GetRetryPollInterval())
+	// The authorization is retried ever less often, up to the update poll
+	// interval, until it succeeds.
+	ctx.authorizeBackoff.Policy = authorizeRetryPolicy(c)
+	interval, _ := ctx.authorizeBackoff.Next()
+	attempt := ctx.lastAuthorizeAttempt.Add(interval)
 
 	now := time.Now()
 	var wait time.Duration
@@ -405,7 +490,36 @@ func (a *AuthorizeWaitState) Handle(ctx *StateContext, c Controller) (State, boo
 	}
 
 	ctx.lastAuthorizeAttempt = attempt
-	return a.Wait(authorizeState, a, wait, ctx.wakeupChan)
+	return a.Wait(authorizeState, a, wait, ctx)
+}
+
+// DecommissionedWaitState waits before the next authorization attempt of a
+// device the server rejects as decommissioned, for much longer than the
+// authorization retries, so that the server is not flooded with requests it
+// rejects anyway.
+type DecommissionedWaitState struct {
+	baseState
+	WaitState
+}
+
+func NewDecommissionedWaitState() State {
+	return &DecommissionedWaitState{
+		baseState: baseState{
+			id: datastore.MenderStateDecommissionedWait,
+			t:  ToIdle,
+		},
+		WaitState: NewWaitState(datastore.MenderStateDecommissionedWait, ToIdle),
+	}
+}
+
+func (d *DecommissionedWaitState) Cancel() bool {
+	return d.WaitState.Cancel()
+}
+
+func (d *DecommissionedWaitState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Debugf("handle decommissioned wait state")
+	ctx.lastAuthorizeAttempt = time.Now()
+	return d.Wait(authorizeState, d, c.GetDecommissionedRetryInterval(), ctx)
 }
 
 type AuthorizeState struct {
@@ -420,10 +534,14 @@ func (a *AuthorizeState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	if err := c.Authorize(); err != nil {
 		log.Errorf("authorize failed: %v", err)
 		if !err.IsFatal() {
+			if c.IsDecommissioned() {
+				return decommissionedWaitState, false
+			}
 			return authorizeWaitState, false
 		}
 		return NewErrorState(err), false
 	}
+	ctx.authorizeBackoff.Reset()
 	// if everything is OK we should let Mender figure out what to do
 	// in MenderStateCheckWait state
 	return checkWaitState, false
@@ -495,6 +613,11 @@ func (uc *UpdateCommitState) Handle(ctx *StateContext, c Controller) (State, boo
 	// now permanent, if there was one.
 	uc.Update().HasDBSchemaUpdate = false
 
+	provides, err := c.GetProvides()
+	if err != nil {
+		log.Errorf("Could not read the provides of the installed artifact: %s", err)
+	}
+
 	// And then store the data together with the new artifact name,
 	// indicating that we have now migrated to a new artifact!
 	err = StoreStateDataAndTransaction(ctx.store, datastore.StateData{
@@ -502,6 +625,11 @@ func (uc *UpdateCommitState) Handle(ctx *StateContext, c Controller) (State, boo
 		UpdateInfo: *uc.Update(),
 	}, func(txn store.Transaction) error {
 		log.Debugf("Committing new artifact name: %s", uc.Update().ArtifactName())
+		err := commitArtifactProvides(txn, provides, uc.Update().Artifact.Provides,
+			uc.Update().Artifact.ClearsArtifactProvides)
+		if err != nil {
+			return err
+		}
 		return txn.WriteAll(datastore.ArtifactNameKey, []byte(uc.Update().ArtifactName()))
 	})
 	if err != nil {
@@ -541,7 +669,7 @@ func (usr *UpdatePreCommitStatusReportRetryState) Handle(ctx *StateContext, c Co
 	maxTrySending++
 
 	if usr.reportTries < maxTrySending {
-		return usr.Wait(usr.returnToState, usr, c.GetRetryPollInterval(), ctx.wakeupChan)
+		return usr.Wait(usr.returnToState, usr, c.GetRetryPollInterval(), ctx)
 	}
 	return usr.returnToState.HandleError(ctx, c,
 		NewTransientError(errors.New("Tried sending status report maximum number of times.")))
@@ -635,13 +763,23 @@ func (u *UpdateCheckState) Handle(ctx *StateContext, c Controller) (State, bool)
 			// Just report successful update and return to normal operations.
 			return NewUpdateStatusReportState(update, client.StatusAlreadyInstalled), false
 		}
+		if err.Cause() == errDeploymentDeferred {
+			// The deployment stays pending on the server, and is
+			// picked up again once the rate limits allow it.
+			return checkWaitState, false
+		}
 
 		log.Errorf("update check failed: %s", err)
 		return NewErrorState(err), false
 	}
 
 	if update != nil {
-		return NewUpdateFetchState(update), false
+		return updateControlGate(ctx, c, u, update,
+			datastore.UpdateControlMapDownloadEnter, NewUpdateFetchState,
+			func(ctx *StateContext, c Controller, err menderError) (State, bool) {
+				log.Error(err.Error())
+				return NewUpdateStatusReportState(update, client.StatusFailure), false
+			})
 	}
 	return checkWaitState, false
 }
@@ -674,13 +812,34 @@ func (u *UpdateFetchState) Handle(ctx *StateContext, c Controller) (State, bool)
 		return NewUpdateStatusReportState(&u.update, client.StatusFailure), false
 	}
 
-	in, _, err := c.FetchUpdate(u.update.URI())
-	if err != nil {
-		log.Errorf("update fetch failed: %s", err)
-		return NewFetchStoreRetryState(u, &u.update, err), false
+	in, size := ctx.artifactCache.open(u.update.ArtifactName())
+	if in != nil {
+		log.Infof("Installing the Artifact %s from the cache", u.update.ArtifactName())
+	} else {
+		in, size = ctx.artifactMirrors.fetch(c, &u.update)
+		if in == nil {
+			var err error
+			in, size, err = c.FetchUpdate(u.update.URI())
+			if client.IsDeploymentAborted(err) {
+				log.Errorf("update fetch failed: %s", err)
+				return NewUpdateStatusReportState(&u.update, client.StatusFailure), false
+			} else if err != nil {
+				log.Errorf("update fetch failed: %s", err)
+				return NewFetchStoreRetryState(u, &u.update, err), false
+			}
+		}
+		in = ctx.artifactCache.tee(in, size, u.update.ArtifactName())
+	}
+
+	if ctx.downloadProgress != nil {
+		ctx.downloadProgress.start(size)
+		in = &progressReader{ReadCloser: in, progress: ctx.downloadProgress}
+	}
+	if ctx.writeProgress != nil {
+		ctx.writeProgress.ReportWriteProgress(0, 0)
 	}
 
-	return NewUpdateStoreState(in, &u.update), false
+	return NewUpdateStoreState(in, size, &u.update), false
 }
 
 func (uf *UpdateFetchState) Update() *datastore.UpdateInfo {
@@ -691,13 +850,16 @@ type UpdateStoreState struct {
 	*updateState
 	// reader for obtaining image data
 	imagein io.ReadCloser
+	// size of the artifact, or -1 if not known
+	size int64
 }
 
-func NewUpdateStoreState(in io.ReadCloser, update *datastore.UpdateInfo) State {
+func NewUpdateStoreState(in io.ReadCloser, size int64, update *datastore.UpdateInfo) State {
 	return &UpdateStoreState{
 		NewUpdateState(datastore.MenderStateUpdateStore,
 			ToDownload_Enter, update),
 		in,
+		size,
 	}
 }
 
@@ -718,22 +880,34 @@ func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 		return NewUpdateStatusReportState(&u.update, client.StatusFailure), false
 	}
 
-	installer, err := c.ReadArtifactHeaders(u.imagein)
-	if err != nil {
-		log.Errorf("Fetching Artifact headers failed: %s", err)
-		return NewFetchStoreRetryState(u, &u.update, err), false
+	// If the deployment is aborted meanwhile, cancelling the reading of the
+	// stream, and closing it, stops the download, and the writing of the
+	// update, right away.
+	readCtx, cancelRead := context.WithCancel(context.Background())
+	defer cancelRead()
+	heartbeat := startSubstateHeartbeat(c, &u.update, client.StatusDownloading,
+		downloadSubstate(ctx.downloadProgress, ctx.writeProgress),
+		func() {
+			cancelRead()
+			u.imagein.Close()
+		})
+	defer heartbeat.Stop()
+
+	inst, err := c.ReadArtifactHeaders(utils.NewContextReadCloser(readCtx, u.imagein))
+	if state := u.handleHeadersError(ctx, heartbeat, err); state != nil {
+		return state, false
 	}
 
-	if installer.GetArtifactName() != u.Update().ArtifactName() {
+	if inst.GetArtifactName() != u.Update().ArtifactName() {
 		log.Errorf("Artifact name in artifact is not what the server claims (%s != %s).",
-			installer.GetArtifactName(), u.Update().ArtifactName())
+			inst.GetArtifactName(), u.Update().ArtifactName())
 		return NewUpdateStatusReportState(u.Update(), client.StatusFailure), false
 	}
 
 	installers := c.GetInstallers()
-	u.update.Artifact.PayloadTypes = make([]string, len(installers))
-	for n, i := range installers {
-		u.update.Artifact.PayloadTypes[n] = i.GetType()
+	if err = u.recordArtifact(inst, installers); err != nil {
+		log.Errorf("Reading the Artifact provides failed: %s", err)
+		return NewUpdateStatusReportState(&u.update, client.StatusFailure), false
 	}
 
 	// Store state so that all the payload handlers are recorded there. This
@@ -749,19 +923,25 @@ func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 			false, u.Id(), &u.update, err)
 	}
 
-	err = installer.StorePayloads()
-	if err != nil {
-		log.Errorf("Artifact install failed: %s", err)
+	// Fail before the payload is downloaded if it can not fit the device;
+	// retrying would not help.
+	if err = installer.CheckCapacity(installers, u.size); err != nil {
+		log.Errorf("Artifact can not be installed on this device: %s", err)
 		return NewUpdateCleanupState(&u.update, client.StatusFailure), false
 	}
 
+	err = inst.StorePayloads()
+	if state := u.handleStoreError(ctx, heartbeat, installers, err); state != nil {
+		return state, false
+	}
+
 	ok, state, cancelled := u.handleSupportsRollback(ctx, c)
 	if !ok {
 		return state, cancelled
 	}
 
 	// restart counter so that we are able to retry next time
-	ctx.fetchInstallAttempts = 0
+	ctx.fetchInstallBackoff.Reset()
 
 	// check if update is not aborted
 	// this step is needed as installing might take a while and we might end up with
@@ -774,6 +954,67 @@ func (u *UpdateStoreState) Handle(ctx *StateContext, c Controller) (State, bool)
 	return NewUpdateAfterStoreState(&u.update), false
 }
 
+// handleHeadersError returns the state to go to if reading the artifact
+// headers failed, or nil if it succeeded.
+func (u *UpdateStoreState) handleHeadersError(ctx *StateContext,
+	heartbeat *substateHeartbeat, err error) State {
+
+	if heartbeat.Aborted() || client.IsDeploymentAborted(err) {
+		log.Errorf("Deployment aborted while fetching Artifact headers: %v", err)
+		return NewUpdateStatusReportState(&u.update, client.StatusFailure)
+	} else if errors.Cause(err) == installer.ErrDependsNotSatisfied {
+		// Retrying would not help.
+		log.Errorf("Artifact can not be installed on this device: %s", err)
+		return NewUpdateStatusReportState(&u.update, client.StatusFailure)
+	} else if err != nil {
+		log.Errorf("Fetching Artifact headers failed: %s", err)
+		ctx.artifactCache.remove(u.update.ArtifactName())
+		return NewFetchStoreRetryState(u, &u.update, err)
+	}
+	return nil
+}
+
+// recordArtifact records the payload types and the provides of the artifact
+// in the update.
+func (u *UpdateStoreState) recordArtifact(inst *installer.Installer,
+	installers []installer.PayloadUpdatePerformer) error {
+
+	u.update.Artifact.PayloadTypes = make([]string, len(installers))
+	for n, i := range installers {
+		u.update.Artifact.PayloadTypes[n] = i.GetType()
+	}
+	provides, err := inst.GetArtifactProvides()
+	if err != nil {
+		return err
+	}
+	u.update.Artifact.Provides = provides
+	u.update.Artifact.ClearsArtifactProvides = inst.GetClearsArtifactProvides()
+	return nil
+}
+
+// handleStoreError returns the state to go to if storing the payloads
+// failed, or nil if it succeeded.
+func (u *UpdateStoreState) handleStoreError(ctx *StateContext, heartbeat *substateHeartbeat,
+	installers []installer.PayloadUpdatePerformer, err error) State {
+
+	if heartbeat.Aborted() || client.IsDeploymentAborted(err) {
+		log.Errorf("Deployment aborted while storing the Artifact: %v", err)
+		return NewUpdateCleanupState(&u.update, client.StatusFailure)
+	} else if err != nil && installer.CanResumeStore(installers) {
+		// Fetching the artifact again resumes the write where it
+		// stopped.
+		log.Errorf("Artifact install failed, retrying: %s", err)
+		ctx.artifactCache.remove(u.update.ArtifactName())
+		return NewFetchStoreRetryState(u, &u.update, err)
+	} else if err != nil {
+		log.Errorf("Artifact install failed: %s", err)
+		// In case it is the cached artifact which is corrupt.
+		ctx.artifactCache.remove(u.update.ArtifactName())
+		return NewUpdateCleanupState(&u.update, client.StatusFailure)
+	}
+	return nil
+}
+
 func (u *UpdateStoreState) handleSupportsRollback(ctx *StateContext, c Controller) (bool, State, bool) {
 	for _, i := range c.GetInstallers() {
 		supportsRollback, err := i.SupportsRollback()
@@ -827,7 +1068,9 @@ func NewUpdateAfterStoreState(update *datastore.UpdateInfo) State {
 
 func (s *UpdateAfterStoreState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	// This state only exists to run Download_Leave.
-	return NewUpdateInstallState(s.Update()), false
+	return updateControlGate(ctx, c, s, s.Update(),
+		datastore.UpdateControlMapInstallEnter, NewUpdateInstallState,
+		s.HandleError)
 }
 
 func (s *UpdateAfterStoreState) HandleError(ctx *StateContext, c Controller, merr menderError) (State, bool) {
@@ -857,6 +1100,12 @@ func (is *UpdateInstallState) Handle(ctx *StateContext, c Controller) (State, bo
 		return is.HandleError(ctx, c, merr)
 	}
 
+	heartbeat := startSubstateHeartbeat(c, is.Update(), client.StatusInstalling,
+		elapsedSubstate("installing"), nil)
+	defer heartbeat.Stop()
+
+	is.Update().InstallAttempted = true
+
 	// If download was successful, install update, which for dual rootfs
 	// means marking inactive partition as the active one.
 	for _, i := range c.GetInstallers() {
@@ -882,8 +1131,10 @@ func (is *UpdateInstallState) Handle(ctx *StateContext, c Controller) (State, bo
 			// Do nothing.
 
 		case datastore.RebootTypeCustom, datastore.RebootTypeAutomatic:
-			// Go to reboot state if at least one payload requested it.
-			return NewUpdateRebootState(is.Update()), false
+			// Go to reboot state if at least one payload requested it,
+			// once the device lets it.
+			return updateControlGate(ctx, c, is, is.Update(),
+				deploymentRebootEnter, NewUpdateRebootState, is.HandleError)
 
 		default:
 			return is.HandleError(ctx, c, NewTransientError(errors.New(
@@ -892,7 +1143,9 @@ func (is *UpdateInstallState) Handle(ctx *StateContext, c Controller) (State, bo
 	}
 
 	// No reboot requests, go to commit state.
-	return NewUpdateCommitState(is.Update()), false
+	return updateControlGate(ctx, c, is, is.Update(),
+		datastore.UpdateControlMapCommitEnter, NewUpdateCommitState,
+		is.HandleError)
 }
 
 func (is *UpdateInstallState) handleRebootType(ctx *StateContext, c Controller) (bool, State, bool) {
@@ -964,7 +1217,8 @@ func (fir *FetchStoreRetryState) Cancel() bool {
 func (fir *FetchStoreRetryState) Handle(ctx *StateContext, c Controller) (State, bool) {
 	log.Debugf("handle fetch install retry state")
 
-	intvl, err := client.GetExponentialBackoffTime(ctx.fetchInstallAttempts, c.GetUpdatePollInterval())
+	ctx.fetchInstallBackoff.Policy = client.ExponentialBackoffPolicy(c.GetUpdatePollInterval())
+	intvl, err := ctx.fetchInstallBackoff.Next()
 	if err != nil {
 		if fir.err != nil {
 			return NewUpdateErrorState(
@@ -975,10 +1229,258 @@ func (fir *FetchStoreRetryState) Handle(ctx *StateContext, c Controller) (State,
 			NewTransientError(err), &fir.update), false
 	}
 
-	ctx.fetchInstallAttempts++
-
 	log.Debugf("wait %v before next fetch/install attempt", intvl)
-	return fir.Wait(NewUpdateFetchState(&fir.update), fir, intvl, ctx.wakeupChan)
+	return fir.Wait(NewUpdateFetchState(&fir.update), fir, intvl, ctx)
+}
+
+// The pause point before rebooting into the update, at which only the
+// device, and not the update control map, pauses the deployment.
+const deploymentRebootEnter = "ArtifactReboot_Enter"
+
+// updateControlFailFunc is the error handler used when the update control
+// map fails a deployment.
+type updateControlFailFunc func(ctx *StateContext, c Controller, err menderError) (State, bool)
+
+// updateControlGate decides how to proceed at the given pause point of the
+// deployment, according to the update control map of the update.
+func updateControlGate(ctx *StateContext, c Controller, from State,
+	update *datastore.UpdateInfo, point string,
+	next func(*datastore.UpdateInfo) State, fail updateControlFailFunc) (State, bool) {
+
+	action := update.UpdateControlMap.Action(point)
+	if action == datastore.UpdateControlMapActionContinue {
+		if substate := deviceGateSubstate(ctx, c, point, false); substate != "" {
+			log.Infof("Deployment %s", substate)
+			return NewUpdateControlPauseState(from, update, point, next, fail), false
+		}
+	}
+
+	switch action {
+	case datastore.UpdateControlMapActionPause:
+		log.Infof("Deployment paused at %s by the update control map", point)
+		return NewUpdateControlPauseState(from, update, point, next, fail), false
+	case datastore.UpdateControlMapActionFail:
+		return fail(ctx, c, NewFatalError(errors.Errorf(
+			"deployment failed at %s by the update control map", point)))
+	default:
+		return next(update), false
+	}
+}
+
+// deviceGateSubstate returns why the device holds the deployment at the pause
+// point, or an empty string if it may continue. A deployment already confirmed
+// on the device only skips the confirmation; it still waits for the other
+// gates.
+func deviceGateSubstate(ctx *StateContext, c Controller, point string, confirmed bool) string {
+	switch {
+	case ctx.deploymentPause.isSet():
+		return fmt.Sprintf("paused at %s on the device", point)
+	case !c.MaintenanceWindowOpen(point):
+		return fmt.Sprintf("waiting at %s for the maintenance window", point)
+	case !confirmed && c.AwaitsConfirmation(point):
+		return fmt.Sprintf("waiting at %s for a confirmation on the device", point)
+	default:
+		return ""
+	}
+}
+
+// UpdateControlPauseState holds the deployment at a pause point of the update
+// control map, polling the server for a new map until it tells the client to
+// either continue or fail the deployment. Past the download, the pause is
+// stored, and restored after a restart of the client.
+type UpdateControlPauseState struct {
+	baseState
+	WaitState
+	update datastore.UpdateInfo
+	point  string
+	from   datastore.MenderState
+	next   func(*datastore.UpdateInfo) State
+	fail   updateControlFailFunc
+	// Whether the pause was stored in the state data.
+	stored bool
+	// When the update control map was last fetched from the server.
+	mapRefreshed time.Time
+	// Whether the deployment was confirmed on the device at the pause point.
+	confirmed bool
+	// Status last reported to the server, repeated in the substate reports.
+	status             string
+	lastSubstateReport time.Time
+}
+
+// NewUpdateControlPauseState returns a pause state at the given pause point.
+// The pause state keeps the transition of the state it was entered from, so
+// that no state scripts are run until the deployment continues.
+func NewUpdateControlPauseState(from State, update *datastore.UpdateInfo, point string,
+	next func(*datastore.UpdateInfo) State, fail updateControlFailFunc) State {
+	status := StateStatus(from.Id())
+	if status == "" {
+		status = client.StatusDownloading
+	}
+	return &UpdateControlPauseState{
+		baseState: baseState{
+			id: datastore.MenderStateUpdateControlPause,
+			t:  from.Transition(),
+		},
+		WaitState: NewWaitState(datastore.MenderStateUpdateControlPause, from.Transition()),
+		update:    *update,
+		point:     point,
+		from:      from.Id(),
+		next:      next,
+		fail:      fail,
+		status:    status,
+	}
+}
+
+func (p *UpdateControlPauseState) Cancel() bool {
+	return p.WaitState.Cancel()
+}
+
+func (p *UpdateControlPauseState) Handle(ctx *StateContext, c Controller) (State, bool) {
+	log.Debugf("handle update control pause state")
+
+	p.checkResumed(ctx)
+
+	if !p.stored && p.point != datastore.UpdateControlMapDownloadEnter {
+		if err := p.store(ctx); err != nil {
+			log.Error("Could not write state data to persistent storage: ", err.Error())
+			state, cancelled := p.fail(ctx, c, NewFatalError(err))
+			return handleStateDataError(ctx, state, cancelled, p.Id(), &p.update, err)
+		}
+		p.stored = true
+	}
+
+	// While only the device holds the deployment, the map last sent by the
+	// server stands for an update poll interval, rather than being fetched
+	// again at every check of the device.
+	deviceSubstate := deviceGateSubstate(ctx, c, p.point, p.confirmed)
+	if deviceSubstate == "" {
+		// A confirmation found on the device was consumed; it stands
+		// while the server still pauses the deployment.
+		p.confirmed = true
+	}
+	if deviceSubstate == "" ||
+		p.update.UpdateControlMap.Action(p.point) != datastore.UpdateControlMapActionContinue ||
+		time.Since(p.mapRefreshed) >= c.GetUpdatePollInterval() {
+
+		if state, cancelled := p.refreshControlMap(ctx, c); state != nil {
+			return state, cancelled
+		}
+	}
+
+	action := p.update.UpdateControlMap.Action(p.point)
+	switch {
+	case action == datastore.UpdateControlMapActionPause:
+		// Like new deployments, a new map is polled for at the update
+		// poll interval.
+		log.Debugf("Deployment still paused at %s", p.point)
+		p.reportSubstate(c, fmt.Sprintf("paused at %s by the update control map", p.point))
+		return p.Wait(p, p, c.GetUpdatePollInterval(), ctx)
+	case action == datastore.UpdateControlMapActionFail:
+		return p.fail(ctx, c, NewFatalError(errors.Errorf(
+			"deployment failed at %s by the update control map", p.point)))
+	case deviceSubstate != "":
+		log.Debugf("Deployment still %s", deviceSubstate)
+		p.reportSubstate(c, deviceSubstate)
+		return p.Wait(p, p, c.GetRetryPollInterval(), ctx)
+	default:
+		log.Infof("Deployment continuing from %s", p.point)
+		return p.next(&p.update), false
+	}
+}
+
+// checkResumed checks whether the deployment was confirmed at the pause point
+// on the device, without waiting for it.
+func (p *UpdateControlPauseState) checkResumed(ctx *StateContext) {
+	select {
+	case point := <-ctx.updateControlResume:
+		if point == p.point {
+			log.Infof("Deployment confirmed at %s on the device", p.point)
+			p.confirmed = true
+		}
+	default:
+	}
+}
+
+// refreshControlMap fetches the update control map from the server. It
+// returns the state to go to if that fails, or nil otherwise.
+func (p *UpdateControlPauseState) refreshControlMap(ctx *StateContext,
+	c Controller) (State, bool) {
+
+	controlMap, err := c.GetUpdateControlMap(&p.update)
+	if err != nil {
+		if err.IsFatal() {
+			return p.fail(ctx, c, err)
+		}
+		log.Errorf("Failed to refresh the update control map: %s", err.Error())
+		return p.Wait(p, p, c.GetRetryPollInterval(), ctx)
+	}
+	p.update.UpdateControlMap = controlMap
+	p.mapRefreshed = time.Now()
+	return nil, false
+}
+
+// store stores the pause in the state data, to be restored by
+// restoreUpdateControlPause after a restart.
+func (p *UpdateControlPauseState) store(ctx *StateContext) error {
+	update := p.update
+	update.UpdateControlPause = &datastore.UpdateControlPause{
+		Point: p.point,
+		State: p.from,
+	}
+	return StoreStateData(ctx.store, datastore.StateData{
+		Name:       p.Id(),
+		UpdateInfo: update,
+	})
+}
+
+// restoreUpdateControlPause returns the pause state stored in the update, or
+// nil if there is none. As after other interrupted states, the enter scripts
+// of the state the deployment was held in are run again.
+func restoreUpdateControlPause(update *datastore.UpdateInfo) State {
+	pause := update.UpdateControlPause
+	if pause == nil {
+		return nil
+	}
+	update.UpdateControlPause = nil
+
+	var from State
+	switch pause.State {
+	case datastore.MenderStateUpdateAfterStore:
+		from = NewUpdateAfterStoreState(update)
+	case datastore.MenderStateUpdateInstall:
+		from = NewUpdateInstallState(update)
+	case datastore.MenderStateAfterReboot:
+		from = NewUpdateAfterRebootState(update)
+	default:
+		return nil
+	}
+
+	var next func(*datastore.UpdateInfo) State
+	switch pause.Point {
+	case datastore.UpdateControlMapInstallEnter:
+		next = NewUpdateInstallState
+	case deploymentRebootEnter:
+		next = NewUpdateRebootState
+	case datastore.UpdateControlMapCommitEnter:
+		next = NewUpdateCommitState
+	default:
+		return nil
+	}
+
+	return NewUpdateControlPauseState(from, update, pause.Point, next, from.HandleError)
+}
+
+// reportSubstate lets the server know the deployment is still paused, at most
+// once per substate report interval.
+func (p *UpdateControlPauseState) reportSubstate(c Controller, substate string) {
+	interval := c.GetSubstateReportInterval()
+	if interval <= 0 || time.Since(p.lastSubstateReport) < interval {
+		return
+	}
+	p.lastSubstateReport = time.Now()
+	if err := c.ReportUpdateSubstate(&p.update, p.status, substate); err != nil {
+		log.Warnf("Failed to report the deployment substate: %s", err.Error())
+	}
 }
 
 type CheckWaitState struct {
@@ -1013,6 +1515,13 @@ func (cw *CheckWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 		inventory = ctx.lastInventoryUpdateAttempt
 	}
 
+	if update.Before(ctx.pollsNotBefore) {
+		update = ctx.pollsNotBefore
+	}
+	if inventory.Before(ctx.pollsNotBefore) {
+		inventory = ctx.pollsNotBefore
+	}
+
 	log.Debugf("check wait state; next checks: (update: %v) (inventory: %v)",
 		update, inventory)
 
@@ -1060,7 +1569,7 @@ func (cw *CheckWaitState) Handle(ctx *StateContext, c Controller) (State, bool)
 
 	if wait != 0 {
 		log.Debugf("waiting %s for the next state", wait)
-		return cw.Wait(next.state, cw, wait, ctx.wakeupChan)
+		return cw.Wait(next.state, cw, wait, ctx)
 	}
 
 	log.Debugf("check wait returned: %v", next.state)
@@ -1179,6 +1688,12 @@ func (s *UpdateCleanupState) Handle(ctx *StateContext, c Controller) (State, boo
 
 	log.Debug("Handling Cleanup state")
 
+	if ctx.store != nil && s.Update().InstallAttempted {
+		if err := recordDeploymentCompletion(ctx.store, time.Now()); err != nil {
+			log.Errorf("Could not record deployment completion: %s", err)
+		}
+	}
+
 	var lastError error
 	for _, i := range c.GetInstallers() {
 		err := i.Cleanup()
@@ -1234,6 +1749,9 @@ func sendDeploymentLogs(update *datastore.UpdateInfo, sentTries *int,
 	if err := c.UploadLog(update, logs); err != nil {
 		// we got error while sending deployment logs to server;
 		log.Errorf("failed to report deployment logs: %v", err)
+		if err.IsFatal() {
+			return NewFatalError(errors.Wrapf(err, "failed to send deployment logs"))
+		}
 		return NewTransientError(errors.Wrapf(err, "failed to send deployment logs"))
 	}
 	return nil
@@ -1343,7 +1861,7 @@ func (usr *UpdateStatusReportRetryState) Handle(ctx *StateContext, c Controller)
 	maxTrySending++
 
 	if usr.triesSending < maxTrySending {
-		return usr.Wait(usr.reportState, usr, c.GetRetryPollInterval(), ctx.wakeupChan)
+		return usr.Wait(usr.reportState, usr, c.GetRetryPollInterval(), ctx)
 	}
 	return NewReportErrorState(&usr.update, usr.status), false
 }
@@ -1497,7 +2015,9 @@ func (rs *UpdateAfterRebootState) Handle(ctx *StateContext,
 	// this state is needed to satisfy ToReboot transition Leave() action
 	log.Debug("handling state after reboot")
 
-	return NewUpdateCommitState(rs.Update()), false
+	return updateControlGate(ctx, c, rs, rs.Update(),
+		datastore.UpdateControlMapCommitEnter, NewUpdateCommitState,
+		rs.HandleError)
 }
 
 type UpdateRollbackState struct {
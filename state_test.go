@@ -45,18 +45,29 @@ type stateTestController struct {
 	fakeDevice
 	updater         fakeUpdater
 	artifactName    string
+	provides        map[string]string
 	updatePollIntvl time.Duration
 	inventPollIntvl time.Duration
 	retryIntvl      time.Duration
+	substateIntvl   time.Duration
+	closedWindows   map[string]bool
+	unconfirmed     map[string]bool
 	state           State
 	updateResp      *datastore.UpdateInfo
 	updateRespErr   menderError
+	controlMap      *datastore.UpdateControlMap
+	controlMapErr   menderError
+	controlMapCalls int
+	notifyPending   bool
+	notifyErr       menderError
 	authorized      bool
 	authorizeErr    menderError
+	decommissioned  bool
 	reportError     menderError
 	logSendingError menderError
 	reportStatus    string
 	reportUpdate    datastore.UpdateInfo
+	substates       chan string
 	logUpdate       datastore.UpdateInfo
 	logs            []byte
 	inventoryErr    error
@@ -69,6 +80,10 @@ func (s *stateTestController) GetCurrentArtifactName() (string, error) {
 	return s.artifactName, nil
 }
 
+func (s *stateTestController) GetProvides() (map[string]string, error) {
+	return s.provides, nil
+}
+
 func (s *stateTestController) GetUpdatePollInterval() time.Duration {
 	return s.updatePollIntvl
 }
@@ -81,10 +96,42 @@ func (s *stateTestController) GetRetryPollInterval() time.Duration {
 	return s.retryIntvl
 }
 
+func (s *stateTestController) GetSubstateReportInterval() time.Duration {
+	return s.substateIntvl
+}
+
+func (s *stateTestController) GetDecommissionedRetryInterval() time.Duration {
+	return s.retryIntvl
+}
+
+func (s *stateTestController) IsDecommissioned() bool {
+	return s.decommissioned
+}
+
+func (s *stateTestController) MaintenanceWindowOpen(point string) bool {
+	return !s.closedWindows[point]
+}
+
+func (s *stateTestController) AwaitsConfirmation(point string) bool {
+	return s.unconfirmed[point]
+}
+
 func (s *stateTestController) CheckUpdate() (*datastore.UpdateInfo, menderError) {
 	return s.updateResp, s.updateRespErr
 }
 
+func (s *stateTestController) GetUpdateControlMap(update *datastore.UpdateInfo) (*datastore.UpdateControlMap, menderError) {
+	s.controlMapCalls++
+	return s.controlMap, s.controlMapErr
+}
+
+func (s *stateTestController) WaitForUpdateNotification() (bool, menderError) {
+	if s.notifyErr == nil && !s.notifyPending {
+		return false, NewFatalError(client.ErrNotificationsUnsupported)
+	}
+	return s.notifyPending, s.notifyErr
+}
+
 func (s *stateTestController) FetchUpdate(url string) (io.ReadCloser, int64, error) {
 	return s.updater.FetchUpdate(nil, url)
 }
@@ -117,6 +164,15 @@ func (s *stateTestController) ReportUpdateStatus(update *datastore.UpdateInfo, s
 	return s.reportError
 }
 
+func (s *stateTestController) ReportUpdateSubstate(update *datastore.UpdateInfo,
+	status, substate string) menderError {
+	select {
+	case s.substates <- status + ": " + substate:
+	default:
+	}
+	return s.reportError
+}
+
 func (s *stateTestController) UploadLog(update *datastore.UpdateInfo, logs []byte) menderError {
 	s.logUpdate = *update
 	s.logs = logs
@@ -166,7 +222,7 @@ type waitStateTest struct {
 	baseState
 }
 
-func (c *waitStateTest) Wait(next, same State, wait time.Duration, wake chan bool) (State, bool) {
+func (c *waitStateTest) Wait(next, same State, wait time.Duration, ctx *StateContext) (State, bool) {
 	log.Debugf("Fake waiting for %f seconds, going from state %s to state %s",
 		wait.Seconds(), same.Id(), next.Id())
 	return next, false
@@ -208,7 +264,7 @@ func TestStateWait(t *testing.T) {
 	}
 
 	tstart = time.Now()
-	s, c = cs.Wait(authorizeState, authorizeWaitState, 100*time.Millisecond, ctx.wakeupChan)
+	s, c = cs.Wait(authorizeState, authorizeWaitState, 100*time.Millisecond, &ctx)
 	tend = time.Now()
 	// not cancelled should return the 'next' state
 	assert.Equal(t, authorizeState, s)
@@ -222,7 +278,7 @@ func TestStateWait(t *testing.T) {
 	}()
 	// should finish right away
 	tstart = time.Now()
-	s, c = cs.Wait(authorizeState, authorizeWaitState, 100*time.Millisecond, ctx.wakeupChan)
+	s, c = cs.Wait(authorizeState, authorizeWaitState, 100*time.Millisecond, &ctx)
 	tend = time.Now()
 	// canceled should return the same state
 	assert.Equal(t, authorizeWaitState, s)
@@ -232,7 +288,7 @@ func TestStateWait(t *testing.T) {
 	go func() {
 		assert.True(t, cs.Wake())
 	}()
-	s, c = cs.Wait(authorizeState, authorizeWaitState, 10*time.Second, ctx.wakeupChan)
+	s, c = cs.Wait(authorizeState, authorizeWaitState, 10*time.Second, &ctx)
 	// Wake should return the next state
 	assert.Equal(t, authorizeState, s)
 	assert.False(t, c)
@@ -406,17 +462,28 @@ func TestStateIdle(t *testing.T) {
 
 func TestStateAuthorize(t *testing.T) {
 	a := AuthorizeState{}
-	s, c := a.Handle(nil, &stateTestController{})
-	assert.IsType(t, &CheckWaitState{}, s)
-	assert.False(t, c)
-
-	s, c = a.Handle(nil, &stateTestController{
+	ctx := new(StateContext)
+	s, c := a.Handle(ctx, &stateTestController{
 		authorizeErr: NewTransientError(errors.New("auth fail temp")),
 	})
 	assert.IsType(t, &AuthorizeWaitState{}, s)
 	assert.False(t, c)
 
-	s, c = a.Handle(nil, &stateTestController{
+	s, c = a.Handle(ctx, &stateTestController{
+		authorizeErr:   NewTransientError(errors.New("device decommissioned")),
+		decommissioned: true,
+	})
+	assert.IsType(t, &DecommissionedWaitState{}, s)
+	assert.False(t, c)
+
+	// The authorization retries start over once authorized.
+	ctx.authorizeBackoff.Next()
+	s, c = a.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &CheckWaitState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, 0, ctx.authorizeBackoff.Attempts())
+
+	s, c = a.Handle(ctx, &stateTestController{
 		authorizeErr: NewFatalError(errors.New("auth error")),
 	})
 	assert.IsType(t, &ErrorState{}, s)
@@ -444,6 +511,30 @@ func TestStateInvetoryUpdate(t *testing.T) {
 
 }
 
+func TestStateDecommissionedWait(t *testing.T) {
+	dws := NewDecommissionedWaitState()
+	assert.Equal(t, "decommissioned-wait", dws.Id().String())
+	ctx := new(StateContext)
+
+	tstart := time.Now()
+	s, c := dws.Handle(ctx, &stateTestController{
+		retryIntvl: 100 * time.Millisecond,
+	})
+	assert.IsType(t, &AuthorizeState{}, s)
+	assert.False(t, c)
+	assert.True(t, time.Since(tstart) >= 100*time.Millisecond)
+	assert.WithinDuration(t, tstart, ctx.lastAuthorizeAttempt, 10*time.Millisecond)
+
+	go func() {
+		assert.True(t, dws.Cancel())
+	}()
+	s, c = dws.Handle(ctx, &stateTestController{
+		retryIntvl: time.Hour,
+	})
+	assert.IsType(t, &DecommissionedWaitState{}, s)
+	assert.True(t, c)
+}
+
 func TestStateAuthorizeWait(t *testing.T) {
 	cws := NewAuthorizeWaitState()
 
@@ -616,6 +707,320 @@ func TestUpdateCheckSameImage(t *testing.T) {
 	assert.Equal(t, client.StatusAlreadyInstalled, urs.status)
 }
 
+func TestUpdateCheckDeferred(t *testing.T) {
+	cs := UpdateCheckState{}
+	ctx := new(StateContext)
+
+	// deferred by the rate limits; not an error
+	s, c := cs.Handle(ctx, &stateTestController{
+		updateResp:    &datastore.UpdateInfo{ID: "my-id"},
+		updateRespErr: NewTransientError(errDeploymentDeferred),
+	})
+	assert.IsType(t, &CheckWaitState{}, s)
+	assert.False(t, c)
+}
+
+func TestUpdateCleanupDeploymentHistory(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ms := store.NewMemStore()
+	ctx := &StateContext{store: ms}
+
+	// failed before installing; not counted
+	update := &datastore.UpdateInfo{ID: "my-id"}
+	cs := NewUpdateCleanupState(update, client.StatusFailure)
+	cs.Handle(ctx, &stateTestController{})
+	history, err := loadDeploymentHistory(ms)
+	require.NoError(t, err)
+	assert.Empty(t, history.Completed)
+
+	// installing failed; counted
+	update.InstallAttempted = true
+	cs = NewUpdateCleanupState(update, client.StatusFailure)
+	cs.Handle(ctx, &stateTestController{})
+	history, err = loadDeploymentHistory(ms)
+	require.NoError(t, err)
+	assert.Len(t, history.Completed, 1)
+}
+
+func TestUpdateCheckControlMap(t *testing.T) {
+	cs := UpdateCheckState{}
+	ctx := new(StateContext)
+
+	pauseMap := &datastore.UpdateControlMap{
+		ID: "map-id",
+		States: map[string]datastore.UpdateControlMapState{
+			datastore.UpdateControlMapDownloadEnter: {
+				Action: datastore.UpdateControlMapActionPause,
+			},
+		},
+	}
+	update := &datastore.UpdateInfo{
+		ID:               "my-id",
+		UpdateControlMap: pauseMap,
+	}
+
+	s, c := cs.Handle(ctx, &stateTestController{
+		updateResp: update,
+	})
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+	ps := s.(*UpdateControlPauseState)
+	assert.Equal(t, cs.Transition(), ps.Transition())
+
+	// still paused; wait and poll again at the update poll interval
+	s, c = ps.Handle(ctx, &stateTestController{
+		controlMap:      pauseMap,
+		updatePollIntvl: time.Millisecond,
+	})
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+
+	// temporary failure refreshing the map; keep waiting
+	s, c = ps.Handle(ctx, &stateTestController{
+		controlMapErr: NewTransientError(errors.New("no network")),
+		retryIntvl:    time.Millisecond,
+	})
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+
+	// the operator lets the deployment continue
+	s, c = ps.Handle(ctx, &stateTestController{
+		controlMap: &datastore.UpdateControlMap{ID: "map-id"},
+	})
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, "my-id", s.(*UpdateFetchState).update.ID)
+
+	// the operator fails the deployment
+	s, c = ps.Handle(ctx, &stateTestController{
+		controlMap: &datastore.UpdateControlMap{
+			ID: "map-id",
+			States: map[string]datastore.UpdateControlMapState{
+				datastore.UpdateControlMapDownloadEnter: {
+					Action: datastore.UpdateControlMapActionFail,
+				},
+			},
+		},
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+
+	// the deployment was aborted on the server
+	s, c = ps.Handle(ctx, &stateTestController{
+		controlMapErr: NewFatalError(errors.New("deployment aborted")),
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.False(t, c)
+
+	// a map failing the deployment right away
+	update.UpdateControlMap = &datastore.UpdateControlMap{
+		ID: "map-id",
+		States: map[string]datastore.UpdateControlMapState{
+			datastore.UpdateControlMapDownloadEnter: {
+				Action: datastore.UpdateControlMapActionFail,
+			},
+		},
+	}
+	s, c = cs.Handle(ctx, &stateTestController{
+		updateResp: update,
+	})
+	assert.IsType(t, &UpdateStatusReportState{}, s)
+	assert.False(t, c)
+}
+
+func TestUpdateMaintenanceWindow(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ctx := &StateContext{
+		store:           store.NewMemStore(),
+		deploymentPause: new(deploymentPause),
+	}
+	update := &datastore.UpdateInfo{ID: "my-id"}
+	as := NewUpdateAfterStoreState(update)
+
+	closed := &stateTestController{
+		closedWindows: map[string]bool{
+			datastore.UpdateControlMapInstallEnter: true,
+			deploymentRebootEnter:                  true,
+		},
+		retryIntvl: time.Millisecond,
+	}
+
+	// outside the install window; wait for it
+	s, c := as.Handle(ctx, closed)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+	ps := s.(*UpdateControlPauseState)
+	assert.Equal(t, as.Transition(), ps.Transition())
+
+	s, c = ps.Handle(ctx, closed)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+
+	// the window opens
+	s, c = ps.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.False(t, c)
+
+	// outside the reboot window; wait for it
+	s, c = s.Handle(ctx, closed)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+	ps = s.(*UpdateControlPauseState)
+	assert.Equal(t, deploymentRebootEnter, ps.point)
+
+	s, c = ps.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &UpdateRebootState{}, s)
+	assert.False(t, c)
+}
+
+func TestUpdateCommitConfirmation(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ctx := &StateContext{store: store.NewMemStore()}
+	update := &datastore.UpdateInfo{ID: "my-id"}
+	ars := NewUpdateAfterRebootState(update)
+
+	unconfirmed := &stateTestController{
+		unconfirmed: map[string]bool{
+			datastore.UpdateControlMapCommitEnter: true,
+		},
+		retryIntvl: time.Millisecond,
+	}
+
+	// waiting for a confirmation on the device
+	s, c := ars.Handle(ctx, unconfirmed)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+	ps := s.(*UpdateControlPauseState)
+	assert.Equal(t, datastore.UpdateControlMapCommitEnter, ps.point)
+
+	s, c = ps.Handle(ctx, unconfirmed)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+
+	// confirmed
+	s, c = ps.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, c)
+}
+
+func TestUpdateControlPauseDevicePolling(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ctx := &StateContext{
+		store:           store.NewMemStore(),
+		deploymentPause: new(deploymentPause),
+	}
+	update := &datastore.UpdateInfo{ID: "my-id"}
+	c := &stateTestController{
+		closedWindows: map[string]bool{
+			datastore.UpdateControlMapInstallEnter: true,
+		},
+		retryIntvl:      time.Millisecond,
+		updatePollIntvl: time.Hour,
+	}
+
+	s, _ := NewUpdateAfterStoreState(update).Handle(ctx, c)
+	require.IsType(t, &UpdateControlPauseState{}, s)
+
+	// Only the device holds the deployment; the map is not fetched again
+	// before the update poll interval has passed.
+	s, _ = s.Handle(ctx, c)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	s, _ = s.Handle(ctx, c)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.Equal(t, 1, c.controlMapCalls)
+
+	// The map is fetched again before the deployment continues.
+	c.closedWindows = nil
+	s, _ = s.Handle(ctx, c)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.Equal(t, 2, c.controlMapCalls)
+}
+
+func TestUpdateControlPauseRestore(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	ms := store.NewMemStore()
+	ctx := &StateContext{
+		store:           ms,
+		deploymentPause: new(deploymentPause),
+	}
+	update := &datastore.UpdateInfo{ID: "my-id"}
+	closed := &stateTestController{
+		closedWindows: map[string]bool{
+			datastore.UpdateControlMapInstallEnter: true,
+		},
+		retryIntvl: time.Millisecond,
+	}
+
+	as := NewUpdateAfterStoreState(update)
+	s, _ := as.Handle(ctx, closed)
+	require.IsType(t, &UpdateControlPauseState{}, s)
+	s, _ = s.Handle(ctx, closed)
+	require.IsType(t, &UpdateControlPauseState{}, s)
+
+	sd, err := LoadStateData(ms)
+	require.NoError(t, err)
+	assert.Equal(t, datastore.MenderStateUpdateControlPause, sd.Name)
+	assert.Equal(t, &datastore.UpdateControlPause{
+		Point: datastore.UpdateControlMapInstallEnter,
+		State: datastore.MenderStateUpdateAfterStore,
+	}, sd.UpdateInfo.UpdateControlPause)
+
+	// After a restart, the deployment is held at the same point.
+	s, _ = initState.Handle(ctx, closed)
+	require.IsType(t, &UpdateControlPauseState{}, s)
+	ps := s.(*UpdateControlPauseState)
+	assert.Equal(t, datastore.UpdateControlMapInstallEnter, ps.point)
+	assert.Equal(t, as.Transition(), ps.Transition())
+	assert.Equal(t, "my-id", ps.update.ID)
+	assert.Nil(t, ps.update.UpdateControlPause)
+
+	s, _ = ps.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &UpdateInstallState{}, s)
+
+	// Held before rebooting into the update.
+	update.UpdateControlPause = &datastore.UpdateControlPause{
+		Point: deploymentRebootEnter,
+		State: datastore.MenderStateUpdateInstall,
+	}
+	require.NoError(t, StoreStateData(ms, datastore.StateData{
+		Name:       datastore.MenderStateUpdateControlPause,
+		UpdateInfo: *update,
+	}))
+	s, _ = initState.Handle(ctx, closed)
+	require.IsType(t, &UpdateControlPauseState{}, s)
+	assert.Equal(t, ToArtifactInstall, s.Transition())
+	s, _ = s.Handle(ctx, &stateTestController{})
+	assert.IsType(t, &UpdateRebootState{}, s)
+
+	// A pause which can not be restored.
+	update.UpdateControlPause = &datastore.UpdateControlPause{
+		Point: datastore.UpdateControlMapDownloadEnter,
+		State: datastore.MenderStateCheckWait,
+	}
+	require.NoError(t, StoreStateData(ms, datastore.StateData{
+		Name:       datastore.MenderStateUpdateControlPause,
+		UpdateInfo: *update,
+	}))
+	s, _ = initState.Handle(ctx, closed)
+	assert.IsType(t, &UpdateErrorState{}, s)
+}
+
 func TestStateUpdateFetch(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
@@ -675,6 +1080,36 @@ func TestStateUpdateFetch(t *testing.T) {
 	}, ud)
 }
 
+func TestStateUpdateFetchProgress(t *testing.T) {
+	data := "test data"
+	sc := &stateTestController{
+		updater: fakeUpdater{
+			fetchUpdateReturnReadCloser: ioutil.NopCloser(bytes.NewBufferString(data)),
+			fetchUpdateReturnSize:       int64(len(data)),
+		},
+	}
+	ctx := StateContext{
+		store:            store.NewMemStore(),
+		downloadProgress: new(downloadProgress),
+		writeProgress:    new(writeProgress),
+	}
+	// Left from an earlier deployment.
+	ctx.writeProgress.ReportWriteProgress(100, 100)
+
+	s, _ := NewUpdateFetchState(&datastore.UpdateInfo{ID: "foobar"}).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateStoreState{}, s)
+	downloaded, total := ctx.downloadProgress.get()
+	assert.Equal(t, int64(0), downloaded)
+	assert.Equal(t, int64(len(data)), total)
+	_, total = ctx.writeProgress.get()
+	assert.Equal(t, int64(0), total)
+
+	_, err := ioutil.ReadAll(s.(*UpdateStoreState).imagein)
+	assert.NoError(t, err)
+	downloaded, _ = ctx.downloadProgress.get()
+	assert.Equal(t, int64(len(data)), downloaded)
+}
+
 func TestStateUpdateFetchRetry(t *testing.T) {
 	// pretend we have an update
 	update := &datastore.UpdateInfo{
@@ -738,7 +1173,7 @@ func TestStateUpdateStore(t *testing.T) {
 		},
 		SupportsRollback: datastore.RollbackSupported,
 	}
-	uis := NewUpdateStoreState(stream, update)
+	uis := NewUpdateStoreState(stream, -1, update)
 
 	ms := store.NewMemStore()
 	ctx := StateContext{
@@ -768,6 +1203,12 @@ func TestStateUpdateStore(t *testing.T) {
 		Name:       datastore.MenderStateUpdateStore,
 	}
 	newUpdate.UpdateInfo.StateDataStoreCount = 3
+	newUpdate.UpdateInfo.Artifact.Provides = map[string]string{
+		"artifact_name": "TestName",
+	}
+	newUpdate.UpdateInfo.Artifact.ClearsArtifactProvides = []string{
+		"artifact_group", "rootfs_image_checksum", "rootfs-image.*",
+	}
 	assert.Equal(t, newUpdate, ud)
 
 	// pretend update was aborted
@@ -778,6 +1219,130 @@ func TestStateUpdateStore(t *testing.T) {
 	assert.IsType(t, &UpdateStatusReportState{}, s)
 }
 
+func TestStateUpdateStoreInsufficientSpace(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName: "TestName",
+			PayloadTypes: []string{"rootfs-image"},
+		},
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		fakeDevice: fakeDevice{
+			consumeUpdate: true,
+			capacity:      1024,
+		},
+	}
+
+	stream, err := MakeRootfsImageArtifact(3, false)
+	require.NoError(t, err)
+	s, _ := NewUpdateStoreState(stream, 1024, update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateAfterStoreState{}, s)
+
+	// Retrying would not help.
+	stream, err = MakeRootfsImageArtifact(3, false)
+	require.NoError(t, err)
+	s, _ = NewUpdateStoreState(stream, 4096, update).Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCleanupState{}, s)
+	assert.Equal(t, client.StatusFailure, s.(*UpdateCleanupState).status)
+}
+
+func TestStateUpdateStoreResumesInterruptedWrite(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := &datastore.UpdateInfo{
+		ID: "foo",
+		Artifact: datastore.Artifact{
+			ArtifactName: "TestName",
+			PayloadTypes: []string{"rootfs-image"},
+		},
+	}
+	ctx := StateContext{
+		store: store.NewMemStore(),
+	}
+	sc := &stateTestController{
+		fakeDevice: fakeDevice{
+			consumeUpdate:  true,
+			canResumeStore: true,
+		},
+	}
+
+	// The artifact is fetched again to resume the write.
+	stream, err := MakeCorruptedRootfsImageArtifact(3, corruptTruncated)
+	require.NoError(t, err)
+	s, _ := NewUpdateStoreState(stream, -1, update).Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+
+	// Also after a restart.
+	s, _ = initState.Handle(&ctx, sc)
+	assert.IsType(t, &FetchStoreRetryState{}, s)
+
+	sc.fakeDevice.canResumeStore = false
+	s, _ = initState.Handle(&ctx, sc)
+	assert.IsType(t, &UpdateCleanupState{}, s)
+}
+
+func TestStateUpdateStoreCorruptedArtifact(t *testing.T) {
+	// create directory for storing deployments logs
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	tests := map[string]struct {
+		corruption artifactCorruption
+		next       State
+	}{
+		"bad checksum": {corruptChecksum, &UpdateCleanupState{}},
+		"truncated":    {corruptTruncated, &UpdateCleanupState{}},
+		"bad version":  {corruptVersion, &FetchStoreRetryState{}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			stream, err := MakeCorruptedRootfsImageArtifact(3, test.corruption)
+			require.NoError(t, err)
+
+			update := &datastore.UpdateInfo{
+				ID: "foo",
+				Artifact: datastore.Artifact{
+					ArtifactName: "TestName",
+					PayloadTypes: []string{"rootfs-image"},
+				},
+			}
+			uis := NewUpdateStoreState(stream, -1, update)
+
+			ctx := StateContext{
+				store: store.NewMemStore(),
+			}
+			sc := &stateTestController{
+				fakeDevice: fakeDevice{
+					consumeUpdate: true,
+				},
+			}
+
+			s, c := uis.Handle(&ctx, sc)
+			assert.IsType(t, test.next, s)
+			assert.False(t, c)
+			if cs, ok := s.(*UpdateCleanupState); ok {
+				// The failure is reported once cleaned up.
+				s, c = cs.Handle(&ctx, sc)
+				assert.IsType(t, &UpdateStatusReportState{}, s)
+				assert.False(t, c)
+				assert.Equal(t, client.StatusFailure, s.(*UpdateStatusReportState).status)
+			}
+		})
+	}
+}
+
 func TestStateWrongArtifactNameFromServer(t *testing.T) {
 	// create directory for storing deployments logs
 	tempDir, _ := ioutil.TempDir("", "logs")
@@ -795,7 +1360,7 @@ func TestStateWrongArtifactNameFromServer(t *testing.T) {
 		},
 		SupportsRollback: datastore.RollbackSupported,
 	}
-	uis := NewUpdateStoreState(stream, update)
+	uis := NewUpdateStoreState(stream, -1, update)
 
 	ms := store.NewMemStore()
 	ctx := StateContext{
@@ -825,7 +1390,7 @@ func TestStateUpdateInstallRetry(t *testing.T) {
 	}
 	data := "test"
 	stream := ioutil.NopCloser(bytes.NewBufferString(data))
-	uis := NewUpdateStoreState(stream, update)
+	uis := NewUpdateStoreState(stream, -1, update)
 	ms := store.NewMemStore()
 	ctx := StateContext{
 		store: ms,
@@ -1052,6 +1617,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1095,6 +1661,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1143,6 +1710,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1180,6 +1748,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Error_00",
 			"Cleanup",
@@ -1206,6 +1775,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Cleanup",
 		},
@@ -1234,6 +1804,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1271,6 +1842,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1308,6 +1880,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1348,6 +1921,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1391,6 +1965,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1444,6 +2019,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1493,6 +2069,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1548,6 +2125,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1599,6 +2177,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1651,6 +2230,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1709,6 +2289,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1764,6 +2345,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1822,6 +2404,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1882,6 +2465,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1934,6 +2518,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -1975,6 +2560,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2023,6 +2609,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2079,6 +2666,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2138,6 +2726,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2199,6 +2788,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2253,6 +2843,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2299,6 +2890,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2378,6 +2970,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2413,6 +3006,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2448,6 +3042,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2486,6 +3081,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2527,6 +3123,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2578,6 +3175,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2625,6 +3223,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2681,6 +3280,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2738,6 +3338,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2793,6 +3394,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2843,6 +3445,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2884,6 +3487,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2933,6 +3537,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -2992,6 +3597,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3044,6 +3650,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3089,6 +3696,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3130,6 +3738,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3160,6 +3769,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3191,6 +3801,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3231,6 +3842,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3274,6 +3886,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3324,6 +3937,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3376,6 +3990,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3434,6 +4049,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3489,6 +4105,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3546,6 +4163,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3605,6 +4223,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3663,6 +4282,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3716,6 +4336,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3758,6 +4379,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3807,6 +4429,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3858,6 +4481,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3905,6 +4529,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -3948,6 +4573,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -4010,6 +4636,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -4107,6 +4734,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -4170,6 +4798,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"Download_Error_00",
 			"Cleanup",
@@ -4199,6 +4828,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -4245,6 +4875,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -4302,6 +4933,7 @@ var stateTransitionsWithUpdateModulesTestCases []stateTransitionsWithUpdateModul
 		},
 		artifactStateChain: []string{
 			"Download_Enter_00",
+			"ProvidePayloadFileSizes",
 			"Download",
 			"SupportsRollback",
 			"Download_Leave_00",
@@ -0,0 +1,104 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+)
+
+// Substate reports are not sent more often than this, whatever the substate
+// report interval.
+const minSubstateReportInterval = 10 * time.Second
+
+// statusReportRecord is the last status reported for a deployment, and
+// whether the server acknowledged it.
+type statusReportRecord struct {
+	DeploymentID string
+	Status       string
+	Acknowledged bool
+}
+
+// isTerminalStatus returns whether the status ends the deployment, so that it
+// must reach the server even if the client restarts meanwhile.
+func isTerminalStatus(status string) bool {
+	switch status {
+	case client.StatusSuccess, client.StatusFailure, client.StatusAlreadyInstalled:
+		return true
+	}
+	return false
+}
+
+func loadStatusReportRecord(s store.Store) *statusReportRecord {
+	if s == nil {
+		return nil
+	}
+	data, err := s.ReadAll(datastore.StatusReportKey)
+	if err == os.ErrNotExist {
+		return nil
+	} else if err != nil {
+		log.Errorf("Could not read the last status report: %v", err)
+		return nil
+	}
+	record := &statusReportRecord{}
+	if err = json.Unmarshal(data, record); err != nil {
+		log.Errorf("Could not parse the last status report: %v", err)
+		return nil
+	}
+	return record
+}
+
+func storeStatusReportRecord(s store.Store, record *statusReportRecord) {
+	if s == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = s.WriteAll(datastore.StatusReportKey, data)
+	}
+	if err != nil {
+		log.Errorf("Could not store the status report: %v", err)
+	}
+}
+
+// substateLimiter drops substate reports which are identical to the last
+// one, or too soon after it.
+type substateLimiter struct {
+	lock         sync.Mutex
+	deploymentID string
+	status       string
+	substate     string
+	sent         time.Time
+}
+
+// allow returns whether the substate report may be sent, and if so, records
+// it as the last one.
+func (l *substateLimiter) allow(report client.StatusReport, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if report.DeploymentID == l.deploymentID && report.Status == l.status &&
+		(report.SubState == l.substate || now.Sub(l.sent) < minSubstateReportInterval) {
+		return false
+	}
+	l.deploymentID, l.status, l.substate = report.DeploymentID, report.Status, report.SubState
+	l.sent = now
+	return true
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubstateLimiter(t *testing.T) {
+	var l substateLimiter
+	now := time.Now()
+	report := client.StatusReport{
+		DeploymentID: "foo",
+		Status:       client.StatusDownloading,
+		SubState:     "downloading 10%",
+	}
+	assert.True(t, l.allow(report, now))
+	// identical
+	assert.False(t, l.allow(report, now.Add(time.Hour)))
+	// too soon
+	report.SubState = "downloading 20%"
+	assert.False(t, l.allow(report, now.Add(time.Second)))
+	assert.True(t, l.allow(report, now.Add(minSubstateReportInterval)))
+	// another status
+	report.Status = client.StatusInstalling
+	report.SubState = "installing for 1s"
+	assert.True(t, l.allow(report, now.Add(minSubstateReportInterval)))
+}
+
+func TestStatusReportAfterRestart(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(tempDir)
+	DeploymentLogger = NewDeploymentLogManager(tempDir)
+
+	update := datastore.UpdateInfo{ID: "foo"}
+	for _, name := range []datastore.MenderState{
+		datastore.MenderStateUpdateStatusReport,
+		datastore.MenderStatusReportRetryState,
+	} {
+		ms := store.NewMemStore()
+		ctx := &StateContext{store: ms}
+		require.NoError(t, StoreStateData(ms, datastore.StateData{
+			Name:       name,
+			UpdateInfo: update,
+		}))
+
+		// not acknowledged; reported again
+		storeStatusReportRecord(ms, &statusReportRecord{
+			DeploymentID: "foo",
+			Status:       client.StatusSuccess,
+		})
+		s, c := initState.Handle(ctx, &stateTestController{})
+		assert.False(t, c)
+		require.IsType(t, &UpdateStatusReportState{}, s)
+		assert.Equal(t, client.StatusSuccess, s.(*UpdateStatusReportState).status)
+
+		// acknowledged
+		storeStatusReportRecord(ms, &statusReportRecord{
+			DeploymentID: "foo",
+			Status:       client.StatusFailure,
+			Acknowledged: true,
+		})
+		s, _ = initState.Handle(ctx, &stateTestController{})
+		assert.Equal(t, idleState, s)
+
+		// of another deployment
+		storeStatusReportRecord(ms, &statusReportRecord{
+			DeploymentID: "bar",
+			Status:       client.StatusSuccess,
+		})
+		s, _ = initState.Handle(ctx, &stateTestController{})
+		assert.IsType(t, &UpdateErrorState{}, s)
+	}
+}
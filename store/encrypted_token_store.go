@@ -0,0 +1,121 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// EncryptedFileTokenStore keeps the token in a file, encrypted with
+// AES-256-GCM. The encryption key is the SHA-256 hash of the contents of a
+// key file, which is typically kept on secure or volatile storage.
+type EncryptedFileTokenStore struct {
+	path    string
+	keyPath string
+}
+
+func NewEncryptedFileTokenStore(path, keyPath string) *EncryptedFileTokenStore {
+	return &EncryptedFileTokenStore{
+		path:    path,
+		keyPath: keyPath,
+	}
+}
+
+func (e *EncryptedFileTokenStore) aead() (cipher.AEAD, error) {
+	key, err := ioutil.ReadFile(e.keyPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read token key file %s", e.keyPath)
+	}
+	if len(key) == 0 {
+		return nil, errors.Errorf("token key file %s is empty", e.keyPath)
+	}
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *EncryptedFileTokenStore) Load() ([]byte, error) {
+	data, err := ioutil.ReadFile(e.path)
+	if err != nil {
+		// Keep os.ErrNotExist recognizable.
+		return nil, err
+	}
+	aead, err := e.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.Errorf("encrypted token %s is truncated", e.path)
+	}
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	token, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt token %s", e.path)
+	}
+	return token, nil
+}
+
+func (e *EncryptedFileTokenStore) Save(token []byte) error {
+	aead, err := e.aead()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.Wrap(err, "failed to generate nonce")
+	}
+	return writeFileAtomically(e.path, aead.Seal(nonce, nonce, token, nil))
+}
+
+func (e *EncryptedFileTokenStore) Remove() error {
+	if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomically replaces the file at path with data, readable by the
+// owner only.
+func writeFileAtomically(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedFileTokenStore(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "tokenstore")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	keyPath := path.Join(tdir, "key")
+	tokenPath := path.Join(tdir, "authtoken")
+	require.NoError(t, ioutil.WriteFile(keyPath, []byte("secret"), 0600))
+
+	ts := NewEncryptedFileTokenStore(tokenPath, keyPath)
+	testTokenStore(t, ts)
+
+	assert.NoError(t, ts.Save([]byte("token")))
+	data, err := ioutil.ReadFile(tokenPath)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(data, []byte("token")))
+	info, err := os.Stat(tokenPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Wrong key.
+	require.NoError(t, ioutil.WriteFile(keyPath, []byte("other"), 0600))
+	_, err = ts.Load()
+	assert.Error(t, err)
+
+	// Missing key.
+	require.NoError(t, os.Remove(keyPath))
+	_, err = ts.Load()
+	assert.Error(t, err)
+	assert.Error(t, ts.Save([]byte("token")))
+
+	// Corrupted file.
+	require.NoError(t, ioutil.WriteFile(keyPath, []byte("secret"), 0600))
+	require.NoError(t, ioutil.WriteFile(tokenPath, []byte("abc"), 0600))
+	_, err = ts.Load()
+	assert.Error(t, err)
+}
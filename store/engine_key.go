@@ -0,0 +1,87 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// OpenSSLCommand is the openssl tool, run to use keys held by an OpenSSL
+// engine.
+var OpenSSLCommand = "openssl"
+
+// engineKey is a private key which never leaves the OpenSSL engine holding
+// it, typically a secure element; only its public key is known to the client.
+type engineKey struct {
+	engine string
+	keyID  string
+	public crypto.PublicKey
+}
+
+// NewEngineKeystore returns a keystore for the key with the given ID in the
+// OpenSSL engine, such as "ateccx08". The key can not be generated or saved by
+// the client; it has to be provisioned in the engine beforehand.
+func NewEngineKeystore(engine, keyID string) *Keystore {
+	return &Keystore{
+		keyName: keyID,
+		engine: &engineKey{
+			engine: engine,
+			keyID:  keyID,
+		},
+	}
+}
+
+func (e *engineKey) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(OpenSSLCommand, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s with engine %s failed: %s",
+			OpenSSLCommand, args[0], e.engine, stderr.String())
+	}
+	return out, nil
+}
+
+func (e *engineKey) load() error {
+	out, err := e.run(nil, "pkey", "-engine", e.engine, "-inform", "ENGINE",
+		"-in", e.keyID, "-pubout")
+	if err != nil {
+		return errors.Wrapf(err, "failed to load key %s", e.keyID)
+	}
+	block, _ := pem.Decode(out)
+	if block == nil {
+		return errors.Errorf("failed to decode public key %s from engine %s", e.keyID, e.engine)
+	}
+	e.public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	return errors.Wrapf(err, "failed to parse public key %s from engine %s", e.keyID, e.engine)
+}
+
+func (e *engineKey) sign(data []byte, hash crypto.Hash) ([]byte, error) {
+	if hash == 0 {
+		return nil, errors.Errorf("signing with key %s in engine %s needs a digest",
+			e.keyID, e.engine)
+	}
+	h := hash.New()
+	h.Write(data)
+	return e.run(h.Sum(nil), "pkeyutl", "-sign", "-engine", e.engine, "-keyform", "ENGINE",
+		"-inkey", e.keyID, "-pkeyopt", "digest:"+digestName(hash))
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A stand-in for openssl with an engine, which drops the engine arguments and
+// reads the key with the given ID from a PEM file in keyDir.
+const fakeOpenSSLEngine = `#!/bin/sh
+keyDir=$(dirname "$0")
+cmd="$1"; shift
+set -- "$@" --
+while [ "$1" != "--" ]; do
+	case "$1" in
+	-engine|-inform|-keyform)
+		shift 2 ;;
+	-in|-inkey)
+		set -- "$@" "$1" "$keyDir/$2.pem"; shift 2 ;;
+	*)
+		set -- "$@" "$1"; shift ;;
+	esac
+done
+shift
+exec openssl "$cmd" "$@"
+`
+
+func TestEngineKeystore(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is not available")
+	}
+
+	tdir, err := ioutil.TempDir("", "mendertest")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	command := path.Join(tdir, "openssl")
+	require.NoError(t, ioutil.WriteFile(command, []byte(fakeOpenSSLEngine), 0755))
+	old := OpenSSLCommand
+	defer func() { OpenSSLCommand = old }()
+	OpenSSLCommand = command
+
+	// Provision the "engine" with a key.
+	fileKeys := NewKeystore(NewDirStore(tdir), "slot0.pem")
+	require.NoError(t, fileKeys.Generate())
+	require.NoError(t, fileKeys.Save())
+
+	ks := NewEngineKeystore("fake", "slot0")
+	assert.False(t, ks.HasKey())
+	require.NoError(t, ks.Load())
+	assert.True(t, ks.HasKey())
+	assert.Nil(t, ks.Private())
+
+	pem, err := ks.PublicPEM()
+	require.NoError(t, err)
+	expected, err := fileKeys.PublicPEM()
+	require.NoError(t, err)
+	assert.Equal(t, expected, pem)
+
+	data := []byte("auth request")
+	sig, err := ks.Sign(data)
+	require.NoError(t, err)
+	sum := sha256.Sum256(data)
+	assert.NoError(t, rsa.VerifyPKCS1v15(ks.Public().(*rsa.PublicKey), crypto.SHA256, sum[:], sig))
+
+	// The key stays in the engine.
+	assert.NoError(t, ks.Save())
+	assert.Error(t, ks.Generate())
+
+	missing := NewEngineKeystore("fake", "slot1")
+	assert.Error(t, missing.Load())
+	assert.False(t, missing.HasKey())
+
+	// ECDSA keys sign the digest given in the key options.
+	ecKeys := NewKeystore(NewDirStore(tdir), "slot2.pem")
+	ecKeys.SetKeyOptions(KeyOptions{Type: KeyTypeECDSAP384})
+	require.NoError(t, ecKeys.Generate())
+	require.NoError(t, ecKeys.Save())
+
+	ks = NewEngineKeystore("fake", "slot2")
+	require.NoError(t, ks.Load())
+	algorithm, err := ks.SignatureAlgorithm()
+	require.NoError(t, err)
+	assert.Equal(t, "ecdsa-sha384", algorithm)
+	sig, err = ks.Sign(data)
+	require.NoError(t, err)
+	assert.NoError(t, ecKeys.Verify(data, sig))
+}
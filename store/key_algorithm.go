@@ -0,0 +1,174 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+	"encoding/asn1"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// Types of device keys.
+const (
+	KeyTypeRSA       = "rsa"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeECDSAP384 = "ecdsa-p384"
+	KeyTypeEd25519   = "ed25519"
+)
+
+// Ed25519 keys are in the standard library from Go 1.13.
+var errNoEd25519 = errors.New("ed25519 keys need a client built with Go 1.13 or newer")
+
+// KeyOptions select the type of the keys generated by a Keystore, and the
+// digest signed with them.
+type KeyOptions struct {
+	// One of the KeyType constants; KeyTypeRSA if empty. Keys which
+	// already exist are used whatever their type.
+	Type string
+	// Digest signed with RSA and ECDSA keys; if zero, SHA-384 for P-384
+	// keys and SHA-256 for the others. Ed25519 keys sign the data itself.
+	Digest crypto.Hash
+}
+
+// ParseKeyOptions checks the names of a key type and a digest ("sha256",
+// "sha384" or "sha512"), which are the defaults if empty.
+func ParseKeyOptions(keyType, digest string) (KeyOptions, error) {
+	opts := KeyOptions{Type: keyType}
+	switch keyType {
+	case "", KeyTypeRSA, KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeEd25519:
+	default:
+		return opts, errors.Errorf("unknown key type %q", keyType)
+	}
+	switch digest {
+	case "":
+	case "sha256":
+		opts.Digest = crypto.SHA256
+	case "sha384":
+		opts.Digest = crypto.SHA384
+	case "sha512":
+		opts.Digest = crypto.SHA512
+	default:
+		return opts, errors.Errorf("unknown digest %q", digest)
+	}
+	return opts, nil
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "", KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, RsaKeyLength)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		return generateEd25519Key()
+	default:
+		return nil, errors.Errorf("unknown key type %q", keyType)
+	}
+}
+
+// signatureDigest returns the digest signed with the key, which is zero for
+// keys signing the data itself.
+func signatureDigest(public crypto.PublicKey, digest crypto.Hash) (crypto.Hash, error) {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		if digest == 0 && key.Curve == elliptic.P384() {
+			return crypto.SHA384, nil
+		}
+	default:
+		if isEd25519Key(public) {
+			return 0, nil
+		}
+		return 0, errors.Errorf("unsupported key type %T", public)
+	}
+	if digest == 0 {
+		return crypto.SHA256, nil
+	}
+	return digest, nil
+}
+
+// signatureAlgorithm names the algorithm of the signatures made with the key,
+// such as "ecdsa-sha384".
+func signatureAlgorithm(public crypto.PublicKey, digest crypto.Hash) (string, error) {
+	hash, err := signatureDigest(public, digest)
+	if err != nil {
+		return "", err
+	}
+	switch public.(type) {
+	case *rsa.PublicKey:
+		return "rsa-pkcs1v15-" + digestName(hash), nil
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + digestName(hash), nil
+	default:
+		return KeyTypeEd25519, nil
+	}
+}
+
+func digestName(hash crypto.Hash) string {
+	switch hash {
+	case crypto.SHA384:
+		return "sha384"
+	case crypto.SHA512:
+		return "sha512"
+	default:
+		return "sha256"
+	}
+}
+
+// Verify checks a signature made by the private key of public, with the given
+// digest as in KeyOptions.
+func Verify(public crypto.PublicKey, digest crypto.Hash, data, sig []byte) error {
+	hash, err := signatureDigest(public, digest)
+	if err != nil {
+		return err
+	}
+	var sum []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(data)
+		sum = h.Sum(nil)
+	}
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, sum, sig)
+	case *ecdsa.PublicKey:
+		if !verifyECDSA(key, sum, sig) {
+			return errors.New("ecdsa: verification error")
+		}
+		return nil
+	default:
+		return verifyEd25519(public, data, sig)
+	}
+}
+
+// verifyECDSA checks an ASN.1 encoded ECDSA signature.
+func verifyECDSA(key *ecdsa.PublicKey, sum, sig []byte) bool {
+	var rs struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(sig, &rs); err != nil || len(rest) != 0 {
+		return false
+	}
+	return ecdsa.Verify(key, sum, rs.R, rs.S)
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// +build go1.13
+
+package store
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+
+	"github.com/pkg/errors"
+)
+
+func generateEd25519Key() (crypto.Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+func isEd25519Key(public crypto.PublicKey) bool {
+	_, ok := public.(ed25519.PublicKey)
+	return ok
+}
+
+func verifyEd25519(public crypto.PublicKey, data, sig []byte) error {
+	key, ok := public.(ed25519.PublicKey)
+	if !ok || !ed25519.Verify(key, data, sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
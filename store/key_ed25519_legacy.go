@@ -0,0 +1,33 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// +build !go1.13
+
+package store
+
+import (
+	"crypto"
+)
+
+func generateEd25519Key() (crypto.Signer, error) {
+	return nil, errNoEd25519
+}
+
+func isEd25519Key(public crypto.PublicKey) bool {
+	return false
+}
+
+func verifyEd25519(public crypto.PublicKey, data, sig []byte) error {
+	return errNoEd25519
+}
@@ -38,15 +38,18 @@ var (
 
 type Keystore struct {
 	store   Store
-	private *rsa.PrivateKey
+	private crypto.Signer
 	keyName string
+	options KeyOptions
+	// Set if the key is held by an OpenSSL engine.
+	engine *engineKey
 }
 
 func (k *Keystore) GetStore() Store {
 	return k.store
 }
 
-func (k *Keystore) GetPrivateKey() *rsa.PrivateKey {
+func (k *Keystore) GetPrivateKey() crypto.Signer {
 	return k.private
 }
 
@@ -65,7 +68,16 @@ func NewKeystore(store Store, name string) *Keystore {
 	}
 }
 
+// SetKeyOptions sets the type of the keys generated, and the digest signed.
+func (k *Keystore) SetKeyOptions(opts KeyOptions) {
+	k.options = opts
+}
+
 func (k *Keystore) Load() error {
+	if k.engine != nil {
+		return k.engine.load()
+	}
+
 	inf, err := k.store.OpenRead(k.keyName)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -87,6 +99,10 @@ func (k *Keystore) Load() error {
 }
 
 func (k *Keystore) Save() error {
+	if k.engine != nil {
+		// The key is kept by the engine.
+		return nil
+	}
 	if k.private == nil {
 		return errNoKeys
 	}
@@ -111,7 +127,11 @@ func (k *Keystore) Save() error {
 }
 
 func (k *Keystore) Generate() error {
-	key, err := rsa.GenerateKey(rand.Reader, RsaKeyLength)
+	if k.engine != nil {
+		return errors.Errorf("keys in OpenSSL engine %s must be provisioned "+
+			"before the client is started", k.engine.engine)
+	}
+	key, err := generateKey(k.options.Type)
 	if err != nil {
 		return err
 	}
@@ -121,11 +141,22 @@ func (k *Keystore) Generate() error {
 	return nil
 }
 
-func (k *Keystore) Private() *rsa.PrivateKey {
+func (k *Keystore) Private() crypto.Signer {
 	return k.private
 }
 
+// HasKey tells whether the keystore has a private key to sign with.
+func (k *Keystore) HasKey() bool {
+	if k.engine != nil {
+		return k.engine.public != nil
+	}
+	return k.private != nil
+}
+
 func (k *Keystore) Public() crypto.PublicKey {
+	if k.engine != nil {
+		return k.engine.public
+	}
 	if k.private != nil {
 		return k.private.Public()
 	}
@@ -150,20 +181,53 @@ func (k *Keystore) PublicPEM() (string, error) {
 	return buf.String(), nil
 }
 
+// Sign signs the data with the digest set in the key options; ed25519 keys
+// sign the data itself.
 func (k *Keystore) Sign(data []byte) ([]byte, error) {
-	hash := crypto.SHA256
+	if !k.HasKey() {
+		return nil, errNoKeys
+	}
+	hash, err := signatureDigest(k.Public(), k.options.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.engine != nil {
+		return k.engine.sign(data, hash)
+	}
+
+	if hash == 0 {
+		return k.private.Sign(rand.Reader, data, hash)
+	}
 	h := hash.New()
 	h.Write(data)
 	sum := h.Sum(nil)
 
-	return rsa.SignPKCS1v15(rand.Reader, k.private, hash, sum)
+	return k.private.Sign(rand.Reader, sum, hash)
+}
+
+// Verify checks a signature made with Sign.
+func (k *Keystore) Verify(data, sig []byte) error {
+	if !k.HasKey() {
+		return errNoKeys
+	}
+	return Verify(k.Public(), k.options.Digest, data, sig)
+}
+
+// SignatureAlgorithm names the algorithm of the signatures made with Sign,
+// such as "rsa-pkcs1v15-sha256", "ecdsa-sha384" or "ed25519".
+func (k *Keystore) SignatureAlgorithm() (string, error) {
+	if !k.HasKey() {
+		return "", errNoKeys
+	}
+	return signatureAlgorithm(k.Public(), k.options.Digest)
 }
 
 func IsNoKeys(e error) bool {
 	return e == errNoKeys
 }
 
-func loadFromPem(in io.Reader) (*rsa.PrivateKey, error) {
+func loadFromPem(in io.Reader) (crypto.Signer, error) {
 	data, err := ioutil.ReadAll(in)
 	if err != nil {
 		return nil, err
@@ -176,20 +240,47 @@ func loadFromPem(in io.Reader) (*rsa.PrivateKey, error) {
 
 	log.Debugf("block type: %s", block.Type)
 
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	default:
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
 	}
-
-	return key, nil
 }
 
-func saveToPem(out io.Writer, key *rsa.PrivateKey) error {
-	data := x509.MarshalPKCS1PrivateKey(key)
+func saveToPem(out io.Writer, key crypto.Signer) error {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		// RSA keys are kept in PKCS1, which older clients read.
+		return pem.Encode(out, &pem.Block{
+			Type:  "RSA PRIVATE KEY", // PKCS1
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		})
+	}
 
-	err := pem.Encode(out, &pem.Block{
-		Type:  "RSA PRIVATE KEY", // PKCS1
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal private key")
+	}
+	return pem.Encode(out, &pem.Block{
+		Type:  "PRIVATE KEY", // PKCS8
 		Bytes: data,
 	})
-	return err
 }
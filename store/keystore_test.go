@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -139,11 +140,77 @@ func TestKeystore(t *testing.T) {
 	h.Write(tosigndata)
 	hashed := h.Sum(nil)
 
-	err = rsa.VerifyPKCS1v15(&k.private.PublicKey, crypto.SHA256, hashed, s)
+	err = rsa.VerifyPKCS1v15(k.Public().(*rsa.PublicKey), crypto.SHA256, hashed, s)
 	// signature should be valid
 	assert.NoError(t, err)
 }
 
+func TestKeystoreKeyTypes(t *testing.T) {
+	tcs := []struct {
+		opts      KeyOptions
+		pemType   string
+		algorithm string
+	}{
+		{KeyOptions{}, "RSA PRIVATE KEY", "rsa-pkcs1v15-sha256"},
+		{KeyOptions{Type: KeyTypeRSA, Digest: crypto.SHA512}, "RSA PRIVATE KEY", "rsa-pkcs1v15-sha512"},
+		{KeyOptions{Type: KeyTypeECDSAP256}, "PRIVATE KEY", "ecdsa-sha256"},
+		{KeyOptions{Type: KeyTypeECDSAP384}, "PRIVATE KEY", "ecdsa-sha384"},
+		{KeyOptions{Type: KeyTypeECDSAP384, Digest: crypto.SHA512}, "PRIVATE KEY", "ecdsa-sha512"},
+		{KeyOptions{Type: KeyTypeEd25519}, "PRIVATE KEY", "ed25519"},
+		// Ed25519 keys sign the data, not a digest.
+		{KeyOptions{Type: KeyTypeEd25519, Digest: crypto.SHA384}, "PRIVATE KEY", "ed25519"},
+	}
+
+	for _, tc := range tcs {
+		ms := NewMemStore()
+		k := NewKeystore(ms, "key")
+		k.SetKeyOptions(tc.opts)
+		err := k.Generate()
+		if err == errNoEd25519 {
+			continue
+		}
+		require.NoError(t, err, tc.algorithm)
+		require.NoError(t, k.Save())
+
+		data, err := ms.ReadAll("key")
+		require.NoError(t, err)
+		block, _ := pem.Decode(data)
+		require.NotNil(t, block)
+		assert.Equal(t, tc.pemType, block.Type)
+
+		// Keys of any type are loaded, whatever the options.
+		loaded := NewKeystore(ms, "key")
+		require.NoError(t, loaded.Load())
+		loaded.SetKeyOptions(KeyOptions{Digest: tc.opts.Digest})
+
+		algorithm, err := loaded.SignatureAlgorithm()
+		require.NoError(t, err)
+		assert.Equal(t, tc.algorithm, algorithm)
+
+		sig, err := loaded.Sign([]byte("foobar"))
+		require.NoError(t, err)
+		assert.NoError(t, k.Verify([]byte("foobar"), sig), tc.algorithm)
+		assert.Error(t, k.Verify([]byte("foobaz"), sig), tc.algorithm)
+		_, err = loaded.PublicPEM()
+		assert.NoError(t, err)
+	}
+}
+
+func TestParseKeyOptions(t *testing.T) {
+	opts, err := ParseKeyOptions("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, KeyOptions{}, opts)
+
+	opts, err = ParseKeyOptions(KeyTypeECDSAP256, "sha384")
+	assert.NoError(t, err)
+	assert.Equal(t, KeyOptions{Type: KeyTypeECDSAP256, Digest: crypto.SHA384}, opts)
+
+	_, err = ParseKeyOptions("dsa", "")
+	assert.Error(t, err)
+	_, err = ParseKeyOptions(KeyTypeRSA, "md5")
+	assert.Error(t, err)
+}
+
 func TestKeystoreLoadPem(t *testing.T) {
 	// this should fail
 	nk, err := loadFromPem(bytes.NewBufferString(badPrivKey))
@@ -0,0 +1,77 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// SystemdCredsCommand is the systemd-creds tool, run to encrypt and decrypt
+// tokens.
+var SystemdCredsCommand = "systemd-creds"
+
+const systemdCredName = "mender-authtoken"
+
+// SystemdCredsTokenStore keeps the token in a credential file encrypted by
+// systemd-creds, with the TPM2 chip of the device and/or the host key of
+// systemd.
+type SystemdCredsTokenStore struct {
+	path string
+}
+
+func NewSystemdCredsTokenStore(path string) *SystemdCredsTokenStore {
+	return &SystemdCredsTokenStore{
+		path: path,
+	}
+}
+
+func (s *SystemdCredsTokenStore) run(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(SystemdCredsCommand, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s failed: %s",
+			SystemdCredsCommand, args[0], stderr.String())
+	}
+	return out, nil
+}
+
+func (s *SystemdCredsTokenStore) Load() ([]byte, error) {
+	if _, err := os.Stat(s.path); err != nil {
+		// Keep os.ErrNotExist recognizable.
+		return nil, err
+	}
+	return s.run(nil, "decrypt", "--name="+systemdCredName, s.path, "-")
+}
+
+func (s *SystemdCredsTokenStore) Save(token []byte) error {
+	sealed, err := s.run(token, "encrypt", "--name="+systemdCredName, "-", "-")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.path, sealed)
+}
+
+func (s *SystemdCredsTokenStore) Remove() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A stand-in for systemd-creds, "encrypting" by reversing the bytes.
+const fakeSystemdCreds = `#!/bin/sh
+case "$1" in
+encrypt)
+	[ "$2" = "--name=mender-authtoken" ] || exit 1
+	rev ;;
+decrypt)
+	[ "$2" = "--name=mender-authtoken" ] || exit 1
+	rev < "$3" ;;
+*)
+	exit 1 ;;
+esac
+`
+
+func TestSystemdCredsTokenStore(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "tokenstore")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	command := path.Join(tdir, "systemd-creds")
+	require.NoError(t, ioutil.WriteFile(command, []byte(fakeSystemdCreds), 0755))
+	old := SystemdCredsCommand
+	defer func() { SystemdCredsCommand = old }()
+	SystemdCredsCommand = command
+
+	tokenPath := path.Join(tdir, "authtoken.cred")
+	ts := NewSystemdCredsTokenStore(tokenPath)
+	testTokenStore(t, ts)
+
+	assert.NoError(t, ts.Save([]byte("token\n")))
+	data, err := ioutil.ReadFile(tokenPath)
+	require.NoError(t, err)
+	assert.Equal(t, "nekot\n", string(data))
+
+	SystemdCredsCommand = path.Join(tdir, "does-not-exist")
+	_, err = ts.Load()
+	assert.Error(t, err)
+	assert.Error(t, ts.Save([]byte("token")))
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"os"
+	"sync"
+)
+
+// TokenStore keeps the authentication token of the client. Devices with a
+// read-only root file system, or with secure storage, may keep the token
+// apart from the rest of the client data.
+//
+// Load returns os.ErrNotExist if no token is stored.
+type TokenStore interface {
+	Load() ([]byte, error)
+	Save(token []byte) error
+	Remove() error
+}
+
+// entryTokenStore keeps the token in an entry of a Store.
+type entryTokenStore struct {
+	store Store
+	name  string
+}
+
+// NewEntryTokenStore returns a TokenStore keeping the token in the named
+// entry of the store.
+func NewEntryTokenStore(store Store, name string) TokenStore {
+	return &entryTokenStore{
+		store: store,
+		name:  name,
+	}
+}
+
+func (e *entryTokenStore) Load() ([]byte, error) {
+	return e.store.ReadAll(e.name)
+}
+
+func (e *entryTokenStore) Save(token []byte) error {
+	return e.store.WriteAll(e.name, token)
+}
+
+func (e *entryTokenStore) Remove() error {
+	return e.store.Remove(e.name)
+}
+
+// MemTokenStore keeps the token in memory only, so that the client has to
+// authorize again after every restart.
+type MemTokenStore struct {
+	lock  sync.Mutex
+	token []byte
+}
+
+func NewMemTokenStore() *MemTokenStore {
+	return &MemTokenStore{}
+}
+
+func (m *MemTokenStore) Load() ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.token == nil {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte{}, m.token...), nil
+}
+
+func (m *MemTokenStore) Save(token []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.token = append([]byte{}, token...)
+	return nil
+}
+
+func (m *MemTokenStore) Remove() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.token = nil
+	return nil
+}
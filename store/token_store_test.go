@@ -0,0 +1,64 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTokenStore runs the common checks of a token store.
+func testTokenStore(t *testing.T, ts TokenStore) {
+	_, err := ts.Load()
+	assert.True(t, os.IsNotExist(err), "%v", err)
+
+	assert.NoError(t, ts.Save([]byte("token1")))
+	token, err := ts.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("token1"), token)
+
+	assert.NoError(t, ts.Save([]byte("token2")))
+	token, err = ts.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("token2"), token)
+
+	assert.NoError(t, ts.Remove())
+	_, err = ts.Load()
+	assert.True(t, os.IsNotExist(err), "%v", err)
+}
+
+func TestEntryTokenStore(t *testing.T) {
+	ms := NewMemStore()
+	ts := NewEntryTokenStore(ms, "authtoken")
+	testTokenStore(t, ts)
+
+	assert.NoError(t, ts.Save([]byte("token")))
+	data, err := ms.ReadAll("authtoken")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("token"), data)
+}
+
+func TestMemTokenStore(t *testing.T) {
+	ts := NewMemTokenStore()
+	testTokenStore(t, ts)
+
+	// The stored token is a copy.
+	token := []byte("token")
+	assert.NoError(t, ts.Save(token))
+	token[0] = 'T'
+	loaded, _ := ts.Load()
+	assert.Equal(t, []byte("token"), loaded)
+}
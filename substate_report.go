@@ -0,0 +1,122 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/datastore"
+)
+
+// substateHeartbeat periodically reports what the device is doing during a
+// long running phase of a deployment, so that the server does not see the
+// device as silent until the phase is over.
+type substateHeartbeat struct {
+	stop    chan struct{}
+	done    chan struct{}
+	aborted int32
+}
+
+// startSubstateHeartbeat starts reporting the given status, together with the
+// substate returned by the substate function, at the substate report interval
+// of the controller. Nothing is reported if the interval is 0. If a report
+// tells that the deployment was aborted, the reports stop and abort, if not
+// nil, is called to interrupt the phase.
+func startSubstateHeartbeat(c Controller, update *datastore.UpdateInfo,
+	status string, substate func() string, abort func()) *substateHeartbeat {
+
+	h := &substateHeartbeat{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	interval := c.GetSubstateReportInterval()
+	if interval <= 0 {
+		close(h.done)
+		return h
+	}
+
+	// The update keeps changing in the state machine; only its ID is needed
+	// for the reports.
+	report := datastore.UpdateInfo{ID: update.ID}
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+				err := c.ReportUpdateSubstate(&report, status, substate())
+				if err != nil && err.IsFatal() {
+					log.Errorf("Deployment aborted: %s", err.Error())
+					atomic.StoreInt32(&h.aborted, 1)
+					if abort != nil {
+						abort()
+					}
+					return
+				} else if err != nil {
+					log.Warnf("Failed to report the deployment substate: %s", err.Error())
+				}
+			}
+		}
+	}()
+	return h
+}
+
+// Stop stops the reports and waits for any report in progress.
+func (h *substateHeartbeat) Stop() {
+	close(h.stop)
+	<-h.done
+}
+
+// Aborted returns whether a report told that the deployment was aborted.
+func (h *substateHeartbeat) Aborted() bool {
+	return atomic.LoadInt32(&h.aborted) != 0
+}
+
+// elapsedSubstate returns a substate function describing the given activity
+// and how long it has been going on.
+func elapsedSubstate(activity string) func() string {
+	start := time.Now()
+	return func() string {
+		return fmt.Sprintf("%s for %s", activity,
+			time.Since(start).Truncate(time.Second))
+	}
+}
+
+// downloadSubstate returns a substate function describing the download
+// progress, as a percentage if the size of the artifact is known. As updates
+// are written while they are downloaded, the progress of writing the update
+// to the inactive partition is included once it has started.
+func downloadSubstate(progress *downloadProgress, write *writeProgress) func() string {
+	elapsed := elapsedSubstate("downloading")
+	return func() string {
+		substate := elapsed()
+		if progress != nil {
+			if downloaded, total := progress.get(); total > 0 {
+				substate = fmt.Sprintf("downloading %d%%", downloaded*100/total)
+			}
+		}
+		if write != nil {
+			if written, total := write.get(); total > 0 {
+				substate += fmt.Sprintf(", written %d%%", written*100/total)
+			}
+		}
+		return substate
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubstateHeartbeat(t *testing.T) {
+	update := &datastore.UpdateInfo{ID: "foobar"}
+
+	// Disabled.
+	c := &stateTestController{substates: make(chan string, 10)}
+	h := startSubstateHeartbeat(c, update, "installing", func() string {
+		return "busy"
+	}, nil)
+	time.Sleep(10 * time.Millisecond)
+	h.Stop()
+	assert.Len(t, c.substates, 0)
+
+	c = &stateTestController{
+		substateIntvl: time.Millisecond,
+		substates:     make(chan string, 10),
+	}
+	h = startSubstateHeartbeat(c, update, "installing", func() string {
+		return "busy"
+	}, nil)
+	assert.Equal(t, "installing: busy", <-c.substates)
+	assert.Equal(t, "installing: busy", <-c.substates)
+	h.Stop()
+	assert.False(t, h.Aborted())
+
+	// Aborted on the server.
+	c.reportError = NewFatalError(client.ErrDeploymentAborted)
+	aborted := make(chan struct{})
+	h = startSubstateHeartbeat(c, update, "downloading", func() string {
+		return "busy"
+	}, func() { close(aborted) })
+	<-aborted
+	h.Stop()
+	assert.True(t, h.Aborted())
+}
+
+func TestSubstates(t *testing.T) {
+	assert.Regexp(t, "^installing for [0-9]+s$", elapsedSubstate("installing")())
+
+	progress := new(downloadProgress)
+	write := new(writeProgress)
+	substate := downloadSubstate(progress, write)
+	assert.Regexp(t, "^downloading for [0-9]+s$", substate())
+
+	progress.start(200)
+	progress.downloaded = 84
+	assert.Equal(t, "downloading 42%", substate())
+
+	write.ReportWriteProgress(30, 100)
+	assert.Equal(t, "downloading 42%, written 30%", substate())
+
+	assert.Regexp(t, "^downloading for [0-9]+s$", downloadSubstate(nil, nil)())
+}
+
+func TestUpdateControlPauseSubstate(t *testing.T) {
+	update := &datastore.UpdateInfo{
+		ID: "foobar",
+		UpdateControlMap: &datastore.UpdateControlMap{
+			ID: "map-id",
+			States: map[string]datastore.UpdateControlMapState{
+				datastore.UpdateControlMapInstallEnter: {
+					Action: datastore.UpdateControlMapActionPause,
+				},
+			},
+		},
+	}
+	c := &stateTestController{
+		controlMap:      update.UpdateControlMap,
+		updatePollIntvl: time.Millisecond,
+		retryIntvl:      time.Millisecond,
+		substateIntvl:   time.Hour,
+		substates:       make(chan string, 10),
+	}
+	ctx := &StateContext{store: store.NewMemStore()}
+
+	s := NewUpdateControlPauseState(NewUpdateStoreState(nil, -1, update), update,
+		datastore.UpdateControlMapInstallEnter, NewUpdateInstallState,
+		func(*StateContext, Controller, menderError) (State, bool) {
+			return idleState, false
+		})
+
+	// Reported when paused, and not again before the interval has passed.
+	s.Handle(ctx, c)
+	s.Handle(ctx, c)
+	assert.Len(t, c.substates, 1)
+	assert.Equal(t, "downloading: paused at ArtifactInstall_Enter by the update control map",
+		<-c.substates)
+
+	c.substateIntvl = time.Nanosecond
+	ctx.deploymentPause = new(deploymentPause)
+	ctx.deploymentPause.set(true)
+	c.controlMap = &datastore.UpdateControlMap{ID: "map-id"}
+	s.Handle(ctx, c)
+	assert.Equal(t, "downloading: paused at ArtifactInstall_Enter on the device",
+		<-c.substates)
+}
@@ -0,0 +1,390 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/store"
+	"github.com/pkg/errors"
+)
+
+// journalctlCommand is run to get the recent log of the client; needed so that
+// we can override it when testing.
+var journalctlCommand = []string{"journalctl", "--unit", "mender", "--no-pager", "--lines", "2000"}
+
+const (
+	// Number of deployment logs, newest first, put in a support bundle.
+	supportBundleMaxDeploymentLogs = 5
+	// How long to wait for each server when testing connectivity.
+	supportBundleConnectTimeout = 10 * time.Second
+
+	redacted = "<redacted>"
+)
+
+// Database keys put in a support bundle. The auth token is left out on
+// purpose.
+var supportBundleStateKeys = []string{
+	datastore.ArtifactNameKey,
+	datastore.ArtifactProvidesKey,
+	datastore.StateDataKey,
+	datastore.StateDataKeyUncommitted,
+	datastore.StandaloneStateKey,
+	datastore.DeploymentHistoryKey,
+	datastore.WriteThroughputKey,
+	datastore.InventoryKey,
+	datastore.StatusReportKey,
+	datastore.OfflineDeploymentKey,
+}
+
+// Values of configuration options and state fields with matching names are
+// replaced by redacted. Options such as AuthTokenStore only name where a
+// secret is kept, and are left alone.
+var sensitiveNamePattern = regexp.MustCompile(`(?i)(token|password|secret|passphrase)$`)
+
+// Patterns of secrets in log lines, and what they are replaced by: the query
+// strings of URLs, which may be signed, bearer tokens and JWTs, and the values
+// following sensitive names, as in "TenantToken": "..." or password=....
+var sensitiveLogPatterns = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile(`(\w+://[^\s"'?]*\?)[^\s"']*`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)(bearer\s+)[\w.~+/=-]+`), "${1}" + redacted},
+	{regexp.MustCompile(`eyJ[\w-]*\.[\w-]+\.[\w-]*`), redacted},
+	{regexp.MustCompile(`(?i)((?:token|password|secret|passphrase)(?:\\?["'])?` +
+		`(?:\s*=\s*(?:\\?["'])?|\s*:\s*\\?["']))[^\s"'\\,&;}]+`),
+		"${1}" + redacted},
+}
+
+type supportBundleSummary struct {
+	Version string    `json:"version"`
+	Created time.Time `json:"created"`
+	// Parts of the bundle which could not be collected, and why.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type connectivityResult struct {
+	ServerURL  string   `json:"server_url"`
+	Addresses  []string `json:"addresses,omitempty"`
+	StatusCode int      `json:"status_code,omitempty"`
+	DurationMs int64    `json:"duration_ms"`
+	Error      string   `json:"error,omitempty"`
+}
+
+type supportBundle struct {
+	tw      *tar.Writer
+	summary supportBundleSummary
+}
+
+// doSupportBundle collects the configuration, state, recent logs, partition
+// and boot environment information of the device, and the result of
+// connecting to the servers, into a gzipped tarball at out, for attaching to
+// support tickets. Tokens, passwords and signed URLs are redacted. Parts which
+// can not be collected are listed in summary.json, rather than failing the
+// whole bundle.
+func doSupportBundle(out string, opts *runOptionsType, config *menderConfig,
+	env installer.BootEnvReadWriter, device installer.DualRootfsDevice) error {
+
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "can not create support bundle %s", out)
+	}
+	gz := gzip.NewWriter(f)
+	b := &supportBundle{
+		tw: tar.NewWriter(gz),
+		summary: supportBundleSummary{
+			Version: VersionString(),
+			Created: time.Now().UTC(),
+			Errors:  make(map[string]string),
+		},
+	}
+
+	b.collectConfig(*opts.config, *opts.fallbackConfig)
+	b.collectState(*opts.dataStore)
+	b.collectLogs(*opts.dataStore)
+	b.collectDevice(env, device)
+	b.collectConnectivity(config)
+
+	err = b.addJSON("summary.json", &b.summary)
+	if err == nil {
+		err = b.tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return errors.Wrapf(err, "can not write support bundle %s", out)
+	}
+	fmt.Printf("Support bundle written to %s\n", out)
+	return nil
+}
+
+func (b *supportBundle) add(name string, data []byte) error {
+	err := b.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: b.summary.Created,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = b.tw.Write(data)
+	return err
+}
+
+func (b *supportBundle) addJSON(name string, v interface{}) error {
+	// Keep redacted readable.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return b.add(name, buf.Bytes())
+}
+
+func (b *supportBundle) fail(part string, err error) {
+	b.summary.Errors[part] = err.Error()
+}
+
+// collectConfig adds the configuration files, redacted. Files which do not
+// exist are skipped.
+func (b *supportBundle) collectConfig(files ...string) {
+	for i, file := range files {
+		name := "config/mender.conf"
+		if i > 0 {
+			name = "config/fallback-mender.conf"
+		}
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			b.fail(name, err)
+			continue
+		}
+		var conf interface{}
+		if err = json.Unmarshal(data, &conf); err != nil {
+			// Leave it out; there is no telling what an
+			// unparsable file contains.
+			b.fail(name, errors.Wrapf(err, "can not parse %s", file))
+			continue
+		}
+		if err = b.addJSON(name, redactJSON(conf)); err != nil {
+			b.fail(name, err)
+		}
+	}
+}
+
+// collectState adds the state kept in the database, redacted.
+func (b *supportBundle) collectState(dataStore string) {
+	db := store.NewDBStore(dataStore)
+	if db == nil {
+		b.fail("state", errors.New("failed to open the database"))
+		return
+	}
+	defer db.Close()
+
+	for _, key := range supportBundleStateKeys {
+		name := "state/" + key + ".json"
+		data, err := db.ReadAll(key)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			b.fail(name, err)
+			continue
+		}
+		var value interface{}
+		if json.Unmarshal(data, &value) != nil {
+			// Not all keys are JSON; the artifact name is a plain
+			// string.
+			value = string(data)
+		}
+		if err = b.addJSON(name, redactJSON(value)); err != nil {
+			b.fail(name, err)
+		}
+	}
+}
+
+// collectLogs adds the most recent deployment logs, and the recent log of the
+// client from the journal, redacted.
+func (b *supportBundle) collectLogs(dataStore string) {
+	logs, err := filepath.Glob(filepath.Join(dataStore, baseLogFileName+".*.log"))
+	if err != nil {
+		b.fail("logs", err)
+		return
+	}
+	// The sequence number in the name is 1 for the newest log.
+	sort.Strings(logs)
+	if len(logs) > supportBundleMaxDeploymentLogs {
+		logs = logs[:supportBundleMaxDeploymentLogs]
+	}
+	for _, file := range logs {
+		name := "logs/" + filepath.Base(file)
+		data, err := ioutil.ReadFile(file)
+		if err == nil {
+			err = b.add(name, redactLog(data))
+		}
+		if err != nil {
+			b.fail(name, err)
+		}
+	}
+
+	journal, err := exec.Command(journalctlCommand[0], journalctlCommand[1:]...).Output()
+	if err == nil {
+		err = b.add("logs/journal.log", redactLog(journal))
+	}
+	if err != nil {
+		b.fail("logs/journal.log", err)
+	}
+}
+
+// collectDevice adds the partitions and the boot environment variables used by
+// the client.
+func (b *supportBundle) collectDevice(env installer.BootEnvReadWriter,
+	device installer.DualRootfsDevice) {
+
+	info := make(map[string]interface{})
+	if device != nil {
+		if active, err := device.GetActive(); err != nil {
+			b.fail("device/active_partition", err)
+		} else {
+			info["active_partition"] = active
+		}
+		if inactive, err := device.GetInactive(); err != nil {
+			b.fail("device/inactive_partition", err)
+		} else {
+			info["inactive_partition"] = inactive
+		}
+	}
+	if env != nil {
+		vars, err := env.ReadEnv("mender_boot_part", "mender_boot_part_hex",
+			"upgrade_available", "bootcount")
+		if err != nil {
+			b.fail("device/bootenv", err)
+		} else {
+			info["bootenv"] = vars
+		}
+	}
+	if err := b.addJSON("device.json", info); err != nil {
+		b.fail("device.json", err)
+	}
+}
+
+// collectConnectivity tries to reach each of the servers, the same way as the
+// client does.
+func (b *supportBundle) collectConnectivity(config *menderConfig) {
+	results := []connectivityResult{}
+	api, err := client.New(config.GetHttpConfig())
+	for _, server := range config.Servers {
+		result := connectivityResult{ServerURL: server.ServerURL}
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			checkConnectivity(api, &result)
+		}
+		results = append(results, result)
+	}
+	if err := b.addJSON("connectivity.json", results); err != nil {
+		b.fail("connectivity.json", err)
+	}
+}
+
+func checkConnectivity(api *client.ApiClient, result *connectivityResult) {
+	start := time.Now()
+	defer func() {
+		result.DurationMs = int64(time.Since(start) / time.Millisecond)
+	}()
+
+	u, err := url.Parse(result.ServerURL)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	result.Addresses, err = net.LookupHost(u.Hostname())
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+
+	api.Timeout = supportBundleConnectTimeout
+	rsp, err := api.Get(result.ServerURL)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	rsp.Body.Close()
+	// Any response at all means the server is reachable.
+	result.StatusCode = rsp.StatusCode
+}
+
+// redactJSON returns v, as decoded by encoding/json, with the values of
+// sensitive fields replaced, and the query strings of URLs, which may be
+// signed, removed.
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if sensitiveNamePattern.MatchString(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSON(value)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactJSON(value)
+		}
+		return v
+	case string:
+		if strings.Contains(v, "://") && strings.Contains(v, "?") {
+			return v[:strings.Index(v, "?")+1] + redacted
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// redactLog returns the log with signed URLs and tokens replaced.
+func redactLog(data []byte) []byte {
+	for _, p := range sensitiveLogPatterns {
+		data = p.pattern.ReplaceAll(data, []byte(p.replace))
+	}
+	return data
+}
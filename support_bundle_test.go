@@ -0,0 +1,194 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type supportBundleBootEnv installer.BootVars
+
+func (e supportBundleBootEnv) ReadEnv(names ...string) (installer.BootVars, error) {
+	vars := make(installer.BootVars)
+	for _, name := range names {
+		vars[name] = e[name]
+	}
+	return vars, nil
+}
+
+func (e supportBundleBootEnv) WriteEnv(installer.BootVars) error {
+	return nil
+}
+
+func readSupportBundle(t *testing.T, name string) map[string][]byte {
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		files[hdr.Name], err = ioutil.ReadAll(tr)
+		require.NoError(t, err)
+	}
+	return files
+}
+
+func TestSupportBundle(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestSupportBundle")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	confPath := path.Join(tmpdir, "mender.conf")
+	require.NoError(t, ioutil.WriteFile(confPath, []byte(`{
+		"ServerURL": "`+srv.URL+`",
+		"TenantToken": "secret-tenant-token",
+		"AuthTokenStore": "memory"
+	}`), 0600))
+	config, err := loadConfig(confPath, path.Join(tmpdir, "does-not-exist.conf"))
+	require.NoError(t, err)
+	config.Servers = append(config.Servers, client.MenderServer{ServerURL: "https://does-not-exist.invalid"})
+
+	dataStore := path.Join(tmpdir, "data")
+	require.NoError(t, os.MkdirAll(dataStore, 0700))
+	db := store.NewDBStore(dataStore)
+	require.NoError(t, db.WriteAll(datastore.ArtifactNameKey, []byte("release-1")))
+	require.NoError(t, db.WriteAll(datastore.AuthTokenName, []byte("secret-auth-token")))
+	require.NoError(t, db.WriteAll(datastore.StateDataKey, []byte(`{
+		"Name": "update-store",
+		"UpdateInfo": {"artifact": {"source": {"uri": "https://s3/artifact?X-Amz-Signature=abc"}}}
+	}`)))
+	db.Close()
+	for i := 1; i <= supportBundleMaxDeploymentLogs+1; i++ {
+		name := path.Join(dataStore, fmt.Sprintf("deployments.%04d.id.log", i))
+		require.NoError(t, ioutil.WriteFile(name, []byte(`{"level":"info",`+
+			`"message":"Downloading https://s3/artifact?X-Amz-Signature=secret-signature"}`), 0600))
+	}
+
+	oldJournalctl := journalctlCommand
+	defer func() { journalctlCommand = oldJournalctl }()
+	journalctlCommand = []string{"echo", "journal line, Authorization: Bearer secret.jwt.token"}
+
+	args, err := argsParse([]string{"-config", confPath,
+		"-fallback-config", path.Join(tmpdir, "does-not-exist.conf"),
+		"-data", dataStore, "-support-bundle", path.Join(tmpdir, "bundle.tar.gz")})
+	require.NoError(t, err)
+
+	env := supportBundleBootEnv{"mender_boot_part": "2", "upgrade_available": "0"}
+	require.NoError(t, doSupportBundle(*args.supportBundle, &args, config, env, nil))
+
+	files := readSupportBundle(t, path.Join(tmpdir, "bundle.tar.gz"))
+
+	var conf map[string]interface{}
+	require.NoError(t, json.Unmarshal(files["config/mender.conf"], &conf))
+	assert.Equal(t, redacted, conf["TenantToken"])
+	assert.Equal(t, "memory", conf["AuthTokenStore"])
+	assert.NotContains(t, files, "config/fallback-mender.conf")
+
+	assert.Equal(t, "\"release-1\"\n", string(files["state/artifact-name.json"]))
+	assert.Contains(t, string(files["state/state.json"]), `"https://s3/artifact?<redacted>"`)
+	assert.NotContains(t, string(files["state/state.json"]), "X-Amz-Signature")
+	for name, data := range files {
+		assert.NotContains(t, string(data), "secret", name)
+	}
+
+	assert.Contains(t, files, "logs/deployments.0001.id.log")
+	assert.Contains(t, files, "logs/deployments.0005.id.log")
+	assert.NotContains(t, files, "logs/deployments.0006.id.log")
+	assert.Equal(t, "journal line, Authorization: Bearer <redacted>\n",
+		string(files["logs/journal.log"]))
+	assert.Contains(t, string(files["logs/deployments.0001.id.log"]),
+		"https://s3/artifact?<redacted>")
+
+	var device map[string]interface{}
+	require.NoError(t, json.Unmarshal(files["device.json"], &device))
+	assert.Equal(t, map[string]interface{}{
+		"mender_boot_part":     "2",
+		"mender_boot_part_hex": "",
+		"upgrade_available":    "0",
+		"bootcount":            "",
+	}, device["bootenv"])
+
+	var connectivity []connectivityResult
+	require.NoError(t, json.Unmarshal(files["connectivity.json"], &connectivity))
+	require.Len(t, connectivity, 2)
+	assert.Equal(t, srv.URL, connectivity[0].ServerURL)
+	assert.Equal(t, http.StatusNotFound, connectivity[0].StatusCode)
+	assert.Empty(t, connectivity[0].Error)
+	assert.NotEmpty(t, connectivity[1].Error)
+
+	var summary supportBundleSummary
+	require.NoError(t, json.Unmarshal(files["summary.json"], &summary))
+	assert.Empty(t, summary.Errors)
+}
+
+func TestRedactJSON(t *testing.T) {
+	var v interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"TenantToken": "t",
+		"Servers": [{"ServerURL": "https://example.com"}],
+		"Nested": {"password": "p", "list": ["http://x/y?sig=1", "plain?text"]}
+	}`), &v))
+	assert.Equal(t, map[string]interface{}{
+		"TenantToken": redacted,
+		"Servers":     []interface{}{map[string]interface{}{"ServerURL": "https://example.com"}},
+		"Nested": map[string]interface{}{
+			"password": redacted,
+			"list":     []interface{}{"http://x/y?" + redacted, "plain?text"},
+		},
+	}, redactJSON(v))
+}
+
+func TestRedactLog(t *testing.T) {
+	tc := map[string]string{
+		"GET https://s3/bucket/artifact?X-Amz-Signature=abc&X-Amz-Date=1 failed": "GET https://s3/bucket/artifact?<redacted> failed",
+		"Authorization: Bearer abc.def-ghi":                                      "Authorization: Bearer <redacted>",
+		"token eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln rejected":               "token <redacted> rejected",
+		`{"message":"config: \"TenantToken\": \"abc\", ok"}`:                     `{"message":"config: \"TenantToken\": \"<redacted>\", ok"}`,
+		"tenant_token=abc&x=1":                                                   "tenant_token=<redacted>&x=1",
+		`password="abc"`:                                                         `password="<redacted>"`,
+		"Failed to get token: connection refused":                                "Failed to get token: connection refused",
+		"Downloading https://example.com/artifact":                               "Downloading https://example.com/artifact",
+	}
+	for line, expected := range tc {
+		assert.Equal(t, expected, string(redactLog([]byte(line))), line)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package system
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// EfiVarsDir is where the efivarfs file system exposes the EFI variables.
+var EfiVarsDir = "/sys/firmware/efi/efivars"
+
+const (
+	efiVariableNonVolatile       = 0x1
+	efiVariableBootServiceAccess = 0x2
+	efiVariableRuntimeAccess     = 0x4
+
+	// From <linux/fs.h>
+	fsImmutableFl = 0x10
+)
+
+func efiVariablePath(name, guid string) string {
+	return filepath.Join(EfiVarsDir, name+"-"+guid)
+}
+
+// ReadEfiStringVariable reads an EFI variable holding a NUL terminated
+// UTF-16 string, as the variables of systemd-boot do. An error satisfying
+// os.IsNotExist is returned if the variable is not set.
+func ReadEfiStringVariable(name, guid string) (string, error) {
+	data, err := ioutil.ReadFile(efiVariablePath(name, guid))
+	if err != nil {
+		return "", err
+	}
+	// The value follows the 32 bit attributes.
+	if len(data) < 4 || len(data)%2 != 0 {
+		return "", errors.Errorf("invalid EFI variable %s", name)
+	}
+	chars := make([]uint16, 0, (len(data)-4)/2)
+	for i := 4; i < len(data); i += 2 {
+		c := binary.LittleEndian.Uint16(data[i:])
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return string(utf16.Decode(chars)), nil
+}
+
+// WriteEfiStringVariable sets a non-volatile EFI variable to a NUL terminated
+// UTF-16 string.
+func WriteEfiStringVariable(name, guid, value string) error {
+	attributes := uint32(efiVariableNonVolatile | efiVariableBootServiceAccess |
+		efiVariableRuntimeAccess)
+	chars := append(utf16.Encode([]rune(value)), 0)
+	data := make([]byte, 4+2*len(chars))
+	binary.LittleEndian.PutUint32(data, attributes)
+	for i, c := range chars {
+		binary.LittleEndian.PutUint16(data[4+2*i:], c)
+	}
+
+	path := efiVariablePath(name, guid)
+	clearImmutableFlag(path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	// efivarfs requires the variable to be written by a single write.
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// DeleteEfiVariable unsets an EFI variable, if it is set.
+func DeleteEfiVariable(name, guid string) error {
+	path := efiVariablePath(name, guid)
+	clearImmutableFlag(path)
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// efivarfs makes most variables immutable, to protect against them being
+// removed by accident. Failing to clear the flag is not an error, as it is
+// not set for all variables, or supported by all file systems.
+func clearImmutableFlag(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	sizeOfLong := ioctlRequestValue(unsafe.Sizeof(uintptr(0))) << 16
+	var flags uintptr
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		uintptr(unsafe.Pointer(FS_IOC_GETFLAGS|sizeOfLong)),
+		uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 || flags&fsImmutableFl == 0 {
+		return
+	}
+	flags &^= fsImmutableFl
+	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		uintptr(unsafe.Pointer(FS_IOC_SETFLAGS|sizeOfLong)),
+		uintptr(unsafe.Pointer(&flags)))
+}
@@ -127,6 +127,12 @@ func GetBlockDeviceSectorSize(file *os.File) (int, error) {
 	if err == NotABlockDevice {
 		// Check if it is an UBI block device
 		sectorSize, err = getUbiDeviceSectorSize(file)
+		if err == NotABlockDevice {
+			// Or a raw MTD device, written a page at a time
+			var pageSize uint64
+			pageSize, err = getMtdAttribute(file, "writesize")
+			sectorSize = int(pageSize)
+		}
 		if err != nil {
 			return 0, err
 		}
@@ -148,6 +154,10 @@ func GetBlockDeviceSize(file *os.File) (uint64, error) {
 	if err == NotABlockDevice {
 		// Check if it is an UBI block device
 		devSize, err = getUbiDeviceSize(file)
+		if err == NotABlockDevice {
+			// Or a raw MTD device
+			devSize, err = getMtdAttribute(file, "size")
+		}
 		if err != nil {
 			return 0, err
 		}
@@ -157,3 +167,50 @@ func GetBlockDeviceSize(file *os.File) (uint64, error) {
 
 	return devSize, nil
 }
+
+// DropPageCache drops the cached pages of the file, so that it is read from
+// the underlying storage the next time. Dirty pages must have been synced
+// first.
+func DropPageCache(file *os.File) error {
+	return unix.Fadvise(int(file.Fd()), 0, 0, unix.FADV_DONTNEED)
+}
+
+// SetDirectIO turns direct I/O (O_DIRECT) on or off for an open file.
+func SetDirectIO(file *os.File, enabled bool) error {
+	fd := file.Fd()
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+	if enabled {
+		flags |= syscall.O_DIRECT
+	} else {
+		flags &^= syscall.O_DIRECT
+	}
+	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFL, flags)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Taken from <linux/fs.h>; the same on all architectures.
+const BLKDISCARD ioctlRequestValue = 0x1277
+
+// DiscardBlockDevice tells the block device that the given range of it is no
+// longer in use, so that flash storage can erase it in the background.
+// NotABlockDevice is returned if the file is not a block device.
+func DiscardBlockDevice(file *os.File, offset, length uint64) error {
+	span := [2]uint64{offset, length}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(),
+		uintptr(unsafe.Pointer(BLKDISCARD)),
+		uintptr(unsafe.Pointer(&span)))
+
+	if errno == syscall.ENOTTY {
+		return NotABlockDevice
+	} else if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -17,4 +17,7 @@
 package system
 
 // Taken from <mtd/ubi-user.h>
-const UBI_IOCVOLUP ioctlRequestValue = 0x80084f00
+const (
+	UBI_IOCVOLUP ioctlRequestValue = 0x80084f00
+	UBI_IOCRSVOL ioctlRequestValue = 0x800c6f02
+)
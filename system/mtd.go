@@ -0,0 +1,102 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/ungerik/go-sysfs"
+)
+
+// MtdInfo is the information about an MTD device returned by the MEMGETINFO
+// ioctl; struct mtd_info_user in <mtd/mtd-abi.h>.
+type MtdInfo struct {
+	Type      uint8
+	Flags     uint32
+	Size      uint32
+	EraseSize uint32
+	WriteSize uint32
+	OobSize   uint32
+	padding   uint64
+}
+
+// Only the read-write character devices, not the read-only "mtdXro" ones.
+var mtdCharDeviceName = regexp.MustCompile(`^mtd[0-9]+$`)
+
+// IsMtdCharDevice tells whether the device is a raw MTD character device,
+// such as /dev/mtd3.
+func IsMtdCharDevice(deviceName string) bool {
+	dev := filepath.Base(deviceName)
+	return mtdCharDeviceName.MatchString(dev) &&
+		sysfs.Class.Object("mtd").SubObject(dev).Exists()
+}
+
+func getMtdAttribute(file *os.File, name string) (uint64, error) {
+	dev := strings.TrimPrefix(file.Name(), "/dev/")
+
+	attr := sysfs.Class.Object("mtd").SubObject(dev).Attribute(name)
+
+	if !attr.Exists() {
+		return 0, NotABlockDevice
+	}
+
+	value, err := attr.ReadUint64()
+	if err != nil {
+		return 0, NotABlockDevice
+	}
+
+	return value, nil
+}
+
+func mtdIoctl(file *os.File, request ioctlRequestValue, arg unsafe.Pointer) (uintptr, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(),
+		uintptr(unsafe.Pointer(request)),
+		uintptr(arg))
+
+	if errno == syscall.ENOTTY {
+		return 0, NotABlockDevice
+	} else if errno != 0 {
+		return 0, errno
+	}
+
+	return r, nil
+}
+
+// GetMtdInfo returns the information about the MTD device, such as the sizes
+// of its erase blocks and pages.
+func GetMtdInfo(file *os.File) (MtdInfo, error) {
+	var info MtdInfo
+	_, err := mtdIoctl(file, MEMGETINFO, unsafe.Pointer(&info))
+	return info, err
+}
+
+// IsMtdBadBlock tells whether the erase block at the offset of the MTD device
+// is marked bad.
+func IsMtdBadBlock(file *os.File, offset int64) (bool, error) {
+	r, err := mtdIoctl(file, MEMGETBADBLOCK, unsafe.Pointer(&offset))
+	return r > 0, err
+}
+
+// EraseMtd erases the given range of the MTD device, which must be aligned
+// to its erase blocks.
+func EraseMtd(file *os.File, offset, length int64) error {
+	span := [2]uint64{uint64(offset), uint64(length)}
+	_, err := mtdIoctl(file, MEMERASE64, unsafe.Pointer(&span))
+	return err
+}
@@ -32,7 +32,17 @@ func NewSystemRebootCmd(command Commander) *SystemRebootCmd {
 }
 
 func (s *SystemRebootCmd) Reboot() error {
-	err := s.command.Command("reboot").Run()
+	return s.RebootWithArgument("")
+}
+
+// RebootWithArgument reboots, passing the argument to the firmware, as
+// "reboot <argument>" does; a plain reboot if it is empty.
+func (s *SystemRebootCmd) RebootWithArgument(argument string) error {
+	args := []string{}
+	if argument != "" {
+		args = append(args, argument)
+	}
+	err := s.command.Command("reboot", args...).Run()
 	if err != nil {
 		return err
 	}
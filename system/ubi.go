@@ -0,0 +1,72 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// ubiRsvolReq is struct ubi_rsvol_req in <mtd/ubi-user.h>, which is packed;
+// the kernel only reads the first 12 bytes of it.
+type ubiRsvolReq struct {
+	bytes int64
+	volID int32
+}
+
+// ubiVolumeDevice returns the UBI device, such as /dev/ubi0, and the ID of
+// the UBI volume, such as ubi0_1.
+func ubiVolumeDevice(volume string) (string, int32, error) {
+	name := filepath.Base(volume)
+	sep := strings.LastIndex(name, "_")
+	if !strings.HasPrefix(name, "ubi") || sep < 0 {
+		return "", 0, errors.Errorf("%s is not a UBI volume", volume)
+	}
+	volID, err := strconv.ParseInt(name[sep+1:], 10, 32)
+	if err != nil {
+		return "", 0, errors.Errorf("%s is not a UBI volume", volume)
+	}
+	return filepath.Join("/dev", name[:sep]), int32(volID), nil
+}
+
+// ResizeUbiVolume resizes the UBI volume to at least size bytes, as
+// ubirsvol does. The UBI device must have enough free erase blocks, and the
+// volume must not be open.
+func ResizeUbiVolume(volume string, size int64) error {
+	device, volID, err := ubiVolumeDevice(volume)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	req := ubiRsvolReq{bytes: size, volID: volID}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(),
+		uintptr(unsafe.Pointer(UBI_IOCRSVOL)),
+		uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return errors.Wrapf(errno, "failed to resize UBI volume %s to %d bytes",
+			volume, size)
+	}
+	return nil
+}
@@ -0,0 +1,450 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package tests provides a fake Mender server, serving the device API, to
+// test the client against without a real server: authorization, deployments,
+// status reports, deployment logs, inventory, and the download of artifacts,
+// with faults which can be injected, such as expired tokens, aborted
+// deployments and connections dropped in the middle of downloads.
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiPrefix   = "/api/devices/v1"
+	apiPrefixV2 = "/api/devices/v2"
+
+	deploymentsPrefix = apiPrefix + "/deployments/device/deployments/"
+
+	// Where the artifacts are downloaded from, outside of the API, as
+	// from the storage the real server links to.
+	artifactsPrefix = "/artifacts/"
+)
+
+// Deployment is the deployment the server gives the devices asking for one.
+type Deployment struct {
+	ID           string
+	ArtifactName string
+	// The device types the artifact is compatible with; any if empty.
+	DeviceTypes []string
+	// The artifact downloaded by the devices.
+	Artifact []byte
+}
+
+// AuthRequest is an authorization request received by the server.
+type AuthRequest struct {
+	IdentityData string `json:"id_data"`
+	PublicKey    string `json:"pubkey"`
+	TenantToken  string `json:"tenant_token,omitempty"`
+}
+
+// Server is a fake Mender server. It authorizes every device, unless
+// RejectAuth is set, and serves the deployment set by SetDeployment.
+type Server struct {
+	*httptest.Server
+
+	lock       sync.Mutex
+	token      string
+	tokens     int
+	rejectAuth bool
+	authReqs   []AuthRequest
+	deployment *Deployment
+	aborted    bool
+	statuses   []string
+	logs       [][]byte
+	inventory  []map[string]interface{}
+	downloads  int
+	dropAt     int64
+	dropTimes  int
+}
+
+// NewServer starts a fake server, which is closed with Close.
+func NewServer() *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+// NewTLSServer starts a fake server serving HTTPS, with the certificate of
+// httptest.
+func NewTLSServer() *Server {
+	s := &Server{}
+	s.Server = httptest.NewTLSServer(s.handler())
+	return s
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"/authentication/auth_requests", s.auth)
+	mux.HandleFunc(deploymentsPrefix, s.authorized(s.deployments))
+	mux.HandleFunc(apiPrefixV2+"/deployments/device/deployments/next",
+		s.authorized(s.nextDeploymentV2))
+	mux.HandleFunc(apiPrefix+"/inventory/device/attributes", s.authorized(s.submitInventory))
+	mux.HandleFunc(artifactsPrefix, s.downloadArtifact)
+	return mux
+}
+
+// SetDeployment sets the deployment given to the devices, or none if nil,
+// which is no longer aborted.
+func (s *Server) SetDeployment(deployment *Deployment) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deployment = deployment
+	s.aborted = false
+	s.statuses = nil
+	s.logs = nil
+	s.downloads = 0
+}
+
+// AbortDeployment aborts the deployment, so that the requests of the devices
+// about it are rejected with 409 Conflict.
+func (s *Server) AbortDeployment() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.aborted = true
+}
+
+// RejectAuth rejects the authorization requests with 401 Unauthorized, as if
+// the devices were not accepted, or accepts them again.
+func (s *Server) RejectAuth(reject bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejectAuth = reject
+}
+
+// ExpireToken expires the token given to the devices, so that their requests
+// are rejected with 401 Unauthorized until they authorize again.
+func (s *Server) ExpireToken() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.token = ""
+}
+
+// DropDownloads drops the connection of the next downloads of the artifact,
+// as many as times, once offset bytes of the artifact have been sent.
+func (s *Server) DropDownloads(offset int64, times int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dropAt = offset
+	s.dropTimes = times
+}
+
+// AuthRequests returns the authorization requests received.
+func (s *Server) AuthRequests() []AuthRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]AuthRequest(nil), s.authReqs...)
+}
+
+// Statuses returns the statuses reported for the deployment, in order.
+func (s *Server) Statuses() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.statuses...)
+}
+
+// Logs returns the deployment logs uploaded, uncompressed.
+func (s *Server) Logs() [][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([][]byte(nil), s.logs...)
+}
+
+// Inventory returns the inventory attributes submitted, by name.
+func (s *Server) Inventory() map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	attrs := make(map[string]interface{})
+	for _, submitted := range s.inventory {
+		for name, value := range submitted {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
+// Downloads returns how many times the download of the artifact was started,
+// including resumed downloads.
+func (s *Server) Downloads() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.downloads
+}
+
+func (s *Server) auth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req AuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.authReqs = append(s.authReqs, req)
+	if s.rejectAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.tokens++
+	s.token = fmt.Sprintf("token-%d", s.tokens)
+	w.Write([]byte(s.token))
+}
+
+// authorized rejects the requests without the token last given.
+func (s *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		token := s.token
+		s.lock.Unlock()
+		if token == "" || r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *Server) deployments(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, deploymentsPrefix)
+	switch {
+	case path == "next" && r.Method == http.MethodGet:
+		s.nextDeployment(w, r.URL.Query().Get("device_type"),
+			r.URL.Query().Get("artifact_name"))
+	case path == "next/notify" && r.Method == http.MethodGet:
+		// Updates are not pushed.
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/status") && r.Method == http.MethodPut:
+		s.reportStatus(w, r, strings.TrimSuffix(path, "/status"))
+	case strings.HasSuffix(path, "/log") && r.Method == http.MethodPut:
+		s.uploadLog(w, r, strings.TrimSuffix(path, "/log"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *Server) nextDeploymentV2(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		DeviceProvides map[string]string `json:"device_provides"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.nextDeployment(w, req.DeviceProvides["device_type"],
+		req.DeviceProvides["artifact_name"])
+}
+
+// nextDeployment gives the deployment, unless the device has its artifact
+// installed already, or is not compatible with it.
+func (s *Server) nextDeployment(w http.ResponseWriter, deviceType, artifactName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := s.deployment
+	if d == nil || s.aborted || d.ArtifactName == artifactName ||
+		!compatible(d.DeviceTypes, deviceType) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	deviceTypes := d.DeviceTypes
+	if len(deviceTypes) == 0 {
+		deviceTypes = []string{deviceType}
+	}
+
+	var next struct {
+		ID       string `json:"id"`
+		Artifact struct {
+			Source struct {
+				URI    string `json:"uri"`
+				Expire string `json:"expire"`
+			} `json:"source"`
+			CompatibleDevices []string `json:"device_types_compatible"`
+			ArtifactName      string   `json:"artifact_name"`
+		} `json:"artifact"`
+	}
+	next.ID = d.ID
+	next.Artifact.Source.URI = s.URL + artifactsPrefix + d.ID
+	next.Artifact.Source.Expire = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	next.Artifact.CompatibleDevices = deviceTypes
+	next.Artifact.ArtifactName = d.ArtifactName
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&next)
+}
+
+func compatible(deviceTypes []string, deviceType string) bool {
+	if len(deviceTypes) == 0 {
+		return true
+	}
+	for _, t := range deviceTypes {
+		if t == deviceType {
+			return true
+		}
+	}
+	return false
+}
+
+// deploymentRequest checks that the request is about the current deployment,
+// which has not been aborted, and responds otherwise.
+func (s *Server) deploymentRequest(w http.ResponseWriter, id string) bool {
+	if s.deployment == nil || s.deployment.ID != id {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	if s.aborted {
+		w.WriteHeader(http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+func (s *Server) reportStatus(w http.ResponseWriter, r *http.Request, id string) {
+	var report struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil || report.Status == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.deploymentRequest(w, id) {
+		return
+	}
+	s.statuses = append(s.statuses, report.Status)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) uploadLog(w http.ResponseWriter, r *http.Request, id string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil && r.Header.Get("Content-Encoding") == "gzip" {
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(body)); err == nil {
+			body, err = ioutil.ReadAll(zr)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.deploymentRequest(w, id) {
+		return
+	}
+	s.logs = append(s.logs, body)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) submitInventory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var attrs []struct {
+		Name  string      `json:"name"`
+		Value interface{} `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	submitted := make(map[string]interface{}, len(attrs))
+	for _, attr := range attrs {
+		submitted[attr.Name] = attr.Value
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.inventory = append(s.inventory, submitted)
+	w.WriteHeader(http.StatusOK)
+}
+
+// downloadArtifact serves the artifact of the deployment, supporting Range
+// requests so that interrupted downloads can be resumed.
+func (s *Server) downloadArtifact(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, artifactsPrefix)
+
+	s.lock.Lock()
+	if !s.deploymentRequest(w, id) {
+		s.lock.Unlock()
+		return
+	}
+	artifact := s.deployment.Artifact
+	s.downloads++
+	dropAt := int64(-1)
+	if s.dropTimes > 0 {
+		s.dropTimes--
+		dropAt = s.dropAt
+	}
+	s.lock.Unlock()
+
+	if dropAt >= 0 {
+		remaining := dropAt - rangeStart(r)
+		if remaining < 0 {
+			remaining = 0
+		}
+		w = &droppingWriter{ResponseWriter: w, remaining: remaining}
+	}
+	http.ServeContent(w, r, id, time.Time{}, bytes.NewReader(artifact))
+}
+
+// rangeStart returns the offset of the artifact the requested range starts
+// at; the client only requests ranges up to the end.
+func rangeStart(r *http.Request) int64 {
+	var start int64
+	fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+	return start
+}
+
+// droppingWriter drops the connection once the remaining bytes have been
+// sent.
+type droppingWriter struct {
+	http.ResponseWriter
+	remaining int64
+}
+
+func (w *droppingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= w.remaining {
+		w.remaining -= int64(len(p))
+		return w.ResponseWriter.Write(p)
+	}
+	n, _ := w.ResponseWriter.Write(p[:w.remaining])
+	w.remaining -= int64(n)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	// Aborts the response, closing the connection.
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,151 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testAuthData struct{}
+
+func (testAuthData) MakeAuthRequest(serverURL string) (*client.AuthRequest, error) {
+	data, err := json.Marshal(AuthRequest{
+		IdentityData: `{"mac":"de:ad:be:ef:00:01"}`,
+		PublicKey:    "public key",
+	})
+	return &client.AuthRequest{Data: data}, err
+}
+
+func (testAuthData) RecvAuthResponse([]byte) error {
+	return nil
+}
+
+// newTestAPI authorizes with the server, and returns the API requester,
+// authorizing again when the token expires.
+func newTestAPI(t *testing.T, s *Server) client.ApiRequester {
+	api, err := client.NewApiClient(client.Config{})
+	require.NoError(t, err)
+	authorize := func(string) (client.AuthToken, error) {
+		token, err := client.NewAuth().Request(api, s.URL, testAuthData{})
+		return client.AuthToken(token), err
+	}
+	token, err := authorize(s.URL)
+	require.NoError(t, err)
+
+	called := false
+	servers := func() *client.MenderServer {
+		called = !called
+		if !called {
+			return nil
+		}
+		return &client.MenderServer{ServerURL: s.URL}
+	}
+	return api.Request(token, s.URL, servers, authorize)
+}
+
+func TestServerDeployment(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	api := newTestAPI(t, s)
+	require.Len(t, s.AuthRequests(), 1)
+	assert.Equal(t, "public key", s.AuthRequests()[0].PublicKey)
+
+	current := client.CurrentUpdate{Artifact: "release-1", DeviceType: "qemux86-64"}
+	update, err := client.NewUpdate().GetScheduledUpdate(api, s.URL, current)
+	require.NoError(t, err)
+	assert.Nil(t, update)
+
+	artifact := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(artifact)
+	s.SetDeployment(&Deployment{
+		ID:           "deployment-1",
+		ArtifactName: "release-2",
+		DeviceTypes:  []string{"qemux86-64"},
+		Artifact:     artifact,
+	})
+	update, err = client.NewUpdate().GetScheduledUpdate(api, s.URL, current)
+	require.NoError(t, err)
+	info := update.(datastore.UpdateInfo)
+	assert.Equal(t, "deployment-1", info.ID)
+	assert.Equal(t, "release-2", info.ArtifactName())
+
+	// Nor is it given to other device types.
+	other, err := client.NewUpdate().GetScheduledUpdate(api, s.URL,
+		client.CurrentUpdate{Artifact: "release-1", DeviceType: "raspberrypi4"})
+	require.NoError(t, err)
+	assert.Nil(t, other)
+
+	// Downloads dropped in the middle are resumed.
+	oldBackoff := client.ExponentialBackoffSmallestUnit
+	defer func() { client.ExponentialBackoffSmallestUnit = oldBackoff }()
+	client.ExponentialBackoffSmallestUnit = time.Millisecond
+	s.DropDownloads(100*1024, 2)
+	stream, size, err := client.NewUpdate().FetchUpdate(api, info.URI(), time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(artifact)), size)
+	downloaded, err := ioutil.ReadAll(stream)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(artifact, downloaded))
+	assert.Equal(t, 3, s.Downloads())
+
+	require.NoError(t, client.NewStatus().Report(api, s.URL, client.StatusReport{
+		DeploymentID: "deployment-1", Status: client.StatusInstalling}))
+	require.NoError(t, client.NewLogWithConfig(client.LogUploadConfig{Compress: true}).
+		Upload(api, s.URL, client.LogData{DeploymentID: "deployment-1",
+			Messages: []byte(`{"messages":[]}`)}))
+	assert.Equal(t, []string{client.StatusInstalling}, s.Statuses())
+	require.Len(t, s.Logs(), 1)
+
+	// The device authorizes again when its token expires.
+	s.ExpireToken()
+	require.NoError(t, client.NewInventory().Submit(api, s.URL, client.InventoryData{
+		{Name: "device_type", Value: "qemux86-64"}}))
+	assert.Equal(t, map[string]interface{}{"device_type": "qemux86-64"}, s.Inventory())
+	assert.Len(t, s.AuthRequests(), 2)
+
+	// Requests about aborted deployments are rejected.
+	s.AbortDeployment()
+	err = client.NewStatus().Report(api, s.URL, client.StatusReport{
+		DeploymentID: "deployment-1", Status: client.StatusSuccess})
+	assert.True(t, client.IsDeploymentAborted(err))
+	_, _, err = client.NewUpdate().FetchUpdate(api, info.URI(), time.Second)
+	assert.True(t, client.IsDeploymentAborted(err))
+}
+
+func TestServerRejectAuth(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.RejectAuth(true)
+
+	api, err := client.NewApiClient(client.Config{})
+	require.NoError(t, err)
+	_, err = client.NewAuth().Request(api, s.URL, testAuthData{})
+	assert.Error(t, err)
+	assert.Len(t, s.AuthRequests(), 1)
+
+	s.RejectAuth(false)
+	token, err := client.NewAuth().Request(api, s.URL, testAuthData{})
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", string(token))
+}
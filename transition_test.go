@@ -258,15 +258,7 @@ func (sexec *stateScriptReportExecutor) CheckRootfsScriptsVersion() error {
 func TestTransitionReporting(t *testing.T) {
 
 	update := &datastore.UpdateInfo{
-		Artifact: struct {
-			Source struct {
-				URI    string
-				Expire string
-			}
-			CompatibleDevices []string `json:"device_types_compatible"`
-			ArtifactName      string   `json:"artifact_name"`
-			PayloadTypes      []string
-		}{
+		Artifact: datastore.Artifact{
 			Source: struct {
 				URI    string
 				Expire string
@@ -312,7 +304,7 @@ func TestTransitionReporting(t *testing.T) {
 			expected: true,
 		},
 		{
-			state:    NewUpdateStoreState(nil, update),
+			state:    NewUpdateStoreState(nil, -1, update),
 			expected: true,
 		},
 		{
@@ -0,0 +1,137 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/pkg/errors"
+)
+
+var (
+	errNoRebootToConfirm = errors.New("no deployment is waiting for a reboot confirmation")
+	errNoCommitToConfirm = errors.New("no deployment is waiting for a commit confirmation")
+)
+
+// daemonUpdateManager exposes the state and the operations of the daemon to
+// on-device integrations, such as the D-Bus service and the local API.
+type daemonUpdateManager struct {
+	daemon *menderDaemon
+}
+
+func NewUpdateManager(d *menderDaemon) *daemonUpdateManager {
+	return &daemonUpdateManager{daemon: d}
+}
+
+func (u *daemonUpdateManager) State() string {
+	s := u.daemon.currentState()
+	if s == nil {
+		return datastore.MenderStateInit.String()
+	}
+	return s.Id().String()
+}
+
+func (u *daemonUpdateManager) InstalledArtifact() (string, error) {
+	return u.daemon.mender.GetCurrentArtifactName()
+}
+
+func (u *daemonUpdateManager) DeploymentID() string {
+	switch s := u.daemon.currentState().(type) {
+	case UpdateState:
+		return s.Update().ID
+	case *UpdateControlPauseState:
+		return s.update.ID
+	default:
+		return ""
+	}
+}
+
+func (u *daemonUpdateManager) Progress() (downloaded, total int64) {
+	return u.daemon.sctx.downloadProgress.get()
+}
+
+func (u *daemonUpdateManager) Paused() bool {
+	return u.daemon.sctx.deploymentPause.isSet()
+}
+
+func (u *daemonUpdateManager) CheckUpdate() error {
+	u.daemon.forceState(updateCheckState)
+	return nil
+}
+
+func (u *daemonUpdateManager) TriggerInventory() error {
+	u.daemon.forceState(inventoryUpdateState)
+	return nil
+}
+
+// ConfirmReboot confirms a deployment paused before the update is installed
+// and the device rebooted, or waiting for a confirmation before rebooting into
+// the update. The confirmation only stands in for the one required on the
+// device; a deployment paused by the server or on the device, or outside the
+// maintenance window, keeps waiting.
+func (u *daemonUpdateManager) ConfirmReboot() error {
+	return u.confirm(errNoRebootToConfirm,
+		datastore.UpdateControlMapInstallEnter, deploymentRebootEnter)
+}
+
+// ConfirmCommit confirms a deployment paused, or waiting for a confirmation,
+// before the update is committed. As with ConfirmReboot, the other reasons to
+// pause the deployment still hold.
+func (u *daemonUpdateManager) ConfirmCommit() error {
+	return u.confirm(errNoCommitToConfirm, datastore.UpdateControlMapCommitEnter)
+}
+
+// confirm confirms a deployment paused at one of the pause points, or returns
+// notPaused.
+func (u *daemonUpdateManager) confirm(notPaused error, points ...string) error {
+	ps, ok := u.daemon.currentState().(*UpdateControlPauseState)
+	if !ok {
+		return notPaused
+	}
+	paused := false
+	for _, point := range points {
+		if ps.point == point {
+			paused = true
+		}
+	}
+	if !paused {
+		return notPaused
+	}
+
+	select {
+	case u.daemon.sctx.updateControlResume <- ps.point:
+	default:
+	}
+	select {
+	case u.daemon.sctx.wakeupChan <- true:
+	default:
+	}
+	return nil
+}
+
+// Pause holds deployments at the next pause point of the update control map.
+func (u *daemonUpdateManager) Pause() error {
+	u.daemon.sctx.deploymentPause.set(true)
+	return nil
+}
+
+// Resume lets paused deployments continue, unless the update control map
+// from the server pauses them.
+func (u *daemonUpdateManager) Resume() error {
+	u.daemon.sctx.deploymentPause.set(false)
+	select {
+	case u.daemon.sctx.wakeupChan <- true:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateManager(t *testing.T) {
+	ctrl := &stateTestController{artifactName: "release-1"}
+	d := NewDaemon(ctrl, store.NewMemStore())
+	manager := NewUpdateManager(d)
+
+	var states []string
+	d.SetStateListener(func(state string) {
+		states = append(states, state)
+	})
+
+	assert.Equal(t, "init", manager.State())
+	assert.Equal(t, "", manager.DeploymentID())
+	name, err := manager.InstalledArtifact()
+	assert.NoError(t, err)
+	assert.Equal(t, "release-1", name)
+
+	d.setState(idleState)
+	d.setState(idleState)
+	assert.Equal(t, "idle", manager.State())
+	assert.Equal(t, []string{"idle"}, states)
+
+	assert.NoError(t, manager.CheckUpdate())
+	assert.Equal(t, updateCheckState, <-d.forceToState)
+	assert.True(t, <-d.sctx.wakeupChan)
+
+	assert.NoError(t, manager.TriggerInventory())
+	assert.Equal(t, inventoryUpdateState, <-d.forceToState)
+	assert.True(t, <-d.sctx.wakeupChan)
+
+	// Nothing to confirm.
+	assert.Equal(t, errNoRebootToConfirm, manager.ConfirmReboot())
+
+	update := &datastore.UpdateInfo{ID: "deployment-1"}
+	d.setState(NewUpdateStoreState(nil, -1, update))
+	assert.Equal(t, "deployment-1", manager.DeploymentID())
+
+	// Paused before downloading; not a reboot.
+	ps := NewUpdateControlPauseState(updateCheckState, update,
+		datastore.UpdateControlMapDownloadEnter, NewUpdateFetchState,
+		func(*StateContext, Controller, menderError) (State, bool) {
+			return idleState, false
+		})
+	d.setState(ps)
+	assert.Equal(t, "update-control-pause", manager.State())
+	assert.Equal(t, "deployment-1", manager.DeploymentID())
+	assert.Equal(t, errNoRebootToConfirm, manager.ConfirmReboot())
+
+	// Paused before installing and rebooting.
+	ps = NewUpdateControlPauseState(updateCheckState, update,
+		datastore.UpdateControlMapInstallEnter, NewUpdateInstallState,
+		func(*StateContext, Controller, menderError) (State, bool) {
+			return idleState, false
+		})
+	d.setState(ps)
+	assert.NoError(t, manager.ConfirmReboot())
+	assert.Equal(t, errNoCommitToConfirm, manager.ConfirmCommit())
+
+	// The confirmation doesn't override the update control map.
+	ctrl.controlMap = &datastore.UpdateControlMap{
+		ID: "map-id",
+		States: map[string]datastore.UpdateControlMapState{
+			datastore.UpdateControlMapInstallEnter: {
+				Action: datastore.UpdateControlMapActionPause,
+			},
+		},
+	}
+	ctrl.retryIntvl = time.Millisecond
+	ctrl.updatePollIntvl = time.Millisecond
+	s, c := ps.Handle(&d.sctx, ctrl)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+	ctrl.controlMap = nil
+	s, c = ps.Handle(&d.sctx, ctrl)
+	assert.IsType(t, &UpdateInstallState{}, s)
+	assert.False(t, c)
+
+	// Waiting for a confirmation before rebooting; the confirmation
+	// doesn't override the maintenance window.
+	ctrl.unconfirmed = map[string]bool{
+		deploymentRebootEnter:                 true,
+		datastore.UpdateControlMapCommitEnter: true,
+	}
+	ctrl.closedWindows = map[string]bool{deploymentRebootEnter: true}
+	ps = NewUpdateControlPauseState(NewUpdateInstallState(update), update,
+		deploymentRebootEnter, NewUpdateRebootState,
+		func(*StateContext, Controller, menderError) (State, bool) {
+			return idleState, false
+		})
+	d.setState(ps)
+	s, c = ps.Handle(&d.sctx, ctrl)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+	assert.Equal(t, errNoCommitToConfirm, manager.ConfirmCommit())
+	assert.NoError(t, manager.ConfirmReboot())
+	s, c = ps.Handle(&d.sctx, ctrl)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+	ctrl.closedWindows = nil
+	s, c = ps.Handle(&d.sctx, ctrl)
+	assert.IsType(t, &UpdateRebootState{}, s)
+	assert.False(t, c)
+
+	// Waiting for a confirmation before committing; the confirmation
+	// doesn't override a pause on the device.
+	ps = NewUpdateControlPauseState(NewUpdateAfterRebootState(update), update,
+		datastore.UpdateControlMapCommitEnter, NewUpdateCommitState,
+		func(*StateContext, Controller, menderError) (State, bool) {
+			return idleState, false
+		})
+	d.setState(ps)
+	assert.Equal(t, errNoRebootToConfirm, manager.ConfirmReboot())
+	assert.NoError(t, manager.Pause())
+	assert.NoError(t, manager.ConfirmCommit())
+	s, c = ps.Handle(&d.sctx, ctrl)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+	assert.NoError(t, manager.Resume())
+	s, c = ps.Handle(&d.sctx, ctrl)
+	assert.IsType(t, &UpdateCommitState{}, s)
+	assert.False(t, c)
+}
+
+func TestUpdateManagerLocalPause(t *testing.T) {
+	ctrl := &stateTestController{
+		updateResp: &datastore.UpdateInfo{ID: "deployment-1"},
+		controlMap: &datastore.UpdateControlMap{ID: "map-id"},
+		retryIntvl: time.Millisecond,
+	}
+	d := NewDaemon(ctrl, store.NewMemStore())
+	manager := NewUpdateManager(d)
+
+	assert.False(t, manager.Paused())
+	assert.NoError(t, manager.Pause())
+	assert.True(t, manager.Paused())
+
+	// A deployment the server lets continue is held on the device.
+	s, c := updateCheckState.Handle(&d.sctx, ctrl)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+
+	s, c = s.Handle(&d.sctx, ctrl)
+	assert.IsType(t, &UpdateControlPauseState{}, s)
+	assert.False(t, c)
+
+	// Resuming wakes the pause state up and lets it continue.
+	assert.NoError(t, manager.Resume())
+	assert.False(t, manager.Paused())
+	assert.True(t, <-d.sctx.wakeupChan)
+	s, c = s.Handle(&d.sctx, ctrl)
+	assert.IsType(t, &UpdateFetchState{}, s)
+	assert.False(t, c)
+
+	downloaded, total := manager.Progress()
+	assert.Equal(t, int64(0), downloaded)
+	assert.Equal(t, int64(0), total)
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrBackoffExhausted is returned by the backoffs once the operation should
+// not be attempted again.
+var ErrBackoffExhausted = errors.New("Tried maximum amount of times")
+
+// Swapped in tests, to control the jitter and the elapsed time.
+var (
+	backoffRandom = rand.Float64
+	backoffNow    = time.Now
+)
+
+// BackoffPolicy is the schedule of the waits between the attempts of an
+// operation: the waits start at MinInterval, and double every
+// IntervalAttempts attempts, up to MaxInterval.
+type BackoffPolicy struct {
+	MinInterval time.Duration
+	// The waits are never longer than MaxInterval, unless it is shorter
+	// than MinInterval.
+	MaxInterval time.Duration
+	// How many attempts are made with every interval before doubling it;
+	// one if 0.
+	IntervalAttempts int
+	// Every wait is randomized by up to this fraction of it, both ways, so
+	// that the devices failing together do not retry together.
+	Jitter float64
+	// Give up after this many attempts; never if 0.
+	MaxAttempts int
+	// Give up once this long has passed since the first attempt; never if
+	// 0.
+	MaxElapsedTime time.Duration
+}
+
+// Interval returns the wait, without jitter, before the next attempt after
+// tried attempts, or ErrBackoffExhausted after MaxAttempts.
+func (p BackoffPolicy) Interval(tried int) (time.Duration, error) {
+	if p.MaxAttempts > 0 && tried >= p.MaxAttempts {
+		return 0, ErrBackoffExhausted
+	}
+	perInterval := p.IntervalAttempts
+	if perInterval <= 0 {
+		perInterval = 1
+	}
+
+	interval := p.MinInterval
+	for doublings := tried / perInterval; doublings > 0 && interval < p.MaxInterval; doublings-- {
+		interval *= 2
+	}
+	if interval > p.MaxInterval {
+		interval = p.MaxInterval
+	}
+	if interval < p.MinInterval {
+		interval = p.MinInterval
+	}
+	return interval, nil
+}
+
+// Backoff counts the attempts of an operation, and gives the waits between
+// them by its Policy. The zero Backoff, with the Policy set, is ready to use.
+type Backoff struct {
+	Policy BackoffPolicy
+
+	attempts int
+	start    time.Time
+}
+
+// NewBackoff returns a backoff with the policy.
+func NewBackoff(policy BackoffPolicy) *Backoff {
+	return &Backoff{Policy: policy}
+}
+
+// Next returns the wait before the next attempt, and counts it, or
+// ErrBackoffExhausted if the operation should be given up.
+func (b *Backoff) Next() (time.Duration, error) {
+	now := backoffNow()
+	if b.attempts == 0 {
+		b.start = now
+	} else if b.Policy.MaxElapsedTime > 0 && now.Sub(b.start) >= b.Policy.MaxElapsedTime {
+		return 0, ErrBackoffExhausted
+	}
+
+	interval, err := b.Policy.Interval(b.attempts)
+	if err != nil {
+		return 0, err
+	}
+	b.attempts++
+
+	if b.Policy.Jitter > 0 {
+		interval += time.Duration((2*backoffRandom() - 1) * b.Policy.Jitter * float64(interval))
+	}
+	return interval, nil
+}
+
+// Attempts returns how many attempts have been counted since the last
+// reset.
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Reset starts the schedule over, typically once the operation succeeds.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+	b.start = time.Time{}
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffPolicyInterval(t *testing.T) {
+	policy := BackoffPolicy{
+		MinInterval:      time.Second,
+		MaxInterval:      10 * time.Second,
+		IntervalAttempts: 2,
+		MaxAttempts:      12,
+	}
+	expected := []time.Duration{1, 1, 2, 2, 4, 4, 8, 8, 10, 10, 10, 10}
+	for tried, interval := range expected {
+		actual, err := policy.Interval(tried)
+		require.NoError(t, err)
+		assert.Equal(t, interval*time.Second, actual, "after %d attempts", tried)
+	}
+	_, err := policy.Interval(12)
+	assert.Equal(t, ErrBackoffExhausted, err)
+
+	// Never shorter than the smallest interval, and never given up without
+	// MaxAttempts.
+	policy = BackoffPolicy{MinInterval: time.Minute, MaxInterval: time.Second}
+	for _, tried := range []int{0, 1, 100} {
+		actual, err := policy.Interval(tried)
+		require.NoError(t, err)
+		assert.Equal(t, time.Minute, actual)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	now := time.Now()
+	random := 0.0
+	defer func() {
+		backoffNow = time.Now
+		backoffRandom = rand.Float64
+	}()
+	backoffNow = func() time.Time { return now }
+	backoffRandom = func() float64 { return random }
+
+	b := NewBackoff(BackoffPolicy{
+		MinInterval:    time.Second,
+		MaxInterval:    time.Minute,
+		Jitter:         0.5,
+		MaxElapsedTime: 10 * time.Second,
+	})
+
+	// The jitter is up to half the interval, both ways.
+	wait, err := b.Next()
+	require.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	random = 1.0
+	wait, err = b.Next()
+	require.NoError(t, err)
+	assert.Equal(t, 3*time.Second, wait)
+	random = 0.5
+	wait, err = b.Next()
+	require.NoError(t, err)
+	assert.Equal(t, 4*time.Second, wait)
+	assert.Equal(t, 3, b.Attempts())
+
+	// Given up once MaxElapsedTime has passed since the first attempt.
+	now = now.Add(10 * time.Second)
+	_, err = b.Next()
+	assert.Equal(t, ErrBackoffExhausted, err)
+
+	b.Reset()
+	assert.Equal(t, 0, b.Attempts())
+	wait, err = b.Next()
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, wait)
+
+	// The zero backoff works with the policy set, and MaxAttempts stops it.
+	var zero Backoff
+	zero.Policy = BackoffPolicy{MinInterval: time.Second, MaxAttempts: 1}
+	wait, err = zero.Next()
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, wait)
+	_, err = zero.Next()
+	assert.Equal(t, ErrBackoffExhausted, err)
+}
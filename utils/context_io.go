@@ -0,0 +1,102 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"io"
+)
+
+// The size of the buffer CopyContext copies through.
+const copyContextBufferSize = 32 * 1024
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// NewContextReader returns a reader which reads from r until ctx is done,
+// after which the reads fail with ctx.Err(). A read in progress is not
+// interrupted, so long copies through the reader stop at the next read.
+func NewContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+type contextReadCloser struct {
+	contextReader
+	c io.Closer
+}
+
+// NewContextReadCloser is NewContextReader for readers which are closed,
+// such as the artifact streams; Close closes rc, whether ctx is done or not.
+func NewContextReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	return &contextReadCloser{contextReader: contextReader{ctx: ctx, r: rc}, c: rc}
+}
+
+func (c *contextReadCloser) Close() error {
+	return c.c.Close()
+}
+
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+// NewContextWriter returns a writer which writes to w until ctx is done,
+// after which the writes fail with ctx.Err().
+func NewContextWriter(ctx context.Context, w io.Writer) io.Writer {
+	return &contextWriter{ctx: ctx, w: w}
+}
+
+func (c *contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// CopyContext copies from src to dst like io.Copy, until ctx is done, after
+// which it fails with ctx.Err(). It returns the number of bytes copied.
+func CopyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, copyContextBufferSize)
+	var n int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		m, rerr := src.Read(buf)
+		if m > 0 {
+			w, werr := dst.Write(buf[:m])
+			n += int64(w)
+			if werr != nil {
+				return n, werr
+			} else if w < m {
+				return n, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		} else if rerr != nil {
+			return n, rerr
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCloser struct {
+	io.Reader
+	closed bool
+}
+
+func (c *testCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewContextReader(ctx, strings.NewReader("mender"))
+	buf := make([]byte, 3)
+	n, err := r.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "men", string(buf[:n]))
+
+	cancel()
+	n, err = r.Read(buf)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, context.Canceled, err)
+
+	rc := &testCloser{Reader: strings.NewReader("mender")}
+	wrapped := NewContextReadCloser(ctx, rc)
+	_, err = ioutil.ReadAll(wrapped)
+	assert.Equal(t, context.Canceled, err)
+	assert.NoError(t, wrapped.Close())
+	assert.True(t, rc.closed)
+}
+
+func TestContextWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	buf := &bytes.Buffer{}
+	w := NewContextWriter(ctx, buf)
+	_, err := w.Write([]byte("mender"))
+	require.NoError(t, err)
+
+	cancel()
+	n, err := w.Write([]byte("client"))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, "mender", buf.String())
+}
+
+// cancellingReader cancels the context after the given number of reads.
+type cancellingReader struct {
+	io.Reader
+	reads  int
+	cancel context.CancelFunc
+}
+
+func (c *cancellingReader) Read(p []byte) (int, error) {
+	c.reads--
+	if c.reads == 0 {
+		c.cancel()
+	}
+	return c.Reader.Read(p)
+}
+
+func TestCopyContext(t *testing.T) {
+	data := bytes.Repeat([]byte("mender"), copyContextBufferSize)
+	buf := &bytes.Buffer{}
+	n, err := CopyContext(context.Background(), buf, bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, buf.Bytes())
+
+	// The copy stops at the next read once cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	buf.Reset()
+	src := &cancellingReader{Reader: bytes.NewReader(data), reads: 2, cancel: cancel}
+	n, err = CopyContext(ctx, buf, src)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, int64(2*copyContextBufferSize), n)
+	assert.Equal(t, data[:n], buf.Bytes())
+
+	n, err = CopyContext(context.Background(),
+		&testErrorWriter{Written: 10}, bytes.NewReader(data))
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, int64(10), n)
+}
@@ -19,33 +19,110 @@ import (
 	"syscall"
 )
 
+// LimitedWriter writes at most N bytes to W; writes beyond them fail with
+// ENOSPC, as writes beyond the end of a block device do, after writing what
+// fits.
 type LimitedWriter struct {
 	W io.Writer // underlying writer
 	N uint64    // number of bytes remaining
 }
 
+// The size of the buffer ReadFrom copies through, unless W is an
+// io.ReaderFrom.
+const limitedWriterBufferSize = 32 * 1024
+
 func (lw *LimitedWriter) Write(p []byte) (int, error) {
 	if lw.W == nil {
 		return 0, syscall.EBADF
 	}
-	var selferr error
 	toWrite := p
-
 	if uint64(len(p)) > lw.N {
 		// https://godoc.org/io#Writer Write writes len(p) bytes from p to the
 		// underlying data stream. It returns the number of bytes written from p (0
 		// <= n <= len(p)) and any error encountered that caused the write to stop
 		// early.
 		toWrite = p[:lw.N]
-		selferr = syscall.ENOSPC
 	}
 
 	w, err := lw.W.Write(toWrite)
-	if w != 0 {
-		lw.N -= uint64(w)
+	if w < 0 || w > len(toWrite) {
+		// The underlying writer is broken; nothing is known to have
+		// been written.
+		return 0, io.ErrShortWrite
+	}
+	lw.N -= uint64(w)
+	if err == nil && w < len(toWrite) {
+		err = io.ErrShortWrite
+	}
+	if err == nil && len(toWrite) < len(p) {
+		err = syscall.ENOSPC
+	}
+	return w, err
+}
+
+// ReadFrom writes what is read from r until EOF, failing with ENOSPC if it
+// does not fit, so that io.Copy to it does not go through an extra buffer if
+// W is an io.ReaderFrom. It returns the number of bytes written.
+func (lw *LimitedWriter) ReadFrom(r io.Reader) (int64, error) {
+	if lw.W == nil {
+		return 0, syscall.EBADF
 	}
-	if err != nil {
-		selferr = err
+
+	var n int64
+	var err error
+	if rf, ok := lw.W.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(io.LimitReader(r, int64(lw.N)))
+		if n < 0 || uint64(n) > lw.N {
+			return 0, io.ErrShortWrite
+		}
+		lw.N -= uint64(n)
+	} else {
+		n, err = lw.copyBuffered(r)
+	}
+	if err != nil || lw.N > 0 {
+		return n, err
+	}
+
+	// Whatever is left to read does not fit.
+	var probe [1]byte
+	for {
+		m, err := r.Read(probe[:])
+		if m > 0 {
+			return n, syscall.ENOSPC
+		} else if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+	}
+}
+
+func (lw *LimitedWriter) copyBuffered(r io.Reader) (int64, error) {
+	size := uint64(limitedWriterBufferSize)
+	if lw.N < size {
+		size = lw.N
+	}
+	buf := make([]byte, size)
+
+	var n int64
+	for lw.N > 0 {
+		chunk := buf
+		if uint64(len(chunk)) > lw.N {
+			chunk = chunk[:lw.N]
+		}
+		m, rerr := r.Read(chunk)
+		if m > 0 {
+			w, werr := lw.Write(chunk[:m])
+			n += int64(w)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		} else if rerr != nil {
+			return n, rerr
+		}
 	}
-	return w, selferr
+	return n, nil
 }
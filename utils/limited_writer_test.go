@@ -16,9 +16,11 @@ package utils
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"syscall"
 	"testing"
+	"testing/iotest"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -79,3 +81,118 @@ func TestLimitedWriter(t *testing.T) {
 	// and we should get an error from the error writer
 	assert.EqualError(t, err, "fail")
 }
+
+// shortWriter writes at most max bytes at a time, without an error.
+type shortWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > s.max {
+		p = p[:s.max]
+	}
+	return s.Buffer.Write(p)
+}
+
+func TestLimitedWriterShortWrite(t *testing.T) {
+	sw := &shortWriter{max: 2}
+	lw := LimitedWriter{sw, 10}
+	w, err := lw.Write([]byte("abcd"))
+	assert.Equal(t, 2, w)
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, uint64(8), lw.N)
+
+	// Short writes are reported as such, rather than as ENOSPC, even
+	// when the write would not fit.
+	lw = LimitedWriter{sw, 3}
+	w, err = lw.Write([]byte("abcd"))
+	assert.Equal(t, 2, w)
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, uint64(1), lw.N)
+
+	lw = LimitedWriter{&testErrorWriter{Written: 5}, 10}
+	w, err = lw.Write([]byte("foo"))
+	assert.Equal(t, 0, w)
+	assert.Equal(t, io.ErrShortWrite, err)
+	assert.Equal(t, uint64(10), lw.N)
+}
+
+func TestLimitedWriterENOSPCBoundaries(t *testing.T) {
+	for _, tc := range []struct {
+		limit   uint64
+		writes  []string
+		written string
+		errs    []error
+	}{
+		{limit: 0, writes: []string{""}, errs: []error{nil}},
+		{limit: 0, writes: []string{"a"}, errs: []error{syscall.ENOSPC}},
+		{limit: 3, writes: []string{"abc", ""}, written: "abc", errs: []error{nil, nil}},
+		{limit: 3, writes: []string{"abc", "d"}, written: "abc",
+			errs: []error{nil, syscall.ENOSPC}},
+		{limit: 3, writes: []string{"ab", "cd"}, written: "abc",
+			errs: []error{nil, syscall.ENOSPC}},
+		{limit: 3, writes: []string{"abcd", "e"}, written: "abc",
+			errs: []error{syscall.ENOSPC, syscall.ENOSPC}},
+	} {
+		b := &bytes.Buffer{}
+		lw := LimitedWriter{b, tc.limit}
+		for i, p := range tc.writes {
+			w, err := lw.Write([]byte(p))
+			assert.Equal(t, tc.errs[i], err, "limit %d, write %q", tc.limit, p)
+			if err == nil {
+				assert.Equal(t, len(p), w)
+			}
+		}
+		assert.Equal(t, tc.written, b.String())
+		assert.Equal(t, tc.limit-uint64(len(tc.written)), lw.N)
+	}
+}
+
+// writerOnly hides the io.ReaderFrom of bytes.Buffer.
+type writerOnly struct {
+	io.Writer
+}
+
+func TestLimitedWriterReadFrom(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+
+	for _, readerFrom := range []bool{true, false} {
+		for _, tc := range []struct {
+			limit uint64
+			err   error
+		}{
+			{limit: uint64(len(data)) + 1},
+			{limit: uint64(len(data))},
+			{limit: uint64(len(data)) - 1, err: syscall.ENOSPC},
+			{limit: 0, err: syscall.ENOSPC},
+		} {
+			b := &bytes.Buffer{}
+			var w io.Writer = b
+			if !readerFrom {
+				w = writerOnly{b}
+			}
+			lw := &LimitedWriter{w, tc.limit}
+			n, err := io.Copy(lw, bytes.NewReader(data))
+			assert.Equal(t, tc.err, err, "limit %d", tc.limit)
+
+			expected := data
+			if tc.limit < uint64(len(data)) {
+				expected = data[:tc.limit]
+			}
+			assert.Equal(t, int64(len(expected)), n)
+			assert.True(t, bytes.Equal(expected, b.Bytes()))
+		}
+	}
+
+	// The errors of the reader and the writer are returned.
+	lw := &LimitedWriter{ioutil.Discard, 100}
+	_, err := lw.ReadFrom(iotest.TimeoutReader(bytes.NewReader(data)))
+	assert.Equal(t, iotest.ErrTimeout, err)
+	lw = &LimitedWriter{&testErrorWriter{Err: errors.New("fail"), Written: 1}, 100}
+	n, err := lw.ReadFrom(bytes.NewReader(data))
+	assert.EqualError(t, err, "fail")
+	assert.Equal(t, int64(1), n)
+	_, err = (&LimitedWriter{N: 100}).ReadFrom(bytes.NewReader(data))
+	assert.Equal(t, syscall.EBADF, err)
+}
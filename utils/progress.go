@@ -28,9 +28,15 @@ type ProgressWriter struct {
 func (p *ProgressWriter) Write(data []byte) (int, error) {
 	n := len(data)
 
+	p.Add(n)
+	return n, nil
+}
+
+// Add advances the progress by n bytes, for progress which is not tracked by
+// writing the data itself.
+func (p *ProgressWriter) Add(n int) {
 	p.reportGeneric(n)
 	p.c += int64(n)
-	return n, nil
 }
 
 func (p *ProgressWriter) maybeWarn(then int64) {
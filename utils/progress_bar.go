@@ -0,0 +1,154 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// The width of the bar itself, between the brackets.
+	progressBarWidth = 30
+	// The bar is not redrawn more often than this.
+	progressBarRefresh = 200 * time.Millisecond
+)
+
+// Swapped in tests, to control the throughput.
+var progressNow = time.Now
+
+// ProgressBar shows the progress of a long operation, such as a standalone
+// install, to an interactive user: on a terminal a bar is redrawn in place,
+// with the bytes done, the percentage, the throughput and the time left;
+// otherwise the dots of ProgressWriter are written, which suit logs better.
+type ProgressBar struct {
+	out  io.Writer
+	size int64 // 0 if not known
+	tty  bool
+	dots *ProgressWriter
+
+	done     int64
+	start    time.Time
+	drawn    time.Time
+	finished bool
+}
+
+// NewProgressBar returns a progress bar of an operation of size bytes, or of
+// unknown size if 0, written to out.
+func NewProgressBar(out io.Writer, size int64) *ProgressBar {
+	return &ProgressBar{
+		out:   out,
+		size:  size,
+		tty:   isTerminal(out),
+		dots:  &ProgressWriter{Out: out, N: size},
+		start: progressNow(),
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && terminal.IsTerminal(int(f.Fd()))
+}
+
+func (p *ProgressBar) Write(data []byte) (int, error) {
+	p.Add(len(data))
+	return len(data), nil
+}
+
+// Add advances the progress by n bytes.
+func (p *ProgressBar) Add(n int) {
+	if !p.tty {
+		p.dots.Add(n)
+		return
+	}
+	p.done += int64(n)
+	now := progressNow()
+	if p.size != 0 && p.done >= p.size {
+		p.Finish()
+	} else if now.Sub(p.drawn) >= progressBarRefresh {
+		p.draw(now)
+	}
+}
+
+// Finish draws the bar a last time, and ends its line; it is needed only if
+// the size is not known, or the operation stops short of it.
+func (p *ProgressBar) Finish() {
+	if !p.tty || p.finished {
+		return
+	}
+	p.draw(progressNow())
+	p.out.Write([]byte("\n"))
+	p.finished = true
+}
+
+func (p *ProgressBar) draw(now time.Time) {
+	p.drawn = now
+	var rate float64
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		rate = float64(p.done) / elapsed
+	}
+
+	var line string
+	if p.size == 0 || p.done > p.size {
+		line = fmt.Sprintf("\r%s  %s/s", formatBytes(p.done), formatBytes(int64(rate)))
+	} else {
+		filled := int(progressBarWidth * p.done / p.size)
+		bar := strings.Repeat("=", filled)
+		if filled < progressBarWidth {
+			bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+		}
+		eta := "--:--"
+		if rate > 0 {
+			left := time.Duration(float64(p.size-p.done)/rate) * time.Second
+			eta = formatDuration(left)
+		}
+		line = fmt.Sprintf("\r[%s] %3d%%  %s/%s  %s/s  ETA %s", bar, 100*p.done/p.size,
+			formatBytes(p.done), formatBytes(p.size), formatBytes(int64(rate)), eta)
+	}
+	p.out.Write([]byte(line))
+}
+
+// formatBytes formats a size in the largest binary unit it reaches.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n) / unit
+	suffix := "KiB"
+	for _, s := range []string{"MiB", "GiB", "TiB"} {
+		if value < unit {
+			break
+		}
+		value /= unit
+		suffix = s
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
+
+// formatDuration formats a duration as minutes and seconds, with the hours
+// if any.
+func formatDuration(d time.Duration) string {
+	s := int64(d.Round(time.Second) / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%02d:%02d", s/60, s%60)
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressBar(t *testing.T) {
+	now := time.Now()
+	defer func() { progressNow = time.Now }()
+	progressNow = func() time.Time { return now }
+
+	b := &bytes.Buffer{}
+	p := NewProgressBar(b, 40*1024*1024)
+	p.tty = true
+
+	now = now.Add(time.Second)
+	p.Add(10 * 1024 * 1024)
+	assert.Equal(t, "\r[=======>                      ]  25%  10.0 MiB/40.0 MiB  10.0 MiB/s  ETA 00:03",
+		b.String())
+
+	// Not redrawn more often than progressBarRefresh.
+	b.Reset()
+	p.Add(1024)
+	assert.Empty(t, b.String())
+
+	b.Reset()
+	now = now.Add(3 * time.Second)
+	p.Write(make([]byte, 30*1024*1024-1024))
+	assert.Equal(t, "\r[==============================] 100%  40.0 MiB/40.0 MiB  10.0 MiB/s  ETA 00:00\n",
+		b.String())
+	b.Reset()
+	p.Finish()
+	assert.Empty(t, b.String())
+
+	// Of unknown size.
+	p = NewProgressBar(b, 0)
+	p.tty = true
+	now = now.Add(2 * time.Second)
+	p.Add(3 * 1024)
+	p.Finish()
+	assert.Equal(t, "\r3.0 KiB  1.5 KiB/s\r3.0 KiB  1.5 KiB/s\n", b.String())
+}
+
+func TestProgressBarNotTerminal(t *testing.T) {
+	b := &bytes.Buffer{}
+	p := NewProgressBar(b, 100)
+	assert.False(t, p.tty)
+	writeZeros(p, 100)
+	p.Finish()
+	assert.Equal(t, ".                                100% 100 B\n", b.String())
+}
+
+func TestFormatProgress(t *testing.T) {
+	assert.Equal(t, "1023 B", formatBytes(1023))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "2.0 GiB", formatBytes(2*1024*1024*1024))
+	assert.Equal(t, "00:59", formatDuration(59*time.Second))
+	assert.Equal(t, "1:01:01", formatDuration(time.Hour+61*time.Second))
+	assert.Equal(t, "5.0 TiB", formatBytes(5*1024*1024*1024*1024))
+}
@@ -27,6 +27,17 @@ func writeZeros(out io.Writer, cnt int64) {
 	}
 }
 
+func TestProgressAdd(t *testing.T) {
+	b := &bytes.Buffer{}
+	p := &ProgressWriter{
+		Out: b,
+		N:   1024 * 800,
+	}
+	p.Add(1024 * 400)
+	p.Add(1024 * 400)
+	assert.Equal(t, ".........................        100% 800 KiB\n", b.String())
+}
+
 func TestProgress(t *testing.T) {
 	b := &bytes.Buffer{}
 	p := &ProgressWriter{
@@ -0,0 +1,145 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/log"
+)
+
+// systemdWatchdog pets the watchdog of the systemd service running the
+// daemon, so that systemd restarts the daemon if its state machine hangs
+// between states. While a state executes, the watchdog is kept alive; the
+// operations which may block in a state, such as state scripts, update
+// modules and network requests, are bounded by their own timeouts.
+type systemdWatchdog struct {
+	socket   string
+	interval time.Duration
+	// Time of the last pet, in nanoseconds since the epoch.
+	lastPet int64
+}
+
+// newSystemdWatchdog returns the watchdog of the service set up by systemd
+// in the environment of the daemon, or nil if there is none.
+func newSystemdWatchdog() *systemdWatchdog {
+	socket := systemdNotifySocket()
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if socket == "" || err != nil || usec <= 0 {
+		return nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+
+	interval := time.Duration(usec) * time.Microsecond
+	log.Infof("Petting the systemd watchdog, which expires after %v", interval)
+	return &systemdWatchdog{
+		socket:   socket,
+		interval: interval,
+	}
+}
+
+// petInterval is the interval the watchdog is to be pet at, at the latest;
+// 0 for a nil watchdog.
+func (w *systemdWatchdog) petInterval() time.Duration {
+	if w == nil {
+		return 0
+	}
+	return w.interval / 2
+}
+
+// pet tells systemd that the daemon is alive. It does nothing if the watchdog
+// has been pet recently, so that it can be called from hot loops.
+func (w *systemdWatchdog) pet() {
+	if w == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&w.lastPet)
+	if time.Duration(now-last) < w.interval/4 ||
+		!atomic.CompareAndSwapInt64(&w.lastPet, last, now) {
+		return
+	}
+
+	if err := notifySystemd(w.socket, "WATCHDOG=1"); err != nil {
+		log.Errorf("Failed to pet the systemd watchdog: %v", err)
+	}
+}
+
+// keepAlive pets the watchdog every petInterval, until the returned function
+// is called.
+func (w *systemdWatchdog) keepAlive() func() {
+	if w == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(w.petInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.pet()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// systemdNotifySocket returns the notification socket of the systemd service
+// running the daemon, or "" if there is none.
+func systemdNotifySocket() string {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if strings.HasPrefix(socket, "@") {
+		// abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	return socket
+}
+
+// notifySystemdReady tells systemd that the daemon has started, as the
+// service is of Type=notify.
+func notifySystemdReady() {
+	socket := systemdNotifySocket()
+	if socket == "" {
+		return
+	}
+	if err := notifySystemd(socket, "READY=1"); err != nil {
+		log.Errorf("Failed to notify systemd that the daemon is ready: %v", err)
+	}
+}
+
+func notifySystemd(socket, state string) error {
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setWatchdogEnv(t *testing.T, socket, usec, pid string) func() {
+	vars := map[string]string{
+		"NOTIFY_SOCKET": socket,
+		"WATCHDOG_USEC": usec,
+		"WATCHDOG_PID":  pid,
+	}
+	old := map[string]string{}
+	for name, value := range vars {
+		old[name] = os.Getenv(name)
+		require.NoError(t, os.Setenv(name, value))
+	}
+	return func() {
+		for name, value := range old {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+func TestNewSystemdWatchdog(t *testing.T) {
+	restore := setWatchdogEnv(t, "", "", "")
+	defer restore()
+	assert.Nil(t, newSystemdWatchdog())
+
+	setWatchdogEnv(t, "/run/notify", "", "")
+	assert.Nil(t, newSystemdWatchdog())
+
+	setWatchdogEnv(t, "/run/notify", "20000000", "1")
+	assert.Nil(t, newSystemdWatchdog())
+
+	setWatchdogEnv(t, "/run/notify", "20000000", strconv.Itoa(os.Getpid()))
+	w := newSystemdWatchdog()
+	require.NotNil(t, w)
+	assert.Equal(t, "/run/notify", w.socket)
+	assert.Equal(t, 10*time.Second, w.petInterval())
+
+	setWatchdogEnv(t, "@notify", "20000000", "")
+	w = newSystemdWatchdog()
+	require.NotNil(t, w)
+	assert.Equal(t, "\x00notify", w.socket)
+
+	// a nil watchdog is never pet
+	w = nil
+	assert.Equal(t, time.Duration(0), w.petInterval())
+	w.pet()
+}
+
+func TestSystemdWatchdogPet(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "watchdog")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	socket := path.Join(tdir, "notify")
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	w := &systemdWatchdog{socket: socket, interval: 40 * time.Millisecond}
+	w.pet()
+	// pet too soon after the last one
+	w.pet()
+	time.Sleep(15 * time.Millisecond)
+	w.pet()
+
+	buf := make([]byte, 64)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "WATCHDOG=1", string(buf[:n]))
+	}
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = conn.Read(buf)
+	assert.Error(t, err)
+
+	// kept alive while a state executes
+	stop := w.keepAlive()
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "WATCHDOG=1", string(buf[:n]))
+
+	// and no longer once it is stopped
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		if _, err = conn.Read(buf); err != nil {
+			break
+		}
+	}
+
+	// a nil watchdog is never kept alive
+	w = nil
+	w.keepAlive()()
+}
+
+func TestNotifySystemdReady(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "watchdog")
+	require.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	socket := path.Join(tdir, "notify")
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	restore := setWatchdogEnv(t, "", "", "")
+	defer restore()
+	notifySystemdReady()
+
+	setWatchdogEnv(t, socket, "", "")
+	notifySystemdReady()
+	buf := make([]byte, 64)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "READY=1", string(buf[:n]))
+}
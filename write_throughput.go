@@ -0,0 +1,100 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/mendersoftware/log"
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/pkg/errors"
+)
+
+// Writes smaller than this are over too quickly for their throughput to say
+// anything about the health of the storage.
+const minWriteThroughputSampleBytes = 16 * 1024 * 1024
+
+// writeThroughput is the write throughput measured when the last update was
+// written to the inactive partition.
+type writeThroughput struct {
+	KiBps    int64
+	Degraded bool
+}
+
+// RecordWriteThroughput stores the write throughput of an update, flagging it
+// as degraded if it is lower than the configured minimum.
+func (d *deviceManager) RecordWriteThroughput(t installer.WriteThroughput) {
+	if t.Bytes < minWriteThroughputSampleBytes {
+		log.Debugf("Wrote %d bytes in %s; too little to judge the write throughput",
+			t.Bytes, t.Duration)
+		return
+	}
+
+	wt := writeThroughput{KiBps: t.BytesPerSecond() / 1024}
+	min := int64(d.config.WriteThroughputMinKiBps)
+	if min > 0 && wt.KiBps < min {
+		wt.Degraded = true
+		log.Warnf("Write throughput of %d KiB/s is below the expected minimum of %d KiB/s; "+
+			"the storage of the device may be failing", wt.KiBps, min)
+	} else {
+		log.Infof("Write throughput: %d KiB/s", wt.KiBps)
+	}
+
+	if d.store == nil {
+		return
+	}
+	data, err := json.Marshal(&wt)
+	if err == nil {
+		err = d.store.WriteAll(datastore.WriteThroughputKey, data)
+	}
+	if err != nil {
+		log.Errorf("Could not store the write throughput: %v", err)
+	}
+}
+
+func (d *deviceManager) loadWriteThroughput() (*writeThroughput, error) {
+	if d.store == nil {
+		return nil, nil
+	}
+	data, err := d.store.ReadAll(datastore.WriteThroughputKey)
+	if err == os.ErrNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	wt := &writeThroughput{}
+	if err = json.Unmarshal(data, wt); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the write throughput")
+	}
+	return wt, nil
+}
+
+// writeThroughputAttributes returns the inventory attributes of the last
+// measured write throughput, if any.
+func (d *deviceManager) writeThroughputAttributes() []client.InventoryAttribute {
+	wt, err := d.loadWriteThroughput()
+	if err != nil {
+		log.Errorf("Could not read the write throughput: %v", err)
+		return nil
+	} else if wt == nil {
+		return nil
+	}
+	return []client.InventoryAttribute{
+		{Name: "write_throughput_kibps", Value: wt.KiBps},
+		{Name: "write_throughput_degraded", Value: wt.Degraded},
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/mender/client"
+	"github.com/mendersoftware/mender/datastore"
+	"github.com/mendersoftware/mender/installer"
+	"github.com/mendersoftware/mender/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordWriteThroughput(t *testing.T) {
+	ms := store.NewMemStore()
+	config := &menderConfig{
+		menderConfigFromFile: menderConfigFromFile{
+			WriteThroughputMinKiBps: 10 * 1024,
+		},
+	}
+	d := NewDeviceManager(nil, config, ms)
+	assert.Nil(t, d.writeThroughputAttributes())
+
+	// Too small to judge.
+	d.RecordWriteThroughput(installer.WriteThroughput{
+		Bytes:    1024,
+		Duration: time.Second,
+	})
+	assert.Nil(t, d.writeThroughputAttributes())
+
+	d.RecordWriteThroughput(installer.WriteThroughput{
+		Bytes:    64 * 1024 * 1024,
+		Duration: 4 * time.Second,
+	})
+	assert.Equal(t, []client.InventoryAttribute{
+		{Name: "write_throughput_kibps", Value: int64(16 * 1024)},
+		{Name: "write_throughput_degraded", Value: false},
+	}, d.writeThroughputAttributes())
+
+	d.RecordWriteThroughput(installer.WriteThroughput{
+		Bytes:    64 * 1024 * 1024,
+		Duration: 16 * time.Second,
+	})
+	assert.Equal(t, []client.InventoryAttribute{
+		{Name: "write_throughput_kibps", Value: int64(4 * 1024)},
+		{Name: "write_throughput_degraded", Value: true},
+	}, d.writeThroughputAttributes())
+
+	// Never degraded without a minimum.
+	d.config.WriteThroughputMinKiBps = 0
+	d.RecordWriteThroughput(installer.WriteThroughput{
+		Bytes:    64 * 1024 * 1024,
+		Duration: 16 * time.Second,
+	})
+	assert.Equal(t, []client.InventoryAttribute{
+		{Name: "write_throughput_kibps", Value: int64(4 * 1024)},
+		{Name: "write_throughput_degraded", Value: false},
+	}, d.writeThroughputAttributes())
+
+	ms.WriteAll(datastore.WriteThroughputKey, []byte("garbage"))
+	assert.Nil(t, d.writeThroughputAttributes())
+}